@@ -0,0 +1,335 @@
+// Package auth implements SASL mechanisms for SMTP authentication, both for
+// the relay to authenticate to upstreams, as net/smtp.Auth, and for smtpd to
+// authenticate clients.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// SCRAMSHA256 is the name of the SCRAM-SHA-256 mechanism (RFC 7677)
+const SCRAMSHA256 = "SCRAM-SHA-256"
+
+// SCRAMIterations is the iteration count used by NewSCRAMCredentials, the
+// minimum recommended by RFC 7677
+const SCRAMIterations = 4096
+
+// gs2Header is the GS2 header of SCRAM messages without channel binding
+const gs2Header = "n,,"
+
+var (
+	// ErrSCRAMInvalidProof is returned by SCRAMServer.Next when the client
+	// doesn't know the password
+	ErrSCRAMInvalidProof = errors.New("scram: invalid client proof")
+
+	// ErrSCRAMMalformed is returned when a SCRAM message can't be parsed
+	ErrSCRAMMalformed = errors.New("scram: malformed message")
+)
+
+// SCRAMCredentials are the credentials stored by servers for SCRAM
+// authentication, from which the password can't be recovered
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSCRAMCredentials derives the SCRAM credentials of the password, with a
+// random salt
+func NewSCRAMCredentials(password string) (SCRAMCredentials, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return SCRAMCredentials{}, err
+	}
+
+	clientKey, serverKey := scramKeys(password, salt, SCRAMIterations)
+	storedKey := sha256.Sum256(clientKey)
+
+	return SCRAMCredentials{
+		Salt:       salt,
+		Iterations: SCRAMIterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  serverKey,
+	}, nil
+}
+
+// scramKeys returns the client and server keys of the password
+func scramKeys(password string, salt []byte, iterations int) (clientKey, serverKey []byte) {
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+
+	return hmacSHA256(salted, "Client Key"), hmacSHA256(salted, "Server Key")
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+
+	return mac.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+
+	return out
+}
+
+// scramNonce returns a random printable nonce
+func scramNonce() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+// escapeSASLName escapes "," and "=" in usernames (RFC 5801). Usernames
+// aren't normalized with SASLprep, so non-ASCII usernames must be sent
+// normalized.
+func escapeSASLName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+func unescapeSASLName(name string) (string, error) {
+	if strings.Count(name, "=") != strings.Count(name, "=3D")+strings.Count(name, "=2C") {
+		return "", ErrSCRAMMalformed
+	}
+
+	return strings.NewReplacer("=3D", "=", "=2C", ",").Replace(name), nil
+}
+
+// parseSCRAM parses the attributes of a SCRAM message, e.g. "r=...,s=..."
+func parseSCRAM(msg string) (map[byte]string, error) {
+	attrs := map[byte]string{}
+
+	for _, field := range strings.Split(msg, ",") {
+		if len(field) < 2 || field[1] != '=' {
+			return nil, ErrSCRAMMalformed
+		}
+
+		attrs[field[0]] = field[2:]
+	}
+
+	return attrs, nil
+}
+
+type scramClient struct {
+	username string
+	password string
+
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+	verified        bool
+}
+
+// SCRAMSHA256Auth returns an smtp.Auth implementing SCRAM-SHA-256: the
+// password isn't sent to the server, and the server proves it knows the
+// credentials too. Unlike smtp.PlainAuth, it can be used without TLS.
+func SCRAMSHA256Auth(username, password string) smtp.Auth {
+	return &scramClient{username: username, password: password}
+}
+
+func (c *scramClient) Start(_ *smtp.ServerInfo) (string, []byte, error) {
+	nonce, err := scramNonce()
+	if err != nil {
+		return "", nil, err
+	}
+
+	c.nonce = nonce
+	c.clientFirstBare = "n=" + escapeSASLName(c.username) + ",r=" + nonce
+
+	return SCRAMSHA256, []byte(gs2Header + c.clientFirstBare), nil
+}
+
+func (c *scramClient) Next(fromServer []byte, more bool) ([]byte, error) {
+	switch {
+	case !more && c.verified:
+		return nil, nil
+	case !more:
+		return nil, errors.New("scram: server signature not received")
+	case c.serverSignature == nil:
+		return c.clientFinal(string(fromServer))
+	default:
+		return c.verify(string(fromServer))
+	}
+}
+
+// clientFinal answers the server-first message with the client proof
+func (c *scramClient) clientFinal(serverFirst string) ([]byte, error) {
+	attrs, err := parseSCRAM(serverFirst)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return nil, errors.New("scram: invalid server nonce")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil || len(salt) == 0 {
+		return nil, ErrSCRAMMalformed
+	}
+
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil || iterations <= 0 {
+		return nil, ErrSCRAMMalformed
+	}
+
+	clientKey, serverKey := scramKeys(c.password, salt, iterations)
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(gs2Header)) + ",r=" + nonce
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + withoutProof
+
+	proof := xor(clientKey, hmacSHA256(storedKey[:], authMessage))
+	c.serverSignature = hmacSHA256(serverKey, authMessage)
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks the server signature of the server-final message
+func (c *scramClient) verify(serverFinal string) ([]byte, error) {
+	attrs, err := parseSCRAM(serverFinal)
+	if err != nil {
+		return nil, err
+	}
+
+	if e, ok := attrs['e']; ok {
+		return nil, fmt.Errorf("scram: server error: %s", e)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil || !hmac.Equal(signature, c.serverSignature) {
+		return nil, errors.New("scram: invalid server signature")
+	}
+
+	c.verified = true
+
+	return []byte{}, nil
+}
+
+// SCRAMServer is the server side of a SCRAM-SHA-256 exchange
+type SCRAMServer struct {
+	lookup func(username string) (SCRAMCredentials, error)
+
+	username        string
+	creds           SCRAMCredentials
+	nonce           string
+	clientFirstBare string
+	serverFirst     string
+}
+
+// NewSCRAMServer starts a SCRAM-SHA-256 exchange, lookup returns the stored
+// credentials of the user
+func NewSCRAMServer(lookup func(username string) (SCRAMCredentials, error)) *SCRAMServer {
+	return &SCRAMServer{lookup: lookup}
+}
+
+// Next processes the response of the client, and returns the next challenge.
+// done is set with the server-final message, which must be sent to the
+// client before completing the authentication. Errors of lookup are returned
+// as-is.
+func (s *SCRAMServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if s.serverFirst == "" {
+		challenge, err = s.serverFirstMessage(string(response))
+		return challenge, false, err
+	}
+
+	challenge, err = s.serverFinal(string(response))
+
+	return challenge, err == nil, err
+}
+
+// Username returns the username sent by the client
+func (s *SCRAMServer) Username() string {
+	return s.username
+}
+
+func (s *SCRAMServer) serverFirstMessage(clientFirst string) ([]byte, error) {
+	// channel binding isn't supported
+	bare, ok := strings.CutPrefix(clientFirst, gs2Header)
+	if !ok {
+		bare, ok = strings.CutPrefix(clientFirst, "y,,")
+	}
+
+	if !ok {
+		return nil, ErrSCRAMMalformed
+	}
+
+	attrs, err := parseSCRAM(bare)
+	if err != nil || attrs['n'] == "" || attrs['r'] == "" {
+		return nil, ErrSCRAMMalformed
+	}
+
+	if s.username, err = unescapeSASLName(attrs['n']); err != nil {
+		return nil, err
+	}
+
+	if s.creds, err = s.lookup(s.username); err != nil {
+		return nil, err
+	}
+
+	nonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	s.nonce = attrs['r'] + nonce
+	s.clientFirstBare = bare
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d",
+		s.nonce, base64.StdEncoding.EncodeToString(s.creds.Salt), s.creds.Iterations)
+
+	return []byte(s.serverFirst), nil
+}
+
+func (s *SCRAMServer) serverFinal(clientFinal string) ([]byte, error) {
+	withoutProof, proof64, ok := strings.Cut(clientFinal, ",p=")
+	if !ok {
+		return nil, ErrSCRAMMalformed
+	}
+
+	attrs, err := parseSCRAM(withoutProof)
+	if err != nil {
+		return nil, err
+	}
+
+	if attrs['r'] != s.nonce {
+		return nil, ErrSCRAMInvalidProof
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(proof64)
+	if err != nil || len(proof) != sha256.Size {
+		return nil, ErrSCRAMMalformed
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+
+	// the client key is recovered from the proof, and must hash to the
+	// stored key
+	clientKey := xor(proof, hmacSHA256(s.creds.StoredKey, authMessage))
+	storedKey := sha256.Sum256(clientKey)
+
+	if !hmac.Equal(storedKey[:], s.creds.StoredKey) {
+		return nil, ErrSCRAMInvalidProof
+	}
+
+	signature := hmacSHA256(s.creds.ServerKey, authMessage)
+
+	return []byte("v=" + base64.StdEncoding.EncodeToString(signature)), nil
+}
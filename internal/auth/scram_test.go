@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSCRAMClientRFC7677(t *testing.T) {
+	t.Parallel()
+
+	// example exchange of RFC 7677, section 3
+	c := &scramClient{
+		username:        "user",
+		password:        "pencil",
+		nonce:           "rOprNGfwEbeRWgbNEkqO",
+		clientFirstBare: "n=user,r=rOprNGfwEbeRWgbNEkqO",
+	}
+
+	resp, err := c.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true)
+	require.NoError(t, err)
+	assert.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", string(resp))
+
+	_, err = c.Next([]byte("v=AAAA"), true)
+	require.Error(t, err)
+
+	resp, err = c.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="), true)
+	require.NoError(t, err)
+	assert.Empty(t, resp)
+
+	_, err = c.Next([]byte("OK"), false)
+	require.NoError(t, err)
+}
+
+func TestSCRAMClientErrors(t *testing.T) {
+	t.Parallel()
+
+	c := SCRAMSHA256Auth("user", "pencil")
+
+	_, _, err := c.Start(nil)
+	require.NoError(t, err)
+
+	// the server nonce must extend the client one
+	_, err = c.Next([]byte("r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true)
+	require.Error(t, err)
+
+	_, err = c.Next([]byte("garbage"), true)
+	require.ErrorIs(t, err, ErrSCRAMMalformed)
+
+	// success without server signature
+	_, err = c.Next(nil, false)
+	require.Error(t, err)
+}
+
+func TestSCRAMExchange(t *testing.T) {
+	t.Parallel()
+
+	creds, err := NewSCRAMCredentials("pencil")
+	require.NoError(t, err)
+	assert.Len(t, creds.StoredKey, sha256.Size)
+
+	lookup := func(username string) (SCRAMCredentials, error) {
+		assert.Equal(t, "us,er=", username)
+		return creds, nil
+	}
+
+	exchange := func(password string) (*SCRAMServer, error) {
+		client := SCRAMSHA256Auth("us,er=", password)
+		server := NewSCRAMServer(lookup)
+
+		_, resp, err := client.Start(nil)
+		require.NoError(t, err)
+
+		for {
+			challenge, done, err := server.Next(resp)
+			if err != nil {
+				return server, err
+			}
+
+			resp, err = client.Next(challenge, true)
+			require.NoError(t, err)
+
+			if done {
+				return server, nil
+			}
+		}
+	}
+
+	server, err := exchange("pencil")
+	require.NoError(t, err)
+	assert.Equal(t, "us,er=", server.Username())
+
+	_, err = exchange("wrong")
+	require.ErrorIs(t, err, ErrSCRAMInvalidProof)
+}
+
+func TestSCRAMServerMalformed(t *testing.T) {
+	t.Parallel()
+
+	server := NewSCRAMServer(func(string) (SCRAMCredentials, error) {
+		return SCRAMCredentials{Salt: []byte("salt"), Iterations: 4096}, nil
+	})
+
+	// channel binding isn't supported
+	_, _, err := server.Next([]byte("p=tls-unique,,n=user,r=abc"))
+	require.ErrorIs(t, err, ErrSCRAMMalformed)
+
+	challenge, done, err := server.Next([]byte("n,,n=user,r=abc"))
+	require.NoError(t, err)
+	assert.False(t, done)
+	assert.Contains(t, string(challenge), "s="+base64.StdEncoding.EncodeToString([]byte("salt"))+",i=4096")
+
+	_, _, err = server.Next([]byte("c=biws,r=abc"))
+	require.ErrorIs(t, err, ErrSCRAMMalformed)
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/smtp"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// XOAUTH2 is the name of the XOAUTH2 mechanism, used by Google and Microsoft
+const XOAUTH2 = "XOAUTH2"
+
+type xoauth2Client struct {
+	username string
+	tokens   oauth2.TokenSource
+}
+
+// XOAuth2Auth returns an smtp.Auth implementing XOAUTH2, authenticating as
+// username with the access tokens of the token source. Like smtp.PlainAuth,
+// it refuses to send the token unless the connection is encrypted or to
+// localhost.
+func XOAuth2Auth(username string, tokens oauth2.TokenSource) smtp.Auth {
+	return &xoauth2Client{username: username, tokens: tokens}
+}
+
+func (c *xoauth2Client) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	token, err := c.tokens.Token()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return XOAUTH2, []byte("user=" + c.username + "\x01auth=Bearer " + token.AccessToken + "\x01\x01"), nil
+}
+
+func (c *xoauth2Client) Next(_ []byte, more bool) ([]byte, error) {
+	// the server sends the details of the failure as a challenge, the empty
+	// response gets the final error reply
+	if more {
+		return []byte{}, nil
+	}
+
+	return nil, nil
+}
+
+// OAUTHBEARER is the name of the standard OAUTHBEARER mechanism (RFC 7628)
+const OAUTHBEARER = "OAUTHBEARER"
+
+type oauthBearerClient struct {
+	username string
+	tokens   oauth2.TokenSource
+}
+
+// OAuthBearerAuth returns an smtp.Auth implementing OAUTHBEARER, the standard
+// equivalent of XOAUTH2, for upstreams which don't support the latter
+func OAuthBearerAuth(username string, tokens oauth2.TokenSource) smtp.Auth {
+	return &oauthBearerClient{username: username, tokens: tokens}
+}
+
+func (c *oauthBearerClient) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	token, err := c.tokens.Token()
+	if err != nil {
+		return "", nil, err
+	}
+
+	resp := "n,a=" + escapeSASLName(c.username) + ",\x01host=" + server.Name +
+		"\x01auth=Bearer " + token.AccessToken + "\x01\x01"
+
+	return OAUTHBEARER, []byte(resp), nil
+}
+
+func (c *oauthBearerClient) Next(_ []byte, more bool) ([]byte, error) {
+	// the server sends the details of the failure as a challenge, which must
+	// be answered with a single separator to get the final error reply
+	if more {
+		return []byte{0x01}, nil
+	}
+
+	return nil, nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// TokenSource caches the access tokens of an OAuth2 flow until they expire,
+// or until they're rejected by the server, see Invalidate
+type TokenSource struct {
+	fetch func(ctx context.Context) (*oauth2.Token, error)
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+// ClientCredentials returns a TokenSource using the client credentials flow,
+// e.g. for Microsoft 365 applications allowed to send as any mailbox
+func ClientCredentials(conf *clientcredentials.Config) *TokenSource {
+	return &TokenSource{fetch: conf.Token}
+}
+
+// RefreshToken returns a TokenSource getting access tokens with a refresh
+// token, e.g. for Google accounts. Refresh tokens rotated by the server are
+// used for the following refreshes.
+func RefreshToken(conf *oauth2.Config, refreshToken string) *TokenSource {
+	ts := &TokenSource{}
+
+	ts.fetch = func(ctx context.Context) (*oauth2.Token, error) {
+		// the token has no access token, so it's always refreshed
+		token, err := conf.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+		if err != nil {
+			return nil, err
+		}
+
+		if token.RefreshToken != "" {
+			refreshToken = token.RefreshToken
+		}
+
+		return token, nil
+	}
+
+	return ts
+}
+
+// Token returns the cached access token, or a new one if it expired
+func (ts *TokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token.Valid() {
+		return ts.token, nil
+	}
+
+	token, err := ts.fetch(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	ts.token = token
+
+	return token, nil
+}
+
+// Invalidate drops the cached access token, as it was rejected, so the next
+// call to Token gets a new one
+func (ts *TokenSource) Invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.token = nil
+}
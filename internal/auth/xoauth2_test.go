@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// startTokenServer returns the URL of a token endpoint issuing numbered access
+// tokens, and the number of tokens issued
+func startTokenServer(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+
+	issued := &atomic.Int32{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+
+		n := issued.Add(1)
+
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Form.Get("grant_type") {
+		case "refresh_token":
+			// refresh tokens are rotated
+			assert.Equal(t, fmt.Sprintf("refresh-%d", n-1), r.Form.Get("refresh_token"))
+			_, _ = fmt.Fprintf(w, `{"access_token":"token-%d","refresh_token":"refresh-%d","expires_in":3600}`, n, n)
+		default:
+			assert.Equal(t, "client_credentials", r.Form.Get("grant_type"))
+			_, _ = fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3600}`, n)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL, issued
+}
+
+func TestXOAuth2Auth(t *testing.T) {
+	t.Parallel()
+
+	a := XOAuth2Auth("bob@example.com", oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}))
+
+	mech, resp, err := a.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+	require.NoError(t, err)
+	assert.Equal(t, "XOAUTH2", mech)
+	assert.Equal(t, "user=bob@example.com\x01auth=Bearer token\x01\x01", string(resp))
+
+	// error details
+	resp, err = a.Next([]byte(`{"status":"401"}`), true)
+	require.NoError(t, err)
+	assert.Empty(t, resp)
+
+	_, _, err = a.Start(&smtp.ServerInfo{Name: "smtp.example.com"})
+	require.Error(t, err)
+
+	_, _, err = a.Start(&smtp.ServerInfo{Name: "localhost"})
+	require.NoError(t, err)
+}
+
+func TestOAuthBearerAuth(t *testing.T) {
+	t.Parallel()
+
+	a := OAuthBearerAuth("bob,x@example.com", oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}))
+
+	mech, resp, err := a.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+	require.NoError(t, err)
+	assert.Equal(t, "OAUTHBEARER", mech)
+	assert.Equal(t, "n,a=bob=2Cx@example.com,\x01host=smtp.example.com\x01auth=Bearer token\x01\x01", string(resp))
+
+	// error details
+	resp, err = a.Next([]byte(`{"status":"invalid_token"}`), true)
+	require.NoError(t, err)
+	assert.Equal(t, "\x01", string(resp))
+
+	_, _, err = a.Start(&smtp.ServerInfo{Name: "smtp.example.com"})
+	require.Error(t, err)
+}
+
+func TestClientCredentials(t *testing.T) {
+	t.Parallel()
+
+	url, issued := startTokenServer(t)
+
+	ts := ClientCredentials(&clientcredentials.Config{ClientID: "id", ClientSecret: "secret", TokenURL: url})
+
+	token, err := ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token.AccessToken)
+
+	// cached until it expires
+	token, err = ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token.AccessToken)
+
+	ts.Invalidate()
+
+	token, err = ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token.AccessToken)
+	assert.Equal(t, int32(2), issued.Load())
+}
+
+func TestRefreshToken(t *testing.T) {
+	t.Parallel()
+
+	url, issued := startTokenServer(t)
+
+	ts := RefreshToken(&oauth2.Config{ClientID: "id", Endpoint: oauth2.Endpoint{TokenURL: url}}, "refresh-0")
+
+	token, err := ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token.AccessToken)
+
+	ts.Invalidate()
+
+	// refreshed with the rotated refresh token
+	token, err = ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token.AccessToken)
+	assert.Equal(t, int32(2), issued.Load())
+}
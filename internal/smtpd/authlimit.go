@@ -0,0 +1,232 @@
+package smtpd
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of AUTH lockouts, see AuthLimiter.OnLockout
+const (
+	AuthLockIP       = "ip"       // of the client IP
+	AuthLockUsername = "username" // of the username, from any IP
+)
+
+// AuthLimiter limits the failed AUTH attempts of each client IP and of each
+// username, to blunt credential stuffing. The replies to the failures are
+// delayed, doubling with each failure of the IP or username, and after
+// MaxFailures of them the IP or the username is locked: its AUTH commands
+// are refused with ErrAuthLocked, which ends the session. Share it between
+// servers to count the failures on all of them together.
+type AuthLimiter struct {
+	MaxFailures int           // Failures after which the IP or username is locked
+	Delay       time.Duration // Delay of the reply to the first failure (default: 1s)
+	MaxDelay    time.Duration // Max delay of the replies to the failures (default: 30s)
+
+	// How long the IP or username is locked. The failures are also
+	// forgotten this long after the last one. (default: 15m)
+	Lockout time.Duration
+
+	// Called when a client IP or a username gets locked, with the kind of
+	// lockout, AuthLockIP or AuthLockUsername, and the IP or the username.
+	// (default: none)
+	OnLockout func(ctx context.Context, peer Peer, kind, key string)
+
+	mu       sync.Mutex
+	failures map[string]*authFailures // by kind and key
+}
+
+// authFailures are the recent failed AUTH attempts of an IP or a username
+type authFailures struct {
+	count  int
+	last   time.Time
+	locked time.Time // until when, zero if it isn't
+}
+
+func (l *AuthLimiter) lockout() time.Duration {
+	return cmp.Or(l.Lockout, 15*time.Minute)
+}
+
+// locked returns the kind of lockout of the IP or the username, or an empty
+// string if neither is locked. The username is only checked when set.
+func (l *AuthLimiter) locked(ip, username string) string {
+	if l == nil {
+		return ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	if f := l.failures[AuthLockIP+":"+ip]; f != nil && now.Before(f.locked) {
+		return AuthLockIP
+	}
+
+	if username == "" {
+		return ""
+	}
+
+	if f := l.failures[AuthLockUsername+":"+strings.ToLower(username)]; f != nil && now.Before(f.locked) {
+		return AuthLockUsername
+	}
+
+	return ""
+}
+
+// failed records a failed attempt of the IP for the username, and returns the
+// delay of its reply, and the kinds of lockouts it led to
+func (l *AuthLimiter) failed(ip, username string) (time.Duration, []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	lockout := l.lockout()
+
+	if l.failures == nil {
+		l.failures = map[string]*authFailures{}
+	}
+
+	// forget the failures past the lockout, the other ones are kept until
+	// then
+	for key, f := range l.failures {
+		if now.Sub(f.last) > lockout && !now.Before(f.locked) {
+			delete(l.failures, key)
+		}
+	}
+
+	keys := [][2]string{{AuthLockIP, ip}}
+	if username != "" {
+		keys = append(keys, [2]string{AuthLockUsername, strings.ToLower(username)})
+	}
+
+	var count int
+	var locks []string
+
+	for _, k := range keys {
+		kind, key := k[0], k[1]
+
+		f := l.failures[kind+":"+key]
+		if f == nil {
+			f = &authFailures{}
+			l.failures[kind+":"+key] = f
+		}
+
+		f.count++
+		f.last = now
+		count = max(count, f.count)
+
+		if l.MaxFailures > 0 && f.count >= l.MaxFailures && !now.Before(f.locked) {
+			f.locked = now.Add(lockout)
+			f.count = 0
+			locks = append(locks, kind)
+		}
+	}
+
+	delay := cmp.Or(l.Delay, time.Second)
+	maxDelay := cmp.Or(l.MaxDelay, 30*time.Second)
+
+	for range count - 1 {
+		if delay >= maxDelay {
+			break
+		}
+
+		delay *= 2
+	}
+
+	return min(delay, maxDelay), locks
+}
+
+// authIP returns the IP the failed AUTH attempts of the client are counted
+// by
+func (session *session) authIP() string {
+	if addr, ok := session.peer.Addr.(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+
+	return session.peer.Addr.String()
+}
+
+// authLocked refuses the AUTH command, and ends the session, if the IP of the
+// client or the username is locked. The username is only checked when set.
+func (session *session) authLocked(username string) bool {
+	kind := session.server.AuthLimiter.locked(session.authIP(), username)
+	if kind == "" {
+		return false
+	}
+
+	session.refuseAuth(kind)
+
+	return true
+}
+
+// refuseAuth ends the session of a client whose IP or username is locked
+func (session *session) refuseAuth(kind string) {
+	session.logf("authentication locked: %s", kind)
+	session.record("--", "authentication locked: "+kind)
+
+	session.error(ErrAuthLocked)
+	session.close()
+}
+
+// authFailed replies err to a failed AUTH attempt for username. Invalid
+// credentials (535) are counted by the AuthLimiter, and their replies
+// delayed, or the session is ended if the IP or the username gets locked.
+func (session *session) authFailed(ctx context.Context, username string, err error) {
+	limiter := session.server.AuthLimiter
+
+	var smtpdError *Error
+	if limiter == nil || !errors.As(err, &smtpdError) || smtpdError.Code != 535 {
+		// the username is checked during the SCRAM exchange
+		if errors.Is(err, ErrAuthLocked) {
+			session.refuseAuth(cmp.Or(limiter.locked(session.authIP(), username), AuthLockUsername))
+			return
+		}
+
+		session.error(err)
+		return
+	}
+
+	ip := session.authIP()
+
+	delay, locks := limiter.failed(ip, username)
+
+	for _, kind := range locks {
+		if limiter.OnLockout != nil {
+			key := ip
+			if kind == AuthLockUsername {
+				key = username
+			}
+
+			limiter.OnLockout(ctx, session.peer, kind, key)
+		}
+	}
+
+	if len(locks) > 0 {
+		session.refuseAuth(locks[0])
+		return
+	}
+
+	if !session.expires.IsZero() {
+		delay = min(delay, time.Until(session.expires))
+	}
+
+	if delay > 0 {
+		session.logf("delaying failed authentication for %s", delay)
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		// the delay is cut short on shutdown
+		select {
+		case <-timer.C:
+		case <-session.server.getDoneChan():
+		}
+	}
+
+	session.error(err)
+}
@@ -0,0 +1,95 @@
+package smtpd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// builtinCommands are the commands handled by the server, which can't be
+// registered with RegisterCommand. Keep in sync with session.handle.
+var builtinCommands = []string{
+	"PROXY", "HELO", "EHLO", "LHLO", "MAIL", "RCPT", "STARTTLS", "DATA", "BDAT", "RSET", "NOOP", "VRFY",
+	"EXPN", "QUIT", "AUTH", "XCLIENT",
+}
+
+// Reply is the successful reply to a custom command, with a line per element
+// of Lines
+type Reply struct {
+	Code         int      // Reply code, e.g. 250
+	EnhancedCode string   // Enhanced status code, e.g. "2.0.0", generic if empty
+	Lines        []string // Human readable lines
+}
+
+// CommandHandler handles a custom command, see Server.RegisterCommand. It's
+// given the arguments following the verb, and returns the reply, or the error
+// to reply with, e.g. an Error.
+type CommandHandler func(ctx context.Context, peer Peer, args string) (Reply, error)
+
+// RegisterCommand registers the handler of a site-specific command, e.g.
+// ETRN, ATRN or HELP, which replaces the default reply to HELP. Verbs are case
+// insensitive. It panics if the verb is empty or has spaces, is a built-in
+// command, or is already registered.
+func (srv *Server) RegisterCommand(verb string, handler CommandHandler) {
+	verb = strings.ToUpper(verb)
+
+	if verb == "" || strings.ContainsAny(verb, " \t") {
+		panic(fmt.Sprintf("smtpd: invalid command %q", verb))
+	}
+
+	for _, builtin := range builtinCommands {
+		if verb == builtin {
+			panic("smtpd: built-in command " + verb + " can't be registered")
+		}
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if _, ok := srv.commands[verb]; ok {
+		panic("smtpd: command " + verb + " already registered")
+	}
+
+	if srv.commands == nil {
+		srv.commands = map[string]CommandHandler{}
+	}
+
+	srv.commands[verb] = handler
+}
+
+// command returns the handler of the custom command, nil if it isn't
+// registered
+func (srv *Server) command(verb string) CommandHandler {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.commands[verb]
+}
+
+// handleCustom runs the handler of a custom command, and replies HELP or
+// reports unsupported commands if there isn't one
+func (session *session) handleCustom(ctx context.Context, cmd command) {
+	handler := session.server.command(cmd.action)
+
+	switch {
+	case handler != nil:
+	case cmd.action == "HELP":
+		session.replyStatus(214, "2.0.0", "See RFC 5321 for the supported commands")
+		return
+	default:
+		session.error(ErrUnsupportedCommand)
+		return
+	}
+
+	reply, err := handler(ctx, session.peer, strings.Join(cmd.fields[1:], " "))
+	if err != nil {
+		session.error(err)
+		return
+	}
+
+	if len(reply.Lines) == 0 {
+		reply.Lines = []string{"OK"}
+	}
+
+	session.replyLines(reply.Code, reply.EnhancedCode, reply.Lines)
+}
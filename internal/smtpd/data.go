@@ -0,0 +1,201 @@
+package smtpd
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"io"
+)
+
+// Data modes, see Server.DataMode
+const (
+	DataLenient = ""       // read the data as textproto's DotReader does
+	DataReject  = "reject" // reject messages with bare CRs or LFs
+	DataRepair  = "repair" // turn bare CRs and LFs into line breaks
+)
+
+// maxDataLineLength is the max length of the lines of the message data,
+// excluding the CRLF (RFC 5321 section 4.5.3.1.6)
+const maxDataLineLength = 998
+
+// States of dataReader
+const (
+	dataBeginLine = iota // at the beginning of a line
+	dataDot              // after a dot beginning a line
+	dataDotCR            // after a dot alone on its line, and a CR
+	dataText             // in a line
+	dataCR               // after a CR in a line
+)
+
+// dataReader reads the message data of the DATA command strictly (RFC 5321
+// section 4.1.1.4). Unlike textproto's DotReader, only CRLF.CRLF ends the
+// data, so that a message can't be smuggled after a bare LF followed by a dot
+// which upstreams could take for the end of the data. Bare CRs and LFs are
+// either rejected or repaired into line breaks, and the message is rejected
+// if a line is longer than 998 characters. As with DotReader, the lines read
+// end with LF, and dot-stuffing is removed.
+//
+// The violations are reported once the whole data is read, in place of
+// io.EOF, except for bare LFs in reject mode: ErrBareLF is returned at once,
+// as the client may have meant it to end the data.
+type dataReader struct {
+	r      *bufio.Reader
+	repair bool
+
+	state int
+	line  int    // length of the current line
+	out   []byte // read data, not returned yet
+	err   error  // first violation
+	end   error  // returned once out is drained
+}
+
+func newDataReader(r *bufio.Reader, repair bool) *dataReader {
+	return &dataReader{r: r, repair: repair}
+}
+
+func (d *dataReader) Read(p []byte) (int, error) {
+	for len(d.out) < len(p) && d.end == nil {
+		d.step()
+	}
+
+	n := copy(p, d.out)
+	d.out = d.out[:copy(d.out, d.out[n:])]
+
+	if n == 0 && d.end != nil {
+		return 0, d.end
+	}
+
+	return n, nil
+}
+
+// step reads a byte of the data
+func (d *dataReader) step() {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		d.end = err
+
+		return
+	}
+
+	switch d.state {
+	case dataBeginLine:
+		if c == '.' {
+			d.state = dataDot
+			return
+		}
+	case dataDot:
+		if c == '\r' {
+			d.state = dataDotCR
+			return
+		}
+
+		// the dot stuffs the line, unless it's alone on a line ended with a
+		// bare LF
+		if c == '\n' {
+			d.text('.')
+		}
+	case dataDotCR:
+		if c == '\n' {
+			d.end = cmp.Or(d.err, io.EOF)
+			return
+		}
+
+		d.bareCR()
+	case dataCR:
+		if c == '\n' {
+			d.newline()
+			d.state = dataBeginLine
+
+			return
+		}
+
+		d.bareCR()
+	}
+
+	d.text(c)
+}
+
+// text reads a byte of a line
+func (d *dataReader) text(c byte) {
+	switch c {
+	case '\r':
+		d.state = dataCR
+	case '\n':
+		if !d.repair {
+			d.end = ErrBareLF
+			return
+		}
+
+		// a dot following the repaired line break doesn't end the data
+		d.newline()
+		d.state = dataText
+	default:
+		d.line++
+		if d.line > maxDataLineLength {
+			d.violation(ErrDataLineTooLong)
+		}
+
+		d.out = append(d.out, c)
+		d.state = dataText
+	}
+}
+
+// bareCR handles a CR which isn't followed by a LF
+func (d *dataReader) bareCR() {
+	if !d.repair {
+		d.violation(ErrBareCR)
+	}
+
+	d.newline()
+	d.state = dataText
+}
+
+func (d *dataReader) newline() {
+	d.out = append(d.out, '\n')
+	d.line = 0
+}
+
+func (d *dataReader) violation(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// checkChunkedData checks the message data received with BDAT as dataReader
+// does the DATA one, repairing the bare CRs and LFs into CRLFs if repair is
+// set. The data of BDAT isn't dot-stuffed, and its lines end with CRLF.
+func checkChunkedData(data []byte, repair bool) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	line := 0
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+
+		switch {
+		case c == '\r' && i+1 < len(data) && data[i+1] == '\n':
+			i++
+		case c == '\r' && !repair:
+			return nil, ErrBareCR
+		case c == '\n' && !repair:
+			return nil, ErrBareLF
+		case c != '\r' && c != '\n':
+			line++
+			if line > maxDataLineLength {
+				return nil, ErrDataLineTooLong
+			}
+
+			out = append(out, c)
+
+			continue
+		}
+
+		out = append(out, '\r', '\n')
+		line = 0
+	}
+
+	return out, nil
+}
@@ -0,0 +1,126 @@
+package smtpd
+
+import (
+	"bufio"
+	"io"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataReader(t *testing.T) {
+	t.Parallel()
+
+	long := strings.Repeat("a", maxDataLineLength)
+
+	for _, tc := range []struct {
+		name     string
+		data     string
+		expected string
+		rejected error // in reject mode
+		repaired error // in repair mode
+	}{
+		{name: "empty", data: ".\r\n"},
+		{name: "valid", data: "Subject: test\r\n\r\nhello\r\n.\r\n", expected: "Subject: test\n\nhello\n"},
+		{name: "dot-stuffed", data: "..hello\r\n...\r\n.\r\n", expected: ".hello\n..\n"},
+		{name: "max line", data: long + "\r\n.\r\n", expected: long + "\n"},
+		{
+			name:     "long line",
+			data:     long + "a\r\nhello\r\n.\r\n",
+			rejected: ErrDataLineTooLong,
+			repaired: ErrDataLineTooLong,
+		},
+		{
+			name:     "bare CR",
+			data:     "hello\rworld\r\n.\r\n",
+			expected: "hello\nworld\n",
+			rejected: ErrBareCR,
+		},
+		{
+			name:     "bare LF",
+			data:     "hello\nworld\r\n.\r\n",
+			expected: "hello\nworld\n",
+			rejected: ErrBareLF,
+		},
+		{
+			// the bare LFs don't end the data, unlike with DotReader
+			name:     "smuggled after bare LF",
+			data:     "hello\n.\nMAIL FROM:<x>\r\n.\r\n",
+			expected: "hello\n.\nMAIL FROM:<x>\n",
+			rejected: ErrBareLF,
+		},
+		{
+			name:     "smuggled after bare CR",
+			data:     "hello\r.\r\nMAIL FROM:<x>\r\n.\r\n",
+			expected: "hello\n.\nMAIL FROM:<x>\n",
+			rejected: ErrBareCR,
+		},
+		{
+			name:     "smuggled after bare LF and dot",
+			data:     "hello\r\n.\nMAIL FROM:<x>\r\n.\r\n",
+			expected: "hello\n.\nMAIL FROM:<x>\n",
+			rejected: ErrBareLF,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			for repair, expectedErr := range map[bool]error{false: tc.rejected, true: tc.repaired} {
+				// the rest of the session follows the data
+				br := bufio.NewReader(strings.NewReader(tc.data + "QUIT\r\n"))
+
+				data, err := io.ReadAll(newDataReader(br, repair))
+
+				if expectedErr != nil {
+					require.ErrorIs(t, err, expectedErr)
+					continue
+				}
+
+				require.NoError(t, err)
+				assert.Equal(t, tc.expected, string(data))
+
+				rest, err := io.ReadAll(br)
+				require.NoError(t, err)
+				assert.Equal(t, "QUIT\r\n", string(rest))
+			}
+		})
+	}
+
+	// the data matches textproto's once it's valid
+	data := "Subject: test\r\n\r\n..hello\r\n\r\n.\r\n"
+
+	expected, err := io.ReadAll(textproto.NewReader(bufio.NewReader(strings.NewReader(data))).DotReader())
+	require.NoError(t, err)
+
+	actual, err := io.ReadAll(newDataReader(bufio.NewReader(strings.NewReader(data)), false))
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+
+	// the connection is closed before the end of the data
+	_, err = io.ReadAll(newDataReader(bufio.NewReader(strings.NewReader("hello\r\n")), false))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestCheckChunkedData(t *testing.T) {
+	t.Parallel()
+
+	data, err := checkChunkedData([]byte("Subject: test\r\n\r\n.hello\r\n"), false)
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: test\r\n\r\n.hello\r\n", string(data))
+
+	data, err = checkChunkedData([]byte("hello\nworld\r\rend"), true)
+	require.NoError(t, err)
+	assert.Equal(t, "hello\r\nworld\r\n\r\nend", string(data))
+
+	_, err = checkChunkedData([]byte("hello\nworld\r\n"), false)
+	require.ErrorIs(t, err, ErrBareLF)
+
+	_, err = checkChunkedData([]byte("hello\rworld\r\n"), false)
+	require.ErrorIs(t, err, ErrBareCR)
+
+	_, err = checkChunkedData([]byte(strings.Repeat("a", maxDataLineLength+1)+"\r\n"), true)
+	require.ErrorIs(t, err, ErrDataLineTooLong)
+}
@@ -1,13 +1,40 @@
 package smtpd
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"net/textproto"
+	"strings"
 	"time"
 )
 
+// Body types of the BODY parameter of MAIL FROM (RFC 6152)
+const (
+	Body7Bit     = "7BIT"
+	Body8BitMIME = "8BITMIME"
+)
+
+// Values of the RET parameter of MAIL FROM (RFC 3461)
+const (
+	DSNRetFull    = "FULL"
+	DSNRetHeaders = "HDRS"
+)
+
+// Range of the MT-PRIORITY parameter of MAIL FROM (RFC 6710)
+const (
+	MinPriority = -9
+	MaxPriority = 9
+)
+
+// RecipientDSN holds the DSN parameters of a RCPT TO command (RFC 3461)
+type RecipientDSN struct {
+	Notify string `json:"notify,omitempty"` // NOTIFY parameter, e.g. "SUCCESS,FAILURE" or "NEVER"
+	ORcpt  string `json:"orcpt,omitempty"`  // ORCPT parameter, e.g. "rfc822;user@example.org" (xtext encoded)
+}
+
 // Envelope holds a message, its headers and recipients. The Header field is
 // read-only and updates to it are not reflected in Data.
 type Envelope struct {
@@ -15,10 +42,70 @@ type Envelope struct {
 	Recipients []string
 	Header     textproto.MIMEHeader
 	Data       []byte
+
+	// Body streams the message data from the client, instead of Data, when
+	// Server.StreamData is set. Reading it fails with ErrTooBig once the
+	// message exceeds Server.MaxMessageSize, and it's only valid until the
+	// Handler returns.
+	Body io.Reader
+
+	SMTPUTF8 bool   // SMTPUTF8 was requested on MAIL FROM (RFC 6531)
+	BodyType string // BODY parameter of MAIL FROM (Body7Bit or Body8BitMIME), if given
+	Size     int64  // SIZE parameter of MAIL FROM (RFC 1870), the size declared by the client, 0 if not given
+
+	DSNRet   string                  // RET parameter of MAIL FROM (DSNRetFull or DSNRetHeaders), if given
+	DSNEnvID string                  // ENVID parameter of MAIL FROM (xtext encoded), if given
+	DSN      map[string]RecipientDSN // DSN parameters of RCPT TO, by recipient, if given
+
+	// Priority is the MT-PRIORITY parameter of MAIL FROM (RFC 6710), from
+	// MinPriority to MaxPriority, 0 if not given or not enabled with
+	// Server.EnableMTPriority
+	Priority int
+
+	mime *mimeCache // parsed by MIME
 }
 
-// AddReceivedLine prepends a Received header to the Data
+// Buffer reads the rest of the streamed Body into Data, for handlers which
+// need the whole message, e.g. to verify signatures
+func (env *Envelope) Buffer() error {
+	if env.Body == nil {
+		return nil
+	}
+
+	data, err := io.ReadAll(env.Body)
+	if err != nil {
+		return err
+	}
+
+	env.Data = data
+	env.Body = nil
+
+	return nil
+}
+
+// ReceivedFields selects the details of the client given in the Received
+// header added by AddReceived
+type ReceivedFields struct {
+	HeloName bool // name given by the client in HELO or EHLO
+	ClientIP bool // IP address of the client
+	TLS      bool // TLS version and cipher suite of the session
+	Username bool // authenticated username of the client
+}
+
+// DefaultReceivedFields are the details of the client given by
+// AddReceivedLine
+var DefaultReceivedFields = ReceivedFields{HeloName: true, ClientIP: true, TLS: true}
+
+// AddReceivedLine prepends a Received header to the Data, or to the Body,
+// with the DefaultReceivedFields
 func (env *Envelope) AddReceivedLine(peer Peer) {
+	env.AddReceived(peer, DefaultReceivedFields)
+}
+
+// AddReceived prepends a Received header to the Data, or to the Body, giving
+// the selected details of the client. The from clause is left out when
+// neither the HELO name nor the IP address of the client is given.
+func (env *Envelope) AddReceived(peer Peer, fields ReceivedFields) {
 	tlsDetails := ""
 
 	tlsVersions := map[uint16]string{
@@ -28,7 +115,7 @@ func (env *Envelope) AddReceivedLine(peer Peer) {
 		tls.VersionTLS13: "TLS1.3",
 	}
 
-	if peer.TLS != nil {
+	if peer.TLS != nil && fields.TLS {
 		version := "unknown"
 
 		if val, ok := tlsVersions[peer.TLS.Version]; ok {
@@ -45,23 +132,142 @@ func (env *Envelope) AddReceivedLine(peer Peer) {
 	}
 
 	peerIP := ""
-	if addr, ok := peer.Addr.(*net.TCPAddr); ok {
+	if addr, ok := peer.Addr.(*net.TCPAddr); ok && fields.ClientIP {
 		peerIP = addr.IP.String()
 	}
 
+	var from []string
+
+	switch {
+	case fields.HeloName && peerIP != "":
+		from = append(from, fmt.Sprintf("from %s ([%s])", peer.HeloName, peerIP))
+	case fields.HeloName:
+		from = append(from, "from "+peer.HeloName)
+	case peerIP != "":
+		from = append(from, fmt.Sprintf("from [%s]", peerIP))
+	}
+
+	if peer.Username != "" && fields.Username {
+		from = append(from, fmt.Sprintf("(Authenticated sender: %s)", peer.Username))
+	}
+
+	if len(from) > 0 {
+		from = append(from, "")
+	}
+
 	line := wrap([]byte(fmt.Sprintf(
-		"Received: from %s ([%s]) by %s with %s;%s\r\n\t%s\r\n",
-		peer.HeloName,
-		peerIP,
+		"Received: %sby %s with %s;%s\r\n\t%s\r\n",
+		strings.Join(from, " "),
 		peer.ServerName,
 		peer.Protocol,
 		tlsDetails,
 		time.Now().Format("Mon, 02 Jan 2006 15:04:05 -0700 (MST)"),
 	)))
 
+	env.prepend(line)
+}
+
+// AddHeader prepends a header to the Data, or to the Body, folding it if
+// needed
+func (env *Envelope) AddHeader(key, value string) {
+	env.prepend(wrap([]byte(key + ": " + value + "\r\n")))
+}
+
+// RemoveHeaders removes the header fields named key whose (unfolded) value
+// matches from the Data. The Header field is left unchanged. Streamed
+// messages must be buffered first, see Buffer.
+func (env *Envelope) RemoveHeaders(key string, match func(value string) bool) {
+	env.editHeaders(key, func(field []byte, value string) []byte {
+		if match(value) {
+			return nil
+		}
+
+		return field
+	})
+}
+
+// ReplaceHeaders replaces the (unfolded) values of the header fields named
+// key in the Data with the result of replace, folding them if needed. The
+// fields keep their position, and the Header field is left unchanged.
+// Streamed messages must be buffered first, see Buffer.
+func (env *Envelope) ReplaceHeaders(key string, replace func(value string) string) {
+	env.editHeaders(key, func(field []byte, value string) []byte {
+		newValue := replace(value)
+		if newValue == value {
+			return field
+		}
+
+		name, _, _ := bytes.Cut(field, []byte(":"))
+
+		return wrap([]byte(string(name) + ": " + newValue + "\r\n"))
+	})
+}
+
+// editHeaders replaces the raw header fields named key in the Data with the
+// result of edit, given the field and its unfolded value. Fields are removed
+// if edit returns nil.
+func (env *Envelope) editHeaders(key string, edit func(field []byte, value string) []byte) {
+	data := make([]byte, 0, len(env.Data))
+
+	// apply edits the raw header field if it's named key
+	apply := func(field []byte) []byte {
+		name, value, ok := bytes.Cut(field, []byte(":"))
+		if !ok || !strings.EqualFold(string(bytes.TrimSpace(name)), key) {
+			return field
+		}
+
+		value = bytes.ReplaceAll(value, []byte("\r\n"), nil)
+		value = bytes.ReplaceAll(value, []byte("\n"), nil)
+
+		return edit(field, string(bytes.TrimSpace(value)))
+	}
+
+	start := -1 // start of the current field
+
+	for pos := 0; pos < len(env.Data); {
+		end := len(env.Data)
+		if i := bytes.IndexByte(env.Data[pos:], '\n'); i != -1 {
+			end = pos + i + 1
+		}
+
+		line := env.Data[pos:end]
+
+		// the current field ends with the next line not starting with a space
+		if start != -1 && line[0] != ' ' && line[0] != '\t' {
+			data = append(data, apply(env.Data[start:pos])...)
+			start = -1
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// end of the header, keep the body as-is
+			env.Data = append(data, env.Data[pos:]...)
+			return
+		}
+
+		if start == -1 {
+			start = pos
+		}
+
+		pos = end
+	}
+
+	// message without body
+	if start != -1 {
+		data = append(data, apply(env.Data[start:])...)
+	}
+
+	env.Data = data
+}
+
+func (env *Envelope) prepend(line []byte) {
+	if env.Body != nil {
+		env.Body = io.MultiReader(bytes.NewReader(line), env.Body)
+		return
+	}
+
 	env.Data = append(env.Data, line...)
 
-	// Move the new Received line up front
+	// Move the new line up front
 	copy(env.Data[len(line):], env.Data[0:len(env.Data)-len(line)])
 	copy(env.Data, line)
 }
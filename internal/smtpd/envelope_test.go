@@ -0,0 +1,105 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRemoveHeaders(t *testing.T) {
+	t.Parallel()
+
+	ours := func(value string) bool {
+		return strings.HasPrefix(value, "relay.example.com;")
+	}
+
+	cases := map[string]string{
+		// folded field is removed entirely, other fields are kept
+		"Authentication-Results: relay.example.com;\r\n\tdkim=pass\r\nAuthentication-Results: mx.example.org; spf=pass\r\nSubject: test\r\n\r\nAuthentication-Results: relay.example.com; body\r\n": "Authentication-Results: mx.example.org; spf=pass\r\nSubject: test\r\n\r\nAuthentication-Results: relay.example.com; body\r\n",
+		// LF line endings, case-insensitive name
+		"Subject: test\nauthentication-results: relay.example.com; dkim=fail\n\nhello\n": "Subject: test\n\nhello\n",
+		// no body
+		"Subject: test\r\nAuthentication-Results: relay.example.com; none": "Subject: test\r\n",
+		// nothing to remove
+		"Subject: test\r\n\r\nhello\r\n": "Subject: test\r\n\r\nhello\r\n",
+	}
+
+	for k, v := range cases {
+		env := &Envelope{Data: []byte(k)}
+		env.RemoveHeaders("Authentication-Results", ours)
+
+		if string(env.Data) != v {
+			t.Fatalf("unexpected data for %q: %q", k, env.Data)
+		}
+	}
+}
+
+func TestReplaceHeaders(t *testing.T) {
+	t.Parallel()
+
+	domain := func(value string) string {
+		return strings.ReplaceAll(value, "@internal.example.com", "@example.com")
+	}
+
+	cases := map[string]string{
+		// folded field is unfolded, others are kept as-is, in place
+		"Subject: test\r\nfrom: Bob\r\n <bob@internal.example.com>\r\nTo: alice@internal.example.com\r\n\r\nFrom: bob@internal.example.com\r\n": "Subject: test\r\nfrom: Bob <bob@example.com>\r\nTo: alice@internal.example.com\r\n\r\nFrom: bob@internal.example.com\r\n",
+		// unchanged values keep their folding
+		"From: Bob\r\n <bob@example.com>\r\n\r\nhello\r\n": "From: Bob\r\n <bob@example.com>\r\n\r\nhello\r\n",
+		// no body
+		"From: bob@internal.example.com": "From: bob@example.com\r\n",
+	}
+
+	for k, v := range cases {
+		env := &Envelope{Data: []byte(k)}
+		env.ReplaceHeaders("From", domain)
+
+		if string(env.Data) != v {
+			t.Fatalf("unexpected data for %q: %q", k, env.Data)
+		}
+	}
+}
+
+func TestAddHeader(t *testing.T) {
+	t.Parallel()
+
+	env := &Envelope{Data: []byte("Subject: test\r\n\r\nhello\r\n")}
+	env.AddHeader("X-Test", "foo")
+
+	if string(env.Data) != "X-Test: foo\r\nSubject: test\r\n\r\nhello\r\n" {
+		t.Fatalf("unexpected data: %q", env.Data)
+	}
+}
+
+func TestAddReceived(t *testing.T) {
+	t.Parallel()
+
+	peer := Peer{
+		HeloName:   "client.example.com",
+		Username:   "bob",
+		Protocol:   ESMTP,
+		ServerName: "relay.example.com",
+		Addr:       &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 12345},
+		TLS:        &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256},
+	}
+
+	cases := []struct {
+		fields   ReceivedFields
+		expected string
+	}{
+		{DefaultReceivedFields, "Received: from client.example.com ([10.0.0.1]) by relay.example.com with ESMTP;\r\n\t(version=TLS1.3 cipher=TLS_AES_128_GCM_SHA256);\r\n\t"},
+		{ReceivedFields{HeloName: true, Username: true}, "Received: from client.example.com (Authenticated sender: bob) by relay.example.com\r\n\twith ESMTP;\r\n\t"},
+		{ReceivedFields{ClientIP: true}, "Received: from [10.0.0.1] by relay.example.com with ESMTP;\r\n\t"},
+		{ReceivedFields{}, "Received: by relay.example.com with ESMTP;\r\n\t"},
+	}
+
+	for _, c := range cases {
+		env := &Envelope{Data: []byte("Subject: test\r\n\r\nhello\r\n")}
+		env.AddReceived(peer, c.fields)
+
+		if !strings.HasPrefix(string(env.Data), c.expected) {
+			t.Fatalf("unexpected data for %+v: %q", c.fields, env.Data)
+		}
+	}
+}
@@ -1,35 +1,125 @@
 package smtpd
 
-import "net/textproto"
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// enhancedCodeRe matches an RFC 3463 enhanced status code at the start of a
+// reply message
+var enhancedCodeRe = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}(\s|$)`)
+
+// Error represents an SMTP error reply, with an RFC 3463 enhanced status
+// code. If EnhancedCode is empty, a generic "<class>.0.0" code is used.
+type Error struct {
+	Code         int    // Reply code, e.g. 550
+	EnhancedCode string // Enhanced status code, e.g. "5.7.1"
+	Msg          string // Human readable message
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, withEnhancedCode(e.Code, e.EnhancedCode, e.Msg))
+}
+
+// withEnhancedCode prefixes the message with the enhanced status code, unless
+// it already starts with one
+func withEnhancedCode(code int, enhancedCode, msg string) string {
+	if enhancedCodeRe.MatchString(msg) {
+		return msg
+	}
+
+	if enhancedCode == "" {
+		enhancedCode = fmt.Sprintf("%d.0.0", code/100)
+	}
+
+	return enhancedCode + " " + msg
+}
+
+// RecipientErrors can be returned by the Handler to report the result of the
+// delivery for each recipient, the recipients which aren't in the map were
+// delivered. In LMTP mode, each recipient gets its own reply after the message
+// data (RFC 2033). Otherwise, the error of the first failed recipient is
+// reported for the whole message.
+type RecipientErrors map[string]error
+
+func (e RecipientErrors) Error() string {
+	rcpts := make([]string, 0, len(e))
+	for rcpt := range e {
+		rcpts = append(rcpts, rcpt)
+	}
+
+	slices.Sort(rcpts)
+
+	msgs := make([]string, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		msgs = append(msgs, fmt.Sprintf("rcpt %s: %v", rcpt, e[rcpt]))
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// first returns the error of the first failed recipient, in the given order
+func (e RecipientErrors) first(recipients []string) error {
+	for _, rcpt := range recipients {
+		if err := e[rcpt]; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
 var (
-	ErrBusy              = &textproto.Error{Code: 421, Msg: "Too busy. Try again later."}
-	ErrIPDenied          = &textproto.Error{Code: 421, Msg: "Denied - IP out of allowed network range"}
-	ErrRecipientDenied   = &textproto.Error{Code: 451, Msg: "Denied recipient address"}
-	ErrRecipientInvalid  = &textproto.Error{Code: 451, Msg: "Invalid recipient address"}
-	ErrSenderDenied      = &textproto.Error{Code: 451, Msg: "sender address not allowed"}
-	ErrTooManyRecipients = &textproto.Error{Code: 452, Msg: "Too many recipients"}
-
-	ErrLineTooLong           = &textproto.Error{Code: 500, Msg: "Line too long"}
-	ErrDuplicateMAIL         = &textproto.Error{Code: 502, Msg: "Duplicate MAIL"}
-	ErrDuplicateSTARTTLS     = &textproto.Error{Code: 502, Msg: "Already running in TLS"}
-	ErrInvalidSyntax         = &textproto.Error{Code: 502, Msg: "Invalid syntax."}
-	ErrMalformedAuth         = &textproto.Error{Code: 502, Msg: "Couldn't decode your credentials"}
-	ErrMalformedCommand      = &textproto.Error{Code: 502, Msg: "Couldn't decode the command"}
-	ErrMalformedEmail        = &textproto.Error{Code: 502, Msg: "Malformed email address"} // TODO: should this be a 502 or 451?
-	ErrMissingParam          = &textproto.Error{Code: 502, Msg: "Missing parameter"}
-	ErrNoHELO                = &textproto.Error{Code: 502, Msg: "Please introduce yourself first."}
-	ErrNoMAIL                = &textproto.Error{Code: 502, Msg: "Missing MAIL FROM command."}
-	ErrNoRCPT                = &textproto.Error{Code: 502, Msg: "Missing RCPT TO command."}
-	ErrNoSTARTTLS            = &textproto.Error{Code: 502, Msg: "Please turn on TLS by issuing a STARTTLS command."}
-	ErrTLSNotSupported       = &textproto.Error{Code: 502, Msg: "TLS not supported"}
-	ErrUnknownAuth           = &textproto.Error{Code: 502, Msg: "Unknown authentication mechanism"}
-	ErrUnsupportedCommand    = &textproto.Error{Code: 502, Msg: "Unsupported command"}
-	ErrUnsupportedConn       = &textproto.Error{Code: 502, Msg: "Unsupported network connection"}
-	ErrUnsupportedAuthMethod = &textproto.Error{Code: 530, Msg: "Authentication method not supported"}
-	ErrAuthRequired          = &textproto.Error{Code: 530, Msg: "Authentication required."}
-	ErrAuthInvalid           = &textproto.Error{Code: 535, Msg: "Authentication credentials invalid"}
-	ErrBadHandshake          = &textproto.Error{Code: 550, Msg: "Handshake error"}
-	ErrTooBig                = &textproto.Error{Code: 552, Msg: "Message exceeded maximum size"}
-	ErrForwardingFailed      = &textproto.Error{Code: 554, Msg: "Forwarding failed"}
+	ErrBusy                 = &Error{Code: 421, EnhancedCode: "4.3.2", Msg: "Too busy. Try again later."}
+	ErrPaused               = &Error{Code: 421, EnhancedCode: "4.3.2", Msg: "Not accepting mail, try again later"}
+	ErrIPDenied             = &Error{Code: 421, EnhancedCode: "4.7.1", Msg: "Denied - IP out of allowed network range"}
+	ErrRateLimited          = &Error{Code: 421, EnhancedCode: "4.7.0", Msg: "Rate limit exceeded, try again later"}
+	ErrSessionExpired       = &Error{Code: 421, EnhancedCode: "4.4.2", Msg: "Session lasted too long, closing connection"}
+	ErrTooManyCommands      = &Error{Code: 421, EnhancedCode: "4.7.0", Msg: "Too many commands, closing connection"}
+	ErrTooManyErrors        = &Error{Code: 421, EnhancedCode: "4.7.0", Msg: "Too many errors, closing connection"}
+	ErrAuthLocked           = &Error{Code: 421, EnhancedCode: "4.7.0", Msg: "Too many authentication failures, try again later"}
+	ErrRecipientDenied      = &Error{Code: 451, EnhancedCode: "4.7.1", Msg: "Denied recipient address"}
+	ErrMessageRateLimited   = &Error{Code: 450, EnhancedCode: "4.7.1", Msg: "Message rate limit exceeded, try again later"}
+	ErrRecipientRateLimited = &Error{Code: 450, EnhancedCode: "4.7.1", Msg: "Recipient rate limit exceeded, try again later"}
+	ErrRecipientInvalid     = &Error{Code: 451, EnhancedCode: "4.1.3", Msg: "Invalid recipient address"}
+	ErrSenderDenied         = &Error{Code: 451, EnhancedCode: "4.7.1", Msg: "sender address not allowed"}
+	ErrTooManyRecipients    = &Error{Code: 452, EnhancedCode: "4.5.3", Msg: "Too many recipients"}
+	ErrSPFTempError         = &Error{Code: 451, EnhancedCode: "4.7.24", Msg: "SPF validation error, try again later"}
+
+	ErrLineTooLong           = &Error{Code: 500, EnhancedCode: "5.5.2", Msg: "Line too long"}
+	ErrDuplicateMAIL         = &Error{Code: 502, EnhancedCode: "5.5.1", Msg: "Duplicate MAIL"}
+	ErrDuplicateSTARTTLS     = &Error{Code: 502, EnhancedCode: "5.5.1", Msg: "Already running in TLS"}
+	ErrInvalidSyntax         = &Error{Code: 502, EnhancedCode: "5.5.2", Msg: "Invalid syntax."}
+	ErrMalformedAuth         = &Error{Code: 502, EnhancedCode: "5.5.2", Msg: "Couldn't decode your credentials"}
+	ErrMalformedCommand      = &Error{Code: 502, EnhancedCode: "5.5.2", Msg: "Couldn't decode the command"}
+	ErrMalformedEmail        = &Error{Code: 502, EnhancedCode: "5.1.3", Msg: "Malformed email address"} // TODO: should this be a 502 or 451?
+	ErrMissingParam          = &Error{Code: 502, EnhancedCode: "5.5.4", Msg: "Missing parameter"}
+	ErrNoHELO                = &Error{Code: 502, EnhancedCode: "5.5.1", Msg: "Please introduce yourself first."}
+	ErrNoMAIL                = &Error{Code: 502, EnhancedCode: "5.5.1", Msg: "Missing MAIL FROM command."}
+	ErrNoRCPT                = &Error{Code: 502, EnhancedCode: "5.5.1", Msg: "Missing RCPT TO command."}
+	ErrNoSTARTTLS            = &Error{Code: 502, EnhancedCode: "5.7.0", Msg: "Please turn on TLS by issuing a STARTTLS command."}
+	ErrTLSNotSupported       = &Error{Code: 502, EnhancedCode: "5.5.1", Msg: "TLS not supported"}
+	ErrUnknownAuth           = &Error{Code: 502, EnhancedCode: "5.5.4", Msg: "Unknown authentication mechanism"}
+	ErrUnsupportedCommand    = &Error{Code: 502, EnhancedCode: "5.5.1", Msg: "Unsupported command"}
+	ErrUnsupportedConn       = &Error{Code: 502, EnhancedCode: "5.5.4", Msg: "Unsupported network connection"}
+	ErrDATAAfterBDAT         = &Error{Code: 503, EnhancedCode: "5.5.1", Msg: "DATA not allowed after BDAT"}
+	ErrUnsupportedAuthMethod = &Error{Code: 530, EnhancedCode: "5.7.4", Msg: "Authentication method not supported"}
+	ErrAuthRequired          = &Error{Code: 530, EnhancedCode: "5.7.0", Msg: "Authentication required."}
+	ErrAuthInvalid           = &Error{Code: 535, EnhancedCode: "5.7.8", Msg: "Authentication credentials invalid"}
+	ErrBadHandshake          = &Error{Code: 550, EnhancedCode: "5.7.0", Msg: "Handshake error"}
+	ErrSPFFail               = &Error{Code: 550, EnhancedCode: "5.7.23", Msg: "SPF validation failed"}
+	ErrDMARCReject           = &Error{Code: 550, EnhancedCode: "5.7.1", Msg: "Rejected by DMARC policy"}
+	ErrUntrustedProxy        = &Error{Code: 550, EnhancedCode: "5.7.1", Msg: "PROXY and XCLIENT not allowed from this address"}
+	ErrUserUnknown           = &Error{Code: 550, EnhancedCode: "5.1.1", Msg: "User unknown"}
+	ErrSMTPUTF8Unsupported   = &Error{Code: 550, EnhancedCode: "5.6.7", Msg: "Non-ASCII addresses not supported by upstream server"}
+	ErrNonASCIIAddress       = &Error{Code: 553, EnhancedCode: "5.6.7", Msg: "Non-ASCII addresses require SMTPUTF8"}
+	Err8BitMIMEUnsupported   = &Error{Code: 554, EnhancedCode: "5.6.3", Msg: "8-bit content not supported by upstream server"}
+	ErrBareCR                = &Error{Code: 554, EnhancedCode: "5.6.0", Msg: "Bare CR in message data, lines must end with CRLF"}
+	ErrBareLF                = &Error{Code: 554, EnhancedCode: "5.6.0", Msg: "Bare LF in message data, lines must end with CRLF"}
+	ErrDataLineTooLong       = &Error{Code: 554, EnhancedCode: "5.6.0", Msg: "Message line longer than 998 characters"}
+	ErrTooBig                = &Error{Code: 552, EnhancedCode: "5.3.4", Msg: "Message exceeded maximum size"}
+	ErrForwardingFailed      = &Error{Code: 554, EnhancedCode: "5.0.0", Msg: "Forwarding failed"}
+	ErrEarlyTalker           = &Error{Code: 554, EnhancedCode: "5.5.1", Msg: "Protocol error, data sent before the greeting"}
 )
@@ -0,0 +1,22 @@
+package smtpd
+
+import "context"
+
+// Handler handles an e-mail once its data is received. If an error is
+// returned, it will be reported in the SMTP session.
+type Handler func(ctx context.Context, peer Peer, env Envelope) error
+
+// Middleware wraps a Handler, to check or alter e-mails before passing them on
+// to next, or to act on the result. It may return without calling next to
+// reject an e-mail.
+type Middleware func(next Handler) Handler
+
+// Chain returns h wrapped by the middlewares, the first one being the
+// outermost, so e-mails go through them in the order given.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	return h
+}
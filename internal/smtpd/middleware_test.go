@@ -0,0 +1,47 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChain(t *testing.T) {
+	t.Parallel()
+
+	var calls []string
+
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, peer Peer, env Envelope) error {
+				calls = append(calls, name)
+				return next(ctx, peer, env)
+			}
+		}
+	}
+
+	h := Chain(func(context.Context, Peer, Envelope) error {
+		calls = append(calls, "handler")
+		return nil
+	}, record("first"), record("second"))
+
+	require.NoError(t, h(context.Background(), Peer{}, Envelope{}))
+	assert.Equal(t, []string{"first", "second", "handler"}, calls)
+
+	// middlewares reject e-mails by not calling next
+	errRejected := errors.New("rejected")
+	reject := func(Handler) Handler {
+		return func(context.Context, Peer, Envelope) error {
+			return errRejected
+		}
+	}
+
+	calls = nil
+	h = Chain(h, record("outer"), reject, record("inner"))
+
+	require.ErrorIs(t, h(context.Background(), Peer{}, Envelope{}), errRejected)
+	assert.Equal(t, []string{"outer"}, calls)
+}
@@ -0,0 +1,464 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/base64"
+	"io"
+	"maps"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"slices"
+	"strings"
+)
+
+// maxMIMEDepth is how deep nested multiparts are parsed, deeper ones being
+// left as leaf parts
+const maxMIMEDepth = 10
+
+// MIMEPart is a message, or one of its MIME parts, as parsed by ParseMIME or
+// Envelope.MIME. Its Header, Body and Parts may be changed, e.g. to remove an
+// attachment, and the message serialized again with Bytes or
+// Envelope.SetMIME: the parts left unchanged are serialized as received.
+type MIMEPart struct {
+	Header textproto.MIMEHeader
+
+	MediaType  string            // lowercased media type of the Content-Type, text/plain by default
+	Params     map[string]string // parameters of the Content-Type, e.g. charset or boundary
+	Filename   string            // file name, from the Content-Disposition or the Content-Type
+	Attachment bool              // whether it's a leaf part with a file name or an attachment disposition
+	Truncated  bool              // whether it's a multipart nested too deep to be parsed, left as a leaf part
+	Size       int64             // decoded size of the Body, as received
+
+	Body  []byte      // body of a leaf part, as transfer-encoded, see Decode
+	Parts []*MIMEPart // parts of a multipart, whose Body is nil
+
+	orig mimeOriginal
+}
+
+// mimeOriginal is a part as received, to serialize the unchanged parts as is
+type mimeOriginal struct {
+	raw       []byte // header and body
+	rawHeader []byte // header, with the empty line ending it
+	header    textproto.MIMEHeader
+	body      []byte
+	parts     []*MIMEPart
+	preamble  []byte // before the first boundary of a multipart
+	epilogue  []byte // after the closing boundary of a multipart
+	closeNL   string // line ending of the closing boundary, none at the end of a part
+	nl        string // line ending
+}
+
+// mimeCache is the MIME structure parsed by Envelope.MIME, and the Data it
+// was parsed from
+type mimeCache struct {
+	data []byte
+	part *MIMEPart
+}
+
+// MIME returns the MIME structure of the message. It's parsed from the Data
+// on the first call, and shared with the handlers the envelope is then passed
+// to, unless the Data changes. Streamed messages are buffered first, see
+// Buffer. Changes to the parts are only applied to the message by SetMIME.
+func (env *Envelope) MIME() (*MIMEPart, error) {
+	if err := env.Buffer(); err != nil {
+		return nil, err
+	}
+
+	if c := env.mime; c != nil && sameBytes(c.data, env.Data) {
+		return c.part, nil
+	}
+
+	part := ParseMIME(env.Data)
+	env.mime = &mimeCache{data: env.Data, part: part}
+
+	return part, nil
+}
+
+// SetMIME replaces the Data and the Header with the serialized message, e.g.
+// once the structure returned by MIME was changed
+func (env *Envelope) SetMIME(part *MIMEPart) {
+	env.Body = nil
+	env.Data = part.Bytes()
+	env.Header = maps.Clone(part.Header)
+	env.mime = nil
+}
+
+// sameBytes reports whether a and b are the same slice
+func sameBytes(a, b []byte) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// ParseMIME parses the MIME structure of a message. Malformed messages are
+// parsed as far as possible: e.g. multiparts without their boundary are left
+// as leaf parts.
+func ParseMIME(data []byte) *MIMEPart {
+	return parseMIMEPart(data, 0)
+}
+
+func parseMIMEPart(raw []byte, depth int) *MIMEPart {
+	rawHeader, body := cutHeader(raw)
+
+	nl := "\n"
+	if bytes.Contains(rawHeader, []byte("\r\n")) || len(rawHeader) == 0 {
+		nl = "\r\n"
+	}
+
+	header := readMIMEHeader(rawHeader)
+
+	p := &MIMEPart{
+		Header: header,
+		Body:   body,
+		orig: mimeOriginal{
+			raw:       raw,
+			rawHeader: rawHeader,
+			header:    cloneHeader(header),
+			body:      body,
+			nl:        nl,
+		},
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+
+	p.MediaType = cmp.Or(mediaType, "text/plain")
+	p.Params = params
+	p.Filename = cmp.Or(dparams["filename"], params["name"])
+
+	boundary := params["boundary"]
+	multipart := strings.HasPrefix(mediaType, "multipart/") && boundary != ""
+
+	if multipart && depth < maxMIMEDepth {
+		ranges, preambleEnd, epilogueStart := multipartRanges(body, boundary)
+		if len(ranges) > 0 {
+			for _, r := range ranges {
+				p.Parts = append(p.Parts, parseMIMEPart(body[r.start:r.end], depth+1))
+			}
+
+			p.Body = nil
+			p.orig.body = nil
+			p.orig.parts = slices.Clone(p.Parts)
+			p.orig.preamble = body[:preambleEnd]
+			p.orig.epilogue = body[epilogueStart:]
+
+			switch {
+			case bytes.HasSuffix(body[:epilogueStart], []byte("\r\n")):
+				p.orig.closeNL = "\r\n"
+			case bytes.HasSuffix(body[:epilogueStart], []byte("\n")):
+				p.orig.closeNL = "\n"
+			}
+
+			return p
+		}
+	}
+
+	p.Attachment = p.Filename != "" || disposition == "attachment"
+	p.Truncated = multipart && depth >= maxMIMEDepth
+
+	p.Size = int64(len(body))
+	if decoded, err := p.Decode(); err == nil {
+		p.Size = int64(len(decoded))
+	}
+
+	return p
+}
+
+// Decode returns the Body decoded from its base64 or quoted-printable
+// Content-Transfer-Encoding, as is with other encodings
+func (p *MIMEPart) Decode() ([]byte, error) {
+	var r io.Reader
+
+	switch strings.ToLower(strings.TrimSpace(p.Header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		// line breaks are ignored by the decoder
+		r = base64.NewDecoder(base64.StdEncoding, bytes.NewReader(bytes.TrimRight(p.Body, " \t\r\n")))
+	case "quoted-printable":
+		r = quotedprintable.NewReader(bytes.NewReader(p.Body))
+	default:
+		return p.Body, nil
+	}
+
+	return io.ReadAll(r)
+}
+
+// Walk calls fn with the part, then its descendants, depth first, until it
+// returns an error
+func (p *MIMEPart) Walk(fn func(part *MIMEPart) error) error {
+	if err := fn(p); err != nil {
+		return err
+	}
+
+	for _, part := range p.Parts {
+		if err := part.Walk(fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Attachments returns the attachments among the part and its descendants,
+// depth first
+func (p *MIMEPart) Attachments() []*MIMEPart {
+	var attachments []*MIMEPart
+
+	_ = p.Walk(func(part *MIMEPart) error {
+		if part.Attachment {
+			attachments = append(attachments, part)
+		}
+
+		return nil
+	})
+
+	return attachments
+}
+
+// Bytes serializes the part, as received if it's unchanged. Changed header
+// fields are folded, and added ones follow the received ones. Multiparts are
+// serialized with the boundary of their Content-Type.
+func (p *MIMEPart) Bytes() []byte {
+	if !p.changed() {
+		return p.orig.raw
+	}
+
+	nl := cmp.Or(p.orig.nl, "\r\n")
+
+	var b bytes.Buffer
+
+	b.Write(p.headerBytes(nl))
+
+	_, params, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+
+	if boundary := params["boundary"]; len(p.Parts) > 0 && boundary != "" {
+		b.Write(p.orig.preamble)
+
+		for _, part := range p.Parts {
+			b.WriteString("--" + boundary + nl)
+			b.Write(part.Bytes())
+			b.WriteString(nl)
+		}
+
+		closeNL := p.orig.closeNL
+		if p.orig.raw == nil {
+			closeNL = nl
+		}
+
+		b.WriteString("--" + boundary + "--" + closeNL)
+		b.Write(p.orig.epilogue)
+
+		return b.Bytes()
+	}
+
+	b.Write(p.Body)
+
+	return b.Bytes()
+}
+
+// changed reports whether the part or one of its descendants changed since
+// it was parsed
+func (p *MIMEPart) changed() bool {
+	if p.orig.raw == nil || !headerEqual(p.Header, p.orig.header) || !bytes.Equal(p.Body, p.orig.body) ||
+		!slices.Equal(p.Parts, p.orig.parts) {
+		return true
+	}
+
+	return slices.ContainsFunc(p.Parts, (*MIMEPart).changed)
+}
+
+// headerBytes serializes the header, with the empty line ending it. The
+// received fields are kept as is, in place, unless the values of their name
+// changed: they're then replaced with the new values.
+func (p *MIMEPart) headerBytes(nl string) []byte {
+	if headerEqual(p.Header, p.orig.header) && p.orig.raw != nil {
+		return p.orig.rawHeader
+	}
+
+	var b bytes.Buffer
+
+	field := func(key, value string) {
+		f := wrap([]byte(key + ": " + value + "\r\n"))
+		if nl != "\r\n" {
+			f = bytes.ReplaceAll(f, []byte("\r\n"), []byte(nl))
+		}
+
+		b.Write(f)
+	}
+
+	written := map[string]bool{}
+
+	for _, raw := range headerFields(p.orig.rawHeader) {
+		name, _, _ := bytes.Cut(raw, []byte(":"))
+		key := textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(name)))
+
+		switch {
+		case written[key]:
+		case slices.Equal(p.Header[key], p.orig.header[key]):
+			b.Write(raw)
+		default:
+			// the changed fields are all written in place of the first one
+			for _, value := range p.Header[key] {
+				field(key, value)
+			}
+
+			written[key] = true
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(p.Header)) {
+		if _, ok := p.orig.header[key]; ok {
+			continue
+		}
+
+		for _, value := range p.Header[key] {
+			field(key, value)
+		}
+	}
+
+	b.WriteString(nl)
+
+	return b.Bytes()
+}
+
+// headerFields returns the raw fields of a header, with their folded lines
+// and line endings, excluding the empty line ending it
+func headerFields(header []byte) [][]byte {
+	var fields [][]byte
+
+	start := -1
+
+	for pos := 0; pos < len(header); {
+		end := len(header)
+		if i := bytes.IndexByte(header[pos:], '\n'); i != -1 {
+			end = pos + i + 1
+		}
+
+		line := header[pos:end]
+
+		if start != -1 && line[0] != ' ' && line[0] != '\t' {
+			fields = append(fields, header[start:pos])
+			start = -1
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return fields
+		}
+
+		if start == -1 {
+			start = pos
+		}
+
+		pos = end
+	}
+
+	if start != -1 {
+		fields = append(fields, header[start:])
+	}
+
+	return fields
+}
+
+func headerEqual(a, b textproto.MIMEHeader) bool {
+	return maps.EqualFunc(a, b, slices.Equal)
+}
+
+func cloneHeader(h textproto.MIMEHeader) textproto.MIMEHeader {
+	c := make(textproto.MIMEHeader, len(h))
+	for k, v := range h {
+		c[k] = slices.Clone(v)
+	}
+
+	return c
+}
+
+// readMIMEHeader parses the header of a message or part, ignoring malformed
+// fields
+func readMIMEHeader(header []byte) textproto.MIMEHeader {
+	h, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(header))).ReadMIMEHeader()
+	if h == nil {
+		h = textproto.MIMEHeader{}
+	}
+
+	return h
+}
+
+// cutHeader splits the message or part at the empty line ending its header,
+// which is kept with the header
+func cutHeader(data []byte) (header, body []byte) {
+	for _, sep := range []string{"\r\n", "\n"} {
+		if bytes.HasPrefix(data, []byte(sep)) {
+			return data[:len(sep)], data[len(sep):]
+		}
+	}
+
+	crlf := bytes.Index(data, []byte("\r\n\r\n"))
+	lf := bytes.Index(data, []byte("\n\n"))
+
+	switch {
+	case crlf != -1 && (lf == -1 || crlf < lf):
+		return data[:crlf+4], data[crlf+4:]
+	case lf != -1:
+		return data[:lf+2], data[lf+2:]
+	default:
+		return data, nil
+	}
+}
+
+// partRange is the position of a part in the body of a multipart, excluding
+// the line ending before the next boundary
+type partRange struct {
+	start, end int
+}
+
+// multipartRanges returns the positions of the parts of the multipart body,
+// along with the end of its preamble and the start of its epilogue
+func multipartRanges(body []byte, boundary string) (ranges []partRange, preambleEnd, epilogueStart int) {
+	delimiter := "--" + boundary
+	start := -1
+
+	for pos := 0; pos < len(body); {
+		end := bytes.IndexByte(body[pos:], '\n')
+		next := pos + end + 1
+
+		if end == -1 {
+			end = len(body) - pos
+			next = len(body)
+		}
+
+		line := string(bytes.TrimRight(body[pos:pos+end], " \t\r"))
+
+		if line == delimiter || line == delimiter+"--" {
+			if start == -1 {
+				preambleEnd = pos
+			} else {
+				// the line ending before the delimiter belongs to it
+				partEnd := pos
+				if partEnd > start && body[partEnd-1] == '\n' {
+					partEnd--
+				}
+
+				if partEnd > start && body[partEnd-1] == '\r' {
+					partEnd--
+				}
+
+				ranges = append(ranges, partRange{start: start, end: max(partEnd, start)})
+			}
+
+			if line != delimiter {
+				return ranges, preambleEnd, next
+			}
+
+			start = next
+		}
+
+		pos = next
+	}
+
+	// unterminated multiparts end with the body
+	if start != -1 && start < len(body) {
+		ranges = append(ranges, partRange{start: start, end: len(body)})
+	}
+
+	return ranges, preambleEnd, len(body)
+}
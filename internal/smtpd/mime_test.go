@@ -0,0 +1,180 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMIMEMessage = "From: alice@example.com\r\n" +
+	"Subject: report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"This is a multi-part message in MIME format.\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=C3=A9\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>Caf\xc3\xa9</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"aGVsbG8=\r\n" +
+	"--outer--\r\n" +
+	"epilogue\r\n"
+
+func TestParseMIME(t *testing.T) {
+	t.Parallel()
+
+	msg := ParseMIME([]byte(testMIMEMessage))
+
+	assert.Equal(t, "multipart/mixed", msg.MediaType)
+	assert.Equal(t, "report", msg.Header.Get("Subject"))
+	assert.Nil(t, msg.Body)
+	require.Len(t, msg.Parts, 2)
+
+	alt := msg.Parts[0]
+	assert.Equal(t, "multipart/alternative", alt.MediaType)
+	require.Len(t, alt.Parts, 2)
+
+	text := alt.Parts[0]
+	assert.Equal(t, "text/plain", text.MediaType)
+	assert.Equal(t, "utf-8", text.Params["charset"])
+	assert.False(t, text.Attachment)
+	assert.Equal(t, int64(len("Café")), text.Size)
+
+	decoded, err := text.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, "Café", string(decoded))
+
+	pdf := msg.Parts[1]
+	assert.True(t, pdf.Attachment)
+	assert.Equal(t, "report.pdf", pdf.Filename)
+	assert.Equal(t, "application/pdf", pdf.MediaType)
+	assert.Equal(t, int64(len("%PDF-1.4\nhello")), pdf.Size)
+	assert.Equal(t, []*MIMEPart{pdf}, msg.Attachments())
+
+	decoded, err = pdf.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, "%PDF-1.4\nhello", string(decoded))
+
+	var types []string
+
+	require.NoError(t, msg.Walk(func(part *MIMEPart) error {
+		types = append(types, part.MediaType)
+		return nil
+	}))
+	assert.Equal(t, []string{"multipart/mixed", "multipart/alternative", "text/plain", "text/html", "application/pdf"}, types)
+
+	// unchanged messages are serialized as received
+	assert.Equal(t, testMIMEMessage, string(msg.Bytes()))
+
+	// messages with an empty header or an invalid multipart are leaf parts
+	plain := ParseMIME([]byte("\r\nhello\r\n"))
+	assert.Equal(t, "text/plain", plain.MediaType)
+	assert.Equal(t, "hello\r\n", string(plain.Body))
+
+	broken := ParseMIME([]byte("Content-Type: multipart/mixed; boundary=b\n\nno parts\n"))
+	assert.Empty(t, broken.Parts)
+	assert.Equal(t, "no parts\n", string(broken.Body))
+	assert.False(t, broken.Truncated)
+
+	// multiparts nested too deep are left as truncated leaf parts
+	deep := "Content-Type: text/plain\r\n\r\nhello\r\n"
+	for i := range maxMIMEDepth + 1 {
+		deep = fmt.Sprintf("Content-Type: multipart/mixed; boundary=b%d\r\n\r\n--b%d\r\n%s\r\n--b%d--\r\n", i, i, deep, i)
+	}
+
+	part := ParseMIME([]byte(deep))
+	for range maxMIMEDepth {
+		assert.False(t, part.Truncated)
+		require.Len(t, part.Parts, 1)
+		part = part.Parts[0]
+	}
+
+	assert.Equal(t, "multipart/mixed", part.MediaType)
+	assert.Empty(t, part.Parts)
+	assert.True(t, part.Truncated)
+}
+
+func TestMIMEPartBytes(t *testing.T) {
+	t.Parallel()
+
+	msg := ParseMIME([]byte(testMIMEMessage))
+
+	// the attachment is replaced, and the html part left as is
+	msg.Parts[1] = &MIMEPart{
+		Header: map[string][]string{"Content-Type": {"text/plain"}},
+		Body:   []byte("The attachment was removed."),
+	}
+	msg.Parts[0].Parts[0].Body = []byte("Tea")
+	msg.Header.Set("Subject", "[ext] report")
+	msg.Header.Add("X-Filtered", "yes")
+
+	expected := strings.NewReplacer(
+		"Subject: report\r\n", "Subject: [ext] report\r\n",
+		"Caf=C3=A9\r\n", "Tea\r\n",
+		"Content-Type: application/pdf; name=\"report.pdf\"\r\n"+
+			"Content-Disposition: attachment; filename=\"report.pdf\"\r\n"+
+			"Content-Transfer-Encoding: base64\r\n"+
+			"\r\n"+
+			"JVBERi0xLjQK\r\n"+
+			"aGVsbG8=\r\n", "Content-Type: text/plain\r\n\r\nThe attachment was removed.\r\n",
+		// added fields follow the received ones
+		"boundary=\"outer\"\r\n\r\n", "boundary=\"outer\"\r\nX-Filtered: yes\r\n\r\n",
+	).Replace(testMIMEMessage)
+
+	assert.Equal(t, expected, string(msg.Bytes()))
+
+	// removed fields are dropped, LF line endings kept
+	lf := ParseMIME([]byte("Subject: test\nX-Mailer: foo\n\nhello\n"))
+	lf.Header.Del("X-Mailer")
+	assert.Equal(t, "Subject: test\n\nhello\n", string(lf.Bytes()))
+}
+
+func TestEnvelopeMIME(t *testing.T) {
+	t.Parallel()
+
+	env := &Envelope{Body: strings.NewReader("Subject: test\r\n\r\nhello\r\n")}
+
+	msg, err := env.MIME()
+	require.NoError(t, err)
+	assert.Equal(t, "hello\r\n", string(msg.Body))
+
+	// the parsed message is shared with the next handlers
+	next := *env
+
+	again, err := next.MIME()
+	require.NoError(t, err)
+	assert.Same(t, msg, again)
+
+	// and parsed again once the data changed
+	next.AddHeader("X-Spam", "no")
+
+	again, err = next.MIME()
+	require.NoError(t, err)
+	assert.NotSame(t, msg, again)
+	assert.Equal(t, "no", again.Header.Get("X-Spam"))
+
+	again.Body = bytes.ToUpper(again.Body)
+	next.SetMIME(again)
+
+	assert.Equal(t, "X-Spam: no\r\nSubject: test\r\n\r\nHELLO\r\n", string(next.Data))
+	assert.Equal(t, "test", next.Header.Get("Subject"))
+}
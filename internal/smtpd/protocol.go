@@ -4,16 +4,24 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/md5" //nolint:gosec // required by CRAM-MD5
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/textproto"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"github.com/evidentiq/smtprelay/v2/internal/auth"
 )
 
 type command struct {
@@ -44,10 +52,11 @@ func parseLine(line string) command {
 			// MAIL FROM:<test@example.org>
 			//
 			// Thus, we add a check if the second field ends with ':'
-			// and appends the rest of the third field.
+			// and appends the rest of the third field. Any following
+			// fields (ESMTP parameters) are kept as-is.
 			if cmd.fields[1][len(cmd.fields[1])-1] == ':' && len(cmd.fields) > 2 {
 				cmd.fields[1] += cmd.fields[2]
-				cmd.fields = cmd.fields[0:2]
+				cmd.fields = append(cmd.fields[0:2], cmd.fields[3:]...)
 			}
 
 			cmd.params = strings.Split(cmd.fields[1], ":")
@@ -59,6 +68,49 @@ func parseLine(line string) command {
 	return cmd
 }
 
+// parseParams parses the ESMTP parameters of a MAIL or RCPT command (the
+// fields following the address) into a map of uppercased keywords to values.
+// Keywords without a value map to an empty string.
+func parseParams(fields []string) map[string]string {
+	params := make(map[string]string, len(fields))
+
+	for _, field := range fields {
+		key, value, _ := strings.Cut(field, "=")
+		params[strings.ToUpper(key)] = value
+	}
+
+	return params
+}
+
+// validNotify reports whether s is a valid NOTIFY parameter value: either
+// NEVER, or a comma separated list of SUCCESS, FAILURE and DELAY
+func validNotify(s string) bool {
+	values := strings.Split(strings.ToUpper(s), ",")
+
+	if len(values) == 1 && values[0] == "NEVER" {
+		return true
+	}
+
+	for _, v := range values {
+		if v != "SUCCESS" && v != "FAILURE" && v != "DELAY" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isASCII reports whether s only contains ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (session *session) handle(ctx context.Context, line string) {
 	cmd := parseLine(line)
 
@@ -73,7 +125,7 @@ func (session *session) handle(ctx context.Context, line string) {
 		session.handlePROXY(ctx, cmd)
 	case "HELO":
 		session.handleHELO(ctx, cmd)
-	case "EHLO":
+	case "EHLO", "LHLO":
 		session.handleEHLO(ctx, cmd)
 	case "MAIL":
 		session.handleMAIL(ctx, cmd)
@@ -83,10 +135,16 @@ func (session *session) handle(ctx context.Context, line string) {
 		session.handleSTARTTLS(ctx, cmd)
 	case "DATA":
 		session.handleDATA(ctx, cmd)
+	case "BDAT":
+		session.handleBDAT(ctx, cmd)
 	case "RSET":
 		session.handleRSET(ctx, cmd)
 	case "NOOP":
 		session.handleNOOP(ctx, cmd)
+	case "VRFY":
+		session.handleVRFY(ctx, cmd)
+	case "EXPN":
+		session.handleEXPN(ctx, cmd)
 	case "QUIT":
 		session.handleQUIT(ctx, cmd)
 	case "AUTH":
@@ -94,11 +152,16 @@ func (session *session) handle(ctx context.Context, line string) {
 	case "XCLIENT":
 		session.handleXCLIENT(ctx, cmd)
 	default:
-		session.error(ErrUnsupportedCommand)
+		session.handleCustom(ctx, cmd)
 	}
 }
 
 func (session *session) handleHELO(ctx context.Context, cmd command) {
+	if session.server.LMTP {
+		session.error(ErrUnsupportedCommand)
+		return
+	}
+
 	if len(cmd.fields) < 2 {
 		session.error(ErrMissingParam)
 		return
@@ -119,10 +182,17 @@ func (session *session) handleHELO(ctx context.Context, cmd command) {
 
 	session.peer.HeloName = cmd.fields[1]
 	session.peer.Protocol = SMTP
-	session.reply(250, "Go ahead")
+	session.replyRaw(250, "Go ahead")
 }
 
+// handleEHLO handles both EHLO, and LHLO in LMTP mode, which only differ by
+// their name
 func (session *session) handleEHLO(ctx context.Context, cmd command) {
+	if (cmd.action == "LHLO") != session.server.LMTP {
+		session.error(ErrUnsupportedCommand)
+		return
+	}
+
 	if len(cmd.fields) < 2 {
 		session.error(ErrMissingParam)
 		return
@@ -144,17 +214,23 @@ func (session *session) handleEHLO(ctx context.Context, cmd command) {
 	session.peer.HeloName = cmd.fields[1]
 	session.peer.Protocol = ESMTP
 
+	if session.server.LMTP {
+		session.peer.Protocol = LMTP
+	}
+
 	fmt.Fprintf(session.writer, "250-%s\r\n", session.server.Hostname)
+	session.record("S", "250-"+session.server.Hostname)
 
 	extensions := session.extensions()
 
 	if len(extensions) > 1 {
 		for _, ext := range extensions[:len(extensions)-1] {
 			fmt.Fprintf(session.writer, "250-%s\r\n", ext)
+			session.record("S", "250-"+ext)
 		}
 	}
 
-	session.reply(250, extensions[len(extensions)-1])
+	session.replyRaw(250, extensions[len(extensions)-1])
 }
 
 func (session *session) handleMAIL(ctx context.Context, cmd command) {
@@ -168,7 +244,7 @@ func (session *session) handleMAIL(ctx context.Context, cmd command) {
 		return
 	}
 
-	if session.server.Authenticator != nil && session.peer.Username == "" {
+	if len(session.authMechanisms()) > 0 && session.peer.Username == "" {
 		session.error(ErrAuthRequired)
 		return
 	}
@@ -195,6 +271,71 @@ func (session *session) handleMAIL(ctx context.Context, cmd command) {
 		}
 	}
 
+	env := &Envelope{
+		Sender: addr,
+	}
+
+	params := parseParams(cmd.fields[2:])
+
+	if _, ok := params["SMTPUTF8"]; ok {
+		env.SMTPUTF8 = true
+	}
+
+	if body, ok := params["BODY"]; ok {
+		env.BodyType = strings.ToUpper(body)
+
+		if env.BodyType != Body7Bit && env.BodyType != Body8BitMIME {
+			session.error(ErrInvalidSyntax)
+			return
+		}
+	}
+
+	// messages declared bigger than MaxMessageSize are rejected before their
+	// data is sent
+	if size, ok := params["SIZE"]; ok {
+		env.Size, err = strconv.ParseInt(size, 10, 64)
+		if err != nil || env.Size < 0 {
+			session.error(ErrInvalidSyntax)
+			return
+		}
+
+		if env.Size > int64(session.server.MaxMessageSize) {
+			session.error(fmt.Errorf("%w (max %d bytes)", ErrTooBig, session.server.MaxMessageSize))
+			return
+		}
+	}
+
+	if ret, ok := params["RET"]; ok {
+		env.DSNRet = strings.ToUpper(ret)
+
+		if env.DSNRet != DSNRetFull && env.DSNRet != DSNRetHeaders {
+			session.error(ErrInvalidSyntax)
+			return
+		}
+	}
+
+	if priority, ok := params["MT-PRIORITY"]; ok && session.server.EnableMTPriority {
+		env.Priority, err = strconv.Atoi(priority)
+		if err != nil || env.Priority < MinPriority || env.Priority > MaxPriority {
+			session.error(ErrInvalidSyntax)
+			return
+		}
+	}
+
+	if envid, ok := params["ENVID"]; ok {
+		if envid == "" {
+			session.error(ErrInvalidSyntax)
+			return
+		}
+
+		env.DSNEnvID = envid
+	}
+
+	if !env.SMTPUTF8 && !isASCII(addr) {
+		session.error(ErrNonASCIIAddress)
+		return
+	}
+
 	if session.server.SenderChecker != nil {
 		err = session.server.SenderChecker(ctx, session.peer, addr)
 		if err != nil {
@@ -203,11 +344,9 @@ func (session *session) handleMAIL(ctx context.Context, cmd command) {
 		}
 	}
 
-	session.envelope = &Envelope{
-		Sender: addr,
-	}
+	session.envelope = env
 
-	session.reply(250, "Go ahead")
+	session.replyStatus(250, "2.1.0", "Go ahead")
 }
 
 func (session *session) handleRCPT(ctx context.Context, cmd command) {
@@ -232,8 +371,30 @@ func (session *session) handleRCPT(ctx context.Context, cmd command) {
 		return
 	}
 
+	if !session.envelope.SMTPUTF8 && !isASCII(addr) {
+		session.error(ErrNonASCIIAddress)
+		return
+	}
+
+	params := parseParams(cmd.fields[2:])
+
+	dsn := RecipientDSN{
+		Notify: strings.ToUpper(params["NOTIFY"]),
+		ORcpt:  params["ORCPT"],
+	}
+
+	if _, ok := params["NOTIFY"]; ok && !validNotify(dsn.Notify) {
+		session.error(ErrInvalidSyntax)
+		return
+	}
+
+	if _, ok := params["ORCPT"]; ok && !strings.Contains(dsn.ORcpt, ";") {
+		session.error(ErrInvalidSyntax)
+		return
+	}
+
 	if session.server.RecipientChecker != nil {
-		err = session.server.RecipientChecker(ctx, session.peer, addr)
+		err = session.server.RecipientChecker(context.WithValue(ctx, envelopeContextKey, session.envelope), session.peer, addr)
 		if err != nil {
 			session.error(err)
 			return
@@ -242,10 +403,18 @@ func (session *session) handleRCPT(ctx context.Context, cmd command) {
 
 	session.envelope.Recipients = append(session.envelope.Recipients, addr)
 
-	session.reply(250, "Go ahead")
+	if dsn != (RecipientDSN{}) {
+		if session.envelope.DSN == nil {
+			session.envelope.DSN = map[string]RecipientDSN{}
+		}
+
+		session.envelope.DSN[addr] = dsn
+	}
+
+	session.replyStatus(250, "2.1.5", "Go ahead")
 }
 
-func (session *session) handleSTARTTLS(_ context.Context, _ command) {
+func (session *session) handleSTARTTLS(ctx context.Context, _ command) {
 	if session.tls {
 		session.error(ErrDuplicateSTARTTLS)
 		return
@@ -276,65 +445,317 @@ func (session *session) handleSTARTTLS(_ context.Context, _ command) {
 	session.conn = tlsConn
 	session.reader = bufio.NewReader(tlsConn)
 	session.writer = bufio.NewWriter(tlsConn)
-	session.scanner = bufio.NewScanner(session.reader)
 	session.tls = true
 
 	// Save connection state on peer
-	state := tlsConn.ConnectionState()
-	session.peer.TLS = &state
+	session.tlsState(ctx, tlsConn.ConnectionState())
 
 	// Flush the connection to set new timeout deadlines
 	session.flush()
 }
 
 func (session *session) handleDATA(ctx context.Context, _ command) {
+	if session.bdat != nil {
+		session.error(ErrDATAAfterBDAT)
+		return
+	}
+
 	if session.envelope == nil || len(session.envelope.Recipients) == 0 {
 		session.error(ErrNoRCPT)
 		return
 	}
 
 	session.reply(354, "Go ahead. End your data with <CR><LF>.<CR><LF>")
-	_ = session.conn.SetDeadline(time.Now().Add(session.server.DataTimeout))
+	_ = session.conn.SetDeadline(session.deadline(session.server.DataTimeout))
+
+	var reader io.Reader
+	if session.server.DataMode != DataLenient {
+		reader = newDataReader(session.reader, session.server.DataMode == DataRepair)
+	} else {
+		reader = textproto.NewReader(session.reader).DotReader()
+	}
+
+	if session.server.StreamData {
+		session.streamData(ctx, reader)
+		return
+	}
 
 	data := &bytes.Buffer{}
-	reader := textproto.NewReader(session.reader).DotReader()
 
 	_, err := io.CopyN(data, reader, int64(session.server.MaxMessageSize))
 	if errors.Is(err, io.EOF) {
 		// EOF was reached before MaxMessageSize
 		// Accept and deliver message
-		session.envelope.Data = data.Bytes()
+		session.deliverData(ctx, data.Bytes())
+		return
+	} else if err != nil {
+		session.dataFailed(err)
+		return
+	}
+
+	// Discard the rest and report an error.
+	_, err = io.Copy(io.Discard, reader)
+	if err != nil {
+		session.dataFailed(err)
+		return
+	}
 
-		// re-read to get the MIME header (if any)
-		header, _ := textproto.NewReader(bufio.NewReader(data)).ReadMIMEHeader()
-		session.envelope.Header = header
+	session.replyData(fmt.Errorf("%w (max %d bytes)", ErrTooBig, session.server.MaxMessageSize))
 
-		err = session.deliver(ctx)
-		if err != nil {
-			session.error(err)
+	session.reset()
+}
+
+// dataFailed handles the error reading the message data: the violations of
+// the strict data checks are replied, and the connection is closed after a
+// bare LF as the client may not have sent the end of the data. Other errors
+// are network ones, and ignored.
+func (session *session) dataFailed(err error) {
+	var smtpdError *Error
+	if !errors.As(err, &smtpdError) {
+		return
+	}
+
+	session.replyData(err)
+
+	if errors.Is(err, ErrBareLF) {
+		session.close()
+
+		// what the client sent after the bare LF mustn't be taken for commands
+		session.reader.Reset(session.conn)
+
+		return
+	}
+
+	session.reset()
+}
+
+// handleBDAT implements RFC 3030 CHUNKING. Each BDAT command is immediately
+// followed by exactly size bytes of message data, and the message is delivered
+// once the chunk flagged LAST is received.
+func (session *session) handleBDAT(ctx context.Context, cmd command) {
+	last := len(cmd.fields) == 3 && strings.ToUpper(cmd.fields[2]) == "LAST"
+
+	var size int64
+	var err error
+
+	if len(cmd.fields) == 2 || last {
+		size, err = strconv.ParseInt(cmd.fields[1], 10, 64)
+	}
+
+	if (len(cmd.fields) != 2 && !last) || err != nil || size < 0 {
+		// We can't know where the chunk ends, so there's no way to recover
+		session.error(ErrInvalidSyntax)
+		session.close()
+		return
+	}
+
+	_ = session.conn.SetDeadline(session.deadline(session.server.DataTimeout))
+
+	if session.envelope == nil || len(session.envelope.Recipients) == 0 {
+		if _, err = io.CopyN(io.Discard, session.reader, size); err != nil {
+			// Network error, ignore
+			return
+		}
+
+		session.error(ErrNoRCPT)
+		return
+	}
+
+	if session.bdat == nil {
+		session.bdat = &bytes.Buffer{}
+	}
+
+	if int64(session.bdat.Len())+size > int64(session.server.MaxMessageSize) {
+		// Discard the chunk and fail the transaction - the client must not
+		// send any further chunks after an error
+		if _, err = io.CopyN(io.Discard, session.reader, size); err != nil {
+			// Network error, ignore
+			return
+		}
+
+		err = fmt.Errorf("%w (max %d bytes)", ErrTooBig, session.server.MaxMessageSize)
+
+		// the last chunk completes the message, as DATA
+		if last {
+			session.replyData(err)
 		} else {
-			session.reply(250, "Thank you.")
+			session.error(err)
 		}
 
 		session.reset()
 		return
-	} else if err != nil {
-		// Other network error, ignore
+	}
+
+	if _, err = io.CopyN(session.bdat, session.reader, size); err != nil {
+		// Network error, ignore
 		return
 	}
 
-	// Discard the rest and report an error.
-	_, err = io.Copy(io.Discard, reader)
-	if err != nil {
+	if !last {
+		session.reply(250, fmt.Sprintf("%d bytes received", size))
+		return
+	}
+
+	data := session.bdat.Bytes()
+
+	if session.server.DataMode != DataLenient {
+		data, err = checkChunkedData(data, session.server.DataMode == DataRepair)
+		if err != nil {
+			session.replyData(err)
+			session.reset()
+
+			return
+		}
+	}
+
+	session.deliverData(ctx, data)
+}
+
+// deliverData completes the envelope with the received message data, hands it
+// off to the Handler, and reports the result to the client.
+func (session *session) deliverData(ctx context.Context, data []byte) {
+	if session.server.StreamData {
+		session.envelope.Body = bytes.NewReader(data)
+	} else {
+		session.envelope.Data = data
+	}
+
+	// re-read to get the MIME header (if any)
+	header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	session.envelope.Header = header
+
+	session.replyData(session.deliver(ctx))
+
+	session.reset()
+}
+
+// streamData hands the message data off to the Handler while it's received,
+// once its header is read. The data the Handler didn't read is discarded
+// before replying, as the client sends the whole message anyway.
+func (session *session) streamData(ctx context.Context, reader io.Reader) {
+	body := &sizeLimitReader{r: reader, max: int64(session.server.MaxMessageSize)}
+	br := bufio.NewReader(body)
+
+	// the strict data checks fail once the data ended, handled below
+	var smtpdError *Error
+
+	header, err := readHeader(br)
+	if err != nil && body.err == nil && !errors.As(err, &smtpdError) {
 		// Network error, ignore
 		return
 	}
 
-	session.error(fmt.Errorf("%w (max %d bytes)", ErrTooBig, session.server.MaxMessageSize))
+	var deliverErr error
+
+	if err == nil {
+		session.envelope.Header, _ = textproto.NewReader(bufio.NewReader(bytes.NewReader(header))).ReadMIMEHeader()
+		session.envelope.Body = io.MultiReader(bytes.NewReader(header), br)
+
+		deliverErr = session.deliver(ctx)
+	}
+
+	if _, err = io.Copy(io.Discard, reader); err != nil {
+		session.dataFailed(err)
+		return
+	}
+
+	// the Handler is expected to fail reading the message, but it's too big
+	// whatever it returned
+	if body.err != nil {
+		deliverErr = body.err
+	}
+
+	session.replyData(deliverErr)
 
 	session.reset()
 }
 
+// readHeader reads the raw header of the message, up to and including the
+// empty line separating it from the body
+func readHeader(br *bufio.Reader) ([]byte, error) {
+	var header []byte
+
+	for {
+		line, err := br.ReadBytes('\n')
+		header = append(header, line...)
+
+		if errors.Is(err, io.EOF) {
+			// message without body
+			return header, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return header, nil
+		}
+	}
+}
+
+// sizeLimitReader fails with ErrTooBig once more than max bytes are read
+type sizeLimitReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+	err error
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+
+	// read one byte more than allowed to detect oversized messages
+	if remaining := l.max - l.n + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+
+	if l.n > l.max {
+		l.err = fmt.Errorf("%w (max %d bytes)", ErrTooBig, l.max)
+		return n - int(l.n-l.max), l.err
+	}
+
+	return n, err
+}
+
+// replyData reports the result of the transaction once the message data is
+// complete. In LMTP mode, there's a reply for each recipient, in the order of
+// the RCPT commands.
+func (session *session) replyData(err error) {
+	var rcptErrs RecipientErrors
+	isRcptErrs := errors.As(err, &rcptErrs)
+
+	if !session.server.LMTP {
+		if isRcptErrs {
+			err = rcptErrs.first(session.envelope.Recipients)
+		}
+
+		if err != nil {
+			session.error(err)
+		} else {
+			session.reply(250, "Thank you.")
+		}
+
+		return
+	}
+
+	for _, rcpt := range session.envelope.Recipients {
+		rcptErr := err
+		if isRcptErrs {
+			rcptErr = rcptErrs[rcpt]
+		}
+
+		if rcptErr != nil {
+			session.error(rcptErr)
+		} else {
+			session.replyStatus(250, "2.1.5", fmt.Sprintf("<%s> Thank you.", rcpt))
+		}
+	}
+}
+
 func (session *session) handleRSET(_ context.Context, _ command) {
 	session.reset()
 	session.reply(250, "Go ahead")
@@ -344,6 +765,74 @@ func (session *session) handleNOOP(_ context.Context, _ command) {
 	session.reply(250, "Go ahead")
 }
 
+func (session *session) handleVRFY(ctx context.Context, cmd command) {
+	query, ok := session.verifyQuery(cmd)
+	if !ok {
+		return
+	}
+
+	mailbox := ""
+
+	if session.server.VerifyHandler != nil {
+		var err error
+
+		mailbox, err = session.server.VerifyHandler(ctx, session.peer, query)
+		if err != nil {
+			session.error(err)
+			return
+		}
+	}
+
+	if mailbox == "" {
+		session.reply(252, "Cannot VRFY user, but will accept message and attempt delivery")
+		return
+	}
+
+	session.replyStatus(250, "2.1.5", mailbox)
+}
+
+func (session *session) handleEXPN(ctx context.Context, cmd command) {
+	query, ok := session.verifyQuery(cmd)
+	if !ok {
+		return
+	}
+
+	var mailboxes []string
+
+	if session.server.ExpandHandler != nil {
+		var err error
+
+		mailboxes, err = session.server.ExpandHandler(ctx, session.peer, query)
+		if err != nil {
+			session.error(err)
+			return
+		}
+	}
+
+	if len(mailboxes) == 0 {
+		session.reply(252, "Cannot EXPN list, but will accept message and attempt delivery")
+		return
+	}
+
+	session.replyLines(250, "2.1.5", mailboxes)
+}
+
+// verifyQuery returns the user or address queried with VRFY or EXPN, which are
+// only answered to the clients allowed to send mail, as they disclose it
+func (session *session) verifyQuery(cmd command) (string, bool) {
+	if len(cmd.fields) < 2 {
+		session.error(ErrMissingParam)
+		return "", false
+	}
+
+	if len(session.authMechanisms()) > 0 && session.peer.Username == "" {
+		session.error(ErrAuthRequired)
+		return "", false
+	}
+
+	return strings.Join(cmd.fields[1:], " "), true
+}
+
 func (session *session) handleQUIT(_ context.Context, _ command) {
 	session.reply(221, "OK, bye")
 	session.close()
@@ -355,7 +844,8 @@ func (session *session) handleAUTH(ctx context.Context, cmd command) {
 		return
 	}
 
-	if session.server.Authenticator == nil {
+	mechanisms := session.authMechanisms()
+	if len(mechanisms) == 0 {
 		session.error(ErrUnsupportedCommand)
 		return
 	}
@@ -365,26 +855,49 @@ func (session *session) handleAUTH(ctx context.Context, cmd command) {
 		return
 	}
 
-	if !session.tls {
+	if !session.authAllowed() {
 		session.error(ErrNoSTARTTLS)
 		return
 	}
 
 	mechanism := strings.ToUpper(cmd.fields[1])
 
+	if !slices.Contains(mechanisms, mechanism) {
+		session.logf("unknown authentication mechanism: %s", mechanism)
+		session.error(ErrUnknownAuth)
+		return
+	}
+
+	if session.authLocked("") {
+		return
+	}
+
 	var username string
 	var password string
 
 	switch mechanism {
+	case "CRAM-MD5":
+		// there's no initial response
+		if len(cmd.fields) > 2 {
+			session.error(ErrInvalidSyntax)
+			return
+		}
+
+		session.authCRAMMD5(ctx)
+		return
+	case auth.SCRAMSHA256:
+		session.authSCRAM(ctx, cmd)
+		return
 	case "PLAIN":
 		var auth string
 
 		if len(cmd.fields) < 3 {
 			session.reply(334, "Give me your credentials")
-			if !session.scanner.Scan() {
+
+			var ok bool
+			if auth, ok = session.readContinuation(); !ok {
 				return
 			}
-			auth = session.scanner.Text()
 		} else {
 			auth = cmd.fields[2]
 		}
@@ -410,10 +923,11 @@ func (session *session) handleAUTH(ctx context.Context, cmd command) {
 
 		if len(cmd.fields) < 3 {
 			session.reply(334, "VXNlcm5hbWU6")
-			if !session.scanner.Scan() {
+
+			var ok bool
+			if encodedUsername, ok = session.readContinuation(); !ok {
 				return
 			}
-			encodedUsername = session.scanner.Text()
 		} else {
 			encodedUsername = cmd.fields[2]
 		}
@@ -427,11 +941,12 @@ func (session *session) handleAUTH(ctx context.Context, cmd command) {
 
 		session.reply(334, "UGFzc3dvcmQ6")
 
-		if !session.scanner.Scan() {
+		encodedPassword, ok := session.readContinuation()
+		if !ok {
 			return
 		}
 
-		bytePassword, err := base64.StdEncoding.DecodeString(session.scanner.Text())
+		bytePassword, err := base64.StdEncoding.DecodeString(encodedPassword)
 
 		if err != nil {
 			session.error(ErrMalformedAuth)
@@ -440,15 +955,15 @@ func (session *session) handleAUTH(ctx context.Context, cmd command) {
 
 		username = string(byteUsername)
 		password = string(bytePassword)
-	default:
-		session.logf("unknown authentication mechanism: %s", mechanism)
-		session.error(ErrUnknownAuth)
+	}
+
+	if session.authLocked(username) {
 		return
 	}
 
 	err := session.server.Authenticator(ctx, session.peer, username, password)
 	if err != nil {
-		session.error(err)
+		session.authFailed(ctx, username, err)
 		return
 	}
 
@@ -458,6 +973,127 @@ func (session *session) handleAUTH(ctx context.Context, cmd command) {
 	session.reply(235, "OK, you are now authenticated")
 }
 
+// authCRAMMD5 challenges the client to prove it knows the shared secret of
+// the user, with an HMAC-MD5 digest of a unique challenge (RFC 2195)
+func (session *session) authCRAMMD5(ctx context.Context) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		session.error(ErrBusy)
+		return
+	}
+
+	challenge := fmt.Sprintf("<%x.%d@%s>", nonce, time.Now().Unix(), session.server.Hostname)
+	session.reply(334, base64.StdEncoding.EncodeToString([]byte(challenge)))
+
+	encoded, ok := session.readContinuation()
+	if !ok {
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		session.error(ErrMalformedAuth)
+		return
+	}
+
+	// the digest follows the last space, the username may contain some
+	i := bytes.LastIndexByte(data, ' ')
+	if i == -1 {
+		session.error(ErrMalformedAuth)
+		return
+	}
+
+	username, digest := string(data[:i]), bytes.ToLower(data[i+1:])
+
+	if session.authLocked(username) {
+		return
+	}
+
+	secret, err := session.server.SecretLookup(ctx, session.peer, username)
+	if err != nil {
+		session.authFailed(ctx, username, err)
+		return
+	}
+
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write([]byte(challenge))
+
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), digest) {
+		session.authFailed(ctx, username, ErrAuthInvalid)
+		return
+	}
+
+	session.peer.Username = username
+
+	session.reply(235, "OK, you are now authenticated")
+}
+
+// authSCRAM runs a SCRAM-SHA-256 exchange, in which the client and the server
+// prove each other they know the credentials of the user
+func (session *session) authSCRAM(ctx context.Context, cmd command) {
+	server := auth.NewSCRAMServer(func(username string) (auth.SCRAMCredentials, error) {
+		if session.server.AuthLimiter.locked(session.authIP(), username) != "" {
+			return auth.SCRAMCredentials{}, ErrAuthLocked
+		}
+
+		return session.server.SCRAMLookup(ctx, session.peer, username)
+	})
+
+	var response string
+
+	if len(cmd.fields) < 3 {
+		session.reply(334, "")
+
+		var ok bool
+		if response, ok = session.readContinuation(); !ok {
+			return
+		}
+	} else {
+		response = cmd.fields[2]
+	}
+
+	for {
+		data, err := base64.StdEncoding.DecodeString(response)
+		if err != nil {
+			session.error(ErrMalformedAuth)
+			return
+		}
+
+		challenge, done, err := server.Next(data)
+
+		var smtpdErr *Error
+
+		switch {
+		case errors.As(err, &smtpdErr):
+			session.authFailed(ctx, server.Username(), err)
+			return
+		case errors.Is(err, auth.ErrSCRAMInvalidProof):
+			session.authFailed(ctx, server.Username(), ErrAuthInvalid)
+			return
+		case err != nil:
+			session.error(ErrMalformedAuth)
+			return
+		}
+
+		session.reply(334, base64.StdEncoding.EncodeToString(challenge))
+
+		var ok bool
+		if response, ok = session.readContinuation(); !ok {
+			return
+		}
+
+		// the client acknowledges the server-final message with an empty
+		// response
+		if done {
+			break
+		}
+	}
+
+	session.peer.Username = server.Username()
+
+	session.reply(235, "OK, you are now authenticated")
+}
+
 func (session *session) handleXCLIENT(ctx context.Context, cmd command) {
 	if len(cmd.fields) < 2 {
 		session.error(ErrInvalidSyntax)
@@ -469,6 +1105,11 @@ func (session *session) handleXCLIENT(ctx context.Context, cmd command) {
 		return
 	}
 
+	if !session.trustedProxy() {
+		session.error(ErrUntrustedProxy)
+		return
+	}
+
 	var (
 		newHeloName, newUsername string
 		newProto                 Protocol
@@ -536,14 +1177,20 @@ func (session *session) handleXCLIENT(ctx context.Context, cmd command) {
 		session.peer.HeloName = newHeloName
 	}
 
+	// the address is replaced rather than changed, as it may be the one of
+	// the connection
+	addr := *tcpAddr
+
 	if newAddr != nil {
-		tcpAddr.IP = newAddr
+		addr.IP, addr.Zone = newAddr, ""
 	}
 
 	if newTCPPort != 0 {
-		tcpAddr.Port = int(newTCPPort)
+		addr.Port = int(newTCPPort)
 	}
 
+	session.peer.Addr = &addr
+
 	if newUsername != "" {
 		session.peer.Username = newUsername
 	}
@@ -561,6 +1208,13 @@ func (session *session) handlePROXY(ctx context.Context, cmd command) {
 		return
 	}
 
+	if !session.trustedProxy() {
+		session.error(ErrUntrustedProxy)
+		session.close()
+
+		return
+	}
+
 	if len(cmd.fields) < 6 {
 		session.error(ErrMalformedCommand)
 		return
@@ -581,13 +1235,37 @@ func (session *session) handlePROXY(ctx context.Context, cmd command) {
 		return
 	}
 
+	addr := *tcpAddr
+
 	if newAddr != nil {
-		tcpAddr.IP = newAddr
+		addr.IP, addr.Zone = newAddr, ""
 	}
 
 	if newTCPPort != 0 {
-		tcpAddr.Port = int(newTCPPort)
+		addr.Port = int(newTCPPort)
 	}
 
+	session.peer.Addr = &addr
+
 	session.welcome(ctx)
 }
+
+// readContinuation reads a line sent by the client in response to a 334
+// continuation request. It returns false if the session should stop handling
+// the current command.
+func (session *session) readContinuation() (string, bool) {
+	line, err := session.readLine()
+	if errors.Is(err, bufio.ErrTooLong) {
+		session.error(ErrLineTooLong)
+		return "", false
+	}
+
+	if err != nil {
+		return "", false
+	}
+
+	// the continuations carry the credentials
+	session.record("C", redacted)
+
+	return line, true
+}
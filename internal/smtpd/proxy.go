@@ -0,0 +1,277 @@
+package smtpd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 commands, address families and TLV types
+const (
+	proxyCmdLocal = 0x0
+	proxyCmdProxy = 0x1
+
+	proxyAFInet  = 0x1
+	proxyAFInet6 = 0x2
+	proxyAFUnix  = 0x3
+
+	// length of the source and destination addresses of unix sockets
+	proxyUnixAddrsLen = 216
+
+	pp2TypeALPN       = 0x01
+	pp2TypeAuthority  = 0x02
+	pp2TypeCRC32C     = 0x03
+	pp2TypeUniqueID   = 0x05
+	pp2TypeSSL        = 0x20
+	pp2SubtypeVersion = 0x21
+	pp2SubtypeCN      = 0x22
+	pp2SubtypeCipher  = 0x23
+	pp2SubtypeSigAlg  = 0x24
+	pp2SubtypeKeyAlg  = 0x25
+
+	pp2ClientSSL      = 0x01
+	pp2ClientCertConn = 0x02
+	pp2ClientCertSess = 0x04
+)
+
+// ProxyInfo holds the details of the original connection conveyed by a PROXY
+// protocol v2 header, see Peer.Proxy
+type ProxyInfo struct {
+	LocalAddr net.Addr  // Original destination address, if conveyed
+	Authority string    // Host name requested by the client, e.g. with SNI
+	ALPN      string    // Application protocol negotiated by the client
+	UniqueID  []byte    // Unique ID of the connection, set by the proxy
+	TLS       *ProxyTLS // TLS details, if the proxy terminated TLS
+}
+
+// ProxyTLS holds the details of the TLS connection between the client and the
+// proxy. Sessions aren't considered TLS sessions, for ForceTLS and
+// authentication, as the connection between the proxy and the server may not
+// be encrypted.
+type ProxyTLS struct {
+	Version      string // TLS version, e.g. "TLSv1.3"
+	CipherSuite  string // Cipher suite, e.g. "ECDHE-RSA-AES128-GCM-SHA256"
+	SigAlg       string // Signature algorithm of the server certificate
+	KeyAlg       string // Key algorithm of the server certificate
+	CommonName   string // Common name of the client certificate, if any
+	ClientCert   bool   // Whether the client presented a certificate
+	CertVerified bool   // Whether the client certificate was verified
+}
+
+// isProxyV2 reports whether the client starts with a PROXY protocol v2
+// header, without consuming anything
+func (session *session) isProxyV2() bool {
+	_ = session.conn.SetReadDeadline(session.deadline(session.server.ReadTimeout))
+
+	sig, err := session.reader.Peek(len(proxyV2Signature))
+
+	return err == nil && bytes.Equal(sig, proxyV2Signature)
+}
+
+// handleProxyV2 reads the PROXY protocol v2 header, and applies the source
+// address and details of the original connection to the peer
+func (session *session) handleProxyV2() error {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(session.reader, header); err != nil {
+		return err
+	}
+
+	verCmd, fam := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if verCmd>>4 != 2 {
+		return fmt.Errorf("unsupported version %d", verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(session.reader, payload); err != nil {
+		return err
+	}
+
+	switch verCmd & 0xf {
+	case proxyCmdLocal:
+		// health checks of the proxy itself, keep the connection details
+		return nil
+	case proxyCmdProxy:
+	default:
+		return fmt.Errorf("unsupported command %d", verCmd&0xf)
+	}
+
+	src, dst, tlvs, err := parseProxyAddrs(fam>>4, payload)
+	if err != nil {
+		return err
+	}
+
+	info := &ProxyInfo{LocalAddr: dst}
+
+	if err := info.parseTLVs(tlvs, append(header, payload...)); err != nil {
+		return err
+	}
+
+	if src != nil {
+		session.peer.Addr = src
+	}
+
+	session.peer.Proxy = info
+
+	return nil
+}
+
+// parseProxyAddrs parses the source and destination addresses of the given
+// family, and returns the TLVs which follow them
+func parseProxyAddrs(family byte, payload []byte) (src, dst net.Addr, tlvs []byte, err error) {
+	var ipLen int
+
+	switch family {
+	case proxyAFInet:
+		ipLen = net.IPv4len
+	case proxyAFInet6:
+		ipLen = net.IPv6len
+	case proxyAFUnix:
+		// unix socket addresses aren't conveyed, as the peer address is
+		// expected to be a TCP one
+		if len(payload) < proxyUnixAddrsLen {
+			return nil, nil, nil, errors.New("truncated addresses")
+		}
+
+		return nil, nil, payload[proxyUnixAddrsLen:], nil
+	default:
+		// unspecified, there are no addresses
+		return nil, nil, payload, nil
+	}
+
+	addrsLen := 2*ipLen + 4
+	if len(payload) < addrsLen {
+		return nil, nil, nil, errors.New("truncated addresses")
+	}
+
+	src = &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(payload[:ipLen])),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+
+	dst = &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(payload[ipLen : 2*ipLen])),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+
+	return src, dst, payload[addrsLen:], nil
+}
+
+// parseTLVs parses the TLVs of the header, verifying its checksum if there's
+// one. Unknown TLVs are ignored.
+func (info *ProxyInfo) parseTLVs(tlvs []byte, header []byte) error {
+	offset := len(header) - len(tlvs)
+
+	return walkTLVs(tlvs, func(typ byte, value []byte, pos int) error {
+		switch typ {
+		case pp2TypeALPN:
+			info.ALPN = string(value)
+		case pp2TypeAuthority:
+			info.Authority = string(value)
+		case pp2TypeUniqueID:
+			info.UniqueID = bytes.Clone(value)
+		case pp2TypeCRC32C:
+			if len(value) != 4 {
+				return errors.New("invalid CRC32C length")
+			}
+
+			return verifyProxyChecksum(header, offset+pos, binary.BigEndian.Uint32(value))
+		case pp2TypeSSL:
+			tlsInfo, err := parseProxyTLS(value)
+			if err != nil {
+				return err
+			}
+
+			info.TLS = tlsInfo
+		}
+
+		return nil
+	})
+}
+
+// parseProxyTLS parses the value of a PP2_TYPE_SSL TLV, nil if the client
+// didn't connect over TLS
+func parseProxyTLS(value []byte) (*ProxyTLS, error) {
+	if len(value) < 5 {
+		return nil, errors.New("truncated SSL TLV")
+	}
+
+	client := value[0]
+	if client&pp2ClientSSL == 0 {
+		return nil, nil
+	}
+
+	tlsInfo := &ProxyTLS{
+		ClientCert: client&(pp2ClientCertConn|pp2ClientCertSess) != 0,
+	}
+
+	// verify is 0 if the client certificate was verified
+	tlsInfo.CertVerified = tlsInfo.ClientCert && binary.BigEndian.Uint32(value[1:5]) == 0
+
+	err := walkTLVs(value[5:], func(typ byte, value []byte, _ int) error {
+		switch typ {
+		case pp2SubtypeVersion:
+			tlsInfo.Version = string(value)
+		case pp2SubtypeCN:
+			tlsInfo.CommonName = string(value)
+		case pp2SubtypeCipher:
+			tlsInfo.CipherSuite = string(value)
+		case pp2SubtypeSigAlg:
+			tlsInfo.SigAlg = string(value)
+		case pp2SubtypeKeyAlg:
+			tlsInfo.KeyAlg = string(value)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tlsInfo, nil
+}
+
+// walkTLVs calls f for each TLV, with the position of the TLV in b
+func walkTLVs(b []byte, f func(typ byte, value []byte, pos int) error) error {
+	for pos := 0; pos < len(b); {
+		if len(b)-pos < 3 {
+			return errors.New("truncated TLV")
+		}
+
+		typ := b[pos]
+		length := int(binary.BigEndian.Uint16(b[pos+1:]))
+
+		if len(b)-pos-3 < length {
+			return fmt.Errorf("truncated TLV 0x%02x", typ)
+		}
+
+		if err := f(typ, b[pos+3:pos+3+length], pos); err != nil {
+			return err
+		}
+
+		pos += 3 + length
+	}
+
+	return nil
+}
+
+// verifyProxyChecksum verifies the CRC32C checksum of the whole header, which
+// is computed with the checksum value of the TLV at pos set to zero
+func verifyProxyChecksum(header []byte, pos int, checksum uint32) error {
+	b := bytes.Clone(header)
+	copy(b[pos+3:pos+7], make([]byte, 4))
+
+	if crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli)) != checksum {
+		return errors.New("CRC32C checksum mismatch")
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package smtpd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// proxyV2Header builds a PROXY protocol v2 header, appending a CRC32C TLV if
+// checksum is set
+func proxyV2Header(cmd, fam byte, addrs, tlvs []byte, checksum bool) []byte {
+	payload := append(bytes.Clone(addrs), tlvs...)
+	if checksum {
+		payload = append(payload, pp2TypeCRC32C, 0, 4, 0, 0, 0, 0)
+	}
+
+	b := append(bytes.Clone(proxyV2Signature), 0x20|cmd, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	b = append(b, payload...)
+
+	if checksum {
+		sum := crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli))
+		binary.BigEndian.PutUint32(b[len(b)-4:], sum)
+	}
+
+	return b
+}
+
+func tlv(typ byte, value []byte) []byte {
+	b := []byte{typ}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+
+	return append(b, value...)
+}
+
+func inetAddrs(src, dst string, sport, dport uint16) []byte {
+	b := append(bytes.Clone(net.ParseIP(src).To4()), net.ParseIP(dst).To4()...)
+	b = binary.BigEndian.AppendUint16(b, sport)
+
+	return binary.BigEndian.AppendUint16(b, dport)
+}
+
+func TestParseProxyTLS(t *testing.T) {
+	t.Parallel()
+
+	sub := append(tlv(pp2SubtypeVersion, []byte("TLSv1.3")), tlv(pp2SubtypeCN, []byte("client.example.com"))...)
+	sub = append(sub, tlv(pp2SubtypeCipher, []byte("TLS_AES_128_GCM_SHA256"))...)
+
+	value := append([]byte{pp2ClientSSL | pp2ClientCertConn, 0, 0, 0, 0}, sub...)
+
+	tlsInfo, err := parseProxyTLS(value)
+	require.NoError(t, err)
+	assert.Equal(t, &ProxyTLS{
+		Version:      "TLSv1.3",
+		CipherSuite:  "TLS_AES_128_GCM_SHA256",
+		CommonName:   "client.example.com",
+		ClientCert:   true,
+		CertVerified: true,
+	}, tlsInfo)
+
+	// failed verification
+	value[4] = 1
+	tlsInfo, err = parseProxyTLS(value)
+	require.NoError(t, err)
+	assert.False(t, tlsInfo.CertVerified)
+
+	// not over TLS
+	tlsInfo, err = parseProxyTLS([]byte{0, 0, 0, 0, 0})
+	require.NoError(t, err)
+	assert.Nil(t, tlsInfo)
+
+	_, err = parseProxyTLS([]byte{pp2ClientSSL})
+	require.Error(t, err)
+
+	_, err = parseProxyTLS(append([]byte{pp2ClientSSL, 0, 0, 0, 0}, pp2SubtypeCN, 0, 10, 'x'))
+	require.Error(t, err)
+}
+
+func TestParseProxyAddrs(t *testing.T) {
+	t.Parallel()
+
+	src, dst, tlvs, err := parseProxyAddrs(proxyAFInet, append(inetAddrs("192.0.2.1", "198.51.100.1", 4242, 25), 1, 2))
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:4242", src.String())
+	assert.Equal(t, "198.51.100.1:25", dst.String())
+	assert.Equal(t, []byte{1, 2}, tlvs)
+
+	addrs := append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...)
+	addrs = append(addrs, 0, 1, 0, 25)
+
+	src, dst, _, err = parseProxyAddrs(proxyAFInet6, addrs)
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:1", src.String())
+	assert.Equal(t, "[2001:db8::2]:25", dst.String())
+
+	src, dst, tlvs, err = parseProxyAddrs(proxyAFUnix, make([]byte, proxyUnixAddrsLen+1))
+	require.NoError(t, err)
+	assert.Nil(t, src)
+	assert.Nil(t, dst)
+	assert.Len(t, tlvs, 1)
+
+	_, _, _, err = parseProxyAddrs(proxyAFInet, []byte{1, 2, 3})
+	require.Error(t, err)
+}
+
+func TestProxyInfoTLVs(t *testing.T) {
+	t.Parallel()
+
+	tlvs := append(tlv(pp2TypeAuthority, []byte("mx.example.com")), tlv(pp2TypeUniqueID, []byte{1, 2, 3})...)
+	tlvs = append(tlvs, tlv(0xe0, []byte("custom"))...)
+
+	header := proxyV2Header(proxyCmdProxy, proxyAFInet<<4|1, inetAddrs("192.0.2.1", "198.51.100.1", 4242, 25), tlvs, true)
+	payload := header[16:]
+	tlvs = payload[12:]
+
+	info := &ProxyInfo{}
+	require.NoError(t, info.parseTLVs(tlvs, header))
+	assert.Equal(t, "mx.example.com", info.Authority)
+	assert.Equal(t, []byte{1, 2, 3}, info.UniqueID)
+
+	// corrupted header
+	header[20]++
+	require.Error(t, info.parseTLVs(tlvs, header))
+}
@@ -1,25 +1,40 @@
-// Package smtpd implements an SMTP server with support for STARTTLS, authentication (PLAIN/LOGIN), XCLIENT and optional restrictions on the different stages of the SMTP session.
+// Package smtpd implements an SMTP server with support for STARTTLS, authentication (PLAIN/LOGIN/CRAM-MD5/SCRAM-SHA-256, client certificates), XCLIENT, CHUNKING, ENHANCEDSTATUSCODES, DSN, LMTP and optional restrictions on the different stages of the SMTP session.
 package smtpd
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/textproto"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/evidentiq/smtprelay/v2/internal/auth"
 	"go.opentelemetry.io/otel"
 )
 
 var tracer = otel.Tracer("github.com/evidentiq/smtprelay/v2/internal/smtpd")
 
+// maxLineLength is the maximum length of a line sent by the client
+const maxLineLength = bufio.MaxScanTokenSize
+
+// Session limits, see Server.OnLimit
+const (
+	LimitDuration = "duration" // MaxSessionDuration
+	LimitCommands = "commands" // MaxCommands
+	LimitErrors   = "errors"   // MaxErrors
+)
+
 // Server defines the parameters for running the SMTP server
 //
 //nolint:govet
@@ -35,10 +50,46 @@ type Server struct {
 	MaxMessageSize int // Max message size in bytes. (default: 10240000)
 	MaxRecipients  int // Max RCPT TO calls for each envelope. (default: 100)
 
+	// Limits of each session, to disconnect slow or abusive clients with a
+	// 421 reply: its duration, which is also the deadline of its context,
+	// the number of commands the client sends, and the number of error
+	// replies it gets. Use 0 to disable. (default: 0)
+	MaxSessionDuration time.Duration
+	MaxCommands        int
+	MaxErrors          int
+
+	// Called when a session is ended on one of the limits above, with the
+	// reason: LimitDuration, LimitCommands or LimitErrors. (default: none)
+	OnLimit func(ctx context.Context, peer Peer, reason string)
+
+	// Tarpit the clients getting error replies, e.g. guessing recipients:
+	// from the TarpitAfter-th error reply of a session on, each one is
+	// delayed by TarpitDelay more than the previous one, up to
+	// TarpitMaxDelay. The replies ending the session aren't delayed. Use 0
+	// to disable. (default: 0, TarpitMaxDelay: none)
+	TarpitAfter    int
+	TarpitDelay    time.Duration
+	TarpitMaxDelay time.Duration
+
 	// New e-mails are handed off to this function.
 	// Can be left empty for a NOOP server.
 	// If an error is returned, it will be reported in the SMTP session.
-	Handler func(ctx context.Context, peer Peer, env Envelope) error
+	// Use Chain to run middlewares before it.
+	Handler Handler
+
+	// Hand the message data off to the Handler as Envelope.Body, streaming it
+	// from the client, rather than buffering it in Envelope.Data. BDAT
+	// messages are still buffered, as their chunks come with separate
+	// commands. (default: false)
+	StreamData bool
+
+	// Check the message data strictly: only CRLF.CRLF ends the data of the
+	// DATA command, and messages with lines longer than 998 characters are
+	// rejected. Bare CRs and LFs are rejected with DataReject, or repaired
+	// into line breaks with DataRepair. In reject mode, the connection is
+	// closed after a bare LF, as the client may have meant it to end the data.
+	// (default: DataLenient)
+	DataMode string
 
 	// Enable various checks during the SMTP session.
 	// Can be left empty for no restrictions.
@@ -49,18 +100,84 @@ type Server struct {
 	SenderChecker     func(ctx context.Context, peer Peer, addr string) error // Called after MAIL FROM.
 	RecipientChecker  func(ctx context.Context, peer Peer, addr string) error // Called after each RCPT TO.
 
+	// Wait this long before the greeting, to catch the clients sending data
+	// before it, as spambots do: they're rejected with ErrEarlyTalker, or
+	// EarlyTalkerChecker decides what to do with them. If it returns an
+	// error, it's reported and the session is ended, otherwise the session
+	// goes on. (default: 0, early talkers aren't detected)
+	GreetDelay         time.Duration
+	EarlyTalkerChecker func(ctx context.Context, peer Peer) error
+
+	// Answer VRFY and EXPN (RFC 5321 section 3.5). VerifyHandler returns the
+	// mailbox of the user or address, e.g. "Bob <bob@example.com>", and
+	// ExpandHandler the mailboxes of the mailing list. Return ErrUserUnknown
+	// for unknown users, or an empty result to reply 252 as when they're left
+	// empty: the address can't be verified, but messages to it are accepted.
+	VerifyHandler func(ctx context.Context, peer Peer, query string) (string, error)   // Called on VRFY.
+	ExpandHandler func(ctx context.Context, peer Peer, query string) ([]string, error) // Called on EXPN.
+
 	// Enable PLAIN/LOGIN authentication, only available after STARTTLS.
 	// Can be left empty for no authentication support.
 	Authenticator func(ctx context.Context, peer Peer, username, password string) error
 
+	// Enable CRAM-MD5 authentication (RFC 2195), only available after
+	// STARTTLS. It returns the shared secret of the user, which the client
+	// proves it knows without sending it. Return ErrAuthInvalid for unknown
+	// users. Can be left empty for no CRAM-MD5 support.
+	SecretLookup func(ctx context.Context, peer Peer, username string) (string, error)
+
+	// Enable SCRAM-SHA-256 authentication (RFC 7677), only available after
+	// STARTTLS. It returns the stored credentials of the user, see
+	// auth.NewSCRAMCredentials: neither the password nor anything it could
+	// be recovered from is sent. Return ErrAuthInvalid for unknown users.
+	// Can be left empty for no SCRAM-SHA-256 support.
+	SCRAMLookup func(ctx context.Context, peer Peer, username string) (auth.SCRAMCredentials, error)
+
+	// Enable client certificate authentication: called after the TLS
+	// handshake when the client presented a certificate verified against
+	// TLSConfig.ClientCAs, see tls.VerifyClientCertIfGiven. It returns the
+	// username the client is then authenticated as, without using AUTH.
+	// Errors are logged, and the client may still use AUTH. Can be left
+	// empty for no client certificate authentication.
+	CertAuthenticator func(ctx context.Context, peer Peer, cert *x509.Certificate) (string, error)
+
+	// Limit the failed AUTH attempts of the clients. (default: none)
+	AuthLimiter *AuthLimiter
+
+	// Allow authentication on plaintext connections, e.g. on localhost or
+	// behind a load balancer terminating TLS. Credentials are then sent in
+	// the clear with PLAIN and LOGIN. (default: false)
+	AllowInsecureAuth bool
+
 	EnableXCLIENT       bool // Enable XCLIENT support (default: false)
-	EnableProxyProtocol bool // Enable proxy protocol support (default: false)
+	EnableProxyProtocol bool // Enable proxy protocol v1 and v2 support (default: false)
+	EnableMTPriority    bool // Enable the MT-PRIORITY parameter of MAIL FROM, RFC 6710 (default: false)
+
+	// Networks allowed to send PROXY headers and XCLIENT commands, which are
+	// rejected from other addresses. (default: all)
+	TrustedProxies []*net.IPNet
+
+	// Speak LMTP (RFC 2033) instead of SMTP: clients greet with LHLO, and
+	// get a reply for each recipient after the message data, see
+	// RecipientErrors. (default: false)
+	LMTP bool
+
+	// Additional EHLO keywords, e.g. advertising the commands registered with
+	// RegisterCommand. (default: none)
+	Extensions []string
 
 	TLSConfig *tls.Config // Enable STARTTLS support.
 	ForceTLS  bool        // Force STARTTLS usage.
 
 	ProtocolLogger *log.Logger
 
+	// Transcript optionally returns the writer the transcript of the session
+	// with peer is written to, once the client is welcomed, or nil not to
+	// record it. The transcript has the commands and the replies, without
+	// the message data, and with the AUTH credentials redacted. The writer is
+	// closed when the session ends. (default: none)
+	Transcript func(ctx context.Context, peer Peer) io.WriteCloser
+
 	// ConnContext optionally specifies a function that modifies
 	// the context used for a new connection c. The provided ctx
 	// is derived from the base context.
@@ -71,8 +188,12 @@ type Server struct {
 	mu         sync.Mutex
 	doneChan   chan struct{}
 	listener   *net.Listener
+	sessions   map[*session]*SessionInfo
 	waitgrp    sync.WaitGroup
 	inShutdown atomic.Bool // true when server is in shutdown
+
+	// commands are the custom commands, by verb, guarded by mu
+	commands map[string]CommandHandler
 }
 
 // Protocol represents the protocol used in the SMTP session
@@ -84,17 +205,31 @@ const (
 
 	// Extended SMTP
 	ESMTP = "ESMTP"
+
+	// Local Mail Transfer Protocol
+	LMTP = "LMTP"
 )
 
 // Peer represents the client connecting to the server
 type Peer struct {
 	Addr       net.Addr             // Network address
 	TLS        *tls.ConnectionState // TLS Connection details, if on TLS
+	ClientCert *x509.Certificate    // Verified client certificate, if any
 	HeloName   string               // Server name used in HELO/EHLO command
 	Username   string               // Username from authentication, if authenticated
 	Password   string               // Password from authentication, if authenticated
-	Protocol   Protocol             // Protocol used, SMTP or ESMTP
+	Protocol   Protocol             // Protocol used, SMTP, ESMTP or LMTP
 	ServerName string               // A copy of Server.Hostname
+	Proxy      *ProxyInfo           // Original connection details, if conveyed by a PROXY protocol v2 header
+}
+
+// SessionInfo describes an active session, as returned by Server.Sessions
+type SessionInfo struct {
+	Peer       Peer      // Peer of the session, without its password
+	LocalAddr  net.Addr  // Local address the connection arrived on
+	Started    time.Time // Time the connection was accepted
+	Sender     string    // Sender of the current transaction, if any
+	Recipients []string  // Recipients of the current transaction, if any
 }
 
 // ErrServerClosed is returned by the Server's Serve and ListenAndServe,
@@ -104,8 +239,16 @@ var ErrServerClosed = errors.New("smtp: Server closed")
 var (
 	// similar to net/http's LocalAddrContextKey
 	localAddrContextKey = &struct{}{}
+
+	envelopeContextKey = &contextKey{"envelope"}
 )
 
+// contextKey is a key for context.WithValue, which unlike pointers to empty
+// structs can't compare equal to another key
+type contextKey struct {
+	name string
+}
+
 // LocalAddrFromContext can be used in handlers to access the local address the
 // connection arrived on. If no local address is available, nil is returned.
 func LocalAddrFromContext(ctx context.Context) net.Addr {
@@ -116,6 +259,18 @@ func LocalAddrFromContext(ctx context.Context) net.Addr {
 	return nil
 }
 
+// EnvelopeFromContext can be used in recipient checkers to access the envelope
+// of the current transaction, with its sender and the recipients accepted so
+// far. If there's no transaction, nil is returned. The envelope must not be
+// modified.
+func EnvelopeFromContext(ctx context.Context) *Envelope {
+	if env, ok := ctx.Value(envelopeContextKey).(*Envelope); ok {
+		return env
+	}
+
+	return nil
+}
+
 type session struct {
 	server *Server
 
@@ -123,13 +278,36 @@ type session struct {
 
 	conn net.Conn
 
-	reader  *bufio.Reader
-	writer  *bufio.Writer
-	scanner *bufio.Scanner
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	// bdat holds the message data received so far with BDAT, nil if no
+	// BDAT transaction is in progress
+	bdat *bytes.Buffer
 
 	peer Peer
 
+	// remoteIP is the IP address of the connection, checked by trustedProxy:
+	// the one of the peer may be set by PROXY headers and XCLIENT commands
+	remoteIP net.IP
+
 	tls bool
+
+	started time.Time
+
+	// greeted is set once the client was welcomed, as XCLIENT welcomes it
+	// again
+	greeted bool
+
+	// expires is when the session reaches MaxSessionDuration, zero if it
+	// doesn't
+	expires time.Time
+
+	commands int // sent by the client
+	errors   int // 4xx and 5xx replies
+
+	// transcript records the session, nil if it isn't
+	transcript io.WriteCloser
 }
 
 func (srv *Server) newSession(c net.Conn) *session {
@@ -142,25 +320,18 @@ func (srv *Server) newSession(c net.Conn) *session {
 			Addr:       c.RemoteAddr(),
 			ServerName: srv.Hostname,
 		},
+		started: time.Now(),
 	}
 
-	// Check if the underlying connection is already TLS.
-	// This will happen if the Listerner provided Serve()
-	// is from tls.Listen()
-
-	var tlsConn *tls.Conn
-
-	tlsConn, s.tls = c.(*tls.Conn)
-
-	if s.tls {
-		// run handshake otherwise it's done when we first
-		// read/write and connection state will be invalid
-		_ = tlsConn.Handshake()
-		state := tlsConn.ConnectionState()
-		s.peer.TLS = &state
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		s.remoteIP = slices.Clone(addr.IP)
 	}
 
-	s.scanner = bufio.NewScanner(s.reader)
+	// Check if the underlying connection is already TLS.
+	// This will happen if the Listerner provided Serve()
+	// is from tls.Listen(). The handshake itself is run
+	// when the session starts, outside of the accept loop.
+	_, s.tls = c.(*tls.Conn)
 
 	return s
 }
@@ -181,6 +352,27 @@ func (srv *Server) ListenAndServe(ctx context.Context, addr string) error {
 	return srv.Serve(ctx, l)
 }
 
+// ListenAndServeTLS starts the SMTP server and listens on addr for implicit
+// TLS (SMTPS) connections, using ctx as the base context for incoming requests.
+// TLSConfig must be set and contain at least one certificate.
+func (srv *Server) ListenAndServeTLS(ctx context.Context, addr string) error {
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
+
+	if srv.TLSConfig == nil {
+		return errors.New("smtp: TLSConfig is required for ListenAndServeTLS")
+	}
+
+	lc := net.ListenConfig{}
+	l, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(ctx, tls.NewListener(l, srv.TLSConfig))
+}
+
 // Serve starts the SMTP server and listens on l, using ctx as the base context
 // for incoming requests.
 func (srv *Server) Serve(ctx context.Context, l net.Listener) error {
@@ -296,6 +488,38 @@ func (srv *Server) Wait() error {
 	return nil
 }
 
+// Close shuts the server down like Shutdown, then closes the connections of
+// the active sessions without waiting for them to finish.
+func (srv *Server) Close() error {
+	lnerr := srv.Shutdown(false)
+
+	srv.mu.Lock()
+	for s := range srv.sessions {
+		_ = s.conn.Close()
+	}
+	srv.mu.Unlock()
+
+	return lnerr
+}
+
+// Sessions returns the active sessions of the server, oldest first. Their
+// state is updated after each command.
+func (srv *Server) Sessions() []SessionInfo {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	sessions := make([]SessionInfo, 0, len(srv.sessions))
+	for _, info := range srv.sessions {
+		sessions = append(sessions, *info)
+	}
+
+	slices.SortFunc(sessions, func(a, b SessionInfo) int {
+		return a.Started.Compare(b.Started)
+	})
+
+	return sessions
+}
+
 // Address returns the listening address of the server
 func (srv *Server) Address() net.Addr {
 	return (*srv.listener).Addr()
@@ -334,6 +558,10 @@ func (srv *Server) configureDefaults() {
 		srv.Hostname = "localhost.localdomain"
 	}
 
+	if srv.WelcomeMessage == "" && srv.LMTP {
+		srv.WelcomeMessage = srv.Hostname + " LMTP ready."
+	}
+
 	if srv.WelcomeMessage == "" {
 		srv.WelcomeMessage = srv.Hostname + " ESMTP ready."
 	}
@@ -345,44 +573,180 @@ func (session *session) serve(ctx context.Context) {
 
 	defer session.close()
 
+	session.track()
+	defer session.untrack()
+
 	ctx = context.WithValue(ctx, localAddrContextKey, session.conn.LocalAddr())
 
+	if d := session.server.MaxSessionDuration; d > 0 {
+		session.expires = session.started.Add(d)
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, session.expires)
+		defer cancel()
+	}
+
 	if ctx.Err() != nil {
 		session.reject()
 		return
 	}
 
-	if !session.server.EnableProxyProtocol {
+	if tlsConn, ok := session.conn.(*tls.Conn); ok {
+		// run handshake otherwise it's done when we first
+		// read/write and connection state will be invalid
+		_ = tlsConn.SetDeadline(session.deadline(session.server.ReadTimeout))
+
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			session.logError(err, "couldn't perform handshake")
+			return
+		}
+
+		session.tlsState(ctx, tlsConn.ConnectionState())
+	}
+
+	switch {
+	case !session.server.EnableProxyProtocol:
+		session.welcome(ctx)
+	case session.isProxyV2():
+		if !session.trustedProxy() {
+			session.error(ErrUntrustedProxy)
+			return
+		}
+
+		if err := session.handleProxyV2(); err != nil {
+			// there's no way to find where the header ends
+			session.logError(err, "invalid PROXY protocol v2 header")
+			session.error(ErrMalformedCommand)
+
+			return
+		}
+
 		session.welcome(ctx)
 	}
 
 	for {
-		for session.scanner.Scan() {
-			line := session.scanner.Text()
-			session.logf("received: %s", strings.TrimSpace(line))
-			session.handle(ctx, line)
-		}
+		line, err := session.readLine()
 
-		err := session.scanner.Err()
+		// the deadlines of the connection don't go past the session's
+		if session.expired() {
+			session.limitReached(ctx, LimitDuration, ErrSessionExpired)
+			break
+		}
 
 		if errors.Is(err, bufio.ErrTooLong) {
 			session.error(ErrLineTooLong)
 
+			// Reset and have the client start over.
+			session.reset()
+
+			continue
+		}
+
+		if err != nil {
+			break
+		}
+
+		session.commands++
+		if limit := session.server.MaxCommands; limit > 0 && session.commands > limit {
+			session.limitReached(ctx, LimitCommands, ErrTooManyCommands)
+			break
+		}
+
+		session.logf("received: %s", redactAUTH(strings.TrimSpace(line)))
+		session.record("C", redactAUTH(strings.TrimSpace(line)))
+		session.handle(ctx, line)
+		session.track()
+
+		if limit := session.server.MaxErrors; limit > 0 && session.errors >= limit {
+			session.limitReached(ctx, LimitErrors, ErrTooManyErrors)
+			break
+		}
+	}
+}
+
+// readLine reads a single line sent by the client, without the line ending.
+// Lines are read directly from the buffered reader rather than with a
+// bufio.Scanner, so that nothing past the end of the line is consumed - BDAT
+// chunks immediately follow the command line.
+//
+// Lines longer than maxLineLength are discarded, and bufio.ErrTooLong is
+// returned.
+func (session *session) readLine() (string, error) {
+	var line []byte
+
+	for {
+		chunk, err := session.reader.ReadSlice('\n')
+
+		if len(line)+len(chunk) > maxLineLength {
 			// Advance reader to the next newline
+			for errors.Is(err, bufio.ErrBufferFull) {
+				_, err = session.reader.ReadSlice('\n')
+			}
 
-			_, _ = session.reader.ReadString('\n')
-			session.scanner = bufio.NewScanner(session.reader)
+			if err != nil {
+				return "", err
+			}
 
-			// Reset and have the client start over.
+			return "", bufio.ErrTooLong
+		}
 
-			session.reset()
+		line = append(line, chunk...)
 
+		if errors.Is(err, bufio.ErrBufferFull) {
 			continue
 		}
 
+		if err != nil {
+			return "", err
+		}
+
 		break
 	}
 
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+
+	return string(line), nil
+}
+
+// track updates the state of the session returned by Server.Sessions
+func (session *session) track() {
+	info := &SessionInfo{
+		Peer:      session.peer,
+		LocalAddr: session.conn.LocalAddr(),
+		Started:   session.started,
+	}
+
+	info.Peer.Password = ""
+
+	if session.envelope != nil {
+		info.Sender = session.envelope.Sender
+		info.Recipients = slices.Clone(session.envelope.Recipients)
+	}
+
+	session.server.setSession(session, info)
+}
+
+// untrack removes the session from the ones returned by Server.Sessions
+func (session *session) untrack() {
+	session.server.setSession(session, nil)
+}
+
+// setSession sets the state of the session, removing it if info is nil
+func (srv *Server) setSession(s *session, info *SessionInfo) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if info == nil {
+		delete(srv.sessions, s)
+		return
+	}
+
+	if srv.sessions == nil {
+		srv.sessions = map[*session]*SessionInfo{}
+	}
+
+	srv.sessions[s] = info
 }
 
 func (session *session) reject() {
@@ -392,9 +756,21 @@ func (session *session) reject() {
 
 func (session *session) reset() {
 	session.envelope = nil
+	session.bdat = nil
 }
 
 func (session *session) welcome(ctx context.Context) {
+	session.openTranscript(ctx)
+
+	if !session.greeted {
+		session.greeted = true
+
+		if !session.greetDelay(ctx) {
+			session.close()
+			return
+		}
+	}
+
 	if session.server.ConnectionChecker != nil {
 		err := session.server.ConnectionChecker(ctx, session.peer)
 		if err != nil {
@@ -404,30 +780,187 @@ func (session *session) welcome(ctx context.Context) {
 		}
 	}
 
-	session.reply(220, session.server.WelcomeMessage)
+	session.replyRaw(220, session.server.WelcomeMessage)
+}
+
+// greetDelay waits GreetDelay before the greeting, checking whether the
+// client sends data meanwhile. It returns false if the session must end.
+func (session *session) greetDelay(ctx context.Context) bool {
+	if session.server.GreetDelay <= 0 {
+		return true
+	}
+
+	// the data isn't consumed, to be read as commands if the session goes on
+	_ = session.conn.SetReadDeadline(session.deadline(session.server.GreetDelay))
+
+	_, err := session.reader.Peek(1)
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+
+	if err != nil {
+		return false
+	}
+
+	session.logf("client sent data before the greeting")
+	session.record("--", "client sent data before the greeting")
+
+	if session.server.EarlyTalkerChecker == nil {
+		session.error(ErrEarlyTalker)
+		return false
+	}
+
+	if err := session.server.EarlyTalkerChecker(ctx, session.peer); err != nil {
+		session.error(err)
+		return false
+	}
+
+	return true
 }
 
+// reply sends a reply with a generic enhanced status code (RFC 2034)
 func (session *session) reply(code int, message string) {
+	session.replyStatus(code, "", message)
+}
+
+// replyStatus sends a reply with the given enhanced status code. Enhanced
+// status codes are only used for 2xx, 4xx and 5xx replies.
+func (session *session) replyStatus(code int, enhancedCode, message string) {
+	session.replyRaw(code, statusMessage(code, enhancedCode, message))
+}
+
+// replyLines sends a multiline reply, with the enhanced status code on each
+// line
+func (session *session) replyLines(code int, enhancedCode string, lines []string) {
+	for _, line := range lines[:len(lines)-1] {
+		line = statusMessage(code, enhancedCode, line)
+
+		session.logf("sending: %d-%s", code, line)
+		session.record("S", fmt.Sprintf("%d-%s", code, line))
+		_, _ = fmt.Fprintf(session.writer, "%d-%s\r\n", code, line)
+	}
+
+	session.replyStatus(code, enhancedCode, lines[len(lines)-1])
+}
+
+// statusMessage prefixes the message with the enhanced status code, for 2xx,
+// 4xx and 5xx replies
+func statusMessage(code int, enhancedCode, message string) string {
+	if class := code / 100; class == 2 || class == 4 || class == 5 {
+		return withEnhancedCode(code, enhancedCode, message)
+	}
+
+	return message
+}
+
+// replyRaw sends a reply without an enhanced status code, as used for the
+// greeting and HELO/EHLO replies.
+func (session *session) replyRaw(code int, message string) {
+	if code >= 400 {
+		session.countError(code)
+	}
+
 	session.logf("sending: %d %s", code, message)
+	session.record("S", fmt.Sprintf("%d %s", code, message))
 	_, _ = fmt.Fprintf(session.writer, "%d %s\r\n", code, message)
 	session.flush()
 }
 
 func (session *session) flush() {
-	_ = session.conn.SetWriteDeadline(time.Now().Add(session.server.WriteTimeout))
+	_ = session.conn.SetWriteDeadline(session.deadline(session.server.WriteTimeout))
 	session.writer.Flush()
-	_ = session.conn.SetReadDeadline(time.Now().Add(session.server.ReadTimeout))
+	_ = session.conn.SetReadDeadline(session.deadline(session.server.ReadTimeout))
+}
+
+// deadline returns the deadline of an operation on the connection taking up
+// to timeout, which doesn't go past the end of the session
+func (session *session) deadline(timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	if !session.expires.IsZero() && session.expires.Before(deadline) {
+		return session.expires
+	}
+
+	return deadline
+}
+
+// expired reports whether the session reached MaxSessionDuration
+func (session *session) expired() bool {
+	return !session.expires.IsZero() && !time.Now().Before(session.expires)
+}
+
+// countError counts an error reply with code, and tarpits the client before
+// it's sent once it got TarpitAfter of them
+func (session *session) countError(code int) {
+	session.errors++
+
+	after := session.server.TarpitAfter
+	if after <= 0 || session.errors < after || session.server.TarpitDelay <= 0 || code == 421 {
+		return
+	}
+
+	delay := time.Duration(session.errors-after+1) * session.server.TarpitDelay
+	if limit := session.server.TarpitMaxDelay; limit > 0 && delay > limit {
+		delay = limit
+	}
+
+	if !session.expires.IsZero() {
+		delay = min(delay, time.Until(session.expires))
+	}
+
+	if delay <= 0 {
+		return
+	}
+
+	session.logf("tarpitting for %s", delay)
+	session.record("--", "tarpitting for "+delay.String())
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	// the delay is cut short on shutdown
+	select {
+	case <-timer.C:
+	case <-session.server.getDoneChan():
+	}
+}
+
+// limitReached ends the session on one of the limits, replying err to the
+// client
+func (session *session) limitReached(ctx context.Context, reason string, err error) {
+	session.logf("session limit reached: %s", reason)
+	session.record("--", "session limit reached: "+reason)
+
+	// the last reply gets its own deadline, past the end of the session
+	session.expires = time.Time{}
+	session.error(err)
+
+	if session.server.OnLimit != nil {
+		session.server.OnLimit(ctx, session.peer, reason)
+	}
 }
 
 func (session *session) error(err error) {
-	var smtpdError *textproto.Error
-	if errors.As(err, &smtpdError) {
-		// session.reply(smtpdError.Code, err.Error())
-		// the error code will be prefixed in the error message
+	var smtpdError *Error
+	var tpError *textproto.Error
+
+	switch {
+	case errors.As(err, &smtpdError) && strings.Contains(smtpdError.Msg, "\n"):
+		session.replyLines(smtpdError.Code, smtpdError.EnhancedCode, strings.Split(smtpdError.Msg, "\n"))
+	case errors.As(err, &smtpdError):
+		if smtpdError.Code >= 400 {
+			session.countError(smtpdError.Code)
+		}
+
+		// the reply and enhanced status codes are prefixed in the error message
 		session.logf("sending: %s", err)
+		session.record("S", err.Error())
 		_, _ = fmt.Fprintf(session.writer, "%s\r\n", err)
 		session.flush()
-	} else {
+	case errors.As(err, &tpError):
+		session.reply(tpError.Code, tpError.Msg)
+	default:
 		session.reply(502, err.Error())
 	}
 }
@@ -453,9 +986,19 @@ func (session *session) extensions() []string {
 		fmt.Sprintf("SIZE %d", session.server.MaxMessageSize),
 		"8BITMIME",
 		"PIPELINING",
+		"CHUNKING",
+		"SMTPUTF8",
+		"ENHANCEDSTATUSCODES",
+		"DSN",
 	}
 
-	if session.server.EnableXCLIENT {
+	if session.server.EnableMTPriority {
+		extensions = append(extensions, "MT-PRIORITY")
+	}
+
+	extensions = append(extensions, session.server.Extensions...)
+
+	if session.server.EnableXCLIENT && session.trustedProxy() {
 		extensions = append(extensions, "XCLIENT")
 	}
 
@@ -463,13 +1006,85 @@ func (session *session) extensions() []string {
 		extensions = append(extensions, "STARTTLS")
 	}
 
-	if session.server.Authenticator != nil && session.tls {
-		extensions = append(extensions, "AUTH PLAIN LOGIN")
+	if mechanisms := session.authMechanisms(); len(mechanisms) > 0 && session.authAllowed() {
+		extensions = append(extensions, "AUTH "+strings.Join(mechanisms, " "))
 	}
 
 	return extensions
 }
 
+// authMechanisms returns the enabled authentication mechanisms
+func (session *session) authMechanisms() []string {
+	var mechanisms []string
+
+	if session.server.Authenticator != nil {
+		mechanisms = append(mechanisms, "PLAIN", "LOGIN")
+	}
+
+	if session.server.SecretLookup != nil {
+		mechanisms = append(mechanisms, "CRAM-MD5")
+	}
+
+	if session.server.SCRAMLookup != nil {
+		mechanisms = append(mechanisms, auth.SCRAMSHA256)
+	}
+
+	return mechanisms
+}
+
+// tlsState saves the state of the TLS connection on the peer, and
+// authenticates the client with its certificate if it sent one
+func (session *session) tlsState(ctx context.Context, state tls.ConnectionState) {
+	session.peer.TLS = &state
+	session.record("--", "started "+tlsNote(state))
+
+	// only certificates verified against ClientCAs can be trusted
+	if len(state.VerifiedChains) == 0 {
+		return
+	}
+
+	session.peer.ClientCert = state.VerifiedChains[0][0]
+
+	if session.server.CertAuthenticator == nil {
+		return
+	}
+
+	username, err := session.server.CertAuthenticator(ctx, session.peer, session.peer.ClientCert)
+	if err != nil {
+		session.logError(err, "client certificate rejected")
+		return
+	}
+
+	session.peer.Username = username
+}
+
+// authAllowed reports whether the connection is secure enough to
+// authenticate
+func (session *session) authAllowed() bool {
+	return session.tls || session.server.AllowInsecureAuth
+}
+
+// trustedProxy reports whether the client is allowed to send PROXY headers
+// and XCLIENT commands. The address of the connection is checked, rather than
+// the one of the peer, which these may have changed.
+func (session *session) trustedProxy() bool {
+	if len(session.server.TrustedProxies) == 0 {
+		return true
+	}
+
+	if session.remoteIP == nil {
+		return false
+	}
+
+	for _, trusted := range session.server.TrustedProxies {
+		if trusted.Contains(session.remoteIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (session *session) deliver(ctx context.Context) error {
 	if session.server.Handler != nil {
 		return session.server.Handler(ctx, session.peer, *session.envelope)
@@ -480,6 +1095,7 @@ func (session *session) deliver(ctx context.Context) error {
 
 func (session *session) close() {
 	session.writer.Flush()
+	session.closeTranscript()
 	time.Sleep(200 * time.Millisecond)
 	session.conn.Close()
 }
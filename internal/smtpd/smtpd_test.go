@@ -3,18 +3,27 @@ package smtpd_test
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/big"
 	"net"
 	"net/smtp"
 	"net/textproto"
 	"os"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/evidentiq/smtprelay/v2/internal/auth"
 	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -124,6 +133,22 @@ func cmd(c *textproto.Conn, expectedCode int, format string, args ...interface{}
 	return err
 }
 
+// bdat sends a BDAT command and its chunk as-is, as textproto.Conn.Cmd would
+// append a line ending to the chunk
+func bdat(c *textproto.Conn, expectedCode int, chunk string) error {
+	if _, err := c.W.WriteString(chunk); err != nil {
+		return err
+	}
+
+	if err := c.W.Flush(); err != nil {
+		return err
+	}
+
+	_, _, err := c.ReadResponse(expectedCode)
+
+	return err
+}
+
 func runserver(t *testing.T, server *smtpd.Server) (addr string, closer func()) {
 	t.Helper()
 
@@ -353,6 +378,72 @@ func TestAuthRejection(t *testing.T) {
 	require.Error(t, err, "Auth worked despite rejection")
 }
 
+func TestAuthLimiter(t *testing.T) {
+	t.Parallel()
+
+	locks := make(chan string, 2)
+
+	addr, closer := runserver(t, &smtpd.Server{
+		Authenticator: func(_ context.Context, _ smtpd.Peer, username, password string) error {
+			if username != "foo" || password != "bar" {
+				return smtpd.ErrAuthInvalid
+			}
+
+			return nil
+		},
+		AuthLimiter: &smtpd.AuthLimiter{
+			MaxFailures: 3,
+			Delay:       50 * time.Millisecond,
+			MaxDelay:    80 * time.Millisecond,
+			Lockout:     500 * time.Millisecond,
+			OnLockout: func(_ context.Context, _ smtpd.Peer, kind, key string) {
+				locks <- kind + " " + key
+			},
+		},
+		AllowInsecureAuth: true,
+		ProtocolLogger:    log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	dial := func() *textproto.Conn {
+		c, err := textproto.Dial("tcp", addr)
+		require.NoError(t, err)
+
+		t.Cleanup(func() { _ = c.Close() })
+
+		_, _, err = c.ReadResponse(220)
+		require.NoError(t, err)
+		require.NoError(t, cmd(c, 250, "HELO localhost"))
+
+		return c
+	}
+
+	timed := func(c *textproto.Conn, code int, command string) time.Duration {
+		start := time.Now()
+		require.NoError(t, cmd(c, code, command))
+
+		return time.Since(start)
+	}
+
+	// the failures are delayed, doubling up to the max delay
+	c := dial()
+	assert.InDelta(t, 50*time.Millisecond, timed(c, 535, "AUTH PLAIN AGZvbwBiYXo="), float64(25*time.Millisecond))
+	assert.InDelta(t, 80*time.Millisecond, timed(c, 535, "AUTH PLAIN AGZvbwBiYXo="), float64(25*time.Millisecond))
+
+	// the third one locks both the IP and the username
+	require.ErrorContains(t, cmd(c, 535, "AUTH PLAIN AGZvbwBiYXo="), "Too many authentication failures")
+	assert.ElementsMatch(t, []string{"ip 127.0.0.1", "username foo"}, []string{<-locks, <-locks})
+
+	// even valid credentials are refused until the lockout ends
+	c = dial()
+	require.ErrorContains(t, cmd(c, 235, "AUTH PLAIN AGZvbwBiYXI="), "Too many authentication failures")
+
+	time.Sleep(500 * time.Millisecond)
+
+	c = dial()
+	require.NoError(t, cmd(c, 235, "AUTH PLAIN AGZvbwBiYXI="))
+}
+
 func TestAuthNotSupported(t *testing.T) {
 	t.Parallel()
 
@@ -394,6 +485,139 @@ func TestAuthBypass(t *testing.T) {
 	require.Error(t, err, "MAIL succeeded despite AuthBypass")
 }
 
+func TestInsecureAuth(t *testing.T) {
+	t.Parallel()
+
+	authenticator := func(_ context.Context, _ smtpd.Peer, username, password string) error {
+		if username != "foo" || password != "bar" {
+			return smtpd.ErrAuthInvalid
+		}
+
+		return nil
+	}
+
+	// AUTH needs TLS by default
+	addr, closer := runserver(t, &smtpd.Server{
+		Authenticator:  authenticator,
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Hello("localhost"))
+
+	supported, _ := c.Extension("AUTH")
+	assert.False(t, supported, "AUTH advertised without TLS")
+
+	require.NoError(t, cmd(c.Text, 502, "AUTH PLAIN AGZvbwBiYXI="))
+
+	addr, closer = runserver(t, &smtpd.Server{
+		Authenticator:     authenticator,
+		AllowInsecureAuth: true,
+		ProtocolLogger:    log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err = smtp.Dial(addr)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Hello("localhost"))
+
+	_, mechs := c.Extension("AUTH")
+	assert.Equal(t, "PLAIN LOGIN", mechs)
+
+	require.NoError(t, c.Auth(smtp.PlainAuth("", "foo", "bar", "127.0.0.1")))
+	require.NoError(t, c.Mail("sender@example.org"))
+	require.NoError(t, c.Quit())
+}
+
+// clientCert returns a self-signed client certificate, and the pool trusting
+// it
+func clientCert(t *testing.T, cn string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestCertAuth(t *testing.T) {
+	t.Parallel()
+
+	cert, err := tls.X509KeyPair(localhostCert, localhostKey)
+	require.NoError(t, err)
+
+	client, pool := clientCert(t, "app.example.com")
+	other, _ := clientCert(t, "other.example.com")
+
+	addr, closer := runserver(t, &smtpd.Server{
+		TLSConfig: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		},
+		Authenticator: func(_ context.Context, _ smtpd.Peer, _, _ string) error {
+			return smtpd.ErrAuthInvalid
+		},
+		CertAuthenticator: func(_ context.Context, peer smtpd.Peer, cert *x509.Certificate) (string, error) {
+			assert.Equal(t, cert, peer.ClientCert)
+			return cert.Subject.CommonName, nil
+		},
+		SenderChecker: func(_ context.Context, peer smtpd.Peer, _ string) error {
+			assert.Equal(t, "app.example.com", peer.Username)
+			return nil
+		},
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	dial := func(certs ...tls.Certificate) *smtp.Client {
+		c, err := smtp.Dial(addr)
+		require.NoError(t, err)
+
+		//nolint:gosec
+		err = c.StartTLS(&tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		require.NoError(t, err)
+
+		return c
+	}
+
+	// no AUTH needed with a verified certificate
+	c := dial(client)
+	require.NoError(t, c.Mail("sender@example.org"))
+	require.NoError(t, c.Quit())
+
+	// without certificate
+	c = dial()
+	require.Error(t, c.Mail("sender@example.org"))
+
+	// the certificate isn't signed by a trusted CA, so the client doesn't
+	// even send it
+	c = dial(other)
+	require.Error(t, c.Mail("sender@example.org"))
+}
+
 func TestConnectionCheck(t *testing.T) {
 	t.Parallel()
 
@@ -483,6 +707,47 @@ func TestRecipientCheck(t *testing.T) {
 	require.Error(t, err, "RCPT succeeded despite RecipientCheck")
 }
 
+func TestRecipientCheckEnvelope(t *testing.T) {
+	t.Parallel()
+
+	var (
+		senders    []string
+		recipients [][]string
+		localAddrs []net.Addr
+	)
+
+	addr, closer := runserver(t, &smtpd.Server{
+		RecipientChecker: func(ctx context.Context, _ smtpd.Peer, _ string) error {
+			if env := smtpd.EnvelopeFromContext(ctx); env != nil {
+				senders = append(senders, env.Sender)
+				recipients = append(recipients, slices.Clone(env.Recipients))
+			}
+
+			// the envelope doesn't hide the other values of the context
+			localAddrs = append(localAddrs, smtpd.LocalAddrFromContext(ctx))
+
+			return nil
+		},
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Mail("sender@example.org"))
+	require.NoError(t, c.Rcpt("alice@example.net"))
+	require.NoError(t, c.Rcpt("bob@example.net"))
+	require.NoError(t, c.Quit())
+
+	assert.Equal(t, []string{"sender@example.org", "sender@example.org"}, senders)
+	assert.Equal(t, [][]string{nil, {"alice@example.net"}}, recipients)
+	assert.Equal(t, []net.Addr{localAddrs[0], localAddrs[0]}, localAddrs)
+	assert.NotNil(t, localAddrs[0])
+
+	assert.Nil(t, smtpd.EnvelopeFromContext(context.Background()))
+}
+
 func TestMaxMessageSize(t *testing.T) {
 	t.Parallel()
 
@@ -514,6 +779,57 @@ func TestMaxMessageSize(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestMailSize(t *testing.T) {
+	t.Parallel()
+
+	var env smtpd.Envelope
+
+	addr, closer := runserver(t, &smtpd.Server{
+		MaxMessageSize: 100,
+		Handler: func(_ context.Context, _ smtpd.Peer, e smtpd.Envelope) error {
+			env = e
+			return nil
+		},
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	err = c.Hello("localhost")
+	require.NoError(t, err)
+
+	_, param := c.Extension("SIZE")
+	require.Equal(t, "100", param)
+
+	for _, size := range []string{"", "-1", "big"} {
+		err = cmd(c.Text, 502, "MAIL FROM:<sender@example.org> SIZE="+size)
+		require.NoError(t, err, size)
+	}
+
+	// messages declared too big are rejected before their data is sent
+	err = cmd(c.Text, 552, "MAIL FROM:<sender@example.org> SIZE=101")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 250, "MAIL FROM:<sender@example.org> SIZE=100")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 250, "RCPT TO:<recipient@example.net>")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 354, "DATA")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 250, "Subject: test\r\n\r\nhello\r\n.")
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(100), env.Size)
+
+	err = c.Quit()
+	require.NoError(t, err)
+}
+
 func TestHandler(t *testing.T) {
 	t.Parallel()
 
@@ -553,150 +869,1018 @@ func TestHandler(t *testing.T) {
 	require.NoError(t, err)
 }
 
-func TestRejectHandler(t *testing.T) {
+func TestStreamData(t *testing.T) {
 	t.Parallel()
 
+	var received []string
+
 	addr, closer := runserver(t, &smtpd.Server{
-		Handler: func(_ context.Context, _ smtpd.Peer, _ smtpd.Envelope) error {
-			return smtpd.ErrTooBig
+		MaxMessageSize: 64,
+		StreamData:     true,
+		Handler: func(_ context.Context, _ smtpd.Peer, env smtpd.Envelope) error {
+			assert.Nil(t, env.Data)
+			require.NotNil(t, env.Body)
+
+			if env.Sender == "reject@example.org" {
+				// the rest of the message is discarded
+				return smtpd.ErrSenderDenied
+			}
+
+			assert.Equal(t, "bar", env.Header.Get("Foo"))
+
+			env.AddHeader("X-Stream", "yes")
+
+			b, err := io.ReadAll(env.Body)
+			if err != nil {
+				return err
+			}
+
+			received = append(received, string(b))
+
+			return nil
 		},
 		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
 	})
-
 	defer closer()
 
 	c, err := smtp.Dial(addr)
 	require.NoError(t, err)
 
+	send := func(sender, body string, code int) {
+		t.Helper()
+
+		require.NoError(t, c.Mail(sender))
+		require.NoError(t, c.Rcpt("recipient@example.net"))
+		require.NoError(t, cmd(c.Text, 354, "DATA"))
+
+		wc := c.Text.DotWriter()
+		_, err := wc.Write([]byte(body))
+		require.NoError(t, err)
+		require.NoError(t, wc.Close())
+
+		_, _, err = c.Text.ReadResponse(code)
+		require.NoError(t, err)
+	}
+
+	send("sender@example.org", "Foo: bar\n\nhello\n", 250)
+	send("reject@example.org", "Foo: bar\n\n"+strings.Repeat("x", 40)+"\n", 451)
+	send("sender@example.org", "Foo: bar\n\n"+strings.Repeat("x", 64)+"\n", 552)
+
+	// BDAT messages are buffered, but handed off as a stream too
 	err = c.Mail("sender@example.org")
 	require.NoError(t, err)
 
 	err = c.Rcpt("recipient@example.net")
 	require.NoError(t, err)
 
-	wc, err := c.Data()
-	require.NoError(t, err)
-
-	_, err = fmt.Fprintf(wc, "This is the email body")
+	err = bdat(c.Text, 250, "BDAT 15 LAST\r\nFoo: bar\r\n\r\nbye")
 	require.NoError(t, err)
 
-	err = wc.Close()
-	require.Error(t, err, "Unexpected accept of data")
-
 	err = c.Quit()
 	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"X-Stream: yes\r\nFoo: bar\n\nhello\n",
+		"X-Stream: yes\r\nFoo: bar\r\n\r\nbye",
+	}, received)
 }
 
-func TestMaxConnections(t *testing.T) {
+func TestBDAT(t *testing.T) {
 	t.Parallel()
 
+	var received []string
+
 	addr, closer := runserver(t, &smtpd.Server{
-		MaxConnections: 1,
+		MaxMessageSize: 32,
+		Handler: func(_ context.Context, _ smtpd.Peer, env smtpd.Envelope) error {
+			received = append(received, string(env.Data))
+			assert.Equal(t, "bar", env.Header.Get("Foo"))
+
+			return nil
+		},
 		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
 	})
 	defer closer()
 
-	c1, err := smtp.Dial(addr)
+	c, err := smtp.Dial(addr)
 	require.NoError(t, err)
 
-	_, err = smtp.Dial(addr)
-	require.Error(t, err, "Dial succeeded despite MaxConnections = 1")
-
-	c1.Close()
-}
+	err = c.Hello("localhost")
+	require.NoError(t, err)
 
-func TestNoMaxConnections(t *testing.T) {
-	t.Parallel()
+	supported, _ := c.Extension("CHUNKING")
+	require.True(t, supported, "CHUNKING not supported")
 
-	addr, closer := runserver(t, &smtpd.Server{
-		MaxConnections: -1,
-		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
-	})
-	defer closer()
+	// BDAT before RCPT is rejected, but the chunk is still consumed
+	err = bdat(c.Text, 502, "BDAT 5\r\nhello")
+	require.NoError(t, err)
 
-	c1, err := smtp.Dial(addr)
+	err = c.Mail("sender@example.org")
 	require.NoError(t, err)
 
-	c1.Close()
-}
+	err = c.Rcpt("recipient@example.net")
+	require.NoError(t, err)
 
-func TestMaxRecipients(t *testing.T) {
-	t.Parallel()
+	// pipeline the chunks without waiting for replies
+	_, err = fmt.Fprintf(c.Text.W, "BDAT 12\r\nFoo: bar\r\n\r\nBDAT 5 LAST\r\nhello")
+	require.NoError(t, err)
+	require.NoError(t, c.Text.W.Flush())
 
-	addr, closer := runserver(t, &smtpd.Server{
-		MaxRecipients:  1,
-		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
-	})
-	defer closer()
+	_, _, err = c.Text.ReadResponse(250)
+	require.NoError(t, err)
 
-	c, err := smtp.Dial(addr)
+	_, _, err = c.Text.ReadResponse(250)
 	require.NoError(t, err)
 
+	require.Equal(t, []string{"Foo: bar\r\n\r\nhello"}, received)
+
+	// too big, the transaction is reset
 	err = c.Mail("sender@example.org")
 	require.NoError(t, err)
 
 	err = c.Rcpt("recipient@example.net")
 	require.NoError(t, err)
 
+	err = bdat(c.Text, 250, "BDAT 20\r\n"+strings.Repeat("x", 20))
+	require.NoError(t, err)
+
+	err = bdat(c.Text, 552, "BDAT 20 LAST\r\n"+strings.Repeat("x", 20))
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 502, "DATA")
+	require.NoError(t, err)
+
+	// DATA can't be mixed with BDAT
+	err = c.Mail("sender@example.org")
+	require.NoError(t, err)
+
 	err = c.Rcpt("recipient@example.net")
-	require.Error(t, err, "RCPT succeeded despite MaxRecipients = 1")
+	require.NoError(t, err)
+
+	err = bdat(c.Text, 250, "BDAT 12\r\nFoo: bar\r\n\r\n")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 503, "DATA")
+	require.NoError(t, err)
 
 	err = c.Quit()
 	require.NoError(t, err)
+
+	require.Len(t, received, 1)
 }
 
-func TestInvalidHelo(t *testing.T) {
+func TestDataMode(t *testing.T) {
 	t.Parallel()
 
-	addr, closer := runserver(t, &smtpd.Server{
-		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream=%t", stream), func(t *testing.T) {
+			t.Parallel()
+
+			var received []string
+
+			handler := func(_ context.Context, _ smtpd.Peer, env smtpd.Envelope) error {
+				data := env.Data
+				if env.Body != nil {
+					var err error
+					if data, err = io.ReadAll(env.Body); err != nil {
+						return err
+					}
+				}
+
+				received = append(received, string(data))
+
+				return nil
+			}
+
+			dial := func(mode string) *smtp.Client {
+				addr, closer := runserver(t, &smtpd.Server{
+					Handler:        handler,
+					DataMode:       mode,
+					StreamData:     stream,
+					ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+				})
+				t.Cleanup(closer)
+
+				c, err := smtp.Dial(addr)
+				require.NoError(t, err)
+
+				require.NoError(t, c.Hello("localhost"))
+
+				return c
+			}
+
+			transaction := func(c *smtp.Client) {
+				require.NoError(t, c.Mail("sender@example.org"))
+				require.NoError(t, c.Rcpt("recipient@example.net"))
+				require.NoError(t, cmd(c.Text, 354, "DATA"))
+			}
+
+			c := dial(smtpd.DataReject)
+
+			// the message ends at CRLF.CRLF, so the bare CR and dot are data
+			transaction(c)
+			require.NoError(t, bdat(c.Text, 554, "Subject: test\r\n\r\nhello\r.\r\nworld\r\n.\r\n"))
+
+			transaction(c)
+			require.NoError(t, bdat(c.Text, 554, strings.Repeat("a", 999)+"\r\n.\r\n"))
+
+			transaction(c)
+			require.NoError(t, bdat(c.Text, 250, "Subject: test\r\n\r\nhello\r\n.\r\n"))
+
+			// the connection is closed after a bare LF, which the client may
+			// have meant to end the data
+			transaction(c)
+			require.NoError(t, bdat(c.Text, 554, "Subject: test\r\n\r\nhello\n.\nRSET\r\n"))
+
+			_, err := c.Text.ReadLine()
+			require.ErrorIs(t, err, io.EOF)
+
+			c = dial(smtpd.DataRepair)
+
+			transaction(c)
+			require.NoError(t, bdat(c.Text, 250, "Subject: test\r\n\r\nhello\n.\nworld\r\n.\r\n"))
+
+			require.NoError(t, c.Mail("sender@example.org"))
+			require.NoError(t, c.Rcpt("recipient@example.net"))
+			require.NoError(t, bdat(c.Text, 250, "BDAT 21 LAST\r\nSubject: test\n\nhello\r"))
+
+			require.NoError(t, c.Quit())
+
+			assert.Equal(t, []string{
+				"Subject: test\n\nhello\n",
+				"Subject: test\n\nhello\n.\nworld\n",
+				"Subject: test\r\n\r\nhello\r\n",
+			}, received)
+		})
+	}
+}
+
+func TestRejectHandler(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		Handler: func(_ context.Context, _ smtpd.Peer, _ smtpd.Envelope) error {
+			return smtpd.ErrTooBig
+		},
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	err = c.Mail("sender@example.org")
+	require.NoError(t, err)
+
+	err = c.Rcpt("recipient@example.net")
+	require.NoError(t, err)
+
+	wc, err := c.Data()
+	require.NoError(t, err)
+
+	_, err = fmt.Fprintf(wc, "This is the email body")
+	require.NoError(t, err)
+
+	err = wc.Close()
+	require.Error(t, err, "Unexpected accept of data")
+
+	err = c.Quit()
+	require.NoError(t, err)
+}
+
+func TestLMTP(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		LMTP:           true,
+		MaxMessageSize: 64,
+		Handler: func(_ context.Context, peer smtpd.Peer, _ smtpd.Envelope) error {
+			assert.Equal(t, smtpd.Protocol(smtpd.LMTP), peer.Protocol)
+
+			return smtpd.RecipientErrors{
+				"carol@example.net": smtpd.ErrForwardingFailed,
+				"dave@example.net":  &smtpd.Error{Code: 452, EnhancedCode: "4.2.2", Msg: "Mailbox full"},
+			}
+		},
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+
+	defer closer()
+
+	c, err := textproto.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	_, msg, err := c.ReadResponse(220)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost.localdomain LMTP ready.", msg)
+
+	// LMTP clients must greet with LHLO
+	require.NoError(t, cmd(c, 502, "HELO localhost"))
+	require.NoError(t, cmd(c, 502, "EHLO localhost"))
+	require.NoError(t, cmd(c, 250, "LHLO localhost"))
+
+	require.NoError(t, cmd(c, 250, "MAIL FROM:<sender@example.org>"))
+
+	for _, rcpt := range []string{"alice@example.net", "carol@example.net", "dave@example.net"} {
+		require.NoError(t, cmd(c, 250, "RCPT TO:<%s>", rcpt))
+	}
+
+	require.NoError(t, cmd(c, 354, "DATA"))
+
+	_, err = fmt.Fprintf(c.W, "Subject: test\r\n\r\nhello\r\n.\r\n")
+	require.NoError(t, err)
+	require.NoError(t, c.W.Flush())
+
+	// one reply for each recipient, in order
+	_, msg, err = c.ReadResponse(250)
+	require.NoError(t, err)
+	assert.Equal(t, "2.1.5 <alice@example.net> Thank you.", msg)
+
+	code, _, err := c.ReadResponse(250)
+	require.Error(t, err)
+	assert.Equal(t, 554, code)
+
+	code, msg, err = c.ReadResponse(250)
+	require.Error(t, err)
+	assert.Equal(t, 452, code)
+	assert.Equal(t, "4.2.2 Mailbox full", msg)
+
+	// messages which are too big are rejected for each recipient too
+	require.NoError(t, cmd(c, 250, "MAIL FROM:<sender@example.org>"))
+	require.NoError(t, cmd(c, 250, "RCPT TO:<alice@example.net>"))
+	require.NoError(t, cmd(c, 250, "RCPT TO:<bob@example.net>"))
+	require.NoError(t, cmd(c, 354, "DATA"))
+
+	_, err = fmt.Fprintf(c.W, "%s\r\n.\r\n", strings.Repeat("x", 100))
+	require.NoError(t, err)
+	require.NoError(t, c.W.Flush())
+
+	for range 2 {
+		code, _, err = c.ReadResponse(250)
+		require.Error(t, err)
+		assert.Equal(t, 552, code)
+	}
+
+	require.NoError(t, cmd(c, 221, "QUIT"))
+}
+
+func TestRecipientErrorsSMTP(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		Handler: func(_ context.Context, _ smtpd.Peer, _ smtpd.Envelope) error {
+			return smtpd.RecipientErrors{
+				"carol@example.net": smtpd.ErrForwardingFailed,
+				"dave@example.net":  &smtpd.Error{Code: 452, EnhancedCode: "4.2.2", Msg: "Mailbox full"},
+			}
+		},
+	})
+
+	defer closer()
+
+	c, err := textproto.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	_, _, err = c.ReadResponse(220)
+	require.NoError(t, err)
+
+	// LHLO is only supported in LMTP mode
+	require.NoError(t, cmd(c, 502, "LHLO localhost"))
+	require.NoError(t, cmd(c, 250, "EHLO localhost"))
+
+	require.NoError(t, cmd(c, 250, "MAIL FROM:<sender@example.org>"))
+
+	for _, rcpt := range []string{"alice@example.net", "dave@example.net", "carol@example.net"} {
+		require.NoError(t, cmd(c, 250, "RCPT TO:<%s>", rcpt))
+	}
+
+	require.NoError(t, cmd(c, 354, "DATA"))
+
+	_, err = fmt.Fprintf(c.W, "hello\r\n.\r\n")
+	require.NoError(t, err)
+	require.NoError(t, c.W.Flush())
+
+	// a single reply, with the error of the first failed recipient
+	code, _, err := c.ReadResponse(250)
+	require.Error(t, err)
+	assert.Equal(t, 452, code)
+
+	require.NoError(t, cmd(c, 221, "QUIT"))
+}
+
+func TestMaxConnections(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		MaxConnections: 1,
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c1, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	_, err = smtp.Dial(addr)
+	require.Error(t, err, "Dial succeeded despite MaxConnections = 1")
+
+	c1.Close()
+}
+
+func TestNoMaxConnections(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		MaxConnections: -1,
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c1, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	c1.Close()
+}
+
+func TestMaxRecipients(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		MaxRecipients:  1,
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	err = c.Mail("sender@example.org")
+	require.NoError(t, err)
+
+	err = c.Rcpt("recipient@example.net")
+	require.NoError(t, err)
+
+	err = c.Rcpt("recipient@example.net")
+	require.Error(t, err, "RCPT succeeded despite MaxRecipients = 1")
+
+	err = c.Quit()
+	require.NoError(t, err)
+}
+
+func TestSessionLimits(t *testing.T) {
+	t.Parallel()
+
+	reasons := make(chan string, 1)
+
+	deadlines := make(chan time.Time, 1)
+
+	addr, closer := runserver(t, &smtpd.Server{
+		MaxSessionDuration: 500 * time.Millisecond,
+		MaxCommands:        10,
+		MaxErrors:          2,
+		HeloChecker: func(ctx context.Context, _ smtpd.Peer, _ string) error {
+			deadline, _ := ctx.Deadline()
+			deadlines <- deadline
+
+			return nil
+		},
+		OnLimit: func(_ context.Context, _ smtpd.Peer, reason string) {
+			reasons <- reason
+		},
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	dial := func() *textproto.Conn {
+		c, err := textproto.Dial("tcp", addr)
+		require.NoError(t, err)
+
+		t.Cleanup(func() { _ = c.Close() })
+
+		_, _, err = c.ReadResponse(220)
+		require.NoError(t, err)
+
+		return c
+	}
+
+	// the session's context ends with it
+	c := dial()
+	require.NoError(t, cmd(c, 250, "HELO localhost"))
+	assert.WithinDuration(t, time.Now().Add(500*time.Millisecond), <-deadlines, 200*time.Millisecond)
+
+	for range 9 {
+		require.NoError(t, cmd(c, 250, "NOOP"))
+	}
+
+	require.ErrorContains(t, cmd(c, 250, "NOOP"), "4.7.0 Too many commands")
+	assert.Equal(t, smtpd.LimitCommands, <-reasons)
+
+	c = dial()
+	require.NoError(t, cmd(c, 502, "FOO"))
+	require.NoError(t, cmd(c, 502, "BAR"))
+
+	_, msg, err := c.ReadResponse(421)
+	require.NoError(t, err)
+	assert.Equal(t, "4.7.0 Too many errors, closing connection", msg)
+	assert.Equal(t, smtpd.LimitErrors, <-reasons)
+
+	// the client is disconnected once the session expires, even while it's
+	// still sending commands
+	c = dial()
+	start := time.Now()
+
+	for err = nil; err == nil; time.Sleep(100 * time.Millisecond) {
+		err = cmd(c, 250, "NOOP")
+	}
+
+	require.ErrorContains(t, err, "4.4.2 Session lasted too long")
+	assert.WithinDuration(t, start.Add(500*time.Millisecond), time.Now(), 300*time.Millisecond)
+	assert.Equal(t, smtpd.LimitDuration, <-reasons)
+}
+
+func TestTarpit(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		TarpitAfter:    2,
+		TarpitDelay:    100 * time.Millisecond,
+		TarpitMaxDelay: 150 * time.Millisecond,
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err := textproto.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	_, _, err = c.ReadResponse(220)
+	require.NoError(t, err)
+
+	timed := func(code int, command string) time.Duration {
+		start := time.Now()
+		require.NoError(t, cmd(c, code, command))
+
+		return time.Since(start)
+	}
+
+	assert.Less(t, timed(502, "FOO"), 80*time.Millisecond)
+
+	// the delay grows with each error, up to the maximum
+	assert.InDelta(t, 100*time.Millisecond, timed(502, "FOO"), float64(50*time.Millisecond))
+	assert.InDelta(t, 150*time.Millisecond, timed(502, "FOO"), float64(50*time.Millisecond))
+	assert.InDelta(t, 150*time.Millisecond, timed(502, "FOO"), float64(50*time.Millisecond))
+
+	// successful replies aren't delayed
+	assert.Less(t, timed(250, "NOOP"), 80*time.Millisecond)
+}
+
+func TestGreetDelay(t *testing.T) {
+	t.Parallel()
+
+	talkers := make(chan string, 1)
+
+	addr, closer := runserver(t, &smtpd.Server{
+		GreetDelay:     200 * time.Millisecond,
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	// the clients waiting for the greeting get it after the delay
+	start := time.Now()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	require.NoError(t, c.Hello("localhost"))
+	require.NoError(t, c.Quit())
+
+	earlyTalker := func(addr string) *textproto.Conn {
+		c, err := textproto.Dial("tcp", addr)
+		require.NoError(t, err)
+
+		t.Cleanup(func() { _ = c.Close() })
+
+		_, err = c.Cmd("EHLO localhost")
+		require.NoError(t, err)
+
+		return c
+	}
+
+	// early talkers are rejected
+	_, msg, err := earlyTalker(addr).ReadResponse(220)
+	require.Error(t, err)
+	assert.Equal(t, "5.5.1 Protocol error, data sent before the greeting", msg)
+
+	// or the checker lets them go on, their data being read afterwards
+	addr, closer = runserver(t, &smtpd.Server{
+		GreetDelay: 200 * time.Millisecond,
+		EarlyTalkerChecker: func(_ context.Context, peer smtpd.Peer) error {
+			talkers <- peer.Addr.String()
+			return nil
+		},
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	tc := earlyTalker(addr)
+
+	_, _, err = tc.ReadResponse(220)
+	require.NoError(t, err)
+
+	_, _, err = tc.ReadResponse(250)
+	require.NoError(t, err)
+	assert.Contains(t, <-talkers, "127.0.0.1:")
+}
+
+func TestInvalidHelo(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	err = c.Hello("")
+	require.Error(t, err, "HELO succeeded despite empty name")
+}
+
+func TestInvalidSender(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	err = c.Mail("invalid@@example.org")
+	require.Error(t, err, "MAIL succeeded despite invalid address")
+}
+
+func TestInvalidRecipient(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
 	})
 	defer closer()
 
 	c, err := smtp.Dial(addr)
 	require.NoError(t, err)
 
-	err = c.Hello("")
-	require.Error(t, err, "HELO succeeded despite empty name")
+	err = c.Mail("sender@example.org")
+	require.NoError(t, err)
+
+	err = c.Rcpt("invalid@@example.org")
+	require.Error(t, err, "RCPT succeeded despite invalid address")
 }
 
-func TestInvalidSender(t *testing.T) {
+func TestRCPTbeforeMAIL(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	err = c.Rcpt("recipient@example.net")
+	require.Error(t, err, "RCPT succeeded despite no MAIL")
+}
+
+func TestDATAbeforeRCPT(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	err = c.Mail("sender@example.org")
+	require.NoError(t, err)
+
+	_, err = c.Data()
+	require.Error(t, err, "Data accepted despite no recipients")
+
+	err = c.Quit()
+	require.NoError(t, err)
+}
+
+func TestInterruptedDATA(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		Handler: func(_ context.Context, _ smtpd.Peer, _ smtpd.Envelope) error {
+			t.Fatal("Accepted DATA despite disconnection")
+			return nil
+		},
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	err = c.Mail("sender@example.org")
+	require.NoError(t, err)
+
+	err = c.Rcpt("recipient@example.net")
+	require.NoError(t, err)
+
+	wc, err := c.Data()
+	require.NoError(t, err)
+
+	_, err = fmt.Fprintf(wc, "This is the email body")
+	require.NoError(t, err)
+
+	_ = c.Close()
+}
+
+func TestTimeoutClose(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		MaxConnections: 1,
+		ReadTimeout:    1000 * time.Millisecond,
+		WriteTimeout:   1000 * time.Millisecond,
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+
+	defer closer()
+
+	c1, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	// TODO: reduce this after fixing Serve to do an exponential backoff instead
+	// of sleeping for a full second
+	time.Sleep(2000 * time.Millisecond)
+
+	c2, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	err = c1.Mail("sender@example.org")
+	require.Error(t, err, "MAIL succeeded despite being timed out.")
+
+	err = c2.Mail("sender@example.org")
+	require.NoError(t, err)
+
+	err = c2.Quit()
+	require.NoError(t, err)
+
+	c2.Close()
+}
+
+func TestClose(t *testing.T) {
+	t.Parallel()
+
+	server := &smtpd.Server{}
+
+	addr, closer := runserver(t, server)
+
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	err = c.Hello("localhost")
+	require.NoError(t, err)
+
+	require.Len(t, server.Sessions(), 1)
+
+	_ = server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		_ = server.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sessions still active after Close")
+	}
+
+	err = c.Mail("sender@example.org")
+	require.Error(t, err, "MAIL succeeded on a closed session")
+
+	_, err = smtp.Dial(addr)
+	require.Error(t, err, "connected after Close")
+}
+
+func TestTLSTimeout(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runsslserver(t, &smtpd.Server{
+		ReadTimeout:    200 * time.Millisecond,
+		WriteTimeout:   200 * time.Millisecond,
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	err = c.StartTLS(testTLSConfig)
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	err = c.Mail("sender@example.org")
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	err = c.Rcpt("recipient@example.net")
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	err = c.Rcpt("recipient@example.net")
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	err = c.Quit()
+	require.NoError(t, err)
+}
+
+func TestLongLine(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	err = c.Mail(strings.Repeat("x", 65*1024) + "@example.org")
+	require.Error(t, err)
+
+	err = c.Quit()
+	require.NoError(t, err)
+}
+
+func TestXCLIENT(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		EnableXCLIENT: true,
+		SenderChecker: func(_ context.Context, peer smtpd.Peer, addr string) error {
+			require.Equal(t, "new.example.net", peer.HeloName)
+			require.Equal(t, "42.42.42.42:4242", peer.Addr.String())
+			require.Equal(t, "newusername", peer.Username)
+			require.Equal(t, smtpd.SMTP, peer.Protocol)
+			require.Equal(t, "sender@example.org", addr)
+
+			return nil
+		},
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	supported, _ := c.Extension("XCLIENT")
+	require.True(t, supported, "XCLIENT not supported")
+
+	err = cmd(c.Text, 220, "XCLIENT NAME=ignored ADDR=42.42.42.42 PORT=4242 PROTO=SMTP HELO=new.example.net LOGIN=newusername")
+	require.NoError(t, err)
+
+	err = c.Mail("sender@example.org")
+	require.NoError(t, err)
+
+	err = c.Rcpt("recipient@example.net")
+	require.NoError(t, err)
+
+	err = c.Rcpt("recipient2@example.net")
+	require.NoError(t, err)
+
+	wc, err := c.Data()
+	require.NoError(t, err)
+
+	_, err = fmt.Fprintf(wc, "This is the email body")
+	require.NoError(t, err)
+
+	err = wc.Close()
+	require.NoError(t, err)
+
+	err = c.Quit()
+	require.NoError(t, err)
+}
+
+func TestProxyProtocolV2(t *testing.T) {
 	t.Parallel()
 
+	peers := make(chan smtpd.Peer, 1)
+
 	addr, closer := runserver(t, &smtpd.Server{
+		EnableProxyProtocol: true,
+		HeloChecker: func(_ context.Context, peer smtpd.Peer, _ string) error {
+			peers <- peer
+			return nil
+		},
 		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
 	})
 	defer closer()
 
-	c, err := smtp.Dial(addr)
+	signature := "\r\n\r\n\x00\r\nQUIT\n"
+
+	// PROXY over TCP/IPv4, from 192.0.2.1:4242 to 198.51.100.1:25, with the
+	// PP2_TYPE_SSL TLV holding the TLS version and client certificate CN
+	ssl := "\x01\x00\x00\x00\x00" +
+		"\x21\x00\x07TLSv1.3" +
+		"\x22\x00\x12client.example.com"
+	payload := "\xc0\x00\x02\x01\xc6\x33\x64\x01\x10\x92\x00\x19" +
+		"\x20\x00\x24" + ssl
+
+	conn, err := net.Dial("tcp", addr)
 	require.NoError(t, err)
 
-	err = c.Mail("invalid@@example.org")
-	require.Error(t, err, "MAIL succeeded despite invalid address")
-}
+	_, err = fmt.Fprintf(conn, "%s\x21\x11\x00%c%s", signature, len(payload), payload)
+	require.NoError(t, err)
 
-func TestInvalidRecipient(t *testing.T) {
-	t.Parallel()
+	c := textproto.NewConn(conn)
+	defer c.Close()
 
-	addr, closer := runserver(t, &smtpd.Server{
-		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
-	})
-	defer closer()
+	_, _, err = c.ReadResponse(220)
+	require.NoError(t, err)
 
-	c, err := smtp.Dial(addr)
+	require.NoError(t, cmd(c, 250, "EHLO localhost"))
+
+	peer := <-peers
+	assert.Equal(t, "192.0.2.1:4242", peer.Addr.String())
+	require.NotNil(t, peer.Proxy)
+	assert.Equal(t, "198.51.100.1:25", peer.Proxy.LocalAddr.String())
+	require.NotNil(t, peer.Proxy.TLS)
+	assert.Equal(t, "TLSv1.3", peer.Proxy.TLS.Version)
+	assert.Equal(t, "client.example.com", peer.Proxy.TLS.CommonName)
+	assert.False(t, peer.Proxy.TLS.ClientCert)
+	assert.Nil(t, peer.TLS)
+
+	require.NoError(t, cmd(c, 221, "QUIT"))
+
+	// LOCAL, e.g. health checks of the proxy: the connection is kept as-is
+	conn, err = net.Dial("tcp", addr)
 	require.NoError(t, err)
 
-	err = c.Mail("sender@example.org")
+	_, err = fmt.Fprintf(conn, "%s\x20\x00\x00\x00", signature)
 	require.NoError(t, err)
 
-	err = c.Rcpt("invalid@@example.org")
-	require.Error(t, err, "RCPT succeeded despite invalid address")
+	c = textproto.NewConn(conn)
+	defer c.Close()
+
+	_, _, err = c.ReadResponse(220)
+	require.NoError(t, err)
+
+	require.NoError(t, cmd(c, 250, "EHLO localhost"))
+
+	peer = <-peers
+	assert.Equal(t, conn.LocalAddr().String(), peer.Addr.String())
+	assert.Nil(t, peer.Proxy)
+
+	// unsupported version
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	_, err = fmt.Fprintf(conn, "%s\x31\x11\x00\x00", signature)
+	require.NoError(t, err)
+
+	c = textproto.NewConn(conn)
+	defer c.Close()
+
+	_, _, err = c.ReadResponse(220)
+	require.Error(t, err)
 }
 
-func TestRCPTbeforeMAIL(t *testing.T) {
+func TestTrustedProxies(t *testing.T) {
 	t.Parallel()
 
+	_, trusted, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+
 	addr, closer := runserver(t, &smtpd.Server{
+		EnableXCLIENT:  true,
+		TrustedProxies: []*net.IPNet{trusted},
 		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
 	})
 	defer closer()
@@ -704,48 +1888,87 @@ func TestRCPTbeforeMAIL(t *testing.T) {
 	c, err := smtp.Dial(addr)
 	require.NoError(t, err)
 
-	err = c.Rcpt("recipient@example.net")
-	require.Error(t, err, "RCPT succeeded despite no MAIL")
-}
+	require.NoError(t, c.Hello("localhost"))
 
-func TestDATAbeforeRCPT(t *testing.T) {
-	t.Parallel()
+	supported, _ := c.Extension("XCLIENT")
+	assert.False(t, supported, "XCLIENT advertised to untrusted client")
 
-	addr, closer := runserver(t, &smtpd.Server{
-		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
-	})
+	err = cmd(c.Text, 550, "XCLIENT ADDR=42.42.42.42")
+	require.NoError(t, err)
+
+	require.NoError(t, c.Quit())
 
+	addr, closer = runserver(t, &smtpd.Server{
+		EnableProxyProtocol: true,
+		TrustedProxies:      []*net.IPNet{trusted},
+		ProtocolLogger:      log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
 	defer closer()
 
-	c, err := smtp.Dial(addr)
+	// PROXY v1
+	tc, err := textproto.Dial("tcp", addr)
 	require.NoError(t, err)
 
-	err = c.Mail("sender@example.org")
+	err = cmd(tc, 550, "PROXY TCP4 42.42.42.42 127.0.0.1 4242 25")
 	require.NoError(t, err)
+	require.NoError(t, tc.Close())
 
-	_, err = c.Data()
-	require.Error(t, err, "Data accepted despite no recipients")
+	// PROXY v2, LOCAL
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
 
-	err = c.Quit()
+	_, err = fmt.Fprint(conn, "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00")
+	require.NoError(t, err)
+
+	tc = textproto.NewConn(conn)
+	defer tc.Close()
+
+	code, _, err := tc.ReadResponse(220)
+	require.Error(t, err)
+	assert.Equal(t, 550, code)
+
+	// the address of the connection is trusted, not the one XCLIENT sets
+	_, local, err := net.ParseCIDR("127.0.0.1/32")
+	require.NoError(t, err)
+
+	addr, closer = runserver(t, &smtpd.Server{
+		EnableXCLIENT:  true,
+		TrustedProxies: []*net.IPNet{local},
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err = smtp.Dial(addr)
 	require.NoError(t, err)
+
+	require.NoError(t, cmd(c.Text, 220, "XCLIENT ADDR=42.42.42.42"))
+	require.NoError(t, cmd(c.Text, 220, "XCLIENT ADDR=43.43.43.43"))
+	require.NoError(t, c.Quit())
 }
 
-func TestInterruptedDATA(t *testing.T) {
+func TestEnvelopeReceived(t *testing.T) {
 	t.Parallel()
 
-	addr, closer := runserver(t, &smtpd.Server{
-		Handler: func(_ context.Context, _ smtpd.Peer, _ smtpd.Envelope) error {
-			t.Fatal("Accepted DATA despite disconnection")
+	addr, closer := runsslserver(t, &smtpd.Server{
+		Hostname: "foobar.example.net",
+		Handler: func(_ context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+			env.AddReceivedLine(peer)
+			if !bytes.HasPrefix(env.Data, []byte("Received: from localhost ([127.0.0.1]) by foobar.example.net with ESMTP;")) {
+				t.Fatal("Wrong received line.")
+			}
 			return nil
 		},
+		ForceTLS:       true,
 		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
 	})
-
 	defer closer()
 
 	c, err := smtp.Dial(addr)
 	require.NoError(t, err)
 
+	err = c.StartTLS(testTLSConfig)
+	require.NoError(t, err)
+
 	err = c.Mail("sender@example.org")
 	require.NoError(t, err)
 
@@ -758,49 +1981,46 @@ func TestInterruptedDATA(t *testing.T) {
 	_, err = fmt.Fprintf(wc, "This is the email body")
 	require.NoError(t, err)
 
-	_ = c.Close()
+	err = wc.Close()
+	require.NoError(t, err)
+
+	err = c.Quit()
+	require.NoError(t, err)
 }
 
-func TestTimeoutClose(t *testing.T) {
+func TestHELO(t *testing.T) {
 	t.Parallel()
 
 	addr, closer := runserver(t, &smtpd.Server{
-		MaxConnections: 1,
-		ReadTimeout:    1000 * time.Millisecond,
-		WriteTimeout:   1000 * time.Millisecond,
 		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
 	})
 
 	defer closer()
 
-	c1, err := smtp.Dial(addr)
+	c, err := smtp.Dial(addr)
 	require.NoError(t, err)
 
-	// TODO: reduce this after fixing Serve to do an exponential backoff instead
-	// of sleeping for a full second
-	time.Sleep(2000 * time.Millisecond)
-
-	c2, err := smtp.Dial(addr)
+	err = cmd(c.Text, 502, "MAIL FROM:<test@example.org>")
 	require.NoError(t, err)
 
-	err = c1.Mail("sender@example.org")
-	require.Error(t, err, "MAIL succeeded despite being timed out.")
+	err = cmd(c.Text, 250, "HELO localhost")
+	require.NoError(t, err)
 
-	err = c2.Mail("sender@example.org")
+	err = cmd(c.Text, 250, "MAIL FROM:<test@example.org>")
 	require.NoError(t, err)
 
-	err = c2.Quit()
+	err = cmd(c.Text, 250, "HELO localhost")
 	require.NoError(t, err)
 
-	c2.Close()
+	err = c.Quit()
+	require.NoError(t, err)
 }
 
-func TestTLSTimeout(t *testing.T) {
+func TestLOGINAuth(t *testing.T) {
 	t.Parallel()
 
 	addr, closer := runsslserver(t, &smtpd.Server{
-		ReadTimeout:    200 * time.Millisecond,
-		WriteTimeout:   200 * time.Millisecond,
+		Authenticator:  func(_ context.Context, _ smtpd.Peer, _, _ string) error { return nil },
 		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
 	})
 
@@ -812,107 +2032,202 @@ func TestTLSTimeout(t *testing.T) {
 	err = c.StartTLS(testTLSConfig)
 	require.NoError(t, err)
 
-	time.Sleep(100 * time.Millisecond)
+	err = cmd(c.Text, 334, "AUTH LOGIN")
+	require.NoError(t, err)
 
-	err = c.Mail("sender@example.org")
+	err = cmd(c.Text, 502, "foo")
 	require.NoError(t, err)
 
-	time.Sleep(100 * time.Millisecond)
+	err = cmd(c.Text, 334, "AUTH LOGIN")
+	require.NoError(t, err)
 
-	err = c.Rcpt("recipient@example.net")
+	err = cmd(c.Text, 334, "Zm9v")
 	require.NoError(t, err)
 
-	time.Sleep(100 * time.Millisecond)
+	err = cmd(c.Text, 502, "foo")
+	require.NoError(t, err)
 
-	err = c.Rcpt("recipient@example.net")
+	err = cmd(c.Text, 334, "AUTH LOGIN")
 	require.NoError(t, err)
 
-	time.Sleep(100 * time.Millisecond)
+	err = cmd(c.Text, 334, "Zm9v")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 235, "Zm9v")
+	require.NoError(t, err)
 
 	err = c.Quit()
 	require.NoError(t, err)
 }
 
-func TestLongLine(t *testing.T) {
+func TestCRAMMD5Auth(t *testing.T) {
 	t.Parallel()
 
-	addr, closer := runserver(t, &smtpd.Server{
+	addr, closer := runsslserver(t, &smtpd.Server{
+		SecretLookup: func(_ context.Context, _ smtpd.Peer, username string) (string, error) {
+			if username != "alice" {
+				return "", smtpd.ErrAuthInvalid
+			}
+
+			return "secret", nil
+		},
 		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
 	})
+
 	defer closer()
 
-	c, err := smtp.Dial(addr)
+	dial := func() *smtp.Client {
+		t.Helper()
+
+		c, err := smtp.Dial(addr)
+		require.NoError(t, err)
+
+		err = c.StartTLS(testTLSConfig)
+		require.NoError(t, err)
+
+		return c
+	}
+
+	// net/smtp closes the connection when authentication fails
+	for _, auth := range []smtp.Auth{
+		smtp.CRAMMD5Auth("bob", "secret"),
+		smtp.CRAMMD5Auth("alice", "wrong"),
+	} {
+		err := dial().Auth(auth)
+		require.ErrorContains(t, err, "535")
+	}
+
+	c := dial()
+
+	_, mechanisms := c.Extension("AUTH")
+	assert.Equal(t, "CRAM-MD5", mechanisms)
+
+	// PLAIN and LOGIN need an Authenticator
+	err := cmd(c.Text, 502, "AUTH PLAIN")
 	require.NoError(t, err)
 
-	err = c.Mail(strings.Repeat("x", 65*1024) + "@example.org")
-	require.Error(t, err)
+	// no initial response
+	err = cmd(c.Text, 502, "AUTH CRAM-MD5 Zm9v")
+	require.NoError(t, err)
+
+	err = c.Mail("sender@example.org")
+	require.ErrorContains(t, err, "530")
+
+	err = c.Auth(smtp.CRAMMD5Auth("alice", "secret"))
+	require.NoError(t, err)
+
+	err = c.Mail("sender@example.org")
+	require.NoError(t, err)
 
 	err = c.Quit()
 	require.NoError(t, err)
 }
 
-func TestXCLIENT(t *testing.T) {
+func TestSCRAMAuth(t *testing.T) {
 	t.Parallel()
 
-	addr, closer := runserver(t, &smtpd.Server{
-		EnableXCLIENT: true,
-		SenderChecker: func(_ context.Context, peer smtpd.Peer, addr string) error {
-			require.Equal(t, "new.example.net", peer.HeloName)
-			require.Equal(t, "42.42.42.42:4242", peer.Addr.String())
-			require.Equal(t, "newusername", peer.Username)
-			require.Equal(t, smtpd.SMTP, peer.Protocol)
-			require.Equal(t, "sender@example.org", addr)
+	creds, err := auth.NewSCRAMCredentials("secret")
+	require.NoError(t, err)
 
+	addr, closer := runsslserver(t, &smtpd.Server{
+		SCRAMLookup: func(_ context.Context, _ smtpd.Peer, username string) (auth.SCRAMCredentials, error) {
+			if username != "alice" {
+				return auth.SCRAMCredentials{}, smtpd.ErrAuthInvalid
+			}
+
+			return creds, nil
+		},
+		Handler: func(_ context.Context, peer smtpd.Peer, _ smtpd.Envelope) error {
+			assert.Equal(t, "alice", peer.Username)
 			return nil
 		},
 		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
 	})
+
 	defer closer()
 
-	c, err := smtp.Dial(addr)
-	require.NoError(t, err)
+	dial := func() *smtp.Client {
+		t.Helper()
 
-	supported, _ := c.Extension("XCLIENT")
-	require.True(t, supported, "XCLIENT not supported")
+		c, err := smtp.Dial(addr)
+		require.NoError(t, err)
 
-	err = cmd(c.Text, 220, "XCLIENT NAME=ignored ADDR=42.42.42.42 PORT=4242 PROTO=SMTP HELO=new.example.net LOGIN=newusername")
+		err = c.StartTLS(testTLSConfig)
+		require.NoError(t, err)
+
+		return c
+	}
+
+	for _, a := range []smtp.Auth{
+		auth.SCRAMSHA256Auth("bob", "secret"),
+		auth.SCRAMSHA256Auth("alice", "wrong"),
+	} {
+		err := dial().Auth(a)
+		require.ErrorContains(t, err, "535")
+	}
+
+	c := dial()
+
+	_, mechanisms := c.Extension("AUTH")
+	assert.Equal(t, "SCRAM-SHA-256", mechanisms)
+
+	err = c.Auth(auth.SCRAMSHA256Auth("alice", "secret"))
 	require.NoError(t, err)
 
 	err = c.Mail("sender@example.org")
 	require.NoError(t, err)
 
-	err = c.Rcpt("recipient@example.net")
+	err = c.Quit()
 	require.NoError(t, err)
+}
 
-	err = c.Rcpt("recipient2@example.net")
+func TestMailFrom(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	// null address
+	from := "<>"
+	c, err := smtp.Dial(addr)
 	require.NoError(t, err)
 
-	wc, err := c.Data()
+	err = cmd(c.Text, 250, "HELO localhost")
 	require.NoError(t, err)
 
-	_, err = fmt.Fprintf(wc, "This is the email body")
+	err = cmd(c.Text, 250, "MAIL FROM:%s", from)
 	require.NoError(t, err)
 
-	err = wc.Close()
+	err = c.Quit()
+	require.NoError(t, err)
+
+	// no brackets
+	from = "test@example.org"
+	c, err = smtp.Dial(addr)
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 250, "HELO localhost")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 250, "MAIL FROM:%s", from)
 	require.NoError(t, err)
 
 	err = c.Quit()
 	require.NoError(t, err)
 }
 
-func TestEnvelopeReceived(t *testing.T) {
+func TestMailParams(t *testing.T) {
 	t.Parallel()
 
-	addr, closer := runsslserver(t, &smtpd.Server{
-		Hostname: "foobar.example.net",
-		Handler: func(_ context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
-			env.AddReceivedLine(peer)
-			if !bytes.HasPrefix(env.Data, []byte("Received: from localhost ([127.0.0.1]) by foobar.example.net with ESMTP;")) {
-				t.Fatal("Wrong received line.")
-			}
+	var env smtpd.Envelope
+
+	addr, closer := runserver(t, &smtpd.Server{
+		Handler: func(_ context.Context, _ smtpd.Peer, e smtpd.Envelope) error {
+			env = e
 			return nil
 		},
-		ForceTLS:       true,
 		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
 	})
 	defer closer()
@@ -920,101 +2235,198 @@ func TestEnvelopeReceived(t *testing.T) {
 	c, err := smtp.Dial(addr)
 	require.NoError(t, err)
 
-	err = c.StartTLS(testTLSConfig)
+	err = c.Hello("localhost")
 	require.NoError(t, err)
 
-	err = c.Mail("sender@example.org")
+	for _, ext := range []string{"8BITMIME", "SMTPUTF8"} {
+		supported, _ := c.Extension(ext)
+		require.True(t, supported, ext+" not supported")
+	}
+
+	// non-ASCII addresses require SMTPUTF8
+	err = cmd(c.Text, 553, "MAIL FROM:<josé@example.org>")
 	require.NoError(t, err)
 
-	err = c.Rcpt("recipient@example.net")
+	err = cmd(c.Text, 502, "MAIL FROM:<sender@example.org> BODY=BINARYMIME")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 250, "MAIL FROM:<sender@example.org>")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 553, "RCPT TO:<josé@example.net>")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 250, "RSET")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 250, "MAIL FROM:<josé@example.org> BODY=8BITMIME SMTPUTF8")
 	require.NoError(t, err)
 
-	wc, err := c.Data()
+	err = cmd(c.Text, 250, "RCPT TO:<josé@example.net>")
 	require.NoError(t, err)
 
-	_, err = fmt.Fprintf(wc, "This is the email body")
+	err = cmd(c.Text, 354, "DATA")
 	require.NoError(t, err)
 
-	err = wc.Close()
+	err = cmd(c.Text, 250, "Subject: héllo\r\n\r\nwörld\r\n.")
 	require.NoError(t, err)
 
+	assert.True(t, env.SMTPUTF8)
+	assert.Equal(t, smtpd.Body8BitMIME, env.BodyType)
+	assert.Equal(t, "josé@example.org", env.Sender)
+	assert.Equal(t, []string{"josé@example.net"}, env.Recipients)
+
 	err = c.Quit()
 	require.NoError(t, err)
 }
 
-func TestHELO(t *testing.T) {
+func TestVRFY(t *testing.T) {
 	t.Parallel()
 
 	addr, closer := runserver(t, &smtpd.Server{
+		VerifyHandler: func(_ context.Context, _ smtpd.Peer, query string) (string, error) {
+			switch query {
+			case "bob", "<bob@example.com>":
+				return "Bob <bob@example.com>", nil
+			case "nobody@example.com":
+				return "", smtpd.ErrUserUnknown
+			default:
+				return "", nil
+			}
+		},
+		ExpandHandler: func(_ context.Context, _ smtpd.Peer, query string) ([]string, error) {
+			if query == "staff@example.com" {
+				return []string{"<alice@example.com>", "Bob <bob@example.com>"}, nil
+			}
+
+			return nil, nil
+		},
 		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
 	})
-
 	defer closer()
 
 	c, err := smtp.Dial(addr)
 	require.NoError(t, err)
 
-	err = cmd(c.Text, 502, "MAIL FROM:<test@example.org>")
+	for _, tc := range []struct {
+		cmd  string
+		code int
+		msg  string
+	}{
+		{"VRFY", 502, "5.5.4 Missing parameter"},
+		{"VRFY bob", 250, "2.1.5 Bob <bob@example.com>"},
+		{"VRFY <bob@example.com>", 250, "2.1.5 Bob <bob@example.com>"},
+		{"VRFY nobody@example.com", 550, "5.1.1 User unknown"},
+		{"VRFY carol", 252, "2.0.0 Cannot VRFY user, but will accept message and attempt delivery"},
+		{"EXPN staff@example.com", 250, "2.1.5 <alice@example.com>\n2.1.5 Bob <bob@example.com>"},
+		{"EXPN bob", 252, "2.0.0 Cannot EXPN list, but will accept message and attempt delivery"},
+	} {
+		id, err := c.Text.Cmd("%s", tc.cmd)
+		require.NoError(t, err)
+
+		c.Text.StartResponse(id)
+		code, msg, _ := c.Text.ReadResponse(tc.code)
+		c.Text.EndResponse(id)
+
+		assert.Equal(t, tc.code, code, tc.cmd)
+		assert.Equal(t, tc.msg, msg, tc.cmd)
+	}
+
+	err = c.Quit()
 	require.NoError(t, err)
 
-	err = cmd(c.Text, 250, "HELO localhost")
+	// VRFY and EXPN require authentication like MAIL
+	addr, closer = runserver(t, &smtpd.Server{
+		Authenticator:     func(context.Context, smtpd.Peer, string, string) error { return nil },
+		AllowInsecureAuth: true,
+		ProtocolLogger:    log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err = smtp.Dial(addr)
 	require.NoError(t, err)
 
-	err = cmd(c.Text, 250, "MAIL FROM:<test@example.org>")
+	err = cmd(c.Text, 530, "VRFY bob")
 	require.NoError(t, err)
 
-	err = cmd(c.Text, 250, "HELO localhost")
+	err = cmd(c.Text, 530, "EXPN staff@example.com")
 	require.NoError(t, err)
 
 	err = c.Quit()
 	require.NoError(t, err)
 }
 
-func TestLOGINAuth(t *testing.T) {
+func TestRegisterCommand(t *testing.T) {
 	t.Parallel()
 
-	addr, closer := runsslserver(t, &smtpd.Server{
-		Authenticator:  func(_ context.Context, _ smtpd.Peer, _, _ string) error { return nil },
+	srv := &smtpd.Server{
 		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
-	})
+		Extensions:     []string{"ETRN"},
+	}
 
-	defer closer()
+	var queued []string
 
-	c, err := smtp.Dial(addr)
-	require.NoError(t, err)
+	srv.RegisterCommand("etrn", func(_ context.Context, peer smtpd.Peer, args string) (smtpd.Reply, error) {
+		if peer.HeloName == "" {
+			return smtpd.Reply{}, smtpd.ErrNoHELO
+		}
 
-	err = c.StartTLS(testTLSConfig)
-	require.NoError(t, err)
+		queued = append(queued, args)
 
-	err = cmd(c.Text, 334, "AUTH LOGIN")
-	require.NoError(t, err)
+		return smtpd.Reply{Code: 250, Lines: []string{"Queuing for node " + args + " started"}}, nil
+	})
 
-	err = cmd(c.Text, 502, "foo")
-	require.NoError(t, err)
+	srv.RegisterCommand("HELP", func(context.Context, smtpd.Peer, string) (smtpd.Reply, error) {
+		return smtpd.Reply{Code: 214, EnhancedCode: "2.0.0", Lines: []string{"Commands:", "HELO EHLO MAIL RCPT DATA"}}, nil
+	})
 
-	err = cmd(c.Text, 334, "AUTH LOGIN")
-	require.NoError(t, err)
+	for _, verb := range []string{"", "MAIL", "data", "ETRN", "A B"} {
+		assert.Panics(t, func() {
+			srv.RegisterCommand(verb, func(context.Context, smtpd.Peer, string) (smtpd.Reply, error) {
+				return smtpd.Reply{}, nil
+			})
+		}, verb)
+	}
 
-	err = cmd(c.Text, 334, "Zm9v")
-	require.NoError(t, err)
+	addr, closer := runserver(t, srv)
+	defer closer()
 
-	err = cmd(c.Text, 502, "foo")
+	c, err := smtp.Dial(addr)
 	require.NoError(t, err)
 
-	err = cmd(c.Text, 334, "AUTH LOGIN")
-	require.NoError(t, err)
+	for _, tc := range []struct {
+		cmd  string
+		code int
+		msg  string
+	}{
+		{"ETRN example.com", 502, "5.5.1 Please introduce yourself first."},
+		{"HELO localhost", 250, "Go ahead"},
+		{"etrn  @example.com", 250, "2.0.0 Queuing for node @example.com started"},
+		{"HELP", 214, "2.0.0 Commands:\n2.0.0 HELO EHLO MAIL RCPT DATA"},
+		{"ATRN", 502, "5.5.1 Unsupported command"},
+	} {
+		id, err := c.Text.Cmd("%s", tc.cmd)
+		require.NoError(t, err)
 
-	err = cmd(c.Text, 334, "Zm9v")
-	require.NoError(t, err)
+		c.Text.StartResponse(id)
+		code, msg, _ := c.Text.ReadResponse(tc.code)
+		c.Text.EndResponse(id)
 
-	err = cmd(c.Text, 235, "Zm9v")
-	require.NoError(t, err)
+		assert.Equal(t, tc.code, code, tc.cmd)
+		assert.Equal(t, tc.msg, msg, tc.cmd)
+	}
+
+	// the command is advertised in the EHLO reply
+	ok, _ := c.Extension("ETRN")
+	assert.True(t, ok)
 
 	err = c.Quit()
 	require.NoError(t, err)
+
+	assert.Equal(t, []string{"@example.com"}, queued)
 }
 
-func TestMailFrom(t *testing.T) {
+func TestHELP(t *testing.T) {
 	t.Parallel()
 
 	addr, closer := runserver(t, &smtpd.Server{
@@ -1022,29 +2434,10 @@ func TestMailFrom(t *testing.T) {
 	})
 	defer closer()
 
-	// null address
-	from := "<>"
 	c, err := smtp.Dial(addr)
 	require.NoError(t, err)
 
-	err = cmd(c.Text, 250, "HELO localhost")
-	require.NoError(t, err)
-
-	err = cmd(c.Text, 250, "MAIL FROM:%s", from)
-	require.NoError(t, err)
-
-	err = c.Quit()
-	require.NoError(t, err)
-
-	// no brackets
-	from = "test@example.org"
-	c, err = smtp.Dial(addr)
-	require.NoError(t, err)
-
-	err = cmd(c.Text, 250, "HELO localhost")
-	require.NoError(t, err)
-
-	err = cmd(c.Text, 250, "MAIL FROM:%s", from)
+	err = cmd(c.Text, 214, "HELP")
 	require.NoError(t, err)
 
 	err = c.Quit()
@@ -1116,6 +2509,203 @@ func TestErrors(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestDSNParams(t *testing.T) {
+	t.Parallel()
+
+	var env smtpd.Envelope
+
+	addr, closer := runserver(t, &smtpd.Server{
+		Handler: func(_ context.Context, _ smtpd.Peer, e smtpd.Envelope) error {
+			env = e
+			return nil
+		},
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	err = c.Hello("localhost")
+	require.NoError(t, err)
+
+	supported, _ := c.Extension("DSN")
+	require.True(t, supported, "DSN not supported")
+
+	err = cmd(c.Text, 502, "MAIL FROM:<sender@example.org> RET=BODY")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 250, "MAIL FROM:<sender@example.org> RET=hdrs ENVID=QQ314159")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 502, "RCPT TO:<recipient@example.net> NOTIFY=NEVER,SUCCESS")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 502, "RCPT TO:<recipient@example.net> ORCPT=recipient@example.net")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 250, "RCPT TO:<recipient@example.net> NOTIFY=success,delay ORCPT=rfc822;recipient@example.net")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 250, "RCPT TO:<other@example.net>")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 354, "DATA")
+	require.NoError(t, err)
+
+	err = cmd(c.Text, 250, "Subject: test\r\n\r\nhello\r\n.")
+	require.NoError(t, err)
+
+	assert.Equal(t, smtpd.DSNRetHeaders, env.DSNRet)
+	assert.Equal(t, "QQ314159", env.DSNEnvID)
+	assert.Equal(t, map[string]smtpd.RecipientDSN{
+		"recipient@example.net": {Notify: "SUCCESS,DELAY", ORcpt: "rfc822;recipient@example.net"},
+	}, env.DSN)
+
+	err = c.Quit()
+	require.NoError(t, err)
+}
+
+func TestMTPriority(t *testing.T) {
+	t.Parallel()
+
+	var env smtpd.Envelope
+
+	for _, enabled := range []bool{false, true} {
+		addr, closer := runserver(t, &smtpd.Server{
+			Handler: func(_ context.Context, _ smtpd.Peer, e smtpd.Envelope) error {
+				env = e
+				return nil
+			},
+			EnableMTPriority: enabled,
+		})
+		t.Cleanup(closer)
+
+		c, err := smtp.Dial(addr)
+		require.NoError(t, err)
+
+		err = c.Hello("localhost")
+		require.NoError(t, err)
+
+		supported, _ := c.Extension("MT-PRIORITY")
+		require.Equal(t, enabled, supported)
+
+		if enabled {
+			for _, param := range []string{"MT-PRIORITY=10", "MT-PRIORITY=-10", "MT-PRIORITY=high", "MT-PRIORITY="} {
+				err = cmd(c.Text, 502, "MAIL FROM:<sender@example.org> %s", param)
+				require.NoError(t, err, param)
+			}
+		}
+
+		// the parameter is ignored unless it's enabled
+		err = cmd(c.Text, 250, "MAIL FROM:<sender@example.org> MT-PRIORITY=+6")
+		require.NoError(t, err)
+
+		err = cmd(c.Text, 250, "RCPT TO:<recipient@example.net>")
+		require.NoError(t, err)
+
+		err = cmd(c.Text, 354, "DATA")
+		require.NoError(t, err)
+
+		err = cmd(c.Text, 250, "Subject: test\r\n\r\nhello\r\n.")
+		require.NoError(t, err)
+
+		if enabled {
+			assert.Equal(t, 6, env.Priority)
+		} else {
+			assert.Equal(t, 0, env.Priority)
+		}
+
+		err = c.Quit()
+		require.NoError(t, err)
+	}
+}
+
+func TestMultilineError(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		Handler: func(context.Context, smtpd.Peer, smtpd.Envelope) error {
+			return &smtpd.Error{Code: 550, EnhancedCode: "5.7.1", Msg: "Message rejected\nsee https://example.net/policy"}
+		},
+	})
+	t.Cleanup(closer)
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Hello("localhost"))
+	require.NoError(t, cmd(c.Text, 250, "MAIL FROM:<sender@example.org>"))
+	require.NoError(t, cmd(c.Text, 250, "RCPT TO:<recipient@example.net>"))
+	require.NoError(t, cmd(c.Text, 354, "DATA"))
+
+	id, err := c.Text.Cmd("Subject: test\r\n\r\nhello\r\n.")
+	require.NoError(t, err)
+
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+
+	// each line carries the enhanced status code
+	code, msg, err := c.Text.ReadResponse(250)
+	require.Error(t, err)
+	assert.Equal(t, 550, code)
+	assert.Equal(t, "5.7.1 Message rejected\n5.7.1 see https://example.net/policy", msg)
+}
+
+func TestEnhancedStatusCodes(t *testing.T) {
+	t.Parallel()
+
+	addr, closer := runserver(t, &smtpd.Server{
+		RecipientChecker: func(_ context.Context, _ smtpd.Peer, addr string) error {
+			if addr == "upstream@example.net" {
+				return &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+			}
+
+			return nil
+		},
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	err = c.Hello("localhost")
+	require.NoError(t, err)
+
+	supported, _ := c.Extension("ENHANCEDSTATUSCODES")
+	require.True(t, supported, "ENHANCEDSTATUSCODES not supported")
+
+	testCases := []struct {
+		cmd  string
+		code int
+		msg  string
+	}{
+		{"RCPT TO:<recipient@example.net>", 502, "5.5.1 Missing MAIL FROM command."},
+		{"MAIL FROM:<sender@example.org>", 250, "2.1.0 Go ahead"},
+		{"RCPT TO:<recipient@example.net>", 250, "2.1.5 Go ahead"},
+		{"RCPT TO:<upstream@example.net>", 550, "5.1.1 No such user"},
+		{"NOOP", 250, "2.0.0 Go ahead"},
+		{"VRFY recipient@example.net", 252, "2.0.0 Cannot VRFY user, but will accept message and attempt delivery"},
+		{"TURN", 502, "5.5.1 Unsupported command"},
+	}
+
+	for _, tc := range testCases {
+		id, err := c.Text.Cmd("%s", tc.cmd)
+		require.NoError(t, err)
+
+		c.Text.StartResponse(id)
+		code, msg, _ := c.Text.ReadResponse(tc.code)
+		c.Text.EndResponse(id)
+
+		assert.Equal(t, tc.code, code, tc.cmd)
+		assert.Equal(t, tc.msg, msg, tc.cmd)
+	}
+
+	err = c.Quit()
+	require.NoError(t, err)
+}
+
 func TestMalformedMAILFROM(t *testing.T) {
 	t.Parallel()
 
@@ -1195,6 +2785,96 @@ func TestTLSListener(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestListenAndServeTLS(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	cert, err := tls.X509KeyPair(localhostCert, localhostKey)
+	require.NoError(t, err)
+
+	// get a random port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	server := &smtpd.Server{
+		ProtocolLogger: log.New(os.Stdout, "log: ", log.Lshortfile),
+	}
+
+	err = server.ListenAndServeTLS(ctx, addr)
+	require.Error(t, err, "ListenAndServeTLS should fail without a TLSConfig")
+
+	server.TLSConfig = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	go func() {
+		_ = server.ListenAndServeTLS(ctx, addr)
+	}()
+
+	// wait for the server to start
+	var conn *tls.Conn
+	for {
+		select {
+		case <-ctx.Done():
+			t.Fatal("server failed to start")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		conn, err = tls.Dial("tcp", addr, testTLSConfig)
+		if err == nil {
+			break
+		}
+	}
+
+	c, err := smtp.NewClient(conn, "localhost")
+	require.NoError(t, err)
+
+	err = c.Hello("localhost")
+	require.NoError(t, err)
+
+	supported, _ := c.Extension("STARTTLS")
+	require.False(t, supported, "STARTTLS advertised on an implicit TLS connection")
+
+	err = c.Quit()
+	require.NoError(t, err)
+}
+
+func TestSessions(t *testing.T) {
+	t.Parallel()
+
+	server := &smtpd.Server{}
+
+	addr, closer := runserver(t, server)
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Hello("client.example.com"))
+	require.NoError(t, c.Mail("sender@example.org"))
+	require.NoError(t, c.Rcpt("recipient@example.net"))
+
+	sessions := server.Sessions()
+	require.Len(t, sessions, 1)
+
+	assert.Equal(t, "client.example.com", sessions[0].Peer.HeloName)
+	assert.NotNil(t, sessions[0].Peer.Addr)
+	assert.Equal(t, "sender@example.org", sessions[0].Sender)
+	assert.Equal(t, []string{"recipient@example.net"}, sessions[0].Recipients)
+	assert.Equal(t, addr, sessions[0].LocalAddr.String())
+
+	require.NoError(t, c.Quit())
+
+	require.Eventually(t, func() bool {
+		return len(server.Sessions()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
 func TestShutdown(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,68 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// redacted replaces the AUTH credentials in the transcripts
+const redacted = "[redacted]"
+
+// openTranscript starts the transcript of the session, if the server records
+// it. The session is only recorded once welcomed, when the address of the
+// client is known from the PROXY header.
+func (session *session) openTranscript(ctx context.Context) {
+	if session.server.Transcript == nil || session.transcript != nil {
+		return
+	}
+
+	session.transcript = session.server.Transcript(ctx, session.peer)
+
+	note := fmt.Sprintf("connection from %s to %s", session.peer.Addr, session.conn.LocalAddr())
+	if state := session.peer.TLS; state != nil {
+		note += ", " + tlsNote(*state)
+	}
+
+	session.record("--", note)
+}
+
+// record writes a line of the transcript, from the client (C), the server
+// (S), or a note (--)
+func (session *session) record(from, line string) {
+	if session.transcript == nil {
+		return
+	}
+
+	_, _ = fmt.Fprintf(session.transcript, "%s %s %s\n", time.Now().UTC().Format("15:04:05.000"), from, line)
+}
+
+// closeTranscript ends the transcript of the session
+func (session *session) closeTranscript() {
+	if session.transcript == nil {
+		return
+	}
+
+	session.record("--", "connection closed")
+
+	_ = session.transcript.Close()
+	session.transcript = nil
+}
+
+// tlsNote describes the TLS connection
+func tlsNote(state tls.ConnectionState) string {
+	return fmt.Sprintf("%s, %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+}
+
+// redactAUTH redacts the initial response of an AUTH command, e.g.
+// "AUTH PLAIN dGVzdAB0ZXN0ADEyMzQ="
+func redactAUTH(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || !strings.EqualFold(fields[0], "AUTH") {
+		return line
+	}
+
+	return fields[0] + " " + fields[1] + " " + redacted
+}
@@ -0,0 +1,84 @@
+package smtpd_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/smtp"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTranscript is a transcript, which is done once closed
+type testTranscript struct {
+	bytes.Buffer
+	done chan struct{}
+}
+
+func (tt *testTranscript) Close() error {
+	close(tt.done)
+	return nil
+}
+
+func TestTranscript(t *testing.T) {
+	t.Parallel()
+
+	tt := &testTranscript{done: make(chan struct{})}
+
+	addr, closer := runsslserver(t, &smtpd.Server{
+		Authenticator: func(_ context.Context, _ smtpd.Peer, _, _ string) error { return nil },
+		Transcript: func(_ context.Context, peer smtpd.Peer) io.WriteCloser {
+			assert.Contains(t, peer.Addr.String(), "127.0.0.1:")
+			return tt
+		},
+	})
+	defer closer()
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	require.NoError(t, c.StartTLS(testTLSConfig))
+	require.NoError(t, cmd(c.Text, 334, "AUTH LOGIN"))
+	require.NoError(t, cmd(c.Text, 334, "dXNlcg=="))
+	require.NoError(t, cmd(c.Text, 235, "c2VjcmV0"))
+
+	require.NoError(t, cmd(c.Text, 235, "AUTH PLAIN AHVzZXIAc2VjcmV0"))
+
+	require.NoError(t, c.Mail("sender@example.org"))
+	require.NoError(t, c.Rcpt("recipient@example.net"))
+
+	wc, err := c.Data()
+	require.NoError(t, err)
+	_, err = wc.Write([]byte("Subject: secret data\r\n\r\nsecret body\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+
+	require.NoError(t, c.Quit())
+
+	select {
+	case <-tt.done:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "transcript not closed")
+	}
+
+	transcript := tt.String()
+	assert.Contains(t, transcript, " -- connection from 127.0.0.1:")
+	assert.Contains(t, transcript, " S 220 localhost.localdomain ESMTP ready.\n")
+	assert.Contains(t, transcript, " C EHLO localhost\n")
+	assert.Contains(t, transcript, " S 250 STARTTLS\n")
+	assert.Contains(t, transcript, " -- started TLS 1.3, ")
+	assert.Contains(t, transcript, " C AUTH PLAIN [redacted]\n")
+	assert.Contains(t, transcript, " C [redacted]\n")
+	assert.Contains(t, transcript, " C MAIL FROM:<sender@example.org>")
+	assert.Contains(t, transcript, " S 221 2.0.0 OK, bye\n")
+	assert.Contains(t, transcript, " -- connection closed\n")
+
+	// neither the credentials nor the message data are recorded
+	assert.NotContains(t, transcript, "AHVzZXIAc2VjcmV0")
+	assert.NotContains(t, transcript, "dXNlcg==")
+	assert.NotContains(t, transcript, "secret")
+}
@@ -9,6 +9,7 @@ const (
 	recipientsKey = attribute.Key("smtp.recipients")
 	datasizeKey   = attribute.Key("smtp.data.size")
 	statusCodeKey = attribute.Key("smtp.response.status_code")
+	reusedKey     = attribute.Key("smtp.connection.reused")
 )
 
 // The sender address (from the 'MAIL FROM' SMTP command).
@@ -46,3 +47,12 @@ func DataSize(size int64) attribute.KeyValue {
 func StatusCode(code int) attribute.KeyValue {
 	return statusCodeKey.Int(code)
 }
+
+// Whether the connection to the upstream was reused from the pool.
+//
+// Type: bool
+// Required: No
+// Examples: true
+func ConnectionReused(reused bool) attribute.KeyValue {
+	return reusedKey.Bool(reused)
+}
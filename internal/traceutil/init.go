@@ -110,7 +110,8 @@ func traceSampler(serviceName string) sdktrace.Sampler {
 	)
 }
 
-func traceResource(ctx context.Context, serviceName string) (*resource.Resource, error) {
+// traceResource describes the process, with the extra attributes given
+func traceResource(ctx context.Context, serviceName string, attrs ...attribute.KeyValue) (*resource.Resource, error) {
 	module := "unknown"
 	if bi, ok := debug.ReadBuildInfo(); ok {
 		module = bi.Main.Path
@@ -135,5 +136,6 @@ func traceResource(ctx context.Context, serviceName string) (*resource.Resource,
 			attribute.String("service.revision", version.Revision),
 			attribute.String("module.path", module),
 		),
+		resource.WithAttributes(attrs...),
 	)
 }
@@ -0,0 +1,73 @@
+package traceutil
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	otelprom "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// InitMetricExporter exports the metrics of the Prometheus gatherer to an
+// OTLP collector every interval, alongside the Prometheus exposition. The
+// attributes are added to the resource describing the process, e.g. to tell
+// the instances apart.
+//
+// Use environment variables to configure the exporter, such as
+// OTEL_EXPORTER_OTLP_METRICS_ENDPOINT.
+func InitMetricExporter(ctx context.Context, serviceName string, gatherer prometheus.Gatherer, interval time.Duration, attrs ...attribute.KeyValue) (closer func(context.Context) error, err error) {
+	// we don't want to propagate cancellation to the meter provider, in order
+	// to allow sending the last metrics
+	ctx = context.WithoutCancel(ctx)
+
+	logger := slog.With("component", "metrics")
+
+	if disabled, _ := strconv.ParseBool(os.Getenv("OTEL_SDK_DISABLED")); disabled {
+		logger.Debug("OTLP metrics disabled by environment variable OTEL_SDK_DISABLED")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlpmetricgrpc.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init OTLP exporter: %w", err)
+	}
+
+	res, err := traceResource(ctx, serviceName, attrs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource: %w", err)
+	}
+
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(interval),
+		sdkmetric.WithProducer(otelprom.NewMetricProducer(otelprom.WithGatherer(gatherer))),
+	)
+
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(res),
+	)
+
+	shutdown := func(ctx context.Context) error {
+		// don't propagate cancellation while we shut down, but give it a 5s timeout
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+
+		logger.DebugContext(ctx, "meter provider shutting down")
+
+		// the metrics are exported a last time
+		if err := mp.Shutdown(ctx); err != nil {
+			return fmt.Errorf("failed to shutdown meter provider: %w", err)
+		}
+
+		return nil
+	}
+
+	return shutdown, nil
+}
@@ -0,0 +1,112 @@
+package traceutil
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+)
+
+// fakeCollector is an OTLP metrics collector recording what it receives
+type fakeCollector struct {
+	collectorpb.UnimplementedMetricsServiceServer
+
+	mu      sync.Mutex
+	metrics []*metricspb.ResourceMetrics
+}
+
+func (c *fakeCollector) Export(_ context.Context, req *collectorpb.ExportMetricsServiceRequest) (*collectorpb.ExportMetricsServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.metrics = append(c.metrics, req.GetResourceMetrics()...)
+
+	return &collectorpb.ExportMetricsServiceResponse{}, nil
+}
+
+func (c *fakeCollector) received() []*metricspb.ResourceMetrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]*metricspb.ResourceMetrics{}, c.metrics...)
+}
+
+//nolint:paralleltest
+func TestInitMetricExporter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	collector := &fakeCollector{}
+
+	srv := grpc.NewServer()
+	collectorpb.RegisterMetricsServiceServer(srv, collector)
+
+	go func() { _ = srv.Serve(l) }()
+
+	t.Cleanup(srv.Stop)
+
+	t.Setenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", "http://"+l.Addr().String())
+	t.Setenv("OTEL_EXPORTER_OTLP_METRICS_INSECURE", "true")
+
+	registry := prometheus.NewRegistry()
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "test_requests_total",
+		Help: "count of test requests",
+	}, []string{"status"})
+	registry.MustRegister(counter)
+	counter.WithLabelValues("250").Add(3)
+
+	ctx := context.Background()
+
+	closer, err := InitMetricExporter(ctx, "smtprelay", registry, time.Hour,
+		attribute.String("smtprelay.listen", "0.0.0.0:25"))
+	require.NoError(t, err)
+
+	// the metrics are exported on shutdown
+	require.NoError(t, closer(ctx))
+
+	received := collector.received()
+	require.Len(t, received, 1)
+
+	attrs := map[string]string{}
+	for _, kv := range received[0].GetResource().GetAttributes() {
+		attrs[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+
+	assert.Equal(t, "smtprelay", attrs["service.name"])
+	assert.Equal(t, "0.0.0.0:25", attrs["smtprelay.listen"])
+
+	var sum *metricspb.Sum
+
+	for _, scope := range received[0].GetScopeMetrics() {
+		for _, m := range scope.GetMetrics() {
+			if m.GetName() == "test_requests_total" {
+				sum = m.GetSum()
+			}
+		}
+	}
+
+	require.NotNil(t, sum)
+	require.Len(t, sum.GetDataPoints(), 1)
+	assert.InDelta(t, 3.0, sum.GetDataPoints()[0].GetAsDouble(), 0)
+	assert.True(t, sum.GetIsMonotonic())
+}
+
+//nolint:paralleltest
+func TestInitMetricExporterDisabled(t *testing.T) {
+	t.Setenv("OTEL_SDK_DISABLED", "true")
+
+	closer, err := InitMetricExporter(context.Background(), "smtprelay", prometheus.NewRegistry(), time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, closer(context.Background()))
+}
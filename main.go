@@ -1,115 +1,193 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
-	"net"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 
-	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
-	"github.com/evidentiq/smtprelay/v2/internal/traceutil"
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/evidentiq/smtprelay/v2/pkg/relay"
 	"github.com/prometheus/common/version"
-	"go.opentelemetry.io/otel"
 )
 
-var tracer = otel.Tracer("github.com/evidentiq/smtprelay/v2")
-
-// metrics registry - overridable for tests
-var metricsRegistry = prometheus.DefaultRegisterer
+// exit codes
+const (
+	exitError          = 1 // failed to start, or a listener failed
+	exitShutdownForced = 2 // sessions were closed when the grace period expired
+	exitUsage          = 3 // unknown command
+)
 
-const applicationName = "smtprelay"
+const usage = `Usage: smtprelay [command] [flags] [arguments]
+
+Commands:
+  serve                    run the relay (default)
+  check-config [-probe]    validate the config, resolve the upstreams, and
+                           with -probe, connect to them and greet them
+  send-test rcpt...        deliver a test message to the recipients
+  send-test -to rcpt,...   submit a test message to the running relay, and
+                           show the SMTP transcript
+  queue [list]             list the queued messages
+  queue show ID            show a queued message, with its headers
+  queue retry ID           make a queued message due for delivery at once
+  queue export             write the queued messages with their data as JSON
+  queue import < export    queue the messages of an export
+  hash-password [-scheme bcrypt|argon2id] < password
+                           hash the password read from stdin, for the
+                           allowed_users file or the SQL database
+  version                  show version information
+
+The flags are the config settings, e.g. -config smtprelay.ini, for all the
+commands but hash-password and version. Run "smtprelay serve -help" to list them.
+`
 
 func main() {
+	// the command comes first, the flags after it are parsed with the config
+	cmd := "serve"
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		cmd = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
+	switch cmd {
+	case "serve", "check-config", "send-test", "queue":
+	case "version":
+		fmt.Printf("smtprelay %s\n", version.Info())
+		return
+	case "hash-password":
+		if err := hashPassword(os.Stdin, os.Stdout, os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitError)
+		}
+
+		return
+	case "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(exitUsage)
+	}
+
+	// the flags of the commands are parsed with the config ones
+	var (
+		probe bool
+		to    string
+	)
+
+	switch cmd {
+	case "check-config":
+		flag.BoolVar(&probe, "probe", false, "Connect to the upstreams and greet them with EHLO")
+	case "send-test":
+		flag.StringVar(&to, "to", "", "Recipients of the test message submitted to the running relay, separated by commas")
+	}
+
 	// load config as first thing
-	cfg, err := loadConfig()
+	r, err := relay.NewFromCommandLine()
 	if err != nil {
 		slog.Error("error loading config", slog.Any("error", err))
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 
-	if cfg.versionInfo {
-		fmt.Printf("%s %s\n", applicationName, version.Info())
+	if flag.Lookup("version").Value.String() == "true" {
+		fmt.Printf("smtprelay %s\n", version.Info())
 		return
 	}
 
 	// print version on start
 	slog.Debug("config loaded", slog.String("version", version.Version))
 
-	if err := run(context.Background(), cfg); err != nil {
-		slog.Error("error running smtprelay", slog.Any("error", err))
-		os.Exit(1)
-	}
-}
-
-func run(ctx context.Context, cfg *config) error {
-	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 	defer stop()
 
-	metricsSrv, err := handleMetrics(ctx, cfg.metricsListen, metricsRegistry)
-	if err != nil {
-		return fmt.Errorf("could not start metrics server: %w", err)
-	}
-	defer metricsSrv.Stop()
-
-	closer, err := traceutil.InitTraceExporter(ctx, "smtprelay")
-	if err != nil {
-		return fmt.Errorf("init trace exporter: %w", err)
-	}
-	//nolint:errcheck
-	defer closer(ctx)
-
-	addresses := strings.Split(cfg.listen, " ")
+	switch cmd {
+	case "check-config":
+		if err := r.CheckConfig(ctx, os.Stdout, probe); err != nil {
+			slog.Error("invalid config", slog.Any("error", err))
+			os.Exit(exitError)
+		}
 
-	errch := make(chan error)
+		fmt.Println("config OK")
+	case "send-test":
+		if to != "" {
+			if err := r.SubmitTest(ctx, os.Stdout, strings.Split(to, ",")); err != nil {
+				slog.Error("test message not submitted", slog.Any("error", err))
+				os.Exit(exitError)
+			}
 
-	for i := range addresses {
-		address := addresses[i]
+			fmt.Println("test message submitted")
 
-		var relay *relay
-		relay, err = newRelay(cfg)
-		if err != nil {
-			return fmt.Errorf("error creating relay: %w", err)
+			return
 		}
 
-		var listener net.Listener
-		listener, err = relay.listen(address)
-		if err != nil {
-			return fmt.Errorf("error listening on address %q: %w", address, err)
+		if err := r.SendTest(ctx, flag.Args()); err != nil {
+			slog.Error("test message not delivered", slog.Any("error", err))
+			os.Exit(exitError)
 		}
 
-		slog.InfoContext(ctx, "listening on address", slog.String("address", address))
+		fmt.Println("test message delivered")
+	case "queue":
+		if err := r.Queue(os.Stdin, os.Stdout, flag.Args()); err != nil {
+			slog.Error("queue command failed", slog.Any("error", err))
+			os.Exit(exitError)
+		}
+	default:
+		serve(ctx, stop, r)
+	}
+}
 
-		defer func(ctx context.Context) {
-			slog.WarnContext(ctx, "closing listener", slog.String("address", address))
+// hashPassword hashes the password read from in, which keeps it out of the
+// shell history, and writes the hash to out
+func hashPassword(in io.Reader, out io.Writer, args []string) error {
+	f := flag.NewFlagSet("hash-password", flag.ContinueOnError)
+	scheme := f.String("scheme", relay.HashArgon2id, "Password hashing scheme - bcrypt or argon2id")
 
-			_ = relay.shutdown(ctx)
-		}(ctx)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
 
-		go func() {
-			serveErr := relay.serve(ctx, listener)
-			if serveErr != nil && !errors.Is(serveErr, smtpd.ErrServerClosed) {
-				serveErr = fmt.Errorf("relay shutdown with an error: %w", serveErr)
-			}
+	password, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
 
-			errch <- serveErr
-		}()
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("no password given on stdin")
 	}
 
-	// Now wait for the server to stop, either by a signal or by an error
-	select {
-	case err = <-errch:
-		err = fmt.Errorf("relay error: %w", err)
-	case <-ctx.Done():
-		// if we got to this point without err being set, it's probably due to
-		// a signal being received
-		err = fmt.Errorf("exiting: %w", ctx.Err())
+	hash, err := relay.HashPassword(password, *scheme)
+	if err != nil {
+		return err
 	}
 
+	_, err = fmt.Fprintln(out, hash)
+
 	return err
 }
+
+// serve runs the relay until ctx is done
+func serve(ctx context.Context, stop context.CancelFunc, r *relay.Relay) {
+	// restore the default behaviour of the signals once the relay shuts down,
+	// so a second one exits without waiting for the grace period
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := r.Run(ctx); err != nil {
+		slog.Error("error running smtprelay", slog.Any("error", err))
+
+		if errors.Is(err, relay.ErrShutdownTimeout) {
+			os.Exit(exitShutdownForced)
+		}
+
+		os.Exit(exitError)
+	}
+}
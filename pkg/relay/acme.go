@@ -0,0 +1,123 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeManager obtains and renews the TLS certificate of the listeners from an
+// ACME CA such as Let's Encrypt, instead of loading local_cert and local_key.
+// Certificates are cached in local_acme_cache_dir, so they survive restarts.
+type acmeManager struct {
+	m *autocert.Manager
+
+	// defaultName is the name of the certificate used when clients don't
+	// send SNI, which many SMTP clients don't
+	defaultName string
+
+	// getCert gets the certificate from the manager - overridable for tests
+	getCert func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// srv serves the HTTP-01 challenges
+	srv *http.Server
+}
+
+// newACMEManager returns nil if local_acme_domains isn't set
+func newACMEManager(cfg *config) *acmeManager {
+	domains := splitstr(cfg.localACMEDomains, ' ')
+	if len(domains) == 0 {
+		return nil
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.localACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      cfg.localACMEEmail,
+		Client:     &acme.Client{DirectoryURL: cfg.localACMEURL},
+	}
+
+	a := &acmeManager{
+		m:           m,
+		defaultName: domains[0],
+		getCert:     m.GetCertificate,
+	}
+
+	if slices.Contains(domains, cfg.hostName) {
+		a.defaultName = cfg.hostName
+	}
+
+	return a
+}
+
+// tlsConfig returns the TLS config of the listeners. The TLS-ALPN-01
+// challenge is supported as well, for listeners port 443 is forwarded to.
+func (a *acmeManager) tlsConfig() *tls.Config {
+	//nolint:gosec // 1.2 is default, and omitting MinVersion allows overriding with GODEBUG
+	return &tls.Config{
+		GetCertificate: a.getCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+	}
+}
+
+func (a *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" {
+		named := *hello
+		named.ServerName = a.defaultName
+
+		return a.getCert(&named)
+	}
+
+	return a.getCert(hello)
+}
+
+// listen serves the HTTP-01 challenges on addr, which must be reachable by
+// the CA on port 80. An empty addr disables them.
+func (a *acmeManager) listen(ctx context.Context, addr string) error {
+	if addr == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen at %s: %w", addr, err)
+	}
+
+	a.srv = &http.Server{
+		ReadHeaderTimeout: 5 * time.Second,
+		Handler:           a.m.HTTPHandler(http.NotFoundHandler()),
+		BaseContext:       func(_ net.Listener) context.Context { return ctx },
+	}
+
+	log := slog.Default().With(slog.String("component", "acme"))
+
+	go func() {
+		err := a.srv.Serve(ln)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("ACME challenge server terminated with error", slog.Any("error", err))
+		}
+	}()
+
+	log.Info("ACME challenge server listening", slog.String("addr", addr))
+
+	return nil
+}
+
+// stop stops serving the HTTP-01 challenges
+func (a *acmeManager) stop() {
+	if a == nil || a.srv == nil {
+		return
+	}
+
+	a.srv.Close()
+}
@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewACMEManager(t *testing.T) {
+	t.Parallel()
+
+	assert.Nil(t, newACMEManager(&config{}))
+
+	a := newACMEManager(&config{
+		localACMEDomains:  "mx1.example.com mx2.example.com",
+		localACMECacheDir: t.TempDir(),
+	})
+	require.NotNil(t, a)
+	assert.Equal(t, "mx1.example.com", a.defaultName)
+
+	require.NoError(t, a.m.HostPolicy(context.Background(), "mx2.example.com"))
+	require.Error(t, a.m.HostPolicy(context.Background(), "example.com"))
+
+	// the hostname is preferred for clients not sending SNI
+	a = newACMEManager(&config{
+		hostName:          "mx2.example.com",
+		localACMEDomains:  "mx1.example.com mx2.example.com",
+		localACMECacheDir: t.TempDir(),
+	})
+	require.NotNil(t, a)
+	assert.Equal(t, "mx2.example.com", a.defaultName)
+
+	a.getCert = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &tls.Certificate{Certificate: [][]byte{[]byte(hello.ServerName)}}, nil
+	}
+
+	cert, err := a.getCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, "mx2.example.com", string(cert.Certificate[0]))
+
+	cert, err = a.getCertificate(&tls.ClientHelloInfo{ServerName: "mx1.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "mx1.example.com", string(cert.Certificate[0]))
+}
+
+func TestACMEConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{localACMEDomains: "mx.example.com", localACMECacheDir: t.TempDir()}
+	require.NoError(t, cfg.setup())
+
+	cfg = &config{localACMEDomains: "mx.example.com"}
+	require.Error(t, cfg.setup())
+
+	cfg = &config{localACMEDomains: "mx.example.com", localACMECacheDir: t.TempDir(), localCert: "smtpd.pem"}
+	require.Error(t, cfg.setup())
+}
@@ -0,0 +1,455 @@
+package relay
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// adminServer serves the admin API, used by operators to inspect and control
+// the relay at runtime
+type adminServer struct {
+	relays []*relay
+	shared *relayShared
+	conf   *configStore
+
+	// token is required as a bearer token if set
+	token string
+
+	srv    *http.Server
+	logger *slog.Logger
+}
+
+// adminSession describes an active SMTP session
+type adminSession struct {
+	Listener   string    `json:"listener"`
+	RemoteAddr string    `json:"remote_addr"`
+	HeloName   string    `json:"helo_name,omitempty"`
+	Username   string    `json:"username,omitempty"`
+	TLS        bool      `json:"tls"`
+	Started    time.Time `json:"started"`
+	Sender     string    `json:"sender,omitempty"`
+	Recipients []string  `json:"recipients,omitempty"`
+}
+
+// adminStatus is the state of the relay
+type adminStatus struct {
+	Paused   bool `json:"paused"`
+	Sessions int  `json:"sessions"`
+}
+
+func newAdminServer(relays []*relay, shared *relayShared, conf *configStore, token string) *adminServer {
+	a := &adminServer{
+		relays: relays,
+		shared: shared,
+		conf:   conf,
+		token:  token,
+		logger: slog.Default().With(slog.String("component", "admin")),
+	}
+
+	router := http.NewServeMux()
+	router.HandleFunc("GET /status", a.handleStatus)
+	router.HandleFunc("GET /sessions", a.handleSessions)
+	router.HandleFunc("GET /queue", a.handleQueue)
+	router.HandleFunc("POST /queue/flush", a.handleQueueFlush)
+	router.HandleFunc("GET /queue/export", a.handleQueueExport)
+	router.HandleFunc("POST /queue/import", a.handleQueueImport)
+	router.HandleFunc("GET /queue/{id}", a.handleQueued)
+	router.HandleFunc("GET /queue/{id}/message", a.handleQueuedMessage)
+	router.HandleFunc("POST /queue/{id}/retry", a.handleQueueRetry)
+	router.HandleFunc("GET /quarantine", a.handleQuarantine)
+	router.HandleFunc("GET /quarantine/{id}", a.handleQuarantined)
+	router.HandleFunc("GET /quarantine/{id}/message", a.handleQuarantinedMessage)
+	router.HandleFunc("POST /quarantine/{id}/release", a.handleQuarantineRelease)
+	router.HandleFunc("DELETE /quarantine/{id}", a.handleQuarantineDelete)
+	router.HandleFunc("POST /pause", a.handlePause)
+	router.HandleFunc("POST /resume", a.handleResume)
+	router.HandleFunc("POST /reload", a.handleReload)
+
+	a.srv = &http.Server{
+		ReadHeaderTimeout: 5 * time.Second,
+		Handler:           a.authenticate(router),
+	}
+
+	return a
+}
+
+func handleAdmin(ctx context.Context, addr string, a *adminServer) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen at %s: %w", addr, err)
+	}
+
+	a.srv.BaseContext = func(_ net.Listener) context.Context { return ctx }
+
+	go func() {
+		err := a.srv.Serve(ln)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.logger.Error("admin server terminated with error", slog.Any("error", err))
+		}
+	}()
+
+	a.logger.Info("admin server listening", slog.String("addr", addr))
+
+	return nil
+}
+
+func (a *adminServer) Stop() {
+	a.srv.Close()
+}
+
+// authenticate requires the bearer token, if one is configured
+func (a *adminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if a.token != "" {
+			got := []byte(req.Header.Get("Authorization"))
+			want := []byte("Bearer " + a.token)
+
+			if subtle.ConstantTimeCompare(got, want) != 1 {
+				writeJSONError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (a *adminServer) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, a.status())
+}
+
+func (a *adminServer) handleSessions(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, a.sessions())
+}
+
+func (a *adminServer) handleQueue(w http.ResponseWriter, _ *http.Request) {
+	if a.shared.queue == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("queueing is disabled"))
+		return
+	}
+
+	msgs, err := a.shared.queue.messages()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, msgs)
+}
+
+func (a *adminServer) handleQueueFlush(w http.ResponseWriter, req *http.Request) {
+	if a.shared.queue == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("queueing is disabled"))
+		return
+	}
+
+	a.logger.InfoContext(req.Context(), "flushing queue")
+
+	if err := a.shared.queue.flush(req.Context()); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	a.handleQueue(w, req)
+}
+
+func (a *adminServer) handleQueued(w http.ResponseWriter, req *http.Request) {
+	if a.shared.queue == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("queueing is disabled"))
+		return
+	}
+
+	msg, err := a.shared.queue.get(req.PathValue("id"))
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, msg)
+}
+
+func (a *adminServer) handleQueuedMessage(w http.ResponseWriter, req *http.Request) {
+	if a.shared.queue == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("queueing is disabled"))
+		return
+	}
+
+	data, err := a.shared.queue.data(req.PathValue("id"))
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "message/rfc822")
+	_, _ = w.Write(data)
+}
+
+// handleQueueRetry replies with the message if it's still queued after the
+// attempt, and with no content if it was delivered or dropped
+func (a *adminServer) handleQueueRetry(w http.ResponseWriter, req *http.Request) {
+	if a.shared.queue == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("queueing is disabled"))
+		return
+	}
+
+	id := req.PathValue("id")
+
+	a.logger.InfoContext(req.Context(), "retrying queued message", slog.String("queue_id", id))
+
+	msg, err := a.shared.queue.retry(req.Context(), id)
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+
+	if msg == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, msg)
+}
+
+func (a *adminServer) handleQueueExport(w http.ResponseWriter, _ *http.Request) {
+	if a.shared.queue == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("queueing is disabled"))
+		return
+	}
+
+	msgs, err := a.shared.queue.export()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, msgs)
+}
+
+func (a *adminServer) handleQueueImport(w http.ResponseWriter, req *http.Request) {
+	if a.shared.queue == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("queueing is disabled"))
+		return
+	}
+
+	msgs := []*exportedMessage{}
+	if err := json.NewDecoder(req.Body).Decode(&msgs); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("%w: %w", errInvalidImport, err))
+		return
+	}
+
+	ids, err := a.shared.queue.importMessages(msgs, time.Now())
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+
+	a.logger.InfoContext(req.Context(), "imported queued messages", slog.Any("queue_ids", ids))
+
+	writeJSON(w, http.StatusOK, ids)
+}
+
+func (a *adminServer) handleQuarantine(w http.ResponseWriter, _ *http.Request) {
+	q := a.conf.get().quarantine
+	if q == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("quarantine is disabled"))
+		return
+	}
+
+	msgs, err := q.messages()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, msgs)
+}
+
+func (a *adminServer) handleQuarantined(w http.ResponseWriter, req *http.Request) {
+	q := a.conf.get().quarantine
+	if q == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("quarantine is disabled"))
+		return
+	}
+
+	msg, err := q.get(req.PathValue("id"))
+	if err != nil {
+		writeQuarantineError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, msg)
+}
+
+func (a *adminServer) handleQuarantinedMessage(w http.ResponseWriter, req *http.Request) {
+	q := a.conf.get().quarantine
+	if q == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("quarantine is disabled"))
+		return
+	}
+
+	data, err := q.data(req.PathValue("id"))
+	if err != nil {
+		writeQuarantineError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "message/rfc822")
+	_, _ = w.Write(data)
+}
+
+func (a *adminServer) handleQuarantineRelease(w http.ResponseWriter, req *http.Request) {
+	q := a.conf.get().quarantine
+	if q == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("quarantine is disabled"))
+		return
+	}
+
+	id := req.PathValue("id")
+
+	msg, err := q.get(id)
+	if err != nil {
+		writeQuarantineError(w, err)
+		return
+	}
+
+	// the message is delivered by the relay of the listener it was received
+	// on, if it still exists
+	r := a.relays[0]
+	for _, candidate := range a.relays {
+		if candidate.listener.String() == msg.Listener {
+			r = candidate
+		}
+	}
+
+	a.logger.InfoContext(req.Context(), "releasing quarantined message", slog.String("quarantine_id", id))
+
+	if err := r.release(req.Context(), q, id); err != nil {
+		writeQuarantineError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, msg)
+}
+
+func (a *adminServer) handleQuarantineDelete(w http.ResponseWriter, req *http.Request) {
+	q := a.conf.get().quarantine
+	if q == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("quarantine is disabled"))
+		return
+	}
+
+	id := req.PathValue("id")
+
+	if err := q.remove(id); err != nil {
+		writeQuarantineError(w, err)
+		return
+	}
+
+	a.logger.InfoContext(req.Context(), "quarantined message deleted", slog.String("quarantine_id", id))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminServer) handlePause(w http.ResponseWriter, req *http.Request) {
+	a.shared.paused.Store(true)
+	a.logger.WarnContext(req.Context(), "paused, not accepting mail")
+
+	writeJSON(w, http.StatusOK, a.status())
+}
+
+func (a *adminServer) handleResume(w http.ResponseWriter, req *http.Request) {
+	a.shared.paused.Store(false)
+	a.logger.InfoContext(req.Context(), "resumed, accepting mail")
+
+	writeJSON(w, http.StatusOK, a.status())
+}
+
+func (a *adminServer) handleReload(w http.ResponseWriter, req *http.Request) {
+	if err := a.conf.reload(); err != nil {
+		a.logger.ErrorContext(req.Context(), "could not reload config, keeping the current one", slog.Any("error", err))
+		writeJSONError(w, http.StatusBadRequest, err)
+
+		return
+	}
+
+	a.logger.InfoContext(req.Context(), "config reloaded")
+
+	writeJSON(w, http.StatusOK, a.status())
+}
+
+func (a *adminServer) status() adminStatus {
+	return adminStatus{
+		Paused:   a.shared.paused.Load(),
+		Sessions: len(a.sessions()),
+	}
+}
+
+// sessions returns the active sessions of all listeners
+func (a *adminServer) sessions() []adminSession {
+	sessions := []adminSession{}
+
+	for _, r := range a.relays {
+		for _, s := range r.server.Sessions() {
+			sessions = append(sessions, adminSession{
+				Listener:   r.listener.String(),
+				RemoteAddr: s.Peer.Addr.String(),
+				HeloName:   s.Peer.HeloName,
+				Username:   s.Peer.Username,
+				TLS:        s.Peer.TLS != nil,
+				Started:    s.Started,
+				Sender:     s.Sender,
+				Recipients: s.Recipients,
+			})
+		}
+	}
+
+	return sessions
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeQueueError replies with a 404 for unknown messages, and a 400 for
+// invalid imports
+func writeQueueError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNotQueued):
+		writeJSONError(w, http.StatusNotFound, err)
+	case errors.Is(err, errInvalidImport):
+		writeJSONError(w, http.StatusBadRequest, err)
+	default:
+		writeJSONError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// writeQuarantineError replies with a 404 for unknown messages, and a 502 when
+// a released message couldn't be delivered
+func writeQuarantineError(w http.ResponseWriter, err error) {
+	var smtpErr *smtpd.Error
+
+	switch {
+	case errors.Is(err, errNotQuarantined):
+		writeJSONError(w, http.StatusNotFound, err)
+	case errors.As(err, &smtpErr):
+		writeJSONError(w, http.StatusBadGateway, err)
+	default:
+		writeJSONError(w, http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,289 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// adminRequest sends a request to the admin API and decodes the JSON response
+// into out, if not nil
+func adminRequest(t *testing.T, a *adminServer, method, path, token string, out any) int {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	a.srv.Handler.ServeHTTP(rec, req)
+
+	if out != nil {
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(out))
+	}
+
+	return rec.Code
+}
+
+func TestAdminPause(t *testing.T) {
+	t.Parallel()
+
+	conf := newConfigStore(&config{remoteHost: "localhost:25"})
+	shared := &relayShared{}
+
+	r, err := newRelay(conf, listenerConfig{scheme: schemeTCP, address: "127.0.0.1:0"}, shared)
+	require.NoError(t, err)
+
+	a := newAdminServer([]*relay{r}, shared, conf, "secret")
+
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(t, a, http.MethodGet, "/status", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(t, a, http.MethodGet, "/status", "wrong", nil))
+
+	status := adminStatus{}
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodGet, "/status", "secret", &status))
+	assert.False(t, status.Paused)
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodPost, "/pause", "secret", &status))
+	assert.True(t, status.Paused)
+
+	ctx := context.Background()
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}}
+
+	assert.Equal(t, smtpd.ErrPaused, r.checkConnection(ctx, peer))
+	assert.Equal(t, smtpd.ErrPaused, r.checkSender(ctx, peer, "bob@example.com"))
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodPost, "/resume", "secret", &status))
+	assert.False(t, status.Paused)
+
+	require.NoError(t, r.checkConnection(ctx, peer))
+	require.NoError(t, r.checkSender(ctx, peer, "bob@example.com"))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, adminRequest(t, a, http.MethodGet, "/pause", "secret", nil))
+}
+
+func TestAdminSessions(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conf := newConfigStore(&config{remoteHost: "localhost:25"})
+	shared := &relayShared{}
+
+	r, err := newRelay(conf, listenerConfig{scheme: schemeTCP, address: "127.0.0.1:0"}, shared)
+	require.NoError(t, err)
+
+	ln, err := r.listen()
+	require.NoError(t, err)
+
+	go func() {
+		_ = r.serve(ctx, ln)
+	}()
+
+	a := newAdminServer([]*relay{r}, shared, conf, "")
+
+	sessions := []adminSession{}
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodGet, "/sessions", "", &sessions))
+	assert.Empty(t, sessions)
+
+	c, err := smtp.Dial(ln.Addr().String())
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	require.NoError(t, c.Hello("client.example.com"))
+	require.NoError(t, c.Mail("bob@example.com"))
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodGet, "/sessions", "", &sessions))
+	require.Len(t, sessions, 1)
+
+	assert.Equal(t, "client.example.com", sessions[0].HeloName)
+	assert.Equal(t, "bob@example.com", sessions[0].Sender)
+	assert.False(t, sessions[0].TLS)
+	assert.WithinDuration(t, time.Now(), sessions[0].Started, time.Minute)
+}
+
+func TestAdminQueue(t *testing.T) {
+	t.Parallel()
+
+	conf := newConfigStore(&config{})
+	a := newAdminServer(nil, &relayShared{}, conf, "")
+
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, a, http.MethodGet, "/queue", "", nil))
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, a, http.MethodPost, "/queue/flush", "", nil))
+
+	delivered := 0
+	q := newTestQueue(t, t.TempDir(), func(context.Context, *queuedMessage, []byte) error {
+		delivered++
+		return nil
+	})
+
+	a = newAdminServer(nil, &relayShared{queue: q}, conf, "")
+
+	id, err := q.enqueue(testOutbound, []byte("hello"), errors.New("boom"))
+	require.NoError(t, err)
+
+	msgs := []*queuedMessage{}
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodGet, "/queue", "", &msgs))
+	require.Len(t, msgs, 1)
+	assert.Equal(t, id, msgs[0].ID)
+	assert.Equal(t, testOutbound.Recipients, msgs[0].Recipients)
+
+	// flushing delivers the message even though its next attempt isn't due
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodPost, "/queue/flush", "", &msgs))
+	assert.Empty(t, msgs)
+	assert.Equal(t, 1, delivered)
+}
+
+func TestAdminQueueMessages(t *testing.T) {
+	t.Parallel()
+
+	fail := true
+	q := newTestQueue(t, t.TempDir(), func(context.Context, *queuedMessage, []byte) error {
+		if fail {
+			return errors.New("boom")
+		}
+
+		return nil
+	})
+
+	conf := newConfigStore(&config{})
+	a := newAdminServer(nil, &relayShared{queue: q}, conf, "")
+
+	data := "Subject: test\r\nMessage-ID: <1@example.com>\r\n\r\nhello\r\n"
+
+	id, err := q.enqueue(testOutbound, []byte(data), errors.New("boom"))
+	require.NoError(t, err)
+
+	msg := &queuedMessageDetail{}
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodGet, "/queue/"+id, "", msg))
+	assert.Equal(t, testOutbound.Recipients, msg.Recipients)
+	assert.Equal(t, "<1@example.com>", msg.Headers.Get("Message-ID"))
+
+	rec := httptest.NewRecorder()
+	a.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/queue/"+id+"/message", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "message/rfc822", rec.Header().Get("Content-Type"))
+	assert.Equal(t, data, rec.Body.String())
+
+	// the retry fails, and the message stays queued
+	queued := &queuedMessage{}
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodPost, "/queue/"+id+"/retry", "", queued))
+	assert.Equal(t, 2, queued.Attempts)
+
+	// the export is imported with new IDs, due at once
+	exported := []*exportedMessage{}
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodGet, "/queue/export", "", &exported))
+	require.Len(t, exported, 1)
+	assert.Equal(t, data, string(exported[0].Data))
+
+	other := newTestQueue(t, t.TempDir(), nil)
+	b := newAdminServer(nil, &relayShared{queue: other}, conf, "")
+
+	body, err := json.Marshal(exported)
+	require.NoError(t, err)
+
+	rec = httptest.NewRecorder()
+	b.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/queue/import", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	ids := []string{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&ids))
+	require.Len(t, ids, 1)
+	assert.NotEqual(t, id, ids[0])
+
+	imported, err := other.get(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, exported[0].Created, imported.Created)
+	assert.Equal(t, 2, imported.Attempts)
+	assert.WithinDuration(t, time.Now(), imported.NextAttempt, time.Minute)
+
+	for _, bad := range []string{"{}", "[{}]", `[{"host":"upstream:25","recipients":["alice@example.com"]}]`} {
+		rec = httptest.NewRecorder()
+		b.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/queue/import", strings.NewReader(bad)))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, bad)
+	}
+
+	// the retry succeeds, and the message is removed
+	fail = false
+	assert.Equal(t, http.StatusNoContent, adminRequest(t, a, http.MethodPost, "/queue/"+id+"/retry", "", nil))
+
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, a, http.MethodGet, "/queue/"+id, "", nil))
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, a, http.MethodPost, "/queue/"+id+"/retry", "", nil))
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, a, http.MethodGet, "/queue/bogus/message", "", nil))
+}
+
+func TestAdminQuarantine(t *testing.T) {
+	t.Parallel()
+
+	a := newAdminServer(nil, &relayShared{}, newConfigStore(&config{}), "")
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, a, http.MethodGet, "/quarantine", "", nil))
+
+	u := startFakeUpstream(t)
+	r, _ := quarantineRelay(t, u.addr, "policy")
+
+	a = newAdminServer([]*relay{r}, r.shared, r.conf, "")
+
+	require.NoError(t, sendQuarantineMsg(t, r, "Subject: spam 1\r\n\r\nhello\r\n"))
+	require.NoError(t, sendQuarantineMsg(t, r, "Subject: spam 2\r\n\r\nhello\r\n"))
+
+	msgs := []*quarantinedMessage{}
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodGet, "/quarantine", "", &msgs))
+	require.Len(t, msgs, 2)
+
+	msg := &quarantinedMessage{}
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodGet, "/quarantine/"+msgs[0].ID, "", msg))
+	assert.Equal(t, msgs[0], msg)
+
+	rec := httptest.NewRecorder()
+	a.srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/quarantine/"+msg.ID+"/message", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "message/rfc822", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "Subject: spam 1\r\n\r\nhello\r\n", rec.Body.String())
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodPost, "/quarantine/"+msgs[0].ID+"/release", "", msg))
+	assert.Equal(t, http.StatusNoContent, adminRequest(t, a, http.MethodDelete, "/quarantine/"+msgs[1].ID, "", nil))
+
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, a, http.MethodGet, "/quarantine/"+msgs[0].ID, "", nil))
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, a, http.MethodDelete, "/quarantine/"+msgs[1].ID, "", nil))
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, a, http.MethodPost, "/quarantine/bogus/release", "", nil))
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodGet, "/quarantine", "", &msgs))
+	assert.Empty(t, msgs)
+
+	_, delivered := u.received()
+	require.Len(t, delivered, 1)
+	assert.Contains(t, delivered[0], "Subject: spam 1\n")
+}
+
+func TestAdminReload(t *testing.T) {
+	t.Parallel()
+
+	conf := newConfigStore(&config{allowedSender: "old"})
+	a := newAdminServer(nil, &relayShared{}, conf, "")
+
+	conf.read = func() (*config, error) { return nil, errors.New("invalid config") }
+
+	errResp := map[string]string{}
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, a, http.MethodPost, "/reload", "", &errResp))
+	assert.Equal(t, "invalid config", errResp["error"])
+
+	conf.read = func() (*config, error) { return &config{allowedSender: "new"}, nil }
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, a, http.MethodPost, "/reload", "", nil))
+	assert.Equal(t, "new", conf.get().allowedSender)
+}
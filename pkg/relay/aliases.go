@@ -0,0 +1,125 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+// how deep aliases pointing to other aliases are expanded
+const aliasMaxDepth = 10
+
+// aliases rewrite or expand recipient addresses, like the virtual map of
+// Postfix. Keys are lowercased addresses, or domains prefixed with "@" which
+// catch all the addresses of the domain without their own alias.
+type aliases map[string][]string
+
+// loadAliasesFile reads the aliases from file. Each line should be in the
+// form "alias target[, target...]", where alias is an address or a domain
+// prefixed with "@" (e.g. "@example.com"), and the targets are separated by
+// commas or spaces. Targets can be aliases themselves. Empty lines and lines
+// starting with "#" are ignored.
+func loadAliasesFile(file string) (aliases, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := aliases{}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected \"alias target[, target...]\"", n)
+		}
+
+		key := strings.ToLower(fields[0])
+		if _, domain, ok := strings.Cut(key, "@"); !ok || domain == "" {
+			return nil, fmt.Errorf("line %d: invalid alias %q", n, fields[0])
+		}
+
+		for _, target := range fields[1:] {
+			if _, err := mail.ParseAddress(target); err != nil {
+				return nil, fmt.Errorf("line %d: invalid target %q: %w", n, target, err)
+			}
+		}
+
+		a[key] = append(a[key], fields[1:]...)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// expand returns the addresses the recipient is delivered to: its targets,
+// expanded recursively, or the recipient itself if it has no alias. Aliases
+// including themselves are still delivered to (e.g. "bob@example.com
+// bob@example.com alice@example.com"), and duplicate or looping targets are
+// skipped.
+func (a aliases) expand(rcpt string) []string {
+	if len(a) == 0 {
+		return []string{rcpt}
+	}
+
+	var (
+		expanded []string
+		seen     = map[string]bool{}
+	)
+
+	var walk func(addr string, depth int)
+	walk = func(addr string, depth int) {
+		key := strings.ToLower(addr)
+		if seen[key] {
+			return
+		}
+
+		seen[key] = true
+
+		targets, ok := a.lookup(key)
+		if !ok || depth >= aliasMaxDepth {
+			expanded = append(expanded, addr)
+			return
+		}
+
+		for _, target := range targets {
+			if strings.EqualFold(target, addr) {
+				expanded = append(expanded, addr)
+				continue
+			}
+
+			walk(target, depth+1)
+		}
+	}
+
+	walk(rcpt, 0)
+
+	return expanded
+}
+
+// lookup returns the targets of the address, or of its domain
+func (a aliases) lookup(addr string) ([]string, bool) {
+	if targets, ok := a[addr]; ok {
+		return targets, true
+	}
+
+	if i := strings.LastIndex(addr, "@"); i != -1 {
+		targets, ok := a[addr[i:]]
+		return targets, ok
+	}
+
+	return nil, false
+}
@@ -0,0 +1,100 @@
+package relay
+
+import (
+	"context"
+	"net/smtp"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadAliasesFile(t *testing.T) {
+	t.Parallel()
+
+	a, err := loadAliasesFile(writeTestFile(t, "aliases", `
+# comment
+Info@example.com    alice@example.org, bob@example.net
+sales@example.com carol@example.org dave@example.org
+@example.com catchall@example.org
+`))
+	require.NoError(t, err)
+	assert.Equal(t, aliases{
+		"info@example.com":  {"alice@example.org", "bob@example.net"},
+		"sales@example.com": {"carol@example.org", "dave@example.org"},
+		"@example.com":      {"catchall@example.org"},
+	}, a)
+
+	for _, content := range []string{"info@example.com", "info alice@example.org", "info@ alice@example.org", "info@example.com alice@"} {
+		_, err = loadAliasesFile(writeTestFile(t, "aliases", content))
+		require.Error(t, err, content)
+	}
+
+	_, err = loadAliasesFile(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
+
+func TestAliasesExpand(t *testing.T) {
+	t.Parallel()
+
+	var empty aliases
+	assert.Equal(t, []string{"bob@example.com"}, empty.expand("bob@example.com"))
+
+	a := aliases{
+		"info@example.com":  {"alice@example.org", "team@example.com"},
+		"team@example.com":  {"bob@example.net", "alice@example.org"},
+		"bob@example.com":   {"bob@example.com", "archive@example.org"},
+		"loop@example.com":  {"loop2@example.com"},
+		"loop2@example.com": {"loop@example.com", "carol@example.org"},
+		"@example.net":      {"catchall@example.org"},
+		"dave@example.net":  {"dave@example.org"},
+	}
+
+	for rcpt, expected := range map[string][]string{
+		"INFO@example.com":  {"alice@example.org", "catchall@example.org"},
+		"bob@example.com":   {"bob@example.com", "archive@example.org"},
+		"loop@example.com":  {"carol@example.org"},
+		"eve@example.net":   {"catchall@example.org"},
+		"dave@example.net":  {"dave@example.org"},
+		"frank@example.com": {"frank@example.com"},
+	} {
+		assert.Equal(t, expected, a.expand(rcpt), rcpt)
+	}
+
+	// aliases are reloaded
+	cfg := (&config{}).reloaded(&config{aliases: a})
+	assert.Equal(t, a, cfg.aliases)
+}
+
+func TestAliasesRelay(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv := startTestSMTPServer(ctx, t)
+
+	a, err := loadAliasesFile(writeTestFile(t, "aliases", `
+info@example.com alice@example.org, bob@example.org
+broken@example.com carol@unreachable.example.com
+`))
+	require.NoError(t, err)
+
+	// nothing listens on the discard port
+	addr := startRelayConfig(ctx, t, "", &config{
+		remoteHost: srv.addr + " *@unreachable.example.com=127.0.0.1:9",
+		aliases:    a,
+	})
+
+	err = smtp.SendMail(addr, nil, "dave@example.net", []string{"info@example.com", "bob@example.org"},
+		[]byte("Subject: test\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+	require.Len(t, *srv.msgs, 1)
+	assert.Equal(t, []string{"alice@example.org", "bob@example.org"}, (*srv.msgs)[0].Recipients)
+
+	// failures are reported for the alias
+	err = smtp.SendMail(addr, nil, "dave@example.net", []string{"broken@example.com"},
+		[]byte("Subject: test\r\n\r\nhello\r\n"))
+	require.Error(t, err)
+}
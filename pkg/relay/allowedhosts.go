@@ -0,0 +1,151 @@
+package relay
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// max duration of the lookups of the allowed hostnames
+const allowedHostsTimeout = 10 * time.Second
+
+// allowedHosts are the hostnames of allowed_nets, for services whose
+// addresses change, such as cloud mail services. They're resolved on the
+// first connection, then again in the background once their addresses are
+// older than the refresh interval. The previous addresses are kept if the
+// lookups fail.
+type allowedHosts struct {
+	names   []string
+	refresh time.Duration
+
+	// lookupIP overrides the DNS lookups - for tests
+	lookupIP func(ctx context.Context, network, host string) ([]net.IP, error)
+
+	mu         sync.Mutex
+	ips        map[string][]net.IP // by hostname
+	resolved   time.Time
+	refreshing bool
+
+	logger *slog.Logger
+}
+
+// newAllowedHosts returns nil if there are no names
+func newAllowedHosts(names []string, refresh time.Duration) *allowedHosts {
+	if len(names) == 0 {
+		return nil
+	}
+
+	return &allowedHosts{
+		names:    names,
+		refresh:  refresh,
+		lookupIP: net.DefaultResolver.LookupIP,
+		ips:      map[string][]net.IP{},
+		logger:   slog.Default().With(slog.String("component", "allowed_hosts")),
+	}
+}
+
+// splitAllowedHosts separates the hostnames from the networks of s, a list
+// separated by spaces. Only names with a dot are hostnames, so that typos in
+// networks are still reported.
+func splitAllowedHosts(s string) (nets string, hosts []string) {
+	var netstrs []string
+
+	for _, entry := range splitstr(s, ' ') {
+		if isAllowedHostname(entry) {
+			hosts = append(hosts, strings.ToLower(strings.TrimSuffix(entry, ".")))
+		} else {
+			netstrs = append(netstrs, entry)
+		}
+	}
+
+	return strings.Join(netstrs, " "), hosts
+}
+
+func isAllowedHostname(s string) bool {
+	name := strings.TrimSuffix(s, ".")
+	if !strings.Contains(name, ".") || net.ParseIP(name) != nil {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") {
+			return false
+		}
+
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// contains reports whether ip is one of the addresses of the hostnames
+func (h *allowedHosts) contains(ctx context.Context, ip net.IP) bool {
+	if h == nil {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch {
+	case h.resolved.IsZero():
+		// the first lookups are waited for, as there are no addresses yet
+		h.ips = h.lookup(ctx, h.ips)
+		h.resolved = time.Now()
+	case !h.refreshing && time.Since(h.resolved) > h.refresh:
+		h.refreshing = true
+
+		go func(prev map[string][]net.IP) {
+			ips := h.lookup(context.WithoutCancel(ctx), prev)
+
+			h.mu.Lock()
+			defer h.mu.Unlock()
+
+			h.ips = ips
+			h.resolved = time.Now()
+			h.refreshing = false
+		}(h.ips)
+	}
+
+	for _, ips := range h.ips {
+		for _, hostIP := range ips {
+			if hostIP.Equal(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// lookup resolves the addresses of the hostnames, keeping the previous ones
+// of those failing
+func (h *allowedHosts) lookup(ctx context.Context, prev map[string][]net.IP) map[string][]net.IP {
+	ctx, cancel := context.WithTimeout(ctx, allowedHostsTimeout)
+	defer cancel()
+
+	ips := make(map[string][]net.IP, len(h.names))
+
+	for _, name := range h.names {
+		addrs, err := h.lookupIP(ctx, "ip", name)
+		if err != nil {
+			h.logger.WarnContext(ctx, "cannot resolve allowed hostname, keeping its previous addresses",
+				slog.String("hostname", name),
+				slog.Int("addresses", len(prev[name])),
+				slog.Any("error", err))
+
+			addrs = prev[name]
+		}
+
+		ips[name] = addrs
+	}
+
+	return ips
+}
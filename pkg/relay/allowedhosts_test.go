@@ -0,0 +1,142 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitAllowedHosts(t *testing.T) {
+	t.Parallel()
+
+	nets, hosts := splitAllowedHosts("127.0.0.0/8 relay.example.com ::1/128 Mail.Example.NET. bogus 192.0.2.1 bad_host..example.com")
+	assert.Equal(t, "127.0.0.0/8 ::1/128 bogus 192.0.2.1 bad_host..example.com", nets)
+	assert.Equal(t, []string{"relay.example.com", "mail.example.net"}, hosts)
+
+	nets, hosts = splitAllowedHosts("")
+	assert.Empty(t, nets)
+	assert.Empty(t, hosts)
+
+	// typos in networks are still reported
+	cfg := &config{allowedNetsStr: "10.0.0.0/8 bogus"}
+	require.Error(t, cfg.setup())
+
+	cfg = &config{allowedNetsStr: "10.0.0.0/8 relay.example.com", allowedNetsTTL: time.Minute}
+	require.NoError(t, cfg.setup())
+	require.Len(t, cfg.allowedNets, 1)
+	require.NotNil(t, cfg.allowedHosts)
+	assert.Equal(t, []string{"relay.example.com"}, cfg.allowedHosts.names)
+}
+
+func TestAllowedHosts(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	var (
+		mu      sync.Mutex
+		lookups int
+		fail    bool
+		addrs   = map[string][]net.IP{
+			"relay.example.com": {net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::10")},
+			"mail.example.net":  {net.ParseIP("198.51.100.20")},
+		}
+	)
+
+	h := newAllowedHosts([]string{"relay.example.com", "mail.example.net"}, time.Hour)
+	h.lookupIP = func(_ context.Context, _, host string) ([]net.IP, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		lookups++
+
+		if fail {
+			return nil, errors.New("no such host")
+		}
+
+		return addrs[host], nil
+	}
+
+	assert.True(t, h.contains(ctx, net.ParseIP("192.0.2.10")))
+	assert.True(t, h.contains(ctx, net.ParseIP("2001:db8::10")))
+	assert.True(t, h.contains(ctx, net.ParseIP("198.51.100.20")))
+	assert.False(t, h.contains(ctx, net.ParseIP("192.0.2.11")))
+
+	// the addresses are cached until they're refreshed
+	mu.Lock()
+	assert.Equal(t, 2, lookups)
+	addrs["relay.example.com"] = []net.IP{net.ParseIP("192.0.2.11")}
+	mu.Unlock()
+
+	assert.False(t, h.contains(ctx, net.ParseIP("192.0.2.11")))
+
+	// stale addresses are refreshed in the background
+	refresh := func() {
+		h.mu.Lock()
+		h.resolved = time.Now().Add(-2 * time.Hour)
+		h.mu.Unlock()
+
+		h.contains(ctx, nil)
+
+		require.Eventually(t, func() bool {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+
+			return !h.refreshing
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	refresh()
+
+	assert.True(t, h.contains(ctx, net.ParseIP("192.0.2.11")))
+	assert.False(t, h.contains(ctx, net.ParseIP("192.0.2.10")))
+
+	// and kept if the lookups fail
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+
+	refresh()
+
+	assert.True(t, h.contains(ctx, net.ParseIP("192.0.2.11")))
+	assert.True(t, h.contains(ctx, net.ParseIP("198.51.100.20")))
+
+	assert.Nil(t, newAllowedHosts(nil, time.Hour))
+	assert.False(t, (*allowedHosts)(nil).contains(ctx, net.ParseIP("192.0.2.10")))
+}
+
+func TestConnectionCheckerAllowedHosts(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	h := newAllowedHosts([]string{"relay.example.com"}, time.Hour)
+	h.lookupIP = func(context.Context, string, string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.10")}, nil
+	}
+
+	r := &relay{shared: &relayShared{}}
+
+	peer := func(ip string) smtpd.Peer {
+		return smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 12345}}
+	}
+
+	// hostnames alone don't allow every address
+	check := r.connectionChecker(nil, h)
+	require.NoError(t, check(ctx, peer("192.0.2.10")))
+	require.ErrorIs(t, check(ctx, peer("192.0.2.11")), smtpd.ErrIPDenied)
+
+	_, localhost, _ := net.ParseCIDR("127.0.0.0/8")
+
+	check = r.connectionChecker([]*net.IPNet{localhost}, h)
+	require.NoError(t, check(ctx, peer("127.0.0.1")))
+	require.NoError(t, check(ctx, peer("192.0.2.10")))
+	require.ErrorIs(t, check(ctx, peer("198.51.100.1")), smtpd.ErrIPDenied)
+}
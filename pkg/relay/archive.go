@@ -0,0 +1,200 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// bucket archive schemes
+const (
+	archiveS3  = "s3"
+	archiveGCS = "gs"
+)
+
+// how long to wait for the upload of an archived message
+const archiveTimeout = time.Minute
+
+// errArchiveFailed is returned when a message can't be archived: it isn't
+// relayed without its copy, and the client retries it later
+var errArchiveFailed = &smtpd.Error{Code: 451, EnhancedCode: "4.3.0", Msg: "Could not archive message, try again later"}
+
+// archiveEntry is the envelope of an archived message, stored next to it. It
+// is the data of the key template, with the Date and SenderDomain methods.
+type archiveEntry struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	Helo       string    `json:"helo,omitempty"`
+	Username   string    `json:"username,omitempty"`
+	TLS        bool      `json:"tls"`
+	Sender     string    `json:"sender"`
+	Recipients []string  `json:"recipients"`
+	Size       int       `json:"size"`
+}
+
+func newArchiveEntry(id string, peer smtpd.Peer, env *smtpd.Envelope) *archiveEntry {
+	return &archiveEntry{
+		ID:         id,
+		Time:       time.Now().UTC(),
+		Client:     peer.Addr.String(),
+		Helo:       peer.HeloName,
+		Username:   peer.Username,
+		TLS:        peer.TLS != nil,
+		Sender:     env.Sender,
+		Recipients: env.Recipients,
+		Size:       len(env.Data),
+	}
+}
+
+// Date returns the day the message was received, as YYYY/MM/DD
+func (e *archiveEntry) Date() string {
+	return e.Time.Format("2006/01/02")
+}
+
+// SenderDomain returns the lowercased domain of the sender, empty for null
+// senders
+func (e *archiveEntry) SenderDomain() string {
+	_, domain, _ := strings.Cut(e.Sender, "@")
+
+	return strings.ToLower(domain)
+}
+
+// archiver stores a copy of every relayed message, for retention
+// independently of its delivery
+type archiver interface {
+	store(ctx context.Context, entry *archiveEntry, data []byte) error
+}
+
+// newArchiver returns nil unless archive_url is set
+func newArchiver(cfg *config) (archiver, error) {
+	if cfg.archiveURL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(cfg.archiveURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive_url: %w", err)
+	}
+
+	keys, err := template.New("key").Option("missingkey=error").Parse(cfg.archiveKeyTmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive_key_template: %w", err)
+	}
+
+	switch u.Scheme {
+	case archiveS3, archiveGCS:
+		return newBucketArchiver(cfg, u, keys)
+	case archiveMaildir, archiveMbox:
+		return newMailboxArchiver(cfg, u)
+	default:
+		return nil, fmt.Errorf("unsupported archive_url scheme %q", u.Scheme)
+	}
+}
+
+// bucketArchiver uploads the messages to an S3 or GCS bucket, gzipped, as
+// <prefix><key>.eml.gz, with their envelope as <prefix><key>.json
+type bucketArchiver struct {
+	client *s3Client
+	prefix string
+	keys   *template.Template
+}
+
+func newBucketArchiver(cfg *config, u *url.URL, keys *template.Template) (*bucketArchiver, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("archive_url %q has no bucket", cfg.archiveURL)
+	}
+
+	accessKey, secretKey := cfg.archiveAccessKey, cfg.archiveSecretKey
+	if accessKey == "" && secretKey == "" {
+		accessKey, secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("archive_url %q requires archive_access_key and archive_secret_key to be set", cfg.archiveURL)
+	}
+
+	region, endpoint := cfg.archiveRegion, cfg.archiveEndpoint
+
+	switch {
+	case u.Scheme == archiveGCS:
+		// GCS ignores the region, but it's part of the signature
+		if region == "" {
+			region = "auto"
+		}
+
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+	case region == "":
+		region = "us-east-1"
+	}
+
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &bucketArchiver{
+		client: &s3Client{
+			endpoint:  endpoint,
+			bucket:    u.Host,
+			region:    region,
+			accessKey: accessKey,
+			secretKey: secretKey,
+			client:    &http.Client{Timeout: archiveTimeout},
+		},
+		prefix: prefix,
+		keys:   keys,
+	}, nil
+}
+
+// store uploads the message, then its envelope
+func (a *bucketArchiver) store(ctx context.Context, entry *archiveEntry, data []byte) error {
+	var key strings.Builder
+	if err := a.keys.Execute(&key, entry); err != nil {
+		return fmt.Errorf("archive key: %w", err)
+	}
+
+	var msg bytes.Buffer
+
+	zw := gzip.NewWriter(&msg)
+	if _, err := zw.Write(data); err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+
+	name := a.prefix + strings.TrimPrefix(key.String(), "/")
+
+	if err := a.client.put(ctx, name+".eml.gz", "application/gzip", msg.Bytes()); err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+
+	if err := a.client.put(ctx, name+".json", "application/json", meta); err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startBucket starts a fake S3 endpoint storing the objects put by path,
+// and failing with the given status if it isn't 0
+func startBucket(t *testing.T, status int) (*httptest.Server, func() map[string][]byte) {
+	t.Helper()
+
+	var (
+		mu      sync.Mutex
+		objects = map[string][]byte{}
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		objects[r.URL.Path] = body
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() map[string][]byte {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return objects
+	}
+}
+
+func testArchiveEntry() *archiveEntry {
+	return newArchiveEntry("1234", smtpd.Peer{
+		Addr:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1025},
+		HeloName: "client.example.com",
+	}, &smtpd.Envelope{
+		Sender:     "Bob@Example.com",
+		Recipients: []string{"alice@example.org"},
+		Data:       []byte("Subject: test\r\n\r\nhello\r\n"),
+	})
+}
+
+func TestNewArchiver(t *testing.T) {
+	t.Parallel()
+
+	a, err := newArchiver(&config{})
+	require.NoError(t, err)
+	assert.Nil(t, a)
+
+	for _, url := range []string{"ftp://bucket", "s3:///prefix"} {
+		_, err = newArchiver(&config{archiveURL: url, archiveKeyTmpl: "{{.ID}}"})
+		require.Error(t, err, url)
+	}
+
+	_, err = newArchiver(&config{archiveURL: "s3://bucket", archiveKeyTmpl: "{{.ID", archiveAccessKey: "a", archiveSecretKey: "s"})
+	require.Error(t, err)
+
+	a, err = newArchiver(&config{archiveURL: "gs://bucket/", archiveKeyTmpl: "{{.ID}}", archiveAccessKey: "a", archiveSecretKey: "s"})
+	require.NoError(t, err)
+
+	b := a.(*bucketArchiver)
+	assert.Equal(t, "https://storage.googleapis.com", b.client.endpoint)
+	assert.Equal(t, "auto", b.client.region)
+	assert.Equal(t, "bucket", b.client.bucket)
+	assert.Empty(t, b.prefix)
+
+	a, err = newArchiver(&config{archiveURL: "s3://bucket/mail/", archiveKeyTmpl: "{{.ID}}", archiveAccessKey: "a", archiveSecretKey: "s"})
+	require.NoError(t, err)
+
+	b = a.(*bucketArchiver)
+	assert.Equal(t, "https://s3.us-east-1.amazonaws.com", b.client.endpoint)
+	assert.Equal(t, "mail/", b.prefix)
+}
+
+func TestArchiveEntry(t *testing.T) {
+	t.Parallel()
+
+	e := testArchiveEntry()
+	e.Time = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	assert.Equal(t, "2024/01/02", e.Date())
+	assert.Equal(t, "example.com", e.SenderDomain())
+	assert.Equal(t, "127.0.0.1:1025", e.Client)
+	assert.Equal(t, 24, e.Size)
+
+	e.Sender = ""
+	assert.Empty(t, e.SenderDomain())
+}
+
+func TestBucketArchiver(t *testing.T) {
+	t.Parallel()
+
+	srv, objects := startBucket(t, 0)
+
+	a, err := newArchiver(&config{
+		archiveURL:       "s3://bucket/mail",
+		archiveEndpoint:  srv.URL,
+		archiveKeyTmpl:   "{{.SenderDomain}}/{{.Date}}/{{.ID}}",
+		archiveAccessKey: "a",
+		archiveSecretKey: "s",
+	})
+	require.NoError(t, err)
+
+	e := testArchiveEntry()
+	e.Time = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+	require.NoError(t, a.store(context.Background(), e, data))
+
+	objs := objects()
+	require.Len(t, objs, 2)
+
+	zr, err := gzip.NewReader(bytes.NewReader(objs["/bucket/mail/example.com/2024/01/02/1234.eml.gz"]))
+	require.NoError(t, err)
+
+	msg, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, data, msg)
+
+	var meta archiveEntry
+	require.NoError(t, json.Unmarshal(objs["/bucket/mail/example.com/2024/01/02/1234.json"], &meta))
+	assert.Equal(t, *e, meta)
+}
+
+func TestBucketArchiverError(t *testing.T) {
+	t.Parallel()
+
+	srv, objects := startBucket(t, http.StatusForbidden)
+
+	a, err := newArchiver(&config{
+		archiveURL:       "s3://bucket",
+		archiveEndpoint:  srv.URL,
+		archiveKeyTmpl:   "{{.ID}}",
+		archiveAccessKey: "a",
+		archiveSecretKey: "s",
+	})
+	require.NoError(t, err)
+
+	err = a.store(context.Background(), testArchiveEntry(), []byte("hello\r\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "403")
+	assert.Empty(t, objects())
+
+	// unknown template fields fail the archiving
+	a, err = newArchiver(&config{
+		archiveURL:       "s3://bucket",
+		archiveEndpoint:  srv.URL,
+		archiveKeyTmpl:   "{{.Nope}}",
+		archiveAccessKey: "a",
+		archiveSecretKey: "s",
+	})
+	require.NoError(t, err)
+	require.Error(t, a.store(context.Background(), testArchiveEntry(), []byte("hello\r\n")))
+}
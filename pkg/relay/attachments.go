@@ -0,0 +1,359 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// Attachment rule actions
+const (
+	attachmentReject = "reject" // reject the message
+	attachmentStrip  = "strip"  // replace the attachment with a notice
+)
+
+// Attachment rule criteria
+const (
+	attachmentExt  = "ext"  // file name extensions, e.g. exe
+	attachmentType = "type" // declared content types, as globs, e.g. application/x-*
+	attachmentSize = "size" // max decoded size, e.g. 10MB
+)
+
+// attachmentRule matches attachments by extension, content type or size
+type attachmentRule struct {
+	action   string
+	criteria string
+	values   []string // extensions or content types
+	size     int64
+}
+
+// attachmentPolicy is the attachment rules applied to relayed messages before
+// they're forwarded: the global rules to all the messages, and the rules of
+// the upstream host they're delivered to
+type attachmentPolicy struct {
+	global []attachmentRule
+	routes map[string][]attachmentRule // by upstream host
+}
+
+// loadAttachmentPolicy reads the attachment rules from file. Each line is a
+// rule, in one of the forms:
+//
+//	reject|strip ext exe js ...
+//	reject|strip type application/x-msdownload application/x-* ...
+//	reject|strip size 10MB
+//
+// where extensions are matched case-insensitively, content types are globs
+// matched against the declared Content-Type of the attachments, and sizes are
+// in bytes, or with a KB, MB or GB suffix. Rejected messages aren't delivered
+// to the upstream, stripped attachments are replaced with a notice. The rules
+// apply to all messages until a "[route host]" line, after which they only
+// apply to the messages delivered to the upstream host, as given in
+// remote_host. Empty lines and lines starting with "#" are ignored.
+func loadAttachmentPolicy(file string) (*attachmentPolicy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	policy := &attachmentPolicy{routes: map[string][]attachmentRule{}}
+
+	add := func(r attachmentRule) { policy.global = append(policy.global, r) }
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			kind, host, _ := strings.Cut(strings.TrimSpace(line[1:len(line)-1]), " ")
+			host = strings.TrimSpace(host)
+
+			if kind != "route" || host == "" {
+				return nil, fmt.Errorf("line %d: expected \"[route host]\"", n)
+			}
+
+			add = func(r attachmentRule) { policy.routes[host] = append(policy.routes[host], r) }
+
+			continue
+		}
+
+		rule, err := parseAttachmentRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		add(rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// parseAttachmentRule parses a single rule, see loadAttachmentPolicy
+func parseAttachmentRule(line string) (attachmentRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return attachmentRule{}, errors.New(`expected "action criteria value..."`)
+	}
+
+	rule := attachmentRule{action: fields[0], criteria: fields[1]}
+
+	switch rule.action {
+	case attachmentReject, attachmentStrip:
+	default:
+		return attachmentRule{}, fmt.Errorf("unknown action %q", rule.action)
+	}
+
+	switch rule.criteria {
+	case attachmentExt:
+		for _, ext := range fields[2:] {
+			rule.values = append(rule.values, strings.ToLower(strings.TrimPrefix(ext, ".")))
+		}
+	case attachmentType:
+		for _, typ := range fields[2:] {
+			typ = strings.ToLower(typ)
+			if _, err := path.Match(typ, ""); err != nil {
+				return attachmentRule{}, fmt.Errorf("invalid content type %q: %w", typ, err)
+			}
+
+			rule.values = append(rule.values, typ)
+		}
+	case attachmentSize:
+		size, err := parseByteSize(fields[2])
+		if err != nil || len(fields) != 3 {
+			return attachmentRule{}, fmt.Errorf("invalid size %q", strings.Join(fields[2:], " "))
+		}
+
+		rule.size = size
+	default:
+		return attachmentRule{}, fmt.Errorf("unknown criteria %q", rule.criteria)
+	}
+
+	return rule, nil
+}
+
+// parseByteSize parses a size in bytes, optionally with a KB, MB or GB suffix
+// (powers of 1024)
+func parseByteSize(s string) (int64, error) {
+	mult := int64(1)
+
+	for i, suffix := range []string{"KB", "MB", "GB"} {
+		if n, ok := strings.CutSuffix(strings.ToUpper(s), suffix); ok {
+			s, mult = n, int64(1)<<(10*(i+1))
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return n * mult, nil
+}
+
+// forRoute returns the global rules and the rules of the upstream host
+func (p *attachmentPolicy) forRoute(host string) []attachmentRule {
+	if p == nil {
+		return nil
+	}
+
+	return append(append([]attachmentRule{}, p.global...), p.routes[host]...)
+}
+
+// attachment is a part of a message with a file name, or an attachment
+// disposition
+type attachment struct {
+	filename    string
+	contentType string
+	size        int64 // decoded size
+}
+
+// matches reports whether the rule applies to the attachment
+func (r *attachmentRule) matches(a *attachment) bool {
+	switch r.criteria {
+	case attachmentExt:
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(a.filename), "."))
+		for _, v := range r.values {
+			if ext != "" && ext == v {
+				return true
+			}
+		}
+	case attachmentType:
+		for _, v := range r.values {
+			if ok, _ := path.Match(v, a.contentType); ok {
+				return true
+			}
+		}
+	case attachmentSize:
+		return a.size > r.size
+	}
+
+	return false
+}
+
+// errAttachmentsNested is returned for messages with multiparts nested too
+// deep for their attachments to be checked
+var errAttachmentsNested = &smtpd.Error{
+	Code:         554,
+	EnhancedCode: "5.7.1",
+	Msg:          "Message rejected: MIME parts nested too deep to check attachments",
+}
+
+// attachmentRejectedError is returned for messages rejected by an attachment
+// rule
+func attachmentRejectedError(a *attachment) *smtpd.Error {
+	return &smtpd.Error{
+		Code:         554,
+		EnhancedCode: "5.7.1",
+		Msg:          fmt.Sprintf("Message rejected: attachment %q not allowed", a.filename),
+	}
+}
+
+// filterAttachments applies the rules to the attachments of the message, and
+// returns the message with the stripped attachments replaced with a notice,
+// along with their names. Messages with an attachment matching a reject rule
+// fail with an *smtpd.Error. Unchanged messages are returned as is.
+func filterAttachments(env *smtpd.Envelope, rules []attachmentRule) ([]byte, []string, error) {
+	if len(rules) == 0 {
+		return env.Data, nil, nil
+	}
+
+	// the MIME structure is parsed once for all the upstream hosts
+	part, err := env.MIME()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f := &attachmentFilter{rules: rules, nl: "\n"}
+	if line, _, _ := bytes.Cut(env.Data, []byte("\n")); bytes.HasSuffix(line, []byte("\r")) {
+		f.nl = "\r\n"
+	}
+
+	filtered, err := f.filter(part)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(f.stripped) == 0 {
+		return env.Data, nil, nil
+	}
+
+	return filtered.Bytes(), f.stripped, nil
+}
+
+// attachmentFilter walks the MIME tree of a message, see filterAttachments
+type attachmentFilter struct {
+	rules    []attachmentRule
+	nl       string // line ending of the message
+	stripped []string
+}
+
+// filter returns the part with its attachments filtered, the part itself
+// being checked first: it's the whole message for single part messages. The
+// parts are shared by the upstream hosts, so they're left as is: the changed
+// ones are copies. Multiparts nested too deep to be walked are rejected, as
+// their attachments can't be checked.
+func (f *attachmentFilter) filter(part *smtpd.MIMEPart) (*smtpd.MIMEPart, error) {
+	if part.Truncated {
+		return nil, errAttachmentsNested
+	}
+
+	if a := partAttachment(part); a != nil {
+		// reject rules take precedence over strip ones
+		action := ""
+
+		for j := range f.rules {
+			if f.rules[j].matches(a) && action != attachmentReject {
+				action = f.rules[j].action
+			}
+		}
+
+		switch action {
+		case attachmentReject:
+			return nil, attachmentRejectedError(a)
+		case attachmentStrip:
+			f.stripped = append(f.stripped, a.filename)
+			return f.notice(part, a), nil
+		}
+
+		return part, nil
+	}
+
+	var parts []*smtpd.MIMEPart // nil until a part is replaced
+
+	for i, p := range part.Parts {
+		replaced, err := f.filter(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if replaced != p && parts == nil {
+			parts = slices.Clone(part.Parts)
+		}
+
+		if parts != nil {
+			parts[i] = replaced
+		}
+	}
+
+	if parts == nil {
+		return part, nil
+	}
+
+	filtered := *part
+	filtered.Parts = parts
+
+	return &filtered, nil
+}
+
+// notice returns the part replacing a stripped attachment: a text part,
+// keeping the header fields of the attachment other than the Content-* ones,
+// e.g. the From and Subject of a single part message
+func (f *attachmentFilter) notice(part *smtpd.MIMEPart, a *attachment) *smtpd.MIMEPart {
+	notice := *part
+	notice.Header = maps.Clone(part.Header)
+
+	for key := range notice.Header {
+		if strings.HasPrefix(key, "Content-") {
+			delete(notice.Header, key)
+		}
+	}
+
+	notice.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	notice.Header.Set("Content-Disposition", "inline")
+	notice.Body = []byte(fmt.Sprintf("The attachment %q was removed by the attachment policy.", a.filename) + f.nl)
+
+	return smtpd.ParseMIME(notice.Bytes())
+}
+
+// partAttachment returns the attachment of the part, nil if it's not one.
+// Multiparts are walked into even if they're attachments.
+func partAttachment(part *smtpd.MIMEPart) *attachment {
+	if !part.Attachment {
+		return nil
+	}
+
+	contentType := part.MediaType
+	if part.Header.Get("Content-Type") == "" {
+		contentType = "application/octet-stream"
+	}
+
+	return &attachment{filename: part.Filename, contentType: contentType, size: part.Size}
+}
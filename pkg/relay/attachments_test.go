@@ -0,0 +1,271 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAttachmentMessage is a message with a text body, and a nested multipart
+// holding a zip and an exe attachment
+const testAttachmentMessage = "From: bob@example.com\r\n" +
+	"Subject: test\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"preamble\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"hello\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/mixed; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: application/zip; name=\"docs.zip\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"UEsDBBQAAAAIAA==\r\n" +
+	"--inner\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"Setup.EXE\"\r\n" +
+	"\r\n" +
+	"MZ\r\n" +
+	"--inner--\r\n" +
+	"--outer--\r\n" +
+	"epilogue\r\n"
+
+func TestLoadAttachmentPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy, err := loadAttachmentPolicy(writeTestFile(t, "attachment_policy", `
+# global rules
+reject ext .exe js
+strip size 10MB
+
+[route smtp.example.com:587]
+strip type application/x-* application/zip
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, []attachmentRule{
+		{action: attachmentReject, criteria: attachmentExt, values: []string{"exe", "js"}},
+		{action: attachmentStrip, criteria: attachmentSize, size: 10 << 20},
+	}, policy.global)
+	assert.Len(t, policy.forRoute("smtp.example.com:587"), 3)
+	assert.Len(t, policy.forRoute("mx.example.com:25"), 2)
+
+	var nilPolicy *attachmentPolicy
+	assert.Empty(t, nilPolicy.forRoute("mx.example.com:25"))
+
+	for _, line := range []string{
+		"drop ext exe",
+		"reject ext",
+		"reject name exe",
+		"reject type [",
+		"reject size big",
+		"reject size 1 MB",
+		"[listener 0.0.0.0:25]",
+		"[route]",
+	} {
+		_, err = loadAttachmentPolicy(writeTestFile(t, "attachment_policy", line))
+		require.Error(t, err, line)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	t.Parallel()
+
+	for s, want := range map[string]int64{
+		"0":     0,
+		"1024":  1024,
+		"512KB": 512 << 10,
+		"10mb":  10 << 20,
+		"2GB":   2 << 30,
+	} {
+		size, err := parseByteSize(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, size, s)
+	}
+
+	for _, s := range []string{"", "MB", "-1", "1.5MB", "1TB"} {
+		_, err := parseByteSize(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestFilterAttachments(t *testing.T) {
+	t.Parallel()
+
+	data := []byte(testAttachmentMessage)
+
+	t.Run("no matching rule", func(t *testing.T) {
+		t.Parallel()
+
+		rules := []attachmentRule{{action: attachmentReject, criteria: attachmentExt, values: []string{"js"}}}
+
+		filtered, stripped, err := filterAttachments(&smtpd.Envelope{Data: data}, rules)
+		require.NoError(t, err)
+		assert.Empty(t, stripped)
+		assert.Equal(t, testAttachmentMessage, string(filtered))
+	})
+
+	t.Run("reject by extension", func(t *testing.T) {
+		t.Parallel()
+
+		rules := []attachmentRule{
+			{action: attachmentStrip, criteria: attachmentType, values: []string{"application/*"}},
+			{action: attachmentReject, criteria: attachmentExt, values: []string{"exe"}},
+		}
+
+		_, _, err := filterAttachments(&smtpd.Envelope{Data: data}, rules)
+
+		var smtpErr *smtpd.Error
+		require.ErrorAs(t, err, &smtpErr)
+		assert.Equal(t, 554, smtpErr.Code)
+		assert.Contains(t, smtpErr.Msg, "Setup.EXE")
+	})
+
+	t.Run("strip by content type", func(t *testing.T) {
+		t.Parallel()
+
+		rules := []attachmentRule{{action: attachmentStrip, criteria: attachmentType, values: []string{"application/zip"}}}
+		env := &smtpd.Envelope{Data: data}
+
+		filtered, stripped, err := filterAttachments(env, rules)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"docs.zip"}, stripped)
+
+		want := strings.Replace(testAttachmentMessage,
+			"Content-Type: application/zip; name=\"docs.zip\"\r\n"+
+				"Content-Transfer-Encoding: base64\r\n"+
+				"\r\n"+
+				"UEsDBBQAAAAIAA==\r\n",
+			"Content-Type: text/plain; charset=utf-8\r\n"+
+				"Content-Disposition: inline\r\n"+
+				"\r\n"+
+				"The attachment \"docs.zip\" was removed by the attachment policy.\r\n"+
+				"\r\n", 1)
+		assert.Equal(t, want, string(filtered))
+
+		// the original message is left untouched
+		assert.Equal(t, testAttachmentMessage, string(data))
+
+		// and so is its MIME structure, shared by the upstream hosts
+		part, err := env.MIME()
+		require.NoError(t, err)
+		assert.Equal(t, testAttachmentMessage, string(part.Bytes()))
+	})
+
+	t.Run("strip by size", func(t *testing.T) {
+		t.Parallel()
+
+		// the zip is 10 bytes once decoded, the exe 2 bytes
+		rules := []attachmentRule{{action: attachmentStrip, criteria: attachmentSize, size: 5}}
+
+		_, stripped, err := filterAttachments(&smtpd.Envelope{Data: data}, rules)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"docs.zip"}, stripped)
+	})
+
+	t.Run("single part attachment", func(t *testing.T) {
+		t.Parallel()
+
+		msg := "From: bob@example.com\r\n" +
+			"Subject: test\r\n" +
+			"Content-Type: application/octet-stream; name=evil.exe\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"TVo=\r\n"
+
+		rules := []attachmentRule{{action: attachmentReject, criteria: attachmentExt, values: []string{"exe"}}}
+
+		_, _, err := filterAttachments(&smtpd.Envelope{Data: []byte(msg)}, rules)
+
+		var smtpErr *smtpd.Error
+		require.ErrorAs(t, err, &smtpErr)
+		assert.Contains(t, smtpErr.Msg, "evil.exe")
+
+		// stripped, the message keeps its other header fields
+		rules[0].action = attachmentStrip
+
+		filtered, stripped, err := filterAttachments(&smtpd.Envelope{Data: []byte(msg)}, rules)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"evil.exe"}, stripped)
+		assert.Equal(t, "From: bob@example.com\r\n"+
+			"Subject: test\r\n"+
+			"Content-Type: text/plain; charset=utf-8\r\n"+
+			"Content-Disposition: inline\r\n"+
+			"\r\n"+
+			"The attachment \"evil.exe\" was removed by the attachment policy.\r\n", string(filtered))
+	})
+
+	t.Run("nested too deep", func(t *testing.T) {
+		t.Parallel()
+
+		msg := "Content-Type: application/octet-stream; name=evil.exe\r\n\r\nMZ\r\n"
+		for i := range 11 {
+			msg = fmt.Sprintf("Content-Type: multipart/mixed; boundary=b%d\r\n\r\n--b%d\r\n%s\r\n--b%d--\r\n", i, i, msg, i)
+		}
+
+		// whatever the rules
+		rules := []attachmentRule{{action: attachmentStrip, criteria: attachmentExt, values: []string{"js"}}}
+
+		_, _, err := filterAttachments(&smtpd.Envelope{Data: []byte(msg)}, rules)
+		require.Equal(t, errAttachmentsNested, err)
+	})
+
+	t.Run("not multipart", func(t *testing.T) {
+		t.Parallel()
+
+		rules := []attachmentRule{{action: attachmentReject, criteria: attachmentSize, size: 0}}
+		msg := []byte("Subject: test\r\n\r\nhello\r\n")
+
+		filtered, stripped, err := filterAttachments(&smtpd.Envelope{Data: msg}, rules)
+		require.NoError(t, err)
+		assert.Empty(t, stripped)
+		assert.Equal(t, msg, filtered)
+	})
+}
+
+func TestAttachmentPolicyRelay(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv := startTestSMTPServer(ctx, t)
+
+	// messages are rejected before their delivery is attempted, so nothing
+	// needs to listen on the discard port
+	policy, err := loadAttachmentPolicy(writeTestFile(t, "attachment_policy", `
+strip ext zip
+[route 127.0.0.1:9]
+reject ext exe
+`))
+	require.NoError(t, err)
+
+	addr := startRelayConfig(ctx, t, "", &config{
+		remoteHost:  srv.addr + " *@blocked.example.com=127.0.0.1:9",
+		attachments: policy,
+	})
+
+	msg := []byte(testAttachmentMessage)
+
+	err = smtp.SendMail(addr, nil, "bob@example.com", []string{"alice@example.com"}, msg)
+	require.NoError(t, err)
+
+	err = smtp.SendMail(addr, nil, "bob@example.com", []string{"carol@blocked.example.com"}, msg)
+	require.ErrorContains(t, err, "554")
+	require.ErrorContains(t, err, "Setup.EXE")
+
+	require.Len(t, *srv.msgs, 1)
+	assert.Contains(t, string((*srv.msgs)[0].Data), "The attachment \"docs.zip\" was removed")
+	assert.Contains(t, string((*srv.msgs)[0].Data), "Setup.EXE")
+}
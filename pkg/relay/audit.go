@@ -0,0 +1,321 @@
+package relay
+
+import (
+	"cmp"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// format of the suffix of rotated audit logs, sorting chronologically
+const auditRotatedFormat = "20060102T150405.000000000Z"
+
+// deliveryAttempt is the outcome of an attempt to deliver a message to some
+// of its recipients, logged to syslog and to the audit log
+type deliveryAttempt struct {
+	id         string // of the message, or of the queued message
+	queueID    string // the message was queued as, if deferred
+	messageID  string
+	peer       smtpd.Peer // zero for queued messages
+	out        *outbound
+	recipients []string // the ones of out the outcome is for
+	size       int
+	attempt    int
+	start      time.Time
+	delay      time.Duration // since the message was received
+	err        error
+	deferred   bool // retried later, by the queue or the client
+}
+
+// auditRecord is a line of the audit log
+type auditRecord struct {
+	Time         time.Time `json:"time"`
+	ID           string    `json:"id"`
+	QueueID      string    `json:"queue_id,omitempty"`
+	MessageID    string    `json:"message_id,omitempty"`
+	ClientIP     string    `json:"client_ip,omitempty"`
+	Username     string    `json:"username,omitempty"`
+	Sender       string    `json:"sender"`
+	Recipients   []string  `json:"recipients"`
+	Upstream     string    `json:"upstream"`
+	UpstreamID   string    `json:"upstream_queue_id,omitempty"`
+	Attempt      int       `json:"attempt"`
+	Status       string    `json:"status"`
+	Code         int       `json:"code,omitempty"`
+	EnhancedCode string    `json:"enhanced_code,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Size         int       `json:"size,omitempty"`
+	DurationMS   int64     `json:"duration_ms"`
+	TLS          *auditTLS `json:"tls,omitempty"`
+}
+
+// auditTLS is the TLS state of the upstream connection
+type auditTLS struct {
+	Version    string `json:"version"`
+	Cipher     string `json:"cipher"`
+	ServerName string `json:"server_name,omitempty"`
+}
+
+// newAuditRecord builds the record of the attempt, finished at now
+func newAuditRecord(a *deliveryAttempt, now time.Time) *auditRecord {
+	rec := &auditRecord{
+		Time:       now.UTC(),
+		ID:         a.id,
+		QueueID:    a.queueID,
+		MessageID:  a.messageID,
+		Username:   a.peer.Username,
+		Sender:     a.out.Sender,
+		Recipients: a.recipients,
+		Upstream:   cmp.Or(a.out.sentVia, a.out.Host),
+		Attempt:    a.attempt,
+		Status:     syslogSent,
+		Code:       250,
+		Size:       a.size,
+		DurationMS: now.Sub(a.start).Milliseconds(),
+	}
+
+	if ip := peerIP(a.peer); ip != nil {
+		rec.ClientIP = ip.String()
+	}
+
+	if state := a.out.tlsState; state != nil {
+		rec.TLS = &auditTLS{
+			Version:    tls.VersionName(state.Version),
+			Cipher:     tls.CipherSuiteName(state.CipherSuite),
+			ServerName: state.ServerName,
+		}
+	}
+
+	if a.err == nil {
+		rec.UpstreamID = upstreamQueueID(a.out.reply)
+		return rec
+	}
+
+	rec.Status, rec.Code, rec.Error = syslogBounced, 0, a.err.Error()
+	if a.deferred {
+		rec.Status = syslogDeferred
+	}
+
+	var (
+		smtpErr *smtpd.Error
+		tperr   *textproto.Error
+	)
+
+	switch {
+	case errors.As(a.err, &smtpErr):
+		rec.Code, rec.EnhancedCode = smtpErr.Code, smtpErr.EnhancedCode
+	case errors.As(a.err, &tperr):
+		rec.Code = tperr.Code
+	}
+
+	return rec
+}
+
+// auditLog is an append-only log of the delivery attempts, with a JSON record
+// on each line (NDJSON), separate from the operational logs. It's rotated
+// once it exceeds maxSize, and at each multiple of maxAge (e.g. at midnight
+// UTC with 24h), the rotated files being suffixed with the time of their
+// rotation. Only the latest backups rotated files are kept, all of them if
+// it's 0.
+type auditLog struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	backups int
+
+	// now returns the current time - overridable for tests
+	now func() time.Time
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	period time.Time // of maxAge the file was written in
+
+	logger *slog.Logger
+}
+
+// newAuditLog returns nil if path is empty. The file is only opened once
+// there's something to write.
+func newAuditLog(path string, maxSize int64, maxAge time.Duration, backups int) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("directory of %s doesn't exist", path)
+	}
+
+	return &auditLog{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		backups: backups,
+		now:     time.Now,
+		logger:  slog.Default().With(slog.String("component", "audit_log")),
+	}, nil
+}
+
+// delivered appends the record of the attempt to the log
+func (l *auditLog) delivered(a *deliveryAttempt) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	line, err := json.Marshal(newAuditRecord(a, now))
+	if err != nil {
+		l.logger.Error("cannot encode audit record", slog.Any("error", err))
+		return
+	}
+
+	line = append(line, '\n')
+
+	if err := l.write(line, now); err != nil {
+		l.logger.Error("cannot write audit record", slog.String("id", a.id), slog.Any("error", err))
+	}
+}
+
+// write appends the line to the file, opening or rotating it first if
+// needed. It must be called with the lock held.
+func (l *auditLog) write(line []byte, now time.Time) error {
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+
+	if l.size > 0 && ((l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize) ||
+		(l.maxAge > 0 && !now.Truncate(l.maxAge).Equal(l.period))) {
+		if err := l.rotate(now); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+
+	if l.maxAge > 0 {
+		l.period = now.Truncate(l.maxAge)
+	}
+
+	return err
+}
+
+// open opens the file for appending, after the existing records if any. It
+// must be called with the lock held.
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	l.f, l.size = f, info.Size()
+
+	// files last written in a previous period are rotated on the next write
+	if l.maxAge > 0 {
+		l.period = info.ModTime().Truncate(l.maxAge)
+	}
+
+	return nil
+}
+
+// rotate renames the file and opens a new one, removing the oldest rotated
+// files. It must be called with the lock held.
+func (l *auditLog) rotate(now time.Time) error {
+	if err := l.f.Close(); err != nil {
+		l.logger.Warn("cannot close audit log", slog.Any("error", err))
+	}
+
+	l.f = nil
+
+	rotated := l.path + "." + now.UTC().Format(auditRotatedFormat)
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	if l.backups > 0 {
+		l.prune()
+	}
+
+	return nil
+}
+
+// prune removes the rotated files beyond the number of backups to keep
+func (l *auditLog) prune() {
+	entries, err := os.ReadDir(filepath.Dir(l.path))
+	if err != nil {
+		l.logger.Warn("cannot list rotated audit logs", slog.Any("error", err))
+		return
+	}
+
+	prefix := filepath.Base(l.path) + "."
+
+	var rotated []string
+
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		if _, err := time.Parse(auditRotatedFormat, suffix); err == nil {
+			rotated = append(rotated, entry.Name())
+		}
+	}
+
+	// oldest first
+	slices.Sort(rotated)
+
+	for len(rotated) > l.backups {
+		if err := os.Remove(filepath.Join(filepath.Dir(l.path), rotated[0])); err != nil {
+			l.logger.Warn("cannot remove rotated audit log", slog.Any("error", err))
+		}
+
+		rotated = rotated[1:]
+	}
+}
+
+// close is nil-safe
+func (l *auditLog) close() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f != nil {
+		_ = l.f.Close()
+		l.f = nil
+	}
+}
+
+// messageID returns the Message-Id of the header, without its angle brackets
+func messageID(h textproto.MIMEHeader) string {
+	return strings.Trim(h.Get("Message-Id"), "<> ")
+}
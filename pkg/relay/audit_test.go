@@ -0,0 +1,289 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readAuditLog returns the records of the audit log file
+func readAuditLog(t *testing.T, path string) []auditRecord {
+	t.Helper()
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	var records []auditRecord
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec auditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec), scanner.Text())
+
+		records = append(records, rec)
+	}
+
+	require.NoError(t, scanner.Err())
+
+	return records
+}
+
+func TestNewAuditRecord(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 3, 5, 14, 30, 15, 0, time.UTC)
+
+	a := &deliveryAttempt{
+		id:        "id1",
+		messageID: "123@example.com",
+		peer: smtpd.Peer{
+			Username: "alice",
+			Addr:     &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345},
+		},
+		out: &outbound{
+			Host:    "mx:example.org",
+			Sender:  "alice@example.com",
+			sentVia: "mx1.example.org:25",
+			tlsState: &tls.ConnectionState{
+				Version:     tls.VersionTLS13,
+				CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+				ServerName:  "mx1.example.org",
+			},
+		},
+		recipients: []string{"bob@example.org"},
+		size:       1234,
+		attempt:    1,
+		start:      start,
+	}
+
+	assert.Equal(t, &auditRecord{
+		Time:       start.Add(1500 * time.Millisecond),
+		ID:         "id1",
+		MessageID:  "123@example.com",
+		ClientIP:   "192.0.2.10",
+		Username:   "alice",
+		Sender:     "alice@example.com",
+		Recipients: []string{"bob@example.org"},
+		Upstream:   "mx1.example.org:25",
+		Attempt:    1,
+		Status:     "sent",
+		Code:       250,
+		Size:       1234,
+		DurationMS: 1500,
+		TLS:        &auditTLS{Version: "TLS 1.3", Cipher: "TLS_AES_128_GCM_SHA256", ServerName: "mx1.example.org"},
+	}, newAuditRecord(a, start.Add(1500*time.Millisecond)))
+
+	a.err = &smtpd.Error{Code: 550, EnhancedCode: "5.1.1", Msg: "User unknown"}
+
+	rec := newAuditRecord(a, start)
+	assert.Equal(t, "bounced", rec.Status)
+	assert.Equal(t, 550, rec.Code)
+	assert.Equal(t, "5.1.1", rec.EnhancedCode)
+	assert.Equal(t, "550 5.1.1 User unknown", rec.Error)
+
+	a.err, a.deferred, a.queueID = &textproto.Error{Code: 421, Msg: "try again later"}, true, "q1"
+
+	rec = newAuditRecord(a, start)
+	assert.Equal(t, "deferred", rec.Status)
+	assert.Equal(t, 421, rec.Code)
+	assert.Empty(t, rec.EnhancedCode)
+	assert.Equal(t, "q1", rec.QueueID)
+
+	// errors without a reply, e.g. failing to connect, have no code
+	a.err = &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+
+	rec = newAuditRecord(a, start)
+	assert.Zero(t, rec.Code)
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.ndjson")
+
+	l, err := newAuditLog(path, 600, 24*time.Hour, 2)
+	require.NoError(t, err)
+
+	t.Cleanup(l.close)
+
+	now := time.Date(2024, 3, 5, 14, 30, 15, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	attempt := func(id string) *deliveryAttempt {
+		return &deliveryAttempt{
+			id:         id,
+			out:        &outbound{Host: "smtp.example.com:587", Sender: "alice@example.com"},
+			recipients: []string{"bob@example.org"},
+			attempt:    1,
+			start:      now,
+		}
+	}
+
+	// records are appended until the max size
+	l.delivered(attempt("id1"))
+	l.delivered(attempt("id2"))
+	l.delivered(attempt("id3"))
+
+	records := readAuditLog(t, path)
+	require.Len(t, records, 3)
+	assert.Equal(t, "id1", records[0].ID)
+	assert.Equal(t, "sent", records[0].Status)
+	assert.Equal(t, now, records[0].Time)
+
+	rotated := func() []string {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+
+		var names []string
+		for _, entry := range entries {
+			if name := entry.Name(); strings.HasPrefix(name, "audit.ndjson.") {
+				names = append(names, name)
+			}
+		}
+
+		return names
+	}
+
+	assert.Empty(t, rotated())
+
+	l.delivered(attempt("id4"))
+
+	require.Len(t, readAuditLog(t, path), 1)
+	assert.Equal(t, []string{"audit.ndjson.20240305T143015.000000000Z"}, rotated())
+
+	// and the file is rotated at midnight
+	now = now.Add(time.Hour)
+	l.delivered(attempt("id5"))
+	require.Len(t, readAuditLog(t, path), 2)
+
+	now = time.Date(2024, 3, 6, 0, 0, 1, 0, time.UTC)
+	l.delivered(attempt("id6"))
+
+	records = readAuditLog(t, path)
+	require.Len(t, records, 1)
+	assert.Equal(t, "id6", records[0].ID)
+	assert.Len(t, rotated(), 2)
+
+	// only the latest backups are kept
+	now = now.Add(24 * time.Hour)
+	l.delivered(attempt("id7"))
+
+	assert.Equal(t, []string{
+		"audit.ndjson.20240306T000001.000000000Z",
+		"audit.ndjson.20240307T000001.000000000Z",
+	}, rotated())
+
+	// the records of a previous run are appended to, unless they're from a
+	// previous period
+	l.close()
+
+	l, err = newAuditLog(path, 0, 24*time.Hour, 0)
+	require.NoError(t, err)
+
+	t.Cleanup(l.close)
+
+	l.now = func() time.Time { return time.Now() }
+	l.delivered(attempt("id8"))
+
+	records = readAuditLog(t, path)
+	require.Len(t, records, 2)
+	assert.Equal(t, "id8", records[1].ID)
+
+	require.NoError(t, os.Chtimes(path, time.Time{}, time.Now().Add(-48*time.Hour)))
+
+	l.close()
+	l.delivered(attempt("id9"))
+
+	records = readAuditLog(t, path)
+	require.Len(t, records, 1)
+	assert.Equal(t, "id9", records[0].ID)
+	assert.Len(t, rotated(), 3)
+
+	// the directory must exist
+	_, err = newAuditLog(filepath.Join(dir, "missing", "audit.ndjson"), 0, 0, 0)
+	require.Error(t, err)
+
+	l, err = newAuditLog("", 0, 0, 0)
+	require.NoError(t, err)
+	assert.Nil(t, l)
+
+	l.delivered(attempt("id10"))
+	l.close()
+}
+
+func TestAuditLogDeliveries(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "audit.ndjson")
+
+	l, err := newAuditLog(path, 0, 0, 0)
+	require.NoError(t, err)
+
+	t.Cleanup(l.close)
+
+	u := startFakeUpstream(t)
+	u.setReply("RCPT TO:<CAROL@EXAMPLE.COM>", "550 5.1.1 User unknown")
+
+	cfg := &config{
+		remoteHost: u.addr,
+		audit:      l,
+	}
+
+	r, err := newRelay(newConfigStore(cfg), listenerConfig{}, &relayShared{})
+	require.NoError(t, err)
+
+	data := "Message-Id: <123@example.com>\r\nSubject: hi\r\n\r\nhello\r\n"
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(data))).ReadMIMEHeader()
+	require.NoError(t, err)
+
+	peer := smtpd.Peer{
+		Username: "alice",
+		Addr:     &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345},
+	}
+	env := smtpd.Envelope{
+		Sender:     "alice@example.com",
+		Recipients: []string{"bob@example.com", "carol@example.com"},
+		Header:     header,
+		Data:       []byte(data),
+	}
+	_ = r.mailHandler()(ctx, peer, env)
+
+	records := readAuditLog(t, path)
+	require.Len(t, records, 2)
+
+	for _, rec := range records {
+		assert.NotEmpty(t, rec.ID)
+		assert.Equal(t, "123@example.com", rec.MessageID)
+		assert.Equal(t, "192.0.2.10", rec.ClientIP)
+		assert.Equal(t, "alice", rec.Username)
+		assert.Equal(t, "alice@example.com", rec.Sender)
+		assert.Equal(t, u.addr, rec.Upstream)
+		assert.Equal(t, 1, rec.Attempt)
+		assert.Nil(t, rec.TLS)
+	}
+
+	assert.Equal(t, []string{"bob@example.com"}, records[0].Recipients)
+	assert.Equal(t, "sent", records[0].Status)
+	assert.Equal(t, 250, records[0].Code)
+
+	assert.Equal(t, []string{"carol@example.com"}, records[1].Recipients)
+	assert.Equal(t, "bounced", records[1].Status)
+	assert.Equal(t, 550, records[1].Code)
+}
@@ -1,16 +1,16 @@
-package main
+package relay
 
 import (
 	"bufio"
 	"errors"
 	"os"
 	"strings"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
 	filename string
+
+	errUserNotFound = errors.New("user not found")
 )
 
 type AuthUser struct {
@@ -85,16 +85,19 @@ func AuthFetch(username string) (*AuthUser, error) {
 		return user, nil
 	}
 
-	return nil, errors.New("user not found")
+	return nil, errUserNotFound
 }
 
+// AuthCheckPassword checks the password of the user against its bcrypt or
+// argon2id hash. Unknown users are checked against a dummy argon2id hash, not
+// to be told apart from wrong passwords by the time they take.
 func AuthCheckPassword(username string, secret string) error {
 	user, err := AuthFetch(username)
+	if errors.Is(err, errUserNotFound) {
+		_ = checkPasswordHash(dummyPasswordHash(), secret)
+	}
 	if err != nil {
 		return err
 	}
-	if bcrypt.CompareHashAndPassword([]byte(user.passwordHash), []byte(secret)) == nil {
-		return nil
-	}
-	return errors.New("password invalid")
+	return checkPasswordHash(user.passwordHash, secret)
 }
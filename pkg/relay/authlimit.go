@@ -0,0 +1,46 @@
+package relay
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// newAuthLimiter returns the limiter of the failed AUTH attempts, nil unless
+// auth_max_failures is set
+func newAuthLimiter(cfg *config) *smtpd.AuthLimiter {
+	if cfg.authMaxFailures == 0 {
+		return nil
+	}
+
+	return &smtpd.AuthLimiter{
+		MaxFailures: cfg.authMaxFailures,
+		Delay:       cfg.authFailureDelay,
+		MaxDelay:    cfg.authMaxDelay,
+		Lockout:     cfg.authLockout,
+		OnLockout:   authLockedOut,
+	}
+}
+
+// authLockedOut logs and counts the lockout of a client IP or a username
+func authLockedOut(ctx context.Context, peer smtpd.Peer, kind, key string) {
+	// the IPs are locked whatever the port
+	clientIP := peer.Addr.String()
+	if ip := peerIP(peer); ip != nil {
+		clientIP = ip.String()
+	}
+
+	attrs := []any{
+		slog.String("component", "auth_limiter"),
+		slog.String("client_ip", clientIP),
+		slog.String("kind", kind),
+	}
+	if kind == smtpd.AuthLockUsername {
+		attrs = append(attrs, slog.String("username", key))
+	}
+
+	slog.WarnContext(ctx, "authentication locked after too many failures", attrs...)
+
+	authLockoutsCounter.WithLabelValues(kind).Inc()
+}
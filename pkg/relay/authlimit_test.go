@@ -0,0 +1,66 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAuthLimiter(t *testing.T) {
+	t.Parallel()
+
+	assert.Nil(t, newAuthLimiter(&config{}))
+
+	limiter := newAuthLimiter(&config{
+		authMaxFailures:  5,
+		authFailureDelay: 2 * time.Second,
+		authMaxDelay:     time.Minute,
+		authLockout:      time.Hour,
+	})
+	require.NotNil(t, limiter)
+	assert.Equal(t, 5, limiter.MaxFailures)
+	assert.Equal(t, 2*time.Second, limiter.Delay)
+	assert.Equal(t, time.Minute, limiter.MaxDelay)
+	assert.Equal(t, time.Hour, limiter.Lockout)
+	assert.NotNil(t, limiter.OnLockout)
+}
+
+func TestAuthLockedOut(t *testing.T) {
+	t.Parallel()
+
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}}
+
+	ips := testutil.ToFloat64(authLockoutsCounter.WithLabelValues(smtpd.AuthLockIP))
+	usernames := testutil.ToFloat64(authLockoutsCounter.WithLabelValues(smtpd.AuthLockUsername))
+
+	authLockedOut(context.Background(), peer, smtpd.AuthLockIP, "192.0.2.1")
+	authLockedOut(context.Background(), peer, smtpd.AuthLockUsername, "foo")
+	authLockedOut(context.Background(), peer, smtpd.AuthLockUsername, "bar")
+
+	assert.InDelta(t, ips+1, testutil.ToFloat64(authLockoutsCounter.WithLabelValues(smtpd.AuthLockIP)), 0)
+	assert.InDelta(t, usernames+2, testutil.ToFloat64(authLockoutsCounter.WithLabelValues(smtpd.AuthLockUsername)), 0)
+}
+
+// the default logger is replaced
+//
+//nolint:paralleltest
+func TestAuthLockedOutClientIP(t *testing.T) {
+	out := &bytes.Buffer{}
+
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(out, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}}
+	authLockedOut(context.Background(), peer, smtpd.AuthLockUsername, "foo")
+
+	assert.Contains(t, out.String(), "client_ip=192.0.2.1 ")
+}
@@ -0,0 +1,59 @@
+package relay
+
+import (
+	"context"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// authenticateMessage verifies the DKIM signatures of the message and checks
+// its DMARC policy if enabled, then stamps an Authentication-Results header
+// (RFC 8601) with the SPF, DKIM and DMARC results. Existing
+// Authentication-Results headers claiming to come from this relay are removed
+// first, so downstream systems can trust it. It returns the SMTP error to
+// reply with if the message should be rejected.
+func (r *relay) authenticateMessage(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) error {
+	// DKIM signatures must be verified before any header is added
+	verifications := r.dkim.verify(ctx, env.Data)
+
+	results := []authres.Result{}
+
+	if r.spf != nil {
+		spfRes := r.spf.result(ctx, peer, env.Sender)
+
+		results = append(results, &authres.SPFResult{
+			Value: authres.ResultValue(spfRes.result),
+			From:  env.Sender,
+			Helo:  peer.HeloName,
+		})
+	}
+
+	results = append(results, dkimResults(verifications)...)
+
+	if r.dmarc != nil {
+		res, err := r.dmarc.check(ctx, peer, env, verifications)
+		if err != nil {
+			return err
+		}
+
+		results = append(results, &authres.DMARCResult{
+			Value: authres.ResultValue(res.result),
+			From:  res.domain,
+		})
+	}
+
+	authservID := r.config(ctx).hostName
+
+	env.RemoveHeaders("Authentication-Results", func(value string) bool {
+		id, _, _ := strings.Cut(value, ";")
+		fields := strings.Fields(id)
+
+		return len(fields) > 0 && strings.EqualFold(fields[0], authservID)
+	})
+
+	env.AddHeader("Authentication-Results", authres.Format(authservID, results))
+
+	return nil
+}
@@ -0,0 +1,367 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// Auto-reply rule actions
+const (
+	autoReplyKeep    = "keep"    // deliver the original message (default)
+	autoReplyDiscard = "discard" // don't deliver the original message
+)
+
+// how many senders replied to are remembered before the expired ones are
+// pruned
+const autoReplyMaxTracked = 10000
+
+// autoReplyRule is the reply sent for the messages to an address
+type autoReplyRule struct {
+	tmpl    *template.Template
+	discard bool
+}
+
+// autoReplies are the auto-reply rules, by lowercased address or domain
+// prefixed with "@", as aliases
+type autoReplies map[string]*autoReplyRule
+
+// autoReplyData are the fields of the auto-reply templates
+type autoReplyData struct {
+	Sender    string // sender of the message, who the reply is sent to
+	Recipient string // recipient of the message, who the reply is from
+	Subject   string // decoded subject of the message
+	MessageID string // Message-ID of the message
+}
+
+// loadAutoRepliesFile reads the auto-reply rules from file. Each line should
+// be in the form "address template [keep|discard]", where address is an
+// address or a domain prefixed with "@" (e.g. "@example.com"), and template
+// the path of the reply template, relative to the file. discard drops the
+// messages to the address instead of delivering them. Empty lines and lines
+// starting with "#" are ignored.
+//
+// Templates are text/template files with the fields of autoReplyData, whose
+// output is the header fields of the reply (e.g. Subject), an empty line and
+// its body, e.g.:
+//
+//	Subject: Out of office: {{.Subject}}
+//
+//	I'm away until Monday, your message will be read then.
+func loadAutoRepliesFile(file string) (autoReplies, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	replies := autoReplies{}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected \"address template [keep|discard]\"", n)
+		}
+
+		key := strings.ToLower(fields[0])
+		if _, domain, ok := strings.Cut(key, "@"); !ok || domain == "" {
+			return nil, fmt.Errorf("line %d: invalid address %q", n, fields[0])
+		}
+
+		rule := &autoReplyRule{}
+
+		if len(fields) == 3 {
+			switch fields[2] {
+			case autoReplyKeep:
+			case autoReplyDiscard:
+				rule.discard = true
+			default:
+				return nil, fmt.Errorf("line %d: unknown action %q", n, fields[2])
+			}
+		}
+
+		path := fields[1]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(file), path)
+		}
+
+		rule.tmpl, err = template.New(filepath.Base(path)).Option("missingkey=error").ParseFiles(path)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid template: %w", n, err)
+		}
+
+		replies[key] = rule
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return replies, nil
+}
+
+// lookup returns the rule of the address, or of its domain
+func (a autoReplies) lookup(addr string) (*autoReplyRule, bool) {
+	addr = strings.ToLower(addr)
+
+	if rule, ok := a[addr]; ok {
+		return rule, true
+	}
+
+	if i := strings.LastIndex(addr, "@"); i != -1 {
+		rule, ok := a[addr[i:]]
+		return rule, ok
+	}
+
+	return nil, false
+}
+
+// replyTracker remembers when each sender was last replied to, so it's
+// replied to at most once per auto_reply_interval. The zero value is ready to
+// use.
+type replyTracker struct {
+	mu   sync.Mutex
+	sent map[string]time.Time // by recipient and sender
+}
+
+// allow reports whether the sender may be replied to on behalf of the
+// recipient, and records the reply if so
+func (t *replyTracker) allow(rcpt, sender string, interval time.Duration, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := strings.ToLower(rcpt + " " + sender)
+
+	if last, ok := t.sent[key]; ok && now.Sub(last) < interval {
+		return false
+	}
+
+	if t.sent == nil {
+		t.sent = map[string]time.Time{}
+	}
+
+	if len(t.sent) >= autoReplyMaxTracked {
+		maps.DeleteFunc(t.sent, func(_ string, last time.Time) bool {
+			return now.Sub(last) >= interval
+		})
+	}
+
+	t.sent[key] = now
+
+	return true
+}
+
+// autoReplyStage sends the replies of the auto_reply rules matching the
+// recipients once the message is delivered, and drops the recipients of the
+// discard rules. Messages to discarded recipients only are accepted without
+// being delivered.
+func (r *relay) autoReplyStage(next smtpd.Handler) smtpd.Handler {
+	return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+		cfg := r.config(ctx)
+		if len(cfg.autoReplies) == 0 {
+			return next(ctx, peer, env)
+		}
+
+		replied := []string{}
+		kept := make([]string, 0, len(env.Recipients))
+
+		for _, rcpt := range env.Recipients {
+			rule, ok := cfg.autoReplies.lookup(rcpt)
+			if ok {
+				replied = append(replied, rcpt)
+			}
+
+			if !ok || !rule.discard {
+				kept = append(kept, rcpt)
+			}
+		}
+
+		if len(replied) == 0 {
+			return next(ctx, peer, env)
+		}
+
+		if len(kept) > 0 {
+			env.Recipients = kept
+
+			if err := next(ctx, peer, env); err != nil {
+				return err
+			}
+		}
+
+		for _, rcpt := range replied {
+			rule, _ := cfg.autoReplies.lookup(rcpt)
+			r.autoReply(ctx, cfg, &env, rcpt, rule)
+		}
+
+		return nil
+	}
+}
+
+// autoReply sends the reply of the rule to the sender of the message, unless
+// it mustn't be replied to, or the sender was already replied to recently.
+// Replies are sent from the null sender, and queued if their delivery fails
+// temporarily.
+func (r *relay) autoReply(ctx context.Context, cfg *config, env *smtpd.Envelope, rcpt string, rule *autoReplyRule) {
+	logger := slog.With(slog.String("component", "auto_reply"), slog.String("uuid", messageUUID(ctx)),
+		slog.String("from", rcpt), slog.String("to", env.Sender))
+
+	if reason := autoReplySuppressed(env, rcpt); reason != "" {
+		logger.DebugContext(ctx, "not replying", slog.String("reason", reason))
+		return
+	}
+
+	now := time.Now()
+
+	if !r.shared.replies.allow(rcpt, env.Sender, cfg.autoReplyInterval, now) {
+		logger.DebugContext(ctx, "not replying", slog.String("reason", "already replied"))
+		return
+	}
+
+	data, err := autoReplyMessage(cfg.hostName, rule, env, rcpt, now)
+	if err != nil {
+		logger.ErrorContext(ctx, "could not generate auto-reply", slog.Any("error", err))
+		return
+	}
+
+	out := &outbound{
+		Host:       r.router.match(env.Sender),
+		Recipients: []string{env.Sender},
+		SMTPUTF8:   env.SMTPUTF8,
+		Body8Bit:   slices.ContainsFunc(data, func(c byte) bool { return c >= 0x80 }),
+		Size:       int64(len(data)),
+	}
+
+	err = r.shared.upstreams.send(ctx, cfg, out, bytes.NewReader(data))
+	if err != nil && r.shared.queue != nil && isTemporaryErr(err) {
+		id, qerr := r.shared.queue.enqueue(out, data, err)
+		if qerr == nil {
+			logger.WarnContext(ctx, "auto-reply deferred, queued for retry",
+				slog.String("queue_id", id), slog.Any("error", err))
+
+			return
+		}
+
+		logger.ErrorContext(ctx, "could not queue auto-reply", slog.Any("error", qerr))
+	}
+
+	if err != nil {
+		logger.ErrorContext(ctx, "could not send auto-reply", slog.Any("error", err))
+		return
+	}
+
+	logger.InfoContext(ctx, "auto-reply sent")
+}
+
+// autoReplySuppressed returns why the message mustn't be replied to
+// automatically, not to reply to other automatic messages, mailing lists, or
+// to the same address, which could loop (RFC 3834 section 2). It's empty if it
+// can be.
+func autoReplySuppressed(env *smtpd.Envelope, rcpt string) string {
+	sender := strings.ToLower(env.Sender)
+	local, _, _ := strings.Cut(sender, "@")
+
+	precedence := strings.ToLower(strings.TrimSpace(env.Header.Get("Precedence")))
+	autoSubmitted := strings.ToLower(strings.TrimSpace(env.Header.Get("Auto-Submitted")))
+
+	switch {
+	case sender == "":
+		return "null sender"
+	case sender == strings.ToLower(rcpt):
+		return "sent to itself"
+	case local == "mailer-daemon" || local == "postmaster" || strings.HasPrefix(local, "owner-") ||
+		strings.HasSuffix(local, "-request") || strings.Contains(strings.ReplaceAll(local, "-", ""), "noreply"):
+		return "automated sender"
+	case autoSubmitted != "" && autoSubmitted != "no":
+		return "automatic message"
+	case precedence == "bulk" || precedence == "list" || precedence == "junk":
+		return "bulk message"
+	case env.Header.Get("List-Id") != "" || env.Header.Get("List-Unsubscribe") != "":
+		return "mailing list message"
+	}
+
+	return ""
+}
+
+// autoReplyMessage returns the reply of the rule to the message: the output of
+// its template, with the header fields identifying it as an automatic reply
+// to the message (RFC 3834 section 3)
+func autoReplyMessage(hostName string, rule *autoReplyRule, env *smtpd.Envelope, rcpt string, now time.Time) ([]byte, error) {
+	messageID := strings.TrimSpace(env.Header.Get("Message-Id"))
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(env.Header.Get("Subject"))
+	if err != nil {
+		subject = env.Header.Get("Subject")
+	}
+
+	var out bytes.Buffer
+
+	err = rule.tmpl.Execute(&out, autoReplyData{
+		Sender:    env.Sender,
+		Recipient: rcpt,
+		Subject:   subject,
+		MessageID: messageID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.ReplaceAll(out.String(), "\r\n", "\n")
+	reply := smtpd.ParseMIME([]byte(strings.ReplaceAll(text, "\n", "\r\n")))
+
+	header := textproto.MIMEHeader{}
+	header.Set("From", "<"+rcpt+">")
+	header.Set("To", "<"+env.Sender+">")
+	header.Set("Subject", "Auto: "+subject)
+	header.Set("Date", now.Format(time.RFC1123Z))
+	header.Set("Message-ID", "<"+generateUUID()+"@"+hostName+">")
+	header.Set("MIME-Version", "1.0")
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "8bit")
+
+	if messageID != "" {
+		header.Set("In-Reply-To", messageID)
+		header.Set("References", strings.TrimSpace(env.Header.Get("References")+" "+messageID))
+	}
+
+	// the template may override the fields, but not mark the reply as a
+	// regular message
+	for k, v := range reply.Header {
+		header[k] = v
+	}
+
+	header.Set("Auto-Submitted", "auto-replied")
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", header.Get("Subject")))
+
+	var b bytes.Buffer
+
+	for _, k := range slices.Sorted(maps.Keys(header)) {
+		for _, v := range header[k] {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+
+	b.WriteString("\r\n")
+	b.Write(reply.Body)
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,172 @@
+package relay
+
+import (
+	"context"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeAutoReplies writes the rules file and the templates, by name, in a
+// temporary directory
+func writeAutoReplies(t *testing.T, rules string, templates map[string]string) string {
+	t.Helper()
+
+	file := writeTestFile(t, "auto_reply", rules)
+
+	for name, content := range templates {
+		require.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(file), name), []byte(content), 0o600))
+	}
+
+	return file
+}
+
+func TestLoadAutoRepliesFile(t *testing.T) {
+	t.Parallel()
+
+	templates := map[string]string{"vacation.txt": "Subject: Away\n\nI'm away.\n"}
+
+	replies, err := loadAutoRepliesFile(writeAutoReplies(t, `
+# comment
+Alice@example.com vacation.txt
+@example.org      vacation.txt discard
+`, templates))
+	require.NoError(t, err)
+	require.Len(t, replies, 2)
+
+	rule, ok := replies.lookup("alice@EXAMPLE.com")
+	require.True(t, ok)
+	assert.False(t, rule.discard)
+
+	rule, ok = replies.lookup("bob@example.org")
+	require.True(t, ok)
+	assert.True(t, rule.discard)
+
+	_, ok = replies.lookup("bob@example.com")
+	assert.False(t, ok)
+
+	for _, bad := range []string{
+		"alice@example.com",
+		"alice vacation.txt",
+		"alice@example.com vacation.txt forward",
+		"alice@example.com missing.txt",
+		"alice@example.com vacation.txt keep extra",
+	} {
+		_, err := loadAutoRepliesFile(writeAutoReplies(t, bad, templates))
+		require.Error(t, err, bad)
+	}
+
+	_, err = loadAutoRepliesFile(writeAutoReplies(t, "alice@example.com bad.txt", map[string]string{
+		"bad.txt": "Subject: {{.Subject\n",
+	}))
+	require.Error(t, err)
+}
+
+func TestAutoReplySuppressed(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		sender string
+		header string
+		reason string
+	}{
+		{"bob@example.org", "", ""},
+		{"bob@example.org", "Auto-Submitted: no", ""},
+		{"", "", "null sender"},
+		{"Alice@example.com", "", "sent to itself"},
+		{"MAILER-DAEMON@example.org", "", "automated sender"},
+		{"owner-list@example.org", "", "automated sender"},
+		{"list-request@example.org", "", "automated sender"},
+		{"no-reply@example.org", "", "automated sender"},
+		{"bob@example.org", "Auto-Submitted: auto-replied", "automatic message"},
+		{"bob@example.org", "Precedence: Bulk", "bulk message"},
+		{"bob@example.org", "List-Id: <list.example.org>", "mailing list message"},
+	} {
+		env := &smtpd.Envelope{Sender: tc.sender, Header: textproto.MIMEHeader{}}
+		if name, value, ok := strings.Cut(tc.header, ": "); ok {
+			env.Header.Set(name, value)
+		}
+
+		assert.Equal(t, tc.reason, autoReplySuppressed(env, "alice@example.com"), "%s %s", tc.sender, tc.header)
+	}
+}
+
+func TestReplyTracker(t *testing.T) {
+	t.Parallel()
+
+	var replies replyTracker
+
+	now := time.Now()
+
+	assert.True(t, replies.allow("alice@example.com", "bob@example.org", time.Hour, now))
+	assert.False(t, replies.allow("alice@example.com", "BOB@example.org", time.Hour, now.Add(time.Minute)))
+	assert.True(t, replies.allow("carol@example.com", "bob@example.org", time.Hour, now))
+	assert.True(t, replies.allow("alice@example.com", "bob@example.org", time.Hour, now.Add(time.Hour)))
+}
+
+func TestAutoReply(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	u := startFakeUpstream(t, "SMTPUTF8", "8BITMIME")
+
+	file := writeAutoReplies(t, `
+alice@example.com  vacation.txt
+noreply@example.com noreply.txt discard
+`, map[string]string{
+		"vacation.txt": "Subject: Out of office: {{.Subject}}\n\nHi {{.Sender}}, {{.Recipient}} is away.\n",
+		"noreply.txt":  "\nThis address isn't read.\n",
+	})
+
+	replies, err := loadAutoRepliesFile(file)
+	require.NoError(t, err)
+
+	addr := startRelayConfig(ctx, t, "", &config{
+		remoteHost:        u.addr,
+		hostName:          "relay.example.com",
+		autoReplies:       replies,
+		autoReplyInterval: time.Hour,
+	})
+
+	// the message is delivered, and replied to
+	require.NoError(t, sendMsg(t, addr, []string{"alice@example.com"}, "bob@example.org", "lunch", nil, "hello"))
+
+	commands, data := u.received()
+	require.Len(t, data, 2)
+	assert.Contains(t, data[0], "Subject: lunch\n")
+	assert.True(t, slices.ContainsFunc(commands, func(c string) bool { return strings.HasPrefix(c, "MAIL FROM:<>") }))
+	assert.Regexp(t, `^Auto-Submitted: auto-replied\n`, data[1])
+	assert.Contains(t, data[1], "From: <alice@example.com>\n")
+	assert.Contains(t, data[1], "To: <bob@example.org>\n")
+	assert.Contains(t, data[1], "Subject: Out of office: lunch\n")
+	assert.Contains(t, data[1], "\n\nHi bob@example.org, alice@example.com is away.\n")
+
+	// the sender was replied to already, and discarded recipients are
+	// replied to but not delivered to
+	require.NoError(t, sendMsg(t, addr, []string{"alice@example.com", "noreply@example.com"}, "bob@example.org", "again", nil, "hello"))
+
+	commands, data = u.received()
+	require.Len(t, data, 4)
+	assert.Contains(t, data[2], "Subject: again\n")
+	assert.Contains(t, data[3], "Subject: Auto: again\n")
+	assert.Contains(t, data[3], "From: <noreply@example.com>\n")
+	assert.NotContains(t, commands, "RCPT TO:<noreply@example.com>")
+
+	// automatic messages aren't replied to
+	require.NoError(t, sendMsg(t, addr, []string{"noreply@example.com"}, "carol@example.org", "re: again", textproto.MIMEHeader{
+		"Auto-Submitted": {"auto-replied"},
+	}, "hello"))
+
+	_, data = u.received()
+	assert.Len(t, data, 4)
+}
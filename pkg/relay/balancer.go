@@ -0,0 +1,350 @@
+package relay
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategies picking the host of an upstream group a message is delivered to
+const (
+	strategyFailover   = "failover"    // in the order they're listed
+	strategyRoundRobin = "round-robin" // each in turn
+	strategyWeighted   = "weighted"    // at random, in proportion to their weight
+)
+
+// upstreamGroup is a set of SMTP hosts an upstream route delivers to, given
+// as "host1:port*3,host2:port" where the optional weight follows a *
+type upstreamGroup struct {
+	hosts   []string
+	weights []int
+
+	// next is the index of the host tried first with round-robin
+	next atomic.Uint64
+}
+
+// isUpstreamGroup reports whether the route host is an upstream group
+func isUpstreamGroup(host string) bool {
+	return strings.Contains(host, ",")
+}
+
+// parseUpstreamGroup parses the hosts of an upstream group, see
+// upstreamGroup
+func parseUpstreamGroup(s string) (*upstreamGroup, error) {
+	g := &upstreamGroup{}
+
+	for _, entry := range strings.Split(s, ",") {
+		host, weight, found := strings.Cut(entry, "*")
+
+		w := 1
+		if found {
+			var err error
+			if w, err = strconv.Atoi(weight); err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight %q in upstream group %q", weight, s)
+			}
+		}
+
+		if _, _, err := net.SplitHostPort(host); err != nil || strings.Contains(host, "://") {
+			return nil, fmt.Errorf("invalid host %q in upstream group %q, expected host:port", host, s)
+		}
+
+		g.hosts = append(g.hosts, host)
+		g.weights = append(g.weights, w)
+	}
+
+	return g, nil
+}
+
+// upstreamBalancer spreads the deliveries to the upstream groups over their
+// hosts, with one of the strategies. Hosts whose connection fails are marked
+// down for deadTime, and tried last until then, or until a health check
+// succeeds.
+type upstreamBalancer struct {
+	strategy string
+	deadTime time.Duration
+
+	mu     sync.Mutex
+	groups map[string]*upstreamGroup // by route host
+	down   map[string]time.Time      // hosts marked down, until when
+
+	now func() time.Time
+}
+
+func newUpstreamBalancer(strategy string, deadTime time.Duration) (*upstreamBalancer, error) {
+	switch strategy {
+	case "":
+		strategy = strategyFailover
+	case strategyFailover, strategyRoundRobin, strategyWeighted:
+	default:
+		return nil, fmt.Errorf("unknown strategy %q, expected %s, %s or %s",
+			strategy, strategyFailover, strategyRoundRobin, strategyWeighted)
+	}
+
+	return &upstreamBalancer{
+		strategy: strategy,
+		deadTime: deadTime,
+		groups:   map[string]*upstreamGroup{},
+		down:     map[string]time.Time{},
+		now:      time.Now,
+	}, nil
+}
+
+// group returns the upstream group of the route host, nil if it's a single
+// host. Groups are parsed on first use, as policy rules may route to groups
+// of their own.
+func (b *upstreamBalancer) group(host string) (*upstreamGroup, error) {
+	if !isUpstreamGroup(host) {
+		return nil, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if g, ok := b.groups[host]; ok {
+		return g, nil
+	}
+
+	g, err := parseUpstreamGroup(host)
+	if err != nil {
+		return nil, err
+	}
+
+	b.groups[host] = g
+
+	return g, nil
+}
+
+// order returns the hosts of the group in the order they should be tried,
+// the ones marked down last
+func (b *upstreamBalancer) order(g *upstreamGroup) []string {
+	var hosts []string
+
+	switch b.strategy {
+	case strategyRoundRobin:
+		start := int(g.next.Add(1)-1) % len(g.hosts)
+		hosts = append(hosts, g.hosts[start:]...)
+		hosts = append(hosts, g.hosts[:start]...)
+	case strategyWeighted:
+		hosts = g.shuffle()
+	default:
+		hosts = append(hosts, g.hosts...)
+	}
+
+	up := make([]string, 0, len(hosts))
+	down := []string{}
+
+	b.mu.Lock()
+	now := b.now()
+
+	for _, host := range hosts {
+		if until, ok := b.down[host]; ok && now.Before(until) {
+			down = append(down, host)
+		} else {
+			up = append(up, host)
+		}
+	}
+	b.mu.Unlock()
+
+	return append(up, down...)
+}
+
+// shuffle returns the hosts in a random order, each host being picked before
+// the remaining ones in proportion to its weight
+func (g *upstreamGroup) shuffle() []string {
+	hosts := append([]string{}, g.hosts...)
+	weights := append([]int{}, g.weights...)
+
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+
+	for i := range hosts {
+		n := rand.IntN(total)
+
+		j := i
+		for ; n >= weights[j]; j++ {
+			n -= weights[j]
+		}
+
+		total -= weights[j]
+		hosts[i], hosts[j] = hosts[j], hosts[i]
+		weights[i], weights[j] = weights[j], weights[i]
+	}
+
+	return hosts
+}
+
+// markDown marks the host down for deadTime
+func (b *upstreamBalancer) markDown(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if until, ok := b.down[host]; !ok || !b.now().Before(until) {
+		slog.Warn("upstream host marked down", slog.String("component", "balancer"),
+			slog.String("host", host), slog.Duration("for", b.deadTime))
+	}
+
+	b.down[host] = b.now().Add(b.deadTime)
+	upstreamUpGauge.WithLabelValues(host).Set(0)
+}
+
+// markUp clears the down mark of the host, if any
+func (b *upstreamBalancer) markUp(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.down[host]; ok {
+		slog.Info("upstream host back up", slog.String("component", "balancer"), slog.String("host", host))
+		delete(b.down, host)
+	}
+
+	upstreamUpGauge.WithLabelValues(host).Set(1)
+}
+
+// upstreamDown reports whether the delivery failed because the upstream is
+// unreachable or unavailable, rather than because of the message: it couldn't
+// be connected to, dropped the connection, or replied 421
+func upstreamDown(err error) bool {
+	var (
+		netErr net.Error
+		tperr  *textproto.Error
+	)
+
+	switch {
+	case errors.As(err, &tperr):
+		return tperr.Code == 421
+	case errors.As(err, &netErr):
+		return true
+	default:
+		return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+}
+
+// sendGroup delivers the message to the hosts of the upstream group, in the
+// order of the strategy, until one accepts it or rejects it permanently.
+// The hosts tried are marked up or down, depending on their reply.
+func (p *upstreamPool) sendGroup(ctx context.Context, cfg *config, out *outbound, g *upstreamGroup, body io.Reader) error {
+	// the body is read again for each host it's sent to
+	rs, err := seekableBody(body)
+	if err != nil {
+		return err
+	}
+
+	for _, host := range cfg.balancer.order(g) {
+		if _, err = rs.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("data: %w", err)
+		}
+
+		hostOut := *out
+		hostOut.Host = host
+		hostOut.tlsState = nil
+
+		err = cfg.scheduler.deliver(ctx, &hostOut, func() error {
+			return p.sendSMTP(ctx, cfg, &hostOut, rs, cfg.mtaSTS.lookup(&hostOut))
+		})
+		out.sentThrough(host, &hostOut)
+
+		var (
+			tperr    *textproto.Error
+			rcptErrs recipientErrors
+		)
+
+		// hosts which replied are up, unless they're shutting down
+		switch {
+		case upstreamDown(err):
+			cfg.balancer.markDown(host)
+		case err == nil || errors.As(err, &tperr) || errors.As(err, &rcptErrs):
+			cfg.balancer.markUp(host)
+		}
+
+		// partial deliveries aren't retried with the next host, as the
+		// message would be delivered again to the accepted recipients
+		if err == nil || !isTemporaryErr(err) || errors.As(err, &rcptErrs) {
+			return err
+		}
+
+		slog.Debug("delivery to upstream host failed", slog.String("component", "balancer"),
+			slog.String("host", host), slog.Any("error", err))
+	}
+
+	return err
+}
+
+// check probes the hosts of the upstream groups every interval, with an
+// SMTP session greeting them, marking them up or down, until ctx is done
+func (b *upstreamBalancer) check(ctx context.Context, conf *configStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		hosts := map[string]bool{}
+
+		b.mu.Lock()
+		for _, g := range b.groups {
+			for _, host := range g.hosts {
+				hosts[host] = true
+			}
+		}
+		b.mu.Unlock()
+
+		for host := range hosts {
+			if err := probeUpstream(ctx, conf.get(), host, interval); err != nil {
+				slog.DebugContext(ctx, "upstream health check failed", slog.String("component", "balancer"),
+					slog.String("host", host), slog.Any("error", err))
+				b.markDown(host)
+
+				continue
+			}
+
+			b.markUp(host)
+		}
+	}
+}
+
+// probeUpstream opens an SMTP session with the host, greets it and quits
+func probeUpstream(ctx context.Context, cfg *config, host string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := cfg.dialer.dial(ctx, host)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	hostname, _, _ := net.SplitHostPort(host)
+
+	c, err := smtp.NewClient(conn, hostname)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+
+	if err = c.Hello(cmp.Or(cfg.hostName, "localhost")); err != nil {
+		return fmt.Errorf("hello: %w", err)
+	}
+
+	return c.Quit()
+}
@@ -0,0 +1,174 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUpstreamGroup(t *testing.T) {
+	t.Parallel()
+
+	g, err := parseUpstreamGroup("smtp1.example.com:587*3,smtp2.example.com:587")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"smtp1.example.com:587", "smtp2.example.com:587"}, g.hosts)
+	assert.Equal(t, []int{3, 1}, g.weights)
+
+	for _, bad := range []string{
+		"smtp1.example.com:587,smtp2.example.com",
+		"smtp1.example.com:587,",
+		"smtp1.example.com:587*0,smtp2.example.com:587",
+		"smtp1.example.com:587*x,smtp2.example.com:587",
+		"smtp1.example.com:587,lmtp://localhost:24",
+	} {
+		_, err := parseUpstreamGroup(bad)
+		require.Error(t, err, bad)
+
+		_, err = parseRoutes("*@example.com="+bad+" smtp.example.com:587", false)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestUpstreamBalancerOrder(t *testing.T) {
+	t.Parallel()
+
+	t.Run("failover", func(t *testing.T) {
+		t.Parallel()
+
+		b, err := newUpstreamBalancer(strategyFailover, time.Minute)
+		require.NoError(t, err)
+
+		now := time.Now()
+		b.now = func() time.Time { return now }
+
+		g, err := b.group("a:25,b:25,c:25")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a:25", "b:25", "c:25"}, b.order(g))
+
+		// hosts marked down are tried last, until they're up again
+		b.markDown("a:25")
+		assert.Equal(t, []string{"b:25", "c:25", "a:25"}, b.order(g))
+
+		now = now.Add(time.Minute)
+		assert.Equal(t, []string{"a:25", "b:25", "c:25"}, b.order(g))
+
+		b.markDown("b:25")
+		b.markUp("b:25")
+		assert.Equal(t, []string{"a:25", "b:25", "c:25"}, b.order(g))
+	})
+
+	t.Run("round-robin", func(t *testing.T) {
+		t.Parallel()
+
+		b, err := newUpstreamBalancer(strategyRoundRobin, time.Minute)
+		require.NoError(t, err)
+
+		g, err := b.group("a:25,b:25,c:25")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a:25", "b:25", "c:25"}, b.order(g))
+		assert.Equal(t, []string{"b:25", "c:25", "a:25"}, b.order(g))
+		assert.Equal(t, []string{"c:25", "a:25", "b:25"}, b.order(g))
+		assert.Equal(t, []string{"a:25", "b:25", "c:25"}, b.order(g))
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		t.Parallel()
+
+		b, err := newUpstreamBalancer(strategyWeighted, time.Minute)
+		require.NoError(t, err)
+
+		g, err := b.group("a:25*9,b:25")
+		require.NoError(t, err)
+
+		first := map[string]int{}
+
+		for range 1000 {
+			hosts := b.order(g)
+			require.ElementsMatch(t, []string{"a:25", "b:25"}, hosts)
+
+			first[hosts[0]]++
+		}
+
+		assert.InDelta(t, 900, first["a:25"], 60)
+	})
+
+	_, err := newUpstreamBalancer("random", time.Minute)
+	require.Error(t, err)
+}
+
+func TestUpstreamDown(t *testing.T) {
+	t.Parallel()
+
+	for err, expected := range map[error]bool{
+		fmt.Errorf("dial: %w", &textproto.Error{Code: 421, Msg: "4.3.2 shutting down"}): true,
+		&textproto.Error{Code: 451, Msg: "4.3.0 try again later"}:                       false,
+		&textproto.Error{Code: 550, Msg: "5.1.1 no such user"}:                          false,
+		fmt.Errorf("data: %w", io.ErrUnexpectedEOF):                                     true,
+		context.DeadlineExceeded:                                                        true,
+		errScheduleFailed:                                                               false,
+	} {
+		assert.Equal(t, expected, upstreamDown(err), err.Error())
+	}
+}
+
+func TestSendGroup(t *testing.T) {
+	t.Parallel()
+
+	u1 := startFakeUpstream(t)
+	u1.setReply("MAIL", "421 4.3.2 shutting down")
+
+	u2 := startFakeUpstream(t)
+
+	// the first host can't be connected to, the second is shutting down
+	group := "127.0.0.1:9," + u1.addr + "," + u2.addr
+
+	cfg := &config{hostName: "relay.example.com", remoteHost: group, remoteDeadTime: time.Minute}
+	require.NoError(t, cfg.setup())
+
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+	out := &outbound{Host: group, Sender: "bob@example.com", Recipients: []string{"alice@example.com"}}
+
+	var p *upstreamPool
+
+	require.NoError(t, p.send(context.Background(), cfg, out, bytes.NewReader(data)))
+	assert.Equal(t, u2.addr, out.sentVia)
+	assert.Equal(t, "queued as 12345", out.reply)
+
+	_, msgs := u2.received()
+	assert.Len(t, msgs, 1)
+
+	// the hosts which are down are tried last
+	g, err := cfg.balancer.group(group)
+	require.NoError(t, err)
+	assert.Equal(t, []string{u2.addr, "127.0.0.1:9", u1.addr}, cfg.balancer.order(g))
+
+	// permanent failures aren't retried with the other hosts
+	u2.setReply("RCPT", "550 5.1.1 no such user")
+
+	err = p.send(context.Background(), cfg, out, bytes.NewReader(data))
+	require.Error(t, err)
+	assert.False(t, isTemporaryErr(err))
+
+	commands, _ := u1.received()
+	assert.NotContains(t, commands, "RCPT TO:<alice@example.com>")
+}
+
+func TestProbeUpstream(t *testing.T) {
+	t.Parallel()
+
+	u := startFakeUpstream(t)
+	cfg := &config{hostName: "relay.example.com"}
+
+	require.NoError(t, probeUpstream(context.Background(), cfg, u.addr, time.Second))
+	require.Error(t, probeUpstream(context.Background(), cfg, "127.0.0.1:9", time.Second))
+
+	commands, _ := u.received()
+	assert.Equal(t, []string{"EHLO relay.example.com", "QUIT"}, commands)
+}
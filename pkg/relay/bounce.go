@@ -0,0 +1,200 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// enhanced status code at the start of upstream replies, e.g. "5.1.1 no such
+// user"
+var enhancedCodeRE = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3}) `)
+
+// bounceFailure is the failed delivery of a queued message to a recipient
+type bounceFailure struct {
+	rcpt string
+	err  error
+}
+
+// bounceRecipients returns the failed recipients of the message which a
+// bounce should be sent for: the ones which didn't opt out of failure
+// notifications with their NOTIFY parameter. Messages from the null sender
+// are never bounced.
+func bounceRecipients(msg *queuedMessage, rcpts []string, err error) []bounceFailure {
+	if msg.Sender == "" {
+		return nil
+	}
+
+	var rcptErrs recipientErrors
+	errors.As(err, &rcptErrs)
+
+	failures := []bounceFailure{}
+
+	for _, rcpt := range rcpts {
+		if notify := strings.ToUpper(msg.DSN[rcpt].Notify); notify != "" && !strings.Contains(notify, "FAILURE") {
+			continue
+		}
+
+		rcptErr := err
+		if e, ok := rcptErrs[rcpt]; ok {
+			rcptErr = e
+		}
+
+		failures = append(failures, bounceFailure{rcpt: rcpt, err: rcptErr})
+	}
+
+	return failures
+}
+
+// bounceMessage returns the delivery status notification of the failures of
+// the queued message, sent back to its sender (RFC 3464). It's a
+// multipart/report with a human readable explanation, the delivery status of
+// each recipient, and the headers of the original message, or the whole
+// message if the sender asked for it with RET=FULL.
+func bounceMessage(hostName string, msg *queuedMessage, failures []bounceFailure, data []byte, now time.Time) []byte {
+	var (
+		b  bytes.Buffer
+		mw = multipart.NewWriter(&b)
+	)
+
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", hostName)
+	fmt.Fprintf(&b, "To: <%s>\r\n", msg.Sender)
+	b.WriteString("Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", generateUUID(), hostName)
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n", mw.Boundary())
+	b.WriteString("\r\n")
+	b.WriteString("This is a MIME-encapsulated message.\r\n\r\n")
+
+	// human readable explanation
+	w, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"text/plain; charset=utf-8"},
+		"Content-Description": {"Notification"},
+	})
+
+	fmt.Fprintf(w, "This is the mail system at host %s.\r\n\r\n", hostName)
+	fmt.Fprintf(w, "Your message could not be delivered to one or more recipients after %d attempts.\r\n", msg.Attempts)
+
+	if msg.DSNRet == smtpd.DSNRetFull {
+		fmt.Fprint(w, "It's attached below.\r\n\r\n")
+	} else {
+		fmt.Fprint(w, "Its headers are attached below.\r\n\r\n")
+	}
+
+	for _, f := range failures {
+		reason := f.err.Error()
+		if _, diagnostic := dsnStatus(f.err); diagnostic != "" {
+			reason = diagnostic
+		}
+
+		fmt.Fprintf(w, "<%s>: %s\r\n", f.rcpt, reason)
+	}
+
+	// machine readable status
+	w, _ = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"message/delivery-status"},
+		"Content-Description": {"Delivery report"},
+	})
+
+	fmt.Fprintf(w, "Reporting-MTA: dns; %s\r\n", hostName)
+
+	if msg.DSNEnvID != "" {
+		fmt.Fprintf(w, "Original-Envelope-Id: %s\r\n", msg.DSNEnvID)
+	}
+
+	fmt.Fprintf(w, "Arrival-Date: %s\r\n", msg.Created.Format(time.RFC1123Z))
+
+	for _, f := range failures {
+		status, diagnostic := dsnStatus(f.err)
+
+		fmt.Fprint(w, "\r\n")
+
+		if orcpt := msg.DSN[f.rcpt].ORcpt; orcpt != "" {
+			fmt.Fprintf(w, "Original-Recipient: %s\r\n", orcpt)
+		}
+
+		fmt.Fprintf(w, "Final-Recipient: rfc822; %s\r\n", f.rcpt)
+		fmt.Fprint(w, "Action: failed\r\n")
+		fmt.Fprintf(w, "Status: %s\r\n", status)
+
+		if diagnostic != "" {
+			fmt.Fprintf(w, "Diagnostic-Code: smtp; %s\r\n", diagnostic)
+		}
+
+		fmt.Fprintf(w, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+	}
+
+	// original message, or its headers
+	if msg.DSNRet == smtpd.DSNRetFull {
+		w, _ = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {"message/rfc822"},
+			"Content-Description": {"Undelivered message"},
+		})
+
+		_, _ = w.Write(data)
+	} else {
+		w, _ = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {"text/rfc822-headers"},
+			"Content-Description": {"Undelivered message headers"},
+		})
+
+		_, _ = w.Write(messageHeaders(data))
+	}
+
+	_ = mw.Close()
+
+	return b.Bytes()
+}
+
+// dsnStatus returns the status code of a failed delivery, and the upstream
+// reply if the failure was reported by the upstream
+func dsnStatus(err error) (status, diagnostic string) {
+	var (
+		smtpErr *smtpd.Error
+		tperr   *textproto.Error
+	)
+
+	switch {
+	case errors.As(err, &smtpErr):
+		status = smtpErr.EnhancedCode
+		if status == "" {
+			status = fmt.Sprintf("%d.0.0", smtpErr.Code/100)
+		}
+
+		return status, fmt.Sprintf("%d %s %s", smtpErr.Code, status, smtpErr.Msg)
+	case errors.As(err, &tperr):
+		if m := enhancedCodeRE.FindStringSubmatch(tperr.Msg); m != nil {
+			status = m[1]
+		} else {
+			status = fmt.Sprintf("%d.0.0", tperr.Code/100)
+		}
+
+		return status, fmt.Sprintf("%d %s", tperr.Code, strings.ReplaceAll(tperr.Msg, "\n", " "))
+	default:
+		// the upstream couldn't be reached until the message expired
+		return "4.4.7", ""
+	}
+}
+
+// messageHeaders returns the header section of the message, without the
+// empty line which ends it
+func messageHeaders(data []byte) []byte {
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i != -1 {
+		return data[:i+2]
+	}
+
+	if i := bytes.Index(data, []byte("\n\n")); i != -1 {
+		return data[:i+1]
+	}
+
+	return data
+}
@@ -0,0 +1,156 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBounceMessage(t *testing.T) {
+	t.Parallel()
+
+	msg := &queuedMessage{
+		outbound: outbound{
+			Host:       "upstream:25",
+			Sender:     "bob@example.com",
+			Recipients: []string{"alice@example.com"},
+			DSNEnvID:   "QQ314159",
+			DSN: map[string]smtpd.RecipientDSN{
+				"alice@example.com": {ORcpt: "rfc822;alice@example.com"},
+			},
+		},
+		Created:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Attempts: 3,
+	}
+
+	data := []byte("From: bob@example.com\r\nSubject: test\r\n\r\nhello\r\n")
+	failures := []bounceFailure{{rcpt: "alice@example.com", err: &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}}}
+
+	parts := func(t *testing.T, b []byte) []string {
+		t.Helper()
+
+		m, err := mail.ReadMessage(bytes.NewReader(b))
+		require.NoError(t, err)
+
+		assert.Equal(t, "<bob@example.com>", m.Header.Get("To"))
+		assert.Equal(t, "auto-replied", m.Header.Get("Auto-Submitted"))
+
+		mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+		require.NoError(t, err)
+		assert.Equal(t, "multipart/report", mediaType)
+		assert.Equal(t, "delivery-status", params["report-type"])
+
+		parts := []string{}
+
+		mr := multipart.NewReader(m.Body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+
+			b, err := io.ReadAll(p)
+			require.NoError(t, err)
+
+			parts = append(parts, p.Header.Get("Content-Type")+"\n"+string(b))
+		}
+
+		return parts
+	}
+
+	t.Run("headers", func(t *testing.T) {
+		t.Parallel()
+
+		p := parts(t, bounceMessage("relay.example.com", msg, failures, data, time.Now()))
+		require.Len(t, p, 3)
+
+		assert.Contains(t, p[0], "<alice@example.com>: 550 5.1.1 no such user")
+		assert.Contains(t, p[1], "message/delivery-status\n")
+		assert.Contains(t, p[1], "Reporting-MTA: dns; relay.example.com\r\n")
+		assert.Contains(t, p[1], "Original-Envelope-Id: QQ314159\r\n")
+		assert.Contains(t, p[1], "Arrival-Date: Wed, 01 May 2024 12:00:00 +0000\r\n")
+		assert.Contains(t, p[1], "Original-Recipient: rfc822;alice@example.com\r\n")
+		assert.Contains(t, p[1], "Final-Recipient: rfc822; alice@example.com\r\n")
+		assert.Contains(t, p[1], "Action: failed\r\n")
+		assert.Contains(t, p[1], "Status: 5.1.1\r\n")
+		assert.Contains(t, p[1], "Diagnostic-Code: smtp; 550 5.1.1 no such user\r\n")
+		assert.Equal(t, "text/rfc822-headers\nFrom: bob@example.com\r\nSubject: test\r\n", p[2])
+	})
+
+	t.Run("full message", func(t *testing.T) {
+		t.Parallel()
+
+		full := *msg
+		full.DSNRet = smtpd.DSNRetFull
+
+		p := parts(t, bounceMessage("relay.example.com", &full, failures, data, time.Now()))
+		require.Len(t, p, 3)
+
+		assert.Equal(t, "message/rfc822\n"+string(data), p[2])
+	})
+}
+
+func TestBounceRecipients(t *testing.T) {
+	t.Parallel()
+
+	msg := &queuedMessage{outbound: outbound{
+		Sender:     "bob@example.com",
+		Recipients: []string{"alice@example.com", "carol@example.com", "dave@example.com"},
+		DSN: map[string]smtpd.RecipientDSN{
+			"carol@example.com": {Notify: "NEVER"},
+			"dave@example.com":  {Notify: "SUCCESS,FAILURE"},
+		},
+	}}
+
+	err := errors.New("connection refused")
+
+	failures := bounceRecipients(msg, msg.Recipients, err)
+	assert.Equal(t, []bounceFailure{
+		{rcpt: "alice@example.com", err: err},
+		{rcpt: "dave@example.com", err: err},
+	}, failures)
+
+	rcptErr := &textproto.Error{Code: 550, Msg: "no such user"}
+	failures = bounceRecipients(msg, []string{"alice@example.com"}, recipientErrors{"alice@example.com": rcptErr})
+	assert.Equal(t, []bounceFailure{{rcpt: "alice@example.com", err: rcptErr}}, failures)
+
+	// no bounces for bounces
+	msg.Sender = ""
+	assert.Empty(t, bounceRecipients(msg, msg.Recipients, err))
+}
+
+func TestDSNStatus(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err        error
+		status     string
+		diagnostic string
+	}{
+		{&textproto.Error{Code: 550, Msg: "5.1.1 no such user"}, "5.1.1", "550 5.1.1 no such user"},
+		{&textproto.Error{Code: 554, Msg: "rejected"}, "5.0.0", "554 rejected"},
+		{&textproto.Error{Code: 452, Msg: "too many\nrecipients"}, "4.0.0", "452 too many recipients"},
+		{smtpd.ErrSMTPUTF8Unsupported, "5.6.7", "550 5.6.7 Non-ASCII addresses not supported by upstream server"},
+		{errors.New("connection refused"), "4.4.7", ""},
+	}
+
+	for _, tt := range tests {
+		status, diagnostic := dsnStatus(tt.err)
+		assert.Equal(t, tt.status, status, tt.err)
+
+		if tt.diagnostic != "" {
+			assert.Equal(t, tt.diagnostic, diagnostic, tt.err)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// Results of the recipient callouts
+const (
+	calloutAccepted = "accepted"
+	calloutRejected = "rejected"
+	calloutError    = "error"
+)
+
+const (
+	// how long accepted recipients are kept, so their next messages aren't
+	// probed again
+	calloutAcceptedTTL = time.Hour
+
+	// how long rejected recipients are kept, shorter so new mailboxes start
+	// receiving mail soon enough
+	calloutRejectedTTL = 10 * time.Minute
+)
+
+var errCalloutRejected = &smtpd.Error{Code: 550, EnhancedCode: "5.1.1", Msg: "Recipient address rejected by upstream"}
+
+// calloutResult is the outcome of a recipient callout: nil if the upstream
+// accepted the recipient, or the SMTP error to reply with
+type calloutResult struct {
+	err     error
+	expires time.Time
+}
+
+// calloutChecker verifies the recipients of unauthenticated clients with
+// their upstream host as they're given, by opening a session with a null
+// sender and checking the reply to RCPT TO without sending any message. This
+// rejects invalid recipients at SMTP time, rather than accepting their
+// messages and bouncing them later to possibly forged senders. Only
+// permanent rejections are acted upon: recipients which can't be verified are
+// accepted.
+type calloutChecker struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*calloutResult
+
+	logger *slog.Logger
+}
+
+// newCalloutChecker returns nil if callouts are disabled
+func newCalloutChecker(enabled bool, timeout time.Duration) *calloutChecker {
+	if !enabled {
+		return nil
+	}
+
+	return &calloutChecker{
+		timeout: timeout,
+		cache:   map[string]*calloutResult{},
+		logger:  slog.Default().With(slog.String("component", "callout")),
+	}
+}
+
+// check verifies the recipient with the upstream host it's routed to, and
+// returns the SMTP error to reply with if it was rejected. Only SMTP hosts
+// are probed, MX hosts included.
+func (c *calloutChecker) check(ctx context.Context, cfg *config, host, rcpt string) error {
+	if _, _, ok := lmtpAddr(host); ok {
+		return nil
+	}
+
+	key := calloutKey(host, rcpt)
+	now := time.Now()
+
+	c.mu.Lock()
+	res, ok := c.cache[key]
+	c.mu.Unlock()
+
+	if ok && now.Before(res.expires) {
+		return res.err
+	}
+
+	log := c.logger.With(slog.String("host", host), slog.String("address", rcpt))
+
+	var ttl time.Duration
+
+	rcptErr, err := c.probe(ctx, cfg, host, rcpt)
+
+	switch {
+	case err != nil:
+		calloutCounter.WithLabelValues(calloutError).Inc()
+		log.WarnContext(ctx, "could not verify recipient, accepting it", slog.Any("error", err))
+
+		return nil
+	case rcptErr != nil:
+		calloutCounter.WithLabelValues(calloutRejected).Inc()
+		log.WarnContext(ctx, "recipient rejected by upstream", slog.Any("error", rcptErr))
+
+		res, ttl = &calloutResult{err: rcptErr}, calloutRejectedTTL
+	default:
+		calloutCounter.WithLabelValues(calloutAccepted).Inc()
+		log.DebugContext(ctx, "recipient accepted by upstream")
+
+		res, ttl = &calloutResult{}, calloutAcceptedTTL
+	}
+
+	res.expires = now.Add(ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, r := range c.cache {
+		if now.After(r.expires) {
+			delete(c.cache, k)
+		}
+	}
+
+	c.cache[key] = res
+
+	return res.err
+}
+
+// verified reports whether the host accepted the recipient in a callout
+// which is still cached, as opposed to recipients which couldn't be verified
+func (c *calloutChecker) verified(host, rcpt string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res, ok := c.cache[calloutKey(host, rcpt)]
+
+	return ok && res.err == nil && time.Now().Before(res.expires)
+}
+
+// calloutKey returns the key of the result of a callout in the cache
+func calloutKey(host, rcpt string) string {
+	return host + " " + strings.ToLower(rcpt)
+}
+
+// probe asks the host, the hosts of the upstream group, or the MX hosts of the
+// recipient domain in order of preference, whether it accepts the recipient. It returns the SMTP error to
+// reply with if the recipient was permanently rejected, or the error which
+// prevented its verification.
+func (c *calloutChecker) probe(ctx context.Context, cfg *config, host, rcpt string) (rcptErr, err error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	if isUpstreamGroup(host) {
+		g, err := cfg.balancer.group(host)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, h := range cfg.balancer.order(g) {
+			if rcptErr, err = c.probeHost(ctx, cfg, &outbound{Host: h}, rcpt); err == nil {
+				return rcptErr, nil
+			}
+		}
+
+		return nil, err
+	}
+
+	domain, ok := strings.CutPrefix(host, mxScheme)
+	if !ok {
+		return c.probeHost(ctx, cfg, &outbound{Host: host}, rcpt)
+	}
+
+	hosts, err := cfg.mx.hosts(domain)
+	if err != nil {
+		// domains which don't exist or don't accept mail are rejected
+		var smtpErr *smtpd.Error
+		if errors.As(err, &smtpErr) && smtpErr.Code >= 500 {
+			return smtpErr, nil
+		}
+
+		return nil, err
+	}
+
+	for _, h := range hosts {
+		rcptErr, err = c.probeHost(ctx, cfg, &outbound{Host: h, direct: true}, rcpt)
+		if err == nil {
+			return rcptErr, nil
+		}
+	}
+
+	return nil, err
+}
+
+// probeHost opens a session with the upstream host, set up like for
+// deliveries, and checks its reply to RCPT TO after a null sender
+func (c *calloutChecker) probeHost(ctx context.Context, cfg *config, out *outbound, rcpt string) (rcptErr, err error) {
+	conn, err := cfg.dialer.dial(ctx, out.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	hostname, _, _ := net.SplitHostPort(out.Host)
+
+	sc, err := smtp.NewClient(conn, hostname)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	uc := &upstreamConn{c: sc, created: time.Now()}
+	defer uc.close()
+
+	if err = uc.setup(ctx, cfg, out); err != nil {
+		return nil, err
+	}
+
+	if err = sc.Mail(""); err != nil {
+		return nil, fmt.Errorf("mail: %w", err)
+	}
+
+	err = sc.Rcpt(rcpt)
+
+	var tperr *textproto.Error
+
+	switch {
+	case err == nil:
+		return nil, nil
+	case errors.As(err, &tperr) && tperr.Code >= 500:
+		return errCalloutRejected, nil
+	default:
+		return nil, fmt.Errorf("rcpt: %w", err)
+	}
+}
@@ -0,0 +1,78 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalloutChecker(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	u := startFakeUpstream(t)
+	u.setReply("RCPT TO:<DAVE@", "550 5.1.1 no such user")
+	u.setReply("RCPT TO:<ERIN@", "450 4.2.1 mailbox busy")
+
+	_, port, err := net.SplitHostPort(u.addr)
+	require.NoError(t, err)
+
+	cfg := &config{
+		hostName: "relay.example.com",
+		mx: testMXResolver(port, map[string][]*net.MX{
+			"example.com":  {{Host: "127.0.0.2.", Pref: 10}, {Host: "127.0.0.1.", Pref: 20}},
+			"null.example": {{Host: ".", Pref: 0}},
+		}),
+	}
+
+	c := newCalloutChecker(true, 5*time.Second)
+
+	// probes sent to the upstream for a recipient
+	rcpts := func(addr string) int {
+		cmds, _ := u.received()
+
+		return len(slices.DeleteFunc(cmds, func(cmd string) bool {
+			return !strings.EqualFold(cmd, "RCPT TO:<"+addr+">")
+		}))
+	}
+
+	require.NoError(t, c.check(ctx, cfg, u.addr, "alice@example.com"))
+	require.ErrorIs(t, c.check(ctx, cfg, u.addr, "dave@example.com"), errCalloutRejected)
+
+	cmds, _ := u.received()
+	assert.Contains(t, cmds, "MAIL FROM:<>")
+
+	// results are cached
+	require.NoError(t, c.check(ctx, cfg, u.addr, "alice@example.com"))
+	require.ErrorIs(t, c.check(ctx, cfg, u.addr, "dave@example.com"), errCalloutRejected)
+	assert.Equal(t, 1, rcpts("alice@example.com"))
+	assert.Equal(t, 1, rcpts("dave@example.com"))
+
+	// temporary failures are accepted, and not cached
+	require.NoError(t, c.check(ctx, cfg, u.addr, "erin@example.com"))
+	require.NoError(t, c.check(ctx, cfg, u.addr, "erin@example.com"))
+	assert.Equal(t, 2, rcpts("erin@example.com"))
+
+	// unreachable upstreams too
+	require.NoError(t, c.check(ctx, cfg, "127.0.0.1:9", "dave@example.com"))
+
+	// MX hosts are tried in order of preference
+	require.ErrorIs(t, c.check(ctx, cfg, "mx://example.com", "dave@example.com"), errCalloutRejected)
+	assert.Equal(t, 2, rcpts("dave@example.com"))
+
+	// and domains which don't accept mail are rejected
+	require.ErrorIs(t, c.check(ctx, cfg, "mx://null.example", "bob@null.example"), errNullMX)
+	require.ErrorIs(t, c.check(ctx, cfg, "mx://nowhere.example", "bob@nowhere.example"), errNoSuchDomain)
+
+	// LMTP hosts aren't probed
+	require.NoError(t, c.check(ctx, cfg, "lmtp://127.0.0.1:9", "dave@example.com"))
+
+	assert.Nil(t, newCalloutChecker(false, time.Second))
+}
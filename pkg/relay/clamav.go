@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// size of the chunks streamed to clamd, below its default StreamMaxLength
+const clamavChunkSize = 64 * 1024
+
+// Results of the virus scans
+const (
+	clamavClean    = "clean"
+	clamavInfected = "infected"
+	clamavError    = "error"
+)
+
+var (
+	errVirusFound     = &smtpd.Error{Code: 554, EnhancedCode: "5.7.1", Msg: "Message rejected: virus detected"}
+	errClamAVFailed   = &smtpd.Error{Code: 451, EnhancedCode: "4.3.0", Msg: "Could not scan message, try again later"}
+	errClamAVResponse = errors.New("clamav: unexpected response")
+)
+
+// clamav scans the messages for viruses with clamd, streaming them with its
+// INSTREAM command
+type clamav struct {
+	network string
+	addr    string
+	timeout time.Duration
+
+	logger *slog.Logger
+}
+
+// newClamAV returns nil if addr is empty. The address is either host:port,
+// or the absolute path of the clamd unix socket.
+func newClamAV(addr string, timeout time.Duration) *clamav {
+	if addr == "" {
+		return nil
+	}
+
+	c := &clamav{
+		network: "tcp",
+		addr:    addr,
+		timeout: timeout,
+		logger:  slog.Default().With(slog.String("component", "clamav")),
+	}
+
+	if strings.HasPrefix(addr, "/") {
+		c.network = "unix"
+	}
+
+	return c
+}
+
+// check scans the message, and returns the SMTP error to reply with if a
+// virus was found, or if it couldn't be scanned
+func (c *clamav) check(ctx context.Context, env *smtpd.Envelope) error {
+	start := time.Now()
+	virus, err := c.scan(ctx, env.Data)
+
+	result := clamavClean
+
+	switch {
+	case err != nil:
+		result = clamavError
+	case virus != "":
+		result = clamavInfected
+	}
+
+	clamavScansCounter.WithLabelValues(result).Inc()
+	clamavDurationHistogram.WithLabelValues(result).Observe(time.Since(start).Seconds())
+
+	switch {
+	case err != nil:
+		c.logger.ErrorContext(ctx, "could not scan message", slog.Any("error", err))
+		return observeErr(ctx, errClamAVFailed)
+	case virus != "":
+		c.logger.WarnContext(ctx, "virus found, rejecting message", slog.String("virus", virus),
+			slog.String("from", env.Sender), slog.Any("to", env.Recipients))
+
+		return flagged(quarantineVirus, virus, observeErr(ctx, errVirusFound))
+	default:
+		c.logger.DebugContext(ctx, "message scanned, no virus found")
+		return nil
+	}
+}
+
+// scan returns the name of the virus found in the message, empty if it's
+// clean
+func (c *clamav) scan(ctx context.Context, data []byte) (string, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return "", fmt.Errorf("clamav: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", fmt.Errorf("clamav: %w", err)
+	}
+
+	// the message is sent as chunks prefixed with their length, up to an
+	// empty chunk
+	size := make([]byte, 4)
+
+	for chunk := range slices.Chunk(data, clamavChunkSize) {
+		binary.BigEndian.PutUint32(size, uint32(len(chunk))) //nolint:gosec // chunks are at most clamavChunkSize
+
+		if _, err = conn.Write(size); err == nil {
+			_, err = conn.Write(chunk)
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("clamav: %w", err)
+		}
+	}
+
+	if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", fmt.Errorf("clamav: %w", err)
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("clamav: %w", err)
+	}
+
+	return parseClamAVReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseClamAVReply parses the reply to INSTREAM: "stream: OK", "stream: name
+// FOUND", or an error ending with "ERROR"
+func parseClamAVReply(reply string) (string, error) {
+	result, ok := strings.CutPrefix(reply, "stream: ")
+
+	switch {
+	case ok && result == "OK":
+		return "", nil
+	case ok && strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return "", fmt.Errorf("clamav: %s", reply)
+	default:
+		return "", fmt.Errorf("%w %q", errClamAVResponse, reply)
+	}
+}
@@ -0,0 +1,181 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eicar is the EICAR antivirus test file
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// startFakeClamd starts a clamd answering INSTREAM commands, reporting a
+// virus for streams containing the EICAR test file
+func startFakeClamd(t *testing.T, network, addr string) string {
+	t.Helper()
+
+	l, err := net.Listen(network, addr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveFakeClamd(conn)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func serveFakeClamd(conn net.Conn) {
+	defer conn.Close()
+
+	cmd := make([]byte, len("zINSTREAM\x00"))
+	if _, err := io.ReadFull(conn, cmd); err != nil || string(cmd) != "zINSTREAM\x00" {
+		_, _ = conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var data bytes.Buffer
+
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+
+		if size == 0 {
+			break
+		}
+
+		if size > clamavChunkSize {
+			_, _ = conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			return
+		}
+
+		if _, err := io.CopyN(&data, conn, int64(size)); err != nil {
+			return
+		}
+	}
+
+	if strings.Contains(data.String(), eicar) {
+		_, _ = conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		return
+	}
+
+	_, _ = conn.Write([]byte("stream: OK\x00"))
+}
+
+func TestClamAVScan(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("tcp", func(t *testing.T) {
+		t.Parallel()
+
+		c := newClamAV(startFakeClamd(t, "tcp", "127.0.0.1:0"), time.Second)
+
+		virus, err := c.scan(ctx, []byte("Subject: test\r\n\r\nhello\r\n"))
+		require.NoError(t, err)
+		assert.Empty(t, virus)
+
+		// the EICAR file spans several chunks
+		data := strings.Repeat("a", clamavChunkSize-10) + eicar
+		virus, err = c.scan(ctx, []byte(data))
+		require.NoError(t, err)
+		assert.Equal(t, "Eicar-Test-Signature", virus)
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		t.Parallel()
+
+		sock := filepath.Join(t.TempDir(), "clamd.sock")
+		startFakeClamd(t, "unix", sock)
+
+		c := newClamAV(sock, time.Second)
+		assert.Equal(t, "unix", c.network)
+
+		virus, err := c.scan(ctx, []byte(eicar))
+		require.NoError(t, err)
+		assert.Equal(t, "Eicar-Test-Signature", virus)
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		t.Parallel()
+
+		c := newClamAV("127.0.0.1:9", time.Second)
+
+		_, err := c.scan(ctx, []byte("hello"))
+		require.Error(t, err)
+	})
+}
+
+func TestParseClamAVReply(t *testing.T) {
+	t.Parallel()
+
+	virus, err := parseClamAVReply("stream: OK")
+	require.NoError(t, err)
+	assert.Empty(t, virus)
+
+	virus, err = parseClamAVReply("stream: Win.Test.EICAR_HDB-1 FOUND")
+	require.NoError(t, err)
+	assert.Equal(t, "Win.Test.EICAR_HDB-1", virus)
+
+	_, err = parseClamAVReply("INSTREAM size limit exceeded. ERROR")
+	require.ErrorContains(t, err, "size limit exceeded")
+
+	_, err = parseClamAVReply("UNKNOWN COMMAND")
+	require.ErrorIs(t, err, errClamAVResponse)
+}
+
+func TestClamAVCheck(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	c := newClamAV(startFakeClamd(t, "tcp", "127.0.0.1:0"), time.Second)
+
+	require.NoError(t, c.check(ctx, &smtpd.Envelope{Data: []byte("hello")}))
+	require.ErrorIs(t, c.check(ctx, &smtpd.Envelope{Data: []byte(eicar)}), errVirusFound)
+
+	c = newClamAV("127.0.0.1:9", time.Second)
+	require.ErrorIs(t, c.check(ctx, &smtpd.Envelope{Data: []byte("hello")}), errClamAVFailed)
+}
+
+func TestClamAVRelay(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv := startTestSMTPServer(ctx, t)
+
+	addr := startRelayConfig(ctx, t, "", &config{
+		remoteHost: srv.addr,
+		clamav:     newClamAV(startFakeClamd(t, "tcp", "127.0.0.1:0"), time.Second),
+	})
+
+	err := sendMsg(t, addr, []string{"alice@example.com"}, "bob@example.com", "virus", nil, eicar)
+	require.ErrorContains(t, err, "554")
+
+	err = sendMsg(t, addr, []string{"alice@example.com"}, "bob@example.com", "clean", nil, "hello")
+	require.NoError(t, err)
+
+	require.Len(t, *srv.msgs, 1)
+}
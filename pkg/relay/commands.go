@@ -0,0 +1,357 @@
+package relay
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// SendTest delivers a test message to the recipients the way received
+// messages are, from remote_sender or the postmaster of hostname, so the
+// upstream settings can be checked without an SMTP client
+func (r *Relay) SendTest(ctx context.Context, recipients []string) error {
+	if len(recipients) == 0 {
+		return errors.New("no recipients")
+	}
+
+	cfg := r.cfg
+
+	router, err := parseRoutes(cfg.remoteHost, cfg.delivery == deliveryMX)
+	if err != nil {
+		return fmt.Errorf("cannot parse remote_host %q: %w", cfg.remoteHost, err)
+	}
+
+	sender, msg := testMessage(cfg, recipients)
+
+	var (
+		p    *upstreamPool
+		errs []error
+	)
+
+	for _, group := range router.split(recipients) {
+		out := &outbound{Host: group.host, Sender: sender, Recipients: group.recipients}
+
+		if err := p.send(ctx, cfg, out, bytes.NewReader(msg)); err != nil {
+			errs = append(errs, fmt.Errorf("%s via %s: %w", strings.Join(group.recipients, ", "), group.host, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// testMessage returns the sender and the message sent by the test commands
+func testMessage(cfg *config, recipients []string) (string, []byte) {
+	hostName := cmp.Or(cfg.hostName, "localhost")
+	sender := cmp.Or(cfg.remoteSender, "postmaster@"+hostName)
+
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "From: <%s>\r\n", sender)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&b, "Subject: smtprelay test message\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", generateUUID(), hostName)
+	fmt.Fprintf(&b, "\r\n")
+	fmt.Fprintf(&b, "This is a test message sent by smtprelay on %s.\r\n", hostName)
+
+	return sender, b.Bytes()
+}
+
+// probeTimeout bounds the probes of each upstream by CheckConfig
+const probeTimeout = 30 * time.Second
+
+// CheckConfig checks what the config loading doesn't: the listeners, the
+// TLS certificate, and that the upstream hosts resolve. With probe, the
+// upstreams are also connected to, and greeted with EHLO (LMTP ones are only
+// connected to). Each check is reported on w, and an error is returned if
+// any failed.
+func (r *Relay) CheckConfig(ctx context.Context, w io.Writer, probe bool) error {
+	cfg := r.cfg
+
+	var checks, failed int
+
+	report := func(err error, format string, args ...any) {
+		checks++
+
+		status := "ok  "
+		if err != nil {
+			failed++
+			status = "FAIL"
+		}
+
+		fmt.Fprintf(w, "%s %s", status, fmt.Sprintf(format, args...))
+
+		if err != nil {
+			fmt.Fprintf(w, ": %v", err)
+		}
+
+		fmt.Fprintln(w)
+	}
+
+	listeners, err := parseListeners(cfg.listen, cfg)
+	report(err, "listen %q", cfg.listen)
+
+	// the certificate is only loaded by the TLS listeners
+	if slices.ContainsFunc(listeners, listenerConfig.tls) && cfg.localACMEDomains == "" {
+		report(checkCertificate(cfg.localCert, cfg.localKey, time.Now()),
+			"TLS certificate %q, key %q", cfg.localCert, cfg.localKey)
+	}
+
+	hosts, err := upstreamHosts(cfg)
+	report(err, "remote_host %q", cfg.remoteHost)
+
+	// hosts differing by port only are resolved once
+	resolved := map[string]error{}
+
+	for _, host := range hosts {
+		if network, addr, ok := lmtpAddr(host); ok {
+			if probe {
+				report(probeLMTP(ctx, cfg, network, addr), "connect to %s", host)
+			}
+
+			continue
+		}
+
+		// the proxy resolves the hosts, except with socks5
+		if cfg.dialer.proxy == nil || cfg.dialer.proxy.Scheme == "socks5" {
+			hostname, _, _ := net.SplitHostPort(host)
+
+			err, ok := resolved[hostname]
+			if !ok {
+				var ips []net.IP
+
+				ips, err = cfg.dialer.resolve(ctx, hostname)
+				resolved[hostname] = err
+
+				if err != nil {
+					report(err, "resolve %s", hostname)
+				} else {
+					report(nil, "resolve %s to %v", hostname, ips)
+				}
+			}
+
+			if err != nil {
+				continue
+			}
+		}
+
+		if probe {
+			report(probeUpstream(ctx, cfg, host, probeTimeout), "EHLO to %s", host)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, checks)
+	}
+
+	return nil
+}
+
+// checkCertificate loads the TLS certificate and its key, and checks it's
+// valid at now
+func checkCertificate(certpath, keypath string, now time.Time) error {
+	if certpath == "" || keypath == "" {
+		return errors.New("local_cert and local_key must be set for the TLS listeners")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certpath, keypath)
+	if err != nil {
+		return err
+	}
+
+	if now.Before(cert.Leaf.NotBefore) {
+		return fmt.Errorf("certificate isn't valid before %s", cert.Leaf.NotBefore.Format(time.RFC3339))
+	}
+
+	if now.After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("certificate expired on %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// upstreamHosts returns the hosts the remote_host routes deliver to over
+// SMTP or LMTP, with the upstream groups expanded, and without duplicates
+func upstreamHosts(cfg *config) ([]string, error) {
+	if cfg.delivery == deliveryDiscard || cfg.webhook != nil || cfg.kafka != nil {
+		return nil, nil
+	}
+
+	router, err := parseRoutes(cfg.remoteHost, cfg.delivery == deliveryMX)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []string{}
+	if router.fallback != "" && !router.direct {
+		routes = append(routes, router.fallback)
+	}
+
+	for _, rt := range router.routes {
+		routes = append(routes, rt.host)
+	}
+
+	hosts := []string{}
+
+	for _, route := range routes {
+		if strings.HasPrefix(route, mxScheme) {
+			continue
+		}
+
+		group := []string{route}
+		if isUpstreamGroup(route) {
+			g, err := parseUpstreamGroup(route)
+			if err != nil {
+				return nil, err
+			}
+
+			group = g.hosts
+		}
+
+		for _, host := range group {
+			if !slices.Contains(hosts, host) {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+
+	return hosts, nil
+}
+
+// probeLMTP connects to an LMTP upstream
+func probeLMTP(ctx context.Context, cfg *config, network, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	if network == "tcp" {
+		conn, err = cfg.dialer.dial(ctx, addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// Queue runs the queue command on the spool directory, args being one of:
+//
+//	list        list the queued messages
+//	show ID     show a queued message, with its headers
+//	retry ID    make a queued message due for delivery at once
+//	export      write the queued messages with their data as JSON to out
+//	import      queue the messages of an export read from in
+//
+// It doesn't need the relay to run: the messages made due or imported are
+// delivered by the relay on its next scan of the queue.
+func (r *Relay) Queue(in io.Reader, out io.Writer, args []string) error {
+	if r.cfg.queueDir == "" {
+		return errors.New("queueing is disabled, queue_dir isn't set")
+	}
+
+	q, err := newQueue(newConfigStore(r.cfg), nil)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	cmd, args := args[0], args[1:]
+
+	argsOK := len(args) == 0
+	if cmd == "show" || cmd == "retry" {
+		argsOK = len(args) == 1
+	}
+
+	if !argsOK {
+		return fmt.Errorf("invalid arguments for queue %s: %q", cmd, args)
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+
+	switch cmd {
+	case "list":
+		msgs, err := q.list()
+		if err != nil {
+			return err
+		}
+
+		return writeQueueList(out, msgs)
+	case "show":
+		msg, err := q.get(args[0])
+		if err != nil {
+			return err
+		}
+
+		return enc.Encode(msg)
+	case "retry":
+		msg, err := q.due(args[0], time.Now())
+		if err != nil {
+			return err
+		}
+
+		return enc.Encode(msg)
+	case "export":
+		msgs, err := q.export()
+		if err != nil {
+			return err
+		}
+
+		return enc.Encode(msgs)
+	case "import":
+		msgs := []*exportedMessage{}
+		if err := json.NewDecoder(in).Decode(&msgs); err != nil {
+			return fmt.Errorf("%w: %w", errInvalidImport, err)
+		}
+
+		ids, err := q.importMessages(msgs, time.Now())
+		for _, id := range ids {
+			fmt.Fprintln(out, id)
+		}
+
+		return err
+	default:
+		return fmt.Errorf("unknown queue command %q, expected list, show, retry, export or import", cmd)
+	}
+}
+
+// writeQueueList writes a line for each queued message
+func writeQueueList(out io.Writer, msgs []*queuedMessage) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "ID\tCREATED\tATTEMPTS\tNEXT ATTEMPT\tSENDER\tRECIPIENTS\tLAST ERROR")
+
+	for _, msg := range msgs {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			msg.ID,
+			msg.Created.Format(time.RFC3339),
+			msg.Attempts,
+			msg.NextAttempt.Format(time.RFC3339),
+			cmp.Or(msg.Sender, "<>"),
+			strings.Join(msg.Recipients, ","),
+			msg.LastError,
+		)
+	}
+
+	return w.Flush()
+}
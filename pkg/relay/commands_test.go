@@ -0,0 +1,143 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelaySendTest(t *testing.T) {
+	t.Parallel()
+
+	u := startFakeUpstream(t)
+
+	cfg := &config{hostName: "relay.example.com", remoteHost: u.addr}
+	require.NoError(t, cfg.setup())
+
+	r := fromConfig(cfg)
+
+	require.NoError(t, r.SendTest(context.Background(), []string{"alice@example.com", "bob@example.org"}))
+
+	commands, msgs := u.received()
+	assert.Contains(t, commands, "MAIL FROM:<postmaster@relay.example.com>")
+	assert.Contains(t, commands, "RCPT TO:<bob@example.org>")
+	require.Len(t, msgs, 1)
+	assert.Contains(t, msgs[0], "Subject: smtprelay test message\n")
+
+	require.Error(t, r.SendTest(context.Background(), nil))
+
+	// the delivery errors are reported
+	u.setReply("RCPT", "550 5.1.1 no such user")
+	require.ErrorContains(t, r.SendTest(context.Background(), []string{"alice@example.com"}), "no such user")
+}
+
+func TestRelayCheckConfig(t *testing.T) {
+	t.Parallel()
+
+	u := startFakeUpstream(t)
+
+	certpath, keypath := writeTestCert(t, t.TempDir(), "relay.example.com")
+
+	cfg := &config{
+		listen:     "127.0.0.1:2525 starttls://127.0.0.1:2587",
+		localCert:  certpath,
+		localKey:   keypath,
+		remoteHost: u.addr + " *@example.org=127.0.0.1:9," + u.addr,
+	}
+	require.NoError(t, cfg.setup())
+
+	var out bytes.Buffer
+	require.NoError(t, fromConfig(cfg).CheckConfig(context.Background(), &out, false))
+	assert.Contains(t, out.String(), "ok   TLS certificate")
+	assert.Contains(t, out.String(), "ok   resolve 127.0.0.1 to [127.0.0.1]")
+	assert.Equal(t, 1, strings.Count(out.String(), "resolve 127.0.0.1 "))
+
+	// only the host of the group which isn't up fails
+	out.Reset()
+	require.ErrorContains(t, fromConfig(cfg).CheckConfig(context.Background(), &out, true), "1 of 6 checks failed")
+	assert.Contains(t, out.String(), "ok   EHLO to "+u.addr)
+	assert.Contains(t, out.String(), "FAIL EHLO to 127.0.0.1:9: dial: ")
+
+	cfg = &config{listen: "smtps://127.0.0.1:2465", remoteHost: "smtp.example.invalid:25"}
+	require.NoError(t, cfg.setup())
+
+	out.Reset()
+	require.ErrorContains(t, fromConfig(cfg).CheckConfig(context.Background(), &out, false), "2 of 4 checks failed")
+	assert.Contains(t, out.String(), "FAIL TLS certificate")
+	assert.Contains(t, out.String(), "FAIL resolve smtp.example.invalid: ")
+}
+
+func TestCheckCertificate(t *testing.T) {
+	t.Parallel()
+
+	certpath, keypath := writeTestCert(t, t.TempDir(), "relay.example.com")
+
+	require.NoError(t, checkCertificate(certpath, keypath, time.Now()))
+	require.ErrorContains(t, checkCertificate(certpath, keypath, time.Now().Add(2*time.Hour)), "expired")
+	require.ErrorContains(t, checkCertificate(certpath, keypath, time.Now().Add(-2*time.Hour)), "isn't valid before")
+	require.Error(t, checkCertificate(certpath, "", time.Now()))
+	require.Error(t, checkCertificate(keypath, certpath, time.Now()))
+}
+
+func TestRelayQueue(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{queueDir: t.TempDir(), remoteHost: "smtp.example.com:25"}
+	r := fromConfig(cfg)
+
+	q, err := newQueue(newConfigStore(cfg), nil)
+	require.NoError(t, err)
+
+	id, err := q.enqueue(testOutbound, []byte("Subject: test\r\n\r\nhello\r\n"), errors.New("boom"))
+	require.NoError(t, err)
+
+	run := func(in string, args ...string) (string, error) {
+		var out bytes.Buffer
+		err := r.Queue(strings.NewReader(in), &out, args)
+
+		return out.String(), err
+	}
+
+	out, err := run("")
+	require.NoError(t, err)
+	assert.Contains(t, out, id)
+	assert.Contains(t, out, "alice@example.com")
+
+	out, err = run("", "show", id)
+	require.NoError(t, err)
+	assert.Contains(t, out, `"Subject": [`)
+
+	// the message is made due, for the relay to deliver it
+	out, err = run("", "retry", id)
+	require.NoError(t, err)
+
+	msg := &queuedMessage{}
+	require.NoError(t, json.Unmarshal([]byte(out), msg))
+	assert.WithinDuration(t, time.Now(), msg.NextAttempt, time.Minute)
+
+	export, err := run("", "export")
+	require.NoError(t, err)
+
+	out, err = run(export, "import")
+	require.NoError(t, err)
+	assert.Len(t, strings.Fields(out), 1)
+
+	msgs, err := q.list()
+	require.NoError(t, err)
+	assert.Len(t, msgs, 2)
+
+	for _, args := range [][]string{{"show"}, {"show", "bogus"}, {"list", id}, {"purge"}} {
+		_, err := run("", args...)
+		require.Error(t, err, args)
+	}
+
+	err = fromConfig(&config{}).Queue(strings.NewReader(""), &bytes.Buffer{}, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,1002 @@
+package relay
+
+import (
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/auth"
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/vharitonsky/iniflags"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+//nolint:govet
+type config struct {
+	logFormat         string
+	hostName          string
+	welcomeMsg        string
+	listen            string
+	metricsListen     string
+	metricsOTLP       bool
+	otlpInterval      time.Duration
+	adminListen       string
+	adminToken        string
+	runUser           string
+	runGroup          string
+	chrootDir         string
+	localCert         string
+	localKey          string
+	localForceTLS     bool
+	localCertWatch    time.Duration
+	localTLSVersion   string
+	localTLSCiphers   string
+	localTLSCurves    string
+	localClientCA     string
+	localACMEDomains  string
+	localACMEEmail    string
+	localACMECacheDir string
+	localACMEURL      string
+	localACMEHTTP     string
+	allowedNetsStr    string
+	allowedNetsTTL    time.Duration
+	allowedSender     string
+	allowedRecipients string
+	deniedRecipients  string
+	journalRcpts      string
+	allowedUsers      string
+	authMaxFailures   int
+	authFailureDelay  time.Duration
+	authMaxDelay      time.Duration
+	authLockout       time.Duration
+	ldapURL           string
+	ldapStartTLS      bool
+	ldapBindDN        string
+	ldapBindPass      string
+	ldapBaseDN        string
+	ldapUserFilter    string
+	ldapGroup         string
+	ldapPoolSize      int
+	ldapTimeout       time.Duration
+	sqlDriver         string
+	sqlDSN            string
+	sqlUserQuery      string
+	sqlCacheTTL       time.Duration
+	authHTTPURL       string
+	authHTTPToken     string
+	authHTTPTimeout   time.Duration
+	authHTTPCacheTTL  time.Duration
+	delivery          string
+	webhookURL        string
+	webhookFormat     string
+	webhookSecret     string
+	webhookTimeout    time.Duration
+	webhookRetries    int
+	kafkaBrokers      string
+	kafkaTopic        string
+	kafkaSASL         string
+	kafkaUser         string
+	kafkaPass         string
+	kafkaTLS          bool
+	kafkaTimeout      time.Duration
+	remoteHost        string
+	remoteUser        string
+	maxMessageSize    int
+	streamData        bool
+	dataMode          string
+	maxConnections    int
+	maxRecipients     int
+	maxCommands       int
+	maxErrors         int
+	tarpitAfter       int
+	tarpitDelay       time.Duration
+	tarpitMaxDelay    time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	dataTimeout       time.Duration
+	maxSessionTime    time.Duration
+	shutdownTimeout   time.Duration
+	remotePass        string
+	remoteAuth        string
+	remoteSender      string
+	senderMasquerade  string
+	srsDomain         string
+	srsSecrets        string
+	versionInfo       bool
+	logLevel          string
+	logHeadersStr     string
+	syslogAddr        string
+	syslogFacility    string
+	syslogTag         string
+	auditLogFile      string
+	auditLogMaxSize   int64
+	auditLogMaxAge    time.Duration
+	auditLogBackups   int
+	transcriptDir     string
+	transcriptSample  int
+	transcriptNets    string
+	queueDir          string
+	queueRetryMin     time.Duration
+	queueRetryMax     time.Duration
+	queueMaxAge       time.Duration
+	etrnDomains       string
+	scheduleMaxDelay  time.Duration
+	archiveURL        string
+	archiveEndpoint   string
+	archiveRegion     string
+	archiveAccessKey  string
+	archiveSecretKey  string
+	archiveKeyTmpl    string
+	archiveMaxSize    int
+	remoteCredsFile   string
+	headerRulesFile   string
+	attachmentFile    string
+	policyFile        string
+	aliasesFile       string
+	autoReplyFile     string
+	autoReplyInterval time.Duration
+	senderLoginFile   string
+	spfPolicy         string
+	dmarcMode         string
+	dkimVerify        bool
+	fcrdnsMode        string
+	greetDelay        time.Duration
+	earlyTalkerAction string
+	clamavAddr        string
+	clamavTimeout     time.Duration
+	policySvcAddr     string
+	policySvcTimeout  time.Duration
+	policySvcContext  string
+	policySvcDefault  string
+	quarantineDir     string
+	quarantineChecks  string
+	rateLimitMessages string
+	rateLimitRcpts    string
+	redisURL          string
+	redisTimeout      time.Duration
+	dedupWindow       time.Duration
+	dedupAction       string
+	dedupMaxEntries   int
+	dnsblLists        string
+	dnsblThreshold    int
+	dnsblMode         string
+	dnsblTimeout      time.Duration
+	rcptCallout       bool
+	calloutTimeout    time.Duration
+	verifyCommands    bool
+	trustedProxiesStr string
+	remotePoolMaxIdle int
+	remotePoolMaxAge  time.Duration
+	remoteStrategy    string
+	remoteDeadTime    time.Duration
+	remoteHealthCheck time.Duration
+	remoteIPPrefer    string
+	remoteSourceAddr  string
+	remoteDialTimeout time.Duration
+	lmtpTimeout       time.Duration
+	remoteFallback    time.Duration
+	remoteProxy       string
+	remoteXClient     string
+	deliveryConns     int
+	destConcurrency   string
+	destRates         string
+	destBackoff       time.Duration
+	destBackoffMax    time.Duration
+	deliveryWaitMax   time.Duration
+	remoteOAuthURL    string
+	remoteOAuthID     string
+	remoteOAuthSecret string
+	remoteOAuthToken  string
+	remoteOAuthScopes string
+	remoteTLSVersion  string
+	remoteTLSCiphers  string
+	remoteTLSCurves   string
+	remoteDANE        string
+	remoteMTASTS      bool
+	traceHeaders      bool
+	receivedHeader    string
+	stripHeaders      bool
+	fixHeaders        bool
+	mtPriority        bool
+	senderPriorities  string
+	successDSN        bool
+	deliveryNotifyURL string
+	upstreamReplyMap  string
+
+	allowedNets       []*net.IPNet
+	trustedProxies    []*net.IPNet
+	logHeaders        map[string]string
+	received          *smtpd.ReceivedFields // nil for the default fields
+	noReceived        bool                  // received_header is none
+	remoteCredentials map[string]upstreamCredentials
+	aliases           aliases
+	autoReplies       autoReplies
+	senderLogins      senderLogins
+	priorities        senderPriorities
+	replyCodes        replyMap
+	localTLS          tlsPolicy
+	remoteTLS         tlsPolicy
+	allowedHosts      *allowedHosts     // nil unless allowed_nets has hostnames
+	mailLog           *mailLog          // nil unless syslog_addr is set
+	audit             *auditLog         // nil unless audit_log is set
+	transcripts       *transcripts      // nil unless transcript_dir is set
+	clientCAs         *x509.CertPool    // nil unless local_client_ca is set
+	dane              *daneVerifier     // nil unless remote_dane is set
+	mtaSTS            *mtaSTS           // nil unless remote_mta_sts is set
+	scheduler         *scheduler        // nil unless delivery limits or backoff are set
+	balancer          *upstreamBalancer // picks the hosts of the upstream groups
+	dialer            *outboundDialer   // connects to the upstreams
+	mx                *mxResolver       // nil for the system resolver - overridable for tests
+	webhook           *webhook          // nil unless delivery is webhook
+	kafka             *kafkaProducer    // nil unless delivery is kafka
+	archive           archiver          // nil unless archive_url is set
+	journal           *journal          // nil unless journal_recipients is set
+	headerRules       *headerRules      // nil unless header_rules is set
+	attachments       *attachmentPolicy // nil unless attachment_policy is set
+	policy            *policy           // nil unless policy_rules is set
+	masquerade        *masquerade       // nil unless sender_masquerade is set
+	srs               *srs              // nil unless srs_domain is set
+	clamav            *clamav           // nil unless clamav_addr is set
+	policyService     *policyService    // nil unless policy_service is set
+	quarantine        *quarantine       // nil unless quarantine_dir is set
+	ldap              *ldapAuth         // nil unless ldap_url is set
+	sql               *sqlAuth          // nil unless sql_dsn is set
+	httpAuth          *httpAuth         // nil unless auth_http_url is set
+	oauthTokens       *auth.TokenSource // nil unless remote_auth is xoauth2 or oauthbearer
+	uid               int               // -1 unless user is set
+	gid               int               // -1 unless user or group is set
+	configFile        string            // resolved path of the -config file
+	cmdlineFlags      map[string]string // flags set on the command line
+}
+
+func setupAllowedNetworks(s string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+
+	for _, netstr := range splitstr(s, ' ') {
+		baseIP, allowedNet, err := net.ParseCIDR(netstr)
+		if err != nil {
+			return nil, fmt.Errorf("parseCIDR %q: %w", netstr, err)
+		}
+
+		// Reject any network specification where any host bits are set,
+		// meaning the address refers to a host and not a network.
+		if !allowedNet.IP.Equal(baseIP) {
+			return nil, fmt.Errorf("invalid network (host bits set): %q", netstr)
+		}
+
+		nets = append(nets, allowedNet)
+	}
+
+	return nets, nil
+}
+
+func loadConfig() (*config, error) {
+	cfg := config{}
+	registerFlags(flag.CommandLine, &cfg)
+
+	// structured config files are read here rather than by iniflags, which
+	// only supports ini files
+	flag.Parse()
+
+	// iniflags would parse the command line again, and read the structured
+	// file given with -config as an ini file
+	cfg.configFile = configFilePath(flag.Lookup("config").Value.String())
+	if !isStructuredConfig(cfg.configFile) {
+		iniflags.Parse()
+	}
+
+	// remember the flags set on the command line, as they take precedence
+	// over the config file and environment, also when it's reloaded
+	cfg.cmdlineFlags = map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		cfg.cmdlineFlags[f.Name] = f.Value.String()
+	})
+
+	if isStructuredConfig(cfg.configFile) {
+		if err := applyConfigFile(flag.CommandLine, cfg.configFile, cfg.cmdlineFlags); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnv(flag.CommandLine, cfg.cmdlineFlags); err != nil {
+		return nil, err
+	}
+
+	setupLogger(cfg.logFormat, cfg.logLevel)
+
+	if err := cfg.setup(); err != nil {
+		return nil, err
+	}
+
+	// iniflags updates the flags in place when it re-reads the config file
+	// on SIGHUP, so return a copy which is only ever replaced as a whole
+	live := cfg
+
+	return &live, nil
+}
+
+// setup populates the fields derived from the flags
+func (cfg *config) setup() error {
+	logger := slog.With(slog.String("component", "config"))
+
+	// if remotePass is not set, try reading it from env var
+	if cfg.remotePass == "" {
+		logger.Debug("remote_pass not set, trying REMOTE_PASS env var")
+		cfg.remotePass = os.Getenv("REMOTE_PASS")
+		if cfg.remotePass != "" {
+			logger.Debug("found data in REMOTE_PASS env var")
+		} else {
+			logger.Debug("no data found in REMOTE_PASS env var")
+		}
+	}
+
+	if cfg.ldapBindPass == "" {
+		cfg.ldapBindPass = os.Getenv("LDAP_BIND_PASSWORD")
+	}
+
+	if cfg.sqlDSN == "" {
+		cfg.sqlDSN = os.Getenv("SQL_DSN")
+	}
+
+	allowedNetsStr, allowedHostnames := splitAllowedHosts(cfg.allowedNetsStr)
+
+	allowedNets, err := setupAllowedNetworks(allowedNetsStr)
+	if err != nil {
+		return fmt.Errorf("setupAllowedNetworks: %w", err)
+	}
+	cfg.allowedNets = allowedNets
+	cfg.allowedHosts = newAllowedHosts(allowedHostnames, cfg.allowedNetsTTL)
+
+	trustedProxies, err := setupAllowedNetworks(cfg.trustedProxiesStr)
+	if err != nil {
+		return fmt.Errorf("invalid trusted_proxies: %w", err)
+	}
+	cfg.trustedProxies = trustedProxies
+
+	cfg.logHeaders = parseLogHeaders(cfg.logHeadersStr)
+
+	switch cfg.dataMode {
+	case smtpd.DataLenient, smtpd.DataReject, smtpd.DataRepair:
+	default:
+		return fmt.Errorf("invalid data_mode %q, expected reject or repair", cfg.dataMode)
+	}
+
+	cfg.received, cfg.noReceived, err = parseReceivedFields(cfg.receivedHeader)
+	if err != nil {
+		return fmt.Errorf("invalid received_header: %w", err)
+	}
+
+	cfg.mailLog, err = newMailLog(cfg.syslogAddr, cfg.syslogFacility, cfg.syslogTag, cfg.hostName)
+	if err != nil {
+		return fmt.Errorf("syslog: %w", err)
+	}
+
+	cfg.audit, err = newAuditLog(cfg.auditLogFile, cfg.auditLogMaxSize, cfg.auditLogMaxAge, cfg.auditLogBackups)
+	if err != nil {
+		return fmt.Errorf("invalid audit_log: %w", err)
+	}
+
+	cfg.transcripts, err = newTranscripts(cfg.transcriptDir, cfg.transcriptSample, cfg.transcriptNets)
+	if err != nil {
+		return err
+	}
+
+	if cfg.remoteCredsFile != "" {
+		creds, err := loadCredentialsFile(cfg.remoteCredsFile)
+		if err != nil {
+			return fmt.Errorf("cannot load remote credentials file %q: %w", cfg.remoteCredsFile, err)
+		}
+		cfg.remoteCredentials = creds
+	}
+
+	if cfg.aliasesFile != "" {
+		cfg.aliases, err = loadAliasesFile(cfg.aliasesFile)
+		if err != nil {
+			return fmt.Errorf("cannot load aliases file %q: %w", cfg.aliasesFile, err)
+		}
+	}
+
+	if cfg.autoReplyFile != "" {
+		cfg.autoReplies, err = loadAutoRepliesFile(cfg.autoReplyFile)
+		if err != nil {
+			return fmt.Errorf("cannot load auto-reply rules %q: %w", cfg.autoReplyFile, err)
+		}
+	}
+
+	if cfg.senderLoginFile != "" {
+		cfg.senderLogins, err = loadSenderLoginsFile(cfg.senderLoginFile)
+		if err != nil {
+			return fmt.Errorf("cannot load sender login map %q: %w", cfg.senderLoginFile, err)
+		}
+	}
+
+	if cfg.headerRulesFile != "" {
+		cfg.headerRules, err = loadHeaderRules(cfg.headerRulesFile)
+		if err != nil {
+			return fmt.Errorf("cannot load header rules file %q: %w", cfg.headerRulesFile, err)
+		}
+	}
+
+	if cfg.attachmentFile != "" {
+		cfg.attachments, err = loadAttachmentPolicy(cfg.attachmentFile)
+		if err != nil {
+			return fmt.Errorf("cannot load attachment policy file %q: %w", cfg.attachmentFile, err)
+		}
+	}
+
+	if cfg.policyFile != "" {
+		cfg.policy, err = loadPolicy(cfg.policyFile)
+		if err != nil {
+			return fmt.Errorf("cannot load policy rules file %q: %w", cfg.policyFile, err)
+		}
+	}
+
+	cfg.localTLS, err = parseTLSPolicy(cfg.localTLSVersion, cfg.localTLSCiphers, cfg.localTLSCurves)
+	if err != nil {
+		return fmt.Errorf("invalid local TLS settings: %w", err)
+	}
+
+	cfg.remoteTLS, err = parseTLSPolicy(cfg.remoteTLSVersion, cfg.remoteTLSCiphers, cfg.remoteTLSCurves)
+	if err != nil {
+		return fmt.Errorf("invalid remote TLS settings: %w", err)
+	}
+
+	cfg.dane, err = newDANEVerifier(cfg.remoteDANE)
+	if err != nil {
+		return fmt.Errorf("invalid remote_dane: %w", err)
+	}
+
+	cfg.mtaSTS = newMTASTS(cfg.remoteMTASTS)
+
+	cfg.dialer, err = newOutboundDialer(cfg.remoteIPPrefer, cfg.remoteSourceAddr, cfg.remoteProxy,
+		cfg.remoteDialTimeout, cfg.remoteFallback)
+	if err != nil {
+		return fmt.Errorf("invalid remote_ip_preference, remote_source_address or remote_proxy: %w", err)
+	}
+
+	cfg.remoteXClient, err = parseForwardMode(cfg.remoteXClient)
+	if err != nil {
+		return fmt.Errorf("invalid remote_xclient: %w", err)
+	}
+
+	cfg.balancer, err = newUpstreamBalancer(cfg.remoteStrategy, cfg.remoteDeadTime)
+	if err != nil {
+		return fmt.Errorf("invalid remote_host_strategy: %w", err)
+	}
+
+	// the groups of remote_host are known to the health checks from the start
+	for _, entry := range splitstr(cfg.remoteHost, ' ') {
+		_, host, found := strings.Cut(entry, "=")
+		if !found {
+			host = entry
+		}
+
+		if _, err := cfg.balancer.group(host); err != nil {
+			return fmt.Errorf("invalid remote_host: %w", err)
+		}
+	}
+
+	cfg.scheduler, err = newScheduler(cfg.deliveryConns, cfg.destConcurrency, cfg.destRates,
+		cfg.destBackoff, cfg.destBackoffMax, cfg.deliveryWaitMax)
+	if err != nil {
+		return err
+	}
+
+	switch cfg.delivery {
+	case "", deliverySmarthost, deliveryMX, deliveryDiscard, deliveryWebhook, deliveryKafka:
+	default:
+		return fmt.Errorf("unknown delivery mode %q", cfg.delivery)
+	}
+
+	cfg.webhook, err = newWebhook(cfg)
+	if err != nil {
+		return err
+	}
+
+	cfg.kafka, err = newKafkaProducer(cfg)
+	if err != nil {
+		return err
+	}
+
+	cfg.archive, err = newArchiver(cfg)
+	if err != nil {
+		return err
+	}
+
+	cfg.clamav = newClamAV(cfg.clamavAddr, cfg.clamavTimeout)
+
+	cfg.policyService, err = newPolicyService(cfg.policySvcAddr, cfg.policySvcTimeout, cfg.policySvcContext, cfg.policySvcDefault)
+	if err != nil {
+		return fmt.Errorf("invalid policy_service_default_action: %w", err)
+	}
+
+	cfg.quarantine, err = newQuarantine(cfg.quarantineDir, cfg.quarantineChecks)
+	if err != nil {
+		return fmt.Errorf("invalid quarantine_checks: %w", err)
+	}
+
+	cfg.ldap, err = newLDAPAuth(cfg.ldapURL, cfg.ldapStartTLS, cfg.ldapBindDN, cfg.ldapBindPass,
+		cfg.ldapBaseDN, cfg.ldapUserFilter, cfg.ldapGroup, cfg.ldapPoolSize, cfg.ldapTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid ldap_url or ldap_user_filter: %w", err)
+	}
+
+	cfg.sql, err = newSQLAuth(cfg.sqlDriver, cfg.sqlDSN, cfg.sqlUserQuery, cfg.sqlCacheTTL)
+	if err != nil {
+		return fmt.Errorf("invalid sql_driver or sql_dsn: %w", err)
+	}
+
+	cfg.httpAuth = newHTTPAuth(cfg.authHTTPURL, cfg.authHTTPToken, cfg.authHTTPTimeout, cfg.authHTTPCacheTTL)
+
+	cfg.journal, err = parseJournal(cfg.journalRcpts)
+	if err != nil {
+		return fmt.Errorf("invalid journal_recipients: %w", err)
+	}
+
+	cfg.priorities, err = parseSenderPriorities(cfg.senderPriorities)
+	if err != nil {
+		return fmt.Errorf("invalid sender_priorities: %w", err)
+	}
+
+	cfg.replyCodes, err = parseReplyMap(cfg.upstreamReplyMap)
+	if err != nil {
+		return fmt.Errorf("invalid upstream_reply_map: %w", err)
+	}
+
+	cfg.masquerade, err = parseMasquerade(cfg.senderMasquerade)
+	if err != nil {
+		return fmt.Errorf("invalid sender_masquerade: %w", err)
+	}
+
+	cfg.srs, err = newSRS(cfg.srsDomain, cfg.srsSecrets)
+	if err != nil {
+		return err
+	}
+
+	if cfg.localACMEDomains != "" {
+		if cfg.localCert != "" || cfg.localKey != "" {
+			return errors.New("local_acme_domains can't be used with local_cert and local_key")
+		}
+
+		// certificates would be requested again on each restart, which CAs
+		// rate limit
+		if cfg.localACMECacheDir == "" {
+			return errors.New("local_acme_domains requires local_acme_cache_dir to be set")
+		}
+	}
+
+	if cfg.etrnDomains != "" && cfg.queueDir == "" {
+		return errors.New("etrn_domains requires queue_dir to be set")
+	}
+
+	if cfg.scheduleMaxDelay > 0 && cfg.queueDir == "" {
+		return errors.New("schedule_max_delay requires queue_dir to be set")
+	}
+
+	if cfg.greetDelay < 0 {
+		return errors.New("greet_delay must not be negative")
+	}
+
+	switch cfg.earlyTalkerAction {
+	case "":
+		cfg.earlyTalkerAction = earlyTalkerReject
+	case earlyTalkerReject, earlyTalkerLog:
+	default:
+		return fmt.Errorf("invalid early_talker_action %q, expected reject or log", cfg.earlyTalkerAction)
+	}
+
+	if cfg.maxCommands < 0 || cfg.maxErrors < 0 || cfg.maxSessionTime < 0 {
+		return errors.New("max_commands, max_errors and max_session_duration must not be negative")
+	}
+
+	if cfg.authMaxFailures < 0 || cfg.authFailureDelay < 0 || cfg.authMaxDelay < 0 || cfg.authLockout < 0 {
+		return errors.New("auth_max_failures, auth_failure_delay, auth_max_delay and auth_lockout must not be negative")
+	}
+
+	if cfg.tarpitAfter < 0 || cfg.tarpitDelay < 0 || cfg.tarpitMaxDelay < 0 {
+		return errors.New("tarpit_after, tarpit_delay and tarpit_max_delay must not be negative")
+	}
+
+	if cfg.shutdownTimeout < 0 {
+		return errors.New("shutdown_timeout must not be negative")
+	}
+
+	if cfg.metricsOTLP && cfg.otlpInterval <= 0 {
+		return errors.New("metrics_otlp_interval must be positive")
+	}
+
+	if cfg.localClientCA != "" {
+		if cfg.allowedUsers == "" {
+			return errors.New("local_client_ca requires allowed_users to be set")
+		}
+
+		pool, err := loadCertPool(cfg.localClientCA)
+		if err != nil {
+			return fmt.Errorf("cannot load client CA file %q: %w", cfg.localClientCA, err)
+		}
+		cfg.clientCAs = pool
+	}
+
+	cfg.uid, cfg.gid, err = lookupIDs(cfg.runUser, cfg.runGroup)
+	if err != nil {
+		return err
+	}
+
+	if cfg.remoteAuth == "xoauth2" || cfg.remoteAuth == "oauthbearer" {
+		tokens, err := cfg.oauthTokenSource()
+		if err != nil {
+			return err
+		}
+		cfg.oauthTokens = tokens
+	}
+
+	return nil
+}
+
+// configFilePath resolves the -config flag the way iniflags does: relative
+// paths not starting with "./" are relative to the executable
+func configFilePath(file string) string {
+	if file == "" || filepath.IsAbs(file) || strings.HasPrefix(file, "./") {
+		return file
+	}
+
+	return filepath.Join(filepath.Dir(os.Args[0]), file)
+}
+
+// readConfig reads the config file and environment again into a new config,
+// with the flags set on the command line taking precedence, as on startup
+func readConfig(file string, cmdlineFlags map[string]string) (*config, error) {
+	cfg := config{}
+
+	f := flag.NewFlagSet(applicationName, flag.ContinueOnError)
+	registerFlags(f, &cfg)
+
+	switch {
+	case isStructuredConfig(file):
+		if err := applyConfigFile(f, file, nil); err != nil {
+			return nil, err
+		}
+	case file != "":
+		args, ok := iniflags.ReadIniFile(file)
+		if !ok {
+			return nil, fmt.Errorf("cannot read config file %q", file)
+		}
+
+		for _, arg := range args {
+			// ignore iniflags' own flags
+			if f.Lookup(arg.Key) == nil {
+				continue
+			}
+
+			if err := f.Set(arg.Key, arg.Value); err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s at line %d of %q: %w",
+					arg.Value, arg.Key, arg.LineNum, arg.FilePath, err)
+			}
+		}
+	}
+
+	if err := applyEnv(f, cmdlineFlags); err != nil {
+		return nil, err
+	}
+
+	for name, value := range cmdlineFlags {
+		if f.Lookup(name) == nil {
+			continue
+		}
+
+		if err := f.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s: %w", value, name, err)
+		}
+	}
+
+	if err := cfg.setup(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// reloaded returns a copy of the config with the settings which can be
+// changed at runtime taken from newCfg. Other settings need a restart.
+func (cfg *config) reloaded(newCfg *config) *config {
+	c := *cfg
+
+	c.allowedNetsStr = newCfg.allowedNetsStr
+	c.allowedNets = newCfg.allowedNets
+	c.allowedNetsTTL = newCfg.allowedNetsTTL
+	c.allowedHosts = newCfg.allowedHosts
+	c.allowedSender = newCfg.allowedSender
+	c.allowedRecipients = newCfg.allowedRecipients
+	c.deniedRecipients = newCfg.deniedRecipients
+	c.localCert = newCfg.localCert
+	c.localKey = newCfg.localKey
+	c.remoteUser = newCfg.remoteUser
+	c.remotePass = newCfg.remotePass
+	c.remoteAuth = newCfg.remoteAuth
+	c.remoteCredsFile = newCfg.remoteCredsFile
+	c.remoteCredentials = newCfg.remoteCredentials
+	c.headerRulesFile = newCfg.headerRulesFile
+	c.headerRules = newCfg.headerRules
+	c.attachmentFile = newCfg.attachmentFile
+	c.attachments = newCfg.attachments
+	c.policyFile = newCfg.policyFile
+	c.policy = newCfg.policy
+	c.aliasesFile = newCfg.aliasesFile
+	c.aliases = newCfg.aliases
+	c.autoReplyFile = newCfg.autoReplyFile
+	c.autoReplies = newCfg.autoReplies
+	c.autoReplyInterval = newCfg.autoReplyInterval
+	c.senderLoginFile = newCfg.senderLoginFile
+	c.senderLogins = newCfg.senderLogins
+	c.remoteOAuthURL = newCfg.remoteOAuthURL
+	c.remoteOAuthID = newCfg.remoteOAuthID
+	c.remoteOAuthSecret = newCfg.remoteOAuthSecret
+	c.remoteOAuthToken = newCfg.remoteOAuthToken
+	c.remoteOAuthScopes = newCfg.remoteOAuthScopes
+	c.oauthTokens = newCfg.oauthTokens
+	c.receivedHeader = newCfg.receivedHeader
+	c.received = newCfg.received
+	c.noReceived = newCfg.noReceived
+	c.verifyCommands = newCfg.verifyCommands
+	c.stripHeaders = newCfg.stripHeaders
+	c.fixHeaders = newCfg.fixHeaders
+	c.etrnDomains = newCfg.etrnDomains
+	c.scheduleMaxDelay = newCfg.scheduleMaxDelay
+	c.priorities = newCfg.priorities
+	c.successDSN = newCfg.successDSN
+	c.deliveryNotifyURL = newCfg.deliveryNotifyURL
+	c.replyCodes = newCfg.replyCodes
+
+	return &c
+}
+
+func registerFlags(f *flag.FlagSet, cfg *config) {
+	f.StringVar(&cfg.logFormat, "log_format", "json", "Log format - json or logfmt")
+	f.StringVar(&cfg.hostName, "hostname", "localhost.localdomain", "Server hostname")
+	f.StringVar(&cfg.welcomeMsg, "welcome_msg", "", "Welcome message for SMTP session")
+	f.StringVar(&cfg.listen, "listen", "127.0.0.1:25 [::1]:25", "Address and port to listen for incoming SMTP, prefix with starttls:// or smtps:// for TLS")
+	f.StringVar(&cfg.metricsListen, "metrics_listen", ":8080", "Address and port to listen for metrics exposition")
+	f.BoolVar(&cfg.metricsOTLP, "metrics_otlp", false, "Also export the metrics to an OTLP collector over gRPC, configured with the OTEL_EXPORTER_OTLP_* environment variables")
+	f.DurationVar(&cfg.otlpInterval, "metrics_otlp_interval", time.Minute, "Interval between exports of the metrics to the OTLP collector")
+	f.StringVar(&cfg.adminListen, "admin_listen", "", "Address and port to listen for the admin API (leave empty to disable)")
+	f.StringVar(&cfg.adminToken, "admin_token", "", "Bearer token required by the admin API (leave empty to not require one)")
+	f.StringVar(&cfg.runUser, "user", "", "User to switch to once the listeners are bound, when started as root")
+	f.StringVar(&cfg.runGroup, "group", "", "Group to switch to once the listeners are bound (defaults to the primary group of user)")
+	f.StringVar(&cfg.chrootDir, "chroot", "", "Directory to chroot to once the listeners are bound")
+	f.StringVar(&cfg.localCert, "local_cert", "", "SSL certificate for STARTTLS/TLS")
+	f.StringVar(&cfg.localKey, "local_key", "", "SSL private key for STARTTLS/TLS")
+	f.BoolVar(&cfg.localForceTLS, "local_forcetls", false, "Force STARTTLS (needs local_cert and local_key)")
+	f.DurationVar(&cfg.localCertWatch, "local_cert_watch_interval", time.Minute, "Interval between checks of local_cert and local_key for changes, reloaded without restart (0 to disable)")
+	f.StringVar(&cfg.localTLSVersion, "local_tls_min_version", "1.2", "Minimum TLS version of incoming connections (1.2 or 1.3)")
+	f.StringVar(&cfg.localTLSCiphers, "local_tls_ciphers", "", "TLS 1.2 cipher suites of incoming connections, separated by spaces (leave empty for the Go defaults)")
+	f.StringVar(&cfg.localTLSCurves, "local_tls_curves", "", "TLS curves of incoming connections, in order of preference (leave empty for the Go defaults)")
+	f.StringVar(&cfg.localACMEDomains, "local_acme_domains", "", "Domains to obtain the STARTTLS/TLS certificate for from an ACME CA, instead of local_cert and local_key (leave empty to disable)")
+	f.StringVar(&cfg.localACMEEmail, "local_acme_email", "", "Contact email of the ACME account")
+	f.StringVar(&cfg.localACMECacheDir, "local_acme_cache_dir", "", "Directory caching the ACME account and certificates")
+	f.StringVar(&cfg.localACMEURL, "local_acme_directory", autocert.DefaultACMEDirectory, "ACME directory URL of the CA")
+	f.StringVar(&cfg.localACMEHTTP, "local_acme_http_listen", ":80", "Address and port to serve ACME HTTP-01 challenges (leave empty to disable)")
+	f.StringVar(&cfg.localClientCA, "local_client_ca", "", "CA certificates verifying client certificates, which authenticate as the matching allowed_users entry (leave empty to disable)")
+	f.StringVar(&cfg.allowedNetsStr, "allowed_nets", "127.0.0.0/8 ::/128", "Networks allowed to send mails (set to \"\" to disable")
+	f.DurationVar(&cfg.allowedNetsTTL, "allowed_nets_refresh", 5*time.Minute, "How often the hostnames of allowed_nets are resolved again")
+	f.StringVar(&cfg.trustedProxiesStr, "trusted_proxies", "", "Networks allowed to send PROXY protocol headers (leave empty to allow any)")
+	f.StringVar(&cfg.allowedSender, "allowed_sender", "", "Regular expression for valid FROM email addresses (leave empty to allow any sender)")
+	f.StringVar(&cfg.allowedRecipients, "allowed_recipients", "", "Regular expression for valid 'to' email addresses (leave empty to allow any recipient)")
+	f.StringVar(&cfg.deniedRecipients, "denied_recipients", "", "Regular expression for email addresses for which will never deliver any emails.")
+	f.StringVar(&cfg.journalRcpts, "journal_recipients", "", "Recipients silently added to the envelope of every message (journal@example.com), or of the messages from or to a domain (example.com=journal@example.com), separated by spaces")
+	f.StringVar(&cfg.allowedUsers, "allowed_users", "", "Path to file with valid users/passwords (leave empty to allow any user)")
+	f.IntVar(&cfg.authMaxFailures, "auth_max_failures", 0, "Failed AUTH attempts of a client IP or username after which it's locked for auth_lockout (0 to disable)")
+	f.DurationVar(&cfg.authFailureDelay, "auth_failure_delay", time.Second, "Delay of the reply to the first failed AUTH attempt of a client IP or username, doubled with each further one, with auth_max_failures")
+	f.DurationVar(&cfg.authMaxDelay, "auth_max_delay", 30*time.Second, "Max delay of the replies to the failed AUTH attempts, with auth_max_failures")
+	f.DurationVar(&cfg.authLockout, "auth_lockout", 15*time.Minute, "How long a client IP or username is locked after auth_max_failures failed AUTH attempts")
+	f.StringVar(&cfg.senderLoginFile, "sender_login_map", "", "Path to file with the sender addresses owned by each authenticated user, the only ones they may use (pattern user[, user...] per line - leave empty to not restrict them)")
+	f.StringVar(&cfg.ldapURL, "ldap_url", "", "LDAP server authenticating users, as ldap://host[:port] or ldaps://host[:port] (leave empty to disable)")
+	f.BoolVar(&cfg.ldapStartTLS, "ldap_starttls", false, "Upgrade ldap:// connections to TLS with StartTLS")
+	f.StringVar(&cfg.ldapBindDN, "ldap_bind_dn", "", "DN of the service account searching users (leave empty to search anonymously)")
+	f.StringVar(&cfg.ldapBindPass, "ldap_bind_password", "", "Password of the LDAP service account")
+	f.StringVar(&cfg.ldapBaseDN, "ldap_base_dn", "", "DN under which users are searched")
+	f.StringVar(&cfg.ldapUserFilter, "ldap_user_filter", "(uid=%s)", "LDAP filter matching the entry of a user, with %s replaced by the username")
+	f.StringVar(&cfg.ldapGroup, "ldap_group", "", "DN of the group users must be members of, checked with their memberOf attribute (leave empty to allow any user)")
+	f.IntVar(&cfg.ldapPoolSize, "ldap_pool_size", 4, "Max idle LDAP connections kept open between authentications")
+	f.DurationVar(&cfg.ldapTimeout, "ldap_timeout", 10*time.Second, "Max duration of an LDAP authentication")
+	f.StringVar(&cfg.sqlDriver, "sql_driver", sqlDriverPostgres, "Driver of the SQL database authenticating users - postgres or mysql")
+	f.StringVar(&cfg.sqlDSN, "sql_dsn", "", "Data source name of the SQL database authenticating users, holding their password hashes, allowed sender addresses and rate limits (leave empty to disable)")
+	f.StringVar(&cfg.sqlUserQuery, "sql_user_query", "", "Query returning the password hash, comma-separated allowed sender addresses and per-minute message and per-hour recipient limits of the username given as its argument (leave empty for the default of sql_driver)")
+	f.DurationVar(&cfg.sqlCacheTTL, "sql_cache_ttl", time.Minute, "Duration users queried from the SQL database are cached")
+	f.StringVar(&cfg.authHTTPURL, "auth_http_url", "", "HTTP endpoint authenticating users, posted their credentials and returning their policy as JSON (leave empty to disable)")
+	f.StringVar(&cfg.authHTTPToken, "auth_http_token", "", "Bearer token sent to the auth endpoint (leave empty to send none)")
+	f.DurationVar(&cfg.authHTTPTimeout, "auth_http_timeout", 10*time.Second, "Timeout of auth endpoint requests")
+	f.DurationVar(&cfg.authHTTPCacheTTL, "auth_http_cache_ttl", 5*time.Minute, "Duration answers of the auth endpoint are cached, by credentials")
+	f.StringVar(&cfg.delivery, "delivery", deliverySmarthost, "Delivery mode - smarthost to deliver to remote_host, mx to deliver directly to the MX hosts of recipient domains not matching a remote_host route, discard to accept messages without delivering them, webhook to post them to webhook_url, or kafka to publish them to kafka_topic")
+	f.StringVar(&cfg.webhookURL, "webhook_url", "", "URL messages are posted to, with the webhook delivery mode")
+	f.StringVar(&cfg.webhookFormat, "webhook_format", webhookFormatRaw, "Format of webhook requests - raw for the message as is, or json for the envelope, headers and body")
+	f.StringVar(&cfg.webhookSecret, "webhook_secret", "", "Secret signing webhook requests with HMAC-SHA256 (leave empty to not sign them)")
+	f.BoolVar(&cfg.successDSN, "success_dsn", false, "Send a success DSN to the sender when a recipient asked for one with NOTIFY=SUCCESS and the upstream accepting the message doesn't support DSN")
+	f.StringVar(&cfg.deliveryNotifyURL, "delivery_notify_url", "", "URL the deliveries accepted by the upstreams are posted to as JSON, with the upstream's reply and queue ID, signed with webhook_secret (leave empty to disable)")
+	f.DurationVar(&cfg.webhookTimeout, "webhook_timeout", 30*time.Second, "Timeout of webhook requests")
+	f.IntVar(&cfg.webhookRetries, "webhook_retries", 3, "Max retries of failed webhook requests, before the delivery fails temporarily")
+	f.StringVar(&cfg.kafkaBrokers, "kafka_brokers", "", "Kafka brokers (host:port) messages are published to with the kafka delivery mode, separated by spaces")
+	f.StringVar(&cfg.kafkaTopic, "kafka_topic", "", "Kafka topic messages are published to, keyed by recipient domain")
+	f.StringVar(&cfg.kafkaSASL, "kafka_sasl_mechanism", "", "SASL mechanism authenticating with the Kafka brokers (plain, scram-sha-256, scram-sha-512, or empty to disable)")
+	f.StringVar(&cfg.kafkaUser, "kafka_user", "", "Username for SASL authentication with the Kafka brokers")
+	f.StringVar(&cfg.kafkaPass, "kafka_pass", "", "Password for SASL authentication with the Kafka brokers")
+	f.BoolVar(&cfg.kafkaTLS, "kafka_tls", false, "Connect to the Kafka brokers with TLS, verified with the system CAs")
+	f.DurationVar(&cfg.kafkaTimeout, "kafka_timeout", 30*time.Second, "Timeout of Kafka publications, after which the delivery fails temporarily")
+	f.StringVar(&cfg.remoteHost, "remote_host", "smtp.gmail.com:587", "Outgoing SMTP server, optionally followed by per-recipient routes (pattern=host:port) separated by spaces")
+	f.StringVar(&cfg.remoteUser, "remote_user", "", "Username for authentication on outgoing SMTP server")
+	f.IntVar(&cfg.maxMessageSize, "max_message_size", 51200000, "Max message size allowed in bytes")
+	f.BoolVar(&cfg.streamData, "stream_data", false, "Stream messages to the upstream as they're received, rather than buffering them in memory")
+	f.StringVar(&cfg.dataMode, "data_mode", "", "Strict checks of the message data (CRLF.CRLF ending, lines of at most 998 characters) - reject or repair the bare CRs and LFs (leave empty to accept the data as received)")
+	f.IntVar(&cfg.maxConnections, "max_connections", 100, "Max number of concurrent connections, use -1 to disable")
+	f.IntVar(&cfg.maxRecipients, "max_recipients", 100, "Max number of recipients on an email")
+	f.IntVar(&cfg.maxCommands, "max_commands", 0, "Max number of commands of an SMTP session, after which the client is disconnected (0 to disable)")
+	f.IntVar(&cfg.maxErrors, "max_errors", 0, "Max number of error replies of an SMTP session, after which the client is disconnected (0 to disable)")
+	f.IntVar(&cfg.tarpitAfter, "tarpit_after", 0, "Number of error replies of an SMTP session after which the replies are delayed, to slow down dictionary attacks (0 to disable)")
+	f.DurationVar(&cfg.tarpitDelay, "tarpit_delay", time.Second, "Delay added to each error reply past tarpit_after")
+	f.DurationVar(&cfg.tarpitMaxDelay, "tarpit_max_delay", 30*time.Second, "Max delay of an error reply with tarpit_after (0 for no limit)")
+	f.DurationVar(&cfg.readTimeout, "read_timeout", 60*time.Second, "Socket timeout for read operations")
+	f.DurationVar(&cfg.writeTimeout, "write_timeout", 60*time.Second, "Socket timeout for write operations")
+	f.DurationVar(&cfg.dataTimeout, "data_timeout", 5*time.Minute, "Socket timeout for DATA command")
+	f.DurationVar(&cfg.maxSessionTime, "max_session_duration", 0, "Max duration of an SMTP session, after which the client is disconnected (0 to disable)")
+	f.DurationVar(&cfg.shutdownTimeout, "shutdown_timeout", 30*time.Second, "Grace period for active sessions and queued deliveries to finish on shutdown, before they're closed")
+	f.StringVar(&cfg.remotePass, "remote_pass", "", "Password for authentication on outgoing SMTP server (set $REMOTE_PASS to use env var instead)")
+	f.StringVar(&cfg.remoteAuth, "remote_auth", "plain", "Auth method on outgoing SMTP server (plain, scram-sha-256, xoauth2, oauthbearer)")
+	f.StringVar(&cfg.remoteOAuthURL, "remote_oauth_token_url", "", "OAuth2 token endpoint, for remote_auth xoauth2 and oauthbearer")
+	f.StringVar(&cfg.remoteOAuthID, "remote_oauth_client_id", "", "OAuth2 client ID, for remote_auth xoauth2 and oauthbearer")
+	f.StringVar(&cfg.remoteOAuthSecret, "remote_oauth_client_secret", "", "OAuth2 client secret, for remote_auth xoauth2 and oauthbearer")
+	f.StringVar(&cfg.remoteOAuthToken, "remote_oauth_refresh_token", "", "OAuth2 refresh token, for remote_auth xoauth2 and oauthbearer (leave empty to use the client credentials flow)")
+	f.StringVar(&cfg.remoteOAuthScopes, "remote_oauth_scopes", "", "OAuth2 scopes requested for access tokens, separated by spaces")
+	f.StringVar(&cfg.remoteTLSVersion, "remote_tls_min_version", "1.2", "Minimum TLS version of outgoing connections (1.2 or 1.3)")
+	f.StringVar(&cfg.remoteTLSCiphers, "remote_tls_ciphers", "", "TLS 1.2 cipher suites of outgoing connections, separated by spaces (leave empty for the Go defaults)")
+	f.StringVar(&cfg.remoteTLSCurves, "remote_tls_curves", "", "TLS curves of outgoing connections, in order of preference (leave empty for the Go defaults)")
+	f.StringVar(&cfg.remoteDANE, "remote_dane", "", "DANE authentication of outgoing connections with TLSA records (opportunistic, required, or empty to disable)")
+	f.BoolVar(&cfg.remoteMTASTS, "remote_mta_sts", false, "Require TLS on outgoing connections for recipient domains publishing an MTA-STS policy in enforce mode")
+	f.IntVar(&cfg.remotePoolMaxIdle, "remote_pool_max_idle", 0, "Max idle connections kept open for reuse per upstream host and user (0 to open a new connection for each message)")
+	f.DurationVar(&cfg.remotePoolMaxAge, "remote_pool_max_age", 5*time.Minute, "Max age of pooled upstream connections")
+	f.StringVar(&cfg.remoteStrategy, "remote_host_strategy", strategyFailover, "How the hosts of the upstream groups of remote_host (host1:port,host2:port) are picked - failover in order, round-robin, or weighted at random by their *N weight")
+	f.DurationVar(&cfg.remoteDeadTime, "remote_dead_time", 30*time.Second, "Duration the hosts of upstream groups which can't be connected to or reply 421 are marked down for, and tried last")
+	f.DurationVar(&cfg.remoteHealthCheck, "remote_health_interval", 0, "Interval of the health checks of the hosts of upstream groups, greeting them to mark them up or down (0 to disable)")
+	f.StringVar(&cfg.remoteIPPrefer, "remote_ip_preference", "", "IP version of the addresses of upstreams tried first - ipv4 or ipv6, or ipv4-only or ipv6-only to only connect with that version (leave empty for the system order)")
+	f.StringVar(&cfg.remoteSourceAddr, "remote_source_address", "", "Source IP address or interface of the outgoing connections, optionally by upstream host name (pattern=address, separated by spaces - leave empty for the system default)")
+	f.DurationVar(&cfg.remoteDialTimeout, "remote_dial_timeout", 30*time.Second, "Timeout of the outgoing connections to each address of the upstreams")
+	f.DurationVar(&cfg.lmtpTimeout, "lmtp_timeout", 10*time.Minute, "Max duration of a delivery to an LMTP host (0 for none)")
+	f.DurationVar(&cfg.remoteFallback, "remote_fallback_delay", 300*time.Millisecond, "Delay before the addresses of the other IP version of an upstream are raced against the preferred ones (Happy Eyeballs), 0 to try them one after the other")
+	f.StringVar(&cfg.remoteProxy, "remote_proxy", "", "Proxy the outgoing connections go through, as socks5://[user:pass@]host:port or http://[user:pass@]host:port for HTTP CONNECT (leave empty to connect directly)")
+	f.StringVar(&cfg.remoteXClient, "remote_xclient", "", "Forward the address, HELO name and login of the clients to the upstreams trusting the relay, with xclient or xforward (leave empty to disable)")
+	f.IntVar(&cfg.deliveryConns, "delivery_concurrency", 0, "Max concurrent SMTP deliveries to all upstream hosts and recipient domains (0 for no limit)")
+	f.StringVar(&cfg.destConcurrency, "delivery_domain_concurrency", "", "Max concurrent SMTP deliveries by recipient domain, or upstream host name (domain=N, separated by spaces, * for the other ones - leave empty for no limit)")
+	f.StringVar(&cfg.destRates, "delivery_domain_rate", "", "Max SMTP deliveries per minute by recipient domain, or upstream host name (domain=N, separated by spaces, * for the other ones - leave empty for no limit)")
+	f.DurationVar(&cfg.destBackoff, "delivery_backoff", 0, "Delay before delivering again to a recipient domain or upstream host which replied 421 or 450, doubled on each consecutive deferral (0 to disable)")
+	f.DurationVar(&cfg.destBackoffMax, "delivery_backoff_max", 15*time.Minute, "Max delay before delivering again to a recipient domain or upstream host which replied 421 or 450")
+	f.DurationVar(&cfg.deliveryWaitMax, "delivery_wait_max", 30*time.Second, "Max time a delivery waits for the concurrency and rate limits before it's deferred (0 to wait as long as needed)")
+	f.StringVar(&cfg.remoteCredsFile, "remote_credentials", "", "Path to file with per-user/per-sender-domain credentials for the outgoing SMTP server (overrides remote_user/remote_pass)")
+	f.StringVar(&cfg.receivedHeader, "received_header", "", "Details of the client given in the Received header added to relayed messages - helo, client_ip, tls and/or user (separated by spaces), or none to not add it (leave empty for helo client_ip tls)")
+	f.BoolVar(&cfg.stripHeaders, "strip_client_headers", false, "Remove the Received, X-Mailer, User-Agent and X-Originating-IP headers of relayed messages before adding the relay's Received header, not to disclose the clients' hosts and software")
+	f.BoolVar(&cfg.fixHeaders, "fix_headers", false, "Add the Message-ID and Date headers missing from relayed messages, and a From header with the envelope sender, as upstreams reject such messages")
+	f.BoolVar(&cfg.traceHeaders, "trace_headers", false, "Add W3C Trace Context headers (Traceparent and Tracestate) to relayed messages, so downstream systems can join the trace")
+	f.StringVar(&cfg.headerRulesFile, "header_rules", "", "Path to file with header rules (add, remove, replace by regexp) applied to messages before they're forwarded, globally, per listener or per upstream host")
+	f.StringVar(&cfg.aliasesFile, "aliases", "", "Path to file with aliases rewriting or expanding recipient addresses before delivery (alias target[, target...] per line)")
+	f.StringVar(&cfg.autoReplyFile, "auto_reply", "", "Path to file with the addresses whose messages are replied to automatically, e.g. out of office replies (address template [keep|discard] per line)")
+	f.DurationVar(&cfg.autoReplyInterval, "auto_reply_interval", 7*24*time.Hour, "Min time between the auto-replies of an address to the same sender")
+	f.StringVar(&cfg.remoteSender, "remote_sender", "", "Sender email address on outgoing SMTP server")
+	f.StringVar(&cfg.senderMasquerade, "sender_masquerade", "", "Domain envelope senders are rewritten to (example.com), or per sender domain pattern (*.internal.example.com=example.com), separated by spaces")
+	f.StringVar(&cfg.srsDomain, "srs_domain", "", "Domain envelope senders are rewritten to with SRS, so forwarded messages pass SPF, and whose SRS recipients are reversed (leave empty to disable)")
+	f.StringVar(&cfg.srsSecrets, "srs_secrets", "", "Secrets signing SRS addresses, separated by spaces - the first one signs, all of them verify")
+	f.BoolVar(&cfg.versionInfo, "version", false, "Show version information")
+	f.StringVar(&cfg.logLevel, "log_level", "debug", "Minimum log level to output")
+	f.StringVar(&cfg.logHeadersStr, "log_header", "", "Log this mail header's value (log_field=Header-Name) set multiples with spaces")
+	f.StringVar(&cfg.syslogAddr, "syslog_addr", "", "Syslog server receiving Postfix-style delivery lines - local for the local daemon, tcp://host:port or tls://host:port (leave empty to disable)")
+	f.StringVar(&cfg.syslogFacility, "syslog_facility", "mail", "Syslog facility of the delivery lines")
+	f.StringVar(&cfg.syslogTag, "syslog_tag", "smtprelay", "Syslog tag (app name) of the delivery lines")
+	f.StringVar(&cfg.auditLogFile, "audit_log", "", "File the delivery attempts are appended to as JSON records, one per line (leave empty to disable)")
+	f.Int64Var(&cfg.auditLogMaxSize, "audit_log_max_size", 100<<20, "Size in bytes the audit log is rotated at (0 to disable)")
+	f.DurationVar(&cfg.auditLogMaxAge, "audit_log_max_age", 24*time.Hour, "Period the audit log is rotated at, e.g. 24h for every day at midnight UTC (0 to disable)")
+	f.IntVar(&cfg.auditLogBackups, "audit_log_backups", 7, "Number of rotated audit logs to keep (0 to keep all of them)")
+	f.StringVar(&cfg.transcriptDir, "transcript_dir", "", "Directory the transcripts of the recorded SMTP sessions are written to, a file for each (leave empty to disable)")
+	f.IntVar(&cfg.transcriptSample, "transcript_sample", 0, "Percentage of the SMTP sessions recorded, from 0 to 100")
+	f.StringVar(&cfg.transcriptNets, "transcript_networks", "", "Networks of the clients whose SMTP sessions are all recorded, separated by spaces")
+	f.StringVar(&cfg.spfPolicy, "spf_policy", "", "SPF check of unauthenticated senders - reject, softfail-allow or log-only (leave empty to disable)")
+	f.StringVar(&cfg.fcrdnsMode, "fcrdns_mode", "", "Forward-confirmed reverse DNS check of unauthenticated clients - reject or tag (leave empty to disable)")
+	f.DurationVar(&cfg.greetDelay, "greet_delay", 0, "Delay before the greeting, to catch the clients sending data before it (0 to disable)")
+	f.StringVar(&cfg.earlyTalkerAction, "early_talker_action", earlyTalkerReject, "Action on the clients sending data before the greeting, with greet_delay - reject or log")
+	f.BoolVar(&cfg.dkimVerify, "dkim_verify", false, "Verify DKIM signatures of messages from unauthenticated senders, and add an Authentication-Results header")
+	f.StringVar(&cfg.dmarcMode, "dmarc_mode", "", "DMARC check of unauthenticated senders - enforce or report-only (leave empty to disable)")
+	f.StringVar(&cfg.clamavAddr, "clamav_addr", "", "Address of clamd to scan messages for viruses, as host:port or the path of its unix socket (leave empty to disable)")
+	f.DurationVar(&cfg.clamavTimeout, "clamav_timeout", 30*time.Second, "Max duration of a virus scan")
+	f.StringVar(&cfg.policySvcAddr, "policy_service", "", "Address of a Postfix policy delegation server (e.g. postfwd) checking each recipient, as host:port or the path of its unix socket (leave empty to disable)")
+	f.DurationVar(&cfg.policySvcTimeout, "policy_service_timeout", 10*time.Second, "Max duration of a policy server request")
+	f.StringVar(&cfg.policySvcContext, "policy_service_context", "", "Value of the policy_context attribute sent to the policy server")
+	f.StringVar(&cfg.policySvcDefault, "policy_service_default_action", "451 4.3.5 Server configuration problem", "Postfix access action taken when the policy server can't be queried, e.g. DUNNO to accept the recipients")
+	f.StringVar(&cfg.attachmentFile, "attachment_policy", "", "Path to file with attachment rules (reject or strip by extension, content type or size) applied to messages before they're forwarded, globally or per upstream host")
+	f.StringVar(&cfg.policyFile, "policy_rules", "", "Path to file with policy rules (expressions evaluated on connect, MAIL, RCPT and DATA to reject messages, override their route or edit their headers)")
+	f.StringVar(&cfg.rateLimitMessages, "rate_limit_messages", "", "Max messages per minute by client IP, authenticated user and/or sender domain (ip=N user=N domain=N, separated by spaces - leave empty to disable)")
+	f.StringVar(&cfg.rateLimitRcpts, "rate_limit_recipients", "", "Max recipients per hour by client IP, authenticated user and/or sender domain (ip=N user=N domain=N, separated by spaces - leave empty to disable)")
+	f.StringVar(&cfg.redisURL, "redis_url", "", "Redis server keeping the rate limits and seen Message-IDs shared by several relay instances, as redis://[[user]:password@]host[:port][/db] or rediss:// for TLS (leave empty to keep them in memory)")
+	f.DurationVar(&cfg.redisTimeout, "redis_timeout", 5*time.Second, "Max duration of a Redis command")
+	f.DurationVar(&cfg.dedupWindow, "dedup_window", 0, "How long the Message-IDs of the accepted messages are remembered, to catch the ones submitted twice by the same sender (0 to disable)")
+	f.StringVar(&cfg.dedupAction, "dedup_action", dedupDrop, "What to do with duplicate messages (drop to accept them without delivering them, reject)")
+	f.IntVar(&cfg.dedupMaxEntries, "dedup_max_entries", 100000, "Max Message-IDs remembered in memory, the oldest being forgotten first (unused with redis_url)")
+	f.StringVar(&cfg.dnsblLists, "dnsbl_lists", "", "DNS blocklists to look the client IPs up in, each optionally followed by its score (zone=N, separated by spaces - leave empty to disable)")
+	f.IntVar(&cfg.dnsblThreshold, "dnsbl_threshold", 1, "Score of the DNS blocklists listing a client IP from which its connections are rejected")
+	f.StringVar(&cfg.dnsblMode, "dnsbl_mode", dnsblModeReject, "What to do with the clients reaching the DNSBL threshold (reject, log-only)")
+	f.DurationVar(&cfg.dnsblTimeout, "dnsbl_timeout", 5*time.Second, "Max duration of the DNS blocklist lookups of a client IP")
+	f.BoolVar(&cfg.rcptCallout, "recipient_callout", false, "Verify the recipients of unauthenticated clients with their upstream host at RCPT TO, rejecting the ones it rejects")
+	f.DurationVar(&cfg.calloutTimeout, "recipient_callout_timeout", 30*time.Second, "Max duration of a recipient callout")
+	f.BoolVar(&cfg.verifyCommands, "verify_commands", false, "Answer VRFY with the recipient checks and callout, and EXPN with the aliases, rather than 252 - which discloses the aliases and the valid recipients")
+	f.StringVar(&cfg.queueDir, "queue_dir", "", "Spool directory for messages whose delivery failed temporarily (leave empty to disable queueing)")
+	f.DurationVar(&cfg.queueRetryMin, "queue_retry_min", time.Minute, "Delay before the first retry of a queued message, doubled on each failed attempt")
+	f.DurationVar(&cfg.queueRetryMax, "queue_retry_max", time.Hour, "Max delay between retries of a queued message")
+	f.DurationVar(&cfg.queueMaxAge, "queue_max_age", 5*24*time.Hour, "Max time a message is kept in the queue before it's dropped")
+	f.DurationVar(&cfg.scheduleMaxDelay, "schedule_max_delay", 0, "Max delay of the messages scheduled for later delivery with an X-Delay-Until or X-Deliver-After header, which are queued until then (0 to disable scheduling)")
+	f.BoolVar(&cfg.mtPriority, "mt_priority", false, "Accept the MT-PRIORITY parameter of MAIL FROM (RFC 6710), forwarded to the upstreams supporting it, the queued messages of higher priority being delivered first")
+	f.StringVar(&cfg.senderPriorities, "sender_priorities", "", "Priorities of the messages of senders, overriding MT-PRIORITY, as address=N or @domain=N from -9 to 9 (separated by spaces)")
+	f.StringVar(&cfg.upstreamReplyMap, "upstream_reply_map", "", "Reply codes overriding the ones of the upstream errors relayed to clients, as code=code entries with optional enhanced status codes, e.g. 452/4.2.2=552/5.2.2 (separated by spaces)")
+	f.StringVar(&cfg.etrnDomains, "etrn_domains", "", "Domains whose queued messages clients may request the delivery of with ETRN, including their subdomains, or * for all (separated by spaces - leave empty to disable ETRN)")
+	f.StringVar(&cfg.quarantineDir, "quarantine_dir", "", "Directory holding the messages flagged by quarantine_checks instead of rejecting them, until they're released or deleted with the admin API (leave empty to disable)")
+	f.StringVar(&cfg.quarantineChecks, "quarantine_checks", "virus dmarc policy", "Checks whose rejects are quarantined - virus, dmarc or policy (separated by spaces)")
+	f.StringVar(&cfg.archiveURL, "archive_url", "", "Where a copy of every relayed message is archived, as s3://bucket/prefix, gs://bucket/prefix, maildir:///path or mbox:///path (leave empty to disable archiving)")
+	f.StringVar(&cfg.archiveEndpoint, "archive_endpoint", "", "Endpoint of the archive bucket, for S3-compatible stores (leave empty for AWS or GCS)")
+	f.StringVar(&cfg.archiveRegion, "archive_region", "", "Region of the archive bucket (defaults to us-east-1 for S3)")
+	f.StringVar(&cfg.archiveAccessKey, "archive_access_key", "", "Access key of the archive bucket, or HMAC key for GCS (defaults to AWS_ACCESS_KEY_ID)")
+	f.StringVar(&cfg.archiveSecretKey, "archive_secret_key", "", "Secret key of the archive bucket, or HMAC secret for GCS (defaults to AWS_SECRET_ACCESS_KEY)")
+	f.StringVar(&cfg.archiveKeyTmpl, "archive_key_template", "{{.Date}}/{{.ID}}", "Template of the object keys of archived messages, with the .ID, .Time, .Date, .Sender and .SenderDomain fields")
+	f.IntVar(&cfg.archiveMaxSize, "archive_max_size", 0, "Size in bytes above which Maildir and mbox archives are rotated (0 to never rotate them)")
+}
+
+// parseReceivedFields parses the details of the client given in the Received
+// header, nil for the default ones if s is empty. none reports that the
+// header isn't added at all.
+func parseReceivedFields(s string) (fields *smtpd.ReceivedFields, none bool, err error) {
+	if s == "none" {
+		return nil, true, nil
+	}
+
+	for _, field := range splitstr(s, ' ') {
+		if fields == nil {
+			fields = &smtpd.ReceivedFields{}
+		}
+
+		switch field {
+		case "helo":
+			fields.HeloName = true
+		case "client_ip":
+			fields.ClientIP = true
+		case "tls":
+			fields.TLS = true
+		case "user":
+			fields.Username = true
+		default:
+			return nil, false, fmt.Errorf("unknown field %q", field)
+		}
+	}
+
+	return fields, false, nil
+}
+
+// parse the input into a map[string]string. It should be in the form of
+// "field1=Header-Name1 field2=Header-Name2" (key=vaue pairs, separated by
+// spaces)
+func parseLogHeaders(s string) map[string]string {
+	h := map[string]string{}
+	if s == "" {
+		return h
+	}
+
+	entries := strings.Split(s, " ")
+	for _, entry := range entries {
+		field, hdr, found := strings.Cut(entry, "=")
+		if !found {
+			continue
+		}
+
+		h[field] = hdr
+	}
+
+	return h
+}
@@ -1,9 +1,10 @@
-package main
+package relay
 
 import (
 	"net"
 	"testing"
 
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -36,3 +37,27 @@ func TestSetupAllowedNetworks(t *testing.T) {
 	_, err = setupAllowedNetworks("1.2.3.4/16")
 	require.Error(t, err)
 }
+
+func TestParseReceivedFields(t *testing.T) {
+	t.Parallel()
+
+	fields, none, err := parseReceivedFields("")
+	require.NoError(t, err)
+	assert.Nil(t, fields)
+	assert.False(t, none)
+
+	fields, none, err = parseReceivedFields("none")
+	require.NoError(t, err)
+	assert.Nil(t, fields)
+	assert.True(t, none)
+
+	fields, _, err = parseReceivedFields("helo  user")
+	require.NoError(t, err)
+	assert.Equal(t, &smtpd.ReceivedFields{HeloName: true, Username: true}, fields)
+
+	_, _, err = parseReceivedFields("helo none")
+	require.Error(t, err)
+
+	_, _, err = parseReceivedFields("client_ip port")
+	require.Error(t, err)
+}
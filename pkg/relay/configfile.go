@@ -0,0 +1,432 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of environment variables overriding flags, e.g.
+// SMTPRELAY_REMOTE_HOST for remote_host
+const envPrefix = "SMTPRELAY_"
+
+// structuredKeys maps the keys of structured (YAML) config files, as dotted
+// paths, to the flag they set. Lists are joined with spaces, and maps are
+// turned into key=value pairs separated by spaces.
+var structuredKeys = map[string]string{
+	"hostname":    "hostname",
+	"welcome_msg": "welcome_msg",
+
+	"log.format":          "log_format",
+	"log.level":           "log_level",
+	"log.headers":         "log_header",
+	"log.syslog.addr":     "syslog_addr",
+	"log.syslog.facility": "syslog_facility",
+	"log.syslog.tag":      "syslog_tag",
+
+	"audit.file":     "audit_log",
+	"audit.max_size": "audit_log_max_size",
+	"audit.max_age":  "audit_log_max_age",
+	"audit.backups":  "audit_log_backups",
+
+	"transcripts.dir":      "transcript_dir",
+	"transcripts.sample":   "transcript_sample",
+	"transcripts.networks": "transcript_networks",
+
+	"metrics.listen":        "metrics_listen",
+	"metrics.otlp":          "metrics_otlp",
+	"metrics.otlp_interval": "metrics_otlp_interval",
+
+	"admin.listen": "admin_listen",
+	"admin.token":  "admin_token",
+
+	"process.user":   "user",
+	"process.group":  "group",
+	"process.chroot": "chroot",
+
+	"listen": "listen",
+
+	"tls.cert":           "local_cert",
+	"tls.key":            "local_key",
+	"tls.force":          "local_forcetls",
+	"tls.client_ca":      "local_client_ca",
+	"tls.watch_interval": "local_cert_watch_interval",
+	"tls.min_version":    "local_tls_min_version",
+	"tls.ciphers":        "local_tls_ciphers",
+	"tls.curves":         "local_tls_curves",
+
+	"tls.acme.domains":     "local_acme_domains",
+	"tls.acme.email":       "local_acme_email",
+	"tls.acme.cache_dir":   "local_acme_cache_dir",
+	"tls.acme.directory":   "local_acme_directory",
+	"tls.acme.http_listen": "local_acme_http_listen",
+
+	"limits.max_message_size": "max_message_size",
+	"limits.stream_data":      "stream_data",
+	"limits.data_mode":        "data_mode",
+	"limits.max_connections":  "max_connections",
+	"limits.max_recipients":   "max_recipients",
+	"limits.max_commands":     "max_commands",
+	"limits.max_errors":       "max_errors",
+	"limits.tarpit_after":     "tarpit_after",
+	"limits.tarpit_delay":     "tarpit_delay",
+	"limits.tarpit_max_delay": "tarpit_max_delay",
+
+	"timeouts.read":     "read_timeout",
+	"timeouts.write":    "write_timeout",
+	"timeouts.data":     "data_timeout",
+	"timeouts.session":  "max_session_duration",
+	"timeouts.shutdown": "shutdown_timeout",
+
+	"upstream.delivery":      "delivery",
+	"upstream.host":          "remote_host",
+	"upstream.user":          "remote_user",
+	"upstream.pass":          "remote_pass",
+	"upstream.auth":          "remote_auth",
+	"upstream.sender":        "remote_sender",
+	"upstream.credentials":   "remote_credentials",
+	"upstream.pool_max_idle": "remote_pool_max_idle",
+	"upstream.pool_max_age":  "remote_pool_max_age",
+	"upstream.xclient":       "remote_xclient",
+	"upstream.lmtp_timeout":  "lmtp_timeout",
+
+	"upstream.strategy":        "remote_host_strategy",
+	"upstream.dead_time":       "remote_dead_time",
+	"upstream.health_interval": "remote_health_interval",
+
+	"upstream.dial.ip_preference":  "remote_ip_preference",
+	"upstream.dial.source_address": "remote_source_address",
+	"upstream.dial.timeout":        "remote_dial_timeout",
+	"upstream.dial.fallback_delay": "remote_fallback_delay",
+	"upstream.dial.proxy":          "remote_proxy",
+
+	"upstream.limits.concurrency":        "delivery_concurrency",
+	"upstream.limits.domain_concurrency": "delivery_domain_concurrency",
+	"upstream.limits.domain_rate":        "delivery_domain_rate",
+	"upstream.limits.backoff":            "delivery_backoff",
+	"upstream.limits.backoff_max":        "delivery_backoff_max",
+	"upstream.limits.wait_max":           "delivery_wait_max",
+
+	"upstream.journal_recipients":   "journal_recipients",
+	"upstream.header_rules":         "header_rules",
+	"upstream.trace_headers":        "trace_headers",
+	"upstream.received_header":      "received_header",
+	"upstream.strip_client_headers": "strip_client_headers",
+	"upstream.fix_headers":          "fix_headers",
+	"upstream.mt_priority":          "mt_priority",
+	"upstream.sender_priorities":    "sender_priorities",
+	"upstream.success_dsn":          "success_dsn",
+	"upstream.delivery_notify_url":  "delivery_notify_url",
+	"upstream.reply_map":            "upstream_reply_map",
+	"upstream.aliases":              "aliases",
+
+	"upstream.auto_reply.rules":    "auto_reply",
+	"upstream.auto_reply.interval": "auto_reply_interval",
+
+	"upstream.masquerade":  "sender_masquerade",
+	"upstream.srs.domain":  "srs_domain",
+	"upstream.srs.secrets": "srs_secrets",
+
+	"upstream.webhook.url":     "webhook_url",
+	"upstream.webhook.format":  "webhook_format",
+	"upstream.webhook.secret":  "webhook_secret",
+	"upstream.webhook.timeout": "webhook_timeout",
+	"upstream.webhook.retries": "webhook_retries",
+
+	"upstream.kafka.brokers":        "kafka_brokers",
+	"upstream.kafka.topic":          "kafka_topic",
+	"upstream.kafka.sasl_mechanism": "kafka_sasl_mechanism",
+	"upstream.kafka.user":           "kafka_user",
+	"upstream.kafka.pass":           "kafka_pass",
+	"upstream.kafka.tls":            "kafka_tls",
+	"upstream.kafka.timeout":        "kafka_timeout",
+
+	"upstream.oauth.token_url":     "remote_oauth_token_url",
+	"upstream.oauth.client_id":     "remote_oauth_client_id",
+	"upstream.oauth.client_secret": "remote_oauth_client_secret",
+	"upstream.oauth.refresh_token": "remote_oauth_refresh_token",
+	"upstream.oauth.scopes":        "remote_oauth_scopes",
+
+	"upstream.tls.min_version": "remote_tls_min_version",
+	"upstream.tls.ciphers":     "remote_tls_ciphers",
+	"upstream.tls.curves":      "remote_tls_curves",
+	"upstream.tls.dane":        "remote_dane",
+	"upstream.tls.mta_sts":     "remote_mta_sts",
+
+	"checks.allowed_nets":       "allowed_nets",
+	"checks.nets_refresh":       "allowed_nets_refresh",
+	"checks.trusted_proxies":    "trusted_proxies",
+	"checks.allowed_sender":     "allowed_sender",
+	"checks.allowed_recipients": "allowed_recipients",
+	"checks.denied_recipients":  "denied_recipients",
+	"checks.allowed_users":      "allowed_users",
+	"checks.auth_max_failures":  "auth_max_failures",
+	"checks.auth_failure_delay": "auth_failure_delay",
+	"checks.auth_max_delay":     "auth_max_delay",
+	"checks.auth_lockout":       "auth_lockout",
+	"checks.sender_login_map":   "sender_login_map",
+	"checks.spf_policy":         "spf_policy",
+	"checks.dkim_verify":        "dkim_verify",
+	"checks.dmarc_mode":         "dmarc_mode",
+	"checks.fcrdns_mode":        "fcrdns_mode",
+	"checks.greet_delay":        "greet_delay",
+	"checks.early_talker":       "early_talker_action",
+	"checks.clamav_addr":        "clamav_addr",
+	"checks.clamav_timeout":     "clamav_timeout",
+	"checks.attachment_policy":  "attachment_policy",
+	"checks.policy_rules":       "policy_rules",
+	"checks.dnsbl_lists":        "dnsbl_lists",
+	"checks.dnsbl_threshold":    "dnsbl_threshold",
+	"checks.dnsbl_mode":         "dnsbl_mode",
+	"checks.dnsbl_timeout":      "dnsbl_timeout",
+	"checks.recipient_callout":  "recipient_callout",
+	"checks.callout_timeout":    "recipient_callout_timeout",
+	"checks.verify_commands":    "verify_commands",
+
+	"policy_service.addr":           "policy_service",
+	"policy_service.timeout":        "policy_service_timeout",
+	"policy_service.context":        "policy_service_context",
+	"policy_service.default_action": "policy_service_default_action",
+
+	"ldap.url":           "ldap_url",
+	"ldap.starttls":      "ldap_starttls",
+	"ldap.bind_dn":       "ldap_bind_dn",
+	"ldap.bind_password": "ldap_bind_password",
+	"ldap.base_dn":       "ldap_base_dn",
+	"ldap.user_filter":   "ldap_user_filter",
+	"ldap.group":         "ldap_group",
+	"ldap.pool_size":     "ldap_pool_size",
+	"ldap.timeout":       "ldap_timeout",
+
+	"sql.driver":     "sql_driver",
+	"sql.dsn":        "sql_dsn",
+	"sql.user_query": "sql_user_query",
+	"sql.cache_ttl":  "sql_cache_ttl",
+
+	"auth_http.url":       "auth_http_url",
+	"auth_http.token":     "auth_http_token",
+	"auth_http.timeout":   "auth_http_timeout",
+	"auth_http.cache_ttl": "auth_http_cache_ttl",
+
+	"rate_limits.messages":   "rate_limit_messages",
+	"rate_limits.recipients": "rate_limit_recipients",
+
+	"redis.url":     "redis_url",
+	"redis.timeout": "redis_timeout",
+
+	"dedup.window":      "dedup_window",
+	"dedup.action":      "dedup_action",
+	"dedup.max_entries": "dedup_max_entries",
+
+	"queue.dir":                "queue_dir",
+	"queue.retry_min":          "queue_retry_min",
+	"queue.retry_max":          "queue_retry_max",
+	"queue.max_age":            "queue_max_age",
+	"queue.etrn_domains":       "etrn_domains",
+	"queue.schedule_max_delay": "schedule_max_delay",
+
+	"quarantine.dir":    "quarantine_dir",
+	"quarantine.checks": "quarantine_checks",
+
+	"archive.url":          "archive_url",
+	"archive.endpoint":     "archive_endpoint",
+	"archive.region":       "archive_region",
+	"archive.access_key":   "archive_access_key",
+	"archive.secret_key":   "archive_secret_key",
+	"archive.key_template": "archive_key_template",
+	"archive.max_size":     "archive_max_size",
+}
+
+// isStructuredConfig reports whether the config file is a structured (YAML)
+// one, rather than a flat ini file
+func isStructuredConfig(file string) bool {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return true
+	default:
+		return false
+	}
+}
+
+// applyConfigFile sets the flags from the structured config file, except the
+// ones in skip
+func applyConfigFile(f *flag.FlagSet, file string, skip map[string]string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %w", err)
+	}
+
+	values, err := parseStructuredConfig(data)
+	if err != nil {
+		return fmt.Errorf("invalid config file %q: %w", file, err)
+	}
+
+	for name, value := range values {
+		if _, ok := skip[name]; ok {
+			continue
+		}
+
+		if err := f.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s in %q: %w", value, name, file, err)
+		}
+	}
+
+	return nil
+}
+
+// parseStructuredConfig parses a YAML config file into flag values
+func parseStructuredConfig(data []byte) (map[string]string, error) {
+	var doc map[string]any
+
+	err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&doc)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	values := map[string]string{}
+
+	return values, flattenConfig("", doc, values)
+}
+
+// flattenConfig walks the sections of the config, setting the flag values of
+// the known keys
+func flattenConfig(prefix string, section map[string]any, values map[string]string) error {
+	for key, val := range section {
+		path := prefix + key
+
+		if name, ok := structuredKeys[path]; ok {
+			s, err := flagValue(val)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+
+			values[name] = s
+
+			continue
+		}
+
+		if !isSection(path) {
+			return fmt.Errorf("unknown key %q", path)
+		}
+
+		// sections may be empty, e.g. when all of their keys are commented
+		// out
+		if val == nil {
+			continue
+		}
+
+		sub, ok := val.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected a section", path)
+		}
+
+		if err := flattenConfig(path+".", sub, values); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isSection reports whether the path is a section of known keys
+func isSection(path string) bool {
+	for key := range structuredKeys {
+		if strings.HasPrefix(key, path+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// flagValue formats a config value as a flag value
+func flagValue(val any) (string, error) {
+	switch v := val.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		items := make([]string, 0, len(v))
+
+		for _, item := range v {
+			s, err := listItem(item)
+			if err != nil {
+				return "", err
+			}
+
+			items = append(items, s)
+		}
+
+		return strings.Join(items, " "), nil
+	case map[string]any:
+		pairs := make([]string, 0, len(v))
+
+		for key, item := range v {
+			s, err := listItem(item)
+			if err != nil {
+				return "", err
+			}
+
+			pairs = append(pairs, key+"="+s)
+		}
+
+		// map order is random, keep the value stable
+		slices.Sort(pairs)
+
+		return strings.Join(pairs, " "), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// listItem formats an item of a list or map config value, which are
+// separated by spaces in flag values
+func listItem(val any) (string, error) {
+	switch val.(type) {
+	case []any, map[string]any:
+		return "", errors.New("nested lists and maps aren't supported")
+	}
+
+	s, _ := flagValue(val)
+	if strings.ContainsAny(s, " \t") {
+		return "", fmt.Errorf("list item %q must not contain spaces", s)
+	}
+
+	return s, nil
+}
+
+// applyEnv sets the flags from their SMTPRELAY_* environment variables,
+// except the ones in skip
+func applyEnv(f *flag.FlagSet, skip map[string]string) error {
+	var err error
+
+	// only the config flags, not the ones of iniflags
+	known := flag.NewFlagSet("", flag.ContinueOnError)
+	registerFlags(known, &config{})
+
+	f.VisitAll(func(fl *flag.Flag) {
+		if _, ok := skip[fl.Name]; ok || err != nil || known.Lookup(fl.Name) == nil {
+			return
+		}
+
+		name := envPrefix + strings.ToUpper(fl.Name)
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+
+		if serr := f.Set(fl.Name, value); serr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, name, serr)
+		}
+	})
+
+	return err
+}
@@ -0,0 +1,125 @@
+package relay
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStructuredConfig(t *testing.T) {
+	t.Parallel()
+
+	values, err := parseStructuredConfig([]byte(`
+hostname: relay.example.com
+welcome_msg: Hello there
+listen:
+  - 127.0.0.1:2525
+  - starttls://127.0.0.1:587
+log:
+  headers:
+    message_id: Message-Id
+    subject: Subject
+checks:
+  dkim_verify: true
+rate_limits:
+  messages:
+    ip: 60
+timeouts:
+  data:
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"hostname":            "relay.example.com",
+		"welcome_msg":         "Hello there",
+		"listen":              "127.0.0.1:2525 starttls://127.0.0.1:587",
+		"log_header":          "message_id=Message-Id subject=Subject",
+		"dkim_verify":         "true",
+		"rate_limit_messages": "ip=60",
+		"data_timeout":        "",
+	}, values)
+
+	values, err = parseStructuredConfig(nil)
+	require.NoError(t, err)
+	assert.Empty(t, values)
+
+	for _, doc := range []string{
+		"unknown: true",
+		"checks:\n  unknown: true",
+		"checks: true",
+		"listen:\n  - [127.0.0.1:2525]",
+		"listen:\n  - 127.0.0.1:2525 127.0.0.1:2526",
+		"listen: [",
+	} {
+		_, err := parseStructuredConfig([]byte(doc))
+		assert.Error(t, err, doc)
+	}
+}
+
+func TestReadStructuredConfig(t *testing.T) {
+	t.Parallel()
+
+	// the example config must be valid
+	cfg, err := readConfig("../../smtprelay.yaml", map[string]string{"hostname": "relay.example.com"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "relay.example.com", cfg.hostName)
+	assert.Equal(t, "127.0.0.1:25 [::1]:25", cfg.listen)
+	assert.Equal(t, "smtp.gmail.com:587", cfg.remoteHost)
+	assert.Equal(t, 5*time.Minute, cfg.dataTimeout)
+	assert.Len(t, cfg.allowedNets, 2)
+
+	file := filepath.Join(t.TempDir(), "smtprelay.yml")
+	require.NoError(t, os.WriteFile(file, []byte("limits:\n  max_recipients: many\n"), 0o600))
+
+	_, err = readConfig(file, nil)
+	require.Error(t, err)
+}
+
+// loadConfig parses the command line with the global flag set
+//
+//nolint:paralleltest
+func TestLoadConfigYAML(t *testing.T) {
+	args, flags := os.Args, flag.CommandLine
+	t.Cleanup(func() { os.Args, flag.CommandLine = args, flags })
+
+	// -config is registered by iniflags, which reads the ini files with it
+	flag.CommandLine = flag.NewFlagSet("smtprelay", flag.ContinueOnError)
+	flag.CommandLine.Var(flags.Lookup("config").Value, "config", "")
+
+	os.Args = []string{"smtprelay", "-config", "../../smtprelay.yaml", "-hostname", "relay.example.com"}
+
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+
+	assert.Equal(t, "relay.example.com", cfg.hostName)
+	assert.Equal(t, "smtp.gmail.com:587", cfg.remoteHost)
+	assert.Equal(t, 5*time.Minute, cfg.dataTimeout)
+}
+
+//nolint:paralleltest
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("SMTPRELAY_REMOTE_HOST", "smtp.example.com:587")
+	t.Setenv("SMTPRELAY_MAX_RECIPIENTS", "10")
+	t.Setenv("SMTPRELAY_ALLOWED_SENDER", "^.*@example\\.com$")
+
+	cfg, err := readConfig("../../smtprelay.yaml", map[string]string{"max_recipients": "20"})
+	require.NoError(t, err)
+
+	// environment variables override the config file
+	assert.Equal(t, "smtp.example.com:587", cfg.remoteHost)
+	assert.Equal(t, "^.*@example\\.com$", cfg.allowedSender)
+
+	// but not the command line
+	assert.Equal(t, 20, cfg.maxRecipients)
+
+	t.Setenv("SMTPRELAY_MAX_RECIPIENTS", "many")
+
+	_, err = readConfig("../../smtprelay.yaml", nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,120 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/evidentiq/smtprelay/v2/internal/auth"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// upstreamCredentials are the username and password used to authenticate on
+// the upstream server
+type upstreamCredentials struct {
+	username string
+	password string
+}
+
+// loadCredentialsFile reads the per-sender upstream credentials from file.
+// Each line should be in the form "key username password", where key is
+// either the username of an authenticated client, or a sender domain prefixed
+// with "@" (e.g. "@example.com"). Empty lines and lines starting with "#" are
+// ignored.
+func loadCredentialsFile(file string) (map[string]upstreamCredentials, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds := map[string]upstreamCredentials{}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("line %d: expected \"key username password\"", n)
+		}
+
+		creds[strings.ToLower(parts[0])] = upstreamCredentials{
+			username: parts[1],
+			password: parts[2],
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
+
+// credentialsKey returns the key of the upstream credentials to use for a
+// message sent by the given authenticated user (empty if the client didn't
+// authenticate) and sender. The authenticated user takes precedence over the
+// sender domain. An empty key means the default remote_user/remote_pass.
+func credentialsKey(creds map[string]upstreamCredentials, authUser, sender string) string {
+	if authUser != "" {
+		if key := strings.ToLower(authUser); hasKey(creds, key) {
+			return key
+		}
+	}
+
+	if idx := strings.LastIndex(sender, "@"); idx != -1 {
+		if key := strings.ToLower(sender[idx:]); hasKey(creds, key) {
+			return key
+		}
+	}
+
+	return ""
+}
+
+func hasKey(creds map[string]upstreamCredentials, key string) bool {
+	_, ok := creds[key]
+	return ok
+}
+
+// upstreamAuth returns the upstream credentials for the given key, falling
+// back to remote_user/remote_pass if there are none
+func (cfg *config) upstreamAuth(key string) upstreamCredentials {
+	if c, ok := cfg.remoteCredentials[key]; ok {
+		return c
+	}
+
+	return upstreamCredentials{username: cfg.remoteUser, password: cfg.remotePass}
+}
+
+// oauthTokenSource returns the source of the access tokens used with XOAUTH2
+// and OAUTHBEARER: with a refresh token, e.g. for Google accounts, or with the client
+// credentials flow, e.g. for Microsoft 365 applications
+func (cfg *config) oauthTokenSource() (*auth.TokenSource, error) {
+	if cfg.remoteOAuthURL == "" || cfg.remoteOAuthID == "" {
+		return nil, fmt.Errorf("remote_auth %s needs remote_oauth_token_url and remote_oauth_client_id", cfg.remoteAuth)
+	}
+
+	scopes := splitstr(cfg.remoteOAuthScopes, ' ')
+
+	if cfg.remoteOAuthToken != "" {
+		return auth.RefreshToken(&oauth2.Config{
+			ClientID:     cfg.remoteOAuthID,
+			ClientSecret: cfg.remoteOAuthSecret,
+			Endpoint:     oauth2.Endpoint{TokenURL: cfg.remoteOAuthURL},
+			Scopes:       scopes,
+		}, cfg.remoteOAuthToken), nil
+	}
+
+	return auth.ClientCredentials(&clientcredentials.Config{
+		ClientID:     cfg.remoteOAuthID,
+		ClientSecret: cfg.remoteOAuthSecret,
+		TokenURL:     cfg.remoteOAuthURL,
+		Scopes:       scopes,
+	}), nil
+}
@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadCredentialsFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "credentials")
+	err := os.WriteFile(file, []byte(`
+# tenants
+alice     tenant-a@upstream.example.com secretA
+@Example.com tenant-b  secretB
+`), 0o600)
+	require.NoError(t, err)
+
+	creds, err := loadCredentialsFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]upstreamCredentials{
+		"alice":        {username: "tenant-a@upstream.example.com", password: "secretA"},
+		"@example.com": {username: "tenant-b", password: "secretB"},
+	}, creds)
+
+	invalid := filepath.Join(dir, "invalid")
+	err = os.WriteFile(invalid, []byte("alice tenant-a\n"), 0o600)
+	require.NoError(t, err)
+
+	_, err = loadCredentialsFile(invalid)
+	require.EqualError(t, err, `line 1: expected "key username password"`)
+
+	_, err = loadCredentialsFile(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func TestCredentialsKey(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{
+		remoteUser: "default",
+		remotePass: "defaultpass",
+		remoteCredentials: map[string]upstreamCredentials{
+			"alice":        {username: "a", password: "apass"},
+			"@example.com": {username: "b", password: "bpass"},
+		},
+	}
+
+	testCases := []struct {
+		authUser string
+		sender   string
+		key      string
+		username string
+	}{
+		{"Alice", "bob@example.com", "alice", "a"},
+		{"carol", "carol@EXAMPLE.com", "@example.com", "b"},
+		{"", "bob@example.com", "@example.com", "b"},
+		{"", "bob@example.org", "", "default"},
+		{"", "", "", "default"},
+	}
+
+	for _, tc := range testCases {
+		key := credentialsKey(cfg.remoteCredentials, tc.authUser, tc.sender)
+		assert.Equal(t, tc.key, key, tc.authUser+" "+tc.sender)
+		assert.Equal(t, tc.username, cfg.upstreamAuth(key).username)
+	}
+}
@@ -0,0 +1,418 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DANE policies
+const (
+	danePolicyOpportunistic = "opportunistic" // enforce TLSA records when published
+	danePolicyRequired      = "required"      // fail deliveries to hosts without TLSA records
+)
+
+// TLSA certificate usages supported for SMTP (RFC 7672 section 3.1)
+const (
+	tlsaUsageDANETA = 2 // trust anchor, the leaf must chain to it
+	tlsaUsageDANEEE = 3 // the leaf itself, without any other checks
+)
+
+// tlsaType is the DNS type of TLSA records (RFC 6698)
+const tlsaType = dnsmessage.Type(52)
+
+// how long to wait for the DNS resolver
+const daneLookupTimeout = 10 * time.Second
+
+// tlsaRecord is a TLSA record (RFC 6698)
+type tlsaRecord struct {
+	usage        uint8
+	selector     uint8
+	matchingType uint8
+	data         []byte
+}
+
+// usable reports whether the record can be used to authenticate SMTP
+// servers: PKIX usages aren't, as there's no agreed set of CAs for SMTP
+func (r tlsaRecord) usable() bool {
+	return (r.usage == tlsaUsageDANETA || r.usage == tlsaUsageDANEEE) &&
+		r.selector <= 1 && r.matchingType <= 2
+}
+
+// matches reports whether the record matches the certificate
+func (r tlsaRecord) matches(cert *x509.Certificate) bool {
+	data := cert.Raw
+	if r.selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+
+	switch r.matchingType {
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+
+	return bytes.Equal(data, r.data)
+}
+
+// daneVerifier authenticates the upstream hosts with their TLSA records
+// (RFC 7672), rather than with the system CAs. The records are only trusted
+// if the resolver validated them with DNSSEC, so it must be a validating
+// resolver on a trusted network, e.g. a local unbound.
+type daneVerifier struct {
+	policy string
+
+	// lookupTLSA overrides the TLSA lookups - for tests
+	lookupTLSA func(ctx context.Context, name string) ([]tlsaRecord, error)
+}
+
+// newDANEVerifier returns nil if policy is empty, in which case the upstream
+// certificates are verified with the system CAs
+func newDANEVerifier(policy string) (*daneVerifier, error) {
+	switch policy {
+	case "":
+		return nil, nil
+	case danePolicyOpportunistic, danePolicyRequired:
+	default:
+		return nil, fmt.Errorf("unknown DANE policy %q", policy)
+	}
+
+	return &daneVerifier{policy: policy, lookupTLSA: lookupTLSA}, nil
+}
+
+// records returns the usable TLSA records of the upstream host, nil if it has
+// none, in which case the connection is authenticated as without DANE. It
+// fails if there are none and the policy requires them.
+func (d *daneVerifier) records(host string) ([]tlsaRecord, error) {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var usable []tlsaRecord
+
+	// IP addresses have no TLSA records
+	if net.ParseIP(hostname) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), daneLookupTimeout)
+		defer cancel()
+
+		records, err := d.lookupTLSA(ctx, "_"+port+"._tcp."+strings.TrimSuffix(hostname, ".")+".")
+		if err != nil {
+			return nil, fmt.Errorf("dane: %w", err)
+		}
+
+		for _, r := range records {
+			if r.usable() {
+				usable = append(usable, r)
+			}
+		}
+	}
+
+	if len(usable) == 0 && d.policy == danePolicyRequired {
+		return nil, fmt.Errorf("dane: no usable TLSA records for %s", host)
+	}
+
+	return usable, nil
+}
+
+// tlsConfig returns the TLS config authenticating the host with the records:
+// the system CAs and expiry dates don't matter for DANE-EE records, and DANE-TA
+// records replace the system CAs.
+func (d *daneVerifier) tlsConfig(hostname string, records []tlsaRecord) *tls.Config {
+	//nolint:gosec // the certificate is verified against the TLSA records
+	return &tls.Config{
+		ServerName:         hostname,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyDANE(cs.PeerCertificates, hostname, records)
+		},
+	}
+}
+
+// verifyDANE checks that one of the records matches the certificate chain
+func verifyDANE(certs []*x509.Certificate, hostname string, records []tlsaRecord) error {
+	if len(certs) == 0 {
+		return errors.New("dane: no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	for _, r := range records {
+		if r.usage == tlsaUsageDANEEE {
+			if r.matches(certs[0]) {
+				return nil
+			}
+
+			continue
+		}
+
+		// DANE-TA: the trust anchor is sent by the server with the chain
+		for _, ta := range certs[1:] {
+			if !r.matches(ta) {
+				continue
+			}
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ta)
+
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				DNSName:       hostname,
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			if err == nil {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("dane: no TLSA record matches the certificate")
+}
+
+// lookupTLSA queries the TLSA records of name from the system resolvers,
+// which must validate them: records whose authenticity the resolver didn't
+// check (without the AD bit) are ignored, as they could be spoofed.
+func lookupTLSA(ctx context.Context, name string) ([]tlsaRecord, error) {
+	var err error
+
+	for _, server := range systemResolvers() {
+		var records []tlsaRecord
+
+		records, err = queryTLSA(ctx, server, name)
+		if err == nil {
+			return records, nil
+		}
+	}
+
+	return nil, err
+}
+
+// systemResolvers returns the nameservers of /etc/resolv.conf
+func systemResolvers() []string {
+	servers := []string{}
+
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+
+	if len(servers) == 0 {
+		servers = append(servers, "127.0.0.1:53")
+	}
+
+	return servers
+}
+
+// queryTLSA sends the TLSA query to the server over UDP, and again over TCP
+// if the response was truncated
+func queryTLSA(ctx context.Context, server, name string) ([]tlsaRecord, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+
+	// the AD bit asks for the validation result (RFC 6840), and the DO bit
+	// for DNSSEC aware responses
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               binary.BigEndian.Uint16(id[:]),
+		RecursionDesired: true,
+		AuthenticData:    true,
+	})
+	b.EnableCompression()
+
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+
+	if err := b.Question(dnsmessage.Question{Name: qname, Type: tlsaType, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, true); err != nil {
+		return nil, err
+	}
+
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchangeDNS(ctx, "udp", server, query)
+	if err != nil {
+		return nil, err
+	}
+
+	records, truncated, err := parseTLSAResponse(resp, binary.BigEndian.Uint16(id[:]))
+	if !truncated {
+		return records, err
+	}
+
+	if resp, err = exchangeDNS(ctx, "tcp", server, query); err != nil {
+		return nil, err
+	}
+
+	records, _, err = parseTLSAResponse(resp, binary.BigEndian.Uint16(id[:]))
+
+	return records, err
+}
+
+// exchangeDNS sends the query and returns the response. Over TCP, messages
+// are prefixed with their length.
+func exchangeDNS(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 65535)
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf[:n], nil
+	}
+
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// parseTLSAResponse returns the TLSA records of the response, nil if they
+// weren't validated by the resolver
+func parseTLSAResponse(resp []byte, id uint16) (records []tlsaRecord, truncated bool, err error) {
+	var p dnsmessage.Parser
+
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if h.ID != id || !h.Response {
+		return nil, false, errors.New("unexpected DNS response")
+	}
+
+	if h.Truncated {
+		return nil, true, nil
+	}
+
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("DNS lookup failed: %s", h.RCode)
+	}
+
+	if !h.AuthenticData {
+		return nil, false, nil
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, false, err
+	}
+
+	for {
+		rh, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			return records, false, nil
+		}
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		// CNAMEs are followed by the resolver
+		if rh.Type != tlsaType {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, false, err
+			}
+
+			continue
+		}
+
+		r, err := p.UnknownResource()
+		if err != nil {
+			return nil, false, err
+		}
+
+		if len(r.Data) < 4 {
+			return nil, false, errors.New("malformed TLSA record")
+		}
+
+		records = append(records, tlsaRecord{
+			usage:        r.Data[0],
+			selector:     r.Data[1],
+			matchingType: r.Data[2],
+			data:         r.Data[3:],
+		})
+	}
+}
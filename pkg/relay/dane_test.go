@@ -0,0 +1,216 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// issueTestCert returns a certificate for the DNS name, signed by the parent,
+// or self-signed if parent is nil
+func issueTestCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert, key
+}
+
+func TestVerifyDANE(t *testing.T) {
+	t.Parallel()
+
+	ca, caKey := issueTestCert(t, "Test CA", nil, nil)
+	leaf, _ := issueTestCert(t, "mx.example.com", ca, caKey)
+	other, _ := issueTestCert(t, "mx.example.com", ca, caKey)
+
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	ee := tlsaRecord{usage: tlsaUsageDANEEE, selector: 1, matchingType: 1, data: spki[:]}
+	ta := tlsaRecord{usage: tlsaUsageDANETA, selector: 0, matchingType: 0, data: ca.Raw}
+
+	chain := []*x509.Certificate{leaf, ca}
+
+	require.NoError(t, verifyDANE(chain, "mx.example.com", []tlsaRecord{ee}))
+	require.NoError(t, verifyDANE(chain, "mx.example.com", []tlsaRecord{ta}))
+
+	// DANE-EE records don't check the name
+	require.NoError(t, verifyDANE(chain, "mx2.example.com", []tlsaRecord{ee}))
+	require.Error(t, verifyDANE(chain, "mx2.example.com", []tlsaRecord{ta}))
+
+	require.Error(t, verifyDANE([]*x509.Certificate{other, ca}, "mx.example.com", []tlsaRecord{ee}))
+
+	// the trust anchor must be sent by the server
+	require.Error(t, verifyDANE([]*x509.Certificate{leaf}, "mx.example.com", []tlsaRecord{ta}))
+
+	require.Error(t, verifyDANE(nil, "mx.example.com", []tlsaRecord{ee}))
+}
+
+func TestDANERecords(t *testing.T) {
+	t.Parallel()
+
+	_, err := newDANEVerifier("bogus")
+	require.Error(t, err)
+
+	d, err := newDANEVerifier("")
+	require.NoError(t, err)
+	assert.Nil(t, d)
+
+	usable := tlsaRecord{usage: tlsaUsageDANEEE, selector: 1, matchingType: 1, data: []byte{1}}
+	pkixEE := tlsaRecord{usage: 1, selector: 1, matchingType: 1, data: []byte{1}}
+
+	lookups := map[string][]tlsaRecord{
+		"_25._tcp.mx.example.com.":    {pkixEE, usable},
+		"_25._tcp.pkix.example.com.":  {pkixEE},
+		"_587._tcp.mx.example.com.":   nil,
+		"_25._tcp.error.example.com.": nil,
+	}
+
+	for _, policy := range []string{danePolicyOpportunistic, danePolicyRequired} {
+		d, err = newDANEVerifier(policy)
+		require.NoError(t, err)
+
+		d.lookupTLSA = func(_ context.Context, name string) ([]tlsaRecord, error) {
+			if name == "_25._tcp.error.example.com." {
+				return nil, errors.New("timeout")
+			}
+
+			return lookups[name], nil
+		}
+
+		records, err := d.records("mx.example.com:25")
+		require.NoError(t, err)
+		assert.Equal(t, []tlsaRecord{usable}, records)
+
+		_, err = d.records("error.example.com:25")
+		require.Error(t, err)
+
+		for _, host := range []string{"pkix.example.com:25", "mx.example.com:587", "127.0.0.1:25"} {
+			records, err = d.records(host)
+			if policy == danePolicyRequired {
+				require.Error(t, err, host)
+			} else {
+				require.NoError(t, err, host)
+				assert.Nil(t, records, host)
+			}
+		}
+	}
+}
+
+func TestSendMailDANE(t *testing.T) {
+	t.Parallel()
+
+	d, err := newDANEVerifier(danePolicyOpportunistic)
+	require.NoError(t, err)
+
+	d.lookupTLSA = func(_ context.Context, _ string) ([]tlsaRecord, error) {
+		return []tlsaRecord{{usage: tlsaUsageDANEEE, selector: 1, matchingType: 1, data: []byte{1}}}, nil
+	}
+
+	u := startFakeUpstream(t)
+
+	// IP addresses have no TLSA records
+	_, port, err := net.SplitHostPort(u.addr)
+	require.NoError(t, err)
+
+	out := &outbound{Host: "localhost:" + port, Sender: "bob@example.com", Recipients: []string{"alice@example.com"}}
+
+	// TLS is mandatory with TLSA records
+	err = sendMail(&config{dane: d}, out, []byte("hello\r\n"))
+	require.ErrorContains(t, err, "doesn't support STARTTLS")
+
+	_, msgs := u.received()
+	assert.Empty(t, msgs)
+}
+
+// tlsaResponse builds the response to a TLSA query
+func tlsaResponse(t *testing.T, id uint16, rcode dnsmessage.RCode, validated bool, records ...tlsaRecord) []byte {
+	t.Helper()
+
+	name := dnsmessage.MustNewName("_25._tcp.mx.example.com.")
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:            id,
+		Response:      true,
+		RCode:         rcode,
+		AuthenticData: validated,
+	})
+
+	require.NoError(t, b.StartQuestions())
+	require.NoError(t, b.Question(dnsmessage.Question{Name: name, Type: tlsaType, Class: dnsmessage.ClassINET}))
+	require.NoError(t, b.StartAnswers())
+
+	for _, r := range records {
+		data := append([]byte{r.usage, r.selector, r.matchingType}, r.data...)
+		require.NoError(t, b.UnknownResource(
+			dnsmessage.ResourceHeader{Name: name, Type: tlsaType, Class: dnsmessage.ClassINET, TTL: 300},
+			dnsmessage.UnknownResource{Type: tlsaType, Data: data},
+		))
+	}
+
+	resp, err := b.Finish()
+	require.NoError(t, err)
+
+	return resp
+}
+
+func TestParseTLSAResponse(t *testing.T) {
+	t.Parallel()
+
+	r := tlsaRecord{usage: tlsaUsageDANEEE, selector: 1, matchingType: 1, data: bytes.Repeat([]byte{0xab}, 32)}
+
+	records, truncated, err := parseTLSAResponse(tlsaResponse(t, 42, dnsmessage.RCodeSuccess, true, r), 42)
+	require.NoError(t, err)
+	assert.False(t, truncated)
+	assert.Equal(t, []tlsaRecord{r}, records)
+
+	// not validated with DNSSEC
+	records, _, err = parseTLSAResponse(tlsaResponse(t, 42, dnsmessage.RCodeSuccess, false, r), 42)
+	require.NoError(t, err)
+	assert.Nil(t, records)
+
+	records, _, err = parseTLSAResponse(tlsaResponse(t, 42, dnsmessage.RCodeNameError, true), 42)
+	require.NoError(t, err)
+	assert.Nil(t, records)
+
+	_, _, err = parseTLSAResponse(tlsaResponse(t, 42, dnsmessage.RCodeServerFailure, false), 42)
+	require.Error(t, err)
+
+	_, _, err = parseTLSAResponse(tlsaResponse(t, 42, dnsmessage.RCodeSuccess, true, r), 43)
+	require.Error(t, err)
+}
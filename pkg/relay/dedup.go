@@ -0,0 +1,282 @@
+package relay
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/redis/go-redis/v9"
+)
+
+// Actions taken on duplicate messages
+const (
+	dedupReject = "reject" // reject them with a permanent error
+	dedupDrop   = "drop"   // accept them without delivering them
+
+	// defer the ones whose first copy is still being delivered, which can't
+	// be configured
+	dedupDefer = "defer"
+)
+
+// Results of deduplicator.claim
+const (
+	dedupClaimed  = iota // the key wasn't recorded, it now is as in flight
+	dedupInFlight        // the message is being delivered by another session
+	dedupSeen            // the message was already accepted
+)
+
+const (
+	// prefix of the keys of the Message-IDs kept in Redis
+	dedupRedisPrefix = "smtprelay:dedup:"
+
+	// value of the Redis keys of the messages in flight, and how long they
+	// live at most, so that a relay instance stopping during the delivery
+	// doesn't defer the message for the whole window
+	dedupRedisPending    = "pending"
+	dedupRedisPendingTTL = 10 * time.Minute
+
+	// max attempts to claim a key in Redis, as it may expire while checked
+	dedupRedisAttempts = 3
+)
+
+var (
+	errDuplicateMessage  = &smtpd.Error{Code: 554, EnhancedCode: "5.7.0", Msg: "Duplicate message, already accepted"}
+	errDuplicateInFlight = &smtpd.Error{Code: 451, EnhancedCode: "4.7.0", Msg: "Duplicate message being delivered, try again later"}
+)
+
+// deduplicator remembers the Message-IDs of the messages accepted from each
+// sender for a while, to drop or reject the ones submitted twice. They're kept
+// in Redis if it's configured, so that duplicates submitted to another relay
+// instance are caught too.
+type deduplicator struct {
+	window     time.Duration
+	action     string
+	maxEntries int           // max Message-IDs kept in memory
+	redis      *redis.Client // nil to keep the Message-IDs in memory
+
+	// now overrides the current time - for tests
+	now func() time.Time
+
+	mu    sync.Mutex
+	seen  map[string]*list.Element // of *dedupEntry, by key
+	order *list.List               // of *dedupEntry, oldest first
+
+	logger *slog.Logger
+}
+
+type dedupEntry struct {
+	key      string
+	expires  time.Time
+	inFlight bool // until confirm
+}
+
+// newDeduplicator returns nil if window isn't positive. Duplicates are dropped
+// or rejected depending on action, and at most maxEntries Message-IDs are kept
+// in memory, the oldest being forgotten first, unless rdb isn't nil.
+func newDeduplicator(window time.Duration, action string, maxEntries int, rdb *redis.Client) (*deduplicator, error) {
+	if window <= 0 {
+		return nil, nil
+	}
+
+	if action != dedupReject && action != dedupDrop {
+		return nil, fmt.Errorf("unknown action %q", action)
+	}
+
+	if maxEntries <= 0 {
+		return nil, fmt.Errorf("invalid max entries %d, expected a positive number", maxEntries)
+	}
+
+	return &deduplicator{
+		window:     window,
+		action:     action,
+		maxEntries: maxEntries,
+		redis:      rdb,
+		now:        time.Now,
+		seen:       map[string]*list.Element{},
+		order:      list.New(),
+		logger:     slog.Default().With(slog.String("component", "dedup")),
+	}, nil
+}
+
+// dedupKey returns the key of a message from the sender with the Message-ID,
+// so that a sender can't have the messages of others dropped by reusing their
+// Message-IDs
+func dedupKey(sender, msgID string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(sender) + "\x00" + msgID))
+	return hex.EncodeToString(sum[:])
+}
+
+// claim records the key as in flight, unless it was already recorded within
+// the window, and returns dedupClaimed, dedupInFlight or dedupSeen. Keys are
+// claimed if Redis fails, rather than dropping all the messages. Claimed keys
+// are then confirmed once their message is accepted, or released.
+func (d *deduplicator) claim(ctx context.Context, key string) int {
+	if d.redis != nil {
+		return d.claimShared(ctx, key)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+
+	// all the entries live for the same window, so the expired ones are the
+	// oldest
+	for e := d.order.Front(); e != nil && !e.Value.(*dedupEntry).expires.After(now); e = d.order.Front() {
+		d.remove(e)
+	}
+
+	if e, ok := d.seen[key]; ok {
+		if e.Value.(*dedupEntry).inFlight {
+			return dedupInFlight
+		}
+
+		return dedupSeen
+	}
+
+	if d.order.Len() >= d.maxEntries {
+		d.remove(d.order.Front())
+	}
+
+	d.seen[key] = d.order.PushBack(&dedupEntry{key: key, expires: now.Add(d.window), inFlight: true})
+
+	return dedupClaimed
+}
+
+// claimShared is claim with the keys kept in Redis
+func (d *deduplicator) claimShared(ctx context.Context, key string) int {
+	ttl := min(d.window, dedupRedisPendingTTL)
+
+	// the key may expire between SET NX and GET, it's then claimed again
+	for range dedupRedisAttempts {
+		claimed, err := d.redis.SetNX(ctx, dedupRedisPrefix+key, dedupRedisPending, ttl).Result()
+		if err != nil {
+			d.logger.WarnContext(ctx, "shared duplicate check failed", slog.Any("error", err))
+			return dedupClaimed
+		}
+
+		// the key isn't set if it exists already
+		if claimed {
+			return dedupClaimed
+		}
+
+		value, err := d.redis.Get(ctx, dedupRedisPrefix+key).Result()
+		switch {
+		case errors.Is(err, redis.Nil):
+			continue
+		case err != nil:
+			d.logger.WarnContext(ctx, "shared duplicate check failed", slog.Any("error", err))
+			return dedupClaimed
+		case value == dedupRedisPending:
+			return dedupInFlight
+		default:
+			return dedupSeen
+		}
+	}
+
+	// the key keeps expiring
+	return dedupClaimed
+}
+
+// confirm records the claimed key as accepted, for the rest of the window
+func (d *deduplicator) confirm(ctx context.Context, key string) {
+	if d.redis != nil {
+		if err := d.redis.Set(ctx, dedupRedisPrefix+key, "1", d.window).Err(); err != nil {
+			d.logger.WarnContext(ctx, "could not confirm shared Message-ID", slog.Any("error", err))
+		}
+
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.seen[key]; ok {
+		e.Value.(*dedupEntry).inFlight = false
+	}
+}
+
+// release forgets the claimed key, so the message can be submitted again
+func (d *deduplicator) release(ctx context.Context, key string) {
+	if d.redis != nil {
+		if err := d.redis.Del(ctx, dedupRedisPrefix+key).Err(); err != nil {
+			d.logger.WarnContext(ctx, "could not release shared Message-ID", slog.Any("error", err))
+		}
+
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.seen[key]; ok {
+		d.remove(e)
+	}
+}
+
+// remove deletes the entry. d.mu must be held.
+func (d *deduplicator) remove(e *list.Element) {
+	delete(d.seen, e.Value.(*dedupEntry).key)
+	d.order.Remove(e)
+}
+
+// dedupStage drops or rejects the messages whose Message-ID was already
+// accepted from the same sender within dedup_window. The ones whose Message-ID
+// is still being delivered are deferred: they're duplicates only if that
+// delivery succeeds. Messages without a Message-ID aren't checked.
+func (r *relay) dedupStage(next smtpd.Handler) smtpd.Handler {
+	return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+		d := r.shared.dedup
+		msgID := messageID(env.Header)
+
+		if d == nil || msgID == "" {
+			return next(ctx, peer, env)
+		}
+
+		key := dedupKey(env.Sender, msgID)
+
+		if claim := d.claim(ctx, key); claim != dedupClaimed {
+			action := d.action
+			if claim == dedupInFlight {
+				action = dedupDefer
+			}
+
+			duplicatesCounter.WithLabelValues(action).Inc()
+
+			d.logger.WarnContext(ctx, "duplicate message",
+				slog.String("uuid", messageUUID(ctx)),
+				slog.String("message_id", msgID),
+				slog.String("from", env.Sender),
+				slog.Any("to", env.Recipients),
+				slog.String("action", action))
+
+			switch {
+			case claim == dedupInFlight:
+				return observeErr(ctx, errDuplicateInFlight)
+			case d.action == dedupDrop:
+				return nil
+			default:
+				return observeErr(ctx, errDuplicateMessage)
+			}
+		}
+
+		err := next(ctx, peer, env)
+		if err != nil {
+			// the message wasn't accepted, so its retries aren't duplicates
+			d.release(ctx, key)
+			return err
+		}
+
+		d.confirm(ctx, key)
+
+		return nil
+	}
+}
@@ -0,0 +1,199 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDeduplicator(t *testing.T) {
+	t.Parallel()
+
+	d, err := newDeduplicator(0, "bogus", 0, nil)
+	require.NoError(t, err)
+	assert.Nil(t, d)
+
+	_, err = newDeduplicator(time.Minute, "bogus", 10, nil)
+	require.Error(t, err)
+
+	_, err = newDeduplicator(time.Minute, dedupReject, 0, nil)
+	require.Error(t, err)
+
+	d, err = newDeduplicator(time.Minute, dedupReject, 10, nil)
+	require.NoError(t, err)
+	assert.Equal(t, dedupReject, d.action)
+}
+
+func TestDedupKey(t *testing.T) {
+	t.Parallel()
+
+	key := dedupKey("Bob@example.com", "1@example.com")
+	assert.Len(t, key, 64)
+	assert.Equal(t, key, dedupKey("bob@example.com", "1@example.com"))
+	assert.NotEqual(t, key, dedupKey("alice@example.com", "1@example.com"))
+	assert.NotEqual(t, key, dedupKey("bob@example.com", "2@example.com"))
+}
+
+func TestDeduplicator(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	d, err := newDeduplicator(time.Minute, dedupDrop, 2, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	assert.Equal(t, dedupClaimed, d.claim(ctx, "a"))
+	assert.Equal(t, dedupInFlight, d.claim(ctx, "a"))
+
+	// released keys can be claimed again
+	d.release(ctx, "a")
+	assert.Equal(t, dedupClaimed, d.claim(ctx, "a"))
+
+	// confirmed keys are duplicates
+	d.confirm(ctx, "a")
+	assert.Equal(t, dedupSeen, d.claim(ctx, "a"))
+
+	// keys are forgotten after the window
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, dedupClaimed, d.claim(ctx, "b"))
+	d.confirm(ctx, "b")
+
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, dedupClaimed, d.claim(ctx, "a"))
+	assert.Equal(t, dedupSeen, d.claim(ctx, "b"))
+
+	// the oldest keys are forgotten first when full
+	assert.Equal(t, dedupClaimed, d.claim(ctx, "c"))
+	assert.Len(t, d.seen, 2)
+	assert.Equal(t, dedupClaimed, d.claim(ctx, "b"))
+	assert.Equal(t, dedupInFlight, d.claim(ctx, "c"))
+}
+
+func TestDedupStage(t *testing.T) {
+	t.Parallel()
+
+	send := func(r *relay, data string) error {
+		header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(data))).ReadMIMEHeader()
+		require.NoError(t, err)
+
+		peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345}}
+		env := smtpd.Envelope{
+			Sender:     "alice@example.com",
+			Recipients: []string{"bob@example.com"},
+			Header:     header,
+			Data:       []byte(data),
+		}
+
+		return r.mailHandler()(context.Background(), peer, env)
+	}
+
+	dedupRelay := func(upstream, action string) *relay {
+		d, err := newDeduplicator(time.Minute, action, 10, nil)
+		require.NoError(t, err)
+
+		r, err := newRelay(newConfigStore(&config{remoteHost: upstream}),
+			listenerConfig{scheme: schemeTCP, address: "127.0.0.1:2525"}, &relayShared{dedup: d})
+		require.NoError(t, err)
+
+		return r
+	}
+
+	msg := "Message-Id: <1@example.com>\r\nSubject: hi\r\n\r\nhello\r\n"
+
+	t.Run("drop", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t)
+		r := dedupRelay(u.addr, dedupDrop)
+
+		require.NoError(t, send(r, msg))
+		require.NoError(t, send(r, msg))
+		require.NoError(t, send(r, "Message-Id: <2@example.com>\r\n\r\nhello\r\n"))
+
+		// messages without a Message-ID aren't checked
+		require.NoError(t, send(r, "Subject: hi\r\n\r\nhello\r\n"))
+		require.NoError(t, send(r, "Subject: hi\r\n\r\nhello\r\n"))
+
+		_, delivered := u.received()
+		assert.Len(t, delivered, 4)
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t)
+		r := dedupRelay(u.addr, dedupReject)
+
+		require.NoError(t, send(r, msg))
+		require.Equal(t, errDuplicateMessage, send(r, msg))
+
+		_, delivered := u.received()
+		assert.Len(t, delivered, 1)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		t.Parallel()
+
+		// messages which weren't accepted can be sent again
+		r := dedupRelay("127.0.0.1:9", dedupReject)
+
+		err := send(r, msg)
+		require.Error(t, err)
+		require.NotEqual(t, errDuplicateMessage, err)
+
+		err = send(r, msg)
+		require.Error(t, err)
+		require.NotEqual(t, errDuplicateMessage, err)
+	})
+	t.Run("in flight", func(t *testing.T) {
+		t.Parallel()
+
+		r := dedupRelay("127.0.0.1:9", dedupReject)
+
+		delivering := make(chan struct{})
+		result := make(chan error)
+
+		handler := r.dedupStage(func(context.Context, smtpd.Peer, smtpd.Envelope) error {
+			delivering <- struct{}{}
+			return <-result
+		})
+
+		env := smtpd.Envelope{
+			Sender: "alice@example.com",
+			Header: textproto.MIMEHeader{"Message-Id": {"<1@example.com>"}},
+		}
+
+		errs := make(chan error)
+		handle := func() {
+			errs <- handler(context.Background(), smtpd.Peer{}, env)
+		}
+
+		// duplicates are deferred while the first copy is delivered, and
+		// accepted if it fails
+		go handle()
+		<-delivering
+		require.Equal(t, errDuplicateInFlight, handler(context.Background(), smtpd.Peer{}, env))
+
+		result <- errors.New("delivery failed")
+		require.Error(t, <-errs)
+
+		go handle()
+		<-delivering
+		result <- nil
+		require.NoError(t, <-errs)
+
+		require.Equal(t, errDuplicateMessage, handler(context.Background(), smtpd.Peer{}, env))
+	})
+}
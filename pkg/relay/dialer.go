@@ -0,0 +1,381 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// IP version preferences of the outbound connections
+const (
+	preferIPv4 = "ipv4"      // IPv4 addresses first
+	preferIPv6 = "ipv6"      // IPv6 addresses first
+	onlyIPv4   = "ipv4-only" // IPv4 addresses only
+	onlyIPv6   = "ipv6-only" // IPv6 addresses only
+)
+
+// sourceRule binds the connections to the upstream hosts matching pattern to
+// a source IP address, or to one of the addresses of an interface
+type sourceRule struct {
+	pattern string // path.Match pattern of the host name, empty for the default rule
+	ip      net.IP // nil if iface is set
+	iface   string
+}
+
+// outboundDialer connects to the upstreams, or to the proxy to them,
+// resolving their addresses itself so they're tried in the order of the IP
+// version preference, with the source address bound to the upstream. Both
+// IP versions are raced (Happy Eyeballs, RFC 8305) with the fallback delay:
+// the addresses of the other version are tried if the preferred one doesn't
+// connect by then. A nil dialer dials like net.Dialer does.
+type outboundDialer struct {
+	prefer   string
+	sources  []sourceRule
+	timeout  time.Duration // of each connection, 0 for none
+	fallback time.Duration // 0 tries the addresses one after the other
+	proxy    *url.URL      // nil to connect directly
+
+	// lookupIPAddr and dialAddr override the DNS lookups and the connections
+	// - for tests
+	lookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+	dialAddr     func(ctx context.Context, local net.Addr, addr string) (net.Conn, error)
+}
+
+// newOutboundDialer parses the IP version preference, the source address
+// rules, in the form of "192.0.2.10 *.example.com=eth1" (separated by
+// spaces), where the rule without a pattern is the default one and the
+// source is an IP address or an interface name, and the proxy URL, see
+// parseProxyURL
+func newOutboundDialer(prefer, sources, proxy string, timeout, fallback time.Duration) (*outboundDialer, error) {
+	switch prefer {
+	case "", preferIPv4, preferIPv6, onlyIPv4, onlyIPv6:
+	default:
+		return nil, fmt.Errorf("invalid IP preference %q, expected %s, %s, %s or %s",
+			prefer, preferIPv4, preferIPv6, onlyIPv4, onlyIPv6)
+	}
+
+	d := &outboundDialer{
+		prefer:       prefer,
+		timeout:      timeout,
+		fallback:     fallback,
+		lookupIPAddr: net.DefaultResolver.LookupIPAddr,
+	}
+
+	d.dialAddr = d.dialTCP
+
+	if proxy != "" {
+		var err error
+		if d.proxy, err = parseProxyURL(proxy); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entry := range splitstr(sources, ' ') {
+		pattern, source, found := strings.Cut(entry, "=")
+		if !found {
+			pattern, source = "", entry
+		}
+
+		if found {
+			pattern = strings.ToLower(pattern)
+
+			if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+				return nil, fmt.Errorf("invalid source address pattern %q", pattern)
+			}
+		}
+
+		rule := sourceRule{pattern: pattern, ip: net.ParseIP(source)}
+		if rule.ip == nil {
+			if _, err := net.InterfaceByName(source); err != nil {
+				return nil, fmt.Errorf("invalid source address %q, expected an IP address or an interface: %w", source, err)
+			}
+
+			rule.iface = source
+		}
+
+		d.sources = append(d.sources, rule)
+	}
+
+	return d, nil
+}
+
+// dial connects to the host:port address of an upstream, through the proxy
+// if there's one
+func (d *outboundDialer) dial(ctx context.Context, address string) (net.Conn, error) {
+	if d == nil {
+		var nd net.Dialer
+		return nd.DialContext(ctx, "tcp", address)
+	}
+
+	if d.proxy != nil {
+		return d.dialProxy(ctx, address)
+	}
+
+	return d.dialDirect(ctx, address)
+}
+
+// dialDirect connects to the host:port address, see outboundDialer
+func (d *outboundDialer) dialDirect(ctx context.Context, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := d.source(host)
+
+	// the addresses of the version of the first one are the primary ones, and
+	// the ones without a source address of their version are skipped
+	var (
+		primaries, fallbacks []dialTarget
+		primaryV4            bool
+	)
+
+	for _, ip := range ips {
+		local, err := rule.addr(ip)
+		if err != nil {
+			continue
+		}
+
+		target := dialTarget{local: local, addr: net.JoinHostPort(ip.String(), port)}
+
+		switch v4 := ip.To4() != nil; {
+		case len(primaries) == 0:
+			primaries, primaryV4 = append(primaries, target), v4
+		case v4 == primaryV4:
+			primaries = append(primaries, target)
+		default:
+			fallbacks = append(fallbacks, target)
+		}
+	}
+
+	if len(primaries) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &net.AddrError{
+			Err: "no suitable address", Addr: host,
+		}}
+	}
+
+	if d.fallback <= 0 || len(fallbacks) == 0 {
+		return d.dialSerial(ctx, append(primaries, fallbacks...))
+	}
+
+	return d.dialParallel(ctx, primaries, fallbacks)
+}
+
+// resolve returns the addresses of the host, in the order of the preference
+func (d *outboundDialer) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := d.lookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+		}
+
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	v4, v6 := []net.IP{}, []net.IP{}
+
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch d.prefer {
+	case preferIPv4:
+		ips = append(v4, v6...)
+	case preferIPv6:
+		ips = append(v6, v4...)
+	case onlyIPv4:
+		ips = v4
+	case onlyIPv6:
+		ips = v6
+	}
+
+	if len(ips) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &net.AddrError{
+			Err: "no suitable address", Addr: host,
+		}}
+	}
+
+	return ips, nil
+}
+
+// source returns the source rule of the host, the zero rule to let the
+// system pick the source address
+func (d *outboundDialer) source(host string) sourceRule {
+	host = strings.ToLower(host)
+
+	var fallback sourceRule
+
+	for _, rule := range d.sources {
+		if rule.pattern == "" {
+			fallback = rule
+			continue
+		}
+
+		if ok, _ := path.Match(rule.pattern, host); ok {
+			return rule
+		}
+	}
+
+	return fallback
+}
+
+// addr returns the source address connecting to ip, nil for any, or an error
+// if the rule has none of its version
+func (r sourceRule) addr(ip net.IP) (net.Addr, error) {
+	v4 := ip.To4() != nil
+
+	switch {
+	case r.ip != nil:
+		if (r.ip.To4() != nil) != v4 {
+			return nil, fmt.Errorf("source address %s can't reach %s", r.ip, ip)
+		}
+
+		return &net.TCPAddr{IP: r.ip}, nil
+	case r.iface != "":
+		iface, err := net.InterfaceByName(r.iface)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if ok && (ipnet.IP.To4() != nil) == v4 && !ipnet.IP.IsLinkLocalUnicast() {
+				return &net.TCPAddr{IP: ipnet.IP}, nil
+			}
+		}
+
+		return nil, fmt.Errorf("interface %s has no address to reach %s", r.iface, ip)
+	default:
+		return nil, nil
+	}
+}
+
+// dialTarget is an address to connect to, from the source address local
+type dialTarget struct {
+	local net.Addr // nil for any
+	addr  string
+}
+
+// dialSerial connects to the targets one after the other, returning the
+// first connection, or the first error
+func (d *outboundDialer) dialSerial(ctx context.Context, targets []dialTarget) (net.Conn, error) {
+	var firstErr error
+
+	for _, t := range targets {
+		if err := ctx.Err(); err != nil {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+		}
+
+		conn, err := d.dialAddr(ctx, t.local, t.addr)
+		if err == nil {
+			return conn, nil
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return nil, firstErr
+}
+
+// dialParallel races the primary targets against the fallback ones, which
+// are started after the fallback delay, or as soon as the primary ones fail
+func (d *outboundDialer) dialParallel(ctx context.Context, primaries, fallbacks []dialTarget) (net.Conn, error) {
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result)
+
+	race := func(targets []dialTarget, primary bool) {
+		conn, err := d.dialSerial(ctx, targets)
+
+		select {
+		case results <- result{conn: conn, err: err, primary: primary}:
+		case <-ctx.Done():
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	go race(primaries, true)
+
+	timer := time.NewTimer(d.fallback)
+	defer timer.Stop()
+
+	var (
+		firstErr        error
+		fallbackStarted bool
+		pending         = 1
+	)
+
+	startFallback := func() {
+		fallbackStarted = true
+		pending++
+
+		go race(fallbacks, false)
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				startFallback()
+			}
+		case res := <-results:
+			pending--
+
+			if res.err == nil {
+				return res.conn, nil
+			}
+
+			// the error of the primary targets is the most relevant one
+			if firstErr == nil || res.primary {
+				firstErr = res.err
+			}
+
+			if !fallbackStarted {
+				startFallback()
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// dialTCP connects to the address from the local address
+func (d *outboundDialer) dialTCP(ctx context.Context, local net.Addr, addr string) (net.Conn, error) {
+	nd := net.Dialer{LocalAddr: local, Timeout: d.timeout}
+	return nd.DialContext(ctx, "tcp", addr)
+}
@@ -0,0 +1,218 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDialer is an outboundDialer resolving all hosts to addrs, whose
+// connections fail unless their address is in accept, in which case they're
+// pipes, or hang if it's in hang
+type fakeDialer struct {
+	*outboundDialer
+
+	mu     sync.Mutex
+	dialed []string // "local>addr", local being empty for any
+}
+
+func newFakeDialer(t *testing.T, prefer, sources string, fallback time.Duration,
+	addrs []string, accept, hang map[string]bool,
+) *fakeDialer {
+	t.Helper()
+
+	d, err := newOutboundDialer(prefer, sources, "", time.Second, fallback)
+	require.NoError(t, err)
+
+	fd := &fakeDialer{outboundDialer: d}
+
+	d.lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		ips := []net.IPAddr{}
+		for _, addr := range addrs {
+			ips = append(ips, net.IPAddr{IP: net.ParseIP(addr)})
+		}
+
+		return ips, nil
+	}
+
+	d.dialAddr = func(ctx context.Context, local net.Addr, addr string) (net.Conn, error) {
+		l := ""
+		if local != nil {
+			l = local.(*net.TCPAddr).IP.String()
+		}
+
+		fd.mu.Lock()
+		fd.dialed = append(fd.dialed, l+">"+addr)
+		fd.mu.Unlock()
+
+		switch {
+		case accept[addr]:
+			c1, c2 := net.Pipe()
+			t.Cleanup(func() { _ = c2.Close() })
+
+			return c1, nil
+		case hang[addr]:
+			<-ctx.Done()
+			return nil, ctx.Err()
+		default:
+			return nil, errors.New("connection refused")
+		}
+	}
+
+	return fd
+}
+
+func (fd *fakeDialer) attempts() []string {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	return append([]string{}, fd.dialed...)
+}
+
+func TestNewOutboundDialer(t *testing.T) {
+	t.Parallel()
+
+	d, err := newOutboundDialer("", "192.0.2.10 *.Example.com=2001:db8::10", "", 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []sourceRule{
+		{ip: net.ParseIP("192.0.2.10")},
+		{pattern: "*.example.com", ip: net.ParseIP("2001:db8::10")},
+	}, d.sources)
+
+	// interfaces are given by name
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			d, err := newOutboundDialer(preferIPv4, "mx.example.com="+iface.Name, "", 0, 0)
+			require.NoError(t, err)
+			assert.Equal(t, iface.Name, d.source("MX.example.com").iface)
+
+			addr, err := d.source("mx.example.com").addr(net.ParseIP("127.0.0.2"))
+			require.NoError(t, err)
+			assert.True(t, addr.(*net.TCPAddr).IP.IsLoopback())
+		}
+	}
+
+	for _, bad := range [][2]string{
+		{"ipv5", ""},
+		{"", "no-such-interface0"},
+		{"", "=192.0.2.10"},
+		{"", "[=192.0.2.10"},
+	} {
+		_, err := newOutboundDialer(bad[0], bad[1], "", 0, 0)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestOutboundDialerOrder(t *testing.T) {
+	t.Parallel()
+
+	addrs := []string{"2001:db8::1", "192.0.2.1", "192.0.2.2"}
+
+	for prefer, expected := range map[string][]string{
+		"":         {">[2001:db8::1]:25", ">192.0.2.1:25", ">192.0.2.2:25"},
+		preferIPv4: {">192.0.2.1:25", ">192.0.2.2:25", ">[2001:db8::1]:25"},
+		preferIPv6: {">[2001:db8::1]:25", ">192.0.2.1:25", ">192.0.2.2:25"},
+		onlyIPv4:   {">192.0.2.1:25", ">192.0.2.2:25"},
+		onlyIPv6:   {">[2001:db8::1]:25"},
+	} {
+		d := newFakeDialer(t, prefer, "", 0, addrs, nil, nil)
+
+		_, err := d.dial(context.Background(), "smtp.example.com:25")
+		require.Error(t, err)
+		assert.Equal(t, expected, d.attempts(), prefer)
+	}
+
+	// there's no address of the version
+	d := newFakeDialer(t, onlyIPv6, "", 0, []string{"192.0.2.1"}, nil, nil)
+
+	_, err := d.dial(context.Background(), "smtp.example.com:25")
+	require.ErrorContains(t, err, "no suitable address")
+	assert.Empty(t, d.attempts())
+}
+
+func TestOutboundDialerSource(t *testing.T) {
+	t.Parallel()
+
+	addrs := []string{"2001:db8::1", "192.0.2.1"}
+	accept := map[string]bool{"192.0.2.1:25": true, "[2001:db8::1]:25": true}
+
+	// the source address restricts the IP version
+	for host, expected := range map[string]string{
+		"smtp.example.org:25": "192.0.2.10>192.0.2.1:25",
+		"mx.example.com:25":   "2001:db8::10>[2001:db8::1]:25",
+		"192.0.2.1:25":        "192.0.2.10>192.0.2.1:25",
+	} {
+		d := newFakeDialer(t, "", "192.0.2.10 *.example.com=2001:db8::10", 0, addrs, accept, nil)
+
+		conn, err := d.dial(context.Background(), host)
+		require.NoError(t, err)
+		_ = conn.Close()
+
+		assert.Equal(t, []string{expected}, d.attempts(), host)
+	}
+
+	// there's no source address of the version of the upstream
+	d := newFakeDialer(t, "", "192.0.2.10", 0, addrs, accept, nil)
+
+	_, err := d.dial(context.Background(), "[2001:db8::1]:25")
+	require.ErrorContains(t, err, "no suitable address")
+}
+
+func TestOutboundDialerHappyEyeballs(t *testing.T) {
+	t.Parallel()
+
+	addrs := []string{"2001:db8::1", "192.0.2.1"}
+
+	// the IPv6 address doesn't connect, so the IPv4 one is tried after the
+	// fallback delay
+	d := newFakeDialer(t, "", "", 50*time.Millisecond, addrs,
+		map[string]bool{"192.0.2.1:25": true}, map[string]bool{"[2001:db8::1]:25": true})
+
+	start := time.Now()
+
+	conn, err := d.dial(context.Background(), "smtp.example.com:25")
+	require.NoError(t, err)
+	_ = conn.Close()
+
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, []string{">[2001:db8::1]:25", ">192.0.2.1:25"}, d.attempts())
+
+	// the IPv6 address fails at once, so the IPv4 one is tried without delay
+	d = newFakeDialer(t, "", "", time.Hour, addrs, map[string]bool{"192.0.2.1:25": true}, nil)
+
+	conn, err = d.dial(context.Background(), "smtp.example.com:25")
+	require.NoError(t, err)
+	_ = conn.Close()
+
+	// both fail, with the error of the preferred version
+	d = newFakeDialer(t, preferIPv4, "", time.Millisecond, addrs, nil, nil)
+
+	_, err = d.dial(context.Background(), "smtp.example.com:25")
+	require.ErrorContains(t, err, "connection refused")
+	assert.ElementsMatch(t, []string{">192.0.2.1:25", ">[2001:db8::1]:25"}, d.attempts())
+}
+
+func TestOutboundDialerConnect(t *testing.T) {
+	t.Parallel()
+
+	u := startFakeUpstream(t)
+
+	cfg := &config{hostName: "relay.example.com", remoteSourceAddr: "127.0.0.1", remoteIPPrefer: onlyIPv4}
+	require.NoError(t, cfg.setup())
+
+	c, err := dialSMTP(context.Background(), cfg, u.addr)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Hello("relay.example.com"))
+	require.NoError(t, c.Quit())
+}
@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// max number of DKIM signatures verified per message
+const dkimMaxVerifications = 5
+
+// dkimVerifier verifies the DKIM signatures of incoming messages
+type dkimVerifier struct {
+	// lookupTXT overrides the DNS TXT lookups - for tests
+	lookupTXT func(domain string) ([]string, error)
+
+	logger *slog.Logger
+}
+
+func newDKIMVerifier() *dkimVerifier {
+	return &dkimVerifier{
+		logger: slog.Default().With(slog.String("component", "dkim")),
+	}
+}
+
+// verify returns the verification result of each DKIM signature of the
+// message, up to dkimMaxVerifications
+func (v *dkimVerifier) verify(ctx context.Context, data []byte) []*dkim.Verification {
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(toCRLF(data)), &dkim.VerifyOptions{
+		LookupTXT:        v.lookupTXT,
+		MaxVerifications: dkimMaxVerifications,
+	})
+	if err != nil && !errors.Is(err, dkim.ErrTooManySignatures) {
+		v.logger.WarnContext(ctx, "could not verify DKIM signatures", slog.Any("error", err))
+	}
+
+	for _, ver := range verifications {
+		log := v.logger.With(slog.String("dkim_domain", ver.Domain))
+
+		if ver.Err != nil {
+			log.InfoContext(ctx, "invalid DKIM signature", slog.Any("error", ver.Err))
+		} else {
+			log.DebugContext(ctx, "valid DKIM signature")
+		}
+	}
+
+	return verifications
+}
+
+// dkimResults returns the Authentication-Results entries for the DKIM
+// verifications
+func dkimResults(verifications []*dkim.Verification) []authres.Result {
+	if len(verifications) == 0 {
+		return []authres.Result{&authres.DKIMResult{Value: authres.ResultNone}}
+	}
+
+	results := make([]authres.Result, 0, len(verifications))
+
+	for _, ver := range verifications {
+		res := &authres.DKIMResult{
+			Value:      authres.ResultPass,
+			Domain:     ver.Domain,
+			Identifier: ver.Identifier,
+		}
+
+		switch {
+		case ver.Err == nil:
+		case dkim.IsTempFail(ver.Err):
+			res.Value = authres.ResultTempError
+		case dkim.IsPermFail(ver.Err):
+			res.Value = authres.ResultPermError
+		default:
+			res.Value = authres.ResultFail
+		}
+
+		if ver.Err != nil {
+			res.Reason = ver.Err.Error()
+		}
+
+		results = append(results, res)
+	}
+
+	return results
+}
+
+// toCRLF converts bare LF line endings to CRLF, as messages received with
+// DATA have their line endings normalized to LF but signatures are computed
+// over CRLF line endings
+func toCRLF(data []byte) []byte {
+	if bytes.Count(data, []byte("\n")) == bytes.Count(data, []byte("\r\n")) {
+		return data
+	}
+
+	out := make([]byte, 0, len(data)+bytes.Count(data, []byte("\n")))
+
+	for i, b := range data {
+		if b == '\n' && (i == 0 || data[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+
+		out = append(out, b)
+	}
+
+	return out
+}
@@ -0,0 +1,116 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDKIMVerifier(t *testing.T) {
+	t.Parallel()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	resolver := fakeResolver{
+		"sel._domainkey.example.com": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}
+
+	v := newDKIMVerifier()
+	v.lookupTXT = func(domain string) ([]string, error) {
+		return resolver.LookupTXT(context.Background(), domain)
+	}
+
+	signed := dkimSign(t, key, "example.com", []byte("From: bob@example.com\r\nSubject: test\r\n\r\nhello\r\n"))
+
+	testCases := []struct {
+		name   string
+		data   []byte
+		result authres.ResultValue
+	}{
+		{"valid signature", signed, authres.ResultPass},
+		{"LF line endings", bytes.ReplaceAll(signed, []byte("\r\n"), []byte("\n")), authres.ResultPass},
+		{"tampered body", append(bytes.Clone(signed), []byte("more\r\n")...), authres.ResultFail},
+		{"no signature", []byte("From: bob@example.com\r\n\r\nhello\r\n"), authres.ResultNone},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			results := dkimResults(v.verify(context.Background(), tc.data))
+			require.Len(t, results, 1)
+
+			res, ok := results[0].(*authres.DKIMResult)
+			require.True(t, ok)
+			assert.Equal(t, tc.result, res.Value)
+		})
+	}
+}
+
+func TestAuthenticateMessage(t *testing.T) {
+	t.Parallel()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	resolver := fakeResolver{
+		"example.com":                {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"sel._domainkey.example.com": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}
+
+	spfChecker, err := newSPFChecker(spfPolicyLogOnly)
+	require.NoError(t, err)
+
+	spfChecker.resolver = resolver
+
+	r := &relay{
+		conf: newConfigStore(&config{hostName: "relay.example.com"}),
+		spf:  spfChecker,
+		dkim: newDKIMVerifier(),
+	}
+
+	r.dkim.lookupTXT = func(domain string) ([]string, error) {
+		return resolver.LookupTXT(context.Background(), domain)
+	}
+
+	peer := smtpd.Peer{
+		HeloName: "client.example.com",
+		Addr:     &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345},
+	}
+
+	data := dkimSign(t, key, "example.com", []byte("From: bob@example.com\r\nSubject: test\r\n\r\nhello\r\n"))
+	data = append([]byte("Authentication-Results: relay.example.com; dkim=pass header.d=forged.example\r\n"+
+		"Authentication-Results: mx.example.org; none\r\n"), data...)
+
+	env := testEnvelope(t, "bob@example.com", data)
+
+	err = r.authenticateMessage(context.Background(), peer, env)
+	require.NoError(t, err)
+
+	header := testEnvelope(t, "", env.Data).Header
+
+	results := header.Values("Authentication-Results")
+	require.Len(t, results, 2)
+	assert.Equal(t, "mx.example.org; none", results[1])
+
+	id, parsed, err := authres.Parse(results[0])
+	require.NoError(t, err)
+	assert.Equal(t, "relay.example.com", id)
+	assert.Equal(t, []authres.Result{
+		&authres.SPFResult{Value: authres.ResultPass, From: "bob@example.com", Helo: "client.example.com"},
+		&authres.DKIMResult{Value: authres.ResultPass, Domain: "example.com", Identifier: "@example.com"},
+	}, parsed)
+
+	assert.False(t, strings.Contains(string(env.Data), "forged.example"))
+}
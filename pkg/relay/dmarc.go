@@ -0,0 +1,254 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/mail"
+	"strings"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"golang.org/x/net/publicsuffix"
+)
+
+// DMARC modes
+const (
+	dmarcModeEnforce    = "enforce"     // apply the policy published by the sender domain
+	dmarcModeReportOnly = "report-only" // only log and count the disposition
+)
+
+// DMARC evaluation results (RFC 7489 section 11.2)
+const (
+	dmarcPass      = "pass"
+	dmarcFail      = "fail"
+	dmarcNone      = "none"
+	dmarcTempError = "temperror"
+	dmarcPermError = "permerror"
+)
+
+// dmarcQuarantineHeader is added to messages whose disposition is quarantine,
+// so the upstream can file them accordingly
+const dmarcQuarantineHeader = "X-DMARC-Quarantine"
+
+// dmarcResult is the outcome of the DMARC evaluation of a message
+type dmarcResult struct {
+	result      string
+	domain      string       // RFC5322.From domain
+	policy      dmarc.Policy // policy published for the domain, if any
+	disposition dmarc.Policy // policy applied to the message
+	spfAligned  bool         // SPF passed for a domain aligned with the From domain
+	dkimAligned bool         // a valid DKIM signature is aligned with the From domain
+	err         error
+}
+
+// dmarcChecker evaluates the DMARC policy of the From domain of incoming
+// messages, based on the SPF and DKIM verification results
+type dmarcChecker struct {
+	mode string
+	spf  *spfChecker
+
+	// lookupTXT overrides the DNS TXT lookups - for tests
+	lookupTXT func(domain string) ([]string, error)
+
+	logger *slog.Logger
+}
+
+func newDMARCChecker(mode string, spfChecker *spfChecker) (*dmarcChecker, error) {
+	switch mode {
+	case dmarcModeEnforce, dmarcModeReportOnly:
+	default:
+		return nil, fmt.Errorf("unknown DMARC mode %q", mode)
+	}
+
+	return &dmarcChecker{
+		mode:   mode,
+		spf:    spfChecker,
+		logger: slog.Default().With(slog.String("component", "dmarc")),
+	}, nil
+}
+
+// check evaluates the DMARC policy for the message, given its DKIM
+// verification results, and returns the SMTP error to reply with if it should
+// be rejected. In enforce mode, quarantined messages are marked with a header.
+func (c *dmarcChecker) check(
+	ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope, verifications []*dkim.Verification,
+) (*dmarcResult, error) {
+	res := c.evaluate(ctx, peer, env, verifications)
+
+	dmarcCounter.WithLabelValues(res.result, string(res.disposition)).Inc()
+
+	log := c.logger.With(
+		slog.String("from_domain", res.domain),
+		slog.String("dmarc_result", res.result),
+		slog.String("dmarc_policy", string(res.policy)),
+		slog.String("dmarc_disposition", string(res.disposition)),
+		slog.Bool("spf_aligned", res.spfAligned),
+		slog.Bool("dkim_aligned", res.dkimAligned),
+	)
+
+	if res.err != nil {
+		log = log.With(slog.Any("error", res.err))
+	}
+
+	if res.disposition == dmarc.PolicyNone || c.mode != dmarcModeEnforce {
+		log.DebugContext(ctx, "DMARC check done")
+		return res, nil
+	}
+
+	if res.disposition == dmarc.PolicyReject {
+		log.WarnContext(ctx, "DMARC check failed, rejecting message")
+		return res, flagged(quarantineDMARC, res.domain, observeErr(ctx, smtpd.ErrDMARCReject))
+	}
+
+	log.WarnContext(ctx, "DMARC check failed, quarantining message")
+	env.AddHeader(dmarcQuarantineHeader, res.domain)
+
+	return res, nil
+}
+
+// evaluate computes the DMARC result and disposition of the message
+func (c *dmarcChecker) evaluate(
+	ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope, verifications []*dkim.Verification,
+) *dmarcResult {
+	res := &dmarcResult{disposition: dmarc.PolicyNone}
+
+	res.domain, res.err = fromDomain(env)
+	if res.err != nil {
+		res.result = dmarcPermError
+		return res
+	}
+
+	rec, err := c.lookupPolicy(res.domain)
+
+	switch {
+	case errors.Is(err, dmarc.ErrNoPolicy):
+		res.result = dmarcNone
+		return res
+	case dmarc.IsTempFail(err):
+		res.result, res.err = dmarcTempError, err
+		return res
+	case err != nil:
+		res.result, res.err = dmarcPermError, err
+		return res
+	}
+
+	res.policy = rec.Policy
+
+	if spfRes := c.spf.result(ctx, peer, env.Sender); spfRes.result == spf.Pass {
+		spfDomain := peer.HeloName
+		if idx := strings.LastIndex(env.Sender, "@"); idx != -1 {
+			spfDomain = env.Sender[idx+1:]
+		}
+
+		res.spfAligned = aligned(spfDomain, res.domain, rec.SPFAlignment)
+	}
+
+	for _, v := range verifications {
+		if v.Err == nil && aligned(v.Domain, res.domain, rec.DKIMAlignment) {
+			res.dkimAligned = true
+		}
+	}
+
+	if res.spfAligned || res.dkimAligned {
+		res.result = dmarcPass
+		return res
+	}
+
+	res.result = dmarcFail
+	res.disposition = samplePolicy(rec.Policy, rec.Percent)
+
+	return res
+}
+
+// lookupPolicy returns the DMARC record of the domain, falling back to the
+// subdomain policy of its organizational domain
+func (c *dmarcChecker) lookupPolicy(domain string) (*dmarc.Record, error) {
+	opts := &dmarc.LookupOptions{LookupTXT: c.lookupTXT}
+
+	rec, err := dmarc.LookupWithOptions(domain, opts)
+	if !errors.Is(err, dmarc.ErrNoPolicy) {
+		return rec, err
+	}
+
+	org := orgDomain(domain)
+	if org == domain {
+		return nil, err
+	}
+
+	rec, err = dmarc.LookupWithOptions(org, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if rec.SubdomainPolicy != "" {
+		rec.Policy = rec.SubdomainPolicy
+	}
+
+	return rec, nil
+}
+
+// samplePolicy applies the pct tag of the DMARC record: messages which aren't
+// sampled get the next less strict policy (RFC 7489 section 6.6.4)
+func samplePolicy(policy dmarc.Policy, percent *int) dmarc.Policy {
+	if percent == nil || rand.IntN(100) < *percent {
+		return policy
+	}
+
+	switch policy {
+	case dmarc.PolicyReject:
+		return dmarc.PolicyQuarantine
+	default:
+		return dmarc.PolicyNone
+	}
+}
+
+// fromDomain returns the domain of the RFC5322.From address of the message,
+// which must contain a single address
+func fromDomain(env *smtpd.Envelope) (string, error) {
+	if len(env.Header["From"]) != 1 {
+		return "", errors.New("message must have exactly one From header")
+	}
+
+	addrs, err := mail.ParseAddressList(env.Header.Get("From"))
+	if err != nil {
+		return "", fmt.Errorf("invalid From header: %w", err)
+	}
+
+	if len(addrs) != 1 {
+		return "", errors.New("From header must contain exactly one address")
+	}
+
+	idx := strings.LastIndex(addrs[0].Address, "@")
+	if idx == -1 {
+		return "", errors.New("From address has no domain")
+	}
+
+	return strings.ToLower(addrs[0].Address[idx+1:]), nil
+}
+
+// aligned reports whether the domains are aligned in the given mode: in
+// strict mode they must be identical, in relaxed mode they must share the
+// same organizational domain
+func aligned(domain, fromDomain string, mode dmarc.AlignmentMode) bool {
+	if mode == dmarc.AlignmentStrict {
+		return strings.EqualFold(domain, fromDomain)
+	}
+
+	return orgDomain(strings.ToLower(domain)) == orgDomain(fromDomain)
+}
+
+// orgDomain returns the organizational domain of the domain, i.e. its public
+// suffix plus one label
+func orgDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+
+	return org
+}
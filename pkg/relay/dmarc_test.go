@@ -0,0 +1,216 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dkimSign signs the message with key for domain, using selector "sel"
+func dkimSign(t *testing.T, key ed25519.PrivateKey, domain string, msg []byte) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+
+	err := dkim.Sign(&b, bytes.NewReader(msg), &dkim.SignOptions{
+		Domain:   domain,
+		Selector: "sel",
+		Signer:   key,
+	})
+	require.NoError(t, err)
+
+	return b.Bytes()
+}
+
+func testEnvelope(t *testing.T, sender string, data []byte) *smtpd.Envelope {
+	t.Helper()
+
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	require.NoError(t, err)
+
+	return &smtpd.Envelope{
+		Sender:     sender,
+		Recipients: []string{"alice@example.org"},
+		Header:     header,
+		Data:       data,
+	}
+}
+
+func TestDMARCChecker(t *testing.T) {
+	t.Parallel()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	resolver := fakeResolver{
+		"example.com":                {"v=spf1 -all"},
+		"bounce.example.com":         {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"_dmarc.example.com":         {"v=DMARC1; p=reject; sp=none"},
+		"quarantine.test":            {"v=spf1 -all"},
+		"_dmarc.quarantine.test":     {"v=DMARC1; p=quarantine"},
+		"sel._domainkey.example.com": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}
+
+	peer := smtpd.Peer{
+		HeloName: "client.example.net",
+		Addr:     &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345},
+	}
+
+	msg := func(from string) []byte {
+		return []byte("From: Bob <bob@" + from + ">\r\nSubject: test\r\n\r\nhello\r\n")
+	}
+
+	testCases := []struct {
+		name        string
+		mode        string
+		sender      string
+		data        []byte
+		result      string
+		disposition dmarc.Policy
+		err         error
+		quarantined bool
+	}{
+		{
+			name:        "aligned DKIM signature",
+			mode:        dmarcModeEnforce,
+			sender:      "bob@example.com",
+			data:        dkimSign(t, key, "example.com", msg("example.com")),
+			result:      dmarcPass,
+			disposition: dmarc.PolicyNone,
+		},
+		{
+			name:        "relaxed SPF alignment",
+			mode:        dmarcModeEnforce,
+			sender:      "bounces@bounce.example.com",
+			data:        msg("example.com"),
+			result:      dmarcPass,
+			disposition: dmarc.PolicyNone,
+		},
+		{
+			name:        "reject",
+			mode:        dmarcModeEnforce,
+			sender:      "bob@example.com",
+			data:        msg("example.com"),
+			result:      dmarcFail,
+			disposition: dmarc.PolicyReject,
+			err:         smtpd.ErrDMARCReject,
+		},
+		{
+			name:        "relaxed DKIM alignment",
+			mode:        dmarcModeEnforce,
+			sender:      "bob@example.com",
+			data:        dkimSign(t, key, "example.com", msg("sub.example.com")),
+			result:      dmarcPass,
+			disposition: dmarc.PolicyNone,
+		},
+		{
+			name:        "subdomain policy",
+			mode:        dmarcModeEnforce,
+			sender:      "bob@sub.example.com",
+			data:        msg("sub.example.com"),
+			result:      dmarcFail,
+			disposition: dmarc.PolicyNone,
+		},
+		{
+			name:        "quarantine",
+			mode:        dmarcModeEnforce,
+			sender:      "bob@quarantine.test",
+			data:        msg("quarantine.test"),
+			result:      dmarcFail,
+			disposition: dmarc.PolicyQuarantine,
+			quarantined: true,
+		},
+		{
+			name:        "report only",
+			mode:        dmarcModeReportOnly,
+			sender:      "bob@example.com",
+			data:        msg("example.com"),
+			result:      dmarcFail,
+			disposition: dmarc.PolicyReject,
+		},
+		{
+			name:        "no policy",
+			mode:        dmarcModeEnforce,
+			sender:      "bob@example.org",
+			data:        msg("example.org"),
+			result:      dmarcNone,
+			disposition: dmarc.PolicyNone,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			spfChecker, err := newSPFChecker(spfPolicyLogOnly)
+			require.NoError(t, err)
+
+			spfChecker.resolver = resolver
+
+			c, err := newDMARCChecker(tc.mode, spfChecker)
+			require.NoError(t, err)
+
+			c.lookupTXT = func(domain string) ([]string, error) {
+				return resolver.LookupTXT(context.Background(), domain)
+			}
+
+			v := newDKIMVerifier()
+			v.lookupTXT = c.lookupTXT
+
+			verifications := v.verify(context.Background(), tc.data)
+
+			res := c.evaluate(context.Background(), peer, testEnvelope(t, tc.sender, tc.data), verifications)
+			assert.Equal(t, tc.result, res.result)
+			assert.Equal(t, tc.disposition, res.disposition)
+
+			env := testEnvelope(t, tc.sender, tc.data)
+
+			_, err = c.check(context.Background(), peer, env, verifications)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, tc.quarantined, bytes.HasPrefix(env.Data, []byte(dmarcQuarantineHeader+": ")))
+		})
+	}
+
+	_, err = newDMARCChecker("strict", nil)
+	require.EqualError(t, err, `unknown DMARC mode "strict"`)
+}
+
+func TestFromDomain(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]string{
+		"From: Bob <bob@Example.COM>\r\n\r\n":                    "example.com",
+		"From: bob@example.com, carol@example.org\r\n\r\n":       "",
+		"From: bob@example.com\r\nFrom: bob@example.org\r\n\r\n": "",
+		"Subject: no from\r\n\r\n":                               "",
+		"From: \"Bob\" <bob@sub.example.com> (comment)\r\n\r\n":  "sub.example.com",
+	}
+
+	for data, expected := range testCases {
+		domain, err := fromDomain(testEnvelope(t, "", []byte(data)))
+		if expected == "" {
+			require.Error(t, err, data)
+		} else {
+			require.NoError(t, err, data)
+		}
+
+		assert.Equal(t, expected, domain, data)
+	}
+}
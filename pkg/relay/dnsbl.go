@@ -0,0 +1,244 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// DNSBL modes
+const (
+	dnsblModeReject  = "reject"   // reject clients reaching the threshold
+	dnsblModeLogOnly = "log-only" // never reject, only log and count the hits
+)
+
+// how long the blocklist results of an IP address are kept
+const dnsblCacheTTL = 10 * time.Minute
+
+var errDNSBLListed = &smtpd.Error{Code: 554, EnhancedCode: "5.7.1", Msg: "Service unavailable; client host blocked by DNS blocklists"}
+
+// dnsbl is a DNS blocklist, with the score added when a client is listed
+type dnsbl struct {
+	zone  string
+	score int
+}
+
+// dnsblResult is the outcome of the blocklist lookups for an IP address
+type dnsblResult struct {
+	score   int
+	listed  []string // zones the address is listed in
+	expires time.Time
+}
+
+// dnsblChecker looks the IP addresses of the clients up in DNS blocklists
+// (RFC 5782) when they connect, and rejects the clients whose total score
+// reaches the threshold. Lookup failures are logged and ignored, so an
+// unreachable blocklist doesn't block the clients.
+type dnsblChecker struct {
+	lists     []dnsbl
+	threshold int
+	mode      string
+	timeout   time.Duration
+
+	// lookupHost overrides the DNS lookups - for tests
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mu    sync.Mutex
+	cache map[string]*dnsblResult
+
+	logger *slog.Logger
+}
+
+// newDNSBLChecker returns nil if lists is empty. Lists are separated by
+// spaces, each optionally followed by its score (e.g. "zen.spamhaus.org=2
+// bl.spamcop.net"), 1 by default.
+func newDNSBLChecker(lists string, threshold int, mode string, timeout time.Duration) (*dnsblChecker, error) {
+	c := &dnsblChecker{
+		threshold:  threshold,
+		mode:       mode,
+		timeout:    timeout,
+		lookupHost: net.DefaultResolver.LookupHost,
+		cache:      map[string]*dnsblResult{},
+		logger:     slog.Default().With(slog.String("component", "dnsbl")),
+	}
+
+	for _, entry := range splitstr(lists, ' ') {
+		zone, score, found := strings.Cut(entry, "=")
+
+		l := dnsbl{zone: strings.ToLower(strings.Trim(zone, ".")), score: 1}
+		if l.zone == "" {
+			return nil, fmt.Errorf("invalid list %q", entry)
+		}
+
+		if found {
+			var err error
+
+			l.score, err = strconv.Atoi(score)
+			if err != nil {
+				return nil, fmt.Errorf("invalid score of list %q: %w", zone, err)
+			}
+		}
+
+		c.lists = append(c.lists, l)
+	}
+
+	if len(c.lists) == 0 {
+		return nil, nil
+	}
+
+	switch mode {
+	case dnsblModeReject, dnsblModeLogOnly:
+	default:
+		return nil, fmt.Errorf("unknown DNSBL mode %q", mode)
+	}
+
+	if threshold < 1 {
+		return nil, fmt.Errorf("invalid DNSBL threshold %d", threshold)
+	}
+
+	return c, nil
+}
+
+// check looks the peer up in the blocklists, and returns the SMTP error to
+// reply with if it should be rejected. Loopback and private addresses aren't
+// looked up.
+func (c *dnsblChecker) check(ctx context.Context, peer smtpd.Peer) error {
+	ip := peerIP(peer)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return nil
+	}
+
+	res := c.result(ctx, ip)
+	if len(res.listed) == 0 {
+		return nil
+	}
+
+	log := c.logger.With(
+		slog.String("ip", ip.String()),
+		slog.Any("lists", res.listed),
+		slog.Int("score", res.score),
+	)
+
+	if res.score < c.threshold || c.mode == dnsblModeLogOnly {
+		log.InfoContext(ctx, "client listed in DNS blocklists")
+		return nil
+	}
+
+	log.WarnContext(ctx, "client listed in DNS blocklists, rejecting connection")
+
+	return observeErr(ctx, errDNSBLListed)
+}
+
+// result returns the blocklist results for the IP address, looking it up in
+// all the lists at once if it isn't cached
+func (c *dnsblChecker) result(ctx context.Context, ip net.IP) *dnsblResult {
+	key := ip.String()
+	now := time.Now()
+
+	c.mu.Lock()
+	res, ok := c.cache[key]
+	c.mu.Unlock()
+
+	if ok && now.Before(res.expires) {
+		return res
+	}
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	listed := make([]bool, len(c.lists))
+
+	var wg sync.WaitGroup
+
+	for i, l := range c.lists {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			listed[i] = c.lookup(ctx, ip, l.zone)
+		}()
+	}
+
+	wg.Wait()
+
+	res = &dnsblResult{expires: now.Add(dnsblCacheTTL)}
+
+	for i, l := range c.lists {
+		if listed[i] {
+			res.score += l.score
+			res.listed = append(res.listed, l.zone)
+
+			dnsblCounter.WithLabelValues(l.zone).Inc()
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, r := range c.cache {
+		if now.After(r.expires) {
+			delete(c.cache, k)
+		}
+	}
+
+	c.cache[key] = res
+
+	return res
+}
+
+// lookup reports whether the IP address is listed in the zone. Replies out of
+// 127.0.0.0/8 are ignored, as well as the 127.255.255.0/24 errors returned by
+// some lists (e.g. for queries through public resolvers).
+func (c *dnsblChecker) lookup(ctx context.Context, ip net.IP, zone string) bool {
+	addrs, err := c.lookupHost(ctx, dnsblQuery(ip, zone))
+	if err != nil {
+		if !isNotFound(err) {
+			c.logger.WarnContext(ctx, "DNS blocklist lookup failed", slog.String("list", zone),
+				slog.String("ip", ip.String()), slog.Any("error", err))
+		}
+
+		return false
+	}
+
+	return slices.ContainsFunc(addrs, func(addr string) bool {
+		a := net.ParseIP(addr).To4()
+		return a != nil && a[0] == 127 && !(a[1] == 255 && a[2] == 255)
+	})
+}
+
+// dnsblQuery returns the name looked up for the IP address in the zone: the
+// reversed octets of IPv4 addresses, or the reversed nibbles of IPv6 ones
+func dnsblQuery(ip net.IP, zone string) string {
+	var b strings.Builder
+
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := 3; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(ip4[i])) + ".")
+		}
+	} else {
+		const hex = "0123456789abcdef"
+
+		ip16 := ip.To16()
+		for i := len(ip16) - 1; i >= 0; i-- {
+			b.WriteByte(hex[ip16[i]&0xf])
+			b.WriteByte('.')
+			b.WriteByte(hex[ip16[i]>>4])
+			b.WriteByte('.')
+		}
+	}
+
+	return b.String() + zone
+}
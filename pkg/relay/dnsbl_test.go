@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDNSBLChecker(t *testing.T) {
+	t.Parallel()
+
+	c, err := newDNSBLChecker("", 1, dnsblModeReject, time.Second)
+	require.NoError(t, err)
+	assert.Nil(t, c)
+
+	c, err = newDNSBLChecker("Zen.Spamhaus.org.=2  bl.spamcop.net", 2, dnsblModeLogOnly, time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	assert.Equal(t, []dnsbl{{zone: "zen.spamhaus.org", score: 2}, {zone: "bl.spamcop.net", score: 1}}, c.lists)
+
+	for _, tc := range []struct {
+		lists     string
+		threshold int
+		mode      string
+	}{
+		{"zen.spamhaus.org=x", 1, dnsblModeReject},
+		{"=2", 1, dnsblModeReject},
+		{"zen.spamhaus.org", 1, "tag"},
+		{"zen.spamhaus.org", 0, dnsblModeReject},
+	} {
+		_, err = newDNSBLChecker(tc.lists, tc.threshold, tc.mode, time.Second)
+		assert.Error(t, err, tc)
+	}
+}
+
+func TestDNSBLQuery(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "2.0.0.127.zen.spamhaus.org", dnsblQuery(net.ParseIP("127.0.0.2"), "zen.spamhaus.org"))
+	assert.Equal(t,
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.example.org",
+		dnsblQuery(net.ParseIP("2001:db8::1"), "example.org"))
+}
+
+func TestDNSBLChecker(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	// 192.0.2.1 is listed in both lists, 192.0.2.2 only in the second one,
+	// and 192.0.2.3 gets an error code from the first one
+	var lookups atomic.Int32
+
+	lookupHost := func(_ context.Context, host string) ([]string, error) {
+		lookups.Add(1)
+
+		switch {
+		case strings.HasPrefix(host, "1.2.0.192."):
+			return []string{"127.0.0.2", "127.0.0.4"}, nil
+		case host == "2.2.0.192.b.example":
+			return []string{"127.0.0.2"}, nil
+		case host == "3.2.0.192.a.example":
+			return []string{"127.255.255.254"}, nil
+		case strings.HasPrefix(host, "4.2.0.192."):
+			return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+		default:
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+	}
+
+	peer := func(ip string) smtpd.Peer {
+		return smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25}}
+	}
+
+	c, err := newDNSBLChecker("a.example=2 b.example", 2, dnsblModeReject, time.Second)
+	require.NoError(t, err)
+
+	c.lookupHost = lookupHost
+
+	err = c.check(ctx, peer("192.0.2.1"))
+	require.ErrorIs(t, err, errDNSBLListed)
+	assert.Equal(t, int32(2), lookups.Load())
+
+	// below the threshold
+	require.NoError(t, c.check(ctx, peer("192.0.2.2")))
+
+	// error codes and lookup failures aren't listings
+	require.NoError(t, c.check(ctx, peer("192.0.2.3")))
+	require.NoError(t, c.check(ctx, peer("192.0.2.4")))
+
+	// results are cached
+	lookups.Store(0)
+	require.ErrorIs(t, c.check(ctx, peer("192.0.2.1")), errDNSBLListed)
+	assert.Zero(t, lookups.Load())
+
+	// private and loopback addresses aren't looked up
+	require.NoError(t, c.check(ctx, peer("10.0.0.1")))
+	require.NoError(t, c.check(ctx, peer("127.0.0.1")))
+	assert.Zero(t, lookups.Load())
+
+	// log-only never rejects
+	c, err = newDNSBLChecker("a.example=2 b.example", 2, dnsblModeLogOnly, time.Second)
+	require.NoError(t, err)
+
+	c.lookupHost = lookupHost
+
+	require.NoError(t, c.check(ctx, peer("192.0.2.1")))
+}
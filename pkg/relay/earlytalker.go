@@ -0,0 +1,32 @@
+package relay
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// Actions on the clients sending data before the greeting, with greet_delay
+const (
+	earlyTalkerReject = "reject" // reply 554 and disconnect them
+	earlyTalkerLog    = "log"    // only log and count them
+)
+
+// checkEarlyTalker handles a client which sent data before the greeting
+func (r *relay) checkEarlyTalker(ctx context.Context, peer smtpd.Peer) error {
+	action := r.config(ctx).earlyTalkerAction
+
+	slog.InfoContext(ctx, "client sent data before the greeting",
+		slog.String("component", "early_talker"),
+		slog.String("client_ip", peer.Addr.String()),
+		slog.String("action", action))
+
+	earlyTalkersCounter.WithLabelValues(r.listener.String(), action).Inc()
+
+	if action == earlyTalkerLog {
+		return nil
+	}
+
+	return observeErr(ctx, smtpd.ErrEarlyTalker)
+}
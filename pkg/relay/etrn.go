@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// handleETRN starts the delivery of the queued messages of the node requested
+// with ETRN (RFC 1985), so that a downstream server which is only connected
+// intermittently receives its mail at once. The node is a domain, or
+// @domain for the domain and its subdomains, which must be in etrn_domains.
+// Queue names (#queue) aren't supported.
+func (r *relay) handleETRN(ctx context.Context, peer smtpd.Peer, args string) (smtpd.Reply, error) {
+	if peer.HeloName == "" {
+		return smtpd.Reply{}, smtpd.ErrNoHELO
+	}
+
+	node := strings.ToLower(args)
+
+	switch {
+	case node == "":
+		return smtpd.Reply{}, smtpd.ErrMissingParam
+	case strings.ContainsAny(node, " \t"):
+		return smtpd.Reply{}, smtpd.ErrInvalidSyntax
+	case strings.HasPrefix(node, "#"):
+		return smtpd.Reply{}, &smtpd.Error{Code: 458, EnhancedCode: "4.3.0",
+			Msg: "Unable to queue messages for node " + args}
+	}
+
+	domain, subdomains := strings.CutPrefix(node, "@")
+
+	logger := slog.Default().With(slog.String("component", "etrn"),
+		slog.String("node", node), slog.String("client_ip", peer.Addr.String()))
+
+	if !etrnAllowed(r.config(ctx).etrnDomains, domain) {
+		logger.WarnContext(ctx, "ETRN denied")
+
+		return smtpd.Reply{}, &smtpd.Error{Code: 459, EnhancedCode: "4.7.1",
+			Msg: "Node " + args + " not allowed"}
+	}
+
+	n, err := r.shared.queue.reschedule(domain, subdomains, time.Now())
+	if err != nil {
+		logger.ErrorContext(ctx, "could not reschedule queued messages", slog.Any("error", err))
+
+		return smtpd.Reply{}, &smtpd.Error{Code: 458, EnhancedCode: "4.3.0",
+			Msg: "Unable to queue messages for node " + args}
+	}
+
+	logger.InfoContext(ctx, "ETRN started queued deliveries", slog.Int("messages", n))
+
+	if n == 0 {
+		return smtpd.Reply{Code: 251, EnhancedCode: "2.0.0",
+			Lines: []string{"No messages waiting for node " + args}}, nil
+	}
+
+	return smtpd.Reply{Code: 253, EnhancedCode: "2.0.0",
+		Lines: []string{fmt.Sprintf("%d pending messages for node %s started", n, args)}}, nil
+}
+
+// etrnAllowed reports whether ETRN may be requested for the domain: it must be
+// in etrn_domains, which also covers the subdomains of its domains, or
+// etrn_domains must be *
+func etrnAllowed(domains, domain string) bool {
+	if domain == "" {
+		return false
+	}
+
+	for _, d := range strings.Fields(strings.ToLower(domains)) {
+		if d == "*" || d == domain || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
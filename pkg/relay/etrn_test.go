@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"context"
+	"net/smtp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestETRNAllowed(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		domains string
+		domain  string
+		allowed bool
+	}{
+		{"", "example.com", false},
+		{"example.com", "example.com", true},
+		{"Example.com example.org", "example.org", true},
+		{"example.com", "mail.example.com", true},
+		{"example.com", "badexample.com", false},
+		{"mail.example.com", "example.com", false},
+		{"*", "example.net", true},
+		{"*", "", false},
+	} {
+		assert.Equal(t, tc.allowed, etrnAllowed(tc.domains, tc.domain), "%q %q", tc.domains, tc.domain)
+	}
+}
+
+func TestETRN(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	u := startFakeUpstream(t, "SMTPUTF8", "8BITMIME")
+	u.setReply("RCPT TO:<ALICE@EXAMPLE.ORG>", "451 4.3.0 try again later")
+
+	addr := startRelayConfig(ctx, t, "", &config{
+		remoteHost:    u.addr,
+		queueDir:      t.TempDir(),
+		queueRetryMin: time.Hour,
+		queueRetryMax: time.Hour,
+		queueMaxAge:   time.Hour,
+		etrnDomains:   "example.org",
+	})
+
+	// the delivery fails temporarily, the message is queued
+	sendMsg(t, addr, []string{"alice@example.org"}, "bob@example.com", "test", nil, "hello")
+
+	_, data := u.received()
+	assert.Empty(t, data)
+
+	u.setReply("RCPT TO:<ALICE@EXAMPLE.ORG>", "250 ok")
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = c.Close() })
+
+	ok, _ := c.Extension("ETRN")
+	assert.True(t, ok)
+
+	for _, tc := range []struct {
+		cmd  string
+		code int
+		msg  string
+	}{
+		{"ETRN", 502, "5.5.4 Missing parameter"},
+		{"ETRN #queue", 458, "4.3.0 Unable to queue messages for node #queue"},
+		{"ETRN example.com", 459, "4.7.1 Node example.com not allowed"},
+		{"ETRN mail.example.org", 251, "2.0.0 No messages waiting for node mail.example.org"},
+		{"ETRN Example.org", 253, "2.0.0 1 pending messages for node Example.org started"},
+	} {
+		id, err := c.Text.Cmd("%s", tc.cmd)
+		require.NoError(t, err)
+
+		c.Text.StartResponse(id)
+		code, msg, _ := c.Text.ReadResponse(tc.code)
+		c.Text.EndResponse(id)
+
+		assert.Equal(t, tc.code, code, tc.cmd)
+		assert.Equal(t, tc.msg, msg, tc.cmd)
+	}
+
+	// the queued message is delivered at once
+	assert.Eventually(t, func() bool {
+		_, data := u.received()
+		return len(data) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
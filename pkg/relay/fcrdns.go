@@ -0,0 +1,220 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// FCrDNS modes
+const (
+	fcrdnsModeReject = "reject" // reject clients failing the check
+	fcrdnsModeTag    = "tag"    // never reject, only log and add the header
+)
+
+// Results of the FCrDNS checks
+const (
+	fcrdnsPass      = "pass"      // a PTR name resolves back to the client IP
+	fcrdnsFail      = "fail"      // no PTR name resolves back to the client IP
+	fcrdnsNone      = "none"      // the client IP has no PTR record
+	fcrdnsTempError = "temperror" // the DNS lookups failed
+)
+
+// fcrdnsHeader is added to the messages of unauthenticated clients in tag
+// mode, with the result of the check
+const fcrdnsHeader = "X-Smtprelay-FCrDNS"
+
+const (
+	// how long the FCrDNS results of an IP address are kept
+	fcrdnsCacheTTL = 10 * time.Minute
+
+	// max duration of the lookups of an IP address
+	fcrdnsTimeout = 10 * time.Second
+
+	// max PTR names of an IP address resolved back
+	fcrdnsMaxNames = 10
+)
+
+var (
+	errFCrDNSFail      = &smtpd.Error{Code: 550, EnhancedCode: "5.7.25", Msg: "Reverse DNS validation failed"}
+	errFCrDNSTempError = &smtpd.Error{Code: 421, EnhancedCode: "4.7.25", Msg: "Reverse DNS validation failed, try again later"}
+)
+
+// fcrdnsResult is the outcome of the FCrDNS check of an IP address
+type fcrdnsResult struct {
+	result  string
+	name    string // PTR name resolving back to the IP address, if any
+	ip      net.IP
+	expires time.Time
+}
+
+// fcrdnsChecker verifies that the IP addresses of the clients have a PTR
+// record whose name resolves back to them (forward-confirmed reverse DNS)
+type fcrdnsChecker struct {
+	mode string
+
+	// lookupAddr and lookupIP override the DNS lookups - for tests
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+	lookupIP   func(ctx context.Context, network, host string) ([]net.IP, error)
+
+	mu    sync.Mutex
+	cache map[string]*fcrdnsResult
+
+	logger *slog.Logger
+}
+
+func newFCrDNSChecker(mode string) (*fcrdnsChecker, error) {
+	switch mode {
+	case fcrdnsModeReject, fcrdnsModeTag:
+	default:
+		return nil, fmt.Errorf("unknown FCrDNS mode %q", mode)
+	}
+
+	return &fcrdnsChecker{
+		mode:       mode,
+		lookupAddr: net.DefaultResolver.LookupAddr,
+		lookupIP:   net.DefaultResolver.LookupIP,
+		cache:      map[string]*fcrdnsResult{},
+		logger:     slog.Default().With(slog.String("component", "fcrdns")),
+	}, nil
+}
+
+// check verifies the reverse DNS of the peer, and returns the SMTP error to
+// reply with if it should be rejected. Loopback and private addresses aren't
+// checked.
+func (c *fcrdnsChecker) check(ctx context.Context, peer smtpd.Peer) error {
+	res := c.result(ctx, peer)
+	if res == nil {
+		return nil
+	}
+
+	log := c.logger.With(
+		slog.String("ip", res.ip.String()),
+		slog.String("fcrdns_result", res.result),
+	)
+
+	switch {
+	case res.result == fcrdnsPass:
+		log.DebugContext(ctx, "FCrDNS check passed", slog.String("name", res.name))
+		return nil
+	case c.mode == fcrdnsModeTag:
+		log.InfoContext(ctx, "FCrDNS check failed")
+		return nil
+	case res.result == fcrdnsTempError:
+		log.WarnContext(ctx, "FCrDNS check failed temporarily, deferring connection")
+		return observeErr(ctx, errFCrDNSTempError)
+	default:
+		log.WarnContext(ctx, "FCrDNS check failed, rejecting connection")
+		return observeErr(ctx, errFCrDNSFail)
+	}
+}
+
+// result returns the FCrDNS result for the peer, resolving its IP address if
+// it isn't cached, or nil if the address isn't checked
+func (c *fcrdnsChecker) result(ctx context.Context, peer smtpd.Peer) *fcrdnsResult {
+	ip := peerIP(peer)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return nil
+	}
+
+	key := ip.String()
+	now := time.Now()
+
+	c.mu.Lock()
+	res, ok := c.cache[key]
+	c.mu.Unlock()
+
+	if ok && now.Before(res.expires) {
+		return res
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fcrdnsTimeout)
+	defer cancel()
+
+	res = &fcrdnsResult{ip: ip, expires: now.Add(fcrdnsCacheTTL)}
+	res.result, res.name = c.resolve(ctx, ip)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, r := range c.cache {
+		if now.After(r.expires) {
+			delete(c.cache, k)
+		}
+	}
+
+	c.cache[key] = res
+
+	return res
+}
+
+// resolve looks up the PTR names of the IP address, and resolves them until
+// one has the IP address among its addresses
+func (c *fcrdnsChecker) resolve(ctx context.Context, ip net.IP) (result, name string) {
+	names, err := c.lookupAddr(ctx, ip.String())
+	if err != nil {
+		if isNotFound(err) {
+			return fcrdnsNone, ""
+		}
+
+		c.logger.WarnContext(ctx, "PTR lookup failed", slog.String("ip", ip.String()), slog.Any("error", err))
+
+		return fcrdnsTempError, ""
+	}
+
+	if len(names) > fcrdnsMaxNames {
+		names = names[:fcrdnsMaxNames]
+	}
+
+	network := "ip6"
+	if ip.To4() != nil {
+		network = "ip4"
+	}
+
+	result = fcrdnsFail
+
+	for _, name := range names {
+		addrs, err := c.lookupIP(ctx, network, name)
+		if err != nil {
+			if !isNotFound(err) {
+				c.logger.WarnContext(ctx, "lookup of PTR name failed", slog.String("name", name), slog.Any("error", err))
+
+				result = fcrdnsTempError
+			}
+
+			continue
+		}
+
+		for _, addr := range addrs {
+			if addr.Equal(ip) {
+				return fcrdnsPass, strings.TrimSuffix(name, ".")
+			}
+		}
+	}
+
+	return result, ""
+}
+
+// header returns the value of the FCrDNS header for the result
+func (res *fcrdnsResult) header() string {
+	fields := []string{res.result, fmt.Sprintf("client-ip=%s;", res.ip)}
+	if res.name != "" {
+		fields = append(fields, fmt.Sprintf("name=%s;", res.name))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// isNotFound reports whether the DNS lookup failed because the name doesn't
+// exist or has no records of the type
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
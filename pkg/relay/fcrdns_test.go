@@ -0,0 +1,113 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFCrDNSChecker(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	notFound := &net.DNSError{Err: "no such host", IsNotFound: true}
+	timeout := &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+
+	ptrs := map[string][]string{
+		"192.0.2.1":   {"other.example.", "mail.example."},
+		"192.0.2.2":   {"spoofed.example."},
+		"192.0.2.4":   {"broken.example."},
+		"2001:db8::1": {"mail6.example."},
+	}
+
+	addrs := map[string][]net.IP{
+		"other.example.":   {net.ParseIP("192.0.2.99")},
+		"mail.example.":    {net.ParseIP("192.0.2.1")},
+		"spoofed.example.": {net.ParseIP("192.0.2.200")},
+		"mail6.example.":   {net.ParseIP("2001:db8::1")},
+	}
+
+	newChecker := func(mode string) *fcrdnsChecker {
+		c, err := newFCrDNSChecker(mode)
+		require.NoError(t, err)
+
+		c.lookupAddr = func(_ context.Context, addr string) ([]string, error) {
+			switch addr {
+			case "192.0.2.5":
+				return nil, timeout
+			default:
+				if names, ok := ptrs[addr]; ok {
+					return names, nil
+				}
+
+				return nil, notFound
+			}
+		}
+
+		c.lookupIP = func(_ context.Context, _, host string) ([]net.IP, error) {
+			if host == "broken.example." {
+				return nil, timeout
+			}
+
+			if ips, ok := addrs[host]; ok {
+				return ips, nil
+			}
+
+			return nil, notFound
+		}
+
+		return c
+	}
+
+	peer := func(ip string) smtpd.Peer {
+		return smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25}}
+	}
+
+	c := newChecker(fcrdnsModeReject)
+
+	for _, tc := range []struct {
+		ip     string
+		result string
+		err    error
+	}{
+		{"192.0.2.1", fcrdnsPass, nil},
+		{"2001:db8::1", fcrdnsPass, nil},
+		{"192.0.2.2", fcrdnsFail, errFCrDNSFail},
+		{"192.0.2.3", fcrdnsNone, errFCrDNSFail},
+		{"192.0.2.4", fcrdnsTempError, errFCrDNSTempError},
+		{"192.0.2.5", fcrdnsTempError, errFCrDNSTempError},
+	} {
+		t.Run(tc.ip, func(t *testing.T) {
+			err := c.check(ctx, peer(tc.ip))
+			if tc.err == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, tc.err)
+			}
+
+			assert.Equal(t, tc.result, c.result(ctx, peer(tc.ip)).result)
+		})
+	}
+
+	assert.Equal(t, "pass client-ip=192.0.2.1; name=mail.example;", c.result(ctx, peer("192.0.2.1")).header())
+	assert.Equal(t, "fail client-ip=192.0.2.2;", c.result(ctx, peer("192.0.2.2")).header())
+
+	// private and loopback addresses aren't checked
+	require.NoError(t, c.check(ctx, peer("10.0.0.1")))
+	require.NoError(t, c.check(ctx, peer("::1")))
+	assert.Nil(t, c.result(ctx, peer("127.0.0.1")))
+
+	// tag mode never rejects
+	c = newChecker(fcrdnsModeTag)
+
+	require.NoError(t, c.check(ctx, peer("192.0.2.2")))
+	require.NoError(t, c.check(ctx, peer("192.0.2.4")))
+
+	_, err := newFCrDNSChecker("log-only")
+	require.Error(t, err)
+}
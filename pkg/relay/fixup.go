@@ -0,0 +1,64 @@
+package relay
+
+import (
+	"context"
+	"log/slog"
+	"net/textproto"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// fixupStage repairs the headers of the messages which lack the Message-ID,
+// Date or From header if fix_headers is set, as many devices (e.g. printers
+// and IoT sensors) send such messages, which upstreams reject (RFC 5322
+// section 3.6)
+func (r *relay) fixupStage(next smtpd.Handler) smtpd.Handler {
+	return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+		if cfg := r.config(ctx); cfg.fixHeaders {
+			completeHeaders(ctx, &env, cfg.hostName, true)
+		}
+
+		return next(ctx, peer, env)
+	}
+}
+
+// completeHeaders adds the Message-ID and Date headers to the message if
+// they're missing, with a Message-ID on the host name, and the From header
+// too if from is set, with the envelope sender, or MAILER-DAEMON for the
+// null sender. The Header of the envelope is updated too, for the next
+// stages.
+func completeHeaders(ctx context.Context, env *smtpd.Envelope, hostName string, from bool) {
+	logger := slog.With(slog.String("component", "fixup"), slog.String("uuid", messageUUID(ctx)))
+
+	header := textproto.MIMEHeader{}
+	for k, v := range env.Header {
+		header[k] = v
+	}
+
+	add := func(key, value string) {
+		logger.DebugContext(ctx, "adding missing header", slog.String("header", key), slog.String("value", value))
+
+		env.AddHeader(key, value)
+		header.Set(key, value)
+	}
+
+	if from && header.Get("From") == "" {
+		sender := env.Sender
+		if sender == "" {
+			sender = "MAILER-DAEMON@" + hostName
+		}
+
+		add("From", "<"+sender+">")
+	}
+
+	if header.Get("Date") == "" {
+		add("Date", time.Now().Format(time.RFC1123Z))
+	}
+
+	if header.Get("Message-Id") == "" {
+		add("Message-ID", "<"+generateUUID()+"@"+hostName+">")
+	}
+
+	env.Header = header
+}
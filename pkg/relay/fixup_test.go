@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFixupStage(t *testing.T) {
+	t.Parallel()
+
+	u := startFakeUpstream(t)
+
+	conf := newConfigStore(&config{remoteHost: u.addr, hostName: "relay.example.com", noReceived: true})
+
+	r, err := newRelay(conf, listenerConfig{}, &relayShared{})
+	require.NoError(t, err)
+
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345}}
+
+	send := func(sender, data string) {
+		t.Helper()
+
+		header := map[string][]string{}
+		if strings.HasPrefix(data, "From:") {
+			header["From"] = []string{"<device@example.com>"}
+		}
+
+		require.NoError(t, r.server.Handler(context.Background(), peer, smtpd.Envelope{
+			Sender:     sender,
+			Recipients: []string{"alice@example.org"},
+			Header:     header,
+			Data:       []byte(data),
+		}))
+	}
+
+	// messages are left as is unless fix_headers is set
+	send("device@example.com", "Subject: alarm\r\n\r\nhello\r\n")
+
+	cfg := *conf.get()
+	cfg.fixHeaders = true
+	conf.cfg.Store(&cfg)
+
+	send("device@example.com", "Subject: alarm\r\n\r\nhello\r\n")
+	send("", "Subject: alarm\r\n\r\nhello\r\n")
+	send("device@example.com", "From: <device@example.com>\r\n\r\nhello\r\n")
+
+	_, msgs := u.received()
+	require.Len(t, msgs, 4)
+
+	assert.Equal(t, "Subject: alarm\n\nhello\n", msgs[0])
+	assert.Regexp(t, `^Message-ID: <[0-9a-f-]+@relay\.example\.com>\nDate: .+\nFrom: <device@example\.com>\nSubject: alarm\n`, msgs[1])
+	assert.Regexp(t, `\nFrom: <MAILER-DAEMON@relay\.example\.com>\nSubject: alarm\n`, msgs[2])
+	assert.Regexp(t, `^Message-ID: .+\nDate: .+\nFrom: <device@example\.com>\n\nhello\n$`, msgs[3])
+}
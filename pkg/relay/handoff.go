@@ -0,0 +1,289 @@
+package relay
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upstreamQueueIDREs match the ID the upstream queued the message as in its
+// reply, e.g. "2.0.0 Ok: queued as 4B1C31234" (Postfix),
+// "OK id=1rABCD-000123-AB" (Exim) or "2.0.0 4B1C31234 Message accepted for
+// delivery" (Sendmail)
+var upstreamQueueIDREs = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bqueued as ([^\s;,]+)`),
+	regexp.MustCompile(`(?i)\bid=([^\s;,]+)`),
+	regexp.MustCompile(`(?i)^(?:[245]\.\d{1,3}\.\d{1,3} )?(\S+) message accepted for delivery`),
+}
+
+// upstreamQueueID returns the ID the upstream queued the message as, parsed
+// from its reply, empty if it doesn't give one
+func upstreamQueueID(reply string) string {
+	for _, re := range upstreamQueueIDREs {
+		if m := re.FindStringSubmatch(reply); m != nil {
+			return m[1]
+		}
+	}
+
+	return ""
+}
+
+// handoffEvent is the body of the requests to delivery_notify_url
+type handoffEvent struct {
+	Time            time.Time `json:"time"`
+	ID              string    `json:"id"`
+	QueueID         string    `json:"queue_id,omitempty"`
+	MessageID       string    `json:"message_id,omitempty"`
+	Sender          string    `json:"sender"`
+	Recipients      []string  `json:"recipients"`
+	Upstream        string    `json:"upstream"`
+	Reply           string    `json:"reply,omitempty"`
+	UpstreamQueueID string    `json:"upstream_queue_id,omitempty"`
+}
+
+// handoffNotifier reports the messages accepted by the upstreams, with a
+// success DSN to their sender (RFC 3461 section 5.2.2) for the recipients
+// which asked for it with NOTIFY=SUCCESS if the upstream doesn't support DSN,
+// and with a POST request to delivery_notify_url.
+type handoffNotifier struct {
+	conf      *configStore
+	router    *router       // routes the DSNs to the senders
+	upstreams *upstreamPool // delivers the DSNs
+	queue     *queue        // nil to drop the DSNs which fail temporarily
+	client    *http.Client
+
+	logger *slog.Logger
+}
+
+func newHandoffNotifier(conf *configStore, upstreams *upstreamPool, q *queue) (*handoffNotifier, error) {
+	cfg := conf.get()
+
+	router, err := parseRoutes(cfg.remoteHost, cfg.delivery == deliveryMX)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse remote_host %q: %w", cfg.remoteHost, err)
+	}
+
+	return &handoffNotifier{
+		conf:      conf,
+		router:    router,
+		upstreams: upstreams,
+		queue:     q,
+		client:    &http.Client{},
+		logger:    slog.Default().With(slog.String("component", "handoff")),
+	}, nil
+}
+
+// delivered notifies the delivery of the message data to the recipients of
+// the attempt, which the upstream accepted
+func (n *handoffNotifier) delivered(ctx context.Context, a *deliveryAttempt, data []byte) {
+	if n == nil {
+		return
+	}
+
+	cfg := n.conf.get()
+	if cfg.delivery == deliveryDiscard {
+		return
+	}
+
+	logger := n.logger.With(slog.String("id", a.id), slog.String("from", a.out.Sender))
+
+	if cfg.successDSN && !a.out.upstreamDSN && a.out.Sender != "" {
+		n.sendDSN(ctx, logger, cfg, a, data)
+	}
+
+	if cfg.deliveryNotifyURL != "" {
+		if err := n.post(ctx, cfg, a); err != nil {
+			logger.WarnContext(ctx, "could not notify delivery", slog.Any("error", err))
+		}
+	}
+}
+
+// sendDSN sends the success DSN of the recipients which asked for it, queueing
+// it if its delivery fails temporarily
+func (n *handoffNotifier) sendDSN(ctx context.Context, logger *slog.Logger, cfg *config, a *deliveryAttempt, data []byte) {
+	rcpts := []string{}
+
+	for _, rcpt := range a.recipients {
+		if strings.Contains(strings.ToUpper(a.out.DSN[rcpt].Notify), "SUCCESS") {
+			rcpts = append(rcpts, rcpt)
+		}
+	}
+
+	if len(rcpts) == 0 {
+		return
+	}
+
+	dsn := successMessage(cfg.hostName, a, rcpts, data, time.Now())
+
+	out := &outbound{
+		Host:       n.router.match(a.out.Sender),
+		Recipients: []string{a.out.Sender},
+		SMTPUTF8:   a.out.SMTPUTF8,
+		Body8Bit:   a.out.Body8Bit,
+		Size:       int64(len(dsn)),
+	}
+
+	err := n.upstreams.send(ctx, cfg, out, bytes.NewReader(dsn))
+	if err != nil && n.queue != nil && isTemporaryErr(err) {
+		id, qerr := n.queue.enqueue(out, dsn, err)
+		if qerr == nil {
+			logger.InfoContext(ctx, "success notification queued for sender", slog.String("dsn_id", id))
+			return
+		}
+
+		logger.ErrorContext(ctx, "could not queue success notification", slog.Any("error", qerr))
+	}
+
+	if err != nil {
+		logger.ErrorContext(ctx, "could not send success notification", slog.Any("error", err))
+		return
+	}
+
+	logger.InfoContext(ctx, "success notification sent to sender", slog.Any("to", rcpts))
+}
+
+// post sends the handoffEvent of the attempt to delivery_notify_url, signed
+// like the webhook delivery requests
+func (n *handoffNotifier) post(ctx context.Context, cfg *config, a *deliveryAttempt) error {
+	body, err := json.Marshal(handoffEvent{
+		Time:            time.Now().UTC(),
+		ID:              a.id,
+		QueueID:         a.queueID,
+		MessageID:       a.messageID,
+		Sender:          a.out.Sender,
+		Recipients:      a.recipients,
+		Upstream:        cmp.Or(a.out.sentVia, a.out.Host),
+		Reply:           a.out.reply,
+		UpstreamQueueID: upstreamQueueID(a.out.reply),
+	})
+	if err != nil {
+		return err
+	}
+
+	if cfg.webhookTimeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, cfg.webhookTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.deliveryNotifyURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if cfg.webhookSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(cfg.webhookSecret, timestamp, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
+	return nil
+}
+
+// successMessage returns the delivery status notification of the relay of
+// the message to the recipients (RFC 3464), sent back to its sender. It's a
+// multipart/report with a human readable explanation, the delivery status of
+// each recipient, and the headers of the message.
+func successMessage(hostName string, a *deliveryAttempt, rcpts []string, data []byte, now time.Time) []byte {
+	var (
+		b  bytes.Buffer
+		mw = multipart.NewWriter(&b)
+	)
+
+	upstream := cmp.Or(a.out.sentVia, a.out.Host)
+	if host, _, err := net.SplitHostPort(upstream); err == nil {
+		upstream = host
+	}
+
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", hostName)
+	fmt.Fprintf(&b, "To: <%s>\r\n", a.out.Sender)
+	b.WriteString("Subject: Successful Mail Delivery Report\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", generateUUID(), hostName)
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n", mw.Boundary())
+	b.WriteString("\r\n")
+	b.WriteString("This is a MIME-encapsulated message.\r\n\r\n")
+
+	// human readable explanation
+	w, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"text/plain; charset=utf-8"},
+		"Content-Description": {"Notification"},
+	})
+
+	fmt.Fprintf(w, "This is the mail system at host %s.\r\n\r\n", hostName)
+	fmt.Fprint(w, "Your message was successfully relayed to the following recipients, as you\r\n")
+	fmt.Fprint(w, "requested. The destination doesn't support delivery notifications, so no\r\n")
+	fmt.Fprint(w, "further notifications will be sent.\r\n\r\n")
+
+	for _, rcpt := range rcpts {
+		fmt.Fprintf(w, "<%s>: relayed to %s\r\n", rcpt, upstream)
+	}
+
+	// machine readable status
+	w, _ = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"message/delivery-status"},
+		"Content-Description": {"Delivery report"},
+	})
+
+	fmt.Fprintf(w, "Reporting-MTA: dns; %s\r\n", hostName)
+
+	if a.out.DSNEnvID != "" {
+		fmt.Fprintf(w, "Original-Envelope-Id: %s\r\n", a.out.DSNEnvID)
+	}
+
+	for _, rcpt := range rcpts {
+		fmt.Fprint(w, "\r\n")
+
+		if orcpt := a.out.DSN[rcpt].ORcpt; orcpt != "" {
+			fmt.Fprintf(w, "Original-Recipient: %s\r\n", orcpt)
+		}
+
+		fmt.Fprintf(w, "Final-Recipient: rfc822; %s\r\n", rcpt)
+		fmt.Fprint(w, "Action: relayed\r\n")
+		fmt.Fprint(w, "Status: 2.0.0\r\n")
+		fmt.Fprintf(w, "Remote-MTA: dns; %s\r\n", upstream)
+
+		if a.out.reply != "" {
+			fmt.Fprintf(w, "Diagnostic-Code: smtp; 250 %s\r\n", strings.ReplaceAll(a.out.reply, "\n", " "))
+		}
+	}
+
+	// headers of the message, success notifications never return it whole
+	w, _ = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"text/rfc822-headers"},
+		"Content-Description": {"Delivered message headers"},
+	})
+
+	_, _ = w.Write(messageHeaders(data))
+
+	_ = mw.Close()
+
+	return b.Bytes()
+}
@@ -0,0 +1,145 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamQueueID(t *testing.T) {
+	t.Parallel()
+
+	for reply, expected := range map[string]string{
+		"2.0.0 Ok: queued as 4B1C31234":                      "4B1C31234",
+		"OK id=1rABCD-000123-AB":                             "1rABCD-000123-AB",
+		"2.0.0 4B1C31234 Message accepted for delivery":      "4B1C31234",
+		"4B1C31234 Message accepted for delivery":            "4B1C31234",
+		"2.0.0 OK 1700000000 x1-20020a17.123 - gsmtp":        "",
+		"Queued as abc123; thanks":                           "abc123",
+		"":                                                   "",
+		"2.0.0 Ok: queued as 4B1C31234, id=1rABCD-000123-AB": "4B1C31234",
+	} {
+		assert.Equal(t, expected, upstreamQueueID(reply), reply)
+	}
+}
+
+func TestSuccessMessage(t *testing.T) {
+	t.Parallel()
+
+	a := &deliveryAttempt{
+		id: "uuid",
+		out: &outbound{
+			Sender:   "bob@example.com",
+			sentVia:  "mx.example.org:25",
+			DSNEnvID: "env-1",
+			DSN: map[string]smtpd.RecipientDSN{
+				"alice@example.org": {Notify: "SUCCESS", ORcpt: "rfc822;Alice@example.org"},
+			},
+			reply: "2.0.0 Ok: queued as 4B1C31234",
+		},
+		recipients: []string{"alice@example.org", "carol@example.org"},
+	}
+
+	data := []byte("Subject: lunch\r\nMessage-ID: <1@example.com>\r\n\r\nhello\r\n")
+	msg := string(successMessage("relay.example.com", a, []string{"alice@example.org"}, data, time.Now()))
+
+	assert.Contains(t, msg, "To: <bob@example.com>\r\n")
+	assert.Contains(t, msg, "Subject: Successful Mail Delivery Report\r\n")
+	assert.Contains(t, msg, "Content-Type: multipart/report; report-type=delivery-status;")
+	assert.Contains(t, msg, "Original-Envelope-Id: env-1\r\n")
+	assert.Contains(t, msg, "Original-Recipient: rfc822;Alice@example.org\r\n")
+	assert.Contains(t, msg, "Final-Recipient: rfc822; alice@example.org\r\n")
+	assert.Contains(t, msg, "Action: relayed\r\n")
+	assert.Contains(t, msg, "Remote-MTA: dns; mx.example.org\r\n")
+	assert.Contains(t, msg, "Diagnostic-Code: smtp; 250 2.0.0 Ok: queued as 4B1C31234\r\n")
+	assert.Contains(t, msg, "Subject: lunch\r\n")
+	assert.NotContains(t, msg, "carol@example.org")
+	assert.NotContains(t, msg, "hello")
+}
+
+func TestHandoffNotifier(t *testing.T) {
+	t.Parallel()
+
+	events := make(chan handoffEvent, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		timestamp := r.Header.Get(webhookTimestampHeader)
+		assert.Equal(t, "sha256="+webhookSignature("secret", timestamp, body), r.Header.Get(webhookSignatureHeader))
+
+		var event handoffEvent
+		assert.NoError(t, json.Unmarshal(body, &event))
+
+		events <- event
+	}))
+	t.Cleanup(srv.Close)
+
+	u := startFakeUpstream(t, "SMTPUTF8", "8BITMIME")
+
+	cfg := &config{
+		hostName:          "relay.example.com",
+		remoteHost:        u.addr,
+		successDSN:        true,
+		deliveryNotifyURL: srv.URL,
+		webhookSecret:     "secret",
+		webhookTimeout:    time.Second,
+	}
+
+	n, err := newHandoffNotifier(newConfigStore(cfg), newUpstreamPool(0, time.Minute), nil)
+	require.NoError(t, err)
+
+	env := &smtpd.Envelope{
+		Sender:     "bob@example.com",
+		Recipients: []string{"alice@example.org", "carol@example.org"},
+		DSN: map[string]smtpd.RecipientDSN{
+			"alice@example.org": {Notify: "SUCCESS,FAILURE"},
+			"carol@example.org": {Notify: "NEVER"},
+		},
+	}
+	out := newOutbound(env, u.addr, env.Sender, env.Recipients)
+	data := []byte("Subject: lunch\r\n\r\nhello\r\n")
+
+	// the upstream doesn't support DSN, so the relay reports the handoff
+	require.NoError(t, sendMail(cfg, out, data))
+	assert.Equal(t, "queued as 12345", out.reply)
+	assert.False(t, out.upstreamDSN)
+
+	n.delivered(context.Background(), &deliveryAttempt{id: "uuid", out: out, recipients: env.Recipients}, data)
+
+	commands, received := u.received()
+	require.Len(t, received, 2)
+	assert.Contains(t, commands, "MAIL FROM:<>")
+	assert.Contains(t, commands, "RCPT TO:<bob@example.com>")
+	assert.Contains(t, received[1], "Final-Recipient: rfc822; alice@example.org\n")
+	assert.Contains(t, received[1], "Action: relayed\n")
+	assert.NotContains(t, received[1], "carol@example.org")
+
+	select {
+	case event := <-events:
+		assert.Equal(t, "uuid", event.ID)
+		assert.Equal(t, "bob@example.com", event.Sender)
+		assert.Equal(t, env.Recipients, event.Recipients)
+		assert.Equal(t, u.addr, event.Upstream)
+		assert.Equal(t, "12345", event.UpstreamQueueID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery not notified")
+	}
+
+	// the upstream sends the DSN itself
+	out.upstreamDSN = true
+	n.delivered(context.Background(), &deliveryAttempt{id: "uuid", out: out, recipients: env.Recipients}, data)
+
+	_, received = u.received()
+	assert.Len(t, received, 2)
+	assert.True(t, strings.HasPrefix((<-events).Reply, "queued as"))
+}
@@ -0,0 +1,213 @@
+package relay
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// Header rule actions
+const (
+	headerAdd     = "add"     // add a header field
+	headerRemove  = "remove"  // remove all the fields with the name
+	headerReplace = "replace" // replace the matches of a regexp in the values of the fields
+)
+
+// clientHeaders are the headers disclosing the hosts and software of the
+// clients, removed from relayed messages by strip_client_headers
+var clientHeaders = []string{"Received", "X-Mailer", "User-Agent", "X-Originating-IP"}
+
+// headerRule is a transformation of the headers of relayed messages
+type headerRule struct {
+	action string
+	name   string
+	value  string         // added value, or replacement of the matches
+	re     *regexp.Regexp // for headerReplace
+}
+
+// headerRules are the header transformations applied to relayed messages
+// before they're forwarded: the global rules to all the messages, then the
+// rules of the listener the message was received on, then the ones of the
+// upstream host it's delivered to
+type headerRules struct {
+	global    []headerRule
+	listeners map[string][]headerRule // by listen address
+	routes    map[string][]headerRule // by upstream host
+}
+
+// loadHeaderRules reads the header rules from file. Each line is a rule, in
+// one of the forms:
+//
+//	add Name: value
+//	remove Name
+//	replace Name /regexp/replacement/
+//
+// where the regexp and replacement of replace rules are delimited by the
+// first character after the name (e.g. / or |), and the replacement can
+// refer to the submatches as $1. The rules apply to all messages until a
+// "[listener address]" line, after which they only apply to the messages
+// received on the listen address (e.g. starttls://0.0.0.0:587), or a
+// "[route host]" line, after which they only apply to the messages delivered
+// to the upstream host, as given in remote_host (e.g. smtp.gmail.com:587).
+// Empty lines and lines starting with "#" are ignored.
+func loadHeaderRules(file string) (*headerRules, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := &headerRules{listeners: map[string][]headerRule{}, routes: map[string][]headerRule{}}
+
+	add := func(r headerRule) { rules.global = append(rules.global, r) }
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			kind, key, _ := strings.Cut(strings.TrimSpace(line[1:len(line)-1]), " ")
+			key = strings.TrimSpace(key)
+
+			var section map[string][]headerRule
+
+			switch {
+			case key == "":
+				return nil, fmt.Errorf("line %d: expected \"[listener address]\" or \"[route host]\"", n)
+			case kind == "listener":
+				section = rules.listeners
+			case kind == "route":
+				section = rules.routes
+			default:
+				return nil, fmt.Errorf("line %d: unknown section %q", n, kind)
+			}
+
+			add = func(r headerRule) { section[key] = append(section[key], r) }
+
+			continue
+		}
+
+		rule, err := parseHeaderRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		add(rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// parseHeaderRule parses a single rule, see loadHeaderRules
+func parseHeaderRule(line string) (headerRule, error) {
+	action, rest, _ := strings.Cut(line, " ")
+	rest = strings.TrimSpace(rest)
+
+	var (
+		rule = headerRule{action: action}
+		ok   bool
+	)
+
+	switch action {
+	case headerAdd:
+		rule.name, rule.value, ok = strings.Cut(rest, ":")
+		rule.value = strings.TrimSpace(rule.value)
+		if !ok || strings.ContainsAny(rule.value, "\r\n") {
+			return headerRule{}, errors.New(`expected "add Name: value"`)
+		}
+	case headerRemove:
+		rule.name = rest
+	case headerReplace:
+		var expr string
+
+		rule.name, expr, _ = strings.Cut(rest, " ")
+		expr = strings.TrimSpace(expr)
+
+		parts := []string{}
+		if expr != "" {
+			parts = strings.Split(expr[1:], expr[:1])
+		}
+
+		if len(parts) != 3 || parts[2] != "" {
+			return headerRule{}, errors.New(`expected "replace Name /regexp/replacement/"`)
+		}
+
+		re, err := regexp.Compile(parts[0])
+		if err != nil {
+			return headerRule{}, fmt.Errorf("invalid regexp %q: %w", parts[0], err)
+		}
+
+		rule.re, rule.value = re, parts[1]
+	default:
+		return headerRule{}, fmt.Errorf("unknown action %q", action)
+	}
+
+	rule.name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(rule.name))
+	if rule.name == "" || strings.ContainsAny(rule.name, " \t:") {
+		return headerRule{}, fmt.Errorf("invalid header name %q", rule.name)
+	}
+
+	return rule, nil
+}
+
+// forListener returns the global rules and the rules of the listener
+func (h *headerRules) forListener(l listenerConfig) []headerRule {
+	if h == nil {
+		return nil
+	}
+
+	rules := append([]headerRule{}, h.global...)
+	rules = append(rules, h.listeners[l.String()]...)
+
+	// tcp listeners may be given without scheme
+	if l.scheme == schemeTCP {
+		rules = append(rules, h.listeners[l.address]...)
+	}
+
+	return rules
+}
+
+// forRoute returns the rules of the upstream host
+func (h *headerRules) forRoute(host string) []headerRule {
+	if h == nil {
+		return nil
+	}
+
+	return h.routes[host]
+}
+
+// applyHeaderRules transforms the headers of the buffered message
+func applyHeaderRules(env *smtpd.Envelope, rules []headerRule) {
+	for _, rule := range rules {
+		switch rule.action {
+		case headerAdd:
+			env.AddHeader(rule.name, rule.value)
+		case headerRemove:
+			env.RemoveHeaders(rule.name, func(string) bool { return true })
+		case headerReplace:
+			env.ReplaceHeaders(rule.name, func(value string) string {
+				return rule.re.ReplaceAllString(value, rule.value)
+			})
+		}
+	}
+}
+
+// stripClientHeaders removes the client headers of the buffered message
+func stripClientHeaders(env *smtpd.Envelope) {
+	for _, name := range clientHeaders {
+		env.RemoveHeaders(name, func(string) bool { return true })
+	}
+}
@@ -0,0 +1,138 @@
+package relay
+
+import (
+	"context"
+	"net/textproto"
+	"path/filepath"
+	"testing"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadHeaderRules(t *testing.T) {
+	t.Parallel()
+
+	rules, err := loadHeaderRules(writeTestFile(t, "header_rules", `
+# global rules
+remove x-originating-ip
+
+[listener starttls://0.0.0.0:587]
+replace From |@[a-z.]+|@example.com|
+add X-Relay-Tenant: acme
+
+[route smtp.example.com:587]
+add X-Route: smtp
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, []headerRule{{action: headerRemove, name: "X-Originating-Ip"}}, rules.global)
+	require.Len(t, rules.listeners["starttls://0.0.0.0:587"], 2)
+	assert.Equal(t, "@example.com", rules.listeners["starttls://0.0.0.0:587"][0].value)
+	assert.Equal(t, "@[a-z.]+", rules.listeners["starttls://0.0.0.0:587"][0].re.String())
+	assert.Equal(t, []headerRule{{action: headerAdd, name: "X-Route", value: "smtp"}}, rules.forRoute("smtp.example.com:587"))
+	assert.Empty(t, rules.forRoute("mx.example.com:25"))
+
+	for _, line := range []string{
+		"drop X-Foo",
+		"add X-Foo",
+		"remove",
+		"remove X Foo",
+		"replace From /a/b",
+		"replace From /(/b/",
+		"[listener]",
+		"[host mx.example.com]",
+	} {
+		_, err = loadHeaderRules(writeTestFile(t, "header_rules", line))
+		require.Error(t, err, line)
+	}
+
+	_, err = loadHeaderRules(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
+
+func TestHeaderRulesForListener(t *testing.T) {
+	t.Parallel()
+
+	var rules *headerRules
+	assert.Nil(t, rules.forListener(listenerConfig{scheme: schemeTCP, address: "127.0.0.1:25"}))
+	assert.Nil(t, rules.forRoute("mx.example.com:25"))
+
+	rules = &headerRules{
+		global: []headerRule{{action: headerRemove, name: "A"}},
+		listeners: map[string][]headerRule{
+			"127.0.0.1:25":         {{action: headerRemove, name: "B"}},
+			"lmtp://127.0.0.1:24":  {{action: headerRemove, name: "C"}},
+			"tcp://127.0.0.1:2525": {{action: headerRemove, name: "D"}},
+		},
+	}
+
+	names := func(rules []headerRule) []string {
+		var names []string
+		for _, r := range rules {
+			names = append(names, r.name)
+		}
+
+		return names
+	}
+
+	assert.Equal(t, []string{"A", "B"}, names(rules.forListener(listenerConfig{scheme: schemeTCP, address: "127.0.0.1:25"})))
+	assert.Equal(t, []string{"A", "C"}, names(rules.forListener(listenerConfig{scheme: schemeLMTP, address: "127.0.0.1:24"})))
+	assert.Equal(t, []string{"A", "D"}, names(rules.forListener(listenerConfig{scheme: schemeTCP, address: "127.0.0.1:2525"})))
+	assert.Equal(t, []string{"A"}, names(rules.forListener(listenerConfig{scheme: schemeLMTP, address: "127.0.0.1:25"})))
+}
+
+func TestApplyHeaderRules(t *testing.T) {
+	t.Parallel()
+
+	rules, err := loadHeaderRules(writeTestFile(t, "header_rules", `
+remove X-Originating-IP
+replace From /@internal\.example\.com/@example.com/
+replace Subject /^(.*)$/[ext] $1/
+add X-Relay-Tenant: acme
+`))
+	require.NoError(t, err)
+
+	env := &smtpd.Envelope{Data: []byte("X-Originating-IP: 10.0.0.1\r\nFrom: Bob <bob@internal.example.com>\r\n" +
+		"Subject: test\r\n\r\nFrom: bob@internal.example.com\r\n")}
+	applyHeaderRules(env, rules.global)
+
+	assert.Equal(t, "X-Relay-Tenant: acme\r\nFrom: Bob <bob@example.com>\r\nSubject: [ext] test\r\n\r\n"+
+		"From: bob@internal.example.com\r\n", string(env.Data))
+}
+
+func TestHeaderRules(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv := startTestSMTPServer(ctx, t)
+	other := startTestSMTPServer(ctx, t)
+
+	rules, err := loadHeaderRules(writeTestFile(t, "header_rules", `
+remove X-Originating-IP
+
+[route `+other.addr+`]
+add X-Relay-Tenant: acme
+`))
+	require.NoError(t, err)
+
+	addr := startRelayConfig(ctx, t, "", &config{
+		remoteHost:  srv.addr + " *@other.example.com=" + other.addr,
+		headerRules: rules,
+	})
+
+	err = sendMsg(t, addr, []string{"alice@example.com", "carol@other.example.com"}, "bob@example.com", "test message",
+		textproto.MIMEHeader{"X-Originating-Ip": {"10.0.0.1"}}, "hello world")
+	require.NoError(t, err)
+
+	require.Len(t, *srv.msgs, 1)
+	assert.NotContains(t, string((*srv.msgs)[0].Data), "X-Originating-Ip")
+	assert.NotContains(t, string((*srv.msgs)[0].Data), "X-Relay-Tenant")
+
+	require.Len(t, *other.msgs, 1)
+	assert.NotContains(t, string((*other.msgs)[0].Data), "X-Originating-Ip")
+	assert.Contains(t, string((*other.msgs)[0].Data), "X-Relay-Tenant: acme\n")
+}
@@ -0,0 +1,218 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// max size of the responses of the auth endpoint
+const httpAuthMaxResponse = 64 << 10
+
+var (
+	errHTTPAuthDenied = errors.New("http auth: denied")
+
+	// errHTTPAuthUnavailable is replied when the auth endpoint fails, so that
+	// clients retry rather than consider their credentials wrong (RFC 4954)
+	errHTTPAuthUnavailable = &smtpd.Error{Code: 454, EnhancedCode: "4.7.0", Msg: "Temporary authentication failure"}
+)
+
+// httpAuthRequest is the body of the requests to the auth endpoint
+type httpAuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	ClientIP string `json:"client_ip,omitempty"`
+	HeloName string `json:"helo_name,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	TLS      bool   `json:"tls"`
+}
+
+// httpAuthPolicy is the body of the 2xx responses of the auth endpoint, with
+// the policy of allowed users
+type httpAuthPolicy struct {
+	Allow bool `json:"allow"`
+
+	// max size of the messages of the user, 0 for max_message_size
+	MaxMessageSize int64 `json:"max_message_size,omitempty"`
+
+	// domains the user may send from, any if empty
+	AllowedSenderDomains []string `json:"allowed_sender_domains,omitempty"`
+}
+
+// senderAllowed reports whether the policy allows the user to send from the
+// address
+func (p *httpAuthPolicy) senderAllowed(addr string) bool {
+	if len(p.AllowedSenderDomains) == 0 {
+		return true
+	}
+
+	allowed := make([]string, 0, len(p.AllowedSenderDomains))
+	for _, domain := range p.AllowedSenderDomains {
+		allowed = append(allowed, "@"+strings.TrimPrefix(domain, "@"))
+	}
+
+	return addrAllowed(addr, allowed)
+}
+
+// httpAuthEntry is a cached answer of the auth endpoint, policy being nil if
+// it denied the credentials
+type httpAuthEntry struct {
+	policy  *httpAuthPolicy
+	expires time.Time
+}
+
+// httpAuth delegates the authentication of users to an HTTP endpoint, such as
+// an existing identity service: the credentials and peer details are posted
+// as JSON, and the endpoint replies with the user's policy. 401 and 403
+// responses deny the user, as does a policy which doesn't allow it. Answers
+// are cached by credentials, so that the policy is known for the rest of the
+// session without querying the endpoint again.
+type httpAuth struct {
+	url    string
+	token  string
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]*httpAuthEntry // by hash of the credentials
+
+	logger *slog.Logger
+}
+
+// newHTTPAuth returns nil if url is empty
+func newHTTPAuth(url, token string, timeout, ttl time.Duration) *httpAuth {
+	if url == "" {
+		return nil
+	}
+
+	return &httpAuth{
+		url:    url,
+		token:  token,
+		ttl:    ttl,
+		client: &http.Client{Timeout: timeout},
+		cache:  map[[sha256.Size]byte]*httpAuthEntry{},
+		logger: slog.Default().With(slog.String("component", "http_auth")),
+	}
+}
+
+// authenticate checks the credentials of the peer with the endpoint,
+// returning the user's policy. It returns errHTTPAuthDenied if the endpoint
+// denied them, and errHTTPAuthUnavailable if it failed.
+func (a *httpAuth) authenticate(ctx context.Context, peer smtpd.Peer, username, password string) (*httpAuthPolicy, error) {
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	now := time.Now()
+
+	a.mu.Lock()
+	entry, ok := a.cache[key]
+	a.mu.Unlock()
+
+	if !ok || !now.Before(entry.expires) {
+		policy, err := a.post(ctx, peer, username, password)
+		if err != nil && !errors.Is(err, errHTTPAuthDenied) {
+			a.logger.WarnContext(ctx, "auth request failed",
+				slog.String("username", username), slog.Any("error", err))
+
+			return nil, errHTTPAuthUnavailable
+		}
+
+		entry = &httpAuthEntry{policy: policy, expires: now.Add(a.ttl)}
+
+		a.mu.Lock()
+
+		for k, e := range a.cache {
+			if now.After(e.expires) {
+				delete(a.cache, k)
+			}
+		}
+
+		a.cache[key] = entry
+
+		a.mu.Unlock()
+	}
+
+	if entry.policy == nil {
+		return nil, errHTTPAuthDenied
+	}
+
+	return entry.policy, nil
+}
+
+// policy returns the policy of the peer's authenticated user, nil if it
+// wasn't authenticated by the endpoint
+func (a *httpAuth) policy(ctx context.Context, peer smtpd.Peer) *httpAuthPolicy {
+	if a == nil || peer.Username == "" || peer.Password == "" {
+		return nil
+	}
+
+	policy, _ := a.authenticate(ctx, peer, peer.Username, peer.Password)
+
+	return policy
+}
+
+// post sends the credentials to the endpoint
+func (a *httpAuth) post(ctx context.Context, peer smtpd.Peer, username, password string) (*httpAuthPolicy, error) {
+	body := httpAuthRequest{
+		Username: username,
+		Password: password,
+		HeloName: peer.HeloName,
+		Protocol: string(peer.Protocol),
+		TLS:      peer.TLS != nil,
+	}
+
+	if ip := peerIP(peer); ip != nil {
+		body.ClientIP = ip.String()
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, errHTTPAuthDenied
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var policy httpAuthPolicy
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, httpAuthMaxResponse)).Decode(&policy); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+
+	if !policy.Allow {
+		return nil, errHTTPAuthDenied
+	}
+
+	return &policy, nil
+}
@@ -0,0 +1,180 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startFakeAuthEndpoint starts an auth endpoint allowing alice and bob, with
+// a policy for alice, and failing for erin
+func startFakeAuthEndpoint(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		if r.Header.Get("Authorization") != "Bearer s3cr3t" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var req httpAuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case req.Username == "alice" && req.Password == "alice-secret":
+			_ = json.NewEncoder(w).Encode(httpAuthPolicy{
+				Allow:                true,
+				MaxMessageSize:       16,
+				AllowedSenderDomains: []string{"example.com"},
+			})
+		case req.Username == "bob" && req.Password == "bob-secret" && req.ClientIP == "192.0.2.10" && req.TLS:
+			_, _ = w.Write([]byte(`{"allow": true}`))
+		case req.Username == "carol":
+			_, _ = w.Write([]byte(`{"allow": false}`))
+		case req.Username == "erin":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return srv, &requests
+}
+
+func TestHTTPAuth(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	srv, requests := startFakeAuthEndpoint(t)
+
+	a := newHTTPAuth(srv.URL, "s3cr3t", 5*time.Second, time.Minute)
+
+	peer := smtpd.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345},
+		TLS:  &tls.ConnectionState{},
+	}
+
+	policy, err := a.authenticate(ctx, peer, "alice", "alice-secret")
+	require.NoError(t, err)
+	assert.Equal(t, int64(16), policy.MaxMessageSize)
+	assert.True(t, policy.senderAllowed("alice@EXAMPLE.com"))
+	assert.False(t, policy.senderAllowed("alice@example.org"))
+
+	policy, err = a.authenticate(ctx, peer, "bob", "bob-secret")
+	require.NoError(t, err)
+	assert.True(t, policy.senderAllowed("bob@example.org"))
+
+	_, err = a.authenticate(ctx, peer, "alice", "wrong")
+	require.ErrorIs(t, err, errHTTPAuthDenied)
+
+	_, err = a.authenticate(ctx, peer, "carol", "carol-secret")
+	require.ErrorIs(t, err, errHTTPAuthDenied)
+
+	_, err = a.authenticate(ctx, peer, "erin", "erin-secret")
+	require.ErrorIs(t, err, errHTTPAuthUnavailable)
+
+	// the peer details are sent
+	_, err = a.authenticate(ctx, smtpd.Peer{}, "bob", "bob-secret2")
+	require.ErrorIs(t, err, errHTTPAuthDenied)
+
+	// answers are cached by credentials, but not failures
+	assert.Equal(t, int32(6), requests.Load())
+
+	_, err = a.authenticate(ctx, peer, "alice", "alice-secret")
+	require.NoError(t, err)
+	_, err = a.authenticate(ctx, peer, "alice", "wrong")
+	require.ErrorIs(t, err, errHTTPAuthDenied)
+	_, err = a.authenticate(ctx, peer, "erin", "erin-secret")
+	require.ErrorIs(t, err, errHTTPAuthUnavailable)
+
+	assert.Equal(t, int32(7), requests.Load())
+
+	// the policy is the one of the session's credentials
+	peer.Username, peer.Password = "alice", "alice-secret"
+	require.NotNil(t, a.policy(ctx, peer))
+
+	peer.Username, peer.Password = "alice", ""
+	assert.Nil(t, a.policy(ctx, peer))
+
+	// requests without the token are denied
+	a = newHTTPAuth(srv.URL, "", 5*time.Second, time.Minute)
+
+	_, err = a.authenticate(ctx, peer, "alice", "alice-secret")
+	require.ErrorIs(t, err, errHTTPAuthDenied)
+
+	assert.Nil(t, newHTTPAuth("", "", time.Second, time.Minute))
+}
+
+func TestHTTPAuthPolicy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	srv, _ := startFakeAuthEndpoint(t)
+
+	cfg := &config{
+		remoteHost: "127.0.0.1:9",
+		delivery:   deliveryDiscard,
+		httpAuth:   newHTTPAuth(srv.URL, "s3cr3t", 5*time.Second, time.Minute),
+	}
+
+	r, err := newRelay(newConfigStore(cfg), listenerConfig{}, &relayShared{})
+	require.NoError(t, err)
+
+	peer := smtpd.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345},
+		TLS:  &tls.ConnectionState{},
+	}
+
+	require.NoError(t, r.authChecker(ctx, peer, "alice", "alice-secret"))
+	require.ErrorIs(t, r.authChecker(ctx, peer, "alice", "wrong"), smtpd.ErrAuthInvalid)
+	require.ErrorIs(t, r.authChecker(ctx, peer, "erin", "erin-secret"), errHTTPAuthUnavailable)
+
+	peer.Username, peer.Password = "alice", "alice-secret"
+
+	// the sender domains apply without allowed_sender
+	checkSender := r.senderChecker("", "")
+	require.NoError(t, checkSender(ctx, peer, "alice@example.com"))
+	require.ErrorIs(t, checkSender(ctx, peer, "alice@example.org"), smtpd.ErrSenderDenied)
+
+	// and so does the max message size
+	handler := r.mailHandler()
+
+	env := smtpd.Envelope{
+		Sender:     "alice@example.com",
+		Recipients: []string{"bob@example.com"},
+		Data:       []byte("Subject: hi\r\n\r\nhello\r\n"),
+	}
+	require.ErrorIs(t, handler(ctx, peer, env), smtpd.ErrTooBig)
+
+	env.Data = []byte("\r\nhello\r\n")
+	require.NoError(t, handler(ctx, peer, env))
+
+	// users without a policy aren't restricted
+	peer.Username, peer.Password = "bob", "bob-secret"
+	env.Data = []byte(strings.Repeat("x", 64))
+
+	require.NoError(t, checkSender(ctx, peer, "bob@example.org"))
+	require.NoError(t, handler(ctx, peer, env))
+}
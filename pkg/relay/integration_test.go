@@ -0,0 +1,573 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testSMTPServer struct {
+	msgs *[]smtpd.Envelope
+	addr string
+}
+
+func startTestSMTPServer(ctx context.Context, t *testing.T) *testSMTPServer {
+	t.Helper()
+
+	msgs := &[]smtpd.Envelope{}
+	srv := &smtpd.Server{
+		ConnectionChecker: func(_ context.Context, peer smtpd.Peer) error {
+			t.Logf("Connection from %s", peer.HeloName)
+			return nil
+		},
+		HeloChecker: func(_ context.Context, peer smtpd.Peer, name string) error {
+			t.Logf("HELO (%s) %s", peer.Protocol, name)
+			return nil
+		},
+		SenderChecker: func(_ context.Context, _ smtpd.Peer, addr string) error {
+			t.Logf("MAIL FROM %s", addr)
+			return nil
+		},
+		RecipientChecker: func(_ context.Context, _ smtpd.Peer, addr string) error {
+			t.Logf("RCPT TO %s", addr)
+			return nil
+		},
+		Handler: func(_ context.Context, _ smtpd.Peer, env smtpd.Envelope) error {
+			t.Logf("DATA\n----\n%s\n----", env.Data)
+			m := append(*msgs, env)
+			*msgs = m
+			return nil
+		},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func(l net.Listener) {
+		_ = srv.Serve(ctx, l)
+	}(l)
+
+	t.Cleanup(func() {
+		_ = srv.Shutdown(false)
+	})
+
+	return &testSMTPServer{addr: l.Addr().String(), msgs: msgs}
+}
+
+func sendMsg(t *testing.T, addr string, to []string, from, subject string, hdrs textproto.MIMEHeader, body string) error {
+	t.Helper()
+
+	data := bytes.Buffer{}
+	data.WriteString("From: " + from + "\r\n")
+	data.WriteString("To: " + strings.Join(to, ", ") + "\r\n")
+	data.WriteString("Subject: " + subject + "\r\n")
+	for k, v := range hdrs {
+		data.WriteString(k + ": " + strings.Join(v, ", ") + "\r\n")
+	}
+	data.WriteString("\r\n")
+	data.WriteString(body)
+
+	return smtp.SendMail(addr, nil, from, to, data.Bytes())
+}
+
+// helper function to start the smtprelay
+//
+// TODO: refactor smtprelay to be more testable (allow passing in the logger and
+// metrics registry, provide a good way to shut down the server, etc...)
+func startRelay(ctx context.Context, t *testing.T, srvAddr string) string {
+	t.Helper()
+
+	return startRelayConfig(ctx, t, "", &config{remoteHost: srvAddr})
+}
+
+// startRelayConfig starts the smtprelay with the given config, listening with
+// the given scheme on a random port
+func startRelayConfig(ctx context.Context, t *testing.T, scheme string, cfg *config) string {
+	t.Helper()
+
+	addr, _ := runRelayConfig(ctx, t, scheme, cfg)
+
+	return addr
+}
+
+// runRelayConfig is like startRelayConfig, and also returns a channel
+// receiving the result of run once the relay has shut down
+func runRelayConfig(ctx context.Context, t *testing.T, scheme string, cfg *config) (string, <-chan error) {
+	t.Helper()
+
+	addr := ""
+	// pick a random port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr = l.Addr().String()
+	_ = l.Close()
+
+	cfg.listen = addr
+	if scheme != "" {
+		cfg.listen = scheme + "://" + addr
+	}
+
+	cfg.metricsListen = "127.0.0.1:0"
+	cfg.logLevel = "debug"
+
+	errc := make(chan error, 1)
+
+	go func() {
+		metricsRegistry = prometheus.NewRegistry()
+
+		errc <- fromConfig(cfg).Run(ctx)
+	}()
+
+	// wait for the server to start
+	for range 10 {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return addr, errc
+}
+
+// writeTestFile writes the content to a file with the name in a temporary
+// directory, and returns its path
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+
+	return file
+}
+
+func TestSendMail(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv := startTestSMTPServer(ctx, t)
+
+	addr := startRelay(ctx, t, srv.addr)
+
+	err := sendMsg(t, addr, []string{"alice@example.com"},
+		"bob@example.com", "test message", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+	assert.Len(t, *srv.msgs, 1)
+
+	r := bufio.NewReader(bytes.NewReader((*srv.msgs)[0].Data))
+	msg := textproto.NewReader(r)
+	hdr, err := msg.ReadMIMEHeader()
+	require.NoError(t, err)
+
+	assert.Equal(t, "bob@example.com", hdr.Get("From"))
+	assert.Equal(t, "alice@example.com", hdr.Get("To"))
+	assert.Equal(t, "test message", hdr.Get("Subject"))
+	assert.NotEmpty(t, hdr.Get("Received"))
+
+	line, err := msg.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", line)
+}
+
+func TestReceivedHeader(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	for received, expected := range map[string]string{
+		"helo":      "from localhost by ",
+		"client_ip": "from [127.0.0.1] by ",
+		"none":      "",
+	} {
+		srv := startTestSMTPServer(ctx, t)
+
+		fields, none, err := parseReceivedFields(received)
+		require.NoError(t, err)
+
+		addr := startRelayConfig(ctx, t, "", &config{remoteHost: srv.addr, received: fields, noReceived: none})
+
+		err = sendMsg(t, addr, []string{"alice@example.com"}, "bob@example.com", "test message", nil, "hello")
+		require.NoError(t, err)
+		require.Len(t, *srv.msgs, 1)
+
+		hdr, err := textproto.NewReader(bufio.NewReader(bytes.NewReader((*srv.msgs)[0].Data))).ReadMIMEHeader()
+		require.NoError(t, err)
+
+		if expected == "" {
+			assert.Empty(t, hdr.Values("Received"), received)
+		} else {
+			assert.Contains(t, hdr.Get("Received"), expected, received)
+		}
+	}
+}
+
+func TestStripClientHeaders(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv := startTestSMTPServer(ctx, t)
+	addr := startRelayConfig(ctx, t, "", &config{remoteHost: srv.addr, stripHeaders: true})
+
+	err := sendMsg(t, addr, []string{"alice@example.com"}, "bob@example.com", "test message", textproto.MIMEHeader{
+		"Received":         {"from laptop.internal ([10.0.0.7]) by mail.internal"},
+		"X-Mailer":         {"Mailer 1.0"},
+		"User-Agent":       {"Agent 2.0"},
+		"X-Originating-Ip": {"[10.0.0.7]"},
+		"X-Custom":         {"kept"},
+	}, "hello")
+	require.NoError(t, err)
+	require.Len(t, *srv.msgs, 1)
+
+	hdr, err := textproto.NewReader(bufio.NewReader(bytes.NewReader((*srv.msgs)[0].Data))).ReadMIMEHeader()
+	require.NoError(t, err)
+
+	// only the relay's own Received header is left
+	require.Len(t, hdr.Values("Received"), 1)
+	assert.Contains(t, hdr.Get("Received"), "from localhost ([127.0.0.1]) by ")
+	assert.NotContains(t, hdr.Get("Received"), "laptop.internal")
+
+	for _, name := range []string{"X-Mailer", "User-Agent", "X-Originating-Ip"} {
+		assert.Empty(t, hdr.Values(name), name)
+	}
+
+	assert.Equal(t, "kept", hdr.Get("X-Custom"))
+	assert.Equal(t, "test message", hdr.Get("Subject"))
+}
+
+func TestLMTPListener(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv := startTestSMTPServer(ctx, t)
+
+	// nothing listens on the discard port, so delivery to these recipients
+	// fails
+	addr := startRelayConfig(ctx, t, schemeLMTP, &config{
+		remoteHost: srv.addr + " *@unreachable.example.com=127.0.0.1:9",
+	})
+
+	c, err := textproto.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	_, _, err = c.ReadResponse(220)
+	require.NoError(t, err)
+
+	for _, line := range []string{
+		"LHLO localhost",
+		"MAIL FROM:<bob@example.com>",
+		"RCPT TO:<alice@example.com>",
+		"RCPT TO:<carol@unreachable.example.com>",
+	} {
+		_, err = c.Cmd("%s", line)
+		require.NoError(t, err)
+
+		_, _, err = c.ReadResponse(250)
+		require.NoError(t, err, line)
+	}
+
+	_, err = c.Cmd("DATA")
+	require.NoError(t, err)
+
+	_, _, err = c.ReadResponse(354)
+	require.NoError(t, err)
+
+	_, err = c.Cmd("Subject: test\r\n\r\nhello\r\n.")
+	require.NoError(t, err)
+
+	_, _, err = c.ReadResponse(250)
+	require.NoError(t, err)
+
+	code, _, err := c.ReadResponse(250)
+	require.Error(t, err)
+	assert.Equal(t, 554, code)
+
+	require.Len(t, *srv.msgs, 1)
+	assert.Equal(t, []string{"alice@example.com"}, (*srv.msgs)[0].Recipients)
+}
+
+func TestRecipientErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	u := startFakeUpstream(t, "PIPELINING")
+	u.setReply("RCPT TO:<DAVE@", "550 5.1.1 no such user")
+
+	addr := startRelayConfig(ctx, t, schemeLMTP, &config{remoteHost: u.addr})
+
+	c, err := textproto.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	_, _, err = c.ReadResponse(220)
+	require.NoError(t, err)
+
+	for _, line := range []string{
+		"LHLO localhost",
+		"MAIL FROM:<bob@example.com>",
+		"RCPT TO:<alice@example.com>",
+		"RCPT TO:<dave@example.com>",
+	} {
+		_, err = c.Cmd("%s", line)
+		require.NoError(t, err)
+
+		_, _, err = c.ReadResponse(250)
+		require.NoError(t, err, line)
+	}
+
+	_, err = c.Cmd("DATA")
+	require.NoError(t, err)
+
+	_, _, err = c.ReadResponse(354)
+	require.NoError(t, err)
+
+	_, err = c.Cmd("Subject: test\r\n\r\nhello\r\n.")
+	require.NoError(t, err)
+
+	// the upstream rejection of dave is passed through, and alice isn't
+	// affected by it
+	_, _, err = c.ReadResponse(250)
+	require.NoError(t, err)
+
+	code, msg, err := c.ReadResponse(250)
+	require.Error(t, err)
+	assert.Equal(t, 550, code)
+	assert.Contains(t, msg, "no such user")
+
+	_, msgs := u.received()
+	assert.Len(t, msgs, 1)
+}
+
+func TestRecipientRateLimit(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	u := startFakeUpstream(t)
+
+	addr := startRelayConfig(ctx, t, "", &config{remoteHost: u.addr, rateLimitRcpts: "ip=2"})
+
+	c, err := textproto.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	_, _, err = c.ReadResponse(220)
+	require.NoError(t, err)
+
+	for _, line := range []string{
+		"EHLO localhost",
+		"MAIL FROM:<bob@example.com>",
+		"RCPT TO:<alice@example.com>",
+		"RCPT TO:<carol@example.com>",
+	} {
+		_, err = c.Cmd("%s", line)
+		require.NoError(t, err)
+
+		_, _, err = c.ReadResponse(250)
+		require.NoError(t, err, line)
+	}
+
+	// the recipients over the limit are deferred on their own, the message
+	// goes to the others
+	_, err = c.Cmd("RCPT TO:<dave@example.com>")
+	require.NoError(t, err)
+
+	_, _, err = c.ReadResponse(450)
+	require.NoError(t, err)
+
+	_, err = c.Cmd("DATA")
+	require.NoError(t, err)
+
+	_, _, err = c.ReadResponse(354)
+	require.NoError(t, err)
+
+	_, err = c.Cmd("Subject: test\r\n\r\nhello\r\n.")
+	require.NoError(t, err)
+
+	_, _, err = c.ReadResponse(250)
+	require.NoError(t, err)
+
+	commands, msgs := u.received()
+	assert.Len(t, msgs, 1)
+	assert.Contains(t, commands, "RCPT TO:<carol@example.com>")
+	assert.NotContains(t, commands, "RCPT TO:<dave@example.com>")
+}
+
+func TestRecipientCallout(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// net/smtp requests SMTPUTF8 if the relay supports it
+	u := startFakeUpstream(t, "SMTPUTF8", "8BITMIME")
+	u.setReply("RCPT TO:<DAVE@", "550 5.1.1 no such user")
+
+	addr := startRelayConfig(ctx, t, "", &config{
+		remoteHost:     u.addr,
+		rcptCallout:    true,
+		calloutTimeout: 5 * time.Second,
+	})
+
+	// dave is rejected at RCPT TO, before the message is sent
+	err := smtp.SendMail(addr, nil, "bob@example.com", []string{"alice@example.com", "dave@example.com"},
+		[]byte("Subject: test\r\n\r\nhello\r\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "5.1.1 Recipient address rejected by upstream")
+
+	err = smtp.SendMail(addr, nil, "bob@example.com", []string{"alice@example.com"},
+		[]byte("Subject: test\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+
+	_, msgs := u.received()
+	assert.Len(t, msgs, 1)
+}
+
+func TestStreamData(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// net/smtp requests SMTPUTF8 if the relay supports it
+	u := startFakeUpstream(t, "SMTPUTF8", "8BITMIME")
+
+	addr := startRelayConfig(ctx, t, "", &config{
+		remoteHost:     u.addr,
+		maxMessageSize: 128,
+		streamData:     true,
+	})
+
+	err := sendMsg(t, addr, []string{"alice@example.com"},
+		"bob@example.com", "test message", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+
+	// the upstream doesn't get the message, as the relay drops the
+	// connection before completing it
+	err = sendMsg(t, addr, []string{"alice@example.com"},
+		"bob@example.com", "test message", textproto.MIMEHeader{}, strings.Repeat("x", 128))
+
+	var tperr *textproto.Error
+	require.ErrorAs(t, err, &tperr)
+	assert.Equal(t, 552, tperr.Code)
+
+	_, msgs := u.received()
+	require.Len(t, msgs, 1)
+	assert.Contains(t, msgs[0], "Received: ")
+	assert.Contains(t, msgs[0], "hello world")
+}
+
+func TestShutdownDrain(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// net/smtp requests SMTPUTF8 if the relay supports it
+	u := startFakeUpstream(t, "SMTPUTF8", "8BITMIME")
+
+	addr, errc := runRelayConfig(ctx, t, "", &config{
+		remoteHost:      u.addr,
+		shutdownTimeout: 10 * time.Second,
+	})
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	require.NoError(t, c.Mail("bob@example.com"))
+	require.NoError(t, c.Rcpt("alice@example.com"))
+
+	cancel()
+
+	// new connections are refused while the session drains
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+		}
+
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	wc, err := c.Data()
+	require.NoError(t, err)
+
+	_, err = wc.Write([]byte("Subject: test\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+	require.NoError(t, c.Quit())
+
+	// the trace exporter gets up to 5s to flush the spans on shutdown
+	select {
+	case err = <-errc:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("relay didn't shut down after the session finished")
+	}
+
+	_, msgs := u.received()
+	assert.Len(t, msgs, 1)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	u := startFakeUpstream(t)
+
+	addr, errc := runRelayConfig(ctx, t, "", &config{
+		remoteHost:      u.addr,
+		shutdownTimeout: 200 * time.Millisecond,
+	})
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	require.NoError(t, c.Hello("localhost"))
+
+	cancel()
+
+	select {
+	case err = <-errc:
+		require.ErrorIs(t, err, ErrShutdownTimeout)
+	case <-time.After(10 * time.Second):
+		t.Fatal("relay didn't close the session after the grace period")
+	}
+
+	require.Error(t, c.Mail("bob@example.com"))
+}
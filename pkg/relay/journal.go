@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"fmt"
+	"net/mail"
+	"slices"
+	"strings"
+)
+
+// journal adds journaling recipients to the envelope of relayed messages, so
+// compliance mailboxes get a copy of them. They're not added to the headers,
+// like BCC recipients.
+type journal struct {
+	global  []string
+	domains map[string][]string // by lowercased domain
+}
+
+// parse the input into a journal. It should be in the form of
+// "journal@example.com example.org=journal@example.org" (separated by spaces),
+// where the entries without a domain get a copy of every message, and the
+// other ones of the messages from or to the domain. Returns nil if the input
+// is empty.
+func parseJournal(s string) (*journal, error) {
+	entries := splitstr(s, ' ')
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	j := &journal{domains: map[string][]string{}}
+
+	for _, entry := range entries {
+		domain, rcpt, found := strings.Cut(entry, "=")
+		if !found {
+			domain, rcpt = "", entry
+		}
+
+		if found && domain == "" {
+			return nil, fmt.Errorf("invalid journal entry %q", entry)
+		}
+
+		if _, err := mail.ParseAddress(rcpt); err != nil {
+			return nil, fmt.Errorf("invalid journal recipient %q: %w", rcpt, err)
+		}
+
+		if domain == "" {
+			j.global = append(j.global, rcpt)
+		} else {
+			domain = strings.ToLower(domain)
+			j.domains[domain] = append(j.domains[domain], rcpt)
+		}
+	}
+
+	return j, nil
+}
+
+// recipients returns the journaling recipients of a message, which aren't
+// already recipients of it
+func (j *journal) recipients(sender string, rcpts []string) []string {
+	if j == nil {
+		return nil
+	}
+
+	var journal []string
+
+	add := func(addrs []string) {
+		for _, addr := range addrs {
+			if !slices.Contains(rcpts, addr) && !slices.Contains(journal, addr) {
+				journal = append(journal, addr)
+			}
+		}
+	}
+
+	add(j.global)
+
+	if len(j.domains) > 0 {
+		for _, addr := range append([]string{sender}, rcpts...) {
+			_, domain, _ := strings.Cut(addr, "@")
+			add(j.domains[strings.ToLower(domain)])
+		}
+	}
+
+	return journal
+}
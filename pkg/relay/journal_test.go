@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"context"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseJournal(t *testing.T) {
+	t.Parallel()
+
+	j, err := parseJournal("")
+	require.NoError(t, err)
+	assert.Nil(t, j)
+
+	j, err = parseJournal("journal@example.com Example.org=a@example.org example.org=b@example.org")
+	require.NoError(t, err)
+	assert.Equal(t, &journal{
+		global:  []string{"journal@example.com"},
+		domains: map[string][]string{"example.org": {"a@example.org", "b@example.org"}},
+	}, j)
+
+	for _, s := range []string{"=journal@example.com", "example.org=", "not an address"} {
+		_, err = parseJournal(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestJournalRecipients(t *testing.T) {
+	t.Parallel()
+
+	var j *journal
+	assert.Nil(t, j.recipients("bob@example.com", []string{"alice@example.com"}))
+
+	j, err := parseJournal("journal@example.com example.org=a@example.org example.net=n@example.net")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"journal@example.com"}, j.recipients("bob@example.com", []string{"alice@example.com"}))
+	assert.Equal(t, []string{"journal@example.com", "a@example.org"},
+		j.recipients("bob@EXAMPLE.org", []string{"alice@example.com"}))
+	assert.Equal(t, []string{"journal@example.com", "a@example.org", "n@example.net"},
+		j.recipients("", []string{"alice@example.org", "carol@example.net", "dave@example.org"}))
+
+	// recipients of the message aren't added again
+	assert.Empty(t, j.recipients("bob@example.com", []string{"journal@example.com"}))
+}
+
+func TestJournal(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv := startTestSMTPServer(ctx, t)
+
+	j, err := parseJournal("journal@example.com")
+	require.NoError(t, err)
+
+	addr := startRelayConfig(ctx, t, "", &config{remoteHost: srv.addr, journal: j})
+
+	err = sendMsg(t, addr, []string{"alice@example.com"},
+		"bob@example.com", "test message", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+	require.Len(t, *srv.msgs, 1)
+
+	msg := (*srv.msgs)[0]
+	assert.Equal(t, []string{"alice@example.com", "journal@example.com"}, msg.Recipients)
+	assert.NotContains(t, string(msg.Data), "journal@example.com")
+}
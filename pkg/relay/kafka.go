@@ -0,0 +1,174 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// Kafka record headers carrying the envelope
+const (
+	kafkaSenderHeader     = "sender"
+	kafkaRecipientsHeader = "recipients"
+)
+
+// kafkaProducer publishes messages to a Kafka topic, one record per recipient
+// domain keyed by the domain, so the messages of a domain keep their order
+// in its partition. The record value is the message as is, and the envelope
+// is in the record headers.
+type kafkaProducer struct {
+	opts    []kgo.Opt
+	timeout time.Duration
+
+	// the client is only created on first use, so the producers of the
+	// configs read on reload, which are discarded, don't connect
+	once   sync.Once
+	client *kgo.Client
+	err    error
+
+	// produce overrides the publication of the records - for tests
+	produce func(ctx context.Context, records ...*kgo.Record) error
+}
+
+// newKafkaProducer returns nil unless the delivery mode is kafka
+func newKafkaProducer(cfg *config) (*kafkaProducer, error) {
+	if cfg.delivery != deliveryKafka {
+		return nil, nil
+	}
+
+	brokers := splitstr(cfg.kafkaBrokers, ' ')
+	if len(brokers) == 0 || cfg.kafkaTopic == "" {
+		return nil, fmt.Errorf("delivery %s requires kafka_brokers and kafka_topic to be set", deliveryKafka)
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(brokers...),
+		kgo.DefaultProduceTopic(cfg.kafkaTopic),
+		kgo.RecordDeliveryTimeout(cfg.kafkaTimeout),
+	}
+
+	var mechanism sasl.Mechanism
+
+	switch cfg.kafkaSASL {
+	case "":
+	case "plain":
+		mechanism = plain.Auth{User: cfg.kafkaUser, Pass: cfg.kafkaPass}.AsMechanism()
+	case "scram-sha-256":
+		mechanism = scram.Auth{User: cfg.kafkaUser, Pass: cfg.kafkaPass}.AsSha256Mechanism()
+	case "scram-sha-512":
+		mechanism = scram.Auth{User: cfg.kafkaUser, Pass: cfg.kafkaPass}.AsSha512Mechanism()
+	default:
+		return nil, fmt.Errorf("unknown kafka_sasl_mechanism %q", cfg.kafkaSASL)
+	}
+
+	if mechanism != nil {
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+
+	if cfg.kafkaTLS {
+		tlsConfig := &tls.Config{}
+		cfg.remoteTLS.apply(tlsConfig)
+
+		opts = append(opts, kgo.DialTLSConfig(tlsConfig))
+	}
+
+	k := &kafkaProducer{opts: opts, timeout: cfg.kafkaTimeout}
+	k.produce = k.produceSync
+
+	return k, nil
+}
+
+// send publishes the message for each recipient domain, failing temporarily
+// if any of the records isn't acknowledged: the message is published again
+// for all the domains on retry.
+func (k *kafkaProducer) send(out *outbound, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("data: %w", err)
+	}
+
+	ctx := context.Background()
+	if k.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k.timeout)
+		defer cancel()
+	}
+
+	if err := k.produce(ctx, kafkaRecords(out, data)...); err != nil {
+		return fmt.Errorf("kafka: %w", err)
+	}
+
+	return nil
+}
+
+// kafkaRecords returns the records of the message, one per recipient domain,
+// in the order the domains were first seen
+func kafkaRecords(out *outbound, data []byte) []*kgo.Record {
+	var records []*kgo.Record
+
+	index := map[string]int{}
+	rcpts := [][]string{}
+
+	for _, rcpt := range out.Recipients {
+		_, domain, _ := strings.Cut(rcpt, "@")
+		domain = strings.ToLower(domain)
+
+		i, ok := index[domain]
+		if !ok {
+			i = len(records)
+			index[domain] = i
+
+			records = append(records, &kgo.Record{Key: []byte(domain), Value: data})
+			rcpts = append(rcpts, nil)
+		}
+
+		rcpts[i] = append(rcpts[i], rcpt)
+	}
+
+	for i, r := range records {
+		r.Headers = []kgo.RecordHeader{
+			{Key: kafkaSenderHeader, Value: []byte(out.Sender)},
+			{Key: kafkaRecipientsHeader, Value: []byte(strings.Join(rcpts[i], ","))},
+		}
+	}
+
+	return records
+}
+
+// produceSync publishes the records, and waits until they're acknowledged
+func (k *kafkaProducer) produceSync(ctx context.Context, records ...*kgo.Record) error {
+	k.once.Do(func() {
+		k.client, k.err = kgo.NewClient(k.opts...)
+	})
+
+	if k.err != nil {
+		return k.err
+	}
+
+	return k.client.ProduceSync(ctx, records...).FirstErr()
+}
+
+// close flushes and closes the client, if it was created
+func (k *kafkaProducer) close() {
+	if k == nil {
+		return
+	}
+
+	k.once.Do(func() {
+		k.err = errors.New("producer closed")
+	})
+
+	if k.client != nil {
+		k.client.Close()
+	}
+}
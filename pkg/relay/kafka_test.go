@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestNewKafkaProducer(t *testing.T) {
+	t.Parallel()
+
+	k, err := newKafkaProducer(&config{delivery: deliverySmarthost, kafkaBrokers: "kafka:9092"})
+	require.NoError(t, err)
+	assert.Nil(t, k)
+
+	for _, cfg := range []*config{
+		{delivery: deliveryKafka, kafkaTopic: "mail"},
+		{delivery: deliveryKafka, kafkaBrokers: "kafka:9092"},
+		{delivery: deliveryKafka, kafkaBrokers: "kafka:9092", kafkaTopic: "mail", kafkaSASL: "gssapi"},
+	} {
+		_, err = newKafkaProducer(cfg)
+		require.Error(t, err)
+	}
+
+	k, err = newKafkaProducer(&config{
+		delivery:     deliveryKafka,
+		kafkaBrokers: "kafka1:9092 kafka2:9092",
+		kafkaTopic:   "mail",
+		kafkaSASL:    "scram-sha-512",
+		kafkaUser:    "relay",
+		kafkaPass:    "secret",
+		kafkaTLS:     true,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, k)
+
+	// the client is only created on first use
+	k.close()
+	assert.Nil(t, k.client)
+	require.Error(t, k.produceSync(context.Background()))
+}
+
+func TestKafkaSend(t *testing.T) {
+	t.Parallel()
+
+	k, err := newKafkaProducer(&config{delivery: deliveryKafka, kafkaBrokers: "kafka:9092", kafkaTopic: "mail"})
+	require.NoError(t, err)
+
+	var published []*kgo.Record
+
+	k.produce = func(_ context.Context, records ...*kgo.Record) error {
+		published = append(published, records...)
+		return nil
+	}
+
+	cfg := &config{kafka: k}
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+
+	out := &outbound{
+		Sender:     "bob@example.org",
+		Recipients: []string{"alice@example.com", "carol@example.net", "dave@Example.com"},
+	}
+	require.NoError(t, sendMail(cfg, out, data))
+
+	require.Len(t, published, 2)
+	assert.Equal(t, "example.com", string(published[0].Key))
+	assert.Equal(t, data, published[0].Value)
+	assert.Equal(t, []kgo.RecordHeader{
+		{Key: kafkaSenderHeader, Value: []byte("bob@example.org")},
+		{Key: kafkaRecipientsHeader, Value: []byte("alice@example.com,dave@Example.com")},
+	}, published[0].Headers)
+	assert.Equal(t, "example.net", string(published[1].Key))
+
+	// unacknowledged publications fail temporarily
+	k.produce = func(_ context.Context, _ ...*kgo.Record) error {
+		return errors.New("not enough replicas")
+	}
+
+	err = sendMail(cfg, out, data)
+	require.Error(t, err)
+	assert.True(t, isTemporaryErr(err))
+}
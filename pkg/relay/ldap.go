@@ -0,0 +1,352 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	errLDAPUserNotFound  = errors.New("ldap: user not found")
+	errLDAPUserAmbiguous = errors.New("ldap: several users match")
+	errLDAPEmptyPassword = errors.New("ldap: empty password")
+)
+
+// ldapAuth authenticates users against an LDAP directory such as Active
+// Directory: the user entry is searched with the service account, then bound
+// with the user's password. Connections bound with the service account are
+// pooled between authentications.
+type ldapAuth struct {
+	addr     string
+	ldaps    bool // TLS from the start, rather than with StartTLS
+	startTLS bool
+
+	bindDN   string
+	bindPass string
+	baseDN   string
+	filter   string // user filter, with %s replaced with the username
+	group    string // DN of the group users must be members of, if any
+
+	poolSize int
+	timeout  time.Duration
+
+	// tlsConfig overrides the TLS config - for tests
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	idle []*ldapConn
+}
+
+// newLDAPAuth returns nil if rawURL is empty. The URL is either
+// ldap://host[:port] or ldaps://host[:port].
+func newLDAPAuth(rawURL string, startTLS bool, bindDN, bindPass, baseDN, filter, group string, poolSize int, timeout time.Duration) (*ldapAuth, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &ldapAuth{
+		addr:     u.Host,
+		startTLS: startTLS,
+		bindDN:   bindDN,
+		bindPass: bindPass,
+		baseDN:   baseDN,
+		filter:   filter,
+		group:    group,
+		poolSize: poolSize,
+		timeout:  timeout,
+	}
+
+	port := "389"
+
+	switch u.Scheme {
+	case "ldap":
+	case "ldaps":
+		if startTLS {
+			return nil, errors.New("StartTLS can't be used with ldaps")
+		}
+
+		a.ldaps, port = true, "636"
+	default:
+		return nil, fmt.Errorf("unknown scheme %q", u.Scheme)
+	}
+
+	if u.Port() == "" {
+		a.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	a.tlsConfig = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+
+	if !strings.Contains(filter, "%s") {
+		return nil, fmt.Errorf("user filter %q doesn't contain %%s", filter)
+	}
+
+	// the filter is validated now, so we don't fail at authentication time
+	if _, err := ldap.CompileFilter(a.userFilter("user")); err != nil {
+		return nil, fmt.Errorf("invalid user filter %q: %w", filter, err)
+	}
+
+	return a, nil
+}
+
+// authenticate checks the password of the user, and that it's a member of
+// the required group. Empty passwords are rejected, as binding with them
+// succeeds anonymously on most servers (RFC 4513 section 5.1.2).
+func (a *ldapAuth) authenticate(ctx context.Context, username, password string) error {
+	if password == "" {
+		return errLDAPEmptyPassword
+	}
+
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+
+	filter := a.userFilter(username)
+
+	// a failure on a pooled connection is retried once on a new connection,
+	// as the server may have closed it in the meantime
+	c, reused := a.get()
+
+	for {
+		var err error
+
+		if c == nil {
+			if c, err = a.dial(ctx); err != nil {
+				return err
+			}
+		}
+
+		err = a.check(ctx, c, filter, password)
+		a.put(c, err)
+
+		if !reused || err == nil || ldapReplied(err) {
+			return err
+		}
+
+		c, reused = nil, false
+	}
+}
+
+// check searches the user entry on the connection, binds with the user's
+// password, and binds back with the service account
+func (a *ldapAuth) check(ctx context.Context, c *ldapConn, filter, password string) error {
+	c.setDeadline(ctx)
+
+	dn, err := c.searchDN(a.baseDN, filter)
+	if err != nil {
+		return err
+	}
+
+	if err := c.bind(dn, password); err != nil {
+		if ldapReplied(err) {
+			// the service account is bound again before the connection
+			// is reused
+			if rebindErr := c.bind(a.bindDN, a.bindPass); rebindErr != nil {
+				c.broken = true
+			}
+		}
+
+		return err
+	}
+
+	if err := c.bind(a.bindDN, a.bindPass); err != nil {
+		c.broken = true
+	}
+
+	return nil
+}
+
+// userFilter returns the filter matching the user entry, and its membership
+// of the group if one is required
+func (a *ldapAuth) userFilter(username string) string {
+	filter := strings.ReplaceAll(a.filter, "%s", ldap.EscapeFilter(username))
+
+	if a.group != "" {
+		filter = "(&" + filter + "(memberOf=" + ldap.EscapeFilter(a.group) + "))"
+	}
+
+	return filter
+}
+
+// dial connects to the server, with TLS if configured, and binds with the
+// service account, anonymously if there's none
+func (a *ldapAuth) dial(ctx context.Context) (*ldapConn, error) {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", a.addr)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+
+	if a.ldaps {
+		tlsConn := tls.Client(conn, a.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("ldap: %w", err)
+		}
+
+		conn = tlsConn
+	}
+
+	c := &ldapConn{conn: ldap.NewConn(conn, a.ldaps)}
+	c.conn.Start()
+	c.setDeadline(ctx)
+
+	if a.startTLS {
+		if err := c.conn.StartTLS(a.tlsConfig); err != nil {
+			c.close()
+			return nil, fmt.Errorf("ldap: starttls: %w", err)
+		}
+	}
+
+	if a.bindDN != "" {
+		if err := c.bind(a.bindDN, a.bindPass); err != nil {
+			c.close()
+			return nil, fmt.Errorf("ldap: service account bind: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// get returns an idle connection, nil if there's none
+func (a *ldapAuth) get() (*ldapConn, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if n := len(a.idle); n > 0 {
+		c := a.idle[n-1]
+		a.idle = a.idle[:n-1]
+
+		return c, true
+	}
+
+	return nil, false
+}
+
+// put returns the connection to the pool, unless it failed or the pool is
+// full
+func (a *ldapAuth) put(c *ldapConn, err error) {
+	if !c.broken && !c.conn.IsClosing() && (err == nil || ldapReplied(err)) {
+		a.mu.Lock()
+		if len(a.idle) < a.poolSize {
+			a.idle = append(a.idle, c)
+			c = nil
+		}
+		a.mu.Unlock()
+	}
+
+	if c != nil {
+		c.close()
+	}
+}
+
+// close closes the idle connections
+func (a *ldapAuth) close() {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, c := range a.idle {
+		c.close()
+	}
+
+	a.idle = nil
+}
+
+// ldapReplied reports whether the error is a reply of the server, rather than
+// a failure of the connection, which can then be reused
+func ldapReplied(err error) bool {
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) {
+		// the codes from ErrorNetwork on are the client's
+		return ldapErr.ResultCode < ldap.ErrorNetwork
+	}
+
+	return errors.Is(err, errLDAPUserNotFound) || errors.Is(err, errLDAPUserAmbiguous)
+}
+
+// ldapConn is a connection to an LDAP server, used by one authentication at
+// a time
+type ldapConn struct {
+	conn *ldap.Conn
+
+	// broken is set if the connection can't be reused
+	broken bool
+}
+
+// setDeadline bounds the requests with the deadline of the context, or clears
+// the bound if there's none
+func (c *ldapConn) setDeadline(ctx context.Context) {
+	var timeout time.Duration
+
+	if deadline, ok := ctx.Deadline(); ok {
+		// an expired deadline mustn't clear the bound
+		timeout = max(time.Until(deadline), time.Nanosecond)
+	}
+
+	c.conn.SetTimeout(timeout)
+}
+
+// bind authenticates the connection with the DN and password, anonymously if
+// both are empty
+func (c *ldapConn) bind(dn, password string) error {
+	if dn == "" && password == "" {
+		return c.conn.UnauthenticatedBind("")
+	}
+
+	return c.conn.Bind(dn, password)
+}
+
+// searchDN returns the DN of the single entry under baseDN matching the
+// filter. Referrals to other servers aren't followed.
+func (c *ldapConn) searchDN(baseDN, filter string) (string, error) {
+	res, err := c.conn.Search(ldap.NewSearchRequest(baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2,     // sizeLimit: one entry is expected
+		0,     // timeLimit
+		false, // typesOnly
+		filter,
+		[]string{"1.1"}, // no attributes
+		nil,
+	))
+
+	// the size limit is exceeded if several entries match
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return "", err
+	}
+
+	switch len(res.Entries) {
+	case 0:
+		return "", errLDAPUserNotFound
+	case 1:
+		return res.Entries[0].DN, nil
+	default:
+		return "", errLDAPUserAmbiguous
+	}
+}
+
+// close ends the session
+func (c *ldapConn) close() {
+	if c.broken || c.conn.Unbind() != nil {
+		_ = c.conn.Close()
+	}
+}
@@ -0,0 +1,387 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLDAP is an LDAP server supporting simple binds, StartTLS, and searches
+// of the entries of its directory
+type fakeLDAP struct {
+	addr      string
+	tlsConfig *tls.Config
+
+	// entries by DN, with their attributes - userPassword is the password
+	entries map[string]map[string][]string
+
+	dials atomic.Int32
+
+	mu    sync.Mutex
+	binds []string
+}
+
+func startFakeLDAP(t *testing.T, tlsConfig *tls.Config, entries map[string]map[string][]string) *fakeLDAP {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = l.Close() })
+
+	s := &fakeLDAP{addr: l.Addr().String(), tlsConfig: tlsConfig, entries: entries}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			s.dials.Add(1)
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeLDAP) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	for {
+		msg, err := ber.ReadPacket(conn)
+		if err != nil || len(msg.Children) < 2 {
+			return
+		}
+
+		id := msg.Children[0].Value
+		op := msg.Children[1]
+
+		reply := func(ops ...*ber.Packet) {
+			for _, op := range ops {
+				p := ber.NewSequence("")
+				p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+				p.AppendChild(op)
+
+				_, _ = conn.Write(p.Bytes())
+			}
+		}
+
+		result := func(tag ber.Tag, code int) *ber.Packet {
+			p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+			p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+			p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+			p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+
+			return p
+		}
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+
+			s.mu.Lock()
+			s.binds = append(s.binds, dn)
+			s.mu.Unlock()
+
+			code := ldap.LDAPResultInvalidCredentials
+			if entry, ok := s.entries[dn]; (dn == "" && password == "") || (ok && entry["userPassword"][0] == password) {
+				code = ldap.LDAPResultSuccess
+			}
+
+			reply(result(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			base := strings.ToLower(op.Children[0].Data.String())
+
+			var ops []*ber.Packet
+
+			for dn, entry := range s.entries {
+				if strings.HasSuffix(strings.ToLower(dn), base) && matchFakeFilter(op.Children[6], entry) {
+					p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+					p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+					p.AppendChild(ber.NewSequence(""))
+
+					ops = append(ops, p)
+				}
+			}
+
+			reply(append(ops, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))...)
+		case ldap.ApplicationExtendedRequest:
+			reply(result(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess))
+
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+
+			conn = tlsConn
+		default:
+			return
+		}
+	}
+}
+
+// matchFakeFilter evaluates the encoded filter against the entry, with
+// case-insensitive comparisons
+func matchFakeFilter(filter *ber.Packet, entry map[string][]string) bool {
+	items := filter.Children
+
+	values := func(attr *ber.Packet) []string {
+		return entry[attr.Data.String()]
+	}
+
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, item := range items {
+			if !matchFakeFilter(item, entry) {
+				return false
+			}
+		}
+
+		return true
+	case ldap.FilterOr:
+		for _, item := range items {
+			if matchFakeFilter(item, entry) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterNot:
+		return !matchFakeFilter(items[0], entry)
+	case ldap.FilterPresent:
+		return len(values(filter)) > 0
+	case ldap.FilterEqualityMatch:
+		for _, v := range values(items[0]) {
+			if strings.EqualFold(v, items[1].Data.String()) {
+				return true
+			}
+		}
+	case ldap.FilterSubstrings:
+		for _, v := range values(items[0]) {
+			v = strings.ToLower(v)
+			ok := true
+
+			for _, sub := range items[1].Children {
+				part := strings.ToLower(sub.Data.String())
+
+				switch sub.Tag {
+				case ldap.FilterSubstringsInitial:
+					ok = ok && strings.HasPrefix(v, part)
+				case ldap.FilterSubstringsFinal:
+					ok = ok && strings.HasSuffix(v, part)
+				default:
+					ok = ok && strings.Contains(v, part)
+				}
+			}
+
+			if ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func TestLDAPUserFilter(t *testing.T) {
+	t.Parallel()
+
+	entry := map[string][]string{
+		"objectClass": {"top", "person"},
+		"uid":         {"alice"},
+		"mail":        {"alice@example.com"},
+		"cn":          {"Alice (Admin)"},
+		"memberOf":    {"cn=smtp (mail),ou=groups,dc=example,dc=com"},
+	}
+
+	for _, tc := range []struct {
+		filter   string
+		username string
+		match    bool
+	}{
+		{"(uid=%s)", "alice", true},
+		{"(UID=%s)", "bob", false},
+		{"(&(objectClass=person)(uid=%s))", "alice", true},
+		{"(|(uid=%s)(mail=%s))", "alice@example.com", true},
+		{"(mail=%s@*)", "alice", true},
+		{"(cn=%s)", "Alice (Admin)", true},
+
+		// usernames can't inject filters
+		{"(uid=%s)", "*", false},
+		{"(uid=%s)", "a*", false},
+		{"(uid=%s)", "alice)(uid=*", false},
+	} {
+		a := &ldapAuth{filter: tc.filter}
+
+		filter, err := ldap.CompileFilter(a.userFilter(tc.username))
+		require.NoError(t, err, tc)
+		assert.Equal(t, tc.match, matchFakeFilter(filter, entry), tc)
+
+		// group membership
+		a.group = "cn=smtp (mail),ou=groups,dc=example,dc=com"
+
+		filter, err = ldap.CompileFilter(a.userFilter(tc.username))
+		require.NoError(t, err, tc)
+		assert.Equal(t, tc.match, matchFakeFilter(filter, entry), tc)
+	}
+
+	a := &ldapAuth{filter: "(uid=%s)"}
+	assert.Equal(t, `(uid=\2a\28\29\5c\00)`, a.userFilter("*()\\\x00"))
+}
+
+func testLDAPDirectory() map[string]map[string][]string {
+	return map[string]map[string][]string{
+		"cn=smtprelay,ou=services,dc=example,dc=com": {
+			"userPassword": {"service-secret"},
+		},
+		"uid=alice,ou=users,dc=example,dc=com": {
+			"objectClass":  {"person"},
+			"uid":          {"alice"},
+			"userPassword": {"alice-secret"},
+			"memberOf":     {"cn=smtp,ou=groups,dc=example,dc=com"},
+		},
+		"uid=bob,ou=users,dc=example,dc=com": {
+			"objectClass":  {"person"},
+			"uid":          {"bob"},
+			"userPassword": {"bob-secret"},
+		},
+	}
+}
+
+func TestLDAPAuth(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s := startFakeLDAP(t, nil, testLDAPDirectory())
+
+	a, err := newLDAPAuth("ldap://"+s.addr, false, "cn=smtprelay,ou=services,dc=example,dc=com", "service-secret",
+		"ou=users,dc=example,dc=com", "(&(objectClass=person)(uid=%s))", "", 2, 5*time.Second)
+	require.NoError(t, err)
+
+	t.Cleanup(a.close)
+
+	require.NoError(t, a.authenticate(ctx, "alice", "alice-secret"))
+	require.NoError(t, a.authenticate(ctx, "bob", "bob-secret"))
+
+	err = a.authenticate(ctx, "alice", "wrong")
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials), err)
+
+	require.ErrorIs(t, a.authenticate(ctx, "carol", "carol-secret"), errLDAPUserNotFound)
+	require.ErrorIs(t, a.authenticate(ctx, "alice", ""), errLDAPEmptyPassword)
+
+	// usernames can't inject filters
+	require.ErrorIs(t, a.authenticate(ctx, "*", "alice-secret"), errLDAPUserNotFound)
+
+	// the service account connection is reused, and bound again after each
+	// user bind
+	assert.Equal(t, int32(1), s.dials.Load())
+
+	s.mu.Lock()
+	binds := s.binds
+	s.mu.Unlock()
+
+	assert.Equal(t, []string{
+		"cn=smtprelay,ou=services,dc=example,dc=com",
+		"uid=alice,ou=users,dc=example,dc=com",
+		"cn=smtprelay,ou=services,dc=example,dc=com",
+		"uid=bob,ou=users,dc=example,dc=com",
+		"cn=smtprelay,ou=services,dc=example,dc=com",
+		"uid=alice,ou=users,dc=example,dc=com",
+		"cn=smtprelay,ou=services,dc=example,dc=com",
+	}, binds)
+
+	// group membership
+	a.group = "cn=smtp,ou=groups,dc=example,dc=com"
+
+	require.NoError(t, a.authenticate(ctx, "alice", "alice-secret"))
+	require.ErrorIs(t, a.authenticate(ctx, "bob", "bob-secret"), errLDAPUserNotFound)
+
+	// pooled connections closed by the server are replaced
+	a.mu.Lock()
+	for _, c := range a.idle {
+		_ = c.conn.Close()
+	}
+	a.mu.Unlock()
+
+	require.NoError(t, a.authenticate(ctx, "alice", "alice-secret"))
+	assert.Equal(t, int32(2), s.dials.Load())
+
+	// unreachable servers
+	a, err = newLDAPAuth("ldap://127.0.0.1:9", false, "", "", "dc=example,dc=com", "(uid=%s)", "", 2, time.Second)
+	require.NoError(t, err)
+
+	require.Error(t, a.authenticate(ctx, "alice", "alice-secret"))
+}
+
+func TestLDAPAuthStartTLS(t *testing.T) {
+	t.Parallel()
+
+	ca, caKey := issueTestCert(t, "Test CA", nil, nil)
+	leaf, leafKey := issueTestCert(t, "ldap.example.com", ca, caKey)
+
+	s := startFakeLDAP(t, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leaf.Raw}, PrivateKey: leafKey}},
+		MinVersion:   tls.VersionTLS12,
+	}, testLDAPDirectory())
+
+	// anonymous searches
+	a, err := newLDAPAuth("ldap://"+s.addr, true, "", "", "dc=example,dc=com", "(uid=%s)", "", 2, 5*time.Second)
+	require.NoError(t, err)
+
+	t.Cleanup(a.close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	a.tlsConfig = &tls.Config{ServerName: "ldap.example.com", RootCAs: roots, MinVersion: tls.VersionTLS12}
+
+	require.NoError(t, a.authenticate(context.Background(), "alice", "alice-secret"))
+
+	// the server certificate is verified
+	a.tlsConfig = &tls.Config{ServerName: "ldap.example.com", MinVersion: tls.VersionTLS12}
+	a.close()
+
+	require.Error(t, a.authenticate(context.Background(), "alice", "alice-secret"))
+}
+
+func TestNewLDAPAuth(t *testing.T) {
+	t.Parallel()
+
+	a, err := newLDAPAuth("", false, "", "", "", "(uid=%s)", "", 4, time.Second)
+	require.NoError(t, err)
+	assert.Nil(t, a)
+
+	a, err = newLDAPAuth("ldaps://dc.example.com", false, "", "", "", "(uid=%s)", "", 4, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "dc.example.com:636", a.addr)
+	assert.True(t, a.ldaps)
+
+	for _, tc := range []struct {
+		url      string
+		startTLS bool
+		filter   string
+	}{
+		{"ldaps://dc.example.com", true, "(uid=%s)"},
+		{"http://dc.example.com", false, "(uid=%s)"},
+		{"ldap://dc.example.com", false, "(uid=alice)"},
+		{"ldap://dc.example.com", false, "uid=%s"},
+	} {
+		_, err = newLDAPAuth(tc.url, tc.startTLS, "", "", "", tc.filter, "", 4, time.Second)
+		assert.Error(t, err, tc)
+	}
+}
@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// listener schemes
+const (
+	schemeTCP      = "tcp"
+	schemeSTARTTLS = "starttls"
+	schemeSMTPS    = "smtps"
+	schemeLMTP     = "lmtp"
+)
+
+// listenerConfig holds the settings of a single listen address
+type listenerConfig struct {
+	scheme       string
+	address      string
+	forceTLS     bool // require STARTTLS before MAIL
+	auth         bool // require authentication before MAIL
+	proxy        bool // expect a PROXY protocol header
+	insecureAuth bool // allow authentication without TLS
+	submission   bool // message submission semantics (RFC 6409)
+
+	// allowed_sender, allowed_recipients and denied_recipients overriding
+	// the global ones, by name
+	patterns map[string]string
+}
+
+func (l listenerConfig) String() string {
+	return l.scheme + "://" + l.address
+}
+
+// tls reports whether the listener supports TLS
+func (l listenerConfig) tls() bool {
+	return l.scheme == schemeSTARTTLS || l.scheme == schemeSMTPS
+}
+
+// parseListeners parses the listen config into the settings of each listener.
+// It should be a list of addresses separated by spaces, in the form
+// "[scheme://]host:port[?option=value&...]" where scheme is one of tcp
+// (default), starttls, smtps (tls is an alias of smtps), or lmtp. lmtp
+// listeners speak LMTP (RFC 2033) instead of SMTP, e.g. as a Postfix
+// transport, and don't support TLS or authentication.
+//
+// Supported options are:
+//   - force_tls: require STARTTLS before MAIL (starttls only, defaults to
+//     local_forcetls)
+//   - auth: require authentication before MAIL (defaults to true if
+//     allowed_users, ldap_url, sql_dsn or auth_http_url is set)
+//   - proxy_protocol: expect a PROXY protocol v1 or v2 header, as sent by
+//     HAProxy or AWS NLB, conveying the original client address (not
+//     supported on smtps)
+//   - insecure_auth: allow authentication without TLS, e.g. on localhost or
+//     behind a load balancer terminating TLS (needs auth)
+//   - allowed_sender, allowed_recipients, denied_recipients: regular
+//     expressions overriding the global ones on the listener, percent-encoded
+//     (e.g. %2B for +)
+//   - submission: message submission profile (RFC 6409), e.g. on port 587:
+//     implies auth and force_tls, and completes the messages, see
+//     submissionStage (starttls and smtps only)
+func parseListeners(s string, cfg *config) ([]listenerConfig, error) {
+	listeners := []listenerConfig{}
+
+	for _, entry := range splitstr(s, ' ') {
+		l, err := parseListener(entry, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", entry, err)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("no listen address")
+	}
+
+	return listeners, nil
+}
+
+func parseListener(entry string, cfg *config) (listenerConfig, error) {
+	if !strings.Contains(entry, "://") {
+		entry = schemeTCP + "://" + entry
+	}
+
+	u, err := url.Parse(entry)
+	if err != nil {
+		return listenerConfig{}, err
+	}
+
+	l := listenerConfig{
+		scheme:  u.Scheme,
+		address: u.Host,
+		auth:    cfg.allowedUsers != "" || cfg.ldapURL != "" || cfg.sqlDSN != "" || cfg.authHTTPURL != "",
+	}
+
+	switch l.scheme {
+	case schemeTCP, schemeSMTPS:
+	case "tls":
+		l.scheme = schemeSMTPS
+	case schemeSTARTTLS:
+		l.forceTLS = cfg.localForceTLS
+	case schemeLMTP:
+		l.auth = false
+	default:
+		return listenerConfig{}, fmt.Errorf("unknown protocol %q", u.Scheme)
+	}
+
+	if l.address == "" {
+		return listenerConfig{}, errors.New("missing address")
+	}
+
+	for key, values := range u.Query() {
+		val := values[len(values)-1]
+
+		switch key {
+		case "force_tls":
+			l.forceTLS, err = strconv.ParseBool(val)
+		case "auth":
+			l.auth, err = strconv.ParseBool(val)
+		case "proxy_protocol":
+			l.proxy, err = strconv.ParseBool(val)
+		case "insecure_auth":
+			l.insecureAuth, err = strconv.ParseBool(val)
+		case "submission":
+			l.submission, err = strconv.ParseBool(val)
+		case "allowed_sender", "allowed_recipients", "denied_recipients":
+			if _, err = regexp.Compile(val); err != nil {
+				err = fmt.Errorf("invalid %s: %w", key, err)
+				break
+			}
+
+			if l.patterns == nil {
+				l.patterns = map[string]string{}
+			}
+
+			l.patterns[key] = val
+		default:
+			err = fmt.Errorf("unknown option %q", key)
+		}
+
+		if err != nil {
+			return listenerConfig{}, err
+		}
+	}
+
+	// submission clients must authenticate, over TLS
+	if l.submission {
+		if !l.tls() {
+			return listenerConfig{}, errors.New("submission is only supported on starttls:// and smtps:// listeners")
+		}
+
+		if l.insecureAuth {
+			return listenerConfig{}, errors.New("insecure_auth isn't supported on submission listeners")
+		}
+
+		l.auth = true
+		l.forceTLS = l.scheme == schemeSTARTTLS
+	}
+
+	if l.forceTLS && l.scheme != schemeSTARTTLS {
+		return listenerConfig{}, errors.New("force_tls is only supported on starttls:// listeners")
+	}
+
+	// the PROXY header is sent before the TLS handshake
+	if l.proxy && l.scheme == schemeSMTPS {
+		return listenerConfig{}, errors.New("proxy_protocol isn't supported on smtps:// listeners")
+	}
+
+	if l.auth && l.scheme == schemeLMTP {
+		return listenerConfig{}, errors.New("auth isn't supported on lmtp:// listeners")
+	}
+
+	if l.auth && cfg.allowedUsers == "" && cfg.ldapURL == "" && cfg.sqlDSN == "" && cfg.authHTTPURL == "" {
+		return listenerConfig{}, errors.New("auth requires allowed_users, ldap_url, sql_dsn or auth_http_url to be set")
+	}
+
+	if l.insecureAuth && !l.auth {
+		return listenerConfig{}, errors.New("insecure_auth requires auth")
+	}
+
+	return l, nil
+}
+
+// pattern returns the listener's allowed_sender, allowed_recipients or
+// denied_recipients, or the global one if it doesn't override it
+func (l listenerConfig) pattern(name, global string) string {
+	if p, ok := l.patterns[name]; ok {
+		return p
+	}
+
+	return global
+}
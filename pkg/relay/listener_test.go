@@ -0,0 +1,113 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListeners(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{localForceTLS: true}
+
+	listeners, err := parseListeners("127.0.0.1:25 [::1]:25 tls://:465 smtps://:465 starttls://:587 starttls://:2587?force_tls=false", cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []listenerConfig{
+		{scheme: schemeTCP, address: "127.0.0.1:25"},
+		{scheme: schemeTCP, address: "[::1]:25"},
+		{scheme: schemeSMTPS, address: ":465"},
+		{scheme: schemeSMTPS, address: ":465"},
+		{scheme: schemeSTARTTLS, address: ":587", forceTLS: true},
+		{scheme: schemeSTARTTLS, address: ":2587"},
+	}, listeners)
+
+	// auth defaults to enabled when a users file is configured
+	cfg = &config{allowedUsers: "users.txt"}
+
+	listeners, err = parseListeners("starttls://:587 tcp://127.0.0.1:25?auth=false lmtp://127.0.0.1:24", cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []listenerConfig{
+		{scheme: schemeSTARTTLS, address: ":587", auth: true},
+		{scheme: schemeTCP, address: "127.0.0.1:25"},
+		{scheme: schemeLMTP, address: "127.0.0.1:24"},
+	}, listeners)
+
+	_, err = parseListeners("lmtp://127.0.0.1:24?auth=true", cfg)
+	require.Error(t, err)
+
+	// submission listeners require authentication over TLS
+	listeners, err = parseListeners("starttls://:587?submission=true&force_tls=false smtps://:465?submission=true&auth=false", cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []listenerConfig{
+		{scheme: schemeSTARTTLS, address: ":587", auth: true, forceTLS: true, submission: true},
+		{scheme: schemeSMTPS, address: ":465", auth: true, submission: true},
+	}, listeners)
+
+	for _, bad := range []string{"tcp://:587?submission=true", "starttls://:587?submission=true&insecure_auth=true"} {
+		_, err = parseListeners(bad, cfg)
+		require.Error(t, err, "expected error for %q", bad)
+	}
+
+	listeners, err = parseListeners("tcp://127.0.0.1:25?insecure_auth=true", cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []listenerConfig{
+		{scheme: schemeTCP, address: "127.0.0.1:25", auth: true, insecureAuth: true},
+	}, listeners)
+
+	// and when an LDAP directory is
+	listeners, err = parseListeners("starttls://:587", &config{ldapURL: "ldaps://dc.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []listenerConfig{
+		{scheme: schemeSTARTTLS, address: ":587", auth: true},
+	}, listeners)
+
+	// or an SQL database
+	listeners, err = parseListeners("starttls://:587", &config{sqlDSN: "postgres://db.example.com/mail"})
+	require.NoError(t, err)
+	assert.Equal(t, []listenerConfig{
+		{scheme: schemeSTARTTLS, address: ":587", auth: true},
+	}, listeners)
+
+	listeners, err = parseListeners("starttls://:587?proxy_protocol=true", &config{})
+	require.NoError(t, err)
+	assert.Equal(t, []listenerConfig{
+		{scheme: schemeSTARTTLS, address: ":587", proxy: true},
+	}, listeners)
+
+	// the sender and recipient patterns override the global ones
+	listeners, err = parseListeners(`tcp://:25?allowed_recipients=@example\.com$&denied_recipients=^[a-z]%2B@&allowed_sender=`, &config{})
+	require.NoError(t, err)
+	assert.Equal(t, []listenerConfig{
+		{scheme: schemeTCP, address: ":25", patterns: map[string]string{
+			"allowed_sender":     "",
+			"allowed_recipients": `@example\.com$`,
+			"denied_recipients":  "^[a-z]+@",
+		}},
+	}, listeners)
+
+	assert.Equal(t, "", listeners[0].pattern("allowed_sender", "@example.org$"))
+	assert.Equal(t, "^[a-z]+@", listeners[0].pattern("denied_recipients", "^root@"))
+	assert.Equal(t, "^root@", listenerConfig{}.pattern("denied_recipients", "^root@"))
+
+	for _, bad := range []string{
+		"",
+		"udp://:25",
+		"tcp://",
+		"tcp://:25?force_tls=true",
+		"smtps://:465?force_tls=true",
+		"starttls://:587?force_tls=maybe",
+		"starttls://:587?bogus=true",
+		"tcp://:25?auth=true",
+		"lmtp://:24?force_tls=true",
+		"smtps://:465?proxy_protocol=true",
+		"tcp://:25?proxy_protocol=maybe",
+		"tcp://:25?insecure_auth=true",
+		"tcp://:25?allowed_sender=(",
+		"starttls://:587?submission=true",
+	} {
+		_, err = parseListeners(bad, &config{})
+		require.Error(t, err, "expected error for %q", bad)
+	}
+}
@@ -0,0 +1,230 @@
+package relay
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// lmtpScheme is the prefix of LMTP upstream hosts, followed by either
+// host:port, or the absolute path of a unix socket
+const lmtpScheme = "lmtp://"
+
+// recipientErrors holds the failed recipients of a delivery which wasn't
+// rejected as a whole: the recipients rejected by an SMTP upstream, or the ones
+// failed in the LMTP replies for each recipient (RFC 2033). The other
+// recipients were delivered.
+type recipientErrors map[string]error
+
+func (e recipientErrors) Error() string {
+	rcpts := make([]string, 0, len(e))
+	for rcpt := range e {
+		rcpts = append(rcpts, rcpt)
+	}
+
+	slices.Sort(rcpts)
+
+	msgs := make([]string, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		msgs = append(msgs, fmt.Sprintf("rcpt %s: %v", rcpt, e[rcpt]))
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// split returns the envelope for the recipients of out which failed
+// temporarily (nil if none) along with one of their errors, and the error of
+// one of the recipients which failed permanently, if any
+func (e recipientErrors) split(out *outbound) (retry *outbound, tempErr, permErr error) {
+	var temp []string
+
+	// keep the recipients order, so the reported errors are deterministic
+	for _, rcpt := range out.Recipients {
+		err, ok := e[rcpt]
+
+		switch {
+		case !ok:
+		case isTemporaryErr(err):
+			temp = append(temp, rcpt)
+			tempErr = cmp.Or(tempErr, err)
+		default:
+			permErr = cmp.Or(permErr, err)
+		}
+	}
+
+	if len(temp) > 0 {
+		o := *out
+		o.Recipients = temp
+		retry = &o
+	}
+
+	return retry, tempErr, permErr
+}
+
+// lmtpAddr returns the network and address of an LMTP upstream host, and
+// whether the host is an LMTP one
+func lmtpAddr(host string) (network, addr string, ok bool) {
+	addr, ok = strings.CutPrefix(host, lmtpScheme)
+	if !ok {
+		return "", "", false
+	}
+
+	if strings.HasPrefix(addr, "/") {
+		return "unix", addr, true
+	}
+
+	return "tcp", addr, true
+}
+
+// sendLMTP delivers the message to an LMTP server such as Dovecot or Cyrus,
+// usually for local mailbox delivery. LMTP servers are trusted: there's no
+// STARTTLS or authentication. As they reply for each recipient, the message
+// may be delivered to some recipients only, in which case a recipientErrors
+// is returned. The delivery is bounded by lmtp_timeout, and ended early if
+// ctx is done.
+func sendLMTP(ctx context.Context, cfg *config, out *outbound, network, addr string, body io.Reader) error {
+	if cfg.lmtpTimeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, cfg.lmtpTimeout)
+		defer cancel()
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	// TCP servers are connected to like the SMTP ones
+	if network == "tcp" {
+		conn, err = cfg.dialer.dial(ctx, addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, network, addr)
+	}
+
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+
+	text := textproto.NewConn(conn)
+	defer text.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	if _, _, err = text.ReadResponse(220); err != nil {
+		return fmt.Errorf("greeting: %w", err)
+	}
+
+	localName := cfg.hostName
+	if localName == "" {
+		localName = "localhost"
+	}
+
+	id, err := text.Cmd("LHLO %s", localName)
+	if err != nil {
+		return fmt.Errorf("lhlo: %w", err)
+	}
+
+	text.StartResponse(id)
+	_, msg, err := text.ReadResponse(250)
+	text.EndResponse(id)
+
+	if err != nil {
+		return fmt.Errorf("lhlo: %w", err)
+	}
+
+	ext := map[string]bool{}
+	for _, line := range strings.Split(msg, "\n")[1:] {
+		name, _, _ := strings.Cut(line, " ")
+		ext[strings.ToUpper(name)] = true
+	}
+
+	if out.SMTPUTF8 && !ext["SMTPUTF8"] {
+		return smtpd.ErrSMTPUTF8Unsupported
+	}
+
+	if out.Body8Bit && !ext["8BITMIME"] {
+		return smtpd.Err8BitMIMEUnsupported
+	}
+
+	dsn := ext["DSN"]
+	out.reply, out.upstreamDSN = "", dsn
+
+	if err = cmd(text, 250, "MAIL FROM:<%s>%s", out.Sender, out.mailParams(dsn, ext["SIZE"], ext["MT-PRIORITY"])); err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+
+	rcptErrs := recipientErrors{}
+	accepted := make([]string, 0, len(out.Recipients))
+
+	for _, rcpt := range out.Recipients {
+		err = cmd(text, 25, "RCPT TO:<%s>%s", rcpt, out.rcptParams(rcpt, dsn))
+
+		var tperr *textproto.Error
+		switch {
+		case errors.As(err, &tperr):
+			rcptErrs[rcpt] = tperr
+		case err != nil:
+			return fmt.Errorf("rcpt %s: %w", rcpt, err)
+		default:
+			accepted = append(accepted, rcpt)
+		}
+	}
+
+	if len(accepted) == 0 {
+		_ = cmd(text, 221, "QUIT")
+		return rcptErrs
+	}
+
+	if err = cmd(text, 354, "DATA"); err != nil {
+		return fmt.Errorf("data: %w", err)
+	}
+
+	// the message isn't completed if the body can't be read
+	w := text.DotWriter()
+	if _, err = io.Copy(w, body); err != nil {
+		return fmt.Errorf("data: %w", err)
+	}
+
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("data: %w", err)
+	}
+
+	// one reply for each accepted recipient, in order
+	for _, rcpt := range accepted {
+		_, reply, err := text.ReadResponse(250)
+
+		var tperr *textproto.Error
+		switch {
+		case errors.As(err, &tperr):
+			rcptErrs[rcpt] = tperr
+		case err != nil:
+			return fmt.Errorf("data: %w", err)
+		default:
+			out.reply = cmp.Or(out.reply, reply)
+		}
+	}
+
+	_ = cmd(text, 221, "QUIT")
+
+	if len(rcptErrs) > 0 {
+		return rcptErrs
+	}
+
+	return nil
+}
@@ -0,0 +1,297 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLMTP is a minimal scripted LMTP server, replying to RCPT and after DATA
+// for each recipient
+type fakeLMTP struct {
+	addr string
+
+	// rcptReplies and dataReplies override the replies for the given
+	// recipients
+	rcptReplies map[string]string
+	dataReplies map[string]string
+
+	data chan string
+}
+
+func startFakeLMTP(t *testing.T, network, addr string) *fakeLMTP {
+	t.Helper()
+
+	l, err := net.Listen(network, addr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = l.Close() })
+
+	s := &fakeLMTP{
+		addr:        l.Addr().String(),
+		rcptReplies: map[string]string{},
+		dataReplies: map[string]string{},
+		data:        make(chan string, 1),
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeLMTP) serve(conn net.Conn) {
+	defer conn.Close()
+
+	tc := textproto.NewConn(conn)
+
+	_ = tc.PrintfLine("220 fake LMTP")
+
+	var accepted []string
+
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(line)
+
+		switch {
+		case strings.HasPrefix(cmd, "LHLO"):
+			_ = tc.PrintfLine("250-fake\r\n250-8BITMIME\r\n250 PIPELINING")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			rcpt := strings.Trim(line[len("RCPT TO:"):], "<>")
+
+			if reply, ok := s.rcptReplies[rcpt]; ok {
+				_ = tc.PrintfLine("%s", reply)
+				continue
+			}
+
+			accepted = append(accepted, rcpt)
+			_ = tc.PrintfLine("250 OK")
+		case cmd == "DATA":
+			_ = tc.PrintfLine("354 go ahead")
+
+			b, err := io.ReadAll(tc.DotReader())
+			if err != nil {
+				return
+			}
+
+			s.data <- string(b)
+
+			for _, rcpt := range accepted {
+				reply, ok := s.dataReplies[rcpt]
+				if !ok {
+					reply = "250 2.0.0 <" + rcpt + "> delivered"
+				}
+
+				_ = tc.PrintfLine("%s", reply)
+			}
+		case cmd == "QUIT":
+			_ = tc.PrintfLine("221 bye")
+			return
+		default:
+			_ = tc.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestLMTPAddr(t *testing.T) {
+	t.Parallel()
+
+	network, addr, ok := lmtpAddr("lmtp://127.0.0.1:24")
+	assert.True(t, ok)
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "127.0.0.1:24", addr)
+
+	network, addr, ok = lmtpAddr("lmtp:///var/run/dovecot/lmtp")
+	assert.True(t, ok)
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/var/run/dovecot/lmtp", addr)
+
+	_, _, ok = lmtpAddr("smtp.example.com:25")
+	assert.False(t, ok)
+}
+
+func TestSendLMTP(t *testing.T) {
+	t.Parallel()
+
+	sock := filepath.Join(t.TempDir(), "lmtp.sock")
+	s := startFakeLMTP(t, "unix", sock)
+
+	out := &outbound{
+		Host:       lmtpScheme + sock,
+		Sender:     "bob@example.com",
+		Recipients: []string{"alice@example.com", "carol@example.com"},
+	}
+
+	err := sendMail(&config{}, out, []byte("Subject: test\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "Subject: test\n\nhello\n", <-s.data)
+}
+
+func TestSendLMTPRecipientErrors(t *testing.T) {
+	t.Parallel()
+
+	s := startFakeLMTP(t, "tcp", "127.0.0.1:0")
+	s.rcptReplies["dave@example.com"] = "550 5.1.1 no such user"
+	s.dataReplies["carol@example.com"] = "452 4.2.2 mailbox full"
+
+	out := &outbound{
+		Host:       lmtpScheme + s.addr,
+		Sender:     "bob@example.com",
+		Recipients: []string{"alice@example.com", "carol@example.com", "dave@example.com"},
+	}
+
+	err := sendMail(&config{}, out, []byte("Subject: test\r\n\r\nhello\r\n"))
+	require.Error(t, err)
+	<-s.data
+
+	var rcptErrs recipientErrors
+	require.ErrorAs(t, err, &rcptErrs)
+	assert.Len(t, rcptErrs, 2)
+	assert.NotContains(t, rcptErrs, "alice@example.com")
+
+	retry, tempErr, permErr := rcptErrs.split(out)
+	require.NotNil(t, retry)
+	assert.Equal(t, []string{"carol@example.com"}, retry.Recipients)
+	assert.Equal(t, out.Sender, retry.Sender)
+
+	var tperr *textproto.Error
+	require.ErrorAs(t, tempErr, &tperr)
+	assert.Equal(t, 452, tperr.Code)
+
+	require.ErrorAs(t, permErr, &tperr)
+	assert.Equal(t, 550, tperr.Code)
+
+	// the recipients of the original envelope are left untouched
+	assert.Len(t, out.Recipients, 3)
+}
+
+func TestSendLMTPAllRejected(t *testing.T) {
+	t.Parallel()
+
+	sock := filepath.Join(t.TempDir(), "lmtp.sock")
+	s := startFakeLMTP(t, "unix", sock)
+	s.rcptReplies["alice@example.com"] = "550 5.1.1 no such user"
+
+	out := &outbound{
+		Host:       lmtpScheme + sock,
+		Sender:     "bob@example.com",
+		Recipients: []string{"alice@example.com"},
+	}
+
+	err := sendMail(&config{}, out, []byte("hello\r\n"))
+
+	var rcptErrs recipientErrors
+	require.ErrorAs(t, err, &rcptErrs)
+
+	retry, tempErr, permErr := rcptErrs.split(out)
+	assert.Nil(t, retry)
+	require.NoError(t, tempErr)
+	require.Error(t, permErr)
+}
+
+func TestSendLMTPTimeout(t *testing.T) {
+	t.Parallel()
+
+	// the server accepts the connection but never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+		}
+	}()
+
+	out := &outbound{
+		Host:       lmtpScheme + l.Addr().String(),
+		Sender:     "bob@example.com",
+		Recipients: []string{"alice@example.com"},
+	}
+
+	start := time.Now()
+	err = sendMail(&config{lmtpTimeout: 100 * time.Millisecond}, out, []byte("hello\r\n"))
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// and deliveries end with their context
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	var p *upstreamPool
+	require.Error(t, p.send(ctx, &config{}, out, strings.NewReader("hello\r\n")))
+}
+
+func TestQueueRetryRecipients(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	attempts := [][]string{}
+
+	deliver := func(_ context.Context, msg *queuedMessage, _ []byte) error {
+		attempts = append(attempts, msg.Recipients)
+
+		if len(attempts) == 1 {
+			return recipientErrors{
+				"carol@example.com": &textproto.Error{Code: 452, Msg: "mailbox full"},
+				"dave@example.com":  &textproto.Error{Code: 550, Msg: "no such user"},
+			}
+		}
+
+		return nil
+	}
+
+	q := newTestQueue(t, dir, deliver)
+
+	out := *testOutbound
+	out.Recipients = []string{"alice@example.com", "carol@example.com", "dave@example.com"}
+
+	_, err := q.enqueue(&out, []byte("hello"), errors.New("connection refused"))
+	require.NoError(t, err)
+
+	require.NoError(t, q.flush(ctx))
+
+	msgs, err := q.messages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, []string{"carol@example.com"}, msgs[0].Recipients)
+	assert.Contains(t, msgs[0].LastError, "mailbox full")
+
+	require.NoError(t, q.flush(ctx))
+
+	msgs, err = q.messages()
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	assert.Equal(t, [][]string{out.Recipients, {"carol@example.com"}}, attempts)
+}
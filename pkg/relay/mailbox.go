@@ -0,0 +1,242 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// local archive schemes
+const (
+	archiveMaildir = "maildir"
+	archiveMbox    = "mbox"
+)
+
+// mailboxArchiver appends the messages to a local Maildir or mbox, which is
+// rotated once it exceeds maxSize: it's renamed with the time of the rotation
+// as suffix, and a new one is started. The envelope is added to the headers
+// of the messages, as Return-Path and X-Smtprelay-Recipients.
+type mailboxArchiver struct {
+	path    string
+	maildir bool
+	maxSize int64 // 0 to never rotate
+
+	mu   sync.Mutex
+	size int64 // -1 until the size of the Maildir is known
+}
+
+func newMailboxArchiver(cfg *config, u *url.URL) (*mailboxArchiver, error) {
+	if u.Host != "" || !filepath.IsAbs(u.Path) {
+		return nil, fmt.Errorf("archive_url %q must be an absolute path, as %s:///path", cfg.archiveURL, u.Scheme)
+	}
+
+	return &mailboxArchiver{
+		path:    filepath.Clean(u.Path),
+		maildir: u.Scheme == archiveMaildir,
+		maxSize: int64(cfg.archiveMaxSize),
+		size:    -1,
+	}, nil
+}
+
+func (a *mailboxArchiver) store(_ context.Context, entry *archiveEntry, data []byte) error {
+	var msg []byte
+	if a.maildir {
+		msg = maildirMessage(entry, data)
+	} else {
+		msg = mboxMessage(entry, data)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var err error
+	if a.maildir {
+		err = a.storeMaildir(entry, msg)
+	} else {
+		err = a.storeMbox(msg)
+	}
+
+	if err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+
+	return nil
+}
+
+// storeMaildir delivers the message to the new/ directory of the Maildir,
+// through its tmp/ directory so readers never see partial messages
+func (a *mailboxArchiver) storeMaildir(entry *archiveEntry, msg []byte) error {
+	if a.size < 0 {
+		size, err := dirSize(a.path)
+		if err != nil {
+			return err
+		}
+
+		a.size = size
+	}
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(msg)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+
+		a.size = 0
+	}
+
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(a.path, dir), 0o700); err != nil {
+			return err
+		}
+	}
+
+	// unique names are time.id.host, with the size for readers which can
+	// use it (Dovecot)
+	hostname, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%s.%s,S=%d", entry.Time.Unix(), entry.ID,
+		strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname), len(msg))
+
+	tmp := filepath.Join(a.path, "tmp", name)
+	if err := writeFileAtomic(tmp, msg); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(a.path, "new", name)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	a.size += int64(len(msg))
+
+	return nil
+}
+
+// storeMbox appends the message to the mbox
+func (a *mailboxArchiver) storeMbox(msg []byte) error {
+	if a.maxSize > 0 {
+		fi, err := os.Stat(a.path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		if err == nil && fi.Size() > 0 && fi.Size()+int64(len(msg)) > a.maxSize {
+			if err := a.rotate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(a.path), 0o700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(msg)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// rotate renames the mailbox with the current time as suffix, followed by a
+// counter if it was already rotated within the same second
+func (a *mailboxArchiver) rotate() error {
+	rotated := a.path + "." + time.Now().UTC().Format("20060102T150405")
+
+	name := rotated
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(name); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+
+		name = rotated + "-" + strconv.Itoa(i)
+	}
+
+	return os.Rename(a.path, name)
+}
+
+// dirSize returns the size of the files in the directory and its
+// subdirectories, 0 if it doesn't exist
+func dirSize(dir string) (int64, error) {
+	var size int64
+
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			size += fi.Size()
+		}
+
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+
+	return size, err
+}
+
+// mailboxHeaders returns the envelope headers prepended to the messages
+func mailboxHeaders(entry *archiveEntry) string {
+	return "Return-Path: <" + entry.Sender + ">\n" +
+		webhookRecipientsHeader + ": " + strings.Join(entry.Recipients, ",") + "\n"
+}
+
+// maildirMessage returns the message as stored in a Maildir, with LF line
+// endings
+func maildirMessage(entry *archiveEntry, data []byte) []byte {
+	return append([]byte(mailboxHeaders(entry)), bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))...)
+}
+
+// mboxMessage returns the message as appended to an mbox, in the mboxrd
+// format: a From line with the sender and date, the message with LF line
+// endings and its From lines quoted with >, and an empty line
+func mboxMessage(entry *archiveEntry, data []byte) []byte {
+	sender := entry.Sender
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+
+	var b bytes.Buffer
+
+	b.WriteString("From " + sender + " " + entry.Time.Format(time.ANSIC) + "\n")
+	b.WriteString(mailboxHeaders(entry))
+
+	for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			b.WriteByte('>')
+		}
+
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+
+	b.WriteByte('\n')
+
+	return b.Bytes()
+}
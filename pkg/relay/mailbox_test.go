@@ -0,0 +1,107 @@
+package relay
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMailboxArchiver(t *testing.T) {
+	t.Parallel()
+
+	for _, url := range []string{"maildir://archive", "mbox:archive"} {
+		_, err := newArchiver(&config{archiveURL: url})
+		require.Error(t, err, url)
+	}
+
+	a, err := newArchiver(&config{archiveURL: "maildir:///var/mail/archive/"})
+	require.NoError(t, err)
+	assert.Equal(t, "/var/mail/archive", a.(*mailboxArchiver).path)
+	assert.True(t, a.(*mailboxArchiver).maildir)
+}
+
+func TestMaildirArchiver(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "archive")
+
+	a, err := newArchiver(&config{archiveURL: "maildir://" + dir, archiveMaxSize: 200})
+	require.NoError(t, err)
+
+	e := testArchiveEntry()
+	require.NoError(t, a.store(context.Background(), e, []byte("Subject: test\r\n\r\nhello\r\n")))
+
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	data, err := os.ReadFile(filepath.Join(dir, "new", entries[0].Name()))
+	require.NoError(t, err)
+	assert.Equal(t, "Return-Path: <Bob@Example.com>\nX-Smtprelay-Recipients: alice@example.org\nSubject: test\n\nhello\n", string(data))
+
+	// the Maildir is rotated once it would exceed the max size
+	for _, id := range []string{"5678", "9012"} {
+		e.ID = id
+		require.NoError(t, a.store(context.Background(), e, []byte("Subject: test\r\n\r\nhello\r\n")))
+	}
+
+	rotated, err := filepath.Glob(dir + ".*")
+	require.NoError(t, err)
+	require.Len(t, rotated, 1)
+
+	entries, err = os.ReadDir(filepath.Join(rotated[0], "new"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	entries, err = os.ReadDir(filepath.Join(dir, "new"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestMboxArchiver(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "archive.mbox")
+
+	a, err := newArchiver(&config{archiveURL: "mbox://" + path, archiveMaxSize: 300})
+	require.NoError(t, err)
+
+	e := testArchiveEntry()
+	e.Time = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	require.NoError(t, a.store(context.Background(), e, []byte("Subject: test\r\n\r\nFrom here\r\n>From there\r\n")))
+
+	e.Sender = ""
+	require.NoError(t, a.store(context.Background(), e, []byte("Subject: bounce\r\n\r\nhello\r\n")))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "From Bob@Example.com Tue Jan  2 03:04:05 2024\n"+
+		"Return-Path: <Bob@Example.com>\nX-Smtprelay-Recipients: alice@example.org\n"+
+		"Subject: test\n\n>From here\n>>From there\n\n"+
+		"From MAILER-DAEMON Tue Jan  2 03:04:05 2024\n"+
+		"Return-Path: <>\nX-Smtprelay-Recipients: alice@example.org\n"+
+		"Subject: bounce\n\nhello\n\n", string(data))
+
+	// the mbox is rotated once it would exceed the max size
+	require.NoError(t, a.store(context.Background(), e, []byte("Subject: bounce\r\n\r\nhello\r\n")))
+
+	rotated, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	require.Len(t, rotated, 1)
+
+	old, err := os.ReadFile(rotated[0])
+	require.NoError(t, err)
+	assert.Equal(t, data, old)
+
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "From MAILER-DAEMON Tue Jan  2 03:04:05 2024\n"+
+		"Return-Path: <>\nX-Smtprelay-Recipients: alice@example.org\n"+
+		"Subject: bounce\n\nhello\n\n", string(data))
+}
@@ -0,0 +1,96 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// masqueradeRule rewrites the domain of the senders whose domain matches a
+// glob pattern
+type masqueradeRule struct {
+	pattern string
+	domain  string
+}
+
+// masquerade rewrites the domain of envelope senders, e.g. to hide internal
+// hostnames behind the domain they send for
+type masquerade struct {
+	rules    []masqueradeRule
+	fallback string // domain of the senders not matching any rule
+}
+
+// parse the input into a masquerade. It should be in the form of
+// "example.com *.internal.example.org=example.org" (separated by spaces),
+// where the entry without a pattern applies to all the senders not matching
+// the other ones. Patterns use path.Match syntax and are matched
+// case-insensitively against the sender domain. Returns nil if the input is
+// empty.
+func parseMasquerade(s string) (*masquerade, error) {
+	entries := splitstr(s, ' ')
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	m := &masquerade{}
+
+	for _, entry := range entries {
+		pattern, domain, found := strings.Cut(entry, "=")
+		if !found {
+			if m.fallback != "" {
+				return nil, fmt.Errorf("duplicate default domain %q", entry)
+			}
+
+			m.fallback = entry
+
+			continue
+		}
+
+		if pattern == "" || domain == "" {
+			return nil, fmt.Errorf("invalid entry %q", entry)
+		}
+
+		pattern = strings.ToLower(pattern)
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+
+		m.rules = append(m.rules, masqueradeRule{pattern: pattern, domain: domain})
+	}
+
+	if strings.Contains(m.fallback, "@") {
+		return nil, errors.New("expected a domain, not an address")
+	}
+
+	return m, nil
+}
+
+// rewrite returns the masqueraded sender, and whether it was rewritten. Null
+// senders are never rewritten.
+func (m *masquerade) rewrite(sender string) (string, bool) {
+	if m == nil {
+		return sender, false
+	}
+
+	local, domain, ok := cutAddress(sender)
+	if !ok {
+		return sender, false
+	}
+
+	target := m.fallback
+
+	for _, r := range m.rules {
+		if matched, _ := path.Match(r.pattern, strings.ToLower(domain)); matched {
+			target = r.domain
+			break
+		}
+	}
+
+	if target == "" || strings.EqualFold(target, domain) {
+		return sender, false
+	}
+
+	return local + "@" + target, true
+}
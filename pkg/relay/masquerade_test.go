@@ -0,0 +1,68 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMasquerade(t *testing.T) {
+	t.Parallel()
+
+	m, err := parseMasquerade("")
+	require.NoError(t, err)
+	assert.Nil(t, m)
+
+	m, err = parseMasquerade("example.com *.Internal.example.org=example.org")
+	require.NoError(t, err)
+	assert.Equal(t, &masquerade{
+		rules:    []masqueradeRule{{pattern: "*.internal.example.org", domain: "example.org"}},
+		fallback: "example.com",
+	}, m)
+
+	for _, s := range []string{"example.com example.org", "=example.org", "*.example.org=", "[=example.org", "bob@example.com"} {
+		_, err = parseMasquerade(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestMasqueradeRewrite(t *testing.T) {
+	t.Parallel()
+
+	var m *masquerade
+
+	sender, ok := m.rewrite("bob@host.example.com")
+	assert.False(t, ok)
+	assert.Equal(t, "bob@host.example.com", sender)
+
+	m, err := parseMasquerade("*.internal.example.org=example.org")
+	require.NoError(t, err)
+
+	for addr, expected := range map[string]string{
+		"bob@host.INTERNAL.example.org": "bob@example.org",
+		"bob@example.com":               "",
+		"":                              "",
+	} {
+		sender, ok = m.rewrite(addr)
+		assert.Equal(t, expected != "", ok, addr)
+
+		if ok {
+			assert.Equal(t, expected, sender)
+		} else {
+			assert.Equal(t, addr, sender)
+		}
+	}
+
+	// the fallback applies to all the other senders
+	m, err = parseMasquerade("example.com *.internal.example.org=example.org")
+	require.NoError(t, err)
+
+	sender, ok = m.rewrite("bob@host.example.net")
+	assert.True(t, ok)
+	assert.Equal(t, "bob@example.com", sender)
+
+	sender, ok = m.rewrite("bob@EXAMPLE.com")
+	assert.False(t, ok)
+	assert.Equal(t, "bob@EXAMPLE.com", sender)
+}
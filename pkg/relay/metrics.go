@@ -0,0 +1,538 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	deltapprof "github.com/grafana/pyroscope-go/godeltaprof/http/pprof"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors/version"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	requestsCounter   prometheus.Counter
+	errorsCounter     *prometheus.CounterVec
+	durationHistogram *prometheus.HistogramVec
+	durationNative    *prometheus.HistogramVec
+	msgSizeHistogram  prometheus.Histogram
+	dmarcCounter      *prometheus.CounterVec
+	throttledCounter  *prometheus.CounterVec
+
+	upstreamConnsCounter  *prometheus.CounterVec
+	upstreamUpGauge       *prometheus.GaugeVec
+	mtaSTSFailuresCounter *prometheus.CounterVec
+	discardedCounter      prometheus.Counter
+	recipientsCounter     *prometheus.CounterVec
+
+	clamavScansCounter      *prometheus.CounterVec
+	clamavDurationHistogram *prometheus.HistogramVec
+
+	dnsblCounter   *prometheus.CounterVec
+	calloutCounter *prometheus.CounterVec
+
+	policyServiceCounter *prometheus.CounterVec
+	quarantineCounter    *prometheus.CounterVec
+	duplicatesCounter    *prometheus.CounterVec
+
+	deliveryDurationHistogram *prometheus.HistogramVec
+	deliveryBytesCounter      *prometheus.CounterVec
+	deliveryThrottledCounter  *prometheus.CounterVec
+	queueMessagesGauge        prometheus.Gauge
+	queueOldestGauge          prometheus.Gauge
+	sessionsGauge             *prometheus.GaugeVec
+	sessionLimitsCounter      *prometheus.CounterVec
+	earlyTalkersCounter       *prometheus.CounterVec
+	authLockoutsCounter       *prometheus.CounterVec
+)
+
+// Outcomes of the deliveries to each recipient
+const (
+	outcomeDelivered = "delivered" // accepted by the upstream
+	outcomeDeferred  = "deferred"  // queued for retry
+	outcomeFailed    = "failed"    // reported back to the client, or dropped from the queue
+)
+
+const mb = 1024 * 1024
+
+func init() {
+	ns := applicationName
+
+	// TODO: rename this to add a _total suffix
+	requestsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "requests_count",
+		Help:      "count of message relay requests",
+	})
+
+	// TODO: rename this to add a _total suffix
+	errorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "errors_count",
+		Help:      "count of unsuccessfully relayed messages",
+	}, []string{"error_code"})
+
+	// TODO: remove this
+	durationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Name:      "request_duration",
+		Help:      "duration of message relay requests",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"error_code"})
+
+	durationNative = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                       ns,
+		Subsystem:                       "relay",
+		Name:                            "duration_seconds",
+		Help:                            "duration of message relay requests",
+		Buckets:                         prometheus.DefBuckets,
+		NativeHistogramBucketFactor:     1.1,
+		NativeHistogramMaxBucketNumber:  160,
+		NativeHistogramMinResetDuration: 1 * time.Hour,
+	}, []string{"status_code"})
+
+	msgSizeHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Name:      "message_bytes",
+		Help:      "size of messages",
+		Buckets:   []float64{0.05 * mb, 0.1 * mb, 0.25 * mb, 0.5 * mb, 1 * mb, 2 * mb, 5 * mb, 10 * mb, 20 * mb},
+	})
+
+	dmarcCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "dmarc",
+		Name:      "messages_total",
+		Help:      "count of messages checked against DMARC policies, by result and disposition",
+	}, []string{"result", "disposition"})
+
+	throttledCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "rate_limit",
+		Name:      "throttled_total",
+		Help:      "count of sessions throttled by rate limits, by limit and key",
+	}, []string{"limit", "key"})
+
+	upstreamConnsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "upstream",
+		Name:      "connections_total",
+		Help:      "count of upstream connections used to deliver messages, by whether they were reused from the pool",
+	}, []string{"reused"})
+
+	upstreamUpGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: "upstream",
+		Name:      "up",
+		Help:      "whether the hosts of the upstream groups are up (1) or marked down (0), by host",
+	}, []string{"host"})
+
+	mtaSTSFailuresCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "mta_sts",
+		Name:      "failures_total",
+		Help:      "count of MTA-STS policy failures of outgoing deliveries, by policy mode and reason",
+	}, []string{"mode", "reason"})
+
+	discardedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "delivery",
+		Name:      "discarded_total",
+		Help:      "count of messages discarded by the discard delivery mode",
+	})
+
+	recipientsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "delivery",
+		Name:      "recipients_total",
+		Help:      "count of delivery attempts to each upstream recipient, by outcome",
+	}, []string{"outcome"})
+
+	clamavScansCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "clamav",
+		Name:      "scans_total",
+		Help:      "count of messages scanned for viruses, by result",
+	}, []string{"result"})
+
+	clamavDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: "clamav",
+		Name:      "scan_duration_seconds",
+		Help:      "duration of virus scans, by result",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	dnsblCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "dnsbl",
+		Name:      "listed_total",
+		Help:      "count of client IPs found in DNS blocklists, by list",
+	}, []string{"list"})
+
+	calloutCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "callout",
+		Name:      "probes_total",
+		Help:      "count of recipients verified with their upstream host, by result",
+	}, []string{"result"})
+
+	policyServiceCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "policy_service",
+		Name:      "requests_total",
+		Help:      "count of recipients checked with the policy server, by result",
+	}, []string{"result"})
+
+	quarantineCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "quarantine",
+		Name:      "messages_total",
+		Help:      "count of messages quarantined instead of rejected, by check",
+	}, []string{"check"})
+
+	duplicatesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "dedup",
+		Name:      "duplicates_total",
+		Help:      "count of messages whose Message-ID was already accepted or being delivered, by action",
+	}, []string{"action"})
+
+	deliveryDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: "delivery",
+		Name:      "duration_seconds",
+		Help:      "duration of deliveries to the upstreams, by upstream host and result class (2xx, 4xx, 5xx, or error without reply)",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"upstream", "result"})
+
+	deliveryBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "delivery",
+		Name:      "bytes_total",
+		Help:      "count of message bytes relayed to the upstreams, by upstream host",
+	}, []string{"upstream"})
+
+	deliveryThrottledCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "delivery",
+		Name:      "throttled_total",
+		Help:      "count of deliveries deferred by the delivery limits, by reason (concurrency, rate or backoff)",
+	}, []string{"reason"})
+
+	queueMessagesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: "queue",
+		Name:      "messages",
+		Help:      "number of messages in the queue, waiting for a retry",
+	})
+
+	queueOldestGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: "queue",
+		Name:      "oldest_message_age_seconds",
+		Help:      "age of the oldest message in the queue, as of the last scan of the spool directory",
+	})
+
+	sessionsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "sessions_active",
+		Help:      "number of open SMTP sessions, by listener",
+	}, []string{"listener"})
+
+	sessionLimitsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "sessions_disconnected_total",
+		Help:      "number of SMTP sessions ended on a limit, by listener and reason (duration, commands or errors)",
+	}, []string{"listener", "reason"})
+
+	earlyTalkersCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "early_talkers_total",
+		Help:      "number of clients which sent data before the greeting, by listener and action (reject or log)",
+	}, []string{"listener", "action"})
+
+	authLockoutsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "auth_lockouts_total",
+		Help:      "number of client IPs and usernames locked after too many failed AUTH attempts, by kind (ip or username)",
+	}, []string{"kind"})
+}
+
+func registerMetrics(registry prometheus.Registerer) error {
+	err := registry.Register(requestsCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(errorsCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(durationHistogram)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(durationNative)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(msgSizeHistogram)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(dmarcCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(throttledCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(upstreamConnsCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(upstreamUpGauge)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(mtaSTSFailuresCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(discardedCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(recipientsCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(clamavScansCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(clamavDurationHistogram)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(dnsblCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(calloutCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(policyServiceCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(quarantineCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(duplicatesCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(deliveryDurationHistogram)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(deliveryBytesCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(deliveryThrottledCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(queueMessagesGauge)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(queueOldestGauge)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(sessionsGauge)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(sessionLimitsCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(earlyTalkersCounter)
+	if err != nil {
+		return err
+	}
+	err = registry.Register(authLockoutsCounter)
+	if err != nil {
+		return err
+	}
+
+	err = registry.Register(version.NewCollector(applicationName))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// observeRecipients counts n recipients with the delivery outcome
+func observeRecipients(outcome string, n int) {
+	if n > 0 {
+		recipientsCounter.WithLabelValues(outcome).Add(float64(n))
+	}
+}
+
+// observeDelivery records the duration of the delivery of a message of size
+// bytes to the upstream host, by class of its result, and counts the bytes
+// relayed if the upstream accepted it, even for some of the recipients only.
+// Recipient domains delivered to with MX lookups share the mx upstream label.
+func observeDelivery(host string, size int64, err error, duration time.Duration) {
+	upstream := host
+	if strings.HasPrefix(host, mxScheme) {
+		upstream = "mx"
+	}
+
+	result := "2xx"
+
+	var (
+		rcptErrs recipientErrors
+		tperr    *textproto.Error
+		smtpErr  *smtpd.Error
+	)
+
+	switch {
+	case err == nil, errors.As(err, &rcptErrs):
+	case errors.As(err, &tperr):
+		result = strconv.Itoa(tperr.Code/100) + "xx"
+	case errors.As(err, &smtpErr):
+		result = strconv.Itoa(smtpErr.Code/100) + "xx"
+	default:
+		result = "error"
+	}
+
+	deliveryDurationHistogram.WithLabelValues(upstream, result).Observe(duration.Seconds())
+
+	if result == "2xx" {
+		deliveryBytesCounter.WithLabelValues(upstream).Add(float64(size))
+	}
+}
+
+// sessionsListener counts the open sessions of the listener, from the time
+// their connection is accepted until it's closed
+type sessionsListener struct {
+	net.Listener
+	gauge prometheus.Gauge
+}
+
+func (l *sessionsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.gauge.Inc()
+
+	return &sessionConn{Conn: conn, gauge: l.gauge}, nil
+}
+
+// sessionConn decrements the gauge once it's closed
+type sessionConn struct {
+	net.Conn
+	gauge prometheus.Gauge
+	once  sync.Once
+}
+
+func (c *sessionConn) Close() error {
+	c.once.Do(c.gauge.Dec)
+
+	return c.Conn.Close()
+}
+
+func handleMetrics(ctx context.Context, addr string, registry prometheus.Registerer) (*instrumentationServer, error) {
+	log := slog.Default().With(slog.String("component", "metrics"))
+
+	// Setup listeners first, so we can fail early if the address is in use.
+	httpListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen at %s: %w", addr, err)
+	}
+
+	if err = registerMetrics(registry); err != nil {
+		return nil, fmt.Errorf("registerMetrics: %w", err)
+	}
+
+	router := http.NewServeMux()
+	router.Handle("/metrics", promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+		}),
+	))
+
+	router.HandleFunc("/debug/pprof/", pprof.Index)
+	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	router.HandleFunc("/debug/pprof/delta_heap", deltapprof.Heap)
+	router.HandleFunc("/debug/pprof/delta_block", deltapprof.Block)
+	router.HandleFunc("/debug/pprof/delta_mutex", deltapprof.Mutex)
+
+	srv := &http.Server{
+		// 5s timeout for header reads to avoid Slowloris attacks (https://thetooth.io/blog/slowloris-attack/)
+		ReadHeaderTimeout: 5 * time.Second,
+		Handler:           router,
+		BaseContext:       func(_ net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		err := srv.Serve(httpListener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("instrumentation server terminated with error", slog.Any("error", err))
+		}
+	}()
+
+	log.Info("instrumentation server listening", slog.String("addr", addr))
+
+	return &instrumentationServer{srv: srv}, nil
+}
+
+type instrumentationServer struct {
+	srv *http.Server
+}
+
+func (m *instrumentationServer) Stop() {
+	m.srv.Close()
+}
+
+// observeDuration records the duration of a message relay request.
+func observeDuration(ctx context.Context, statusCode int, duration time.Duration) {
+	traceID := trace.SpanFromContext(ctx).SpanContext().TraceID()
+	exemplarLabels := prometheus.Labels{}
+	if traceID.IsValid() {
+		exemplarLabels["traceID"] = traceID.String()
+	}
+
+	durHist := durationNative.WithLabelValues(strconv.Itoa(statusCode)).(prometheus.ExemplarObserver)
+	durHist.ObserveWithExemplar(duration.Seconds(), exemplarLabels)
+
+	// legacy metric doesn't get exemplar - it's going away
+	durationHistogram.WithLabelValues(strconv.Itoa(statusCode)).Observe(duration.Seconds())
+}
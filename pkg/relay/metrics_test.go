@@ -0,0 +1,164 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveDelivery(t *testing.T) {
+	t.Parallel()
+
+	// the upstream hosts are unique to the test, as the metrics are global
+	const host = "observe-delivery.example.com:587"
+
+	observeDelivery(host, 100, nil, time.Second)
+	observeDelivery(host, 50, recipientErrors{"bob@example.com": &textproto.Error{Code: 550, Msg: "no"}}, time.Second)
+	observeDelivery(host, 10, &textproto.Error{Code: 421, Msg: "try again later"}, time.Second)
+	observeDelivery(host, 10, &smtpd.Error{Code: 554, Msg: "rejected"}, time.Second)
+	observeDelivery(host, 10, errors.New("dial: connection refused"), time.Second)
+
+	count := func(upstream, result string) int {
+		h := deliveryDurationHistogram.WithLabelValues(upstream, result).(prometheus.Histogram)
+
+		return testutil.CollectAndCount(h)
+	}
+
+	assert.Equal(t, 1, count(host, "2xx"))
+	assert.Equal(t, 1, count(host, "4xx"))
+	assert.Equal(t, 1, count(host, "5xx"))
+	assert.Equal(t, 1, count(host, "error"))
+
+	// only the accepted messages are counted as relayed
+	assert.InDelta(t, 150.0, testutil.ToFloat64(deliveryBytesCounter.WithLabelValues(host)), 0)
+
+	// recipient domains share a label
+	observeDelivery(mxScheme+"observe-delivery.example.org", 20, nil, time.Second)
+	observeDelivery(mxScheme+"observe-delivery.example.net", 20, nil, time.Second)
+	assert.GreaterOrEqual(t, testutil.ToFloat64(deliveryBytesCounter.WithLabelValues("mx")), 40.0)
+}
+
+func TestSessionsListener(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_sessions"})
+	ln := &sessionsListener{Listener: l, gauge: gauge}
+
+	t.Cleanup(func() { _ = ln.Close() })
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = client.Close() })
+
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	assert.InDelta(t, 1.0, testutil.ToFloat64(gauge), 0)
+
+	// closing twice only counts once
+	require.NoError(t, conn.Close())
+	_ = conn.Close()
+	assert.InDelta(t, 0.0, testutil.ToFloat64(gauge), 0)
+}
+
+//nolint:paralleltest
+func TestQueueMetrics(t *testing.T) {
+	q := newTestQueue(t, t.TempDir(), func(context.Context, *queuedMessage, []byte) error {
+		return nil
+	})
+
+	now := time.Now()
+
+	observeQueue(nil, now)
+	assert.InDelta(t, 0.0, testutil.ToFloat64(queueMessagesGauge), 0)
+	assert.InDelta(t, 0.0, testutil.ToFloat64(queueOldestGauge), 0)
+
+	_, err := q.enqueue(testOutbound, []byte("hello"), nil)
+	require.NoError(t, err)
+	_, err = q.enqueue(testOutbound, []byte("hello"), nil)
+	require.NoError(t, err)
+	assert.InDelta(t, 2.0, testutil.ToFloat64(queueMessagesGauge), 0)
+
+	msgs, err := q.messages()
+	require.NoError(t, err)
+
+	observeQueue(msgs, msgs[0].Created.Add(time.Minute))
+	assert.InDelta(t, 60.0, testutil.ToFloat64(queueOldestGauge), 0)
+
+	// delivered messages are removed
+	q.processDue(context.Background(), now.Add(time.Hour))
+	assert.InDelta(t, 0.0, testutil.ToFloat64(queueMessagesGauge), 0)
+}
+
+func TestSessionLimitsMetrics(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	addr := startRelayConfig(ctx, t, "", &config{remoteHost: "127.0.0.1:9", maxErrors: 1})
+
+	c, err := textproto.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = c.Close() })
+
+	_, _, err = c.ReadResponse(220)
+	require.NoError(t, err)
+
+	id, err := c.Cmd("FOO")
+	require.NoError(t, err)
+	c.StartResponse(id)
+
+	_, _, err = c.ReadResponse(502)
+	require.NoError(t, err)
+
+	_, _, err = c.ReadResponse(421)
+	require.NoError(t, err)
+	c.EndResponse(id)
+
+	counter := sessionLimitsCounter.WithLabelValues(schemeTCP+"://"+addr, smtpd.LimitErrors)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(counter) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestEarlyTalkersMetrics(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	addr := startRelayConfig(ctx, t, "", &config{
+		remoteHost:        "127.0.0.1:9",
+		greetDelay:        time.Second,
+		earlyTalkerAction: earlyTalkerReject,
+	})
+
+	c, err := textproto.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = c.Close() })
+
+	require.NoError(t, c.PrintfLine("EHLO localhost"))
+
+	_, _, err = c.ReadResponse(554)
+	require.NoError(t, err)
+
+	counter := earlyTalkersCounter.WithLabelValues(schemeTCP+"://"+addr, earlyTalkerReject)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(counter) == 1
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,381 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MTA-STS policy modes (RFC 8461 section 3.2)
+const (
+	mtaSTSModeEnforce = "enforce" // deliveries must use validated TLS
+	mtaSTSModeTesting = "testing" // failures are only logged and counted
+	mtaSTSModeNone    = "none"    // the domain withdrew its policy
+)
+
+// MTA-STS failure reasons, named as in TLS reports (RFC 8460 section 4.3)
+const (
+	mtaSTSStartTLSUnsupported = "starttls-not-supported"
+	mtaSTSValidationFailure   = "validation-failure"
+	mtaSTSFetchError          = "sts-policy-fetch-error"
+	mtaSTSPolicyInvalid       = "sts-policy-invalid"
+)
+
+const (
+	mtaSTSMaxAge        = 31557600 // max_age limit, about a year
+	mtaSTSMaxPolicySize = 64 * 1024
+	mtaSTSFetchTimeout  = 30 * time.Second
+)
+
+// mtaSTSPolicy is the MTA-STS policy of a recipient domain
+type mtaSTSPolicy struct {
+	domain  string
+	id      string // id of the TXT record announcing the policy
+	mode    string
+	mx      []string
+	expires time.Time
+}
+
+// parseMTASTSPolicy parses a policy file: "key: value" lines, of which the
+// unknown ones are ignored
+func parseMTASTSPolicy(body []byte) (*mtaSTSPolicy, error) {
+	p := &mtaSTSPolicy{}
+	version, maxAge := "", -1
+
+	for _, line := range strings.Split(string(body), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+
+		switch strings.TrimSpace(key) {
+		case "version":
+			version = value
+		case "mode":
+			p.mode = value
+		case "mx":
+			p.mx = append(p.mx, strings.ToLower(value))
+		case "max_age":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid max_age %q", value)
+			}
+
+			maxAge = min(n, mtaSTSMaxAge)
+		}
+	}
+
+	if version != "STSv1" {
+		return nil, fmt.Errorf("unsupported version %q", version)
+	}
+
+	switch p.mode {
+	case mtaSTSModeEnforce, mtaSTSModeTesting:
+		if len(p.mx) == 0 {
+			return nil, errors.New("no mx")
+		}
+	case mtaSTSModeNone:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", p.mode)
+	}
+
+	if maxAge < 0 {
+		return nil, errors.New("no max_age")
+	}
+
+	p.expires = time.Now().Add(time.Duration(maxAge) * time.Second)
+
+	return p, nil
+}
+
+// matchesMX reports whether the MX host matches one of the mx patterns of the
+// policy, whose wildcards only match the leftmost label (RFC 8461 section 4.1)
+func (p *mtaSTSPolicy) matchesMX(hostname string) bool {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+
+	for _, pattern := range p.mx {
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			label, rest, found := strings.Cut(hostname, ".")
+			if found && label != "" && rest == suffix {
+				return true
+			}
+
+			continue
+		}
+
+		if hostname == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseMTASTSRecord returns the policy id of the _mta-sts TXT records, empty
+// if there's no valid one
+func parseMTASTSRecord(txts []string) string {
+	id := ""
+	found := 0
+
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1") {
+			continue
+		}
+
+		found++
+
+		for _, field := range strings.Split(txt, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(field), "id="); ok {
+				id = value
+			}
+		}
+	}
+
+	// several records are treated as if there were none (RFC 8461 section 3.1)
+	if found != 1 {
+		return ""
+	}
+
+	return id
+}
+
+// mtaSTS fetches and caches the MTA-STS policies of recipient domains
+// (RFC 8461), which require deliveries to use TLS validated with the system
+// CAs. The MX patterns of the policies only apply to direct deliveries, as
+// smarthosts aren't the MX hosts of the recipient domains.
+type mtaSTS struct {
+	mu       sync.Mutex
+	policies map[string]*mtaSTSPolicy
+
+	// lookupTXT and fetch override the TXT lookups and the policy fetches -
+	// for tests
+	lookupTXT func(domain string) ([]string, error)
+	fetch     func(ctx context.Context, domain string) ([]byte, error)
+
+	logger *slog.Logger
+}
+
+// newMTASTS returns nil if MTA-STS is disabled
+func newMTASTS(enabled bool) *mtaSTS {
+	if !enabled {
+		return nil
+	}
+
+	return &mtaSTS{
+		policies:  map[string]*mtaSTSPolicy{},
+		lookupTXT: net.LookupTXT,
+		fetch:     fetchMTASTSPolicy,
+		logger:    slog.Default().With(slog.String("component", "mta-sts")),
+	}
+}
+
+// policy returns the policy of the domain, nil if it has none. The cached
+// policy is used until it expires, unless the TXT record announces a new one,
+// and also if the new one can't be fetched.
+func (m *mtaSTS) policy(domain string) *mtaSTSPolicy {
+	m.mu.Lock()
+	cached := m.policies[domain]
+	if cached != nil && time.Now().After(cached.expires) {
+		delete(m.policies, domain)
+		cached = nil
+	}
+	m.mu.Unlock()
+
+	txts, err := m.lookupTXT("_mta-sts." + domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			m.logger.Warn("MTA-STS record lookup failed", slog.String("domain", domain), slog.Any("error", err))
+		}
+
+		return cached
+	}
+
+	id := parseMTASTSRecord(txts)
+	if id == "" || (cached != nil && cached.id == id) {
+		return cached
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mtaSTSFetchTimeout)
+	defer cancel()
+
+	mode, reason := "unknown", mtaSTSFetchError
+	if cached != nil {
+		mode = cached.mode
+	}
+
+	body, err := m.fetch(ctx, domain)
+	if err == nil {
+		reason = mtaSTSPolicyInvalid
+		cached, err = m.update(domain, id, body)
+	}
+
+	if err != nil {
+		mtaSTSFailuresCounter.WithLabelValues(mode, reason).Inc()
+		m.logger.Warn("cannot get MTA-STS policy", slog.String("domain", domain),
+			slog.String("reason", reason), slog.Any("error", err))
+	}
+
+	return cached
+}
+
+// update parses the fetched policy and caches it, returning the cached
+// policy, which is kept if the new one is invalid
+func (m *mtaSTS) update(domain, id string, body []byte) (*mtaSTSPolicy, error) {
+	p, err := parseMTASTSPolicy(body)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		return m.policies[domain], err
+	}
+
+	p.domain = domain
+	p.id = id
+	m.policies[domain] = p
+
+	return p, nil
+}
+
+// lookup returns the policies of the recipient domains, except the ones in
+// mode none
+func (m *mtaSTS) lookup(out *outbound) mtaSTSPolicies {
+	if m == nil {
+		return nil
+	}
+
+	var policies mtaSTSPolicies
+
+	seen := map[string]bool{}
+
+	for _, rcpt := range out.Recipients {
+		idx := strings.LastIndex(rcpt, "@")
+		if idx == -1 {
+			continue
+		}
+
+		domain := strings.ToLower(rcpt[idx+1:])
+		if seen[domain] {
+			continue
+		}
+
+		seen[domain] = true
+
+		if p := m.policy(domain); p != nil && p.mode != mtaSTSModeNone {
+			policies = append(policies, p)
+		}
+	}
+
+	return policies
+}
+
+// mtaSTSPolicies are the policies applying to a delivery
+type mtaSTSPolicies []*mtaSTSPolicy
+
+// check fails if a policy in enforce mode requires TLS and the connection to
+// the upstream isn't encrypted. The certificates are always validated when
+// STARTTLS is used, so there's nothing else to check.
+func (policies mtaSTSPolicies) check(host string, tlsUsed bool) error {
+	if tlsUsed {
+		return nil
+	}
+
+	return policies.fail(mtaSTSStartTLSUnsupported,
+		fmt.Errorf("upstream %s doesn't support STARTTLS", host))
+}
+
+// checkMX fails if a policy in enforce mode doesn't list the MX host
+func (policies mtaSTSPolicies) checkMX(hostname string) error {
+	var unlisted mtaSTSPolicies
+
+	for _, p := range policies {
+		if !p.matchesMX(hostname) {
+			unlisted = append(unlisted, p)
+		}
+	}
+
+	return unlisted.fail(mtaSTSValidationFailure, fmt.Errorf("MX host %s isn't listed", hostname))
+}
+
+// dialFailed records the failures to validate the upstream certificates
+func (policies mtaSTSPolicies) dialFailed(err error) {
+	var cerr *tls.CertificateVerificationError
+	if errors.As(err, &cerr) {
+		_ = policies.fail(mtaSTSValidationFailure, err)
+	}
+}
+
+// fail counts the failure for each policy, and returns an error if one of
+// them is in enforce mode
+func (policies mtaSTSPolicies) fail(reason string, err error) error {
+	var enforced error
+
+	for _, p := range policies {
+		mtaSTSFailuresCounter.WithLabelValues(p.mode, reason).Inc()
+
+		if p.mode == mtaSTSModeEnforce {
+			enforced = fmt.Errorf("mta-sts: policy of %s: %w", p.domain, err)
+		} else {
+			slog.Warn("MTA-STS policy would fail in enforce mode", slog.String("component", "mta-sts"),
+				slog.String("domain", p.domain), slog.String("reason", reason), slog.Any("error", err))
+		}
+	}
+
+	return enforced
+}
+
+// mtaSTSClient fetches the policies: redirects aren't followed (RFC 8461
+// section 3.3)
+var mtaSTSClient = &http.Client{
+	CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// fetchMTASTSPolicy fetches the policy file of the domain over HTTPS
+func fetchMTASTSPolicy(ctx context.Context, domain string) ([]byte, error) {
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := mtaSTSClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q from %s", resp.Status, url)
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/plain" {
+		return nil, fmt.Errorf("unexpected content type %q from %s", mediaType, url)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, mtaSTSMaxPolicySize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > mtaSTSMaxPolicySize {
+		return nil, fmt.Errorf("policy from %s is too big", url)
+	}
+
+	return body, nil
+}
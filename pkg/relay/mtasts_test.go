@@ -0,0 +1,185 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMTASTSPolicy(t *testing.T) {
+	t.Parallel()
+
+	p, err := parseMTASTSPolicy([]byte("version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.Example.net\r\nmax_age: 86400\r\nfoo: bar\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, mtaSTSModeEnforce, p.mode)
+	assert.Equal(t, []string{"mail.example.com", "*.example.net"}, p.mx)
+
+	p, err = parseMTASTSPolicy([]byte("version: STSv1\nmode: none\nmax_age: 0\n"))
+	require.NoError(t, err)
+	assert.Equal(t, mtaSTSModeNone, p.mode)
+
+	for _, bad := range []string{
+		"",
+		"version: STSv2\nmode: enforce\nmx: mail.example.com\nmax_age: 86400\n",
+		"version: STSv1\nmode: bogus\nmx: mail.example.com\nmax_age: 86400\n",
+		"version: STSv1\nmode: enforce\nmax_age: 86400\n",
+		"version: STSv1\nmode: testing\nmx: mail.example.com\n",
+		"version: STSv1\nmode: testing\nmx: mail.example.com\nmax_age: -1\n",
+	} {
+		_, err = parseMTASTSPolicy([]byte(bad))
+		require.Error(t, err, "expected error for %q", bad)
+	}
+}
+
+func TestParseMTASTSRecord(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "20240101", parseMTASTSRecord([]string{"v=spf1 -all", "v=STSv1; id=20240101"}))
+	assert.Empty(t, parseMTASTSRecord([]string{"v=STSv1; id=1", "v=STSv1; id=2"}))
+	assert.Empty(t, parseMTASTSRecord(nil))
+}
+
+// testMTASTS returns an MTA-STS cache serving the policies of the domains,
+// keyed by their TXT record id, and counting the fetches
+func testMTASTS(ids map[string]string, policies map[string]string, fetches *int) *mtaSTS {
+	m := newMTASTS(true)
+
+	m.lookupTXT = func(name string) ([]string, error) {
+		id, ok := ids[name]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+
+		return []string{"v=STSv1; id=" + id}, nil
+	}
+
+	m.fetch = func(_ context.Context, domain string) ([]byte, error) {
+		*fetches++
+
+		policy, ok := policies[domain]
+		if !ok {
+			return nil, errors.New("connection refused")
+		}
+
+		return []byte(policy), nil
+	}
+
+	return m
+}
+
+func TestMTASTSPolicy(t *testing.T) {
+	t.Parallel()
+
+	assert.Nil(t, newMTASTS(false))
+
+	ids := map[string]string{"_mta-sts.example.com": "1", "_mta-sts.down.example.com": "1"}
+	policies := map[string]string{
+		"example.com": "version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: 86400\n",
+	}
+	fetches := 0
+
+	m := testMTASTS(ids, policies, &fetches)
+
+	p := m.policy("example.com")
+	require.NotNil(t, p)
+	assert.Equal(t, mtaSTSModeEnforce, p.mode)
+	assert.Equal(t, "1", p.id)
+
+	// the cached policy is used until the id changes
+	assert.Same(t, p, m.policy("example.com"))
+	assert.Equal(t, 1, fetches)
+
+	ids["_mta-sts.example.com"] = "2"
+	policies["example.com"] = "version: STSv1\nmode: testing\nmx: mail.example.com\nmax_age: 86400\n"
+
+	p = m.policy("example.com")
+	require.NotNil(t, p)
+	assert.Equal(t, mtaSTSModeTesting, p.mode)
+	assert.Equal(t, 2, fetches)
+
+	// invalid policies and removed records keep the cached policy
+	ids["_mta-sts.example.com"] = "3"
+	policies["example.com"] = "bogus"
+	assert.Same(t, p, m.policy("example.com"))
+
+	delete(ids, "_mta-sts.example.com")
+	assert.Same(t, p, m.policy("example.com"))
+
+	assert.Nil(t, m.policy("down.example.com"))
+	assert.Nil(t, m.policy("example.net"))
+
+	policies["example.net"] = "version: STSv1\nmode: none\nmax_age: 86400\n"
+	ids["_mta-sts.example.net"] = "1"
+
+	out := &outbound{Recipients: []string{"a@example.com", "b@EXAMPLE.com", "c@example.net", "d@example.org"}}
+	assert.Equal(t, mtaSTSPolicies{p}, m.lookup(out))
+}
+
+func TestMTASTSPoliciesCheck(t *testing.T) {
+	t.Parallel()
+
+	enforce := &mtaSTSPolicy{domain: "example.com", mode: mtaSTSModeEnforce}
+	testingPolicy := &mtaSTSPolicy{domain: "example.net", mode: mtaSTSModeTesting}
+
+	require.NoError(t, mtaSTSPolicies{enforce, testingPolicy}.check("mx:25", true))
+	require.NoError(t, mtaSTSPolicies{testingPolicy}.check("mx:25", false))
+	require.NoError(t, mtaSTSPolicies(nil).check("mx:25", false))
+
+	err := mtaSTSPolicies{enforce, testingPolicy}.check("mx:25", false)
+	require.ErrorContains(t, err, "example.com")
+	assert.True(t, isTemporaryErr(err))
+}
+
+func TestSendMailMTASTS(t *testing.T) {
+	t.Parallel()
+
+	fetches := 0
+	m := testMTASTS(
+		map[string]string{"_mta-sts.example.com": "1", "_mta-sts.example.net": "1"},
+		map[string]string{
+			"example.com": "version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: 86400\n",
+			"example.net": "version: STSv1\nmode: testing\nmx: mail.example.net\nmax_age: 86400\n",
+		},
+		&fetches,
+	)
+
+	u := startFakeUpstream(t)
+	cfg := &config{mtaSTS: m}
+
+	out := &outbound{Host: u.addr, Sender: "bob@example.org", Recipients: []string{"alice@example.com"}}
+	err := sendMail(cfg, out, []byte("hello\r\n"))
+	require.ErrorContains(t, err, "doesn't support STARTTLS")
+
+	_, msgs := u.received()
+	assert.Empty(t, msgs)
+
+	// testing policies don't fail the delivery
+	out = &outbound{Host: u.addr, Sender: "bob@example.org", Recipients: []string{"alice@example.net"}}
+	require.NoError(t, sendMail(cfg, out, []byte("hello\r\n")))
+
+	_, msgs = u.received()
+	assert.Len(t, msgs, 1)
+}
+
+func TestMTASTSMatchesMX(t *testing.T) {
+	t.Parallel()
+
+	p := &mtaSTSPolicy{domain: "example.com", mode: mtaSTSModeEnforce, mx: []string{"mail.example.com", "*.example.net"}}
+
+	assert.True(t, p.matchesMX("mail.example.com"))
+	assert.True(t, p.matchesMX("Mail.Example.com."))
+	assert.True(t, p.matchesMX("mx1.example.net"))
+	assert.False(t, p.matchesMX("example.net"))
+	assert.False(t, p.matchesMX("a.mx1.example.net"))
+	assert.False(t, p.matchesMX("mail.example.org"))
+
+	require.NoError(t, mtaSTSPolicies{p}.checkMX("mx1.example.net"))
+	require.Error(t, mtaSTSPolicies{p}.checkMX("mail.example.org"))
+
+	p.mode = mtaSTSModeTesting
+	require.NoError(t, mtaSTSPolicies{p}.checkMX("mail.example.org"))
+}
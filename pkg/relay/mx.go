@@ -0,0 +1,137 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// mxScheme is the prefix of the hosts of recipients delivered directly to the
+// MX hosts of their domain, followed by the domain
+const mxScheme = "mx://"
+
+// how long to wait for the MX lookups
+const mxLookupTimeout = 30 * time.Second
+
+var (
+	errNullMX       = &smtpd.Error{Code: 556, EnhancedCode: "5.1.10", Msg: "Recipient domain doesn't accept mail"}
+	errNoSuchDomain = &smtpd.Error{Code: 550, EnhancedCode: "5.1.2", Msg: "Recipient domain not found"}
+)
+
+// mxResolver resolves the hosts delivering the mail of recipient domains. A
+// nil resolver uses the system resolver and port 25.
+type mxResolver struct {
+	port string
+
+	// lookupMX and lookupHost override the DNS lookups - for tests
+	lookupMX   func(ctx context.Context, domain string) ([]*net.MX, error)
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+}
+
+// hosts returns the host:port addresses to deliver the mail of the domain to,
+// in order of MX preference, or the domain itself if it has no MX records
+// (RFC 5321 section 5.1). Domains which don't exist, or publish a null MX
+// (RFC 7505), fail permanently.
+func (r *mxResolver) hosts(domain string) ([]string, error) {
+	if r == nil {
+		r = &mxResolver{port: "25", lookupMX: net.DefaultResolver.LookupMX, lookupHost: net.DefaultResolver.LookupHost}
+	}
+
+	if domain == "" {
+		return nil, errNoSuchDomain
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mxLookupTimeout)
+	defer cancel()
+
+	// net.LookupMX sorts the records by preference, and randomizes the ones
+	// with the same preference
+	mxs, err := r.lookupMX(ctx, domain)
+
+	var dnsErr *net.DNSError
+
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		if _, err := r.lookupHost(ctx, domain); err != nil {
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				return nil, fmt.Errorf("mx: %s: %w", domain, errNoSuchDomain)
+			}
+
+			return nil, fmt.Errorf("mx: %w", err)
+		}
+
+		return []string{net.JoinHostPort(domain, r.port)}, nil
+	case err != nil:
+		return nil, fmt.Errorf("mx: %w", err)
+	}
+
+	if len(mxs) == 1 && mxs[0].Host == "." {
+		return nil, fmt.Errorf("mx: %s: %w", domain, errNullMX)
+	}
+
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(mx.Host, "."), r.port))
+	}
+
+	return hosts, nil
+}
+
+// sendMX delivers the message directly to the MX hosts of the domain, trying
+// them in order of preference until one accepts the message or rejects it
+// permanently. MX hosts are delivered to without authentication, and the
+// MTA-STS policy of the domain, if any, restricts the hosts tried.
+func (p *upstreamPool) sendMX(ctx context.Context, cfg *config, out *outbound, domain string, body io.Reader) error {
+	hosts, err := cfg.mx.hosts(domain)
+	if err != nil {
+		return err
+	}
+
+	// the body is read again for each host it's sent to
+	rs, err := seekableBody(body)
+	if err != nil {
+		return err
+	}
+
+	sts := cfg.mtaSTS.lookup(out)
+
+	for _, host := range hosts {
+		hostname, _, _ := net.SplitHostPort(host)
+
+		if err = sts.checkMX(hostname); err != nil {
+			continue
+		}
+
+		if _, err = rs.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("data: %w", err)
+		}
+
+		hostOut := *out
+		hostOut.Host = host
+		hostOut.direct = true
+		hostOut.tlsState = nil
+
+		// partial deliveries aren't retried with the next host, as the
+		// message would be delivered again to the accepted recipients
+		var rcptErrs recipientErrors
+
+		err = p.sendSMTP(ctx, cfg, &hostOut, rs, sts)
+		out.sentThrough(host, &hostOut)
+
+		if err == nil || !isTemporaryErr(err) || errors.As(err, &rcptErrs) {
+			return err
+		}
+
+		slog.Debug("delivery to MX host failed", slog.String("component", "mx"),
+			slog.String("domain", domain), slog.String("host", host), slog.Any("error", err))
+	}
+
+	return err
+}
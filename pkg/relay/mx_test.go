@@ -0,0 +1,127 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMXResolver returns a resolver serving the MX records of the domains,
+// and A records for the domains without any
+func testMXResolver(port string, mxs map[string][]*net.MX, hosts ...string) *mxResolver {
+	notFound := func(name string) error {
+		return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	return &mxResolver{
+		port: port,
+		lookupMX: func(_ context.Context, domain string) ([]*net.MX, error) {
+			if domain == "error.example.com" {
+				return nil, &net.DNSError{Err: "server misbehaving", Name: domain, IsTemporary: true}
+			}
+
+			records, ok := mxs[domain]
+			if !ok {
+				return nil, notFound(domain)
+			}
+
+			return records, nil
+		},
+		lookupHost: func(_ context.Context, host string) ([]string, error) {
+			for _, h := range hosts {
+				if h == host {
+					return []string{"192.0.2.1"}, nil
+				}
+			}
+
+			return nil, notFound(host)
+		},
+	}
+}
+
+func TestMXHosts(t *testing.T) {
+	t.Parallel()
+
+	r := testMXResolver("25", map[string][]*net.MX{
+		"example.com":      {{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}},
+		"null.example.com": {{Host: ".", Pref: 0}},
+	}, "a.example.com")
+
+	hosts, err := r.hosts("example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mx1.example.com:25", "mx2.example.com:25"}, hosts)
+
+	// implicit MX
+	hosts, err = r.hosts("a.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.example.com:25"}, hosts)
+
+	for domain, code := range map[string]int{"null.example.com": 556, "nx.example.com": 550, "": 550} {
+		_, err = r.hosts(domain)
+
+		var smtpErr *smtpd.Error
+		require.ErrorAs(t, err, &smtpErr, domain)
+		assert.Equal(t, code, smtpErr.Code, domain)
+		assert.False(t, isTemporaryErr(err), domain)
+	}
+
+	_, err = r.hosts("error.example.com")
+	require.Error(t, err)
+	assert.True(t, isTemporaryErr(err))
+}
+
+func TestSendMX(t *testing.T) {
+	t.Parallel()
+
+	u := startFakeUpstream(t)
+
+	_, port, err := net.SplitHostPort(u.addr)
+	require.NoError(t, err)
+
+	// nothing listens on the first MX host, so the second one is tried, and
+	// without authenticating, which the upstream doesn't support
+	cfg := &config{
+		remoteUser: "user",
+		remotePass: "secret",
+		mx: testMXResolver(port, map[string][]*net.MX{
+			"example.com": {{Host: "127.0.0.2.", Pref: 10}, {Host: "127.0.0.1.", Pref: 20}},
+			"example.net": {{Host: "127.0.0.1.", Pref: 10}, {Host: "127.0.0.2.", Pref: 20}},
+		}),
+	}
+
+	out := &outbound{Host: "mx://example.com", Sender: "bob@example.org", Recipients: []string{"alice@example.com"}}
+	require.NoError(t, sendMail(cfg, out, []byte("hello\r\n")))
+
+	_, msgs := u.received()
+	assert.Equal(t, []string{"hello\n"}, msgs)
+
+	// permanent failures aren't retried on the next host
+	u.mu.Lock()
+	u.replies["RCPT"] = "550 5.1.1 no such user"
+	u.mu.Unlock()
+
+	out = &outbound{Host: "mx://example.net", Sender: "bob@example.org", Recipients: []string{"alice@example.net"}}
+	err = sendMail(cfg, out, []byte("hello\r\n"))
+	require.Error(t, err)
+	assert.False(t, isTemporaryErr(err))
+
+	// hosts not listed by the MTA-STS policy aren't tried
+	fetches := 0
+	cfg.mtaSTS = testMTASTS(
+		map[string]string{"_mta-sts.example.com": "1"},
+		map[string]string{"example.com": "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n"},
+		&fetches,
+	)
+
+	out = &outbound{Host: "mx://example.com", Sender: "bob@example.org", Recipients: []string{"alice@example.com"}}
+	err = sendMail(cfg, out, []byte("hello\r\n"))
+	require.ErrorContains(t, err, "isn't listed")
+	assert.True(t, isTemporaryErr(err))
+
+	_, msgs = u.received()
+	assert.Len(t, msgs, 1)
+}
@@ -0,0 +1,138 @@
+package relay
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing schemes, see HashPassword
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// argon2id parameters of the new hashes, the ones recommended by RFC 9106
+// for memory-constrained environments
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+
+	// max memory of the hashes checked, so that a bad hash can't have every
+	// AUTH command allocate gigabytes
+	argon2MaxMemory = 256 * 1024 // KiB
+)
+
+var (
+	errPasswordMismatch = errors.New("password invalid")
+	errUnknownHash      = errors.New("unknown password hash format")
+)
+
+// HashPassword hashes the password with the scheme, for the allowed_users
+// file or the SQL database. argon2id hashes are encoded in the PHC string
+// format, $argon2id$v=19$m=65536,t=3,p=4$salt$hash.
+func HashPassword(password, scheme string) (string, error) {
+	switch scheme {
+	case HashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+
+		return string(hash), nil
+	case HashArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("unknown password hashing scheme %q, expected %s or %s", scheme, HashBcrypt, HashArgon2id)
+	}
+}
+
+// checkPasswordHash checks the password against a bcrypt or argon2id hash,
+// in constant time
+func checkPasswordHash(hash, password string) error {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return checkArgon2id(hash, password)
+	case strings.HasPrefix(hash, "$2"):
+		// bcrypt validates the version itself, e.g. $2$, $2a$, $2b$ or $2y$
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			return errPasswordMismatch
+		}
+
+		return nil
+	default:
+		return errUnknownHash
+	}
+}
+
+// checkArgon2id checks the password against an argon2id hash in the PHC
+// string format
+func checkArgon2id(hash, password string) error {
+	// "", "argon2id", version, parameters, salt, hash
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return errUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return errUnknownHash
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return errUnknownHash
+	}
+
+	// argon2.IDKey panics with no rounds or threads
+	if time < 1 || threads < 1 || memory > argon2MaxMemory {
+		return errUnknownHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return errUnknownHash
+	}
+
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return errUnknownHash
+	}
+
+	got := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want))) //nolint:gosec // len(want) comes from a short hash
+
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return errPasswordMismatch
+	}
+
+	return nil
+}
+
+// dummyPasswordHash is checked for the unknown users, so that they take as
+// long to reject as a wrong password of a hash made by hash-password, which
+// uses argon2id by default
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := HashPassword("dummy password", HashArgon2id)
+	return hash
+})
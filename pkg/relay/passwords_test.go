@@ -0,0 +1,94 @@
+package relay
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashPassword(t *testing.T) {
+	t.Parallel()
+
+	for _, scheme := range []string{HashBcrypt, HashArgon2id} {
+		t.Run(scheme, func(t *testing.T) {
+			t.Parallel()
+
+			hash, err := HashPassword("hunter2", scheme)
+			require.NoError(t, err)
+
+			require.NoError(t, checkPasswordHash(hash, "hunter2"))
+			require.ErrorIs(t, checkPasswordHash(hash, "hunter3"), errPasswordMismatch)
+
+			// the hashes are salted
+			other, err := HashPassword("hunter2", scheme)
+			require.NoError(t, err)
+			assert.NotEqual(t, hash, other)
+		})
+	}
+
+	_, err := HashPassword("hunter2", "md5")
+	require.Error(t, err)
+}
+
+func TestCheckPasswordHash(t *testing.T) {
+	t.Parallel()
+
+	// from the argon2 reference implementation, with the password "password"
+	// and the salt "somesalt"
+	hash := "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+	require.NoError(t, checkPasswordHash(hash, "password"))
+	require.ErrorIs(t, checkPasswordHash(hash, "passwore"), errPasswordMismatch)
+
+	// bcrypt hashes of all versions are checked, e.g. $2$ ones
+	b, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	for _, prefix := range []string{"$2$", "$2a$", "$2b$", "$2y$"} {
+		hash := prefix + strings.SplitN(string(b), "$", 3)[2]
+		require.NoError(t, checkPasswordHash(hash, "password"), hash)
+		require.ErrorIs(t, checkPasswordHash(hash, "passwore"), errPasswordMismatch, hash)
+	}
+
+	for _, bad := range []string{
+		"",
+		"plaintext",
+		"$argon2i$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=16$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=2,p=1$!!!$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$",
+		"$argon2id$v=19$m=65536,t=0,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=2,p=0$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=4194304,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+	} {
+		require.ErrorIs(t, checkPasswordHash(bad, "password"), errUnknownHash, bad)
+	}
+}
+
+func TestAuthCheckPasswordHashes(t *testing.T) {
+	bcryptHash, err := HashPassword("hunter2", HashBcrypt)
+	require.NoError(t, err)
+
+	argon2Hash, err := HashPassword("hunter3", HashArgon2id)
+	require.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), "users.txt")
+	require.NoError(t, os.WriteFile(file, []byte(strings.Join([]string{
+		"alice " + bcryptHash,
+		"bob " + argon2Hash + " bob@example.com",
+	}, "\n")), 0o600))
+
+	prev := filename
+	t.Cleanup(func() { filename = prev })
+	require.NoError(t, AuthLoadFile(file))
+
+	require.NoError(t, AuthCheckPassword("alice", "hunter2"))
+	require.NoError(t, AuthCheckPassword("bob", "hunter3"))
+	require.Error(t, AuthCheckPassword("bob", "hunter2"))
+	require.ErrorIs(t, AuthCheckPassword("carol", "hunter2"), errUserNotFound)
+}
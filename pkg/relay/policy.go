@@ -0,0 +1,347 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// Policy stages, at which the rules of their section are evaluated
+const (
+	policyConnect = "connect" // on new connections
+	policyMail    = "mail"    // after MAIL FROM
+	policyRcpt    = "rcpt"    // after each RCPT TO
+	policyData    = "data"    // once the message data is received
+)
+
+// Policy rule actions
+const (
+	policyReject       = "reject"        // reject with an SMTP error
+	policyRoute        = "route"         // deliver all the recipients to an upstream host
+	policyAddHeader    = "add_header"    // add a header field
+	policyRemoveHeader = "remove_header" // remove all the fields with the name
+)
+
+// enhancedCode matches the enhanced status codes of reject actions
+var enhancedCode = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
+
+// policyEnv holds the fields policy expressions can use. Fields which aren't
+// known yet at a stage are empty.
+type policyEnv struct {
+	IP         string   `expr:"ip"`         // address of the client
+	Helo       string   `expr:"helo"`       // HELO/EHLO name, from mail on
+	Username   string   `expr:"username"`   // authenticated user, from mail on
+	TLS        bool     `expr:"tls"`        // whether the connection is encrypted
+	Listener   string   `expr:"listener"`   // listen address, e.g. starttls://0.0.0.0:587
+	Sender     string   `expr:"sender"`     // envelope sender, from mail on
+	Rcpt       string   `expr:"rcpt"`       // recipient, in rcpt
+	Recipients []string `expr:"recipients"` // envelope recipients, in data
+	Size       int      `expr:"size"`       // size of the message, in data
+	Subject    string   `expr:"subject"`    // Subject header, in data
+
+	// Header returns the first value of a header field, in data
+	Header func(name string) string `expr:"header"`
+}
+
+// policyRule is an action taken when its expression is true
+type policyRule struct {
+	line    int
+	source  string
+	program *vm.Program
+	action  string
+	err     *smtpd.Error // for policyReject
+	host    string       // for policyRoute
+	header  headerRule   // for policyAddHeader and policyRemoveHeader
+}
+
+// policy holds the rules of the policy_rules file, by stage
+type policy struct {
+	rules map[string][]policyRule
+}
+
+// loadPolicy reads the policy rules from file. Each line is a rule in the form
+//
+//	expression => action
+//
+// where the expression is written in the expr language
+// (https://expr-lang.org), and the action is one of:
+//
+//	reject code [enhanced code] message
+//	route host
+//	add_header Name: value
+//	remove_header Name
+//
+// The rules are grouped by the stage they're evaluated at, after a
+// "[connect]", "[mail]", "[rcpt]" or "[data]" line. Only reject actions are
+// allowed before the data stage. Empty lines and lines starting with "#" are
+// ignored.
+func loadPolicy(file string) (*policy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &policy{rules: map[string][]policyRule{}}
+	stage := ""
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			stage = strings.TrimSpace(line[1 : len(line)-1])
+
+			switch stage {
+			case policyConnect, policyMail, policyRcpt, policyData:
+			default:
+				return nil, fmt.Errorf("line %d: unknown stage %q", n, stage)
+			}
+
+			continue
+		}
+
+		if stage == "" {
+			return nil, fmt.Errorf("line %d: rule outside of a stage section", n)
+		}
+
+		rule, err := parsePolicyRule(line, stage)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		rule.line = n
+		p.rules[stage] = append(p.rules[stage], rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func parsePolicyRule(line, stage string) (policyRule, error) {
+	source, action, ok := strings.Cut(line, "=>")
+	if !ok {
+		return policyRule{}, errors.New("missing => action")
+	}
+
+	rule := policyRule{source: strings.TrimSpace(source)}
+
+	program, err := expr.Compile(rule.source, expr.Env(policyEnv{}), expr.AsBool())
+	if err != nil {
+		return policyRule{}, fmt.Errorf("invalid expression: %w", err)
+	}
+	rule.program = program
+
+	name, arg, _ := strings.Cut(strings.TrimSpace(action), " ")
+	arg = strings.TrimSpace(arg)
+	rule.action = name
+
+	if name != policyReject && stage != policyData {
+		return policyRule{}, fmt.Errorf("%s is only allowed in the data stage", name)
+	}
+
+	switch name {
+	case policyReject:
+		rule.err, err = parseReject(arg, "Rejected by policy")
+		if err != nil {
+			return policyRule{}, err
+		}
+	case policyRoute:
+		if arg == "" {
+			return policyRule{}, errors.New("route without a host")
+		}
+
+		// hosts are parsed like the default route of remote_host
+		router, err := parseRoutes(arg, false)
+		if err != nil {
+			return policyRule{}, fmt.Errorf("invalid route: %w", err)
+		}
+		rule.host = router.match("")
+	case policyAddHeader, policyRemoveHeader:
+		// header edits are parsed like the add and remove header rules
+		verb := headerAdd
+		if name == policyRemoveHeader {
+			verb = headerRemove
+		}
+
+		rule.header, err = parseHeaderRule(verb + " " + arg)
+		if err != nil {
+			return policyRule{}, err
+		}
+	default:
+		return policyRule{}, fmt.Errorf("unknown action %q", name)
+	}
+
+	return rule, nil
+}
+
+// parseReject parses the code, optional enhanced code and message of a reject
+// action, with msg as the default message
+func parseReject(arg, msg string) (*smtpd.Error, error) {
+	code, rest, _ := strings.Cut(arg, " ")
+
+	n, err := strconv.Atoi(code)
+	if err != nil || n < 400 || n > 599 {
+		return nil, fmt.Errorf("invalid reject code %q, must be 4xx or 5xx", code)
+	}
+
+	smtpErr := &smtpd.Error{Code: n, Msg: msg}
+
+	rest = strings.TrimSpace(rest)
+	if enhanced, msg, _ := strings.Cut(rest, " "); enhancedCode.MatchString(enhanced) {
+		if enhanced[0] != code[0] {
+			return nil, fmt.Errorf("enhanced code %q doesn't match the class of %d", enhanced, n)
+		}
+
+		smtpErr.EnhancedCode = enhanced
+		rest = strings.TrimSpace(msg)
+	}
+
+	if rest != "" {
+		smtpErr.Msg = rest
+	}
+
+	return smtpErr, nil
+}
+
+// newPolicyEnv returns the fields of the peer for the expressions
+func (r *relay) newPolicyEnv(peer smtpd.Peer) policyEnv {
+	env := policyEnv{
+		Helo:     peer.HeloName,
+		Username: peer.Username,
+		TLS:      peer.TLS != nil,
+		Listener: r.listener.String(),
+		Header:   func(string) string { return "" },
+	}
+
+	if peer.Addr != nil {
+		env.IP = peer.Addr.String()
+		if host, _, err := net.SplitHostPort(env.IP); err == nil {
+			env.IP = host
+		}
+	}
+
+	return env
+}
+
+// matches returns the rules of stage whose expression is true. Expressions
+// failing to evaluate are logged, and don't match.
+func (p *policy) matches(ctx context.Context, stage string, env policyEnv) []policyRule {
+	if p == nil {
+		return nil
+	}
+
+	var matched []policyRule
+
+	for _, rule := range p.rules[stage] {
+		out, err := expr.Run(rule.program, env)
+		if err != nil {
+			slog.WarnContext(ctx, "could not evaluate policy rule",
+				slog.String("component", "policy"),
+				slog.Int("line", rule.line),
+				slog.String("expression", rule.source),
+				slog.Any("error", err))
+
+			continue
+		}
+
+		if ok, _ := out.(bool); ok {
+			matched = append(matched, rule)
+		}
+	}
+
+	return matched
+}
+
+// check returns the error of the first reject rule of stage matching, if any
+func (p *policy) check(ctx context.Context, stage string, env policyEnv) error {
+	return policyRejected(ctx, stage, env, p.matches(ctx, stage, env))
+}
+
+// policyRejected returns the error of the first reject rule of the matched
+// ones, if any
+func policyRejected(ctx context.Context, stage string, env policyEnv, matched []policyRule) error {
+	for _, rule := range matched {
+		if rule.action == policyReject {
+			slog.InfoContext(ctx, "rejected by policy",
+				slog.String("component", "policy"),
+				slog.String("stage", stage),
+				slog.Int("line", rule.line),
+				slog.String("ip", env.IP))
+
+			return observeErr(ctx, rule.err)
+		}
+	}
+
+	return nil
+}
+
+type policyRouteKey struct{}
+
+// routeOverride returns the upstream host the data rules routed the message
+// to, if any
+func routeOverride(ctx context.Context) string {
+	host, _ := ctx.Value(policyRouteKey{}).(string)
+	return host
+}
+
+// policyStage evaluates the data rules: messages are rejected by the first
+// reject rule matching, and otherwise get the header edits of the rules
+// matching, in order, and are routed by the last route rule matching
+func (r *relay) policyStage(next smtpd.Handler) smtpd.Handler {
+	return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+		p := r.config(ctx).policy
+		if p == nil || len(p.rules[policyData]) == 0 {
+			return next(ctx, peer, env)
+		}
+
+		// the size is only known once the message is buffered
+		if err := env.Buffer(); err != nil {
+			return err
+		}
+
+		penv := r.newPolicyEnv(peer)
+		penv.Sender = env.Sender
+		penv.Recipients = env.Recipients
+		penv.Size = len(env.Data)
+		penv.Subject = env.Header.Get("Subject")
+		penv.Header = env.Header.Get
+
+		matched := p.matches(ctx, policyData, penv)
+		if err := policyRejected(ctx, policyData, penv, matched); err != nil {
+			return flagged(quarantinePolicy, "", err)
+		}
+
+		var headers []headerRule
+
+		for _, rule := range matched {
+			switch rule.action {
+			case policyRoute:
+				ctx = context.WithValue(ctx, policyRouteKey{}, rule.host)
+			case policyAddHeader, policyRemoveHeader:
+				headers = append(headers, rule.header)
+			}
+		}
+
+		applyHeaderRules(&env, headers)
+
+		return next(ctx, peer, env)
+	}
+}
@@ -0,0 +1,175 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPolicy(t *testing.T) {
+	t.Parallel()
+
+	p, err := loadPolicy(writeTestFile(t, "policy_rules", `
+# rules by stage
+[connect]
+ip startsWith "198.51.100." => reject 554 5.7.1 Go away
+
+[rcpt]
+rcpt endsWith "@internal.example.com" && !tls => reject 450
+
+[data]
+size > 1000000 => route smtp.example.com:587
+subject contains "[bulk]" => add_header x-bulk: yes
+true => remove_header X-Originating-IP
+`))
+	require.NoError(t, err)
+
+	require.Len(t, p.rules[policyConnect], 1)
+	assert.Equal(t, 4, p.rules[policyConnect][0].line)
+	assert.Equal(t, &smtpd.Error{Code: 554, EnhancedCode: "5.7.1", Msg: "Go away"}, p.rules[policyConnect][0].err)
+	assert.Empty(t, p.rules[policyMail])
+
+	require.Len(t, p.rules[policyRcpt], 1)
+	assert.Equal(t, &smtpd.Error{Code: 450, Msg: "Rejected by policy"}, p.rules[policyRcpt][0].err)
+
+	data := p.rules[policyData]
+	require.Len(t, data, 3)
+	assert.Equal(t, "smtp.example.com:587", data[0].host)
+	assert.Equal(t, headerRule{action: headerAdd, name: "X-Bulk", value: "yes"}, data[1].header)
+	assert.Equal(t, headerRule{action: headerRemove, name: "X-Originating-Ip"}, data[2].header)
+
+	for _, rules := range []string{
+		"true => reject 550",
+		"[helo]",
+		"[connect]\ntrue",
+		"[connect]\nip == => reject 550",
+		"[connect]\nip => reject 550",
+		"[connect]\nunknown == 1 => reject 550",
+		"[mail]\ntrue => route smtp.example.com",
+		"[mail]\ntrue => reject 250",
+		"[mail]\ntrue => reject 550 4.7.1 Mismatched class",
+		"[data]\ntrue => drop",
+		"[data]\ntrue => route",
+		"[data]\ntrue => add_header X-Foo",
+		"[data]\ntrue => remove_header X Foo",
+	} {
+		_, err = loadPolicy(writeTestFile(t, "policy_rules", rules))
+		require.Error(t, err, rules)
+	}
+}
+
+func TestPolicyChecks(t *testing.T) {
+	t.Parallel()
+
+	p, err := loadPolicy(writeTestFile(t, "policy_rules", `
+[connect]
+ip == "192.0.2.66" => reject 554 5.7.1 Blocked
+
+[mail]
+username == "" && sender endsWith "@example.com" => reject 530 5.7.0 Authentication required
+
+[rcpt]
+# evaluation errors don't match
+header("x") == "" && 1 / len(rcpt) > 1 => reject 550
+rcpt == "postmaster@example.com" => reject 550 5.1.1 No such user
+`))
+	require.NoError(t, err)
+
+	r, err := newRelay(newConfigStore(&config{remoteHost: "smtp.example.com:587", policy: p}), listenerConfig{}, &relayShared{})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345}}
+	blocked := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.66"), Port: 12345}}
+
+	require.NoError(t, r.checkConnection(ctx, peer))
+	require.Equal(t, &smtpd.Error{Code: 554, EnhancedCode: "5.7.1", Msg: "Blocked"}, r.checkConnection(ctx, blocked))
+
+	require.NoError(t, r.checkSender(ctx, peer, "alice@example.net"))
+	require.Error(t, r.checkSender(ctx, peer, "alice@example.com"))
+
+	authenticated := peer
+	authenticated.Username = "alice"
+	require.NoError(t, r.checkSender(ctx, authenticated, "alice@example.com"))
+
+	require.NoError(t, r.checkRecipient(ctx, peer, "bob@example.com"))
+
+	err = r.checkRecipient(ctx, peer, "postmaster@example.com")
+	require.Equal(t, &smtpd.Error{Code: 550, EnhancedCode: "5.1.1", Msg: "No such user"}, err)
+
+	// without rules, nothing is rejected
+	r, err = newRelay(newConfigStore(&config{remoteHost: "smtp.example.com:587"}), listenerConfig{}, &relayShared{})
+	require.NoError(t, err)
+	require.NoError(t, r.checkConnection(ctx, blocked))
+}
+
+func TestPolicyStage(t *testing.T) {
+	t.Parallel()
+
+	primary := startFakeUpstream(t)
+	bulk := startFakeUpstream(t)
+
+	p, err := loadPolicy(writeTestFile(t, "policy_rules", `
+[data]
+size > 1000 => reject 552 5.3.4 Message too big
+header("X-Spam") == "yes" => reject 550 5.7.1 Spam
+subject startsWith "[bulk]" => route `+bulk.addr+`
+"carol@example.com" in recipients => add_header X-Policy: carol
+true => remove_header X-Originating-IP
+`))
+	require.NoError(t, err)
+
+	r, err := newRelay(newConfigStore(&config{remoteHost: primary.addr, policy: p}), listenerConfig{}, &relayShared{})
+	require.NoError(t, err)
+
+	send := func(data string, recipients ...string) error {
+		header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(data))).ReadMIMEHeader()
+		require.NoError(t, err)
+
+		peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345}}
+		env := smtpd.Envelope{
+			Sender:     "alice@example.com",
+			Recipients: recipients,
+			Header:     header,
+			Data:       []byte(data),
+		}
+
+		return r.mailHandler()(context.Background(), peer, env)
+	}
+
+	var smtpErr *smtpd.Error
+
+	err = send("Subject: hi\r\n\r\n"+strings.Repeat("x", 1000)+"\r\n", "bob@example.com")
+	require.ErrorAs(t, err, &smtpErr)
+	require.Equal(t, &smtpd.Error{Code: 552, EnhancedCode: "5.3.4", Msg: "Message too big"}, smtpErr)
+
+	err = send("Subject: hi\r\nX-Spam: yes\r\n\r\nhello\r\n", "bob@example.com")
+	require.ErrorAs(t, err, &smtpErr)
+	require.Equal(t, &smtpd.Error{Code: 550, EnhancedCode: "5.7.1", Msg: "Spam"}, smtpErr)
+
+	_, data := primary.received()
+	assert.Empty(t, data)
+
+	require.NoError(t, send("Subject: hi\r\nX-Originating-IP: 192.0.2.10\r\n\r\nhello\r\n", "carol@example.com"))
+
+	_, data = primary.received()
+	require.Len(t, data, 1)
+	assert.Contains(t, data[0], "X-Policy: carol\n")
+	assert.NotContains(t, data[0], "X-Originating-IP")
+
+	require.NoError(t, send("Subject: [bulk] news\r\n\r\nhello\r\n", "bob@example.com", "carol@example.com"))
+
+	_, data = primary.received()
+	assert.Len(t, data, 1)
+
+	_, data = bulk.received()
+	require.Len(t, data, 1)
+	assert.Contains(t, data[0], "Subject: [bulk] news\n")
+}
@@ -0,0 +1,312 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// Results of the policy service requests
+const (
+	policyServiceAccepted = "accepted"
+	policyServiceRejected = "rejected"
+	policyServiceDeferred = "deferred"
+	policyServiceError    = "error"
+)
+
+var errPolicyServiceReply = errors.New("policy service: unexpected reply")
+
+// policyService delegates the recipient checks to an external policy server
+// speaking the Postfix policy delegation protocol, such as postfwd or
+// policyd. A request is sent for each RCPT TO, on a new connection.
+type policyService struct {
+	network string
+	addr    string
+	timeout time.Duration
+
+	// policyContext is sent as the policy_context attribute, to tell the
+	// relays sharing a policy server apart
+	policyContext string
+
+	// defaultAction is the action taken when the policy server can't be
+	// queried, or replies with an unknown action
+	defaultAction string
+
+	logger *slog.Logger
+}
+
+// newPolicyService returns nil if addr is empty. The address is either
+// host:port, or the absolute path of a unix socket.
+func newPolicyService(addr string, timeout time.Duration, policyContext, defaultAction string) (*policyService, error) {
+	if addr == "" {
+		return nil, nil
+	}
+
+	if _, err := policyServiceReply(defaultAction, ""); err != nil {
+		return nil, fmt.Errorf("invalid default action: %w", err)
+	}
+
+	s := &policyService{
+		network:       "tcp",
+		addr:          addr,
+		timeout:       timeout,
+		policyContext: policyContext,
+		defaultAction: defaultAction,
+		logger:        slog.Default().With(slog.String("component", "policy_service")),
+	}
+
+	if strings.HasPrefix(addr, "/") {
+		s.network = "unix"
+	}
+
+	return s, nil
+}
+
+// check queries the policy server for a recipient, and returns the SMTP
+// error to reply with if it's rejected or deferred
+func (s *policyService) check(ctx context.Context, attrs []string, rcpt string) error {
+	if s == nil {
+		return nil
+	}
+
+	result := ""
+
+	action, err := s.query(ctx, attrs)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "could not query policy server", slog.Any("error", err))
+		action, result = s.defaultAction, policyServiceError
+	}
+
+	smtpErr, err := policyServiceReply(action, rcpt)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "unknown policy server action", slog.String("action", action))
+		smtpErr, _ = policyServiceReply(s.defaultAction, rcpt)
+		result = policyServiceError
+	}
+
+	switch {
+	case result != "":
+	case smtpErr == nil:
+		result = policyServiceAccepted
+	case smtpErr.Code >= 500:
+		result = policyServiceRejected
+	default:
+		result = policyServiceDeferred
+	}
+
+	policyServiceCounter.WithLabelValues(result).Inc()
+
+	if smtpErr == nil {
+		return nil
+	}
+
+	s.logger.InfoContext(ctx, "recipient rejected by policy server", slog.String("recipient", rcpt),
+		slog.String("action", action))
+
+	return observeErr(ctx, smtpErr)
+}
+
+// query sends a request with the attributes, and returns the action of the
+// reply
+func (s *policyService) query(ctx context.Context, attrs []string) (string, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, s.network, s.addr)
+	if err != nil {
+		return "", fmt.Errorf("policy service: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var req strings.Builder
+
+	for _, attr := range attrs {
+		req.WriteString(attr)
+		req.WriteByte('\n')
+	}
+
+	if s.policyContext != "" {
+		req.WriteString(policyServiceAttr("policy_context", s.policyContext))
+		req.WriteByte('\n')
+	}
+
+	req.WriteByte('\n')
+
+	if _, err = conn.Write([]byte(req.String())); err != nil {
+		return "", fmt.Errorf("policy service: %w", err)
+	}
+
+	// the reply is a list of attributes, ended by an empty line, of which
+	// only the action is used
+	action := ""
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if action == "" {
+				return "", fmt.Errorf("%w: no action", errPolicyServiceReply)
+			}
+
+			return action, nil
+		}
+
+		if name, value, ok := strings.Cut(line, "="); ok && name == "action" {
+			action = strings.TrimSpace(value)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("policy service: %w", err)
+	}
+
+	return "", fmt.Errorf("%w: truncated", errPolicyServiceReply)
+}
+
+// policyServiceReply returns the SMTP error of a Postfix access action, nil if
+// the recipient is accepted. Actions which don't apply to a relay, like HOLD
+// or FILTER, are ignored.
+func policyServiceReply(action, rcpt string) (*smtpd.Error, error) {
+	name, text, _ := strings.Cut(strings.TrimSpace(action), " ")
+	text = strings.TrimSpace(text)
+
+	if text == "" {
+		text = "Access denied"
+	}
+
+	switch strings.ToUpper(name) {
+	case "OK", "DUNNO", "PERMIT", "DEFER_IF_REJECT":
+		return nil, nil
+	case "REJECT":
+		return &smtpd.Error{Code: 554, EnhancedCode: "5.7.1", Msg: fmt.Sprintf("<%s>: Recipient address rejected: %s", rcpt, text)}, nil
+	case "DEFER", "DEFER_IF_PERMIT":
+		return &smtpd.Error{Code: 450, EnhancedCode: "4.7.1", Msg: fmt.Sprintf("<%s>: Recipient address rejected: %s", rcpt, text)}, nil
+	case "HOLD", "DISCARD", "FILTER", "REDIRECT", "PREPEND", "BCC", "WARN", "INFO":
+		return nil, nil
+	}
+
+	if _, err := strconv.Atoi(name); err != nil {
+		return nil, fmt.Errorf("unknown action %q", name)
+	}
+
+	smtpErr, err := parseReject(action, "Access denied")
+	if err != nil {
+		return nil, err
+	}
+
+	if smtpErr.EnhancedCode == "" {
+		smtpErr.EnhancedCode = action[:1] + ".7.1"
+	}
+
+	return smtpErr, nil
+}
+
+// policyServiceAttr formats an attribute of a request, with the newlines of
+// its value, which would end it, replaced
+func policyServiceAttr(name, value string) string {
+	return name + "=" + strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+// policyServiceAttrs returns the attributes of the request for a recipient
+func (r *relay) policyServiceAttrs(ctx context.Context, peer smtpd.Peer, rcpt string) []string {
+	var (
+		sender string
+		client = "unknown"
+		port   int
+	)
+
+	if env := smtpd.EnvelopeFromContext(ctx); env != nil {
+		sender = env.Sender
+	}
+
+	ip := peerIP(peer)
+	if addr, ok := peer.Addr.(*net.TCPAddr); ok {
+		port = addr.Port
+	}
+
+	// the client name is only known when FCrDNS checks are enabled
+	if r.fcrdns != nil {
+		if res := r.fcrdns.result(ctx, peer); res != nil && res.name != "" {
+			client = strings.TrimSuffix(res.name, ".")
+		}
+	}
+
+	// the instance tells the transactions apart, for policy servers
+	// counting the recipients of a message
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s:%d:%s", ip, port, sender)
+
+	attrs := []string{
+		"request=smtpd_access_policy",
+		"protocol_state=RCPT",
+		policyServiceAttr("protocol_name", string(peer.Protocol)),
+		policyServiceAttr("helo_name", peer.HeloName),
+		"queue_id=",
+		policyServiceAttr("sender", sender),
+		policyServiceAttr("recipient", rcpt),
+		"recipient_count=0", // like Postfix, only counted after DATA
+		policyServiceAttr("client_address", ip.String()),
+		"client_port=" + strconv.Itoa(port),
+		policyServiceAttr("client_name", client),
+		policyServiceAttr("reverse_client_name", client),
+		fmt.Sprintf("instance=%x", h.Sum64()),
+		policyServiceAttr("sasl_username", peer.Username),
+		"size=0",
+	}
+
+	if addr, ok := smtpd.LocalAddrFromContext(ctx).(*net.TCPAddr); ok {
+		attrs = append(attrs,
+			"server_address="+addr.IP.String(),
+			"server_port="+strconv.Itoa(addr.Port))
+	}
+
+	if peer.TLS != nil {
+		attrs = append(attrs,
+			"encryption_protocol="+tls.VersionName(peer.TLS.Version),
+			"encryption_cipher="+tls.CipherSuiteName(peer.TLS.CipherSuite))
+	}
+
+	if cert := peer.ClientCert; cert != nil {
+		attrs = append(attrs,
+			policyServiceAttr("ccert_subject", cert.Subject.CommonName),
+			policyServiceAttr("ccert_issuer", cert.Issuer.CommonName),
+			"ccert_fingerprint="+fingerprint(cert.Raw),
+			"ccert_pubkey_fingerprint="+fingerprint(cert.RawSubjectPublicKeyInfo))
+	}
+
+	return attrs
+}
+
+// fingerprint returns the SHA-256 digest of data as colon separated hex
+// bytes, like Postfix
+func fingerprint(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":")
+}
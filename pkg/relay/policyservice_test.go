@@ -0,0 +1,242 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePolicyServer answers policy delegation requests with the action
+// returned by decide, and records them
+type fakePolicyServer struct {
+	addr   string
+	decide func(attrs map[string]string) string
+
+	mu       sync.Mutex
+	requests []map[string]string
+}
+
+func startFakePolicyServer(t *testing.T, network, addr string, decide func(attrs map[string]string) string) *fakePolicyServer {
+	t.Helper()
+
+	l, err := net.Listen(network, addr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = l.Close() })
+
+	s := &fakePolicyServer{addr: l.Addr().String(), decide: decide}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakePolicyServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	attrs := map[string]string{}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			break
+		}
+
+		name, value, _ := strings.Cut(scanner.Text(), "=")
+		attrs[name] = value
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, attrs)
+	s.mu.Unlock()
+
+	_, _ = conn.Write([]byte(s.decide(attrs) + "\n\n"))
+}
+
+func (s *fakePolicyServer) received() []map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests
+}
+
+// rejectRecipients rejects the recipients starting with "spam", and defers
+// the ones starting with "later"
+func rejectRecipients(attrs map[string]string) string {
+	switch {
+	case strings.HasPrefix(attrs["recipient"], "spam"):
+		return "action=REJECT Spam trap"
+	case strings.HasPrefix(attrs["recipient"], "later"):
+		return "action=451 4.7.1 Try again later"
+	default:
+		return "action=DUNNO"
+	}
+}
+
+func TestPolicyServiceReply(t *testing.T) {
+	t.Parallel()
+
+	for action, expected := range map[string]*smtpd.Error{
+		"OK":                 {},
+		"dunno":              {},
+		"DEFER_IF_REJECT":    {},
+		"PREPEND X-Foo: 1":   {},
+		"REJECT":             {Code: 554, EnhancedCode: "5.7.1", Msg: "<bob@example.com>: Recipient address rejected: Access denied"},
+		"REJECT Go away":     {Code: 554, EnhancedCode: "5.7.1", Msg: "<bob@example.com>: Recipient address rejected: Go away"},
+		"DEFER_IF_PERMIT":    {Code: 450, EnhancedCode: "4.7.1", Msg: "<bob@example.com>: Recipient address rejected: Access denied"},
+		"550 No such user":   {Code: 550, EnhancedCode: "5.7.1", Msg: "No such user"},
+		"452 4.5.3 Too many": {Code: 452, EnhancedCode: "4.5.3", Msg: "Too many"},
+		"421":                {Code: 421, EnhancedCode: "4.7.1", Msg: "Access denied"},
+	} {
+		smtpErr, err := policyServiceReply(action, "bob@example.com")
+		require.NoError(t, err, action)
+
+		if expected.Code == 0 {
+			assert.Nil(t, smtpErr, action)
+		} else {
+			assert.Equal(t, expected, smtpErr, action)
+		}
+	}
+
+	for _, action := range []string{"", "ACCEPT", "250 Ok", "550 4.1.1 Mismatched"} {
+		_, err := policyServiceReply(action, "bob@example.com")
+		require.Error(t, err, action)
+	}
+}
+
+func TestPolicyServiceCheck(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("tcp", func(t *testing.T) {
+		t.Parallel()
+
+		srv := startFakePolicyServer(t, "tcp", "127.0.0.1:0", rejectRecipients)
+
+		s, err := newPolicyService(srv.addr, time.Second, "relay1", "DUNNO")
+		require.NoError(t, err)
+
+		require.NoError(t, s.check(ctx, []string{"recipient=bob@example.com"}, "bob@example.com"))
+
+		err = s.check(ctx, []string{"recipient=spam@example.com"}, "spam@example.com")
+		require.Equal(t, &smtpd.Error{Code: 554, EnhancedCode: "5.7.1", Msg: "<spam@example.com>: Recipient address rejected: Spam trap"}, err)
+
+		err = s.check(ctx, []string{"recipient=later@example.com"}, "later@example.com")
+		require.Equal(t, &smtpd.Error{Code: 451, EnhancedCode: "4.7.1", Msg: "Try again later"}, err)
+
+		requests := srv.received()
+		require.Len(t, requests, 3)
+		assert.Equal(t, "relay1", requests[0]["policy_context"])
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		t.Parallel()
+
+		sock := filepath.Join(t.TempDir(), "policy.sock")
+		startFakePolicyServer(t, "unix", sock, rejectRecipients)
+
+		s, err := newPolicyService(sock, time.Second, "", "DUNNO")
+		require.NoError(t, err)
+		assert.Equal(t, "unix", s.network)
+
+		require.Error(t, s.check(ctx, []string{"recipient=spam@example.com"}, "spam@example.com"))
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		t.Parallel()
+
+		// the default action applies when the server is unreachable, or
+		// replies with an unknown action
+		s, err := newPolicyService("127.0.0.1:9", time.Second, "", "451 4.3.5 Server configuration problem")
+		require.NoError(t, err)
+
+		err = s.check(ctx, nil, "bob@example.com")
+		require.Equal(t, &smtpd.Error{Code: 451, EnhancedCode: "4.3.5", Msg: "Server configuration problem"}, err)
+
+		srv := startFakePolicyServer(t, "tcp", "127.0.0.1:0", func(map[string]string) string { return "action=BOGUS" })
+
+		s, err = newPolicyService(srv.addr, time.Second, "", "DUNNO")
+		require.NoError(t, err)
+		require.NoError(t, s.check(ctx, nil, "bob@example.com"))
+
+		srv = startFakePolicyServer(t, "tcp", "127.0.0.1:0", func(map[string]string) string { return "foo=bar" })
+
+		s, err = newPolicyService(srv.addr, time.Second, "", "DEFER")
+		require.NoError(t, err)
+
+		_, err = s.query(ctx, nil)
+		require.ErrorIs(t, err, errPolicyServiceReply)
+	})
+
+	_, err := newPolicyService("127.0.0.1:10040", time.Second, "", "MAYBE")
+	require.Error(t, err)
+
+	s, err := newPolicyService("", time.Second, "", "MAYBE")
+	require.NoError(t, err)
+	assert.Nil(t, s)
+	require.NoError(t, s.check(ctx, nil, "bob@example.com"))
+}
+
+func TestPolicyServiceRelay(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	smtpSrv := startTestSMTPServer(ctx, t)
+	policySrv := startFakePolicyServer(t, "tcp", "127.0.0.1:0", rejectRecipients)
+
+	s, err := newPolicyService(policySrv.addr, time.Second, "", "DUNNO")
+	require.NoError(t, err)
+
+	addr := startRelayConfig(ctx, t, "", &config{
+		remoteHost:    smtpSrv.addr,
+		policyService: s,
+	})
+
+	err = sendMsg(t, addr, []string{"spam@example.com"}, "bob@example.com", "rejected", nil, "hello")
+	require.ErrorContains(t, err, "554")
+
+	err = sendMsg(t, addr, []string{"alice@example.com", "carol@example.com"}, "bob@example.com", "accepted", nil, "hello")
+	require.NoError(t, err)
+
+	require.Len(t, *smtpSrv.msgs, 1)
+
+	requests := policySrv.received()
+	require.Len(t, requests, 3)
+
+	req := requests[2]
+	assert.Equal(t, "smtpd_access_policy", req["request"])
+	assert.Equal(t, "RCPT", req["protocol_state"])
+	assert.Equal(t, "ESMTP", req["protocol_name"])
+	assert.Equal(t, "bob@example.com", req["sender"])
+	assert.Equal(t, "carol@example.com", req["recipient"])
+	assert.Equal(t, "0", req["recipient_count"])
+	assert.Equal(t, "127.0.0.1", req["client_address"])
+	assert.Equal(t, "unknown", req["client_name"])
+	assert.NotEmpty(t, req["helo_name"])
+	assert.NotEmpty(t, req["server_port"])
+
+	// the recipients of a transaction share its instance
+	assert.Equal(t, requests[1]["instance"], req["instance"])
+	assert.NotEqual(t, requests[0]["instance"], req["instance"])
+}
@@ -0,0 +1,226 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/traceutil"
+)
+
+// upstreamPool keeps connections to the upstream hosts open between messages,
+// saving the TCP, TLS and authentication round trips. Connections are pooled
+// per upstream host and credentials.
+type upstreamPool struct {
+	// maxIdle is the maximum number of idle connections per upstream
+	maxIdle int
+
+	// maxAge is the maximum age of connections, after which they're closed
+	// rather than reused, as upstreams close idle connections after a while
+	maxAge time.Duration
+
+	// dial connects to the upstream - overridable for tests
+	dial func(ctx context.Context, cfg *config, out *outbound) (*upstreamConn, error)
+
+	mu   sync.Mutex
+	idle map[string][]*upstreamConn
+}
+
+// newUpstreamPool returns nil if pooling is disabled, in which case a new
+// connection is used for each message
+func newUpstreamPool(maxIdle int, maxAge time.Duration) *upstreamPool {
+	if maxIdle <= 0 {
+		return nil
+	}
+
+	return &upstreamPool{
+		maxIdle: maxIdle,
+		maxAge:  maxAge,
+		dial:    dialUpstream,
+		idle:    map[string][]*upstreamConn{},
+	}
+}
+
+// send delivers the message to the upstream host, the first match of:
+//   - the discard delivery mode: the message is read and dropped
+//   - the webhook delivery mode: it's posted to the webhook
+//   - the kafka delivery mode: it's published to Kafka
+//   - LMTP hosts: it's delivered with sendLMTP, without pooling
+//   - upstream groups: it's delivered with sendGroup
+//   - otherwise it waits for the delivery scheduler, then is delivered to the
+//     MX hosts of recipient domains with sendMX, or to the SMTP host with
+//     sendSMTP
+//
+// SMTP deliveries are traced as children of the span of ctx. A failure on a
+// reused connection is retried once on a new connection, as long as the
+// upstream didn't reply to anything, as it may have closed the connection in
+// the meantime - the body wasn't read then.
+func (p *upstreamPool) send(ctx context.Context, cfg *config, out *outbound, body io.Reader) error {
+	if cfg.delivery == deliveryDiscard {
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return fmt.Errorf("data: %w", err)
+		}
+
+		discardedCounter.Inc()
+
+		return nil
+	}
+
+	if cfg.webhook != nil {
+		return cfg.webhook.send(out, body)
+	}
+
+	if cfg.kafka != nil {
+		return cfg.kafka.send(out, body)
+	}
+
+	if network, addr, ok := lmtpAddr(out.Host); ok {
+		return sendLMTP(ctx, cfg, out, network, addr, body)
+	}
+
+	if isUpstreamGroup(out.Host) {
+		g, err := cfg.balancer.group(out.Host)
+		if err != nil {
+			return err
+		}
+
+		return p.sendGroup(ctx, cfg, out, g, body)
+	}
+
+	return cfg.scheduler.deliver(ctx, out, func() error {
+		if domain, ok := strings.CutPrefix(out.Host, mxScheme); ok {
+			return p.sendMX(ctx, cfg, out, domain, body)
+		}
+
+		// MTA-STS policies are checked for each message, as pooled
+		// connections may have been set up for recipient domains without one
+		return p.sendSMTP(ctx, cfg, out, body, cfg.mtaSTS.lookup(out))
+	})
+}
+
+// sendSMTP delivers the message to the SMTP upstream host, see send
+func (p *upstreamPool) sendSMTP(ctx context.Context, cfg *config, out *outbound, body io.Reader, sts mtaSTSPolicies) (err error) {
+	key := out.Host + " " + cfg.upstreamAuth(out.CredentialsKey).username
+
+	ctx, span := startUpstreamSpan(ctx, "upstream.send", out)
+	defer func() { endUpstreamSpan(span, err) }()
+
+	if uc := p.get(key); uc != nil {
+		if err := sts.check(out.Host, uc.tls); err != nil {
+			p.put(key, uc, nil)
+			return err
+		}
+
+		upstreamConnsCounter.WithLabelValues(strconv.FormatBool(true)).Inc()
+		span.SetAttributes(traceutil.ConnectionReused(true))
+
+		err := uc.send(ctx, out, body)
+		if err == nil || uc.replied {
+			p.put(key, uc, err)
+			return err
+		}
+
+		uc.close()
+	}
+
+	dial := dialUpstream
+	if p != nil {
+		dial = p.dial
+	}
+
+	uc, err := dial(ctx, cfg, out)
+	if err != nil {
+		sts.dialFailed(err)
+		return err
+	}
+
+	if err := sts.check(out.Host, uc.tls); err != nil {
+		p.put(key, uc, nil)
+		return err
+	}
+
+	upstreamConnsCounter.WithLabelValues(strconv.FormatBool(false)).Inc()
+	span.SetAttributes(traceutil.ConnectionReused(false))
+
+	err = uc.send(ctx, out, body)
+	p.put(key, uc, err)
+
+	return err
+}
+
+// get returns an idle connection to the upstream, nil if there's none
+func (p *upstreamPool) get(key string) *upstreamConn {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for conns := p.idle[key]; len(conns) > 0; conns = p.idle[key] {
+		// most recently used first, as it's the least likely to be closed
+		uc := conns[len(conns)-1]
+		p.idle[key] = conns[:len(conns)-1]
+
+		if !p.expired(uc) {
+			return uc
+		}
+
+		go uc.close()
+	}
+
+	return nil
+}
+
+// put returns the connection to the pool after a transaction, or closes it if
+// it can't be reused
+func (p *upstreamPool) put(key string, uc *upstreamConn, err error) {
+	if p == nil || uc.broken || p.expired(uc) {
+		uc.close()
+		return
+	}
+
+	// the transaction failed, abort it before reusing the connection
+	if err != nil && uc.reset() != nil {
+		uc.broken = true
+		uc.close()
+
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle[key]) >= p.maxIdle {
+		go uc.close()
+		return
+	}
+
+	p.idle[key] = append(p.idle[key], uc)
+}
+
+func (p *upstreamPool) expired(uc *upstreamConn) bool {
+	return p.maxAge > 0 && time.Since(uc.created) >= p.maxAge
+}
+
+// close closes all the idle connections
+func (p *upstreamPool) close() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, conns := range p.idle {
+		for _, uc := range conns {
+			uc.close()
+		}
+
+		delete(p.idle, key)
+	}
+}
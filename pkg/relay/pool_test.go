@@ -0,0 +1,175 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sessions returns the number of SMTP sessions the upstream received
+func (u *fakeUpstream) sessions() int {
+	commands, _ := u.received()
+
+	n := 0
+	for _, cmd := range commands {
+		if strings.HasPrefix(cmd, "EHLO") {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestUpstreamPool(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{hostName: "relay.example.com"}
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+
+	t.Run("connections are reused", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t, "PIPELINING")
+		p := newUpstreamPool(2, time.Minute)
+		t.Cleanup(p.close)
+
+		out := *testOutbound
+		out.Host = u.addr
+
+		require.NoError(t, p.send(context.Background(), cfg, &out, bytes.NewReader(data)))
+		require.NoError(t, p.send(context.Background(), cfg, &out, bytes.NewReader(data)))
+
+		_, msgs := u.received()
+		assert.Len(t, msgs, 2)
+		assert.Equal(t, 1, u.sessions())
+	})
+
+	t.Run("failed transactions are reset", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t)
+		u.setReply("RCPT", "550 5.1.1 no such user")
+
+		p := newUpstreamPool(2, time.Minute)
+		t.Cleanup(p.close)
+
+		out := *testOutbound
+		out.Host = u.addr
+
+		err := p.send(context.Background(), cfg, &out, bytes.NewReader(data))
+		require.ErrorContains(t, err, "rcpt "+out.Recipients[0]+":")
+
+		u.setReply("RCPT", "250 ok")
+		require.NoError(t, p.send(context.Background(), cfg, &out, bytes.NewReader(data)))
+
+		commands, msgs := u.received()
+		assert.Contains(t, commands, "RSET")
+		assert.Len(t, msgs, 1)
+		assert.Equal(t, 1, u.sessions())
+	})
+
+	t.Run("pipelined failures drop the connection", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t, "PIPELINING")
+		u.setReply("RCPT", "550 5.1.1 no such user")
+
+		p := newUpstreamPool(2, time.Minute)
+		t.Cleanup(p.close)
+
+		out := *testOutbound
+		out.Host = u.addr
+
+		require.Error(t, p.send(context.Background(), cfg, &out, bytes.NewReader(data)))
+
+		u.setReply("RCPT", "250 ok")
+		require.NoError(t, p.send(context.Background(), cfg, &out, bytes.NewReader(data)))
+
+		_, msgs := u.received()
+		assert.Len(t, msgs, 1)
+		assert.Equal(t, 2, u.sessions())
+	})
+
+	t.Run("expired connections aren't reused", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t)
+		p := newUpstreamPool(2, time.Nanosecond)
+		t.Cleanup(p.close)
+
+		out := *testOutbound
+		out.Host = u.addr
+
+		require.NoError(t, p.send(context.Background(), cfg, &out, bytes.NewReader(data)))
+		require.NoError(t, p.send(context.Background(), cfg, &out, bytes.NewReader(data)))
+
+		assert.Equal(t, 2, u.sessions())
+	})
+
+	t.Run("closed connections are retried", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t)
+		p := newUpstreamPool(2, time.Minute)
+		t.Cleanup(p.close)
+
+		out := *testOutbound
+		out.Host = u.addr
+
+		require.NoError(t, p.send(context.Background(), cfg, &out, bytes.NewReader(data)))
+
+		// the connection is closed while idle in the pool
+		p.mu.Lock()
+		for _, conns := range p.idle {
+			for _, uc := range conns {
+				_ = uc.c.Close()
+			}
+		}
+		p.mu.Unlock()
+
+		require.NoError(t, p.send(context.Background(), cfg, &out, bytes.NewReader(data)))
+
+		_, msgs := u.received()
+		assert.Len(t, msgs, 2)
+		assert.Equal(t, 2, u.sessions())
+	})
+
+	t.Run("disabled pool", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t)
+		p := newUpstreamPool(0, time.Minute)
+		assert.Nil(t, p)
+
+		out := *testOutbound
+		out.Host = u.addr
+
+		require.NoError(t, p.send(context.Background(), cfg, &out, bytes.NewReader(data)))
+		require.NoError(t, p.send(context.Background(), cfg, &out, bytes.NewReader(data)))
+
+		assert.Equal(t, 2, u.sessions())
+	})
+
+	t.Run("discarded messages aren't delivered", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t)
+
+		out := *testOutbound
+		out.Host = u.addr
+
+		body := bytes.NewReader(data)
+
+		var p *upstreamPool
+		require.NoError(t, p.send(context.Background(), &config{delivery: deliveryDiscard}, &out, body))
+
+		// the message was read in full
+		assert.Zero(t, body.Len())
+		assert.Zero(t, u.sessions())
+	})
+}
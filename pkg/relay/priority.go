@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// senderPriorities are the priorities (RFC 6710) given to the messages of
+// senders, by lowercased address or domain prefixed with "@", as aliases
+type senderPriorities map[string]int
+
+// parseSenderPriorities parses the input into senderPriorities. It should be
+// in the form of "alerts@example.com=5 @bulk.example.com=-5" (separated by
+// spaces), with priorities from -9 to 9. Returns nil if the input is empty.
+func parseSenderPriorities(s string) (senderPriorities, error) {
+	entries := splitstr(s, ' ')
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	p := senderPriorities{}
+
+	for _, entry := range entries {
+		sender, value, found := strings.Cut(entry, "=")
+		if !found || !strings.Contains(sender, "@") || strings.HasSuffix(sender, "@") {
+			return nil, fmt.Errorf("invalid entry %q, expected address=priority or @domain=priority", entry)
+		}
+
+		priority, err := strconv.Atoi(value)
+		if err != nil || priority < smtpd.MinPriority || priority > smtpd.MaxPriority {
+			return nil, fmt.Errorf("invalid priority %q, expected a number from %d to %d",
+				entry, smtpd.MinPriority, smtpd.MaxPriority)
+		}
+
+		p[strings.ToLower(sender)] = priority
+	}
+
+	return p, nil
+}
+
+// priority returns the priority of the messages of the sender, or of its
+// domain, overriding the one the client gave with MT-PRIORITY
+func (p senderPriorities) priority(sender string, given int) int {
+	sender = strings.ToLower(sender)
+
+	if priority, ok := p[sender]; ok {
+		return priority
+	}
+
+	if i := strings.LastIndex(sender, "@"); i != -1 {
+		if priority, ok := p[sender[i:]]; ok {
+			return priority
+		}
+	}
+
+	return given
+}
@@ -0,0 +1,32 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSenderPriorities(t *testing.T) {
+	t.Parallel()
+
+	p, err := parseSenderPriorities("")
+	require.NoError(t, err)
+	assert.Nil(t, p)
+	assert.Equal(t, 3, p.priority("alice@example.com", 3))
+
+	p, err = parseSenderPriorities("Alerts@example.com=5  @newsletter.example.com=-5 @example.com=+1")
+	require.NoError(t, err)
+	assert.Equal(t, senderPriorities{"alerts@example.com": 5, "@newsletter.example.com": -5, "@example.com": 1}, p)
+
+	assert.Equal(t, 5, p.priority("alerts@EXAMPLE.com", -9))
+	assert.Equal(t, 1, p.priority("bob@example.com", 0))
+	assert.Equal(t, -5, p.priority("news@newsletter.example.com", 9))
+	assert.Equal(t, 2, p.priority("bob@example.org", 2))
+	assert.Equal(t, 0, p.priority("", 0))
+
+	for _, s := range []string{"example.com=1", "alice@=1", "alice@example.com", "alice@example.com=10", "@example.com=high"} {
+		_, err := parseSenderPriorities(s)
+		require.Error(t, err, s)
+	}
+}
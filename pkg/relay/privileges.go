@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// lookupIDs resolves the user and group to switch to once the listeners are
+// bound, as names or numeric IDs. The group defaults to the primary group of
+// the user, and either ID is -1 when there's nothing to switch to.
+func lookupIDs(userName, groupName string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+
+	if userName != "" {
+		u, err := lookupUser(userName)
+		if err != nil {
+			return -1, -1, err
+		}
+
+		uid, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return -1, -1, fmt.Errorf("user %q has a non-numeric ID %q", userName, u.Uid)
+		}
+
+		if u.Gid != "" {
+			gid, err = strconv.Atoi(u.Gid)
+			if err != nil {
+				return -1, -1, fmt.Errorf("user %q has a non-numeric group ID %q", userName, u.Gid)
+			}
+		}
+	}
+
+	if groupName != "" {
+		gid, err = lookupGroupID(groupName)
+		if err != nil {
+			return -1, -1, err
+		}
+	}
+
+	if uid >= 0 && gid < 0 {
+		return -1, -1, fmt.Errorf("user %q has no primary group, set group", userName)
+	}
+
+	return uid, gid, nil
+}
+
+// lookupUser looks up a user by name, or by ID if numeric. Numeric IDs
+// missing from the user database are allowed, without a primary group.
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err != nil {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user: %w", err)
+		}
+
+		return u, nil
+	}
+
+	u, err := user.LookupId(name)
+
+	var unknown user.UnknownUserIdError
+	if errors.As(err, &unknown) {
+		return &user.User{Uid: name}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid user: %w", err)
+	}
+
+	return u, nil
+}
+
+// lookupGroupID looks up a group ID by name, or returns it as is if numeric
+func lookupGroupID(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, fmt.Errorf("invalid group: %w", err)
+	}
+
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return -1, fmt.Errorf("group %q has a non-numeric ID %q", name, g.Gid)
+	}
+
+	return gid, nil
+}
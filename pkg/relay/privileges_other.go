@@ -0,0 +1,14 @@
+//go:build !unix
+
+package relay
+
+import "errors"
+
+// dropPrivileges isn't supported outside of Unix
+func dropPrivileges(dir string, uid, gid int) error {
+	if dir != "" || uid >= 0 || gid >= 0 {
+		return errors.New("user, group and chroot are only supported on Unix")
+	}
+
+	return nil
+}
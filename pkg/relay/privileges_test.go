@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupIDs(t *testing.T) {
+	t.Parallel()
+
+	uid, gid, err := lookupIDs("", "")
+	require.NoError(t, err)
+	assert.Equal(t, -1, uid)
+	assert.Equal(t, -1, gid)
+
+	// the group defaults to the primary group of the user
+	uid, gid, err = lookupIDs("root", "")
+	require.NoError(t, err)
+	assert.Equal(t, 0, uid)
+	assert.Equal(t, 0, gid)
+
+	uid, gid, err = lookupIDs("0", "4242")
+	require.NoError(t, err)
+	assert.Equal(t, 0, uid)
+	assert.Equal(t, 4242, gid)
+
+	uid, gid, err = lookupIDs("", "4242")
+	require.NoError(t, err)
+	assert.Equal(t, -1, uid)
+	assert.Equal(t, 4242, gid)
+
+	// numeric IDs don't need to be in the user database, but then there's no
+	// primary group
+	_, _, err = lookupIDs("4242", "")
+	require.Error(t, err)
+
+	uid, gid, err = lookupIDs("4242", "4243")
+	require.NoError(t, err)
+	assert.Equal(t, 4242, uid)
+	assert.Equal(t, 4243, gid)
+
+	_, _, err = lookupIDs("no-such-user", "")
+	require.Error(t, err)
+
+	_, _, err = lookupIDs("", "no-such-group")
+	require.Error(t, err)
+}
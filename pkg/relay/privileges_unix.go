@@ -0,0 +1,43 @@
+//go:build unix
+
+package relay
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// dropPrivileges changes the root directory to dir, if set, then switches to
+// the given group and user, if not negative. It's called once the listeners
+// are bound, so privileged ports can be used without running as root.
+func dropPrivileges(dir string, uid, gid int) error {
+	if dir != "" {
+		if err := syscall.Chroot(dir); err != nil {
+			return fmt.Errorf("chroot to %q: %w", dir, err)
+		}
+
+		if err := os.Chdir("/"); err != nil {
+			return fmt.Errorf("chdir to the new root: %w", err)
+		}
+	}
+
+	// the group has to change first, as it can't once the user isn't root
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("set supplementary groups: %w", err)
+		}
+
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("set group ID %d: %w", gid, err)
+		}
+	}
+
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("set user ID %d: %w", uid, err)
+		}
+	}
+
+	return nil
+}
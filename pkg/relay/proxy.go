@@ -0,0 +1,166 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// parseProxyURL parses the URL of the proxy the outbound connections go
+// through: socks5://[user:pass@]host:port, where the proxy is given the
+// address of the upstream, socks5h://... where it's given its name to
+// resolve, or http://[user:pass@]host:port for an HTTP CONNECT proxy
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		// the URL, and its password, are left out of the error
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL %q, expected a socks5, socks5h or http scheme", u.Redacted())
+	}
+
+	if _, _, err := net.SplitHostPort(u.Host); err != nil || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("invalid proxy URL %q, expected %s://[user:pass@]host:port", u.Redacted(), u.Scheme)
+	}
+
+	return u, nil
+}
+
+// dialProxy connects to the host:port address through the proxy, itself
+// connected to like the upstreams are
+func (d *outboundDialer) dialProxy(ctx context.Context, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	// only socks5h and HTTP proxies resolve the upstream names themselves
+	if d.proxy.Scheme == "socks5" && net.ParseIP(host) == nil {
+		ips, err := d.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		address = net.JoinHostPort(ips[0].String(), port)
+	}
+
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	if d.proxy.Scheme == "http" {
+		return d.dialHTTPProxy(ctx, address)
+	}
+
+	var auth *proxy.Auth
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		auth = &proxy.Auth{User: d.proxy.User.Username(), Password: password}
+	}
+
+	socks, err := proxy.SOCKS5("tcp", d.proxy.Host, auth, proxyForward{d})
+	if err != nil {
+		return nil, err
+	}
+
+	return socks.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+}
+
+// dialHTTPProxy connects to the host:port address through the HTTP proxy,
+// with a CONNECT request
+func (d *outboundDialer) dialHTTPProxy(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := d.dialDirect(ctx, d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake is bounded by the context, and ended early if it's done
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(d.proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	br := bufio.NewReader(conn)
+
+	err = req.Write(conn)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = http.ReadResponse(br, req); err == nil {
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("proxy refused the connection to %s: %s", address, resp.Status)
+			}
+		}
+	}
+
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// proxyForward connects to the SOCKS5 proxy like to the upstreams
+type proxyForward struct {
+	d *outboundDialer
+}
+
+func (f proxyForward) Dial(network, address string) (net.Conn, error) {
+	return f.DialContext(context.Background(), network, address)
+}
+
+func (f proxyForward) DialContext(ctx context.Context, _, address string) (net.Conn, error) {
+	return f.d.dialDirect(ctx, address)
+}
+
+// bufferedConn is a connection whose first bytes were buffered by r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,368 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// Checks whose rejects can be quarantined
+const (
+	quarantineVirus  = "virus"  // clamav found a virus
+	quarantineDMARC  = "dmarc"  // the DMARC policy of the From domain is reject
+	quarantinePolicy = "policy" // a reject rule of the data stage of policy_rules
+)
+
+var (
+	errQuarantineFailed = &smtpd.Error{Code: 451, EnhancedCode: "4.3.0", Msg: "Could not quarantine message, try again later"}
+	errNotQuarantined   = errors.New("no such quarantined message")
+)
+
+// quarantineID matches the IDs of quarantined messages, which name their files
+var quarantineID = regexp.MustCompile(`^[0-9a-f-]{36}$`)
+
+// flaggedError is the reject of a check which can be quarantined instead
+type flaggedError struct {
+	check  string
+	reason string
+	err    error
+}
+
+func (e *flaggedError) Error() string { return e.err.Error() }
+func (e *flaggedError) Unwrap() error { return e.err }
+
+// flagged marks the reject err of a check as quarantinable, reason telling
+// why it was flagged, e.g. the name of the virus
+func flagged(check, reason string, err error) error {
+	return &flaggedError{check: check, reason: reason, err: err}
+}
+
+// quarantinedMessage is the metadata of a quarantined message. The message
+// data is stored next to it, in a file with the same ID and a .eml extension.
+type quarantinedMessage struct {
+	ID          string    `json:"id"`
+	Quarantined time.Time `json:"quarantined"`
+	Check       string    `json:"check"`
+	Reason      string    `json:"reason,omitempty"`
+	Reply       string    `json:"reply"`
+	Listener    string    `json:"listener"`
+	Client      string    `json:"client"`
+	Helo        string    `json:"helo,omitempty"`
+	Username    string    `json:"username,omitempty"`
+	Sender      string    `json:"sender"`
+	Recipients  []string  `json:"recipients"`
+	Subject     string    `json:"subject,omitempty"`
+	Size        int       `json:"size"`
+	SMTPUTF8    bool      `json:"smtputf8,omitempty"`
+	BodyType    string    `json:"body_type,omitempty"`
+}
+
+// quarantine holds the messages flagged by the checks listed in
+// quarantine_checks in a directory, instead of rejecting them, until they're
+// released or deleted with the admin API
+type quarantine struct {
+	dir    string
+	checks []string
+
+	logger *slog.Logger
+}
+
+// newQuarantine returns nil if dir is empty. checks are the names of the
+// checks whose rejects are quarantined, separated by spaces or commas.
+func newQuarantine(dir, checks string) (*quarantine, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	q := &quarantine{
+		dir:    dir,
+		checks: strings.FieldsFunc(checks, func(r rune) bool { return r == ' ' || r == ',' }),
+		logger: slog.Default().With(slog.String("component", "quarantine")),
+	}
+
+	for _, check := range q.checks {
+		switch check {
+		case quarantineVirus, quarantineDMARC, quarantinePolicy:
+		default:
+			return nil, fmt.Errorf("unknown check %q", check)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create quarantine directory: %w", err)
+	}
+
+	return q, nil
+}
+
+// holds returns the flagged reject of err if its check is quarantined
+func (q *quarantine) holds(err error) *flaggedError {
+	var f *flaggedError
+	if q == nil || !errors.As(err, &f) || !slices.Contains(q.checks, f.check) {
+		return nil
+	}
+
+	return f
+}
+
+// store writes the message to the quarantine directory, and returns its ID
+func (q *quarantine) store(listener string, peer smtpd.Peer, env *smtpd.Envelope, f *flaggedError) (string, error) {
+	msg := &quarantinedMessage{
+		ID:          generateUUID(),
+		Quarantined: time.Now().UTC(),
+		Check:       f.check,
+		Reason:      f.reason,
+		Reply:       f.Error(),
+		Listener:    listener,
+		Client:      peer.Addr.String(),
+		Helo:        peer.HeloName,
+		Username:    peer.Username,
+		Sender:      env.Sender,
+		Recipients:  env.Recipients,
+		Subject:     env.Header.Get("Subject"),
+		Size:        len(env.Data),
+		SMTPUTF8:    env.SMTPUTF8,
+		BodyType:    env.BodyType,
+	}
+
+	if msg.ID == "" {
+		return "", errors.New("could not generate message ID")
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return "", fmt.Errorf("marshal quarantine entry: %w", err)
+	}
+
+	// like in the queue, the metadata file is only ever visible for
+	// complete messages
+	if err := writeFileAtomic(q.dataPath(msg.ID), env.Data); err != nil {
+		return "", fmt.Errorf("write message data: %w", err)
+	}
+
+	if err := writeFileAtomic(q.metaPath(msg.ID), b); err != nil {
+		_ = os.Remove(q.dataPath(msg.ID))
+
+		return "", fmt.Errorf("write quarantine entry: %w", err)
+	}
+
+	quarantineCounter.WithLabelValues(msg.Check).Inc()
+
+	return msg.ID, nil
+}
+
+// messages returns the metadata of all quarantined messages, oldest first
+func (q *quarantine) messages() ([]*quarantinedMessage, error) {
+	paths, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]*quarantinedMessage, 0, len(paths))
+
+	for _, p := range paths {
+		msg, err := q.read(strings.TrimSuffix(filepath.Base(p), ".json"))
+		if errors.Is(err, errNotQuarantined) {
+			// removed since it was listed
+			continue
+		}
+
+		if err != nil {
+			q.logger.Error("skipping malformed quarantine entry", slog.String("path", p), slog.Any("error", err))
+			continue
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Quarantined.Before(msgs[j].Quarantined)
+	})
+
+	return msgs, nil
+}
+
+// get returns the metadata of a quarantined message
+func (q *quarantine) get(id string) (*quarantinedMessage, error) {
+	if !quarantineID.MatchString(id) {
+		return nil, errNotQuarantined
+	}
+
+	return q.read(id)
+}
+
+func (q *quarantine) read(id string) (*quarantinedMessage, error) {
+	b, err := os.ReadFile(q.metaPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotQuarantined
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &quarantinedMessage{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// data returns the data of a quarantined message
+func (q *quarantine) data(id string) ([]byte, error) {
+	if !quarantineID.MatchString(id) {
+		return nil, errNotQuarantined
+	}
+
+	data, err := os.ReadFile(q.dataPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotQuarantined
+	}
+
+	return data, err
+}
+
+// remove deletes a quarantined message
+func (q *quarantine) remove(id string) error {
+	if !quarantineID.MatchString(id) {
+		return errNotQuarantined
+	}
+
+	// remove the metadata first so a partially removed message isn't listed
+	if err := os.Remove(q.metaPath(id)); errors.Is(err, os.ErrNotExist) {
+		return errNotQuarantined
+	} else if err != nil {
+		return err
+	}
+
+	if err := os.Remove(q.dataPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (q *quarantine) metaPath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+func (q *quarantine) dataPath(id string) string {
+	return filepath.Join(q.dir, id+".eml")
+}
+
+// quarantineStage holds the messages rejected by the checks of the later
+// stages listed in quarantine_checks, and accepts them instead
+func (r *relay) quarantineStage(next smtpd.Handler) smtpd.Handler {
+	return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+		q := r.config(ctx).quarantine
+		if q == nil {
+			return next(ctx, peer, env)
+		}
+
+		// the message is kept as received, before the checks alter it
+		if err := env.Buffer(); err != nil {
+			return err
+		}
+
+		received := env
+		received.Header = textproto.MIMEHeader{}
+
+		for k, v := range env.Header {
+			received.Header[k] = slices.Clone(v)
+		}
+
+		err := next(ctx, peer, env)
+
+		f := q.holds(err)
+		if f == nil {
+			return err
+		}
+
+		log := q.logger.With(
+			slog.String("uuid", messageUUID(ctx)),
+			slog.String("check", f.check),
+			slog.String("reason", f.reason),
+			slog.String("from", env.Sender),
+			slog.Any("to", env.Recipients),
+		)
+
+		id, qerr := q.store(r.listener.String(), peer, &received, f)
+		if qerr != nil {
+			log.ErrorContext(ctx, "could not quarantine message", slog.Any("error", qerr))
+			return observeErr(ctx, errQuarantineFailed)
+		}
+
+		log.WarnContext(ctx, "message quarantined", slog.String("quarantine_id", id))
+
+		return nil
+	}
+}
+
+// release delivers a quarantined message as if it had passed the checks,
+// queueing it if the delivery fails temporarily and queueing is enabled, and
+// removes it from the quarantine once delivered
+func (r *relay) release(ctx context.Context, q *quarantine, id string) error {
+	msg, err := q.get(id)
+	if err != nil {
+		return err
+	}
+
+	data, err := q.data(id)
+	if err != nil {
+		return err
+	}
+
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	if err != nil {
+		return fmt.Errorf("invalid quarantined message: %w", err)
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", msg.Client)
+	if err != nil {
+		return fmt.Errorf("invalid quarantined client address: %w", err)
+	}
+
+	peer := smtpd.Peer{
+		Addr:       addr,
+		HeloName:   msg.Helo,
+		Username:   msg.Username,
+		Protocol:   smtpd.ESMTP,
+		ServerName: r.config(ctx).hostName,
+	}
+
+	env := smtpd.Envelope{
+		Sender:     msg.Sender,
+		Recipients: msg.Recipients,
+		Header:     header,
+		Data:       data,
+		SMTPUTF8:   msg.SMTPUTF8,
+		BodyType:   msg.BodyType,
+	}
+
+	ctx = context.WithValue(ctx, messageUUIDKey{}, msg.ID)
+
+	if err := r.deliveryHandler()(ctx, peer, env); err != nil {
+		return err
+	}
+
+	q.logger.InfoContext(ctx, "quarantined message released", slog.String("quarantine_id", id),
+		slog.String("from", msg.Sender), slog.Any("to", msg.Recipients))
+
+	return q.remove(id)
+}
@@ -0,0 +1,190 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// quarantineRelay returns a relay delivering to upstream, with a quarantine
+// for checks and a policy rejecting the messages with "spam" in their subject
+func quarantineRelay(t *testing.T, upstream, checks string) (*relay, *quarantine) {
+	t.Helper()
+
+	q, err := newQuarantine(filepath.Join(t.TempDir(), "quarantine"), checks)
+	require.NoError(t, err)
+
+	p, err := loadPolicy(writeTestFile(t, "policy_rules", `
+[data]
+subject contains "spam" => reject 550 5.7.1 Looks like spam
+`))
+	require.NoError(t, err)
+
+	r, err := newRelay(newConfigStore(&config{remoteHost: upstream, policy: p, quarantine: q}),
+		listenerConfig{scheme: schemeTCP, address: "127.0.0.1:2525"}, &relayShared{})
+	require.NoError(t, err)
+
+	return r, q
+}
+
+// sendQuarantineMsg runs the message through the mail handler of the relay
+func sendQuarantineMsg(t *testing.T, r *relay, data string) error {
+	t.Helper()
+
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(data))).ReadMIMEHeader()
+	require.NoError(t, err)
+
+	peer := smtpd.Peer{
+		Addr:     &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345},
+		HeloName: "client.example.com",
+	}
+	env := smtpd.Envelope{
+		Sender:     "alice@example.com",
+		Recipients: []string{"bob@example.com"},
+		Header:     header,
+		Data:       []byte(data),
+	}
+
+	return r.mailHandler()(context.Background(), peer, env)
+}
+
+func TestNewQuarantine(t *testing.T) {
+	t.Parallel()
+
+	q, err := newQuarantine("", "bogus")
+	require.NoError(t, err)
+	assert.Nil(t, q)
+	assert.Nil(t, q.holds(flagged(quarantineVirus, "", errVirusFound)))
+
+	_, err = newQuarantine(t.TempDir(), "virus,spam")
+	require.Error(t, err)
+
+	q, err = newQuarantine(t.TempDir(), "virus, dmarc")
+	require.NoError(t, err)
+	assert.Equal(t, []string{quarantineVirus, quarantineDMARC}, q.checks)
+
+	assert.NotNil(t, q.holds(flagged(quarantineVirus, "Eicar", errVirusFound)))
+	assert.Nil(t, q.holds(flagged(quarantinePolicy, "", errVirusFound)))
+	assert.Nil(t, q.holds(errVirusFound))
+	assert.Nil(t, q.holds(nil))
+}
+
+func TestQuarantineStage(t *testing.T) {
+	t.Parallel()
+
+	u := startFakeUpstream(t)
+	r, q := quarantineRelay(t, u.addr, "policy")
+
+	data := "Subject: cheap spam\r\n\r\nhello\r\n"
+	require.NoError(t, sendQuarantineMsg(t, r, data))
+	require.NoError(t, sendQuarantineMsg(t, r, "Subject: hi\r\n\r\nhello\r\n"))
+
+	// only the clean message was delivered
+	_, delivered := u.received()
+	require.Len(t, delivered, 1)
+	assert.Contains(t, delivered[0], "Subject: hi\n")
+
+	msgs, err := q.messages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	msg := msgs[0]
+	assert.Equal(t, quarantinePolicy, msg.Check)
+	assert.Equal(t, "550 5.7.1 Looks like spam", msg.Reply)
+	assert.Equal(t, "tcp://127.0.0.1:2525", msg.Listener)
+	assert.Equal(t, "192.0.2.10:12345", msg.Client)
+	assert.Equal(t, "client.example.com", msg.Helo)
+	assert.Equal(t, "alice@example.com", msg.Sender)
+	assert.Equal(t, []string{"bob@example.com"}, msg.Recipients)
+	assert.Equal(t, "cheap spam", msg.Subject)
+	assert.Equal(t, len(data), msg.Size)
+
+	got, err := q.get(msg.ID)
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+
+	stored, err := q.data(msg.ID)
+	require.NoError(t, err)
+	assert.Equal(t, data, string(stored))
+
+	// checks which aren't quarantined still reject
+	r, q = quarantineRelay(t, u.addr, "virus")
+	require.Error(t, sendQuarantineMsg(t, r, data))
+
+	msgs, err = q.messages()
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+}
+
+func TestQuarantineClamAV(t *testing.T) {
+	t.Parallel()
+
+	u := startFakeUpstream(t)
+	r, q := quarantineRelay(t, u.addr, "virus")
+	r.conf.get().clamav = newClamAV(startFakeClamd(t, "tcp", "127.0.0.1:0"), time.Second)
+
+	require.NoError(t, sendQuarantineMsg(t, r, "Subject: hi\r\n\r\n"+eicar+"\r\n"))
+
+	msgs, err := q.messages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, quarantineVirus, msgs[0].Check)
+	assert.Equal(t, "Eicar-Test-Signature", msgs[0].Reason)
+
+	_, delivered := u.received()
+	assert.Empty(t, delivered)
+}
+
+func TestQuarantineRelease(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	u := startFakeUpstream(t)
+	r, q := quarantineRelay(t, u.addr, "policy")
+
+	require.NoError(t, sendQuarantineMsg(t, r, "Subject: cheap spam\r\n\r\nhello\r\n"))
+
+	msgs, err := q.messages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	require.NoError(t, r.release(ctx, q, msgs[0].ID))
+
+	// released messages are delivered without being checked again
+	_, delivered := u.received()
+	require.Len(t, delivered, 1)
+	assert.Contains(t, delivered[0], "Subject: cheap spam\n")
+	assert.Contains(t, delivered[0], "from client.example.com ([192.0.2.10])")
+
+	msgs, err = q.messages()
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	require.ErrorIs(t, r.release(ctx, q, generateUUID()), errNotQuarantined)
+	require.ErrorIs(t, q.remove("../quarantine"), errNotQuarantined)
+
+	_, err = q.data("../../etc/passwd")
+	require.ErrorIs(t, err, errNotQuarantined)
+
+	// messages which can't be delivered stay quarantined
+	r, q = quarantineRelay(t, "127.0.0.1:9", "policy")
+	require.NoError(t, sendQuarantineMsg(t, r, "Subject: cheap spam\r\n\r\nhello\r\n"))
+
+	msgs, err = q.messages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	require.Error(t, r.release(ctx, q, msgs[0].ID))
+	require.NoError(t, q.remove(msgs[0].ID))
+	require.ErrorIs(t, q.remove(msgs[0].ID), errNotQuarantined)
+}
@@ -0,0 +1,805 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// how often the queue directory is scanned for messages due for delivery
+const queueScanInterval = 10 * time.Second
+
+var (
+	errNotQueued     = errors.New("no such queued message")
+	errInvalidImport = errors.New("invalid exported message")
+)
+
+// queueID matches the IDs of queued messages, which name their files
+var queueID = regexp.MustCompile(`^[0-9a-f-]{36}$`)
+
+// queuedMessage is the metadata of a spooled message. The message data is
+// stored next to it, in a file with the same ID and a .eml extension.
+type queuedMessage struct {
+	outbound
+
+	ID          string    `json:"id"`
+	Created     time.Time `json:"created"`
+	NextAttempt time.Time `json:"next_attempt"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	// Scheduled is the time the client asked the message to be delivered at,
+	// nil if it's queued because its delivery failed
+	Scheduled *time.Time `json:"scheduled,omitempty"`
+}
+
+// queuedMessageDetail is a queued message, with the headers of its data
+type queuedMessageDetail struct {
+	queuedMessage
+
+	Headers textproto.MIMEHeader `json:"headers"`
+}
+
+// exportedMessage is a queued message with its data, as exported to be
+// imported into the queue of another instance
+type exportedMessage struct {
+	queuedMessage
+
+	Data []byte `json:"data"`
+}
+
+// pending reports whether the message is scheduled for delivery after now
+func (m *queuedMessage) pending(now time.Time) bool {
+	return m.Scheduled != nil && m.Scheduled.After(now)
+}
+
+// age returns how long the message has been waiting for its delivery, from
+// when it was queued or scheduled for
+func (m *queuedMessage) age(now time.Time) time.Duration {
+	if m.Scheduled != nil && m.Scheduled.After(m.Created) {
+		return now.Sub(*m.Scheduled)
+	}
+
+	return now.Sub(m.Created)
+}
+
+// queue is a spool directory-backed retry queue for messages which could not
+// be delivered to the upstream on the first attempt. Messages are retried with
+// exponential backoff until they're delivered, fail permanently, or exceed
+// the maximum age.
+type queue struct {
+	dir        string
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	maxAge     time.Duration
+
+	// deliver sends the message upstream - overridable for tests
+	deliver func(ctx context.Context, msg *queuedMessage, data []byte) error
+
+	// router routes the bounces of messages which failed permanently back to
+	// their sender, nil to drop them silently
+	router   *router
+	hostName string
+
+	// mailLog and audit log the delivery attempts to syslog and the audit
+	// log, nil if they're disabled
+	mailLog *mailLog
+	audit   *auditLog
+
+	// notifier notifies the deliveries accepted by the upstreams, nil not to
+	notifier *handoffNotifier
+
+	// mu serializes processing of the spool directory
+	mu sync.Mutex
+
+	// wake makes run process the due messages at once, rather than on the
+	// next scan
+	wake chan struct{}
+
+	logger *slog.Logger
+}
+
+func newQueue(conf *configStore, upstreams *upstreamPool) (*queue, error) {
+	cfg := conf.get()
+
+	if err := os.MkdirAll(cfg.queueDir, 0o700); err != nil {
+		return nil, fmt.Errorf("create queue directory: %w", err)
+	}
+
+	router, err := parseRoutes(cfg.remoteHost, cfg.delivery == deliveryMX)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse remote_host %q: %w", cfg.remoteHost, err)
+	}
+
+	q := &queue{
+		dir:        cfg.queueDir,
+		minBackoff: cfg.queueRetryMin,
+		maxBackoff: cfg.queueRetryMax,
+		maxAge:     cfg.queueMaxAge,
+		router:     router,
+		hostName:   cfg.hostName,
+		mailLog:    cfg.mailLog,
+		audit:      cfg.audit,
+		wake:       make(chan struct{}, 1),
+		logger:     slog.Default().With(slog.String("component", "queue")),
+	}
+
+	q.deliver = func(ctx context.Context, msg *queuedMessage, data []byte) error {
+		start := time.Now()
+		err := upstreams.send(ctx, conf.get(), &msg.outbound, bytes.NewReader(data))
+		observeDelivery(msg.Host, int64(len(data)), err, time.Since(start))
+
+		return err
+	}
+
+	return q, nil
+}
+
+// enqueue writes the message to the spool directory, scheduling its first
+// retry after the minimum backoff.
+func (q *queue) enqueue(out *outbound, data []byte, lastErr error) (string, error) {
+	now := time.Now()
+
+	msg := &queuedMessage{
+		outbound:    *out,
+		ID:          generateUUID(),
+		Created:     now,
+		NextAttempt: now.Add(q.minBackoff),
+		Attempts:    1,
+	}
+
+	if lastErr != nil {
+		msg.LastError = lastErr.Error()
+	}
+
+	return q.store(msg, data)
+}
+
+// schedule writes the message to the spool directory, for its first delivery
+// attempt at the given time, rather than at once.
+func (q *queue) schedule(out *outbound, data []byte, at time.Time) (string, error) {
+	msg := &queuedMessage{
+		outbound:    *out,
+		ID:          generateUUID(),
+		Created:     time.Now(),
+		NextAttempt: at,
+		Scheduled:   &at,
+	}
+
+	return q.store(msg, data)
+}
+
+// store writes the data and metadata of a new message to the spool directory
+func (q *queue) store(msg *queuedMessage, data []byte) (string, error) {
+	if msg.ID == "" {
+		return "", errors.New("could not generate message ID")
+	}
+
+	// write the data first, so the metadata file is only ever visible for
+	// complete messages
+	if err := writeFileAtomic(q.dataPath(msg.ID), data); err != nil {
+		return "", fmt.Errorf("write message data: %w", err)
+	}
+
+	if err := q.save(msg); err != nil {
+		_ = os.Remove(q.dataPath(msg.ID))
+
+		return "", err
+	}
+
+	queueMessagesGauge.Inc()
+
+	return msg.ID, nil
+}
+
+// run processes the queue periodically until the context is cancelled.
+func (q *queue) run(ctx context.Context) {
+	ticker := time.NewTicker(queueScanInterval)
+	defer ticker.Stop()
+
+	for {
+		q.processDue(ctx, time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// processDue attempts delivery of all messages whose next attempt is due.
+func (q *queue) processDue(ctx context.Context, now time.Time) {
+	q.process(ctx, now, false)
+}
+
+// flush attempts delivery of all queued messages, regardless of their next
+// attempt time, except the ones scheduled for later.
+func (q *queue) flush(ctx context.Context) error {
+	return q.process(ctx, time.Now(), true)
+}
+
+func (q *queue) process(ctx context.Context, now time.Time, all bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msgs, err := q.list()
+	if err != nil {
+		q.logger.ErrorContext(ctx, "could not list queue", slog.Any("error", err))
+		return err
+	}
+
+	observeQueue(msgs, now)
+
+	// the messages of higher priority are delivered first, the oldest first
+	// within each priority
+	slices.SortStableFunc(msgs, func(a, b *queuedMessage) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
+
+	for _, msg := range msgs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if msg.NextAttempt.After(now) && (!all || msg.pending(now)) {
+			continue
+		}
+
+		q.attempt(ctx, msg, now)
+	}
+
+	return nil
+}
+
+// reschedule makes the messages with recipients in the domain due for
+// delivery, and wakes run up to deliver them. The messages to the subdomains
+// of the domain are too if subdomains is set, but not the messages scheduled
+// for later. It returns the number of rescheduled messages.
+func (q *queue) reschedule(domain string, subdomains bool, now time.Time) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msgs, err := q.list()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+
+	for _, msg := range msgs {
+		if msg.pending(now) || !slices.ContainsFunc(msg.Recipients, func(rcpt string) bool {
+			return inDomain(rcpt, domain, subdomains)
+		}) {
+			continue
+		}
+
+		msg.NextAttempt = now
+
+		if err := q.save(msg); err != nil {
+			return n, err
+		}
+
+		n++
+	}
+
+	if n > 0 {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return n, nil
+}
+
+// inDomain reports whether the address is in the domain, or in one of its
+// subdomains if subdomains is set
+func inDomain(addr, domain string, subdomains bool) bool {
+	i := strings.LastIndex(addr, "@")
+	if i == -1 {
+		return false
+	}
+
+	d := strings.ToLower(addr[i+1:])
+
+	return d == domain || (subdomains && strings.HasSuffix(d, "."+domain))
+}
+
+// messages returns the metadata of all queued messages, oldest first. It
+// doesn't wait for the queue to be processed.
+func (q *queue) messages() ([]*queuedMessage, error) {
+	return q.list()
+}
+
+// get returns the metadata of a queued message, with the headers of its data
+func (q *queue) get(id string) (*queuedMessageDetail, error) {
+	msg, err := q.read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := q.data(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// the headers may be malformed, as they're relayed as received
+	header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+
+	return &queuedMessageDetail{queuedMessage: *msg, Headers: header}, nil
+}
+
+func (q *queue) read(id string) (*queuedMessage, error) {
+	if !queueID.MatchString(id) {
+		return nil, errNotQueued
+	}
+
+	b, err := os.ReadFile(q.metaPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotQueued
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &queuedMessage{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// data returns the data of a queued message
+func (q *queue) data(id string) ([]byte, error) {
+	if !queueID.MatchString(id) {
+		return nil, errNotQueued
+	}
+
+	data, err := os.ReadFile(q.dataPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotQueued
+	}
+
+	return data, err
+}
+
+// retry attempts the delivery of a queued message at once, even if it's
+// scheduled for later. It returns the message as left in the queue, nil if
+// it was delivered or dropped.
+func (q *queue) retry(ctx context.Context, id string) (*queuedMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msg, err := q.read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	q.attempt(ctx, msg, time.Now())
+
+	msg, err = q.read(id)
+	if errors.Is(err, errNotQueued) {
+		return nil, nil
+	}
+
+	return msg, err
+}
+
+// due makes a queued message due for delivery at now, even if it's scheduled
+// for later, without attempting it
+func (q *queue) due(id string, now time.Time) (*queuedMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msg, err := q.read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.NextAttempt = now
+
+	if err := q.save(msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// export returns all the queued messages with their data, oldest first
+func (q *queue) export() ([]*exportedMessage, error) {
+	msgs, err := q.list()
+	if err != nil {
+		return nil, err
+	}
+
+	exported := make([]*exportedMessage, 0, len(msgs))
+
+	for _, msg := range msgs {
+		data, err := q.data(msg.ID)
+		if errors.Is(err, errNotQueued) {
+			// delivered since it was listed
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		exported = append(exported, &exportedMessage{queuedMessage: *msg, Data: data})
+	}
+
+	return exported, nil
+}
+
+// importMessages queues the messages exported from another instance, with
+// new IDs, and wakes run up to deliver them. They keep their creation time,
+// attempts and schedule, so they expire as they would have. It returns the
+// IDs of the imported messages.
+func (q *queue) importMessages(msgs []*exportedMessage, now time.Time) ([]string, error) {
+	for i, msg := range msgs {
+		if msg == nil || msg.Host == "" || len(msg.Recipients) == 0 || len(msg.Data) == 0 {
+			return nil, fmt.Errorf("%w %d: host, recipients and data are required", errInvalidImport, i)
+		}
+	}
+
+	ids := make([]string, 0, len(msgs))
+
+	for _, exported := range msgs {
+		msg := exported.queuedMessage
+		msg.ID = generateUUID()
+		msg.Created = cmp.Or(msg.Created, now)
+
+		if !msg.pending(now) {
+			msg.NextAttempt = now
+		}
+
+		id, err := q.store(&msg, exported.Data)
+		if err != nil {
+			return ids, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return ids, nil
+}
+
+func (q *queue) attempt(ctx context.Context, msg *queuedMessage, now time.Time) {
+	log := q.logger.With(
+		slog.String("queue_id", msg.ID),
+		slog.String("host", msg.Host),
+		slog.String("from", msg.Sender),
+		slog.Any("to", msg.Recipients),
+		slog.Int("attempts", msg.Attempts),
+	)
+
+	data, err := os.ReadFile(q.dataPath(msg.ID))
+	if err != nil {
+		log.ErrorContext(ctx, "could not read queued message, dropping it", slog.Any("error", err))
+		q.remove(ctx, msg.ID)
+
+		return
+	}
+
+	// the outcomes of the attempt are logged to syslog and to the audit log
+	header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	attempt := &deliveryAttempt{
+		id:        msg.ID,
+		messageID: messageID(header),
+		out:       &msg.outbound,
+		size:      len(data),
+		attempt:   msg.Attempts + 1,
+		start:     time.Now(),
+		delay:     now.Sub(msg.Created),
+	}
+
+	delivered := func(rcpts []string, err error, deferred bool) {
+		a := *attempt
+		a.recipients, a.err, a.deferred = rcpts, err, deferred
+
+		q.mailLog.delivered(&a)
+		q.audit.delivered(&a)
+	}
+
+	// notify reports the delivery to the recipients the upstream accepted
+	notify := func(rcpts []string) {
+		if len(rcpts) > 0 {
+			a := *attempt
+			a.recipients = rcpts
+
+			q.notifier.delivered(ctx, &a, data)
+		}
+	}
+
+	err = q.deliver(ctx, msg, data)
+	if err == nil {
+		log.InfoContext(ctx, "queued delivery successful")
+		delivered(msg.Recipients, nil, false)
+		notify(msg.Recipients)
+		observeRecipients(outcomeDelivered, len(msg.Recipients))
+		q.remove(ctx, msg.ID)
+
+		return
+	}
+
+	// only the recipients which failed temporarily are retried, the other
+	// ones were delivered or failed permanently
+	var rcptErrs recipientErrors
+	if errors.As(err, &rcptErrs) {
+		retry, tempErr, permErr := rcptErrs.split(&msg.outbound)
+
+		if permErr != nil {
+			log.ErrorContext(ctx, "queued delivery failed permanently for some recipients", slog.Any("error", rcptErrs))
+
+			failed := []string{}
+			for _, rcpt := range msg.Recipients {
+				if err, ok := rcptErrs[rcpt]; ok && !isTemporaryErr(err) {
+					failed = append(failed, rcpt)
+				}
+			}
+
+			q.bounce(ctx, log, msg, failed, rcptErrs, data, now)
+		}
+
+		// the recipients retried are logged below
+		accepted := []string{}
+
+		for _, rcpt := range msg.Recipients {
+			rcptErr := rcptErrs[rcpt]
+			if rcptErr == nil || !isTemporaryErr(rcptErr) {
+				delivered([]string{rcpt}, rcptErr, false)
+			}
+
+			if rcptErr == nil {
+				accepted = append(accepted, rcpt)
+			}
+		}
+
+		notify(accepted)
+
+		observeRecipients(outcomeDelivered, len(msg.Recipients)-len(rcptErrs))
+
+		if retry == nil {
+			observeRecipients(outcomeFailed, len(rcptErrs))
+			q.remove(ctx, msg.ID)
+			return
+		}
+
+		observeRecipients(outcomeFailed, len(rcptErrs)-len(retry.Recipients))
+
+		msg.Recipients = retry.Recipients
+		err = tempErr
+	}
+
+	msg.Attempts++
+	msg.LastError = err.Error()
+
+	if !isTemporaryErr(err) {
+		log.ErrorContext(ctx, "queued delivery failed permanently, dropping message", slog.Any("error", err))
+		delivered(msg.Recipients, err, false)
+		q.bounce(ctx, log, msg, msg.Recipients, err, data, now)
+		observeRecipients(outcomeFailed, len(msg.Recipients))
+		q.remove(ctx, msg.ID)
+
+		return
+	}
+
+	if msg.age(now) >= q.maxAge {
+		log.ErrorContext(ctx, "queued message expired, dropping message", slog.Any("error", err))
+		delivered(msg.Recipients, fmt.Errorf("message expired: %w", err), false)
+		q.bounce(ctx, log, msg, msg.Recipients, err, data, now)
+		observeRecipients(outcomeFailed, len(msg.Recipients))
+		q.remove(ctx, msg.ID)
+
+		return
+	}
+
+	msg.NextAttempt = now.Add(q.backoff(msg.Attempts))
+	observeRecipients(outcomeDeferred, len(msg.Recipients))
+
+	log.WarnContext(ctx, "queued delivery failed, will retry",
+		slog.Any("error", err), slog.Time("next_attempt", msg.NextAttempt))
+	delivered(msg.Recipients, err, true)
+
+	if err := q.save(msg); err != nil {
+		log.ErrorContext(ctx, "could not update queued message", slog.Any("error", err))
+	}
+}
+
+// bounce queues a delivery status notification back to the sender of the
+// message, for the recipients which failed permanently
+func (q *queue) bounce(
+	ctx context.Context, log *slog.Logger, msg *queuedMessage, rcpts []string, err error, data []byte, now time.Time,
+) {
+	if q.router == nil {
+		return
+	}
+
+	failures := bounceRecipients(msg, rcpts, err)
+	if len(failures) == 0 {
+		return
+	}
+
+	out := &outbound{
+		Host:       q.router.match(msg.Sender),
+		Recipients: []string{msg.Sender},
+		SMTPUTF8:   msg.SMTPUTF8,
+		Body8Bit:   msg.Body8Bit,
+	}
+
+	id, err := q.enqueue(out, bounceMessage(q.hostName, msg, failures, data, now), nil)
+	if err != nil {
+		log.ErrorContext(ctx, "could not queue bounce", slog.Any("error", err))
+		return
+	}
+
+	log.InfoContext(ctx, "bounce queued for sender", slog.String("bounce_id", id))
+}
+
+// backoff returns the delay before the next attempt, doubling the minimum
+// backoff for each failed attempt, up to the maximum backoff
+func (q *queue) backoff(attempts int) time.Duration {
+	d := q.minBackoff
+
+	for i := 1; i < attempts && d < q.maxBackoff; i++ {
+		d *= 2
+	}
+
+	return min(d, q.maxBackoff)
+}
+
+// list returns the metadata of all queued messages, oldest first
+func (q *queue) list() ([]*queuedMessage, error) {
+	paths, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]*queuedMessage, 0, len(paths))
+
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			// removed since it was listed
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		msg := &queuedMessage{}
+		if err := json.Unmarshal(b, msg); err != nil {
+			q.logger.Error("skipping malformed queue entry", slog.String("path", p), slog.Any("error", err))
+			continue
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Created.Before(msgs[j].Created)
+	})
+
+	return msgs, nil
+}
+
+func (q *queue) save(msg *queuedMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal queue entry: %w", err)
+	}
+
+	if err := writeFileAtomic(q.metaPath(msg.ID), b); err != nil {
+		return fmt.Errorf("write queue entry: %w", err)
+	}
+
+	return nil
+}
+
+func (q *queue) remove(ctx context.Context, id string) {
+	// remove the metadata first so a partially removed message is never retried
+	for i, p := range []string{q.metaPath(id), q.dataPath(id)} {
+		err := os.Remove(p)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			q.logger.ErrorContext(ctx, "could not remove queued message", slog.String("path", p), slog.Any("error", err))
+		}
+
+		if i == 0 && err == nil {
+			queueMessagesGauge.Dec()
+		}
+	}
+}
+
+// observeQueue sets the queue gauges from the messages listed at now, the
+// count being kept up to date as messages are queued and removed until the
+// next scan
+func observeQueue(msgs []*queuedMessage, now time.Time) {
+	queueMessagesGauge.Set(float64(len(msgs)))
+
+	oldest := 0.0
+	if len(msgs) > 0 {
+		// oldest first
+		oldest = max(now.Sub(msgs[0].Created).Seconds(), 0)
+	}
+
+	queueOldestGauge.Set(oldest)
+}
+
+func (q *queue) metaPath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+func (q *queue) dataPath(id string) string {
+	return filepath.Join(q.dir, id+".eml")
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place,
+// so readers never see partially written files
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// isTemporaryErr reports whether delivery should be retried after the given
+// error. Upstream 5xx replies are permanent, anything else (4xx replies,
+// network errors) is assumed to be temporary.
+func isTemporaryErr(err error) bool {
+	var tperr *textproto.Error
+	if errors.As(err, &tperr) {
+		return tperr.Code < 500
+	}
+
+	var smtpErr *smtpd.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code < 500
+	}
+
+	return true
+}
@@ -0,0 +1,391 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testOutbound = &outbound{
+	Host:       "upstream:25",
+	Sender:     "bob@example.com",
+	Recipients: []string{"alice@example.com"},
+}
+
+func newTestQueue(t *testing.T, dir string, deliver func(context.Context, *queuedMessage, []byte) error) *queue {
+	t.Helper()
+
+	return &queue{
+		dir:        dir,
+		minBackoff: time.Minute,
+		maxBackoff: 10 * time.Minute,
+		maxAge:     time.Hour,
+		deliver:    deliver,
+		logger:     slog.Default(),
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	t.Parallel()
+
+	q := newTestQueue(t, t.TempDir(), nil)
+
+	assert.Equal(t, time.Minute, q.backoff(1))
+	assert.Equal(t, 2*time.Minute, q.backoff(2))
+	assert.Equal(t, 4*time.Minute, q.backoff(3))
+	assert.Equal(t, 8*time.Minute, q.backoff(4))
+	assert.Equal(t, 10*time.Minute, q.backoff(5))
+	assert.Equal(t, 10*time.Minute, q.backoff(100))
+}
+
+func TestQueueRetry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	deliverErr := error(&textproto.Error{Code: 421, Msg: "try again later"})
+	delivered := [][]byte{}
+
+	deliver := func(_ context.Context, msg *queuedMessage, data []byte) error {
+		assert.Equal(t, "upstream:25", msg.Host)
+		assert.Equal(t, "bob@example.com", msg.Sender)
+		assert.Equal(t, []string{"alice@example.com"}, msg.Recipients)
+
+		if deliverErr != nil {
+			return deliverErr
+		}
+
+		delivered = append(delivered, data)
+
+		return nil
+	}
+
+	q := newTestQueue(t, dir, deliver)
+
+	id, err := q.enqueue(testOutbound, []byte("hello"), errors.New("boom"))
+	require.NoError(t, err)
+
+	msgs, err := q.list()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, id, msgs[0].ID)
+	assert.Equal(t, "boom", msgs[0].LastError)
+
+	created := msgs[0].Created
+
+	// not due yet
+	q.processDue(ctx, created)
+
+	msgs, err = q.list()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, 1, msgs[0].Attempts)
+
+	// due, but still failing - next attempt is pushed back
+	now := created.Add(time.Minute)
+	q.processDue(ctx, now)
+
+	msgs, err = q.list()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, 2, msgs[0].Attempts)
+	assert.Equal(t, now.Add(2*time.Minute).UTC(), msgs[0].NextAttempt.UTC())
+	assert.Equal(t, `421 "try again later"`, msgs[0].LastError)
+
+	// a new queue on the same directory (i.e. after a restart) picks it up
+	deliverErr = nil
+	q = newTestQueue(t, dir, deliver)
+	q.processDue(ctx, now.Add(2*time.Minute))
+
+	assert.Equal(t, [][]byte{[]byte("hello")}, delivered)
+
+	msgs, err = q.list()
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestQueueDrop(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("permanent failure", func(t *testing.T) {
+		t.Parallel()
+
+		q := newTestQueue(t, t.TempDir(), func(context.Context, *queuedMessage, []byte) error {
+			return &textproto.Error{Code: 550, Msg: "no such user"}
+		})
+
+		_, err := q.enqueue(testOutbound, []byte("hello"), nil)
+		require.NoError(t, err)
+
+		q.processDue(ctx, time.Now().Add(time.Minute))
+
+		msgs, err := q.list()
+		require.NoError(t, err)
+		assert.Empty(t, msgs)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		t.Parallel()
+
+		q := newTestQueue(t, t.TempDir(), func(context.Context, *queuedMessage, []byte) error {
+			return errors.New("connection refused")
+		})
+
+		_, err := q.enqueue(testOutbound, []byte("hello"), nil)
+		require.NoError(t, err)
+
+		q.processDue(ctx, time.Now().Add(30*time.Minute))
+
+		msgs, err := q.list()
+		require.NoError(t, err)
+		assert.Len(t, msgs, 1)
+
+		q.processDue(ctx, time.Now().Add(2*time.Hour))
+
+		msgs, err = q.list()
+		require.NoError(t, err)
+		assert.Empty(t, msgs)
+	})
+}
+
+func TestQueueBounce(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	data := []byte("From: bob@example.com\r\nSubject: test\r\n\r\nhello\r\n")
+
+	router, err := parseRoutes("upstream:25 *@example.com=internal:25", false)
+	require.NoError(t, err)
+
+	t.Run("permanent failure", func(t *testing.T) {
+		t.Parallel()
+
+		q := newTestQueue(t, t.TempDir(), func(_ context.Context, msg *queuedMessage, _ []byte) error {
+			if msg.Sender == "" {
+				return &textproto.Error{Code: 451, Msg: "try again later"}
+			}
+
+			return &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}
+		})
+		q.router, q.hostName = router, "relay.example.com"
+
+		_, err := q.enqueue(testOutbound, data, nil)
+		require.NoError(t, err)
+
+		q.processDue(ctx, time.Now().Add(time.Minute))
+
+		msgs, err := q.list()
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		assert.Equal(t, "internal:25", msgs[0].Host)
+		assert.Empty(t, msgs[0].Sender)
+		assert.Equal(t, []string{"bob@example.com"}, msgs[0].Recipients)
+
+		bounce, err := os.ReadFile(q.dataPath(msgs[0].ID))
+		require.NoError(t, err)
+		assert.Contains(t, string(bounce), "Final-Recipient: rfc822; alice@example.com\r\n")
+		assert.Contains(t, string(bounce), "Status: 5.1.1\r\n")
+		assert.Contains(t, string(bounce), "Subject: test\r\n")
+		assert.NotContains(t, string(bounce), "hello")
+
+		// bounces failing permanently aren't bounced
+		q.deliver = func(context.Context, *queuedMessage, []byte) error {
+			return &textproto.Error{Code: 550, Msg: "no such user"}
+		}
+		q.processDue(ctx, time.Now().Add(time.Minute))
+
+		msgs, err = q.list()
+		require.NoError(t, err)
+		assert.Empty(t, msgs)
+	})
+
+	t.Run("some recipients failed", func(t *testing.T) {
+		t.Parallel()
+
+		q := newTestQueue(t, t.TempDir(), func(_ context.Context, msg *queuedMessage, _ []byte) error {
+			if msg.Sender == "" {
+				return &textproto.Error{Code: 451, Msg: "try again later"}
+			}
+
+			return recipientErrors{
+				"carol@example.org": &textproto.Error{Code: 550, Msg: "no such user"},
+				"dave@example.org":  &textproto.Error{Code: 550, Msg: "no such user"},
+			}
+		})
+		q.router, q.hostName = router, "relay.example.com"
+
+		out := *testOutbound
+		out.Recipients = []string{"alice@example.com", "carol@example.org", "dave@example.org"}
+		out.DSN = map[string]smtpd.RecipientDSN{"dave@example.org": {Notify: "NEVER"}}
+
+		_, err := q.enqueue(&out, data, nil)
+		require.NoError(t, err)
+
+		q.processDue(ctx, time.Now().Add(time.Minute))
+
+		msgs, err := q.list()
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+
+		bounce, err := os.ReadFile(q.dataPath(msgs[0].ID))
+		require.NoError(t, err)
+		assert.Contains(t, string(bounce), "Final-Recipient: rfc822; carol@example.org\r\n")
+		assert.NotContains(t, string(bounce), "alice@example.com")
+		assert.NotContains(t, string(bounce), "dave@example.org")
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		t.Parallel()
+
+		q := newTestQueue(t, t.TempDir(), func(context.Context, *queuedMessage, []byte) error {
+			return errors.New("connection refused")
+		})
+		q.router, q.hostName = router, "relay.example.com"
+
+		_, err := q.enqueue(testOutbound, data, nil)
+		require.NoError(t, err)
+
+		q.processDue(ctx, time.Now().Add(2*time.Hour))
+
+		msgs, err := q.list()
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+
+		bounce, err := os.ReadFile(q.dataPath(msgs[0].ID))
+		require.NoError(t, err)
+		assert.Contains(t, string(bounce), "Status: 4.4.7\r\n")
+	})
+}
+
+func TestQueueReschedule(t *testing.T) {
+	t.Parallel()
+
+	q := newTestQueue(t, t.TempDir(), nil)
+
+	for _, rcpt := range []string{"alice@example.com", "bob@mail.example.com", "carol@example.org"} {
+		out := *testOutbound
+		out.Recipients = []string{rcpt}
+
+		_, err := q.enqueue(&out, []byte("hello"), errors.New("boom"))
+		require.NoError(t, err)
+	}
+
+	now := time.Now().Add(time.Second)
+
+	due := func() []string {
+		t.Helper()
+
+		msgs, err := q.list()
+		require.NoError(t, err)
+
+		rcpts := []string{}
+		for _, msg := range msgs {
+			if !msg.NextAttempt.After(now) {
+				rcpts = append(rcpts, msg.Recipients...)
+			}
+		}
+
+		return rcpts
+	}
+
+	n, err := q.reschedule("example.net", true, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Empty(t, due())
+
+	n, err = q.reschedule("example.com", false, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.ElementsMatch(t, []string{"alice@example.com"}, due())
+
+	n, err = q.reschedule("example.com", true, now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.ElementsMatch(t, []string{"alice@example.com", "bob@mail.example.com"}, due())
+}
+
+func TestQueueSchedule(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	deliverErr := error(&textproto.Error{Code: 421, Msg: "try again later"})
+	attempts := 0
+
+	q := newTestQueue(t, t.TempDir(), func(context.Context, *queuedMessage, []byte) error {
+		attempts++
+		return deliverErr
+	})
+
+	now := time.Now()
+	at := now.Add(2 * time.Hour)
+
+	_, err := q.schedule(testOutbound, []byte("hello"), at)
+	require.NoError(t, err)
+
+	// the message isn't delivered before its time, even when flushed
+	q.processDue(ctx, now)
+	require.NoError(t, q.flush(ctx))
+
+	n, err := q.reschedule("example.com", false, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 0, attempts)
+
+	// it's retried, and expires max age after its time rather than after
+	// it was queued
+	q.processDue(ctx, at)
+	assert.Equal(t, 1, attempts)
+
+	msgs, err := q.list()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, 1, msgs[0].Attempts)
+	assert.WithinDuration(t, at, *msgs[0].Scheduled, 0)
+
+	q.processDue(ctx, at.Add(time.Hour))
+	assert.Equal(t, 2, attempts)
+
+	msgs, err = q.list()
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+}
+
+func TestQueuePriority(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	delivered := []string{}
+
+	q := newTestQueue(t, t.TempDir(), func(_ context.Context, msg *queuedMessage, _ []byte) error {
+		delivered = append(delivered, msg.Recipients...)
+		return nil
+	})
+
+	for rcpt, priority := range map[string]int{"bulk@example.com": -5, "normal@example.com": 0, "urgent@example.com": 9} {
+		out := *testOutbound
+		out.Recipients = []string{rcpt}
+		out.Priority = priority
+
+		_, err := q.enqueue(&out, []byte("hello"), errors.New("boom"))
+		require.NoError(t, err)
+	}
+
+	q.processDue(ctx, time.Now().Add(time.Hour))
+
+	assert.Equal(t, []string{"urgent@example.com", "normal@example.com", "bulk@example.com"}, delivered)
+}
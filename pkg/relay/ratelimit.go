@@ -0,0 +1,451 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/redis/go-redis/v9"
+)
+
+// rate limit keys
+const (
+	rateKeyIP     = "ip"
+	rateKeyUser   = "user"
+	rateKeyDomain = "domain"
+)
+
+// rate limit names, used as metric labels
+const (
+	rateLimitMessages   = "messages"
+	rateLimitRecipients = "recipients"
+)
+
+// prefix of the keys of the buckets kept in Redis
+const rateRedisPrefix = "smtprelay:ratelimit:"
+
+// rateLimitScript is take and exhausted with the buckets kept in Redis as
+// hashes, so that they're checked and updated atomically. KEYS are the
+// buckets, and ARGV the number of tokens, the current time and period in
+// milliseconds, "1" to only check the buckets, then the limit of each bucket.
+// It returns the index of the first bucket without enough tokens, starting
+// from 1, or 0.
+const rateLimitScript = `
+local n, now, period = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local tokens = {}
+for i, key in ipairs(KEYS) do
+	local limit = tonumber(ARGV[4 + i])
+	local b = redis.call("HMGET", key, "tokens", "last")
+	local t = limit
+	if b[1] and b[2] then
+		t = math.min(limit, tonumber(b[1]) + limit * math.max(now - tonumber(b[2]), 0) / period)
+	end
+	if t < n then
+		return i
+	end
+	tokens[i] = t
+end
+if ARGV[4] ~= "1" then
+	for i, key in ipairs(KEYS) do
+		redis.call("HSET", key, "tokens", tostring(tokens[i] - n), "last", ARGV[2])
+		redis.call("PEXPIRE", key, period)
+	end
+end
+return 0
+`
+
+// throttler enforces the rate limits on messages (per minute) and recipients
+// (per hour) of each client IP, authenticated user and sender domain. The
+// buckets are kept in Redis if it's configured, so that the limits apply to
+// all the relay instances together.
+type throttler struct {
+	messages   *rateLimiter // nil if messages aren't limited
+	recipients *rateLimiter // nil if recipients aren't limited
+
+	// userLimits returns the message and recipient limits of an
+	// authenticated user, overriding the user ones, or 0 for the defaults -
+	// nil if users have no limits of their own
+	userLimits func(ctx context.Context, username string) (messages, recipients int)
+
+	// now overrides the current time - for tests
+	now func() time.Time
+
+	logger *slog.Logger
+}
+
+// newThrottler returns a throttler for the message and recipient limits
+// configs, and the limits of each user if userLimits isn't nil, keeping the
+// buckets in Redis if rdb isn't nil. It returns nil if there are no limits
+// at all.
+func newThrottler(messageLimits, recipientLimits string,
+	userLimits func(ctx context.Context, username string) (messages, recipients int),
+	rdb *redis.Client,
+) (*throttler, error) {
+	messages, err := parseRateLimits(messageLimits, time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate_limit_messages: %w", err)
+	}
+
+	recipients, err := parseRateLimits(recipientLimits, time.Hour)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate_limit_recipients: %w", err)
+	}
+
+	if userLimits != nil {
+		// the users may have limits even if the config sets none
+		if messages == nil {
+			messages = newRateLimiter(time.Minute, map[string]float64{})
+		}
+
+		if recipients == nil {
+			recipients = newRateLimiter(time.Hour, map[string]float64{})
+		}
+	}
+
+	if messages == nil && recipients == nil {
+		return nil, nil
+	}
+
+	if messages != nil {
+		messages.redis, messages.name = rdb, rateLimitMessages
+	}
+
+	if recipients != nil {
+		recipients.redis, recipients.name = rdb, rateLimitRecipients
+	}
+
+	return &throttler{
+		messages:   messages,
+		recipients: recipients,
+		userLimits: userLimits,
+		now:        time.Now,
+		logger:     slog.Default().With(slog.String("component", "rate_limit")),
+	}, nil
+}
+
+// checkConnection rejects the connection if the peer's IP address has
+// already exhausted its message rate
+func (t *throttler) checkConnection(ctx context.Context, peer smtpd.Peer) error {
+	if t.messages == nil {
+		return nil
+	}
+
+	ip := peerIP(peer).String()
+	if !t.messages.exhausted(ctx, rateKeyIP, ip, t.now()) {
+		return nil
+	}
+
+	t.throttled(ctx, rateLimitMessages, rateKeyIP, slog.String("ip", ip))
+
+	return observeErr(ctx, smtpd.ErrRateLimited)
+}
+
+// checkMessage counts a new message from the peer and sender against the
+// message rate limits
+func (t *throttler) checkMessage(ctx context.Context, peer smtpd.Peer, sender string) error {
+	if t.messages == nil {
+		return nil
+	}
+
+	key, ok := t.messages.take(ctx, rateValues(peer, sender), t.overrides(ctx, peer, false), 1, t.now())
+	if ok {
+		return nil
+	}
+
+	t.throttled(ctx, rateLimitMessages, key, slog.String("sender_address", sender))
+
+	return observeErr(ctx, smtpd.ErrMessageRateLimited)
+}
+
+// checkRecipients counts recipients of a message from the peer and sender
+// against the recipient rate limits, as they're accepted at RCPT TO
+func (t *throttler) checkRecipients(ctx context.Context, peer smtpd.Peer, sender string, recipients int) error {
+	if t.recipients == nil {
+		return nil
+	}
+
+	overrides := t.overrides(ctx, peer, true)
+
+	key, ok := t.recipients.take(ctx, rateValues(peer, sender), overrides, recipients, t.now())
+	if ok {
+		return nil
+	}
+
+	t.throttled(ctx, rateLimitRecipients, key,
+		slog.String("sender_address", sender), slog.Int("recipients", recipients))
+
+	return observeErr(ctx, smtpd.ErrRecipientRateLimited)
+}
+
+// overrides returns the limits of the peer's authenticated user overriding
+// the configured ones, either of messages or recipients - nil if it has none
+func (t *throttler) overrides(ctx context.Context, peer smtpd.Peer, recipients bool) map[string]float64 {
+	if t.userLimits == nil || peer.Username == "" {
+		return nil
+	}
+
+	limit, rcptLimit := t.userLimits(ctx, peer.Username)
+	if recipients {
+		limit = rcptLimit
+	}
+
+	if limit <= 0 {
+		return nil
+	}
+
+	return map[string]float64{rateKeyUser: float64(limit)}
+}
+
+func (t *throttler) throttled(ctx context.Context, limit, key string, attrs ...any) {
+	throttledCounter.WithLabelValues(limit, key).Inc()
+
+	t.logger.With(attrs...).WarnContext(ctx, "rate limit exceeded",
+		slog.String("limit", limit), slog.String("key", key))
+}
+
+// rateValues returns the rate limit key/value pairs for the peer and sender
+func rateValues(peer smtpd.Peer, sender string) map[string]string {
+	values := map[string]string{
+		rateKeyUser: peer.Username,
+	}
+
+	if ip := peerIP(peer); ip != nil {
+		values[rateKeyIP] = ip.String()
+	}
+
+	if idx := strings.LastIndex(sender, "@"); idx != -1 {
+		values[rateKeyDomain] = sender[idx+1:]
+	}
+
+	return values
+}
+
+// bucket is a token bucket, refilled continuously up to the limit of its key
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a set of token buckets, one per client IP, authenticated
+// user or sender domain, each allowing up to a configured number of events
+// per period
+type rateLimiter struct {
+	period time.Duration
+	limits map[string]float64 // max events per period, by key
+
+	name  string        // name of the limit, prefixing its buckets in Redis
+	redis *redis.Client // nil to keep the buckets in memory
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket // by key and value
+	lastSweep time.Time
+}
+
+// parseRateLimits parses the limits config into a rate limiter. It should be
+// in the form "ip=60 user=120 domain=300" (key=limit pairs, separated by
+// spaces), where the limit is the max number of events per period. It returns
+// nil if no limit is set.
+func parseRateLimits(s string, period time.Duration) (*rateLimiter, error) {
+	limits := map[string]float64{}
+
+	for _, entry := range splitstr(s, ' ') {
+		key, val, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q, expected key=limit", entry)
+		}
+
+		if key != rateKeyIP && key != rateKeyUser && key != rateKeyDomain {
+			return nil, fmt.Errorf("unknown rate limit key %q", key)
+		}
+
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid rate limit %q, expected a positive number", entry)
+		}
+
+		limits[key] = float64(limit)
+	}
+
+	if len(limits) == 0 {
+		return nil, nil
+	}
+
+	return newRateLimiter(period, limits), nil
+}
+
+// newRateLimiter returns a rate limiter allowing the given max number of
+// events per period, by key
+func newRateLimiter(period time.Duration, limits map[string]float64) *rateLimiter {
+	return &rateLimiter{
+		period:  period,
+		limits:  limits,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// take removes n tokens from the buckets of each of the given key/value
+// pairs, either from all of them or none. The limits in overrides replace the
+// configured ones of their keys. Keys without a limit, or with an empty value
+// (e.g. no authenticated user) are ignored. If any bucket doesn't have enough
+// tokens, it returns the key of the first of them and false.
+func (l *rateLimiter) take(ctx context.Context, values map[string]string, overrides map[string]float64, n int, now time.Time) (string, bool) {
+	keys := make([]string, 0, len(values))
+
+	for key := range values {
+		limit, ok := overrides[key]
+		if !ok {
+			limit, ok = l.limits[key]
+		}
+
+		if ok && values[key] != "" && limit > 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	// check the keys in a stable order, so the reported key is deterministic
+	slices.Sort(keys)
+
+	limits := make([]float64, len(keys))
+	for i, key := range keys {
+		if limit, ok := overrides[key]; ok {
+			limits[i] = limit
+		} else {
+			limits[i] = l.limits[key]
+		}
+	}
+
+	if l.redis != nil {
+		return l.takeShared(ctx, keys, values, limits, n, now, false)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	buckets := make([]*bucket, 0, len(keys))
+
+	for i, key := range keys {
+		b := l.bucket(key, values[key], limits[i], now)
+		if b.tokens < float64(n) {
+			return key, false
+		}
+
+		buckets = append(buckets, b)
+	}
+
+	for _, b := range buckets {
+		b.tokens -= float64(n)
+	}
+
+	return "", true
+}
+
+// exhausted reports whether the bucket for the key and value is empty
+func (l *rateLimiter) exhausted(ctx context.Context, key, value string, now time.Time) bool {
+	limit, ok := l.limits[key]
+	if !ok || value == "" {
+		return false
+	}
+
+	if l.redis != nil {
+		_, ok := l.takeShared(ctx, []string{key}, map[string]string{key: value}, []float64{limit}, 1, now, true)
+		return !ok
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.bucket(key, value, limit, now).tokens < 1
+}
+
+// takeShared is take with the buckets kept in Redis, with the keys having a
+// limit and their limits, only checking the buckets if dryRun is set. The
+// tokens are taken if Redis fails, rather than rejecting all the clients.
+func (l *rateLimiter) takeShared(ctx context.Context, keys []string, values map[string]string, limits []float64, n int, now time.Time, dryRun bool) (string, bool) {
+	if len(keys) == 0 {
+		return "", true
+	}
+
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, rateRedisPrefix+l.name+":"+bucketID(key, values[key]))
+	}
+
+	dry := "0"
+	if dryRun {
+		dry = "1"
+	}
+
+	args := []any{n, now.UnixMilli(), l.period.Milliseconds(), dry}
+	for _, limit := range limits {
+		args = append(args, strconv.FormatFloat(limit, 'f', -1, 64))
+	}
+
+	reply, err := l.redis.Eval(ctx, rateLimitScript, ids, args...).Result()
+
+	idx, ok := reply.(int64)
+	if err != nil || !ok || idx < 0 || idx > int64(len(keys)) {
+		slog.WarnContext(ctx, "shared rate limit check failed",
+			slog.String("component", "rate_limit"),
+			slog.String("limit", l.name),
+			slog.Any("reply", reply),
+			slog.Any("error", err),
+		)
+
+		return "", true
+	}
+
+	if idx > 0 {
+		return keys[idx-1], false
+	}
+
+	return "", true
+}
+
+// bucket returns the bucket for the key and value refilled up to the limit,
+// creating it if needed. l.mu must be held.
+func (l *rateLimiter) bucket(key, value string, limit float64, now time.Time) *bucket {
+	id := bucketID(key, value)
+
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &bucket{tokens: limit, last: now}
+		l.buckets[id] = b
+	}
+
+	elapsed := now.Sub(b.last)
+	if elapsed > 0 {
+		b.tokens = min(limit, b.tokens+limit*elapsed.Seconds()/l.period.Seconds())
+		b.last = now
+	}
+
+	return b
+}
+
+// bucketID returns the ID of the bucket for the key and value
+func bucketID(key, value string) string {
+	return key + ":" + strings.ToLower(value)
+}
+
+// sweep removes the buckets which would be full by now, at most once per
+// period. l.mu must be held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.period {
+		return
+	}
+
+	for id, b := range l.buckets {
+		if now.Sub(b.last) >= l.period {
+			delete(l.buckets, id)
+		}
+	}
+
+	l.lastSweep = now
+}
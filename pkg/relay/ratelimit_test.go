@@ -0,0 +1,161 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	t.Parallel()
+
+	l, err := parseRateLimits("", time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, l)
+
+	l, err = parseRateLimits("ip=10  domain=100", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{rateKeyIP: 10, rateKeyDomain: 100}, l.limits)
+
+	for _, s := range []string{"ip", "ip=0", "ip=-1", "ip=x", "host=10"} {
+		_, err := parseRateLimits(s, time.Minute)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	l, err := parseRateLimits("ip=2 domain=3", time.Minute)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	now := time.Now()
+	values := map[string]string{rateKeyIP: "192.0.2.1", rateKeyUser: "bob", rateKeyDomain: "example.com"}
+
+	for range 2 {
+		_, ok := l.take(ctx, values, nil, 1, now)
+		assert.True(t, ok)
+	}
+
+	key, ok := l.take(ctx, values, nil, 1, now)
+	assert.False(t, ok)
+	assert.Equal(t, rateKeyIP, key)
+	assert.True(t, l.exhausted(ctx, rateKeyIP, "192.0.2.1", now))
+
+	// the domain bucket isn't consumed when another one is exhausted
+	key, ok = l.take(ctx, map[string]string{rateKeyIP: "192.0.2.2", rateKeyDomain: "EXAMPLE.com"}, nil, 2, now)
+	assert.False(t, ok)
+	assert.Equal(t, rateKeyDomain, key)
+
+	_, ok = l.take(ctx, map[string]string{rateKeyDomain: "example.com"}, nil, 1, now)
+	assert.True(t, ok)
+
+	// half the period refills half the limit
+	now = now.Add(30 * time.Second)
+	assert.False(t, l.exhausted(ctx, rateKeyIP, "192.0.2.1", now))
+
+	_, ok = l.take(ctx, values, nil, 1, now)
+	assert.True(t, ok)
+
+	_, ok = l.take(ctx, values, nil, 1, now)
+	assert.False(t, ok)
+
+	// full buckets are swept after a period
+	now = now.Add(2 * time.Minute)
+	_, ok = l.take(ctx, map[string]string{rateKeyIP: "192.0.2.3"}, nil, 1, now)
+	assert.True(t, ok)
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestThrottler(t *testing.T) {
+	t.Parallel()
+
+	thr, err := newThrottler("", "", nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, thr)
+
+	_, err = newThrottler("ip=x", "", nil, nil)
+	require.Error(t, err)
+
+	thr, err = newThrottler("user=1", "ip=3", nil, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	thr.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	peer := smtpd.Peer{
+		Username: "bob",
+		Addr:     &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345},
+	}
+
+	// messages aren't limited by IP
+	require.NoError(t, thr.checkConnection(ctx, peer))
+
+	require.NoError(t, thr.checkMessage(ctx, peer, "bob@example.com"))
+	assert.Equal(t, smtpd.ErrMessageRateLimited, thr.checkMessage(ctx, peer, "bob@example.com"))
+
+	// unauthenticated peers aren't limited by user
+	require.NoError(t, thr.checkMessage(ctx, smtpd.Peer{Addr: peer.Addr}, "bob@example.com"))
+
+	require.NoError(t, thr.checkRecipients(ctx, peer, "bob@example.com", 2))
+	assert.Equal(t, smtpd.ErrRecipientRateLimited, thr.checkRecipients(ctx, peer, "bob@example.com", 2))
+	require.NoError(t, thr.checkRecipients(ctx, peer, "bob@example.com", 1))
+
+	thr, err = newThrottler("ip=1", "", nil, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, thr.checkConnection(ctx, peer))
+	require.NoError(t, thr.checkMessage(ctx, peer, "bob@example.com"))
+	assert.Equal(t, smtpd.ErrRateLimited, thr.checkConnection(ctx, peer))
+}
+
+func TestThrottlerUserLimits(t *testing.T) {
+	t.Parallel()
+
+	userLimits := func(_ context.Context, username string) (int, int) {
+		if username == "alice" {
+			return 2, 5
+		}
+
+		return 0, 0
+	}
+
+	// users have limits even if the config sets none
+	thr, err := newThrottler("", "", userLimits, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	thr.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	alice := smtpd.Peer{Username: "alice"}
+	bob := smtpd.Peer{Username: "bob"}
+
+	require.NoError(t, thr.checkMessage(ctx, alice, "alice@example.com"))
+	require.NoError(t, thr.checkMessage(ctx, alice, "alice@example.com"))
+	assert.Equal(t, smtpd.ErrMessageRateLimited, thr.checkMessage(ctx, alice, "alice@example.com"))
+
+	require.NoError(t, thr.checkRecipients(ctx, alice, "alice@example.com", 5))
+	assert.Equal(t, smtpd.ErrRecipientRateLimited, thr.checkRecipients(ctx, alice, "alice@example.com", 1))
+
+	for range 3 {
+		require.NoError(t, thr.checkMessage(ctx, bob, "bob@example.com"))
+	}
+
+	// and their limits override the configured user ones
+	thr, err = newThrottler("user=1", "", userLimits, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, thr.checkMessage(ctx, alice, "alice@example.com"))
+	require.NoError(t, thr.checkMessage(ctx, alice, "alice@example.com"))
+
+	require.NoError(t, thr.checkMessage(ctx, bob, "bob@example.com"))
+	assert.Equal(t, smtpd.ErrMessageRateLimited, thr.checkMessage(ctx, bob, "bob@example.com"))
+}
@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// max idle Redis connections kept open between commands
+const redisPoolSize = 8
+
+// newRedisClient returns the client of the Redis server holding the state
+// shared by several relay instances, nil if rawURL is empty. The URL is
+// either redis://[[user]:password@]host[:port][/db] or rediss:// for TLS.
+//
+// Commands aren't retried: the scripts and SETs sent aren't idempotent, so a
+// command whose reply was lost can't be sent again.
+func newRedisClient(rawURL string, timeout time.Duration) (*redis.Client, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// ParseURL also takes unix:// URLs and options in the query
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unknown scheme %q", u.Scheme)
+	}
+
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.DB < 0 {
+		return nil, fmt.Errorf("invalid database %d", opts.DB)
+	}
+
+	opts.Protocol = 2
+	opts.DisableIdentity = true
+	opts.MaxRetries = -1
+	opts.DialerRetries = 1
+	opts.MaxIdleConns = redisPoolSize
+
+	if timeout > 0 {
+		opts.DialTimeout = timeout
+		opts.ReadTimeout = timeout
+		opts.WriteTimeout = timeout
+		opts.ContextTimeoutEnabled = true
+	}
+
+	return redis.NewClient(opts), nil
+}
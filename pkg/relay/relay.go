@@ -0,0 +1,1240 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/evidentiq/smtprelay/v2/internal/traceutil"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// relay is an SMTP relay server which can listen on a single address
+type relay struct {
+	server   *smtpd.Server
+	router   *router
+	spf      *spfChecker    // nil if SPF checks are disabled
+	dkim     *dkimVerifier  // nil if DKIM verification is disabled
+	dmarc    *dmarcChecker  // nil if DMARC checks are disabled
+	fcrdns   *fcrdnsChecker // nil if FCrDNS checks are disabled
+	certs    *certStore     // nil for plain TCP listeners, and with ACME
+	listener listenerConfig
+	stages   []mailStage // middlewares of the mail handler, in order
+
+	conf   *configStore
+	shared *relayShared
+}
+
+// relayShared holds the state shared by the relays of all listeners
+type relayShared struct {
+	queue     *queue          // nil if queueing is disabled
+	limits    *throttler      // nil if rate limiting is disabled
+	dedup     *deduplicator   // nil unless dedup_window is set
+	dnsbl     *dnsblChecker   // nil unless DNS blocklists are configured
+	callout   *calloutChecker // nil if recipient callouts are disabled
+	upstreams *upstreamPool   // nil if connection pooling is disabled
+	acme      *acmeManager    // nil unless certificates are obtained with ACME
+
+	// authLimiter counts the failed AUTH attempts on all listeners, nil
+	// unless auth_max_failures is set
+	authLimiter *smtpd.AuthLimiter
+
+	// notifier notifies the deliveries accepted by the upstreams, nil not to
+	notifier *handoffNotifier
+
+	// replies remembers the senders replied to by auto_reply
+	replies replyTracker
+
+	// paused is set while new mail isn't accepted
+	paused atomic.Bool
+}
+
+func newRelay(conf *configStore, lc listenerConfig, shared *relayShared) (*relay, error) {
+	cfg := conf.get()
+
+	router, err := parseRoutes(cfg.remoteHost, cfg.delivery == deliveryMX)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse remote_host %q: %w", cfg.remoteHost, err)
+	}
+
+	r := &relay{
+		router:   router,
+		listener: lc,
+		conf:     conf,
+		shared:   shared,
+	}
+
+	if cfg.spfPolicy != "" {
+		r.spf, err = newSPFChecker(cfg.spfPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spf_policy: %w", err)
+		}
+	}
+
+	if cfg.fcrdnsMode != "" {
+		r.fcrdns, err = newFCrDNSChecker(cfg.fcrdnsMode)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fcrdns_mode: %w", err)
+		}
+	}
+
+	if cfg.dkimVerify || cfg.dmarcMode != "" {
+		r.dkim = newDKIMVerifier()
+	}
+
+	if cfg.dmarcMode != "" {
+		// DMARC needs the SPF results, even if SPF checks aren't enforced
+		if r.spf == nil {
+			r.spf, _ = newSPFChecker(spfPolicyLogOnly)
+		}
+
+		r.dmarc, err = newDMARCChecker(cfg.dmarcMode, r.spf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dmarc_mode: %w", err)
+		}
+	}
+
+	r.stages = r.defaultStages()
+
+	r.server = &smtpd.Server{
+		HeloChecker:       r.heloChecker,
+		ConnectionChecker: r.checkConnection,
+		SenderChecker:     r.checkSender,
+		RecipientChecker:  r.checkRecipient,
+		ConnContext:       r.connContext,
+		VerifyHandler:     r.verifyAddress,
+		ExpandHandler:     r.expandList,
+		Handler:           r.mailHandler(),
+
+		Hostname:       cfg.hostName,
+		WelcomeMessage: cfg.welcomeMsg,
+		MaxMessageSize: cfg.maxMessageSize,
+		StreamData:     cfg.streamData,
+		DataMode:       cfg.dataMode,
+		MaxConnections: cfg.maxConnections,
+		MaxRecipients:  cfg.maxRecipients,
+		ReadTimeout:    cfg.readTimeout,
+		WriteTimeout:   cfg.writeTimeout,
+		DataTimeout:    cfg.dataTimeout,
+		LMTP:           lc.scheme == schemeLMTP,
+
+		MaxSessionDuration: cfg.maxSessionTime,
+		MaxCommands:        cfg.maxCommands,
+		MaxErrors:          cfg.maxErrors,
+		TarpitAfter:        cfg.tarpitAfter,
+		TarpitDelay:        cfg.tarpitDelay,
+		TarpitMaxDelay:     cfg.tarpitMaxDelay,
+		OnLimit:            r.sessionLimitReached,
+
+		GreetDelay:         cfg.greetDelay,
+		EarlyTalkerChecker: r.checkEarlyTalker,
+
+		EnableProxyProtocol: lc.proxy,
+		EnableMTPriority:    cfg.mtPriority,
+		TrustedProxies:      cfg.trustedProxies,
+	}
+
+	if cfg.transcripts != nil {
+		r.server.Transcript = cfg.transcripts.open
+	}
+
+	if lc.auth {
+		if cfg.allowedUsers != "" {
+			err := AuthLoadFile(cfg.allowedUsers)
+			if err != nil {
+				return nil, fmt.Errorf("cannot load allowed users file %q: %w", cfg.allowedUsers, err)
+			}
+		}
+
+		r.server.Authenticator = r.authChecker
+		r.server.AllowInsecureAuth = lc.insecureAuth
+		r.server.AuthLimiter = shared.authLimiter
+	}
+
+	if cfg.etrnDomains != "" && shared.queue != nil {
+		r.server.RegisterCommand("ETRN", r.handleETRN)
+		r.server.Extensions = append(r.server.Extensions, "ETRN")
+	}
+
+	conf.notify(r.reloadCerts)
+
+	return r, nil
+}
+
+// config returns the config of the session of ctx, as it was when the session
+// started, or the current one outside of sessions
+func (r *relay) config(ctx context.Context) *config {
+	if cfg, ok := ctx.Value(configContextKey{}).(*config); ok {
+		return cfg
+	}
+
+	return r.conf.get()
+}
+
+// connContext has the session of the connection use the current config until
+// it ends
+func (r *relay) connContext(ctx context.Context, _ net.Conn) context.Context {
+	return withConfig(ctx, r.conf.get())
+}
+
+// reloadCerts loads the TLS certificate of the new config, and returns the
+// function having the new TLS sessions use it
+func (r *relay) reloadCerts(cfg *config) (func(), error) {
+	if r.certs == nil {
+		return nil, nil
+	}
+
+	apply, err := r.certs.prepare(cfg.localCert, cfg.localKey)
+	if err != nil {
+		return nil, fmt.Errorf("error reloading TLS certificate for %q: %w", r.listener.address, err)
+	}
+
+	return apply, nil
+}
+
+func (r *relay) serve(ctx context.Context, ln net.Listener) error {
+	if interval := r.config(ctx).localCertWatch; r.certs != nil && interval > 0 {
+		go r.certs.watch(ctx, interval)
+	}
+
+	ln = &sessionsListener{Listener: ln, gauge: sessionsGauge.WithLabelValues(r.listener.String())}
+
+	return r.server.Serve(ctx, ln)
+}
+
+// shutdown stops accepting connections, and waits for the active sessions to
+// finish until ctx is done. The sessions left then are closed, and
+// ErrShutdownTimeout is returned.
+func (r *relay) shutdown(ctx context.Context) error {
+	// shutdown without a wait - we'll wait asynchronously after
+	err := r.server.Shutdown(false)
+	if err != nil {
+		slog.WarnContext(ctx, "error closing listener",
+			slog.String("address", r.listener.String()),
+			slog.Any("error", err))
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		_ = r.server.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	sessions := len(r.server.Sessions())
+
+	_ = r.server.Close()
+
+	if sessions == 0 {
+		return nil
+	}
+
+	slog.WarnContext(ctx, "shutdown grace period expired, closed sessions",
+		slog.String("address", r.listener.String()),
+		slog.Int("sessions", sessions))
+
+	return ErrShutdownTimeout
+}
+
+func (r *relay) listen() (net.Listener, error) {
+	if r.listener.tls() {
+		cfg := r.conf.get()
+
+		if r.shared.acme != nil {
+			r.server.TLSConfig = r.shared.acme.tlsConfig()
+		} else {
+			r.certs = &certStore{}
+			if err := r.certs.load(cfg.localCert, cfg.localKey); err != nil {
+				return nil, fmt.Errorf("error getting Server TLS config: %w", err)
+			}
+
+			r.server.TLSConfig = getServerTLSConfig(r.certs)
+		}
+
+		cfg.localTLS.apply(r.server.TLSConfig)
+
+		r.server.ForceTLS = r.listener.forceTLS
+
+		// client certificates are an alternative to AUTH
+		if cfg.clientCAs != nil && r.listener.auth {
+			r.server.TLSConfig.ClientCAs = cfg.clientCAs
+			r.server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			r.server.CertAuthenticator = r.certChecker
+		}
+	}
+
+	ln, err := net.Listen("tcp", r.listener.address)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on address %q: %w", r.listener.address, err)
+	}
+
+	if r.listener.scheme == schemeSMTPS {
+		ln = tls.NewListener(ln, r.server.TLSConfig)
+	}
+
+	return ln, nil
+}
+
+// authChecker checks the password of users of allowed_users, then of the
+// SQL database if sql_dsn is set, then with the auth endpoint if
+// auth_http_url is set, then of the LDAP directory if ldap_url is set
+func (r *relay) authChecker(ctx context.Context, peer smtpd.Peer, username string, password string) error {
+	cfg := r.config(ctx)
+
+	err := errUserNotFound
+	if AuthReady() {
+		err = AuthCheckPassword(username, password)
+	}
+
+	if err != nil && cfg.sql != nil {
+		err = cfg.sql.authenticate(ctx, username, password)
+	}
+
+	if err != nil && cfg.httpAuth != nil {
+		_, err = cfg.httpAuth.authenticate(ctx, peer, username, password)
+	}
+
+	if err != nil && cfg.ldap != nil {
+		err = cfg.ldap.authenticate(ctx, username, password)
+	}
+
+	if err != nil {
+		slog.WarnContext(ctx, "auth error",
+			slog.String("component", "auth_checker"),
+			slog.String("username", username),
+			slog.Any("error", err),
+		)
+
+		if errors.Is(err, errHTTPAuthUnavailable) {
+			return observeErr(ctx, errHTTPAuthUnavailable)
+		}
+
+		return observeErr(ctx, smtpd.ErrAuthInvalid)
+	}
+	return nil
+}
+
+// certChecker authenticates clients with a verified certificate as the user
+// of allowed_users matching its common name, or one of its DNS or email
+// subject alternative names, so they can be restricted to the user's allowed
+// sender addresses
+func (r *relay) certChecker(ctx context.Context, _ smtpd.Peer, cert *x509.Certificate) (string, error) {
+	for _, identity := range certIdentities(cert) {
+		if user, err := AuthFetch(identity); err == nil {
+			return user.username, nil
+		}
+	}
+
+	slog.WarnContext(ctx, "no user matches the client certificate",
+		slog.String("component", "cert_checker"),
+		slog.String("subject", cert.Subject.String()),
+	)
+
+	return "", observeErr(ctx, smtpd.ErrAuthInvalid)
+}
+
+// certIdentities returns the identities of the certificate, in order of
+// precedence
+func certIdentities(cert *x509.Certificate) []string {
+	var identities []string
+
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+
+	identities = append(identities, cert.EmailAddresses...)
+	identities = append(identities, cert.DNSNames...)
+
+	return identities
+}
+
+func (r *relay) heloChecker(_ context.Context, _ smtpd.Peer, _ string) error {
+	// every SMTP request starts with a HELO
+	requestsCounter.Inc()
+
+	return nil
+}
+
+// sessionLimitReached counts the sessions ended on a limit
+func (r *relay) sessionLimitReached(ctx context.Context, peer smtpd.Peer, reason string) {
+	slog.InfoContext(ctx, "session limit reached, client disconnected",
+		slog.String("client_ip", peer.Addr.String()), slog.String("reason", reason))
+
+	sessionLimitsCounter.WithLabelValues(r.listener.String(), reason).Inc()
+}
+
+// checkConnection, checkSender and checkRecipient apply the checks of the
+// current config
+
+func (r *relay) checkConnection(ctx context.Context, peer smtpd.Peer) error {
+	if r.shared.paused.Load() {
+		return observeErr(ctx, smtpd.ErrPaused)
+	}
+
+	cfg := r.config(ctx)
+
+	if err := r.connectionChecker(cfg.allowedNets, cfg.allowedHosts)(ctx, peer); err != nil {
+		return err
+	}
+
+	return cfg.policy.check(ctx, policyConnect, r.newPolicyEnv(peer))
+}
+
+func (r *relay) checkSender(ctx context.Context, peer smtpd.Peer, addr string) error {
+	if r.shared.paused.Load() {
+		return observeErr(ctx, smtpd.ErrPaused)
+	}
+
+	cfg := r.config(ctx)
+
+	allowedSender := r.listener.pattern("allowed_sender", cfg.allowedSender)
+
+	if err := r.senderChecker(allowedSender, cfg.allowedUsers)(ctx, peer, addr); err != nil {
+		return err
+	}
+
+	env := r.newPolicyEnv(peer)
+	env.Sender = addr
+
+	return cfg.policy.check(ctx, policyMail, env)
+}
+
+func (r *relay) checkRecipient(ctx context.Context, peer smtpd.Peer, addr string) error {
+	cfg := r.config(ctx)
+
+	// bounces to SRS addresses are only routed back if they're valid
+	if _, err := cfg.srs.reverse(addr); err != nil {
+		slog.WarnContext(ctx, "invalid SRS recipient", slog.String("component", "recipient_checker"),
+			slog.String("address", addr))
+
+		return observeErr(ctx, errSRSInvalid)
+	}
+
+	allowed := r.listener.pattern("allowed_recipients", cfg.allowedRecipients)
+	denied := r.listener.pattern("denied_recipients", cfg.deniedRecipients)
+
+	if err := r.recipientChecker(allowed, denied)(ctx, peer, addr); err != nil {
+		return err
+	}
+
+	env := r.newPolicyEnv(peer)
+	env.Rcpt = addr
+
+	if tx := smtpd.EnvelopeFromContext(ctx); tx != nil {
+		env.Sender = tx.Sender
+	}
+
+	if err := cfg.policy.check(ctx, policyRcpt, env); err != nil {
+		return err
+	}
+
+	if cfg.policyService != nil {
+		if err := cfg.policyService.check(ctx, r.policyServiceAttrs(ctx, peer, addr), addr); err != nil {
+			return err
+		}
+	}
+
+	if target, ok := r.calloutTarget(cfg, peer, addr); ok {
+		if err := r.shared.callout.check(ctx, cfg, r.router.match(target), target); err != nil {
+			return err
+		}
+	}
+
+	// the recipients are counted as they're accepted, so that the ones over
+	// the limit are deferred on their own, and retried later by the client
+	if r.shared.limits != nil {
+		return r.shared.limits.checkRecipients(ctx, peer, env.Sender, 1)
+	}
+
+	return nil
+}
+
+// calloutTarget returns the address the recipient is verified as with the
+// upstream host it's routed to, as delivered, if it's verified: aliases
+// expanding to several addresses aren't verified, nor messages which aren't
+// delivered over SMTP
+func (r *relay) calloutTarget(cfg *config, peer smtpd.Peer, addr string) (string, bool) {
+	if r.shared.callout == nil || peer.Username != "" ||
+		cfg.delivery == deliveryDiscard || cfg.webhook != nil || cfg.kafka != nil {
+		return "", false
+	}
+
+	orig, _ := cfg.srs.reverse(addr)
+
+	if targets := cfg.aliases.expand(orig); len(targets) == 1 {
+		return targets[0], true
+	}
+
+	return "", false
+}
+
+func (r *relay) connectionChecker(allowedNets []*net.IPNet, allowedHosts *allowedHosts) func(ctx context.Context, peer smtpd.Peer) error {
+	return func(ctx context.Context, peer smtpd.Peer) error {
+		// This can't panic because we only have TCP listeners
+		peerIP := peer.Addr.(*net.TCPAddr).IP
+
+		// Special case: empty string means allow everything
+		allowed := len(allowedNets) == 0 && allowedHosts == nil
+
+		for _, allowedNet := range allowedNets {
+			if allowedNet.Contains(peerIP) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			allowed = allowedHosts.contains(ctx, peerIP)
+		}
+
+		if !allowed {
+			slog.WarnContext(ctx, "IP out of allowed network range", slog.String("ip", peerIP.String()))
+
+			return observeErr(ctx, smtpd.ErrIPDenied)
+		}
+
+		if r.shared.dnsbl != nil {
+			if err := r.shared.dnsbl.check(ctx, peer); err != nil {
+				return err
+			}
+		}
+
+		if r.fcrdns != nil {
+			if err := r.fcrdns.check(ctx, peer); err != nil {
+				return err
+			}
+		}
+
+		if r.shared.limits != nil {
+			return r.shared.limits.checkConnection(ctx, peer)
+		}
+
+		return nil
+	}
+}
+
+func (r *relay) senderChecker(allowedSender, allowedUsers string) func(ctx context.Context, peer smtpd.Peer, addr string) error {
+	return func(ctx context.Context, peer smtpd.Peer, addr string) error {
+		// authenticated clients aren't subject to SPF checks
+		if r.spf != nil && peer.Username == "" {
+			if err := r.spf.check(ctx, peer, addr); err != nil {
+				return err
+			}
+		}
+
+		if r.shared.limits != nil {
+			if err := r.shared.limits.checkMessage(ctx, peer, addr); err != nil {
+				return err
+			}
+		}
+
+		cfg := r.config(ctx)
+
+		if err := cfg.senderLogins.check(ctx, peer, addr); err != nil {
+			return err
+		}
+
+		// the sender domains of the auth endpoint's policy apply even
+		// without allowed_sender
+		if policy := cfg.httpAuth.policy(ctx, peer); policy != nil && !policy.senderAllowed(addr) {
+			slog.WarnContext(ctx, "sender address not allowed by auth policy",
+				slog.String("sender_address", addr), slog.String("username", peer.Username))
+
+			return observeErr(ctx, smtpd.ErrSenderDenied)
+		}
+
+		if allowedSender == "" {
+			// disable sender check, allow anyone to send mail
+			return nil
+		}
+
+		log := slog.With(slog.String("sender_address", addr))
+
+		// check sender address from auth file or SQL database if user is
+		// authenticated
+		if (allowedUsers != "" || cfg.sql != nil) && peer.Username != "" {
+			user, err := authUser(ctx, cfg, peer.Username)
+
+			switch {
+			case errors.Is(err, errUserNotFound) && (cfg.ldap != nil || cfg.httpAuth != nil):
+				// users of the LDAP directory or auth endpoint are only
+				// checked against allowed_sender
+			case err != nil:
+				log.WarnContext(ctx, "sender address not allowed", slog.Any("error", err))
+				return observeErr(ctx, smtpd.ErrSenderDenied)
+			case !addrAllowed(addr, user.allowedAddresses):
+				log.WarnContext(ctx, "sender address not allowed")
+				return observeErr(ctx, smtpd.ErrSenderDenied)
+			}
+		}
+
+		// TODO: precompile this regexp and reject it at config time
+		re, err := regexp.Compile(allowedSender)
+		if err != nil {
+			log.WarnContext(ctx, "allowed_sender invalid", slog.Any("error", err), slog.String("allowed_sender", allowedSender))
+			return observeErr(ctx, smtpd.ErrSenderDenied)
+		}
+
+		if re.MatchString(addr) {
+			return nil
+		}
+
+		log.WarnContext(ctx, "sender address not allowed")
+
+		return observeErr(ctx, smtpd.ErrSenderDenied)
+	}
+}
+
+func (r *relay) recipientChecker(allowed, denied string) func(ctx context.Context, peer smtpd.Peer, addr string) error {
+	log := slog.With(slog.String("component", "recipient_checker"))
+
+	return func(ctx context.Context, _ smtpd.Peer, addr string) error {
+		// First, we check the deny list as that one takes precedence.
+		if denied != "" {
+			// TODO: precompile this regexp and reject it at config time
+			deniedRegexp, err := regexp.Compile(denied)
+			if err != nil {
+				log.WarnContext(ctx, "denied_recipients invalid", slog.String("denied_recipients", denied), slog.Any("error", err))
+
+				return observeErr(ctx, smtpd.ErrRecipientInvalid)
+			}
+
+			if deniedRegexp.MatchString(addr) {
+				log.WarnContext(ctx, "receipt address is part of the deny list", slog.String("address", addr))
+				return observeErr(ctx, smtpd.ErrRecipientDenied)
+			}
+		}
+
+		// Then, we check the allow list.
+		if allowed != "" {
+			allowedRegexp, err := regexp.Compile(allowed)
+			if err != nil {
+				log.WarnContext(ctx, "allowed_recipients invalid", slog.String("allowed_recipients", allowed), slog.Any("error", err))
+				return observeErr(ctx, smtpd.ErrRecipientInvalid)
+			}
+
+			if allowedRegexp.MatchString(addr) {
+				return nil
+			}
+
+			log.WarnContext(ctx, "Invalid recipient address", slog.String("address", addr))
+			return observeErr(ctx, smtpd.ErrRecipientInvalid)
+		}
+
+		// No deny nor allow list, receipient check disabled.
+		return nil
+	}
+}
+
+// mailHandler returns the handler of the messages received: the middlewares
+// of the stages in order, then the delivery
+func (r *relay) mailHandler() smtpd.Handler {
+	middlewares := make([]smtpd.Middleware, 0, len(r.stages))
+	for _, stage := range r.stages {
+		middlewares = append(middlewares, stage.middleware)
+	}
+
+	return smtpd.Chain(r.deliveryHandler(), middlewares...)
+}
+
+// deliveryHandler returns the handler delivering the messages which went
+// through the stages
+func (r *relay) deliveryHandler() smtpd.Handler {
+	return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+		// the config of the session, which a reload doesn't change
+		cfg := r.config(ctx)
+
+		span := trace.SpanFromContext(ctx)
+		uniqueID := messageUUID(ctx)
+
+		logger := slog.With(slog.String("component", "mail_handler"), slog.String("uuid", uniqueID))
+
+		// parse headers from data if we need to log any of them
+		deliveryLog := logger.With(slog.String("from", env.Sender))
+		deliveryLog = addLogHeaderFields(cfg.logHeaders, deliveryLog, env.Header)
+
+		credsKey := credentialsKey(cfg.remoteCredentials, peer.Username, env.Sender)
+
+		// bounces to SRS addresses are routed back to the original senders,
+		// and aliases are expanded, with the failures reported for the
+		// addresses given by the client
+		recipients := make([]string, 0, len(env.Recipients))
+		routed := map[string][]string{}
+
+		for _, rcpt := range env.Recipients {
+			orig, err := cfg.srs.reverse(rcpt)
+			if err != nil {
+				orig = rcpt
+			}
+
+			routed[rcpt] = cfg.aliases.expand(orig)
+
+			for _, addr := range routed[rcpt] {
+				if !slices.Contains(recipients, addr) {
+					recipients = append(recipients, addr)
+				}
+			}
+		}
+
+		// journaling recipients are only added to the envelope, and their
+		// failures aren't reported to the client, which didn't add them
+		if journal := cfg.journal.recipients(env.Sender, recipients); len(journal) > 0 {
+			logger.DebugContext(ctx, "adding journaling recipients", slog.Any("journal", journal))
+			recipients = append(slices.Clone(recipients), journal...)
+		}
+
+		groups := r.router.split(recipients)
+		if host := routeOverride(ctx); host != "" {
+			groups = []routeGroup{{host: host, recipients: recipients}}
+		}
+
+		// streamed messages are buffered when they're needed as a whole: to
+		// send them to several upstreams, to queue them if the delivery fails
+		// temporarily, to archive them, to rewrite or strip their headers, or
+		// to filter their attachments. The stages verifying DKIM signatures
+		// and scanning for viruses buffer them already.
+		buffer := len(groups) > 1 || r.shared.queue != nil || cfg.archive != nil || cfg.headerRules != nil ||
+			cfg.attachments != nil || cfg.stripHeaders
+		if env.Body != nil && buffer {
+			if err := env.Buffer(); err != nil {
+				return err
+			}
+		}
+
+		if cfg.stripHeaders {
+			stripClientHeaders(&env)
+		}
+
+		switch {
+		case cfg.noReceived:
+		case cfg.received != nil:
+			env.AddReceived(peer, *cfg.received)
+		default:
+			env.AddReceivedLine(peer)
+		}
+
+		if r.spf != nil && peer.Username == "" {
+			env.AddHeader("Received-SPF", r.spf.result(ctx, peer, env.Sender).header(cfg.hostName))
+		}
+
+		if r.fcrdns != nil && r.fcrdns.mode == fcrdnsModeTag && peer.Username == "" {
+			if res := r.fcrdns.result(ctx, peer); res != nil {
+				env.AddHeader(fcrdnsHeader, res.header())
+			}
+		}
+
+		// the message is archived as received, before its delivery
+		if cfg.archive != nil {
+			if err := cfg.archive.store(ctx, newArchiveEntry(uniqueID, peer, &env), env.Data); err != nil {
+				logger.ErrorContext(ctx, "could not archive message", slog.Any("error", err))
+				return observeErr(ctx, errArchiveFailed)
+			}
+		}
+
+		applyHeaderRules(&env, cfg.headerRules.forListener(r.listener))
+
+		if cfg.traceHeaders {
+			injectTraceHeaders(ctx, &env)
+		}
+
+		// the envelope sender is replaced with remote_sender, or masqueraded,
+		// or rewritten with SRS
+		sender, masqueraded := cfg.masquerade.rewrite(env.Sender)
+
+		switch {
+		case cfg.remoteSender != "":
+			sender = cfg.remoteSender
+		case !masqueraded:
+			sender = cfg.srs.forward(env.Sender)
+		}
+
+		// the size of streamed messages is only known once they're sent
+		var streamed *countingReader
+		if env.Body != nil {
+			streamed = &countingReader{r: env.Body}
+		}
+
+		// successful status is always 250
+		statusCode := 250
+		start := time.Now()
+
+		defer func() {
+			size := int64(len(env.Data))
+			if streamed != nil {
+				size = streamed.n
+			}
+
+			msgSizeHistogram.Observe(float64(size))
+			span.SetAttributes(traceutil.StatusCode(statusCode), traceutil.DataSize(size))
+
+			observeDuration(ctx, statusCode, time.Since(start))
+		}()
+
+		cfg.mailLog.received(uniqueID, peer, env.Sender, len(env.Data), len(recipients))
+
+		// Each group is delivered independently, and failures are reported for
+		// each recipient: LMTP clients get a reply for each of them, while SMTP
+		// clients get the first error, even though other groups may have been
+		// delivered successfully.
+		failed := map[string]*smtpd.Error{}
+
+		// the client is forwarded to the upstreams trusting the relay
+		var client *clientInfo
+		if cfg.remoteXClient != "" {
+			client = r.clientInfo(ctx, peer)
+		}
+
+		for _, group := range groups {
+			groupLog := deliveryLog.With(
+				slog.String("host", group.host),
+				slog.Any("to", group.recipients),
+			)
+
+			groupLog.InfoContext(ctx, "delivering mail from peer using smarthost")
+
+			out := newOutbound(&env, group.host, sender, group.recipients)
+			out.CredentialsKey = credsKey
+			out.Priority = cfg.priorities.priority(env.Sender, env.Priority)
+			out.Client = client
+
+			// the rules of the upstream host only apply to its copy
+			data := env.Data
+
+			// the outcomes of the attempt are logged to syslog and to the
+			// audit log, and the successful ones notified
+			attemptStart := time.Now()
+			queueID := ""
+
+			newAttempt := func(rcpts []string, err error, deferred bool) *deliveryAttempt {
+				a := &deliveryAttempt{
+					id:         uniqueID,
+					queueID:    queueID,
+					messageID:  messageID(env.Header),
+					peer:       peer,
+					out:        out,
+					recipients: rcpts,
+					size:       len(data),
+					attempt:    1,
+					start:      attemptStart,
+					delay:      time.Since(start),
+					err:        err,
+					deferred:   deferred,
+				}
+
+				if streamed != nil {
+					a.size = int(streamed.n)
+				}
+
+				return a
+			}
+
+			delivered := func(rcpts []string, err error, deferred bool) {
+				a := newAttempt(rcpts, err, deferred)
+
+				cfg.mailLog.delivered(a)
+				cfg.audit.delivered(a)
+			}
+
+			// the recipients accepted by the upstream are notified together
+			notify := func(rcpts []string) {
+				if len(rcpts) > 0 {
+					r.shared.notifier.delivered(ctx, newAttempt(rcpts, nil, false), data)
+				}
+			}
+
+			filtered, stripped, err := filterAttachments(&env, cfg.attachments.forRoute(group.host))
+			if err != nil {
+				smtpErr := deliveryError(ctx, groupLog, cfg.replyCodes, err)
+				for _, rcpt := range group.recipients {
+					failed[rcpt] = smtpErr
+				}
+
+				delivered(group.recipients, smtpErr, false)
+
+				observeRecipients(outcomeFailed, len(group.recipients))
+
+				continue
+			}
+
+			if len(stripped) > 0 {
+				groupLog.InfoContext(ctx, "attachments stripped", slog.Any("attachments", stripped))
+				data = filtered
+			}
+
+			if rules := cfg.headerRules.forRoute(group.host); len(rules) > 0 {
+				routed := smtpd.Envelope{Data: slices.Clone(data)}
+				applyHeaderRules(&routed, rules)
+				data = routed.Data
+			}
+
+			if streamed == nil {
+				out.Size = int64(len(data))
+			}
+
+			// scheduled messages are queued until their delivery time, the
+			// queue buffering them
+			if at := scheduledDelivery(ctx); !at.IsZero() {
+				id, err := r.shared.queue.schedule(out, data, at)
+				if err != nil {
+					groupLog.ErrorContext(ctx, "could not schedule message", slog.Any("error", err))
+
+					for _, rcpt := range group.recipients {
+						failed[rcpt] = errScheduleFailed
+					}
+
+					delivered(group.recipients, errScheduleFailed, true)
+					observeRecipients(outcomeFailed, len(group.recipients))
+
+					continue
+				}
+
+				groupLog.InfoContext(ctx, "delivery scheduled", slog.String("queue_id", id), slog.Time("at", at))
+				observeRecipients(outcomeDeferred, len(group.recipients))
+
+				queueID = id
+				delivered(group.recipients, fmt.Errorf("delivery scheduled at %s", at.Format(time.RFC3339)), true)
+
+				continue
+			}
+
+			var body io.Reader = bytes.NewReader(data)
+			if streamed != nil {
+				body = streamed
+			}
+
+			sendStart := time.Now()
+			err = r.shared.upstreams.send(ctx, cfg, out, body)
+
+			size := int64(len(data))
+			if streamed != nil {
+				size = streamed.n
+			}
+
+			observeDelivery(group.host, size, err, time.Since(sendStart))
+
+			var rcptErrs recipientErrors
+
+			switch {
+			case errors.As(err, &rcptErrs):
+				remaining := r.deferRecipients(ctx, groupLog, out, data, rcptErrs)
+				for rcpt, err := range remaining {
+					failed[rcpt] = deliveryError(ctx, groupLog.With(slog.String("rcpt", rcpt)), cfg.replyCodes, err)
+				}
+
+				// the failed recipients which don't remain were queued
+				accepted := []string{}
+
+				for _, rcpt := range out.Recipients {
+					rcptErr, deferred := rcptErrs[rcpt], true
+					if _, ok := remaining[rcpt]; ok {
+						rcptErr, deferred = failed[rcpt], isTemporaryErr(rcptErrs[rcpt])
+					}
+
+					delivered([]string{rcpt}, rcptErr, deferred)
+
+					if rcptErr == nil {
+						accepted = append(accepted, rcpt)
+					}
+				}
+
+				notify(accepted)
+
+				observeRecipients(outcomeDelivered, len(out.Recipients)-len(rcptErrs))
+				observeRecipients(outcomeDeferred, len(rcptErrs)-len(remaining))
+				observeRecipients(outcomeFailed, len(remaining))
+
+				continue
+			case err != nil && r.shared.queue != nil && isTemporaryErr(err):
+				id, qerr := r.shared.queue.enqueue(out, data, err)
+				if qerr == nil {
+					groupLog.WarnContext(ctx, "delivery deferred, message queued for retry",
+						slog.String("queue_id", id), slog.Any("error", err))
+					observeRecipients(outcomeDeferred, len(group.recipients))
+
+					queueID = id
+					delivered(group.recipients, err, true)
+
+					continue
+				}
+
+				groupLog.ErrorContext(ctx, "could not queue message", slog.Any("error", qerr))
+			}
+
+			if err != nil {
+				smtpErr := deliveryError(ctx, groupLog, cfg.replyCodes, err)
+				for _, rcpt := range group.recipients {
+					failed[rcpt] = smtpErr
+				}
+
+				observeRecipients(outcomeFailed, len(group.recipients))
+
+				delivered(group.recipients, smtpErr, isTemporaryErr(err))
+
+				continue
+			}
+
+			groupLog.InfoContext(ctx, "delivery successful", slog.Int("status_code", statusCode))
+			delivered(group.recipients, nil, false)
+			notify(group.recipients)
+			observeRecipients(outcomeDelivered, len(group.recipients))
+		}
+
+		rcptErrs := smtpd.RecipientErrors{}
+
+		for _, rcpt := range env.Recipients {
+			var smtpErr *smtpd.Error
+
+			for _, addr := range routed[rcpt] {
+				if smtpErr = failed[addr]; smtpErr != nil {
+					break
+				}
+			}
+
+			if smtpErr == nil {
+				continue
+			}
+
+			// the status of the first failed recipient is the one reported to
+			// SMTP clients
+			if len(rcptErrs) == 0 {
+				statusCode = smtpErr.Code
+				_ = observeErr(ctx, smtpErr)
+			}
+
+			rcptErrs[rcpt] = smtpErr
+		}
+
+		if len(rcptErrs) > 0 {
+			return rcptErrs
+		}
+
+		return nil
+	}
+}
+
+// deferRecipients handles a delivery which failed for some recipients only,
+// as reported by SMTP and LMTP upstreams: the recipients which failed temporarily are
+// queued, and the errors of the remaining failed recipients are returned.
+// Without a queue, temporary failures are returned too, so the client retries
+// these recipients.
+func (r *relay) deferRecipients(
+	ctx context.Context, logger *slog.Logger, out *outbound, data []byte, rcptErrs recipientErrors,
+) recipientErrors {
+	logger.WarnContext(ctx, "delivery failed for some recipients", slog.Any("error", rcptErrs))
+
+	retry, tempErr, _ := rcptErrs.split(out)
+	if retry == nil || r.shared.queue == nil {
+		return rcptErrs
+	}
+
+	id, err := r.shared.queue.enqueue(retry, data, tempErr)
+	if err != nil {
+		logger.ErrorContext(ctx, "could not queue message", slog.Any("error", err))
+
+		return rcptErrs
+	}
+
+	logger.WarnContext(ctx, "delivery deferred, message queued for retry",
+		slog.String("queue_id", id), slog.Any("deferred", retry.Recipients))
+
+	remaining := recipientErrors{}
+
+	for rcpt, err := range rcptErrs {
+		if !isTemporaryErr(err) {
+			remaining[rcpt] = err
+		}
+	}
+
+	return remaining
+}
+
+// deliveryError logs a failed delivery and returns the SMTP error to report
+// back to the client. Upstream replies are passed through, including their
+// enhanced status code if any, with the codes they're mapped to by replies.
+func deliveryError(ctx context.Context, logger *slog.Logger, replies replyMap, err error) *smtpd.Error {
+	var (
+		smtpErr *smtpd.Error
+		tperr   *textproto.Error
+	)
+
+	switch {
+	case errors.As(err, &smtpErr):
+		logger.ErrorContext(ctx, "delivery failed",
+			slog.Int("err_code", smtpErr.Code), slog.String("err_msg", smtpErr.Msg))
+	case errors.As(err, &tperr):
+		logger.ErrorContext(ctx, "delivery failed",
+			slog.Int("err_code", tperr.Code), slog.String("err_msg", tperr.Msg))
+
+		smtpErr = replies.apply(upstreamError(tperr))
+	default:
+		smtpErr = smtpd.ErrForwardingFailed
+
+		logger.ErrorContext(ctx, "delivery failed", slog.Any("error", err))
+	}
+
+	return smtpErr
+}
+
+func observeErr(ctx context.Context, err *smtpd.Error) error {
+	errorsCounter.WithLabelValues(strconv.Itoa(err.Code)).Inc()
+
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+
+	return err
+}
+
+// injectTraceHeaders adds the trace context of ctx to the headers of the
+// message, replacing the ones it was received with. These can't be removed
+// from streamed messages, the new ones come first then. Nothing is added if
+// tracing is disabled.
+func injectTraceHeaders(ctx context.Context, env *smtpd.Envelope) {
+	prop := otel.GetTextMapPropagator()
+
+	carrier := traceutil.MIMEHeaderCarrier{}
+	prop.Inject(ctx, carrier)
+
+	if len(carrier) == 0 {
+		return
+	}
+
+	fields := prop.Fields()
+
+	if env.Body == nil {
+		for _, name := range fields {
+			env.RemoveHeaders(name, func(string) bool { return true })
+		}
+	}
+
+	// prepended in reverse order, to keep the order of the propagator
+	for i := len(fields) - 1; i >= 0; i-- {
+		if value := carrier.Get(fields[i]); value != "" {
+			env.AddHeader(textproto.CanonicalMIMEHeaderKey(fields[i]), value)
+		}
+	}
+}
+
+// authUser returns the user of allowed_users, or of the SQL database if
+// sql_dsn is set
+func authUser(ctx context.Context, cfg *config, username string) (*AuthUser, error) {
+	var user *AuthUser
+
+	err := errUserNotFound
+	if AuthReady() {
+		user, err = AuthFetch(username)
+	}
+
+	if errors.Is(err, errUserNotFound) && cfg.sql != nil {
+		var u *sqlUser
+		if u, err = cfg.sql.lookup(ctx, username); err == nil {
+			user = &u.AuthUser
+		}
+	}
+
+	return user, err
+}
+
+func addrAllowed(addr string, allowedAddrs []string) bool {
+	if allowedAddrs == nil {
+		// If absent, all addresses are allowed
+		return true
+	}
+
+	addr = strings.ToLower(addr)
+
+	// Extract optional domain part
+	domain := ""
+	if idx := strings.LastIndex(addr, "@"); idx != -1 {
+		domain = strings.ToLower(addr[idx+1:])
+	}
+
+	// Test each address from allowedUsers file
+	for _, allowedAddr := range allowedAddrs {
+		if matchAddr(allowedAddr, addr, domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchAddr(allowedAddr, addr, domain string) bool {
+	allowedAddr = strings.ToLower(allowedAddr)
+
+	// Three cases for allowedAddr format:
+	idx := strings.Index(allowedAddr, "@")
+	switch {
+	case idx == -1:
+		// 1. local address (no @) -- must match exactly
+		if allowedAddr == addr {
+			return true
+		}
+	case idx != 0:
+		// 2. email address (user@domain.com) -- must match exactly
+		if allowedAddr == addr {
+			return true
+		}
+	default:
+		// 3. domain (@domain.com) -- must match addr domain
+		allowedDomain := allowedAddr[idx+1:]
+		if allowedDomain == domain {
+			return true
+		}
+	}
+
+	return false
+}
+
+func addLogHeaderFields(logHeaders map[string]string, log *slog.Logger, headers textproto.MIMEHeader) *slog.Logger {
+	for field, hdrname := range logHeaders {
+		val := headers.Get(hdrname)
+		if val != "" {
+			// we assume a single value for the header, and get the first
+			log = log.With(slog.String(field, val))
+		}
+	}
+
+	return log
+}
+
+func generateUUID() string {
+	uniqueID, err := uuid.NewRandom()
+	if err != nil {
+		slog.Default().Error("could not generate UUIDv4", slog.Any("error", err))
+
+		return ""
+	}
+
+	return uniqueID.String()
+}
+
+func getServerTLSConfig(certs *certStore) *tls.Config {
+	//nolint:gosec // 1.2 is default, and omitting MinVersion allows overriding with GODEBUG
+	return &tls.Config{
+		GetCertificate: certs.getCertificate,
+	}
+}
@@ -1,10 +1,13 @@
-package main
+package relay
 
 import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
+	"io"
 	"log/slog"
 	"net/textproto"
 	"strings"
@@ -14,6 +17,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func Test_RecepientsCheck(t *testing.T) {
@@ -90,6 +96,94 @@ func Test_RecepientsCheck(t *testing.T) {
 	}
 }
 
+func TestListenerPatterns(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	cfg := &config{
+		remoteHost:        "127.0.0.1:9",
+		allowedSender:     `@example\.com$`,
+		allowedRecipients: `@example\.(com|org)$`,
+	}
+
+	submission, err := parseListener(`starttls://:587?allowed_recipients=`, cfg)
+	require.NoError(t, err)
+
+	gateway, err := parseListener(`tcp://:25?allowed_sender=&allowed_recipients=@example\.com$`, cfg)
+	require.NoError(t, err)
+
+	r, err := newRelay(newConfigStore(cfg), submission, &relayShared{})
+	require.NoError(t, err)
+
+	require.NoError(t, r.checkSender(ctx, smtpd.Peer{}, "alice@example.com"))
+	require.ErrorIs(t, r.checkSender(ctx, smtpd.Peer{}, "alice@example.net"), smtpd.ErrSenderDenied)
+	require.NoError(t, r.checkRecipient(ctx, smtpd.Peer{}, "bob@example.net"))
+
+	r, err = newRelay(newConfigStore(cfg), gateway, &relayShared{})
+	require.NoError(t, err)
+
+	require.NoError(t, r.checkSender(ctx, smtpd.Peer{}, "alice@example.net"))
+	require.NoError(t, r.checkRecipient(ctx, smtpd.Peer{}, "bob@example.com"))
+	require.ErrorIs(t, r.checkRecipient(ctx, smtpd.Peer{}, "bob@example.org"), smtpd.ErrRecipientInvalid)
+}
+
+//nolint:paralleltest
+func TestInjectTraceHeaders(t *testing.T) {
+	prev := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	t.Cleanup(func() { otel.SetTextMapPropagator(prev) })
+
+	traceID, err := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	require.NoError(t, err)
+
+	spanID, err := trace.SpanIDFromHex("00f067aa0ba902b7")
+	require.NoError(t, err)
+
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	const (
+		received = "Traceparent: 00-e775b110dfe5dd5e0f385d5afe2df71e-8cd5b7ec6ac3bcab-01\r\n"
+		injected = "Traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n"
+		message  = "Subject: hi\r\n\r\nhello\r\n"
+	)
+
+	env := smtpd.Envelope{Data: []byte(received + message)}
+	injectTraceHeaders(ctx, &env)
+	assert.Equal(t, injected+message, string(env.Data))
+
+	// the received headers are kept after the new ones in streamed messages
+	env = smtpd.Envelope{Body: strings.NewReader(received + message)}
+	injectTraceHeaders(ctx, &env)
+
+	data, err := io.ReadAll(env.Body)
+	require.NoError(t, err)
+	assert.Equal(t, injected+received+message, string(data))
+
+	// without a trace, the message is left as is
+	env = smtpd.Envelope{Data: []byte(received + message)}
+	injectTraceHeaders(context.Background(), &env)
+	assert.Equal(t, received+message, string(env.Data))
+}
+
+func TestCertIdentities(t *testing.T) {
+	t.Parallel()
+
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "app"},
+		EmailAddresses: []string{"app@example.com"},
+		DNSNames:       []string{"app.example.com", "app2.example.com"},
+	}
+	assert.Equal(t, []string{"app", "app@example.com", "app.example.com", "app2.example.com"}, certIdentities(cert))
+
+	assert.Empty(t, certIdentities(&x509.Certificate{}))
+}
+
 //nolint:paralleltest
 func TestAddLogHeaderFields(t *testing.T) {
 	out := &bytes.Buffer{}
@@ -0,0 +1,279 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// configStore holds the current config, which is replaced as a whole when
+// it's reloaded. Each session keeps the config it started with, see
+// withConfig, so in-flight sessions aren't affected by a reload.
+type configStore struct {
+	cfg atomic.Pointer[config]
+
+	// read reads the new config on reload - overridable for tests
+	read func() (*config, error)
+
+	// mu serializes reloads
+	mu       sync.Mutex
+	onReload []func(cfg *config) (func(), error)
+
+	logger *slog.Logger
+}
+
+func newConfigStore(cfg *config) *configStore {
+	s := &configStore{
+		read: func() (*config, error) {
+			return readConfig(cfg.configFile, cfg.cmdlineFlags)
+		},
+		logger: slog.Default().With(slog.String("component", "config")),
+	}
+
+	s.cfg.Store(cfg)
+
+	return s
+}
+
+// get returns the current config
+func (s *configStore) get() *config {
+	return s.cfg.Load()
+}
+
+// notify registers a function to be called with the new config on reload,
+// before it's applied. It returns the function applying its part of the new
+// config, only called once all of them succeeded, or nil if there's nothing
+// to apply. If it fails, the reload is aborted.
+func (s *configStore) notify(f func(cfg *config) (func(), error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onReload = append(s.onReload, f)
+}
+
+// reload reads the config again, and applies the settings which can be
+// changed at runtime: allowed networks, allowed senders and recipients, TLS
+// certificates and upstream credentials. On error, the current config is
+// kept.
+func (s *configStore) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	newCfg, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	cfg := s.get().reloaded(newCfg)
+
+	applies := make([]func(), 0, len(s.onReload))
+
+	for _, f := range s.onReload {
+		apply, err := f(cfg)
+		if err != nil {
+			return err
+		}
+
+		if apply != nil {
+			applies = append(applies, apply)
+		}
+	}
+
+	for _, apply := range applies {
+		apply()
+	}
+
+	s.cfg.Store(cfg)
+
+	return nil
+}
+
+type configContextKey struct{}
+
+// withConfig returns the context of a session, which uses the config as it
+// was when the session started, see relay.config
+func withConfig(ctx context.Context, cfg *config) context.Context {
+	return context.WithValue(ctx, configContextKey{}, cfg)
+}
+
+// handleReload reloads the config on SIGHUP, until the context is done
+func (s *configStore) handleReload(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			if err := s.reload(); err != nil {
+				s.logger.ErrorContext(ctx, "could not reload config, keeping the current one", slog.Any("error", err))
+				continue
+			}
+
+			s.logger.InfoContext(ctx, "config reloaded")
+		}
+	}
+}
+
+// certStore holds the server certificate, which can be replaced at runtime
+type certStore struct {
+	cert atomic.Pointer[tls.Certificate]
+
+	// mu serializes loads, and guards the paths of the loaded files and
+	// their modification times, see watch
+	mu       sync.Mutex
+	certpath string
+	keypath  string
+	modified [2]time.Time
+}
+
+// load loads the certificate and private key, replacing the current ones
+func (c *certStore) load(certpath, keypath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.loadLocked(certpath, keypath)
+}
+
+func (c *certStore) loadLocked(certpath, keypath string) error {
+	cert, modified, err := readCert(certpath, keypath)
+	if err != nil {
+		return err
+	}
+
+	c.cert.Store(cert)
+	c.certpath, c.keypath, c.modified = certpath, keypath, modified
+
+	return nil
+}
+
+// prepare reads the certificate and private key, and returns the function
+// replacing the current ones with them
+func (c *certStore) prepare(certpath, keypath string) (func(), error) {
+	cert, modified, err := readCert(certpath, keypath)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.cert.Store(cert)
+		c.certpath, c.keypath, c.modified = certpath, keypath, modified
+	}, nil
+}
+
+// readCert reads the certificate and private key files, and returns them with
+// their modification times
+func readCert(certpath, keypath string) (*tls.Certificate, [2]time.Time, error) {
+	if certpath == "" {
+		return nil, [2]time.Time{}, errors.New("empty local_cert")
+	}
+
+	if keypath == "" {
+		return nil, [2]time.Time{}, errors.New("empty local_key")
+	}
+
+	// the files are checked before they're read, so changes made while
+	// they're read are picked up by watch
+	modified, err := modTimes(certpath, keypath)
+	if err != nil {
+		return nil, modified, fmt.Errorf("cannot load X509 keypair: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certpath, keypath)
+	if err != nil {
+		return nil, modified, fmt.Errorf("cannot load X509 keypair: %w", err)
+	}
+
+	return &cert, modified, nil
+}
+
+// loadCertPool loads the PEM encoded certificates of the file
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+
+	return pool, nil
+}
+
+func (c *certStore) getCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// watch reloads the certificate when its files change, e.g. when it's renewed
+// by cert-manager, until the context is done. The files are polled, as
+// Kubernetes updates mounted secrets by swapping symlinks. If the new files
+// can't be loaded, e.g. as only one of them was replaced yet, the current
+// certificate is kept and they're loaded again on the next check.
+func (c *certStore) watch(ctx context.Context, interval time.Duration) {
+	logger := slog.Default().With(slog.String("component", "certs"))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := c.reloadChanged()
+		if err != nil {
+			logger.WarnContext(ctx, "could not reload TLS certificate, keeping the current one", slog.Any("error", err))
+			continue
+		}
+
+		if reloaded {
+			logger.InfoContext(ctx, "TLS certificate reloaded")
+		}
+	}
+}
+
+// reloadChanged loads the files again if they changed since they were loaded
+func (c *certStore) reloadChanged() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if modified, err := modTimes(c.certpath, c.keypath); err == nil && modified == c.modified {
+		return false, nil
+	}
+
+	return true, c.loadLocked(c.certpath, c.keypath)
+}
+
+// modTimes returns the modification times of the certificate and key files
+func modTimes(certpath, keypath string) ([2]time.Time, error) {
+	var modified [2]time.Time
+
+	for i, path := range []string{certpath, keypath} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return modified, err
+		}
+
+		modified[i] = fi.ModTime()
+	}
+
+	return modified, nil
+}
@@ -0,0 +1,201 @@
+package relay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadConfig(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "smtprelay.ini")
+	err := os.WriteFile(file, []byte(`
+; comment
+allowed_nets = 192.0.2.0/24 2001:db8::/32
+allowed_sender = ^.*@example\.com$
+allowed_recipients = ^.*@example\.org$
+`), 0o600)
+	require.NoError(t, err)
+
+	cfg, err := readConfig(file, map[string]string{"allowed_recipients": "^.*@example\\.net$"})
+	require.NoError(t, err)
+
+	assert.Equal(t, `^.*@example\.com$`, cfg.allowedSender)
+	assert.Equal(t, `^.*@example\.net$`, cfg.allowedRecipients)
+	assert.Len(t, cfg.allowedNets, 2)
+
+	// defaults are kept for unset flags
+	assert.Equal(t, 100, cfg.maxRecipients)
+
+	err = os.WriteFile(file, []byte("allowed_nets = 192.0.2.1/24\n"), 0o600)
+	require.NoError(t, err)
+
+	_, err = readConfig(file, nil)
+	require.Error(t, err)
+
+	err = os.WriteFile(file, []byte("max_recipients = many\n"), 0o600)
+	require.NoError(t, err)
+
+	_, err = readConfig(file, nil)
+	require.Error(t, err)
+}
+
+func TestConfigStoreReload(t *testing.T) {
+	t.Parallel()
+
+	store := newConfigStore(&config{
+		listen:        "127.0.0.1:2525",
+		allowedSender: "^old@example\\.com$",
+	})
+
+	newCfg := &config{
+		listen:        "127.0.0.1:2526",
+		allowedSender: "^new@example\\.com$",
+		remoteUser:    "user",
+		remotePass:    "pass",
+	}
+
+	readErr := errors.New("read error")
+	store.read = func() (*config, error) { return nil, readErr }
+
+	require.ErrorIs(t, store.reload(), readErr)
+	assert.Equal(t, "^old@example\\.com$", store.get().allowedSender)
+
+	store.read = func() (*config, error) { return newCfg, nil }
+
+	// a failed reload hook aborts the reload, and the hooks before it
+	// aren't applied
+	var applied int
+	store.notify(func(_ *config) (func(), error) {
+		return func() { applied++ }, nil
+	})
+
+	hookErr := errors.New("hook error")
+	store.notify(func(cfg *config) (func(), error) {
+		if cfg.remoteUser == "" {
+			return nil, hookErr
+		}
+
+		return nil, nil
+	})
+
+	newCfg.remoteUser = ""
+	require.ErrorIs(t, store.reload(), hookErr)
+	assert.Equal(t, "^old@example\\.com$", store.get().allowedSender)
+	assert.Zero(t, applied)
+
+	newCfg.remoteUser = "user"
+	old := store.get()
+
+	require.NoError(t, store.reload())
+	assert.Equal(t, 1, applied)
+
+	cfg := store.get()
+	assert.Equal(t, "^new@example\\.com$", cfg.allowedSender)
+	assert.Equal(t, "user", cfg.remoteUser)
+	assert.Equal(t, "pass", cfg.remotePass)
+
+	// settings which need a restart aren't reloaded
+	assert.Equal(t, "127.0.0.1:2525", cfg.listen)
+
+	// the previous snapshot is left untouched
+	assert.Equal(t, "^old@example\\.com$", old.allowedSender)
+}
+
+func TestCertStore(t *testing.T) {
+	t.Parallel()
+
+	certs := &certStore{}
+
+	require.Error(t, certs.load("", "key.pem"))
+	require.Error(t, certs.load("cert.pem", ""))
+	require.Error(t, certs.load(filepath.Join(t.TempDir(), "cert.pem"), filepath.Join(t.TempDir(), "key.pem")))
+
+	cert, err := certs.getCertificate(nil)
+	require.NoError(t, err)
+	assert.Nil(t, cert)
+}
+
+// writeTestCert writes a self-signed certificate for cn and its key to
+// cert.pem and key.pem in dir
+func writeTestCert(t *testing.T, dir, cn string) (certpath, keypath string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	certpath = filepath.Join(dir, "cert.pem")
+	keypath = filepath.Join(dir, "key.pem")
+
+	require.NoError(t, os.WriteFile(certpath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keypath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return certpath, keypath
+}
+
+func TestCertStoreWatch(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	dir := t.TempDir()
+	certpath, keypath := writeTestCert(t, dir, "old.example.com")
+
+	certs := &certStore{}
+	require.NoError(t, certs.load(certpath, keypath))
+
+	commonName := func() string {
+		cert, _ := certs.getCertificate(nil)
+		return cert.Leaf.Subject.CommonName
+	}
+	assert.Equal(t, "old.example.com", commonName())
+
+	go certs.watch(ctx, 10*time.Millisecond)
+
+	// a half-written update keeps the current certificate
+	require.NoError(t, os.WriteFile(keypath, []byte("garbage"), 0o600))
+	require.NoError(t, os.Chtimes(keypath, time.Time{}, time.Now().Add(time.Minute)))
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "old.example.com", commonName())
+
+	writeTestCert(t, dir, "new.example.com")
+
+	// make sure the modification times change, whatever the resolution of
+	// the filesystem
+	future := time.Now().Add(2 * time.Minute)
+	require.NoError(t, os.Chtimes(certpath, time.Time{}, future))
+	require.NoError(t, os.Chtimes(keypath, time.Time{}, future))
+
+	require.Eventually(t, func() bool {
+		return commonName() == "new.example.com"
+	}, time.Second, 10*time.Millisecond)
+}
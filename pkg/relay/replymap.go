@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// upstreamError returns the error relaying the reply of an upstream to the
+// client: its reply code, its enhanced status code, and its lines, without
+// the enhanced status code they start with
+func upstreamError(tperr *textproto.Error) *smtpd.Error {
+	smtpErr := &smtpd.Error{Code: tperr.Code}
+
+	lines := strings.Split(tperr.Msg, "\n")
+	for i, line := range lines {
+		m := enhancedCodeRE.FindStringSubmatch(line)
+		if m == nil || m[1][0] != strconv.Itoa(tperr.Code)[0] {
+			continue
+		}
+
+		if smtpErr.EnhancedCode == "" {
+			smtpErr.EnhancedCode = m[1]
+		}
+
+		lines[i] = line[len(m[0]):]
+	}
+
+	smtpErr.Msg = strings.Join(lines, "\n")
+
+	return smtpErr
+}
+
+// replyCode is a reply code, with its enhanced status code if any
+type replyCode struct {
+	code     int
+	enhanced string
+}
+
+// replyMap overrides the codes of the upstream errors relayed to the
+// clients, by reply code and enhanced status code, or by reply code only
+type replyMap map[replyCode]replyCode
+
+// parseReplyCode parses a reply code, optionally followed by a slash and an
+// enhanced status code of the same class, e.g. "550" or "550/5.7.1"
+func parseReplyCode(s string) (replyCode, error) {
+	code, enhanced, _ := strings.Cut(s, "/")
+
+	n, err := strconv.Atoi(code)
+	if err != nil || n < 400 || n > 599 {
+		return replyCode{}, fmt.Errorf("invalid reply code %q, expected 4xx or 5xx", code)
+	}
+
+	if enhanced != "" && (!enhancedCode.MatchString(enhanced) || enhanced[0] != code[0]) {
+		return replyCode{}, fmt.Errorf("invalid enhanced status code %q for %d", enhanced, n)
+	}
+
+	return replyCode{code: n, enhanced: enhanced}, nil
+}
+
+// parseReplyMap parses the input into a replyMap. It should be in the form
+// of "452/4.2.2=552/5.2.2 421=451" (separated by spaces). Returns nil if the
+// input is empty.
+func parseReplyMap(s string) (replyMap, error) {
+	entries := splitstr(s, ' ')
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	m := replyMap{}
+
+	for _, entry := range entries {
+		from, to, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid entry %q, expected code=code", entry)
+		}
+
+		fromCode, err := parseReplyCode(from)
+		if err != nil {
+			return nil, err
+		}
+
+		toCode, err := parseReplyCode(to)
+		if err != nil {
+			return nil, err
+		}
+
+		m[fromCode] = toCode
+	}
+
+	return m, nil
+}
+
+// apply returns the error with the codes it's mapped to, the error itself if
+// none. Without an enhanced status code in the mapping, the one of the error
+// is kept, in the class of the new reply code.
+func (m replyMap) apply(smtpErr *smtpd.Error) *smtpd.Error {
+	to, ok := m[replyCode{code: smtpErr.Code, enhanced: smtpErr.EnhancedCode}]
+	if !ok {
+		if to, ok = m[replyCode{code: smtpErr.Code}]; !ok {
+			return smtpErr
+		}
+	}
+
+	enhanced := to.enhanced
+	if enhanced == "" && smtpErr.EnhancedCode != "" {
+		enhanced = strconv.Itoa(to.code / 100)
+		enhanced += smtpErr.EnhancedCode[1:]
+	}
+
+	return &smtpd.Error{Code: to.code, EnhancedCode: enhanced, Msg: smtpErr.Msg}
+}
@@ -0,0 +1,172 @@
+package relay
+
+import (
+	"context"
+	"net/textproto"
+	"testing"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamError(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		err      textproto.Error
+		expected smtpd.Error
+	}{
+		{
+			textproto.Error{Code: 550, Msg: "5.1.1 no such user"},
+			smtpd.Error{Code: 550, EnhancedCode: "5.1.1", Msg: "no such user"},
+		},
+		{
+			textproto.Error{Code: 552, Msg: "5.2.2 Mailbox full\n5.2.2 over quota"},
+			smtpd.Error{Code: 552, EnhancedCode: "5.2.2", Msg: "Mailbox full\nover quota"},
+		},
+		{
+			textproto.Error{Code: 550, Msg: "no such user"},
+			smtpd.Error{Code: 550, Msg: "no such user"},
+		},
+		{
+			// the enhanced status code doesn't match the reply code
+			textproto.Error{Code: 450, Msg: "5.1.1 no such user"},
+			smtpd.Error{Code: 450, Msg: "5.1.1 no such user"},
+		},
+	} {
+		assert.Equal(t, &tc.expected, upstreamError(&tc.err), tc.err.Msg)
+	}
+}
+
+func TestParseReplyMap(t *testing.T) {
+	t.Parallel()
+
+	m, err := parseReplyMap("452/4.2.2=552/5.2.2 421=451")
+	require.NoError(t, err)
+	assert.Equal(t, replyMap{
+		{code: 452, enhanced: "4.2.2"}: {code: 552, enhanced: "5.2.2"},
+		{code: 421}:                    {code: 451},
+	}, m)
+
+	m, err = parseReplyMap("")
+	require.NoError(t, err)
+	assert.Nil(t, m)
+
+	for _, bad := range []string{
+		"452",
+		"452=",
+		"250=550",
+		"550=650",
+		"abc=550",
+		"550/4.1.1=550",
+		"550=550/5.1",
+	} {
+		_, err := parseReplyMap(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestReplyMapApply(t *testing.T) {
+	t.Parallel()
+
+	m, err := parseReplyMap("452/4.2.2=552/5.2.2 421=451 550=554")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		err      smtpd.Error
+		expected smtpd.Error
+	}{
+		{
+			smtpd.Error{Code: 452, EnhancedCode: "4.2.2", Msg: "mailbox full"},
+			smtpd.Error{Code: 552, EnhancedCode: "5.2.2", Msg: "mailbox full"},
+		},
+		{
+			smtpd.Error{Code: 452, EnhancedCode: "4.3.1", Msg: "out of storage"},
+			smtpd.Error{Code: 452, EnhancedCode: "4.3.1", Msg: "out of storage"},
+		},
+		{
+			smtpd.Error{Code: 421, EnhancedCode: "4.7.0", Msg: "try later"},
+			smtpd.Error{Code: 451, EnhancedCode: "4.7.0", Msg: "try later"},
+		},
+		{
+			smtpd.Error{Code: 550, EnhancedCode: "5.1.1", Msg: "no such user"},
+			smtpd.Error{Code: 554, EnhancedCode: "5.1.1", Msg: "no such user"},
+		},
+		{
+			smtpd.Error{Code: 550, Msg: "no such user"},
+			smtpd.Error{Code: 554, Msg: "no such user"},
+		},
+	} {
+		assert.Equal(t, &tc.expected, m.apply(&tc.err), tc.err.Error())
+	}
+
+	// the class of the enhanced status code follows the reply code
+	m, err = parseReplyMap("452=552")
+	require.NoError(t, err)
+	assert.Equal(t, &smtpd.Error{Code: 552, EnhancedCode: "5.2.2", Msg: "mailbox full"},
+		m.apply(&smtpd.Error{Code: 452, EnhancedCode: "4.2.2", Msg: "mailbox full"}))
+
+	var none replyMap
+	assert.Equal(t, &smtpd.Error{Code: 452, Msg: "mailbox full"}, none.apply(&smtpd.Error{Code: 452, Msg: "mailbox full"}))
+}
+
+func TestUpstreamReplyPassThrough(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	u := startFakeUpstream(t)
+	u.setReply("RCPT TO:<ALICE@", "552-5.2.2 Mailbox full\r\n552 5.2.2 over quota")
+	u.setReply("RCPT TO:<DAVE@", "550-5.1.1 no such user\r\n550 5.1.1 see https://example.com/help")
+
+	replies, err := parseReplyMap("552/5.2.2=452")
+	require.NoError(t, err)
+
+	addr := startRelayConfig(ctx, t, "", &config{remoteHost: u.addr, replyCodes: replies})
+
+	for rcpt, expected := range map[string]struct {
+		code int
+		msg  string
+	}{
+		"alice@example.com": {452, "4.2.2 Mailbox full\n4.2.2 over quota"},
+		"dave@example.com":  {550, "5.1.1 no such user\n5.1.1 see https://example.com/help"},
+	} {
+		c, err := textproto.Dial("tcp", addr)
+		require.NoError(t, err)
+
+		_, _, err = c.ReadResponse(220)
+		require.NoError(t, err)
+
+		for _, line := range []string{
+			"EHLO localhost",
+			"MAIL FROM:<bob@example.com>",
+			"RCPT TO:<" + rcpt + ">",
+		} {
+			_, err = c.Cmd("%s", line)
+			require.NoError(t, err)
+
+			_, _, err = c.ReadResponse(250)
+			require.NoError(t, err, line)
+		}
+
+		_, err = c.Cmd("DATA")
+		require.NoError(t, err)
+
+		_, _, err = c.ReadResponse(354)
+		require.NoError(t, err)
+
+		_, err = c.Cmd("Subject: test\r\n\r\nhello\r\n.")
+		require.NoError(t, err)
+
+		// the upstream reply is relayed with all its lines, and its code
+		// mapped
+		code, msg, err := c.ReadResponse(250)
+		require.Error(t, err)
+		assert.Equal(t, expected.code, code, rcpt)
+		assert.Equal(t, expected.msg, msg, rcpt)
+
+		_ = c.Close()
+	}
+}
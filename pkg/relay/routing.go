@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// route maps recipient addresses matching a glob pattern (e.g. "*@gmail.com")
+// to an upstream host
+type route struct {
+	pattern string
+	host    string
+}
+
+// Delivery modes
+const (
+	deliverySmarthost = "smarthost" // deliver to the remote_host routes
+	deliveryMX        = "mx"        // deliver directly to the MX hosts of recipient domains
+	deliveryDiscard   = "discard"   // accept and count messages without delivering them
+	deliveryWebhook   = "webhook"   // post messages to webhook_url
+	deliveryKafka     = "kafka"     // publish messages to kafka_topic
+)
+
+// router picks the upstream host for each recipient, using the first route
+// whose pattern matches, and the fallback host otherwise. With direct
+// delivery, the fallback is the MX hosts of the recipient domain.
+type router struct {
+	routes   []route
+	fallback string
+	direct   bool
+}
+
+// routeGroup is a set of recipients which are delivered to the same host
+type routeGroup struct {
+	host       string
+	recipients []string
+}
+
+// parse the input into a router. It should be in the form of
+// "host:port *@example.com=host2:port" (routes separated by spaces), where the
+// entry without a pattern is the default route. Hosts may be upstream groups,
+// e.g. "host1:port,host2:port". Patterns use path.Match syntax
+// and are matched case-insensitively against the full recipient address. With
+// direct delivery, the default route is optional and ignored.
+func parseRoutes(s string, direct bool) (*router, error) {
+	r := &router{direct: direct}
+
+	for _, entry := range splitstr(s, ' ') {
+		pattern, host, found := strings.Cut(entry, "=")
+		if !found {
+			host = entry
+		}
+
+		if isUpstreamGroup(host) {
+			if _, err := parseUpstreamGroup(host); err != nil {
+				return nil, err
+			}
+		}
+
+		if !found {
+			if r.fallback != "" {
+				return nil, fmt.Errorf("duplicate default route %q", entry)
+			}
+
+			r.fallback = entry
+
+			continue
+		}
+
+		if pattern == "" || host == "" {
+			return nil, fmt.Errorf("invalid route %q", entry)
+		}
+
+		pattern = strings.ToLower(pattern)
+
+		// validate the pattern now, so we don't fail at delivery time
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid route pattern %q: %w", pattern, err)
+		}
+
+		r.routes = append(r.routes, route{pattern: pattern, host: host})
+	}
+
+	if r.fallback == "" && !direct {
+		return nil, errors.New("no default route")
+	}
+
+	return r, nil
+}
+
+// match returns the upstream host for the given recipient address
+func (r *router) match(addr string) string {
+	addr = strings.ToLower(addr)
+
+	for _, rt := range r.routes {
+		if ok, _ := path.Match(rt.pattern, addr); ok {
+			return rt.host
+		}
+	}
+
+	if r.direct {
+		_, domain, _ := strings.Cut(addr, "@")
+		return mxScheme + domain
+	}
+
+	return r.fallback
+}
+
+// split groups the recipients by upstream host, preserving the order in which
+// hosts were first matched
+func (r *router) split(recipients []string) []routeGroup {
+	groups := []routeGroup{}
+	index := map[string]int{}
+
+	for _, rcpt := range recipients {
+		host := r.match(rcpt)
+
+		i, ok := index[host]
+		if !ok {
+			i = len(groups)
+			index[host] = i
+			groups = append(groups, routeGroup{host: host})
+		}
+
+		groups[i].recipients = append(groups[i].recipients, rcpt)
+	}
+
+	return groups
+}
@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRoutes(t *testing.T) {
+	t.Parallel()
+
+	// single host is the default route
+	r, err := parseRoutes("smtp.example.com:587", false)
+	require.NoError(t, err)
+	assert.Equal(t, "smtp.example.com:587", r.fallback)
+	assert.Empty(t, r.routes)
+
+	// patterns are lowercased
+	r, err = parseRoutes("smtp.example.com:587 *@GMail.com=smtp-relay.gmail.com:587", false)
+	require.NoError(t, err)
+	assert.Equal(t, []route{{pattern: "*@gmail.com", host: "smtp-relay.gmail.com:587"}}, r.routes)
+
+	// no default route
+	_, err = parseRoutes("*@gmail.com=smtp-relay.gmail.com:587", false)
+	require.Error(t, err)
+
+	// empty input has no default route either
+	_, err = parseRoutes("", false)
+	require.Error(t, err)
+
+	// two default routes
+	_, err = parseRoutes("a.example.com:25 b.example.com:25", false)
+	require.Error(t, err)
+
+	// empty host
+	_, err = parseRoutes("a.example.com:25 *@gmail.com=", false)
+	require.Error(t, err)
+
+	// bad pattern
+	_, err = parseRoutes("a.example.com:25 [@gmail.com=b.example.com:25", false)
+	require.Error(t, err)
+}
+
+func TestRouterSplit(t *testing.T) {
+	t.Parallel()
+
+	r, err := parseRoutes("default:25 *@gmail.com=gmail:587 *@*.example.com=sub:25 *@example.com=example:25", false)
+	require.NoError(t, err)
+
+	assert.Equal(t, "gmail:587", r.match("Alice@GMAIL.com"))
+	assert.Equal(t, "sub:25", r.match("bob@mail.example.com"))
+	assert.Equal(t, "example:25", r.match("bob@example.com"))
+	assert.Equal(t, "default:25", r.match("carol@example.org"))
+
+	groups := r.split([]string{
+		"carol@example.org",
+		"alice@gmail.com",
+		"dave@example.net",
+		"bob@gmail.com",
+	})
+
+	assert.Equal(t, []routeGroup{
+		{host: "default:25", recipients: []string{"carol@example.org", "dave@example.net"}},
+		{host: "gmail:587", recipients: []string{"alice@gmail.com", "bob@gmail.com"}},
+	}, groups)
+}
+
+func TestRouterDirect(t *testing.T) {
+	t.Parallel()
+
+	// the default route is optional
+	r, err := parseRoutes("*@gmail.com=gmail:587", true)
+	require.NoError(t, err)
+
+	assert.Equal(t, "gmail:587", r.match("alice@gmail.com"))
+	assert.Equal(t, "mx://example.com", r.match("bob@Example.com"))
+
+	// and ignored
+	r, err = parseRoutes("default:25", true)
+	require.NoError(t, err)
+
+	assert.Equal(t, []routeGroup{
+		{host: "mx://example.com", recipients: []string{"alice@example.com", "bob@example.com"}},
+		{host: "mx://example.org", recipients: []string{"carol@example.org"}},
+	}, r.split([]string{"alice@example.com", "carol@example.org", "bob@example.com"}))
+}
@@ -0,0 +1,462 @@
+// Package relay implements smtprelay, an SMTP relay delivering the messages
+// of its clients to upstream SMTP servers, for embedding in other Go services.
+// The smtprelay command runs a Relay configured with its command line flags.
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/evidentiq/smtprelay/v2/internal/traceutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+var tracer = otel.Tracer("github.com/evidentiq/smtprelay/v2")
+
+// metrics registry - overridable for tests
+var metricsRegistry = prometheus.DefaultRegisterer
+
+const applicationName = "smtprelay"
+
+// ErrShutdownTimeout is returned when sessions or deliveries were still in
+// progress at the end of the shutdown grace period
+var ErrShutdownTimeout = errors.New("shutdown grace period expired")
+
+// Types of the SMTP server, for the middlewares of the message handler
+type (
+	// Peer is the client of an SMTP session
+	Peer = smtpd.Peer
+
+	// Envelope is a message received, with its sender and recipients
+	Envelope = smtpd.Envelope
+
+	// MIMEPart is a message or one of its MIME parts, as returned by
+	// Envelope.MIME
+	MIMEPart = smtpd.MIMEPart
+
+	// Handler handles a message once its data is received. If an error is
+	// returned, it's reported to the client.
+	Handler = smtpd.Handler
+
+	// Middleware wraps a Handler, to check or alter messages before passing
+	// them on to next, or to act on the result. It may return without
+	// calling next to reject a message.
+	Middleware = smtpd.Middleware
+
+	// Error is an SMTP reply, with its code, to report to the client
+	Error = smtpd.Error
+)
+
+// Relay is an SMTP relay, listening on the addresses of its config and
+// delivering the messages received to the upstream servers. A Relay runs
+// once.
+type Relay struct {
+	cfg     *config
+	inserts []stageInsert
+	ready   chan struct{} // closed once the listeners serve
+
+	cancel context.CancelFunc
+	done   chan struct{} // closed once Run returned, with err
+	err    error
+}
+
+// stageInsert is a middleware added with Relay.Use
+type stageInsert struct {
+	before string
+	stage  mailStage
+}
+
+// New returns a relay configured with the given config file, ini or YAML, and
+// settings named as the command line flags. The settings take precedence over
+// the config file and the SMTPRELAY_ environment variables, also when the
+// config is reloaded. The config file is optional.
+func New(configFile string, settings map[string]string) (*Relay, error) {
+	cfg, err := readConfig(configFile, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.configFile = configFile
+	cfg.cmdlineFlags = settings
+
+	return fromConfig(cfg), nil
+}
+
+// NewFromCommandLine returns a relay configured like the smtprelay command,
+// with the command line flags, the -config file and the environment. It sets
+// up the default logger as configured too.
+func NewFromCommandLine() (*Relay, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return fromConfig(cfg), nil
+}
+
+func fromConfig(cfg *config) *Relay {
+	return &Relay{cfg: cfg, ready: make(chan struct{})}
+}
+
+// Use adds a middleware named name to the message handler, before the
+// built-in or added stage named before, or right before the delivery if
+// before is empty. It must be called before the relay runs.
+func (r *Relay) Use(name, before string, middleware Middleware) error {
+	stages := make([]mailStage, 0, len(builtinStages)+len(r.inserts))
+	for _, name := range builtinStages {
+		stages = append(stages, mailStage{name: name})
+	}
+
+	for _, ins := range r.inserts {
+		stages, _ = insertStage(stages, ins.before, ins.stage)
+	}
+
+	stage := mailStage{name: name, middleware: middleware}
+	if _, err := insertStage(stages, before, stage); err != nil {
+		return err
+	}
+
+	r.inserts = append(r.inserts, stageInsert{before: before, stage: stage})
+
+	return nil
+}
+
+// Start runs the relay in the background, and returns once it serves, or with
+// the error it failed to start with. Stop stops it.
+func (r *Relay) Start(ctx context.Context) error {
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+		r.err = r.Run(ctx)
+	}()
+
+	select {
+	case <-r.ready:
+		return nil
+	case <-r.done:
+		return r.err
+	}
+}
+
+// Stop stops a relay run with Start, and waits for it to drain for the
+// shutdown timeout. It returns the error the relay stopped with, such as
+// ErrShutdownTimeout, or ctx.Err() if ctx is done first.
+func (r *Relay) Stop(ctx context.Context) error {
+	if r.cancel == nil {
+		return errors.New("relay not started")
+	}
+
+	r.cancel()
+
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run runs the relay until ctx is cancelled, then drains the sessions and the
+// queue for the shutdown timeout. It returns nil after a clean drain, and
+// ErrShutdownTimeout if sessions had to be closed. The config is reloaded on
+// SIGHUP, as by the command.
+func (r *Relay) Run(ctx context.Context) (err error) {
+	cfg := r.cfg
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	// sessions are served with a context of their own, so they aren't
+	// interrupted while draining; it's cancelled once the relays are shut down
+	serveCtx, cancelServe := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelServe()
+
+	metricsSrv, err := handleMetrics(ctx, cfg.metricsListen, metricsRegistry)
+	if err != nil {
+		return fmt.Errorf("could not start metrics server: %w", err)
+	}
+	defer metricsSrv.Stop()
+
+	closer, err := traceutil.InitTraceExporter(ctx, "smtprelay")
+	if err != nil {
+		return fmt.Errorf("init trace exporter: %w", err)
+	}
+	//nolint:errcheck
+	defer closer(ctx)
+
+	if cfg.metricsOTLP {
+		metricsCloser, err := traceutil.InitMetricExporter(ctx, applicationName, prometheus.DefaultGatherer, cfg.otlpInterval,
+			semconv.ServiceInstanceID(cfg.hostName),
+			attribute.String("smtprelay.listen", cfg.listen),
+			attribute.String("smtprelay.upstream", cfg.remoteHost),
+		)
+		if err != nil {
+			return fmt.Errorf("init metric exporter: %w", err)
+		}
+		//nolint:errcheck
+		defer metricsCloser(ctx)
+	}
+
+	conf := newConfigStore(cfg)
+
+	// pending Kafka publications are flushed on shutdown
+	defer cfg.kafka.close()
+
+	defer cfg.mailLog.close()
+	defer cfg.audit.close()
+
+	// pooled LDAP connections are unbound on shutdown
+	defer cfg.ldap.close()
+	defer cfg.sql.close()
+
+	if cfg.delivery == deliveryDiscard {
+		slog.WarnContext(ctx, "discard delivery mode: messages are accepted but not delivered")
+	}
+
+	// upstream connections are shared by all listeners and the queue
+	upstreams := newUpstreamPool(cfg.remotePoolMaxIdle, cfg.remotePoolMaxAge)
+	defer upstreams.close()
+
+	var (
+		q         *queue
+		queueDone chan struct{}
+	)
+	if cfg.queueDir != "" {
+		q, err = newQueue(conf, upstreams)
+		if err != nil {
+			return fmt.Errorf("error creating queue: %w", err)
+		}
+	}
+
+	notifier, err := newHandoffNotifier(conf, upstreams, q)
+	if err != nil {
+		return err
+	}
+
+	if q != nil {
+		q.notifier = notifier
+	}
+
+	shared := &relayShared{queue: q, upstreams: upstreams, notifier: notifier}
+
+	// the ACME certificate is shared by all listeners
+	shared.acme = newACMEManager(cfg)
+	if shared.acme != nil {
+		if err = shared.acme.listen(ctx, cfg.localACMEHTTP); err != nil {
+			return fmt.Errorf("could not start ACME challenge server: %w", err)
+		}
+		defer shared.acme.stop()
+	}
+
+	// users of the SQL database may have rate limits of their own
+	var userLimits func(ctx context.Context, username string) (int, int)
+	if cfg.sql != nil {
+		userLimits = cfg.sql.rateLimits
+	}
+
+	// state shared with the other relay instances is kept in Redis
+	redis, err := newRedisClient(cfg.redisURL, cfg.redisTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid redis_url: %w", err)
+	}
+	if redis != nil {
+		defer redis.Close()
+	}
+
+	// rate limits are shared by all listeners
+	shared.limits, err = newThrottler(cfg.rateLimitMessages, cfg.rateLimitRcpts, userLimits, redis)
+	if err != nil {
+		return fmt.Errorf("error parsing rate limits: %w", err)
+	}
+
+	// seen Message-IDs are shared by all listeners
+	shared.dedup, err = newDeduplicator(cfg.dedupWindow, cfg.dedupAction, cfg.dedupMaxEntries, redis)
+	if err != nil {
+		return fmt.Errorf("invalid dedup_action or dedup_max_entries: %w", err)
+	}
+
+	// blocklist results are cached for all listeners
+	shared.dnsbl, err = newDNSBLChecker(cfg.dnsblLists, cfg.dnsblThreshold, cfg.dnsblMode, cfg.dnsblTimeout)
+	if err != nil {
+		return fmt.Errorf("error parsing DNS blocklists: %w", err)
+	}
+
+	// callout results are cached for all listeners
+	shared.callout = newCalloutChecker(cfg.rcptCallout, cfg.calloutTimeout)
+
+	// failed AUTH attempts are counted on all listeners
+	shared.authLimiter = newAuthLimiter(cfg)
+
+	listeners, err := parseListeners(cfg.listen, cfg)
+	if err != nil {
+		return fmt.Errorf("error parsing listen addresses: %w", err)
+	}
+
+	relays := make([]*relay, 0, len(listeners))
+	lns := make([]net.Listener, 0, len(listeners))
+
+	// shut down all listeners together, so in-flight sessions on every
+	// listener get the same grace period
+	defer func() {
+		// stop the queue on relay errors too
+		stop()
+
+		graceCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.shutdownTimeout)
+		defer cancel()
+
+		shutdownErr := shutdownRelays(graceCtx, relays, queueDone)
+		if shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+
+		cancelServe()
+	}()
+
+	errch := make(chan error, len(listeners))
+
+	for _, lc := range listeners {
+		var relay *relay
+		relay, err = newRelay(conf, lc, shared)
+		if err != nil {
+			return fmt.Errorf("error creating relay: %w", err)
+		}
+
+		for _, ins := range r.inserts {
+			if err = relay.insertStage(ins.before, ins.stage); err != nil {
+				return fmt.Errorf("error adding middleware: %w", err)
+			}
+		}
+
+		var listener net.Listener
+		listener, err = relay.listen()
+		if err != nil {
+			return fmt.Errorf("error listening on address %q: %w", lc.address, err)
+		}
+
+		slog.InfoContext(ctx, "listening on address",
+			slog.String("address", lc.String()),
+			slog.Bool("force_tls", lc.forceTLS),
+			slog.Bool("auth", lc.auth),
+			slog.Bool("insecure_auth", lc.insecureAuth),
+		)
+
+		relays = append(relays, relay)
+		lns = append(lns, listener)
+	}
+
+	go conf.handleReload(ctx)
+
+	if cfg.adminListen != "" {
+		admin := newAdminServer(relays, shared, conf, cfg.adminToken)
+
+		if err = handleAdmin(ctx, cfg.adminListen, admin); err != nil {
+			return fmt.Errorf("could not start admin server: %w", err)
+		}
+		defer admin.Stop()
+	}
+
+	// all listeners are bound, so root privileges aren't needed anymore
+	if cfg.runUser != "" || cfg.runGroup != "" || cfg.chrootDir != "" {
+		if err = dropPrivileges(cfg.chrootDir, cfg.uid, cfg.gid); err != nil {
+			return fmt.Errorf("could not drop privileges: %w", err)
+		}
+
+		slog.InfoContext(ctx, "dropped privileges",
+			slog.Int("uid", os.Getuid()),
+			slog.Int("gid", os.Getgid()),
+			slog.String("chroot", cfg.chrootDir),
+		)
+	}
+
+	for i, relay := range relays {
+		go func() {
+			serveErr := relay.serve(serveCtx, lns[i])
+			if serveErr != nil && !errors.Is(serveErr, smtpd.ErrServerClosed) {
+				serveErr = fmt.Errorf("relay shutdown with an error: %w", serveErr)
+			}
+
+			errch <- serveErr
+		}()
+	}
+
+	if q != nil {
+		// the queue stops picking messages when ctx is cancelled, but the
+		// delivery in progress is drained
+		queueDone = make(chan struct{})
+
+		go func() {
+			defer close(queueDone)
+			q.run(ctx)
+		}()
+	}
+
+	// the hosts of the upstream groups are checked in the background
+	if cfg.remoteHealthCheck > 0 {
+		go cfg.balancer.check(ctx, conf, cfg.remoteHealthCheck)
+	}
+
+	close(r.ready)
+
+	// Now wait for the server to stop, either by a signal or by an error
+	select {
+	case err = <-errch:
+		err = fmt.Errorf("relay error: %w", err)
+	case <-ctx.Done():
+		slog.WarnContext(ctx, "shutting down", slog.Duration("grace_period", cfg.shutdownTimeout))
+	}
+
+	return err
+}
+
+// shutdownRelays shuts down all relays concurrently, and waits for their
+// sessions and for the queue, if any, to finish until ctx is done. The
+// sessions left then are closed, and ErrShutdownTimeout is returned.
+func shutdownRelays(ctx context.Context, relays []*relay, queueDone <-chan struct{}) error {
+	var (
+		wg     sync.WaitGroup
+		forced atomic.Bool
+	)
+
+	for _, r := range relays {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			slog.WarnContext(ctx, "closing listener", slog.String("address", r.listener.String()))
+
+			if r.shutdown(ctx) != nil {
+				forced.Store(true)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if queueDone != nil {
+		select {
+		case <-queueDone:
+		case <-ctx.Done():
+			slog.WarnContext(ctx, "shutdown grace period expired, queue delivery still in progress")
+			forced.Store(true)
+		}
+	}
+
+	if forced.Load() {
+		return ErrShutdownTimeout
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//nolint:paralleltest
+func TestRelayEmbedded(t *testing.T) {
+	metricsRegistry = prometheus.NewRegistry()
+
+	// net/smtp requests SMTPUTF8 if the relay supports it
+	u := startFakeUpstream(t, "SMTPUTF8", "8BITMIME")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	r, err := New("", map[string]string{
+		"listen":           addr,
+		"metrics_listen":   "127.0.0.1:0",
+		"remote_host":      u.addr,
+		"shutdown_timeout": "1s",
+	})
+	require.NoError(t, err)
+
+	var senders []string
+
+	require.NoError(t, r.Use("tenant", StageRateLimit, func(next Handler) Handler {
+		return func(ctx context.Context, peer Peer, env Envelope) error {
+			if env.Sender == "mallory@example.com" {
+				return &Error{Code: 550, Msg: "Unknown tenant"}
+			}
+
+			senders = append(senders, env.Sender)
+
+			return next(ctx, peer, env)
+		}
+	}))
+
+	require.Error(t, r.Use("tenant", "", nil), "duplicate stage")
+	require.Error(t, r.Use("billing", "bogus", nil), "unknown stage")
+
+	require.NoError(t, r.Start(context.Background()))
+
+	err = smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"},
+		[]byte("Subject: hi\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+
+	err = smtp.SendMail(addr, nil, "mallory@example.com", []string{"bob@example.com"},
+		[]byte("Subject: hi\r\n\r\nhello\r\n"))
+	require.ErrorContains(t, err, "Unknown tenant")
+
+	assert.Equal(t, []string{"alice@example.com"}, senders)
+
+	_, msgs := u.received()
+	assert.Len(t, msgs, 1)
+
+	// the trace exporter gets up to 5s to flush the spans on shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	require.NoError(t, r.Stop(ctx))
+
+	_, err = net.Dial("tcp", addr)
+	require.Error(t, err)
+}
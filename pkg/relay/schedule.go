@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"context"
+	"log/slog"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// scheduleHeaders are the header fields asking for the delivery of the
+// message at a later time, in order of precedence
+var scheduleHeaders = []string{"X-Delay-Until", "X-Deliver-After"}
+
+var (
+	errScheduleInvalid = &smtpd.Error{Code: 554, EnhancedCode: "5.6.0", Msg: "Invalid scheduled delivery time"}
+	errScheduleTooLate = &smtpd.Error{Code: 554, EnhancedCode: "5.6.0", Msg: "Scheduled delivery time too far in the future"}
+	errScheduleFailed  = &smtpd.Error{Code: 451, EnhancedCode: "4.3.0", Msg: "Could not schedule message, try again later"}
+)
+
+type scheduleKey struct{}
+
+// scheduledDelivery returns the time the schedule stage deferred the delivery
+// of the message to, zero if it's delivered at once
+func scheduledDelivery(ctx context.Context) time.Time {
+	at, _ := ctx.Value(scheduleKey{}).(time.Time)
+	return at
+}
+
+// parseScheduleTime parses the value of a schedule header, an RFC 5322 date
+// (e.g. "Mon, 02 Jan 2006 15:04:05 -0700") or an RFC 3339 one (e.g.
+// "2006-01-02T15:04:05Z")
+func parseScheduleTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, nil
+	}
+
+	return mail.ParseDate(value)
+}
+
+// scheduleStage defers the delivery of the messages with an X-Delay-Until or
+// X-Deliver-After header to the time it gives, the message being queued until
+// then. The headers are removed, and times in the past are ignored. Messages
+// scheduled later than schedule_max_delay, or at invalid times, are rejected.
+func (r *relay) scheduleStage(next smtpd.Handler) smtpd.Handler {
+	return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+		cfg := r.config(ctx)
+		if cfg.scheduleMaxDelay <= 0 || r.shared.queue == nil {
+			return next(ctx, peer, env)
+		}
+
+		var value string
+
+		for _, key := range scheduleHeaders {
+			if value = env.Header.Get(key); value != "" {
+				break
+			}
+		}
+
+		if value == "" {
+			return next(ctx, peer, env)
+		}
+
+		logger := slog.With(slog.String("component", "schedule"), slog.String("uuid", messageUUID(ctx)))
+
+		at, err := parseScheduleTime(value)
+		if err != nil {
+			logger.InfoContext(ctx, "rejecting message with invalid scheduled delivery time",
+				slog.String("value", value), slog.Any("error", err))
+
+			return observeErr(ctx, errScheduleInvalid)
+		}
+
+		now := time.Now()
+
+		if at.Sub(now) > cfg.scheduleMaxDelay {
+			logger.InfoContext(ctx, "rejecting message scheduled too far in the future", slog.Time("at", at))
+			return observeErr(ctx, errScheduleTooLate)
+		}
+
+		if err := env.Buffer(); err != nil {
+			return err
+		}
+
+		header := textproto.MIMEHeader{}
+		for k, v := range env.Header {
+			header[k] = v
+		}
+
+		for _, key := range scheduleHeaders {
+			env.RemoveHeaders(key, func(string) bool { return true })
+			header.Del(key)
+		}
+
+		env.Header = header
+
+		if at.After(now) {
+			logger.InfoContext(ctx, "scheduling delivery", slog.Time("at", at))
+			ctx = context.WithValue(ctx, scheduleKey{}, at)
+		}
+
+		return next(ctx, peer, env)
+	}
+}
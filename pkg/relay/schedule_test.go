@@ -0,0 +1,99 @@
+package relay
+
+import (
+	"context"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScheduleTime(t *testing.T) {
+	t.Parallel()
+
+	expected := time.Date(2025, 1, 2, 9, 0, 0, 0, time.UTC)
+
+	for _, value := range []string{
+		"2025-01-02T09:00:00Z",
+		" 2025-01-02T10:00:00+01:00 ",
+		"Thu, 02 Jan 2025 09:00:00 +0000",
+		"2 Jan 2025 04:00:00 -0500",
+	} {
+		at, err := parseScheduleTime(value)
+		require.NoError(t, err, value)
+		assert.True(t, expected.Equal(at), value)
+	}
+
+	for _, value := range []string{"", "tomorrow", "2025-01-02"} {
+		_, err := parseScheduleTime(value)
+		require.Error(t, err, value)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	u := startFakeUpstream(t, "SMTPUTF8", "8BITMIME")
+
+	cfg := &config{
+		remoteHost:       u.addr,
+		queueDir:         t.TempDir(),
+		queueRetryMin:    time.Hour,
+		queueRetryMax:    time.Hour,
+		queueMaxAge:      time.Hour,
+		scheduleMaxDelay: 24 * time.Hour,
+	}
+
+	addr := startRelayConfig(ctx, t, "", cfg)
+
+	header := func(key string, at time.Time) textproto.MIMEHeader {
+		return textproto.MIMEHeader{key: {at.Format(time.RFC1123Z)}}
+	}
+
+	// messages scheduled too late, or at invalid times, are rejected
+	err := sendMsg(t, addr, []string{"alice@example.org"}, "bob@example.com", "test",
+		header("X-Delay-Until", time.Now().Add(48*time.Hour)), "hello")
+	require.ErrorContains(t, err, "Scheduled delivery time too far in the future")
+
+	err = sendMsg(t, addr, []string{"alice@example.org"}, "bob@example.com", "test",
+		textproto.MIMEHeader{"X-Deliver-After": {"tomorrow"}}, "hello")
+	require.ErrorContains(t, err, "Invalid scheduled delivery time")
+
+	// scheduled messages are queued until their time, without the header
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	require.NoError(t, sendMsg(t, addr, []string{"alice@example.org"}, "bob@example.com", "later",
+		header("X-Deliver-After", at), "hello"))
+
+	_, data := u.received()
+	assert.Empty(t, data)
+
+	q, err := newQueue(newConfigStore(cfg), nil)
+	require.NoError(t, err)
+
+	msgs, err := q.list()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.True(t, at.Equal(msgs[0].NextAttempt))
+	assert.Equal(t, []string{"alice@example.org"}, msgs[0].Recipients)
+
+	stored, err := os.ReadFile(q.dataPath(msgs[0].ID))
+	require.NoError(t, err)
+	assert.Contains(t, string(stored), "Subject: later")
+	assert.NotContains(t, string(stored), "X-Deliver-After")
+
+	// messages scheduled in the past are delivered at once
+	require.NoError(t, sendMsg(t, addr, []string{"alice@example.org"}, "bob@example.com", "now",
+		header("X-Delay-Until", time.Now().Add(-time.Hour)), "hello"))
+
+	_, data = u.received()
+	require.Len(t, data, 1)
+	assert.Contains(t, data[0], "Subject: now\n")
+	assert.NotContains(t, data[0], "X-Delay-Until")
+}
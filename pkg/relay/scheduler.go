@@ -0,0 +1,373 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// the limits of the destinations without one of their own
+const defaultDestination = "*"
+
+// Reasons deliveries are throttled, used as metric labels
+const (
+	throttledConcurrency = "concurrency" // no connection slot freed up in time
+	throttledRate        = "rate"        // the destination's rate was exceeded
+	throttledBackoff     = "backoff"     // the destination deferred a delivery
+)
+
+// scheduler limits the concurrent SMTP deliveries, globally and by
+// destination, and the rate of the deliveries to each destination. The
+// destination of a message is its recipient domain when it's delivered to the
+// MX hosts, or the upstream host name. Destinations replying 421 or 450 are
+// backed off: their deliveries are deferred for a while, doubled on each
+// consecutive deferral.
+type scheduler struct {
+	global      chan struct{}  // nil if the deliveries aren't limited
+	concurrency map[string]int // max concurrent deliveries, by destination
+	rates       *rateLimiter   // nil if the rates aren't limited
+
+	backoff    time.Duration // 0 to not back off
+	maxBackoff time.Duration
+
+	// waitMax is how long deliveries wait for a slot before they're deferred
+	waitMax time.Duration
+
+	// now overrides the current time - for tests
+	now func() time.Time
+
+	mu           sync.Mutex
+	destinations map[string]*destination
+
+	logger *slog.Logger
+}
+
+// destination is the state of the deliveries to a destination, dropped once
+// it has no deliveries and its last backoff is long over
+type destination struct {
+	slots     chan struct{} // nil if the deliveries aren't limited
+	users     int           // deliveries holding or waiting for a slot
+	deferrals int           // consecutive 421 or 450 replies
+	until     time.Time     // deliveries are deferred until then
+}
+
+// newScheduler returns nil if there are no limits at all. The
+// destination limits are domain=N pairs separated by spaces, * setting the
+// limit of the other destinations, with rates in deliveries per minute.
+func newScheduler(concurrency int, destConcurrency, destRates string,
+	backoff, maxBackoff, waitMax time.Duration,
+) (*scheduler, error) {
+	perDest, err := parseDestinationLimits(destConcurrency)
+	if err != nil {
+		return nil, fmt.Errorf("invalid delivery_domain_concurrency: %w", err)
+	}
+
+	rates, err := parseDestinationLimits(destRates)
+	if err != nil {
+		return nil, fmt.Errorf("invalid delivery_domain_rate: %w", err)
+	}
+
+	if concurrency <= 0 && len(perDest) == 0 && len(rates) == 0 && backoff <= 0 {
+		return nil, nil
+	}
+
+	s := &scheduler{
+		concurrency:  perDest,
+		backoff:      backoff,
+		maxBackoff:   max(maxBackoff, backoff),
+		waitMax:      waitMax,
+		now:          time.Now,
+		destinations: map[string]*destination{},
+		logger:       slog.Default().With(slog.String("component", "scheduler")),
+	}
+
+	if concurrency > 0 {
+		s.global = make(chan struct{}, concurrency)
+	}
+
+	if len(rates) > 0 {
+		limits := make(map[string]float64, len(rates))
+		for dest, limit := range rates {
+			limits[dest] = float64(limit)
+		}
+
+		s.rates = newRateLimiter(time.Minute, limits)
+	}
+
+	return s, nil
+}
+
+// parseDestinationLimits parses domain=N pairs, separated by spaces
+func parseDestinationLimits(s string) (map[string]int, error) {
+	limits := map[string]int{}
+
+	for _, entry := range splitstr(s, ' ') {
+		dest, val, ok := strings.Cut(entry, "=")
+		if !ok || dest == "" {
+			return nil, fmt.Errorf("invalid limit %q, expected domain=limit", entry)
+		}
+
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit %q, expected a positive number", entry)
+		}
+
+		limits[strings.ToLower(dest)] = limit
+	}
+
+	return limits, nil
+}
+
+// destinationOf returns the destination of the message: its recipient domain
+// when it's delivered to the MX hosts, or the name of its upstream host
+func destinationOf(out *outbound) string {
+	if domain, ok := strings.CutPrefix(out.Host, mxScheme); ok {
+		return strings.ToLower(domain)
+	}
+
+	host, _, err := net.SplitHostPort(out.Host)
+	if err != nil {
+		host = out.Host
+	}
+
+	return strings.ToLower(host)
+}
+
+// deliver runs send once the destination of the message is free to be
+// delivered to, and backs it off if it replies 421 or 450. The delivery is
+// deferred with a temporary error if the destination is backed off, or if no
+// slot frees up within waitMax.
+func (s *scheduler) deliver(ctx context.Context, out *outbound, send func() error) error {
+	if s == nil {
+		return send()
+	}
+
+	dest := destinationOf(out)
+
+	release, err := s.acquire(ctx, dest)
+	if err != nil {
+		return err
+	}
+
+	err = send()
+	release(err)
+
+	return err
+}
+
+// acquire waits for a slot to deliver to the destination, and returns the
+// function releasing it with the result of the delivery
+func (s *scheduler) acquire(ctx context.Context, dest string) (func(error), error) {
+	s.mu.Lock()
+
+	d := s.destination(dest)
+	if until := d.until; s.now().Before(until) {
+		s.leave(dest, d)
+		s.mu.Unlock()
+
+		return nil, s.throttled(ctx, dest, throttledBackoff, until)
+	}
+
+	s.mu.Unlock()
+
+	if s.waitMax > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, s.waitMax)
+		defer cancel()
+	}
+
+	fail := func(reason string, slot bool) (func(error), error) {
+		if slot {
+			<-d.slots
+		}
+
+		s.mu.Lock()
+		s.leave(dest, d)
+		s.mu.Unlock()
+
+		return nil, s.throttled(ctx, dest, reason, time.Time{})
+	}
+
+	if !s.takeRate(ctx, dest) {
+		return fail(throttledRate, false)
+	}
+
+	// the destination's slot is taken first, so deliveries waiting for a busy
+	// destination don't hold the global slots the other ones could use
+	if d.slots != nil {
+		select {
+		case d.slots <- struct{}{}:
+		case <-ctx.Done():
+			return fail(throttledConcurrency, false)
+		}
+	}
+
+	if s.global != nil {
+		select {
+		case s.global <- struct{}{}:
+		case <-ctx.Done():
+			return fail(throttledConcurrency, d.slots != nil)
+		}
+	}
+
+	return func(err error) {
+		if s.global != nil {
+			<-s.global
+		}
+
+		if d.slots != nil {
+			<-d.slots
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if deferredReply(err) {
+			s.deferred(dest, d)
+		} else {
+			d.deferrals, d.until = 0, time.Time{}
+		}
+
+		s.leave(dest, d)
+	}, nil
+}
+
+// takeRate takes a token from the rate bucket of the destination, waiting for
+// one to be refilled until ctx is done
+func (s *scheduler) takeRate(ctx context.Context, dest string) bool {
+	if s.rates == nil {
+		return true
+	}
+
+	key := dest
+	if _, ok := s.rates.limits[dest]; !ok {
+		key = defaultDestination
+	}
+
+	limit, ok := s.rates.limits[key]
+	if !ok {
+		return true
+	}
+
+	values := map[string]string{key: dest}
+
+	// a token is refilled every period/limit
+	interval := time.Duration(float64(s.rates.period) / limit)
+
+	for {
+		if _, ok := s.rates.take(ctx, values, nil, 1, s.now()); ok {
+			return true
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// destination returns the state of the destination, creating it if needed,
+// and counts a new delivery to it. s.mu must be held.
+func (s *scheduler) destination(dest string) *destination {
+	d, ok := s.destinations[dest]
+	if !ok {
+		d = &destination{}
+
+		limit, ok := s.concurrency[dest]
+		if !ok {
+			limit = s.concurrency[defaultDestination]
+		}
+
+		if limit > 0 {
+			d.slots = make(chan struct{}, limit)
+		}
+
+		s.destinations[dest] = d
+	}
+
+	d.users++
+
+	return d
+}
+
+// deferred backs the destination off after a 421 or 450 reply, unless it's
+// backed off already by a concurrent delivery. s.mu must be held.
+func (s *scheduler) deferred(dest string, d *destination) {
+	now := s.now()
+	if s.backoff <= 0 || now.Before(d.until) {
+		return
+	}
+
+	delay := s.backoff << min(d.deferrals, 30)
+	if delay <= 0 || delay > s.maxBackoff {
+		delay = s.maxBackoff
+	}
+
+	d.deferrals++
+	d.until = now.Add(delay)
+
+	s.logger.Warn("destination deferred a delivery, backing off",
+		slog.String("destination", dest),
+		slog.Int("deferrals", d.deferrals),
+		slog.Duration("delay", delay))
+}
+
+// leave counts a delivery to the destination as done, and drops the
+// destination's state once it has no deliveries and its last backoff is long
+// over. s.mu must be held.
+func (s *scheduler) leave(dest string, d *destination) {
+	d.users--
+
+	if d.users == 0 && (d.until.IsZero() || s.now().Sub(d.until) >= s.maxBackoff) {
+		delete(s.destinations, dest)
+	}
+}
+
+// throttled counts and logs a throttled delivery, and returns the temporary
+// error deferring it
+func (s *scheduler) throttled(ctx context.Context, dest, reason string, until time.Time) error {
+	deliveryThrottledCounter.WithLabelValues(reason).Inc()
+
+	log := s.logger.With(slog.String("destination", dest), slog.String("reason", reason))
+	if !until.IsZero() {
+		log = log.With(slog.Time("until", until))
+	}
+
+	log.InfoContext(ctx, "delivery throttled")
+
+	return &smtpd.Error{
+		Code:         451,
+		EnhancedCode: "4.4.5",
+		Msg:          fmt.Sprintf("Deliveries to %s are throttled, try again later", dest),
+	}
+}
+
+// deferredReply reports whether the delivery was deferred by the destination
+// with a 421 or 450 reply, as opposed to partially accepted or failed
+// otherwise
+func deferredReply(err error) bool {
+	var (
+		tperr   *textproto.Error
+		smtpErr *smtpd.Error
+	)
+
+	switch {
+	case errors.As(err, &tperr):
+		return tperr.Code == 421 || tperr.Code == 450
+	case errors.As(err, &smtpErr):
+		return smtpErr.Code == 421 || smtpErr.Code == 450
+	default:
+		return false
+	}
+}
@@ -0,0 +1,215 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/textproto"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewScheduler(t *testing.T) {
+	t.Parallel()
+
+	s, err := newScheduler(0, "", "", 0, time.Minute, time.Second)
+	require.NoError(t, err)
+	assert.Nil(t, s)
+
+	for _, bad := range []string{"gmail.com", "=2", "gmail.com=0", "gmail.com=x"} {
+		_, err = newScheduler(0, bad, "", 0, 0, 0)
+		require.Error(t, err, bad)
+
+		_, err = newScheduler(0, "", bad, 0, 0, 0)
+		require.Error(t, err, bad)
+	}
+
+	s, err = newScheduler(10, "Gmail.com=2 *=5", "yahoo.com=10", time.Minute, time.Second, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, 10, cap(s.global))
+	assert.Equal(t, map[string]int{"gmail.com": 2, "*": 5}, s.concurrency)
+	assert.Equal(t, map[string]float64{"yahoo.com": 10}, s.rates.limits)
+	assert.Equal(t, time.Minute, s.maxBackoff)
+}
+
+func TestDestinationOf(t *testing.T) {
+	t.Parallel()
+
+	for host, expected := range map[string]string{
+		"mx://Gmail.com":         "gmail.com",
+		"smtp.example.com:587":   "smtp.example.com",
+		"[2001:db8::1]:25":       "2001:db8::1",
+		"smtp.example.com":       "smtp.example.com",
+		"SMTP.example.com:25000": "smtp.example.com",
+	} {
+		assert.Equal(t, expected, destinationOf(&outbound{Host: host}), host)
+	}
+}
+
+func TestSchedulerConcurrency(t *testing.T) {
+	t.Parallel()
+
+	s, err := newScheduler(3, "gmail.com=2", "", 0, 0, 50*time.Millisecond)
+	require.NoError(t, err)
+
+	gmail := &outbound{Host: "mx://gmail.com"}
+	other := &outbound{Host: "mx://example.com"}
+
+	var (
+		wg     sync.WaitGroup
+		active atomic.Int32
+	)
+
+	started := make(chan struct{}, 3)
+	unblock := make(chan struct{})
+
+	send := func() error {
+		active.Add(1)
+		started <- struct{}{}
+		<-unblock
+
+		return nil
+	}
+
+	for _, out := range []*outbound{gmail, gmail, other} {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.deliver(context.Background(), out, send))
+		}()
+	}
+
+	for range 3 {
+		<-started
+	}
+
+	assert.Equal(t, int32(3), active.Load())
+
+	// the destination and global limits are reached
+	var smtpErr *smtpd.Error
+
+	err = s.deliver(context.Background(), gmail, func() error { return nil })
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 451, smtpErr.Code)
+
+	err = s.deliver(context.Background(), &outbound{Host: "mx://example.org"}, func() error { return nil })
+	require.Error(t, err)
+
+	close(unblock)
+	wg.Wait()
+
+	require.NoError(t, s.deliver(context.Background(), gmail, func() error { return nil }))
+
+	// unused destinations are dropped
+	assert.Empty(t, s.destinations)
+}
+
+func TestSchedulerRate(t *testing.T) {
+	t.Parallel()
+
+	s, err := newScheduler(0, "", "yahoo.com=2", 0, 0, 20*time.Millisecond)
+	require.NoError(t, err)
+
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	yahoo := &outbound{Host: "mx://yahoo.com"}
+	sent := 0
+	send := func() error { sent++; return nil }
+
+	require.NoError(t, s.deliver(context.Background(), yahoo, send))
+	require.NoError(t, s.deliver(context.Background(), yahoo, send))
+	require.Error(t, s.deliver(context.Background(), yahoo, send))
+
+	// other destinations aren't limited
+	require.NoError(t, s.deliver(context.Background(), &outbound{Host: "mx://example.com"}, send))
+
+	now = now.Add(30 * time.Second)
+	require.NoError(t, s.deliver(context.Background(), yahoo, send))
+
+	assert.Equal(t, 4, sent)
+}
+
+func TestSchedulerBackoff(t *testing.T) {
+	t.Parallel()
+
+	s, err := newScheduler(0, "", "", time.Minute, 3*time.Minute, time.Second)
+	require.NoError(t, err)
+
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	out := &outbound{Host: "mx://example.com"}
+	deferred := &textproto.Error{Code: 421, Msg: "4.7.0 Try again later"}
+
+	sent := 0
+	reply := func(err error) func() error {
+		return func() error { sent++; return err }
+	}
+
+	// each consecutive deferral doubles the backoff, up to the max
+	for _, delay := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		require.Equal(t, deferred, s.deliver(context.Background(), out, reply(deferred)))
+
+		now = now.Add(delay - time.Second)
+		err := s.deliver(context.Background(), out, reply(nil))
+
+		var smtpErr *smtpd.Error
+		require.ErrorAs(t, err, &smtpErr)
+		assert.Equal(t, "4.4.5", smtpErr.EnhancedCode)
+
+		now = now.Add(time.Second)
+	}
+
+	assert.Equal(t, 4, sent)
+
+	// the backoff is reset once the destination accepts a message
+	require.NoError(t, s.deliver(context.Background(), out, reply(nil)))
+	require.Error(t, s.deliver(context.Background(), out, reply(&smtpd.Error{Code: 450, Msg: "Busy"})))
+
+	now = now.Add(time.Minute)
+	require.NoError(t, s.deliver(context.Background(), out, reply(nil)))
+
+	// other failures and partial deliveries don't back off
+	require.Error(t, s.deliver(context.Background(), out, reply(&textproto.Error{Code: 451, Msg: "Local error"})))
+	require.Error(t, s.deliver(context.Background(), out, reply(recipientErrors{"bob@example.com": deferred})))
+	require.Error(t, s.deliver(context.Background(), out, reply(errors.New("connection refused"))))
+	require.NoError(t, s.deliver(context.Background(), out, reply(nil)))
+
+	assert.Empty(t, s.destinations)
+}
+
+func TestSchedulerUpstream(t *testing.T) {
+	t.Parallel()
+
+	u := startFakeUpstream(t)
+	u.setReply("MAIL", "421 4.7.0 Too many connections")
+
+	s, err := newScheduler(0, "", "", time.Minute, time.Hour, time.Second)
+	require.NoError(t, err)
+
+	cfg := &config{hostName: "relay.example.com", scheduler: s}
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+
+	out := *testOutbound
+	out.Host = u.addr
+
+	var p *upstreamPool
+
+	err = p.send(context.Background(), cfg, &out, bytes.NewReader(data))
+	require.ErrorContains(t, err, "421")
+	assert.True(t, isTemporaryErr(err))
+
+	// the upstream isn't connected to while it's backed off
+	err = p.send(context.Background(), cfg, &out, bytes.NewReader(data))
+	require.ErrorContains(t, err, "throttled")
+	assert.True(t, isTemporaryErr(err))
+	assert.Equal(t, 1, u.sessions())
+}
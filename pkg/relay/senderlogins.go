@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+var errSenderNotOwned = &smtpd.Error{Code: 553, EnhancedCode: "5.7.1", Msg: "Sender address not owned by the authenticated user"}
+
+// senderLogin is an entry of the sender login map: the users owning the
+// addresses matching the pattern
+type senderLogin struct {
+	pattern string // as written in the file
+	re      *regexp.Regexp
+	users   []string // lowercased
+}
+
+// senderLogins restricts the sender addresses authenticated users may use to
+// the ones they own, like smtpd_sender_login_maps with
+// reject_sender_login_mismatch in Postfix. Unauthenticated clients aren't
+// restricted.
+type senderLogins []senderLogin
+
+// loadSenderLoginsFile reads the sender login map from file. Each line should
+// be in the form "pattern user[, user...]", where the pattern is either an
+// address, a domain prefixed with "@" (e.g. "@example.com"), an address with
+// "*" wildcards (e.g. "alice+*@example.com"), or a regular expression between
+// slashes (e.g. "/^(alice|bob)@example\.com$/"), and the users owning the
+// matching addresses are separated by commas or spaces. Patterns and users
+// are case-insensitive. Empty lines and lines starting with "#" are ignored.
+func loadSenderLoginsFile(file string) (senderLogins, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var logins senderLogins
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// patterns may contain commas, but not spaces
+		pattern, users := line, ""
+		if idx := strings.IndexAny(line, " \t"); idx != -1 {
+			pattern, users = line[:idx], line[idx+1:]
+		}
+
+		fields := strings.FieldsFunc(strings.ToLower(users), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("line %d: expected \"pattern user[, user...]\"", n)
+		}
+
+		re, err := senderLoginPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid pattern %q: %w", n, pattern, err)
+		}
+
+		logins = append(logins, senderLogin{pattern: pattern, re: re, users: fields})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return logins, nil
+}
+
+// senderLoginPattern compiles a pattern of the sender login map
+func senderLoginPattern(pattern string) (*regexp.Regexp, error) {
+	switch {
+	case len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		return regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+	case strings.Contains(pattern, "*"):
+		return regexp.Compile("(?i)^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+	case strings.HasPrefix(pattern, "@") && len(pattern) > 1:
+		return regexp.Compile("(?i)^.*" + regexp.QuoteMeta(pattern) + "$")
+	case strings.Contains(pattern, "@") && !strings.HasSuffix(pattern, "@"):
+		return regexp.Compile("(?i)^" + regexp.QuoteMeta(pattern) + "$")
+	default:
+		return nil, fmt.Errorf("expected an address, @domain, wildcard or /regexp/")
+	}
+}
+
+// owners returns the users owning the address, from all the entries matching
+// it
+func (l senderLogins) owners(addr string) []string {
+	var users []string
+
+	for _, login := range l {
+		if login.re.MatchString(addr) {
+			users = append(users, login.users...)
+		}
+	}
+
+	return users
+}
+
+// check rejects the sender address if the peer is authenticated as a user
+// which doesn't own it. The null sender of bounces isn't checked.
+func (l senderLogins) check(ctx context.Context, peer smtpd.Peer, addr string) error {
+	if l == nil || peer.Username == "" || addr == "" {
+		return nil
+	}
+
+	if slices.Contains(l.owners(addr), strings.ToLower(peer.Username)) {
+		return nil
+	}
+
+	slog.WarnContext(ctx, "sender address not owned by the user",
+		slog.String("component", "sender_logins"),
+		slog.String("sender_address", addr),
+		slog.String("username", peer.Username),
+	)
+
+	return observeErr(ctx, errSenderNotOwned)
+}
@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSenderLoginsFile(t *testing.T) {
+	t.Parallel()
+
+	l, err := loadSenderLoginsFile(writeTestFile(t, "sender_logins", `
+# comment
+Alice@example.com    Alice, postmaster
+@example.org	bob
+carol+*@example.com carol
+/^(dave|erin)@example\.net$/ dave,erin
+/^x{1,3}@example\.net$/ xavier
+`))
+	require.NoError(t, err)
+	require.Len(t, l, 5)
+
+	assert.Equal(t, []string{"alice", "postmaster"}, l.owners("alice@EXAMPLE.com"))
+	assert.Equal(t, []string{"bob"}, l.owners("anyone@example.org"))
+	assert.Empty(t, l.owners("anyone@sub.example.org"))
+	assert.Equal(t, []string{"carol"}, l.owners("carol+news@example.com"))
+	assert.Empty(t, l.owners("carol@example.com"))
+	assert.Equal(t, []string{"dave", "erin"}, l.owners("erin@example.net"))
+	assert.Equal(t, []string{"xavier"}, l.owners("xx@example.net"))
+	assert.Empty(t, l.owners("frank@example.net"))
+
+	for _, content := range []string{
+		"alice@example.com",
+		"alice alice",
+		"alice@ alice",
+		"@ alice",
+		"/(/ alice",
+	} {
+		_, err = loadSenderLoginsFile(writeTestFile(t, "sender_logins", content))
+		require.Error(t, err, content)
+	}
+
+	_, err = loadSenderLoginsFile(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
+
+func TestSenderLoginsCheck(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	l, err := loadSenderLoginsFile(writeTestFile(t, "sender_logins", `
+alice@example.com alice
+@example.com postmaster
+`))
+	require.NoError(t, err)
+
+	alice := smtpd.Peer{Username: "Alice"}
+
+	require.NoError(t, l.check(ctx, alice, "alice@example.com"))
+	require.ErrorIs(t, l.check(ctx, alice, "bob@example.com"), errSenderNotOwned)
+	require.ErrorIs(t, l.check(ctx, alice, "alice@example.org"), errSenderNotOwned)
+
+	// several users may own an address
+	require.NoError(t, l.check(ctx, smtpd.Peer{Username: "postmaster"}, "alice@example.com"))
+
+	// unauthenticated clients and bounces aren't restricted
+	require.NoError(t, l.check(ctx, smtpd.Peer{}, "alice@example.com"))
+	require.NoError(t, l.check(ctx, alice, ""))
+
+	// nor is anyone without a map
+	require.NoError(t, senderLogins(nil).check(ctx, alice, "bob@example.com"))
+}
@@ -0,0 +1,222 @@
+package relay
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"slices"
+	"strings"
+)
+
+// SubmitTest submits a test message for the recipients to the relay itself,
+// through its first SMTP listener which takes messages without
+// authentication, the way a client would, and writes the SMTP transcript to
+// w. STARTTLS is used when the listener offers it. The relay must be
+// running, e.g. to check a deployment end to end.
+func (r *Relay) SubmitTest(ctx context.Context, w io.Writer, recipients []string) error {
+	if len(recipients) == 0 {
+		return errors.New("no recipients")
+	}
+
+	cfg := r.cfg
+
+	listeners, err := parseListeners(cfg.listen, cfg)
+	if err != nil {
+		return fmt.Errorf("error parsing listen addresses: %w", err)
+	}
+
+	i := slices.IndexFunc(listeners, func(l listenerConfig) bool {
+		return l.scheme != schemeLMTP && !l.auth && !l.proxy
+	})
+	if i < 0 {
+		return errors.New("no listener takes messages without authentication or the PROXY protocol")
+	}
+
+	l := listeners[i]
+	addr := localAddr(l.address)
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	fmt.Fprintf(w, "-- connecting to %s (%s)\n", addr, l.scheme)
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	hostName := cmp.Or(cfg.hostName, "localhost")
+
+	//nolint:gosec // the relay is connected to by address, its certificate is checked by check-config
+	tlsConfig := &tls.Config{ServerName: hostName, InsecureSkipVerify: true}
+
+	if l.scheme == schemeSMTPS {
+		if conn, err = startTestTLS(ctx, w, conn, tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	text := textproto.NewConn(&transcriptConn{Conn: conn, w: w})
+
+	if _, _, err = text.ReadResponse(220); err != nil {
+		return err
+	}
+
+	ext, err := ehlo(text, hostName)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := ext["STARTTLS"]; ok && l.scheme != schemeSMTPS {
+		if err = cmd(text, 220, "STARTTLS"); err != nil {
+			return err
+		}
+
+		if conn, err = startTestTLS(ctx, w, conn, tlsConfig); err != nil {
+			return err
+		}
+
+		text = textproto.NewConn(&transcriptConn{Conn: conn, w: w})
+
+		if _, err = ehlo(text, hostName); err != nil {
+			return err
+		}
+	}
+
+	sender, msg := testMessage(cfg, recipients)
+
+	if err = cmd(text, 250, "MAIL FROM:<%s>", sender); err != nil {
+		return err
+	}
+
+	for _, rcpt := range recipients {
+		if err = cmd(text, 25, "RCPT TO:<%s>", rcpt); err != nil {
+			return err
+		}
+	}
+
+	if err = cmd(text, 354, "DATA"); err != nil {
+		return err
+	}
+
+	dw := text.DotWriter()
+	if _, err = dw.Write(msg); err != nil {
+		return err
+	}
+
+	if err = dw.Close(); err != nil {
+		return err
+	}
+
+	if _, _, err = text.ReadResponse(250); err != nil {
+		return err
+	}
+
+	return cmd(text, 221, "QUIT")
+}
+
+// localAddr returns the address the relay is connected to on a listen
+// address, the loopback one for the unspecified addresses
+func localAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+
+	switch ip := net.ParseIP(host); {
+	case host == "", ip != nil && ip.Equal(net.IPv4zero):
+		host = "127.0.0.1"
+	case ip != nil && ip.IsUnspecified():
+		host = "::1"
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// ehlo greets the server, and returns the extensions it supports
+func ehlo(text *textproto.Conn, hostName string) (map[string]string, error) {
+	id, err := text.Cmd("EHLO %s", hostName)
+	if err != nil {
+		return nil, err
+	}
+
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+
+	_, msg, err := text.ReadResponse(250)
+	if err != nil {
+		return nil, err
+	}
+
+	ext := map[string]string{}
+
+	// the first line is the greeting
+	for _, line := range strings.Split(msg, "\n")[1:] {
+		keyword, param, _ := strings.Cut(line, " ")
+		ext[strings.ToUpper(keyword)] = param
+	}
+
+	return ext, nil
+}
+
+// startTestTLS starts TLS on the connection, and notes it in the transcript
+func startTestTLS(ctx context.Context, w io.Writer, conn net.Conn, config *tls.Config) (net.Conn, error) {
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+
+	state := tc.ConnectionState()
+	fmt.Fprintf(w, "-- TLS started: %s, %s\n", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+
+	return tc, nil
+}
+
+// transcriptConn writes the lines read from the connection to w prefixed
+// with "S: ", and the ones written to it prefixed with "C: "
+type transcriptConn struct {
+	net.Conn
+	w io.Writer
+
+	read, written []byte // partial lines
+}
+
+func (c *transcriptConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read = c.transcribe("S: ", append(c.read, p[:n]...))
+
+	return n, err
+}
+
+func (c *transcriptConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written = c.transcribe("C: ", append(c.written, p[:n]...))
+
+	return n, err
+}
+
+// transcribe writes the complete lines of buf, and returns the rest
+func (c *transcriptConn) transcribe(prefix string, buf []byte) []byte {
+	for {
+		line, rest, found := bytes.Cut(buf, []byte("\n"))
+		if !found {
+			return buf
+		}
+
+		fmt.Fprintf(c.w, "%s%s\n", prefix, bytes.TrimSuffix(line, []byte("\r")))
+		buf = rest
+	}
+}
+
+var _ net.Conn = (*transcriptConn)(nil)
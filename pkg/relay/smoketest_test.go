@@ -0,0 +1,65 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelaySubmitTest(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	u := startFakeUpstream(t, "SMTPUTF8", "8BITMIME")
+
+	certpath, keypath := writeTestCert(t, t.TempDir(), "relay.example.com")
+
+	cfg := &config{
+		hostName:   "relay.example.com",
+		localCert:  certpath,
+		localKey:   keypath,
+		remoteHost: u.addr,
+	}
+	startRelayConfig(ctx, t, "starttls", cfg)
+
+	var out bytes.Buffer
+	require.NoError(t, fromConfig(cfg).SubmitTest(ctx, &out, []string{"alice@example.com"}))
+
+	transcript := out.String()
+	assert.Contains(t, transcript, "C: STARTTLS\n")
+	assert.Contains(t, transcript, "-- TLS started: TLS 1.3")
+	assert.Contains(t, transcript, "C: MAIL FROM:<postmaster@relay.example.com>")
+	assert.Contains(t, transcript, "C: Subject: smtprelay test message\n")
+	assert.Contains(t, transcript, "S: 221 ")
+
+	_, msgs := u.received()
+	require.Len(t, msgs, 1)
+	assert.Contains(t, msgs[0], "Subject: smtprelay test message")
+
+	// the delivery errors end the transcript with an error
+	u.setReply("RCPT", "550 5.1.1 no such user")
+
+	out.Reset()
+	require.Error(t, fromConfig(cfg).SubmitTest(ctx, &out, []string{"bob@example.com"}))
+	assert.Contains(t, out.String(), "S: 550 5.1.1 no such user\n")
+
+	require.Error(t, fromConfig(cfg).SubmitTest(ctx, &out, nil))
+
+	cfg = &config{listen: "127.0.0.1:25?proxy_protocol=true lmtp://127.0.0.1:24"}
+	require.ErrorContains(t, fromConfig(cfg).SubmitTest(ctx, &out, []string{"alice@example.com"}), "no listener")
+}
+
+func TestLocalAddr(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "127.0.0.1:25", localAddr(":25"))
+	assert.Equal(t, "127.0.0.1:25", localAddr("0.0.0.0:25"))
+	assert.Equal(t, "[::1]:25", localAddr("[::]:25"))
+	assert.Equal(t, "192.0.2.1:25", localAddr("192.0.2.1:25"))
+	assert.Equal(t, "[2001:db8::1]:587", localAddr("[2001:db8::1]:587"))
+}
@@ -0,0 +1,172 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// SPF policies
+const (
+	spfPolicyReject        = "reject"         // reject fail and softfail results
+	spfPolicySoftfailAllow = "softfail-allow" // reject fail results only
+	spfPolicyLogOnly       = "log-only"       // never reject, only log and add the header
+)
+
+// how long SPF results are kept, so the Received-SPF header can be added to
+// the message without evaluating the sender's policy again
+const spfCacheTTL = 5 * time.Minute
+
+// spfResult is the outcome of an SPF check for a peer and sender
+type spfResult struct {
+	result  spf.Result
+	err     error
+	ip      net.IP
+	sender  string
+	helo    string
+	expires time.Time
+}
+
+// spfChecker verifies that the peer is allowed to send mail for the MAIL FROM
+// domain (or the HELO name, for the null sender) according to its SPF record
+type spfChecker struct {
+	policy string
+
+	// resolver overrides the DNS resolver - for tests
+	resolver spf.DNSResolver
+
+	mu    sync.Mutex
+	cache map[string]*spfResult
+
+	logger *slog.Logger
+}
+
+func newSPFChecker(policy string) (*spfChecker, error) {
+	switch policy {
+	case spfPolicyReject, spfPolicySoftfailAllow, spfPolicyLogOnly:
+	default:
+		return nil, fmt.Errorf("unknown SPF policy %q", policy)
+	}
+
+	return &spfChecker{
+		policy: policy,
+		cache:  map[string]*spfResult{},
+		logger: slog.Default().With(slog.String("component", "spf")),
+	}, nil
+}
+
+// check evaluates the SPF record of the sender domain for the peer, and
+// returns the SMTP error to reply with if the policy says the sender should
+// be rejected
+func (c *spfChecker) check(ctx context.Context, peer smtpd.Peer, sender string) error {
+	res := c.result(ctx, peer, sender)
+
+	log := c.logger.With(
+		slog.String("ip", res.ip.String()),
+		slog.String("sender_address", sender),
+		slog.String("spf_result", string(res.result)),
+	)
+
+	if res.err != nil {
+		log = log.With(slog.Any("error", res.err))
+	}
+
+	switch {
+	case res.result == spf.Fail && c.policy != spfPolicyLogOnly,
+		res.result == spf.SoftFail && c.policy == spfPolicyReject:
+		log.WarnContext(ctx, "SPF check failed, rejecting sender")
+
+		return observeErr(ctx, smtpd.ErrSPFFail)
+	case res.result == spf.TempError && c.policy != spfPolicyLogOnly:
+		log.WarnContext(ctx, "SPF check failed temporarily, deferring sender")
+
+		return observeErr(ctx, smtpd.ErrSPFTempError)
+	}
+
+	log.DebugContext(ctx, "SPF check done")
+
+	return nil
+}
+
+// result returns the SPF result for the peer and sender, evaluating the
+// sender's policy if it isn't cached
+func (c *spfChecker) result(ctx context.Context, peer smtpd.Peer, sender string) *spfResult {
+	ip := peerIP(peer)
+	key := ip.String() + " " + peer.HeloName + " " + sender
+	now := time.Now()
+
+	c.mu.Lock()
+	res, ok := c.cache[key]
+	c.mu.Unlock()
+
+	if ok && now.Before(res.expires) {
+		return res
+	}
+
+	opts := []spf.Option{spf.WithContext(ctx)}
+	if c.resolver != nil {
+		opts = append(opts, spf.WithResolver(c.resolver))
+	}
+
+	result, err := spf.CheckHostWithSender(ip, peer.HeloName, sender, opts...)
+
+	res = &spfResult{
+		result:  result,
+		err:     err,
+		ip:      ip,
+		sender:  sender,
+		helo:    peer.HeloName,
+		expires: now.Add(spfCacheTTL),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, r := range c.cache {
+		if now.After(r.expires) {
+			delete(c.cache, k)
+		}
+	}
+
+	c.cache[key] = res
+
+	return res
+}
+
+// header returns the value of the Received-SPF header for the result (RFC
+// 7208 section 9.1)
+func (res *spfResult) header(hostname string) string {
+	sender := res.sender
+	if sender == "" {
+		sender = "<>"
+	}
+
+	fields := []string{
+		string(res.result),
+		fmt.Sprintf("client-ip=%s;", res.ip),
+		fmt.Sprintf("envelope-from=%q;", sender),
+		fmt.Sprintf("helo=%s;", res.helo),
+	}
+
+	if hostname != "" {
+		fields = append(fields, fmt.Sprintf("receiver=%s;", hostname))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// peerIP returns the IP address of the peer, or nil for non-TCP peers
+func peerIP(peer smtpd.Peer) net.IP {
+	if addr, ok := peer.Addr.(*net.TCPAddr); ok {
+		return addr.IP
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver resolves TXT records from a map, and nothing else
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if txt, ok := r[name]; ok {
+		return txt, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestSPFChecker(t *testing.T) {
+	t.Parallel()
+
+	resolver := fakeResolver{
+		"pass.example.com":     {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"fail.example.com":     {"v=spf1 ip4:198.51.100.1 -all"},
+		"softfail.example.com": {"v=spf1 ip4:198.51.100.1 ~all"},
+	}
+
+	peer := smtpd.Peer{
+		HeloName: "client.example.com",
+		Addr:     &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345},
+	}
+
+	testCases := []struct {
+		policy string
+		sender string
+		result spf.Result
+		err    error
+	}{
+		{spfPolicyReject, "bob@pass.example.com", spf.Pass, nil},
+		{spfPolicyReject, "bob@fail.example.com", spf.Fail, smtpd.ErrSPFFail},
+		{spfPolicyReject, "bob@softfail.example.com", spf.SoftFail, smtpd.ErrSPFFail},
+		{spfPolicyReject, "bob@none.example.com", spf.None, nil},
+		{spfPolicySoftfailAllow, "bob@fail.example.com", spf.Fail, smtpd.ErrSPFFail},
+		{spfPolicySoftfailAllow, "bob@softfail.example.com", spf.SoftFail, nil},
+		{spfPolicyLogOnly, "bob@fail.example.com", spf.Fail, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.policy+" "+tc.sender, func(t *testing.T) {
+			t.Parallel()
+
+			c, err := newSPFChecker(tc.policy)
+			require.NoError(t, err)
+
+			c.resolver = resolver
+
+			err = c.check(context.Background(), peer, tc.sender)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			res := c.result(context.Background(), peer, tc.sender)
+			assert.Equal(t, tc.result, res.result)
+		})
+	}
+
+	_, err := newSPFChecker("strict")
+	require.EqualError(t, err, `unknown SPF policy "strict"`)
+}
+
+func TestSPFResultHeader(t *testing.T) {
+	t.Parallel()
+
+	res := &spfResult{
+		result: spf.Pass,
+		ip:     net.ParseIP("192.0.2.10"),
+		sender: "bob@example.com",
+		helo:   "client.example.com",
+	}
+
+	assert.Equal(t,
+		`pass client-ip=192.0.2.10; envelope-from="bob@example.com"; helo=client.example.com; receiver=relay.example.com;`,
+		res.header("relay.example.com"))
+
+	res.sender = ""
+	assert.Equal(t,
+		`pass client-ip=192.0.2.10; envelope-from="<>"; helo=client.example.com;`,
+		res.header(""))
+}
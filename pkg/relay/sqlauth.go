@@ -0,0 +1,217 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	// SQL drivers of the sql_driver config
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// SQL drivers
+const (
+	sqlDriverPostgres = "postgres"
+	sqlDriverMySQL    = "mysql"
+)
+
+// default queries of the user of a username, by driver. The columns are the
+// bcrypt or argon2id password hash, the comma-separated sender addresses the
+// user is allowed to use (NULL for any), and the max messages per minute and
+// recipients per hour of the user (NULL or 0 for the rate_limit_* ones).
+var sqlUserQueries = map[string]string{
+	sqlDriverPostgres: "SELECT password_hash, allowed_senders, rate_limit_messages, rate_limit_recipients FROM smtprelay_users WHERE username = $1",
+	sqlDriverMySQL:    "SELECT password_hash, allowed_senders, rate_limit_messages, rate_limit_recipients FROM smtprelay_users WHERE username = ?",
+}
+
+// max duration of a user query
+const sqlQueryTimeout = 10 * time.Second
+
+var errSQLPasswordInvalid = errors.New("sql: password invalid")
+
+// sqlUser is a user of the SQL database
+type sqlUser struct {
+	AuthUser
+
+	// max messages per minute and recipients per hour, 0 for the configured
+	// rate limits
+	messages   int
+	recipients int
+}
+
+// sqlCacheEntry is a cached user query, user being nil if there's no such
+// user
+type sqlCacheEntry struct {
+	user    *sqlUser
+	expires time.Time
+}
+
+// sqlAuth authenticates users against a PostgreSQL or MySQL database, which
+// also holds the sender addresses and rate limits of each user. Users are
+// cached, so that the database isn't queried by each command of a session.
+type sqlAuth struct {
+	db    *sql.DB
+	query string
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*sqlCacheEntry // by username, as the database compares them
+
+	logger *slog.Logger
+}
+
+// newSQLAuth returns nil if dsn is empty. The query defaults to the one of
+// the driver, and it's sent with the username as its only argument.
+func newSQLAuth(driver, dsn, query string, ttl time.Duration) (*sqlAuth, error) {
+	if dsn == "" {
+		return nil, nil
+	}
+
+	if query == "" {
+		query = sqlUserQueries[driver]
+		if query == "" {
+			return nil, fmt.Errorf("no default query for driver %q", driver)
+		}
+	}
+
+	// the database is only connected to when a user is queried, so that the
+	// relay starts even if it's down
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetConnMaxIdleTime(5 * time.Minute)
+
+	return &sqlAuth{
+		db:     db,
+		query:  query,
+		ttl:    ttl,
+		cache:  map[string]*sqlCacheEntry{},
+		logger: slog.Default().With(slog.String("component", "sql_auth")),
+	}, nil
+}
+
+// authenticate checks the password of the user
+func (a *sqlAuth) authenticate(ctx context.Context, username, password string) error {
+	user, err := a.lookup(ctx, username)
+	if errors.Is(err, errUserNotFound) {
+		_ = checkPasswordHash(dummyPasswordHash(), password)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if checkPasswordHash(user.passwordHash, password) != nil {
+		return errSQLPasswordInvalid
+	}
+
+	return nil
+}
+
+// rateLimits returns the max messages per minute and recipients per hour of
+// the user, 0 if it has none of its own or can't be looked up
+func (a *sqlAuth) rateLimits(ctx context.Context, username string) (messages, recipients int) {
+	user, err := a.lookup(ctx, username)
+	if err != nil {
+		return 0, 0
+	}
+
+	return user.messages, user.recipients
+}
+
+// lookup returns the user, from the cache if it was queried less than the
+// cache TTL ago. Missing users are cached too, but not query errors.
+func (a *sqlAuth) lookup(ctx context.Context, username string) (*sqlUser, error) {
+	now := time.Now()
+
+	a.mu.Lock()
+	entry, ok := a.cache[username]
+	a.mu.Unlock()
+
+	if !ok || !now.Before(entry.expires) {
+		user, err := a.fetch(ctx, username)
+		if err != nil && !errors.Is(err, errUserNotFound) {
+			a.logger.WarnContext(ctx, "user query failed",
+				slog.String("username", username), slog.Any("error", err))
+
+			return nil, err
+		}
+
+		entry = &sqlCacheEntry{user: user, expires: now.Add(a.ttl)}
+
+		a.mu.Lock()
+
+		for k, e := range a.cache {
+			if now.After(e.expires) {
+				delete(a.cache, k)
+			}
+		}
+
+		a.cache[username] = entry
+
+		a.mu.Unlock()
+	}
+
+	if entry.user == nil {
+		return nil, errUserNotFound
+	}
+
+	return entry.user, nil
+}
+
+// fetch queries the database for the user
+func (a *sqlAuth) fetch(ctx context.Context, username string) (*sqlUser, error) {
+	ctx, cancel := context.WithTimeout(ctx, sqlQueryTimeout)
+	defer cancel()
+
+	var (
+		hash                 string
+		senders              sql.NullString
+		messages, recipients sql.NullInt64
+	)
+
+	err := a.db.QueryRowContext(ctx, a.query, username).Scan(&hash, &senders, &messages, &recipients)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errUserNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("sql: %w", err)
+	}
+
+	user := &sqlUser{
+		AuthUser: AuthUser{
+			username:     username,
+			passwordHash: hash,
+		},
+		messages:   int(max(messages.Int64, 0)),
+		recipients: int(max(recipients.Int64, 0)),
+	}
+
+	if senders.Valid {
+		for _, addr := range splitstr(senders.String, ',') {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				user.allowedAddresses = append(user.allowedAddresses, addr)
+			}
+		}
+	}
+
+	return user, nil
+}
+
+// close closes the connections to the database
+func (a *sqlAuth) close() {
+	if a == nil {
+		return
+	}
+
+	_ = a.db.Close()
+}
@@ -0,0 +1,266 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fakeSQLDBs are the databases of the fakesql driver, by DSN
+var fakeSQLDBs sync.Map
+
+func init() {
+	sql.Register("fakesql", fakeSQLDriver{})
+}
+
+// fakeSQLDB is a database answering user queries from its rows, by username
+type fakeSQLDB struct {
+	mu      sync.Mutex
+	rows    map[string][]driver.Value
+	down    bool
+	queries atomic.Int32
+}
+
+func newFakeSQLDB(t *testing.T, rows map[string][]driver.Value) string {
+	t.Helper()
+
+	dsn := t.Name()
+	fakeSQLDBs.Store(dsn, &fakeSQLDB{rows: rows})
+
+	return dsn
+}
+
+func fakeSQL(dsn string) *fakeSQLDB {
+	db, _ := fakeSQLDBs.Load(dsn)
+	return db.(*fakeSQLDB)
+}
+
+func (db *fakeSQLDB) setDown(down bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.down = down
+}
+
+type fakeSQLDriver struct{}
+
+func (fakeSQLDriver) Open(dsn string) (driver.Conn, error) {
+	return &fakeSQLConn{db: fakeSQL(dsn)}, nil
+}
+
+type fakeSQLConn struct {
+	db *fakeSQLDB
+}
+
+func (c *fakeSQLConn) Prepare(string) (driver.Stmt, error) {
+	return &fakeSQLStmt{db: c.db}, nil
+}
+
+func (c *fakeSQLConn) Close() error {
+	return nil
+}
+
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions aren't supported")
+}
+
+type fakeSQLStmt struct {
+	db *fakeSQLDB
+}
+
+func (s *fakeSQLStmt) Close() error {
+	return nil
+}
+
+func (s *fakeSQLStmt) NumInput() int {
+	return 1
+}
+
+func (s *fakeSQLStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("exec isn't supported")
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if s.db.down {
+		return nil, errors.New("connection refused")
+	}
+
+	s.db.queries.Add(1)
+
+	rows := &fakeSQLRows{}
+	if row, ok := s.db.rows[args[0].(string)]; ok {
+		rows.rows = append(rows.rows, row)
+	}
+
+	return rows, nil
+}
+
+type fakeSQLRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	return []string{"password_hash", "allowed_senders", "rate_limit_messages", "rate_limit_recipients"}
+}
+
+func (r *fakeSQLRows) Close() error {
+	return nil
+}
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+
+	return nil
+}
+
+func testSQLUsers(t *testing.T) map[string][]driver.Value {
+	t.Helper()
+
+	hash := func(password string) string {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		require.NoError(t, err)
+
+		return string(h)
+	}
+
+	return map[string][]driver.Value{
+		"alice": {hash("alice-secret"), "alice@example.com, @alice.example.com", int64(10), int64(100)},
+		"bob":   {hash("bob-secret"), nil, nil, nil},
+	}
+}
+
+func TestSQLAuth(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	dsn := newFakeSQLDB(t, testSQLUsers(t))
+	db := fakeSQL(dsn)
+
+	a, err := newSQLAuth("fakesql", dsn, "SELECT ... WHERE username = ?", time.Minute)
+	require.NoError(t, err)
+
+	t.Cleanup(a.close)
+
+	require.NoError(t, a.authenticate(ctx, "alice", "alice-secret"))
+	require.NoError(t, a.authenticate(ctx, "bob", "bob-secret"))
+	require.ErrorIs(t, a.authenticate(ctx, "alice", "wrong"), errSQLPasswordInvalid)
+	require.ErrorIs(t, a.authenticate(ctx, "carol", "carol-secret"), errUserNotFound)
+
+	user, err := a.lookup(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice@example.com", "@alice.example.com"}, user.allowedAddresses)
+
+	user, err = a.lookup(ctx, "bob")
+	require.NoError(t, err)
+	assert.Nil(t, user.allowedAddresses)
+
+	messages, recipients := a.rateLimits(ctx, "alice")
+	assert.Equal(t, 10, messages)
+	assert.Equal(t, 100, recipients)
+
+	messages, recipients = a.rateLimits(ctx, "bob")
+	assert.Zero(t, messages)
+	assert.Zero(t, recipients)
+
+	// users are cached, missing ones too
+	require.ErrorIs(t, a.authenticate(ctx, "carol", "carol-secret"), errUserNotFound)
+	assert.Equal(t, int32(3), db.queries.Load())
+
+	// query errors aren't
+	db.setDown(true)
+
+	_, err = a.lookup(ctx, "dave")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, errUserNotFound)
+
+	db.setDown(false)
+
+	_, err = a.lookup(ctx, "dave")
+	require.ErrorIs(t, err, errUserNotFound)
+	assert.Equal(t, int32(4), db.queries.Load())
+}
+
+func TestSQLAuthExpiry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	dsn := newFakeSQLDB(t, testSQLUsers(t))
+
+	a, err := newSQLAuth("fakesql", dsn, "SELECT ... WHERE username = ?", time.Nanosecond)
+	require.NoError(t, err)
+
+	t.Cleanup(a.close)
+
+	require.NoError(t, a.authenticate(ctx, "alice", "alice-secret"))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, a.authenticate(ctx, "alice", "alice-secret"))
+
+	assert.Equal(t, int32(2), fakeSQL(dsn).queries.Load())
+	assert.Len(t, a.cache, 1)
+}
+
+func TestNewSQLAuth(t *testing.T) {
+	t.Parallel()
+
+	a, err := newSQLAuth(sqlDriverPostgres, "", "", time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, a)
+
+	// the database isn't connected to until a user is queried
+	for driver, dsn := range map[string]string{
+		sqlDriverPostgres: "postgres://smtprelay@127.0.0.1:9/mail",
+		sqlDriverMySQL:    "smtprelay@tcp(127.0.0.1:9)/mail",
+	} {
+		a, err = newSQLAuth(driver, dsn, "", time.Minute)
+		require.NoError(t, err, driver)
+		assert.True(t, strings.HasPrefix(a.query, "SELECT password_hash"), driver)
+
+		a.close()
+	}
+
+	_, err = newSQLAuth("oracle", "oracle://db.example.com", "", time.Minute)
+	require.Error(t, err)
+
+	_, err = newSQLAuth("oracle", "oracle://db.example.com", "SELECT 1", time.Minute)
+	require.Error(t, err)
+}
+
+func TestAuthUser(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	a, err := newSQLAuth("fakesql", newFakeSQLDB(t, testSQLUsers(t)), "SELECT ... WHERE username = ?", time.Minute)
+	require.NoError(t, err)
+
+	t.Cleanup(a.close)
+
+	user, err := authUser(ctx, &config{sql: a}, "alice")
+	require.NoError(t, err)
+	assert.True(t, addrAllowed("bob@alice.example.com", user.allowedAddresses))
+	assert.False(t, addrAllowed("bob@example.com", user.allowedAddresses))
+
+	_, err = authUser(ctx, &config{sql: a}, "carol")
+	require.ErrorIs(t, err, errUserNotFound)
+}
@@ -0,0 +1,194 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" //nolint:gosec // SRS hashes are HMAC-SHA1
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+const (
+	srsHashLength = 4  // base64 characters of the hash, as in libsrs2
+	srsMaxAge     = 21 // days a rewritten address is valid for, as in libsrs2
+
+	// base32 alphabet of the timestamps
+	srsTimeAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+)
+
+var errSRSInvalid = &smtpd.Error{Code: 550, EnhancedCode: "5.1.1", Msg: "Invalid or expired SRS address"}
+
+// srs rewrites envelope senders with the Sender Rewriting Scheme, so messages
+// forwarded for other domains pass SPF at their destination, and reverses
+// the rewritten addresses, so bounces are routed back to the original
+// senders. Rewritten addresses are signed, and expire after srsMaxAge days.
+//
+// Senders are rewritten as SRS0=hash=timestamp=domain=local@srs_domain, or
+// SRS1=hash=domain==hash=timestamp=domain=local@srs_domain if they were
+// already rewritten by another forwarder, as described in
+// https://www.libsrs2.org/srs/srs.pdf.
+type srs struct {
+	domain  string
+	secrets []string // the first one signs, all of them verify
+
+	// now returns the current time - overridable for tests
+	now func() time.Time
+}
+
+// newSRS returns nil if domain is empty
+func newSRS(domain, secrets string) (*srs, error) {
+	if domain == "" {
+		return nil, nil
+	}
+
+	s := &srs{domain: strings.ToLower(domain), secrets: splitstr(secrets, ' '), now: time.Now}
+	if len(s.secrets) == 0 {
+		return nil, errors.New("srs_domain requires srs_secrets to be set")
+	}
+
+	return s, nil
+}
+
+// forward returns the rewritten sender. Null senders, and senders of the SRS
+// domain, are returned as is.
+func (s *srs) forward(sender string) string {
+	if s == nil {
+		return sender
+	}
+
+	local, domain, ok := cutAddress(sender)
+	if !ok || strings.EqualFold(domain, s.domain) {
+		return sender
+	}
+
+	switch srsTag(local) {
+	case "SRS0=":
+		// SRS0 addresses of another forwarder are wrapped, so bounces go
+		// back to it
+		tail := "=" + local[5:]
+
+		return "SRS1=" + s.hash(s.secrets[0], domain+tail) + "=" + domain + "=" + tail + "@" + s.domain
+	case "SRS1=":
+		// SRS1 addresses keep pointing to the first forwarder
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) == 3 {
+			return "SRS1=" + s.hash(s.secrets[0], parts[1]+parts[2]) + "=" + parts[1] + "=" + parts[2] + "@" + s.domain
+		}
+	}
+
+	timestamp := s.timestamp(s.now())
+
+	return "SRS0=" + s.hash(s.secrets[0], timestamp+domain+local) + "=" + timestamp + "=" + domain + "=" + local +
+		"@" + s.domain
+}
+
+// reverse returns the original address of a rewritten recipient, or the
+// recipient as is if it's not a SRS address of the SRS domain. Addresses
+// with an invalid hash, or expired, fail with errSRSInvalid.
+func (s *srs) reverse(rcpt string) (string, error) {
+	if s == nil {
+		return rcpt, nil
+	}
+
+	local, domain, ok := cutAddress(rcpt)
+	if !ok || !strings.EqualFold(domain, s.domain) {
+		return rcpt, nil
+	}
+
+	switch srsTag(local) {
+	case "SRS0=":
+		parts := strings.SplitN(local[5:], "=", 4)
+		if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+			return "", errSRSInvalid
+		}
+
+		if !s.verify(parts[0], parts[1]+parts[2]+parts[3]) || !s.valid(parts[1]) {
+			return "", errSRSInvalid
+		}
+
+		return parts[3] + "@" + parts[2], nil
+	case "SRS1=":
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			return "", errSRSInvalid
+		}
+
+		if !s.verify(parts[0], parts[1]+parts[2]) {
+			return "", errSRSInvalid
+		}
+
+		return "SRS0" + parts[2] + "@" + parts[1], nil
+	default:
+		return rcpt, nil
+	}
+}
+
+// hash returns the truncated base64 HMAC-SHA1 of the lowercased data, as
+// some MTAs change the case of the local part
+func (s *srs) hash(secret, data string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(strings.ToLower(data)))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:srsHashLength]
+}
+
+// verify reports whether the hash of the data matches with any of the
+// secrets
+func (s *srs) verify(hash, data string) bool {
+	for _, secret := range s.secrets {
+		if strings.EqualFold(hash, s.hash(secret, data)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// timestamp returns the day of t, modulo 1024, as two base32 characters
+func (s *srs) timestamp(t time.Time) string {
+	day := t.Unix() / 86400 % 1024
+
+	return string([]byte{srsTimeAlphabet[day>>5], srsTimeAlphabet[day&31]})
+}
+
+// valid reports whether the timestamp is at most srsMaxAge days old
+func (s *srs) valid(timestamp string) bool {
+	if len(timestamp) != 2 {
+		return false
+	}
+
+	var day int64
+
+	for _, c := range strings.ToUpper(timestamp) {
+		i := strings.IndexRune(srsTimeAlphabet, c)
+		if i < 0 {
+			return false
+		}
+
+		day = day<<5 | int64(i)
+	}
+
+	today := s.now().Unix() / 86400 % 1024
+
+	return (today-day+1024)%1024 <= srsMaxAge
+}
+
+// cutAddress splits the address at its last @, failing for null and local
+// addresses
+func cutAddress(addr string) (local, domain string, ok bool) {
+	i := strings.LastIndex(addr, "@")
+	if i <= 0 || i == len(addr)-1 {
+		return "", "", false
+	}
+
+	return addr[:i], addr[i+1:], true
+}
+
+// srsTag returns the uppercased SRS0= or SRS1= prefix of the local part, if
+// it has one
+func srsTag(local string) string {
+	return strings.ToUpper(local[:min(5, len(local))])
+}
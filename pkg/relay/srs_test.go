@@ -0,0 +1,157 @@
+package relay
+
+import (
+	"context"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSRS(t *testing.T, secrets string, now time.Time) *srs {
+	t.Helper()
+
+	s, err := newSRS("SRS.example.net", secrets)
+	require.NoError(t, err)
+
+	s.now = func() time.Time { return now }
+
+	return s
+}
+
+func TestNewSRS(t *testing.T) {
+	t.Parallel()
+
+	s, err := newSRS("", "secret")
+	require.NoError(t, err)
+	assert.Nil(t, s)
+
+	_, err = newSRS("srs.example.net", "")
+	require.Error(t, err)
+}
+
+func TestSRS(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := testSRS(t, "secret", now)
+
+	fwd := s.forward("bob@example.com")
+	assert.Regexp(t, `^SRS0=[A-Za-z0-9+/]{4}=[A-Z2-7]{2}=example\.com=bob@srs\.example\.net$`, fwd)
+
+	rcpt, err := s.reverse(fwd)
+	require.NoError(t, err)
+	assert.Equal(t, "bob@example.com", rcpt)
+
+	// case changes by other MTAs are tolerated
+	rcpt, err = s.reverse(strings.ToLower(fwd))
+	require.NoError(t, err)
+	assert.Equal(t, "bob@example.com", rcpt)
+
+	// null senders and senders of the SRS domain aren't rewritten
+	assert.Empty(t, s.forward(""))
+	assert.Equal(t, "alice@srs.example.net", s.forward("alice@srs.example.net"))
+
+	// other recipients aren't reversed
+	for _, addr := range []string{"alice@srs.example.net", fwd[:len(fwd)-len("srs.example.net")] + "example.org"} {
+		rcpt, err = s.reverse(addr)
+		require.NoError(t, err)
+		assert.Equal(t, addr, rcpt)
+	}
+
+	// tampered and malformed addresses are rejected
+	for _, addr := range []string{
+		strings.Replace(fwd, "bob@", "eve@", 1),
+		"SRS0=abcd=AA=example.com=bob@srs.example.net",
+		"SRS0=abcd@srs.example.net",
+		"SRS1=abcd=example.org@srs.example.net",
+	} {
+		_, err = s.reverse(addr)
+		require.ErrorIs(t, err, errSRSInvalid, addr)
+	}
+
+	// addresses expire
+	s.now = func() time.Time { return now.Add(srsMaxAge * 24 * time.Hour) }
+	_, err = s.reverse(fwd)
+	require.NoError(t, err)
+
+	s.now = func() time.Time { return now.Add((srsMaxAge + 1) * 24 * time.Hour) }
+	_, err = s.reverse(fwd)
+	require.ErrorIs(t, err, errSRSInvalid)
+
+	// rotated secrets still verify
+	rotated := testSRS(t, "rotated", now)
+	rcpt, err = rotated.reverse(fwd)
+	require.ErrorIs(t, err, errSRSInvalid)
+	assert.Empty(t, rcpt)
+
+	rotated = testSRS(t, "rotated", now)
+	rotated.secrets = append(rotated.secrets, "secret")
+	rcpt, err = rotated.reverse(fwd)
+	require.NoError(t, err)
+	assert.Equal(t, "bob@example.com", rcpt)
+}
+
+func TestSRS1(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := testSRS(t, "secret", now)
+
+	// addresses rewritten by another forwarder are wrapped
+	first := "SRS0=HHHH=TT=example.com=bob@forwarder.example.org"
+
+	fwd := s.forward(first)
+	assert.Regexp(t, `^SRS1=[A-Za-z0-9+/]{4}=forwarder\.example\.org==HHHH=TT=example\.com=bob@srs\.example\.net$`, fwd)
+
+	rcpt, err := s.reverse(fwd)
+	require.NoError(t, err)
+	assert.Equal(t, first, rcpt)
+
+	// and keep pointing to the first forwarder
+	again := testSRS(t, "other", now)
+	again.domain = "srs.example.com"
+
+	fwd2 := again.forward(fwd)
+	assert.Regexp(t, `^SRS1=[A-Za-z0-9+/]{4}=forwarder\.example\.org==HHHH=TT=example\.com=bob@srs\.example\.com$`, fwd2)
+
+	rcpt, err = again.reverse(fwd2)
+	require.NoError(t, err)
+	assert.Equal(t, first, rcpt)
+}
+
+func TestSRSRelay(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv := startTestSMTPServer(ctx, t)
+
+	s := testSRS(t, "secret", time.Now())
+	addr := startRelayConfig(ctx, t, "", &config{remoteHost: srv.addr, srs: s})
+
+	// forwarded senders are rewritten
+	err := sendMsg(t, addr, []string{"alice@example.org"}, "bob@example.com", "test message", textproto.MIMEHeader{}, "hello")
+	require.NoError(t, err)
+	require.Len(t, *srv.msgs, 1)
+
+	sender := (*srv.msgs)[0].Sender
+	assert.True(t, strings.HasPrefix(sender, "SRS0="), sender)
+
+	// bounces are routed back to the original sender
+	err = smtp.SendMail(addr, nil, "", []string{sender}, []byte("Subject: bounce\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+	require.Len(t, *srv.msgs, 2)
+	assert.Equal(t, []string{"bob@example.com"}, (*srv.msgs)[1].Recipients)
+	assert.Empty(t, (*srv.msgs)[1].Sender)
+
+	// invalid SRS recipients are rejected
+	err = smtp.SendMail(addr, nil, "", []string{"SRS0=abcd=AA=example.com=eve@srs.example.net"}, []byte("Subject: bounce\r\n\r\nhello\r\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "550")
+}
@@ -0,0 +1,227 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/evidentiq/smtprelay/v2/internal/traceutil"
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Names of the built-in stages of the message handler, in order, which
+// middlewares can be added before with Relay.Use
+const (
+	StageTrace        = "trace"         // starts the span, and gives the message its ID
+	StageSubmission   = "submission"    // completes the messages of submission listeners
+	StageFixup        = "fixup"         // adds the missing Message-ID, Date and From headers
+	StageUpstreamAuth = "upstream_auth" // rejects senders without usable upstream credentials
+	StageRateLimit    = "rate_limit"    // none, the recipient rate limits apply at RCPT TO
+	StageMessageSize  = "message_size"  // enforces the max message size of the user
+	StageDedup        = "dedup"         // drops or rejects the messages submitted twice
+	StageQuarantine   = "quarantine"    // holds the messages the later checks flag
+	StageDKIM         = "dkim"          // verifies DKIM signatures and DMARC policies
+	StageClamAV       = "clamav"        // scans for viruses
+	StagePolicy       = "policy"        // evaluates the data rules of policy_rules
+	StageSchedule     = "schedule"      // defers the delivery of the messages scheduled for later
+	StageAutoReply    = "auto_reply"    // replies automatically once the message is delivered
+)
+
+// builtinStages are the names of the built-in stages, in order
+var builtinStages = []string{
+	StageTrace, StageSubmission, StageFixup, StageUpstreamAuth, StageRateLimit, StageMessageSize, StageDedup,
+	StageQuarantine, StageDKIM, StageClamAV, StagePolicy, StageSchedule, StageAutoReply,
+}
+
+// mailStage is a named middleware of the mail handler, checking or altering
+// messages before they're delivered
+type mailStage struct {
+	name       string
+	middleware smtpd.Middleware
+}
+
+// defaultStages returns the built-in stages of the mail handler
+func (r *relay) defaultStages() []mailStage {
+	return []mailStage{
+		{name: StageTrace, middleware: r.traceStage},
+		{name: StageSubmission, middleware: r.submissionStage},
+		{name: StageFixup, middleware: r.fixupStage},
+		{name: StageUpstreamAuth, middleware: r.upstreamAuthStage},
+		{name: StageRateLimit, middleware: r.rateLimitStage},
+		{name: StageMessageSize, middleware: r.messageSizeStage},
+		{name: StageDedup, middleware: r.dedupStage},
+		{name: StageQuarantine, middleware: r.quarantineStage},
+		{name: StageDKIM, middleware: r.dkimStage},
+		{name: StageClamAV, middleware: r.clamAVStage},
+		{name: StagePolicy, middleware: r.policyStage},
+		{name: StageSchedule, middleware: r.scheduleStage},
+		{name: StageAutoReply, middleware: r.autoReplyStage},
+	}
+}
+
+// insertStage adds a stage to the mail handler before the stage named before,
+// or last, right before the delivery, if before is empty. It must be called
+// before the relay serves.
+func (r *relay) insertStage(before string, stage mailStage) error {
+	stages, err := insertStage(r.stages, before, stage)
+	if err != nil {
+		return err
+	}
+
+	r.stages = stages
+	r.server.Handler = r.mailHandler()
+
+	return nil
+}
+
+// insertStage returns the stages with stage inserted before the one named
+// before, or last if before is empty
+func insertStage(stages []mailStage, before string, stage mailStage) ([]mailStage, error) {
+	if stage.name == "" {
+		return nil, errors.New("stage without a name")
+	}
+
+	if slices.ContainsFunc(stages, func(s mailStage) bool { return s.name == stage.name }) {
+		return nil, fmt.Errorf("duplicate stage %q", stage.name)
+	}
+
+	i := len(stages)
+	if before != "" {
+		i = slices.IndexFunc(stages, func(s mailStage) bool { return s.name == before })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown stage %q", before)
+		}
+	}
+
+	return slices.Insert(slices.Clone(stages), i, stage), nil
+}
+
+type messageUUIDKey struct{}
+
+// messageUUID returns the unique ID given to the message by the trace stage,
+// or a new one
+func messageUUID(ctx context.Context) string {
+	if id, ok := ctx.Value(messageUUIDKey{}).(string); ok {
+		return id
+	}
+
+	return generateUUID()
+}
+
+// traceStage starts the span of the message, re-parented to the trace
+// propagated in its headers, and gives the message its unique ID
+func (r *relay) traceStage(next smtpd.Handler) smtpd.Handler {
+	return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+		// save upstream span as a link, we're going to re-parent this span to
+		// the extrated propagated trace
+		link := trace.LinkFromContext(ctx)
+
+		tprop := otel.GetTextMapPropagator()
+		ctx = tprop.Extract(ctx, traceutil.MIMEHeaderCarrier(env.Header))
+		ctx, span := tracer.Start(ctx, "relay.mailHandler",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithLinks(link),
+			trace.WithAttributes(
+				semconv.ClientAddress(peer.Addr.String()),
+				traceutil.Sender(env.Sender),
+				traceutil.Recipients(env.Recipients),
+			),
+		)
+		defer span.End()
+
+		ctx = context.WithValue(ctx, messageUUIDKey{}, generateUUID())
+
+		return next(ctx, peer, env)
+	}
+}
+
+// upstreamAuthStage rejects messages the upstream credentials of the sender
+// can't be used for
+func (r *relay) upstreamAuthStage(next smtpd.Handler) smtpd.Handler {
+	return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+		cfg := r.config(ctx)
+
+		credsKey := credentialsKey(cfg.remoteCredentials, peer.Username, env.Sender)
+
+		if _, err := cfg.upstreamSASL(cfg.upstreamAuth(credsKey), ""); err != nil {
+			return observeErr(ctx, smtpd.ErrUnsupportedAuthMethod)
+		}
+
+		return next(ctx, peer, env)
+	}
+}
+
+// rateLimitStage does nothing, as the recipients are counted against the rate
+// limits by checkRecipient. It's kept for StageRateLimit, which middlewares
+// may be added before.
+func (r *relay) rateLimitStage(next smtpd.Handler) smtpd.Handler {
+	return next
+}
+
+// messageSizeStage rejects messages over the max size the auth endpoint
+// gave their user
+func (r *relay) messageSizeStage(next smtpd.Handler) smtpd.Handler {
+	return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+		policy := r.config(ctx).httpAuth.policy(ctx, peer)
+		if policy == nil || policy.MaxMessageSize <= 0 {
+			return next(ctx, peer, env)
+		}
+
+		if err := env.Buffer(); err != nil {
+			return err
+		}
+
+		if int64(len(env.Data)) > policy.MaxMessageSize {
+			slog.WarnContext(ctx, "message exceeds the max size of the user",
+				slog.String("component", "mail_handler"),
+				slog.String("uuid", messageUUID(ctx)),
+				slog.String("from", env.Sender),
+				slog.String("username", peer.Username),
+				slog.Int64("max_message_size", policy.MaxMessageSize))
+
+			return observeErr(ctx, smtpd.ErrTooBig)
+		}
+
+		return next(ctx, peer, env)
+	}
+}
+
+// dkimStage verifies the DKIM signatures of messages from unauthenticated
+// clients, and checks their DMARC policy, before any header is added
+func (r *relay) dkimStage(next smtpd.Handler) smtpd.Handler {
+	return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+		if r.dkim != nil && peer.Username == "" {
+			if err := env.Buffer(); err != nil {
+				return err
+			}
+
+			if err := r.authenticateMessage(ctx, peer, &env); err != nil {
+				return err
+			}
+		}
+
+		return next(ctx, peer, env)
+	}
+}
+
+// clamAVStage rejects messages clamd finds a virus in
+func (r *relay) clamAVStage(next smtpd.Handler) smtpd.Handler {
+	return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+		if cfg := r.config(ctx); cfg.clamav != nil {
+			if err := env.Buffer(); err != nil {
+				return err
+			}
+
+			if err := cfg.clamav.check(ctx, &env); err != nil {
+				return err
+			}
+		}
+
+		return next(ctx, peer, env)
+	}
+}
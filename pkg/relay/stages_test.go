@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsertStage(t *testing.T) {
+	t.Parallel()
+
+	u := startFakeUpstream(t)
+
+	r, err := newRelay(newConfigStore(&config{remoteHost: u.addr}), listenerConfig{}, &relayShared{})
+	require.NoError(t, err)
+
+	var calls []string
+
+	record := func(name string) mailStage {
+		return mailStage{name: name, middleware: func(next smtpd.Handler) smtpd.Handler {
+			return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+				calls = append(calls, name+":"+messageUUID(ctx))
+				return next(ctx, peer, env)
+			}
+		}}
+	}
+
+	require.NoError(t, r.insertStage(StageRateLimit, record("tenant")))
+	require.NoError(t, r.insertStage("", record("billing")))
+
+	require.Error(t, r.insertStage("", record("tenant")), "duplicate stage")
+	require.Error(t, r.insertStage("bogus", record("other")), "unknown stage")
+
+	names := make([]string, 0, len(r.stages))
+	for _, s := range r.stages {
+		names = append(names, s.name)
+	}
+
+	assert.Equal(t, []string{
+		StageTrace, StageSubmission, StageFixup, StageUpstreamAuth, "tenant", StageRateLimit,
+		StageMessageSize, StageDedup, StageQuarantine, StageDKIM, StageClamAV, StagePolicy, StageSchedule,
+		StageAutoReply, "billing",
+	}, names)
+
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345}}
+	env := smtpd.Envelope{
+		Sender:     "alice@example.com",
+		Recipients: []string{"bob@example.com"},
+		Data:       []byte("Subject: hi\r\n\r\nhello\r\n"),
+	}
+
+	// the stages run in order, after the trace stage gave the message its ID
+	require.NoError(t, r.server.Handler(context.Background(), peer, env))
+	require.Len(t, calls, 2)
+
+	id := calls[0][len("tenant:"):]
+	assert.Equal(t, []string{"tenant:" + id, "billing:" + id}, calls)
+
+	_, msgs := u.received()
+	assert.Len(t, msgs, 1)
+
+	// stages reject messages by not calling the next one
+	require.NoError(t, r.insertStage(StageDKIM, mailStage{name: "reject", middleware: func(smtpd.Handler) smtpd.Handler {
+		return func(context.Context, smtpd.Peer, smtpd.Envelope) error {
+			return smtpd.ErrRecipientDenied
+		}
+	}}))
+
+	calls = nil
+
+	err = r.server.Handler(context.Background(), peer, env)
+	require.ErrorIs(t, err, smtpd.ErrRecipientDenied)
+	assert.Len(t, calls, 1)
+
+	_, msgs = u.received()
+	assert.Len(t, msgs, 1)
+}
@@ -0,0 +1,35 @@
+package relay
+
+import (
+	"context"
+	"log/slog"
+	"net/mail"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// submissionStage completes the messages received on submission listeners,
+// as message submission agents do (RFC 6409 section 8): the envelope sender
+// is set to the address the client authenticated as, if its username is an
+// address, and the Message-ID and Date headers are added if they're missing.
+// Clients which don't authenticate over TLS are rejected before MAIL.
+func (r *relay) submissionStage(next smtpd.Handler) smtpd.Handler {
+	return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+		if !r.listener.submission {
+			return next(ctx, peer, env)
+		}
+
+		logger := slog.With(slog.String("component", "submission"), slog.String("uuid", messageUUID(ctx)))
+
+		if addr, err := mail.ParseAddress(peer.Username); err == nil && addr.Address != env.Sender {
+			logger.DebugContext(ctx, "rewriting envelope sender to authenticated user",
+				slog.String("from", env.Sender), slog.String("user", addr.Address))
+
+			env.Sender = addr.Address
+		}
+
+		completeHeaders(ctx, &env, r.config(ctx).hostName, false)
+
+		return next(ctx, peer, env)
+	}
+}
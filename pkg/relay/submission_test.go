@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubmissionStage(t *testing.T) {
+	t.Parallel()
+
+	u := startFakeUpstream(t)
+
+	r, err := newRelay(newConfigStore(&config{remoteHost: u.addr, hostName: "relay.example.com", noReceived: true}),
+		listenerConfig{scheme: schemeSTARTTLS, auth: true, forceTLS: true, submission: true}, &relayShared{})
+	require.NoError(t, err)
+
+	var ids []string
+
+	require.NoError(t, r.insertStage(StageUpstreamAuth, mailStage{name: "record", middleware: func(next smtpd.Handler) smtpd.Handler {
+		return func(ctx context.Context, peer smtpd.Peer, env smtpd.Envelope) error {
+			ids = append(ids, env.Header.Get("Message-Id"))
+			return next(ctx, peer, env)
+		}
+	}}))
+
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345}
+
+	// the sender is the authenticated user, and the missing headers are added
+	err = r.server.Handler(context.Background(), smtpd.Peer{Addr: addr, Username: "alice@example.com"}, smtpd.Envelope{
+		Sender:     "bob@example.com",
+		Recipients: []string{"carol@example.org"},
+		Data:       []byte("Subject: hi\r\n\r\nhello\r\n"),
+	})
+	require.NoError(t, err)
+
+	// complete messages are left as is, and usernames which aren't addresses
+	// don't replace the sender
+	data := "Date: Mon, 02 Jan 2006 15:04:05 -0700\r\nMessage-ID: <1@example.com>\r\nSubject: hi\r\n\r\nhello\r\n"
+
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(data))).ReadMIMEHeader()
+	require.NoError(t, err)
+
+	err = r.server.Handler(context.Background(), smtpd.Peer{Addr: addr, Username: "alice"}, smtpd.Envelope{
+		Sender:     "bob@example.com",
+		Recipients: []string{"carol@example.org"},
+		Header:     header,
+		Data:       []byte(data),
+	})
+	require.NoError(t, err)
+
+	commands, msgs := u.received()
+	assert.Contains(t, commands, "MAIL FROM:<alice@example.com>")
+	assert.Contains(t, commands, "MAIL FROM:<bob@example.com>")
+
+	require.Len(t, msgs, 2)
+	require.Len(t, ids, 2)
+	assert.Regexp(t, `^<[0-9a-f-]+@relay\.example\.com>$`, ids[0])
+	assert.Regexp(t, `^Message-ID: `+regexp.QuoteMeta(ids[0])+"\nDate: .+\nSubject: hi\n", msgs[0])
+	assert.Equal(t, "<1@example.com>", ids[1])
+	assert.Equal(t, strings.ReplaceAll(data, "\r\n", "\n"), msgs[1])
+}
@@ -0,0 +1,368 @@
+package relay
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// syslog_addr value for the local syslog daemon
+const syslogLocal = "local"
+
+const (
+	// max duration of the connection and writes to the syslog server
+	syslogTimeout = 5 * time.Second
+
+	// how long lines are dropped after the syslog server failed, rather than
+	// slowing down deliveries by reconnecting for each of them
+	syslogRetryDelay = 10 * time.Second
+)
+
+// sockets of the local syslog daemon, by platform
+var syslogLocalSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// syslog facilities (RFC 5424)
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslog severities
+const (
+	syslogWarning = 4
+	syslogInfo    = 6
+)
+
+// Delivery statuses, as logged by Postfix
+const (
+	syslogSent     = "sent"
+	syslogDeferred = "deferred"
+	syslogBounced  = "bounced"
+)
+
+// mailLog writes Postfix-style lines about the messages relayed to syslog,
+// for mail log pipelines expecting them (e.g. pflogsumm): a client= and a
+// from= line for each message received, and a to= line for each delivery
+// attempt of each recipient, all prefixed with the message ID:
+//
+//	3f0c…: client=unknown[192.0.2.10], sasl_username=alice
+//	3f0c…: from=<alice@example.com>, size=1234, nrcpt=1
+//	3f0c…: to=<bob@example.org>, relay=smtp.example.com:587, delay=0.42, dsn=2.0.0, status=sent (delivered)
+//
+// Lines are sent to the local syslog daemon in the traditional format, or to a
+// remote server over TCP or TLS in the RFC 5424 format, with octet-counting
+// framing (RFC 6587). The connection is opened when needed, and lines are
+// dropped for a while if the server is unreachable.
+type mailLog struct {
+	network  string // unixgram, unix, tcp or tls
+	addr     string
+	facility int
+	tag      string
+	hostName string
+	pid      int
+
+	tlsConfig *tls.Config
+
+	// dialLocal connects to the local daemon, nil for remote servers -
+	// overridable for tests
+	dialLocal func() (net.Conn, string, error)
+
+	mu       sync.Mutex
+	conn     net.Conn
+	failedAt time.Time
+	dropped  int
+
+	logger *slog.Logger
+}
+
+// newMailLog returns nil if addr is empty. addr should either be "local",
+// or a URL in the form tcp://host:port or tls://host:port.
+func newMailLog(addr, facility, tag, hostName string) (*mailLog, error) {
+	if addr == "" {
+		return nil, nil
+	}
+
+	fac, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+
+	l := &mailLog{
+		facility: fac,
+		tag:      tag,
+		hostName: hostName,
+		pid:      os.Getpid(),
+		logger:   slog.Default().With(slog.String("component", "syslog")),
+	}
+
+	if addr == syslogLocal {
+		l.dialLocal = dialLocalSyslog
+
+		return l, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Port() == "" {
+		return nil, fmt.Errorf("missing port in %q", addr)
+	}
+
+	switch u.Scheme {
+	case "tcp":
+	case "tls":
+		l.tlsConfig = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	default:
+		return nil, fmt.Errorf("unknown syslog protocol %q, expected %s, tcp:// or tls://", u.Scheme, syslogLocal)
+	}
+
+	l.network, l.addr = u.Scheme, u.Host
+
+	return l, nil
+}
+
+// dialLocalSyslog connects to the socket of the local syslog daemon,
+// returning its network
+func dialLocalSyslog() (net.Conn, string, error) {
+	var errs []error
+
+	for _, path := range syslogLocalSockets {
+		for _, network := range []string{"unixgram", "unix"} {
+			conn, err := net.DialTimeout(network, path, syslogTimeout)
+			if err == nil {
+				return conn, network, nil
+			}
+
+			errs = append(errs, err)
+		}
+	}
+
+	return nil, "", fmt.Errorf("no local syslog daemon: %w", errors.Join(errs...))
+}
+
+// received logs a message accepted from the peer. size is 0 if it isn't known
+// yet, for streamed messages.
+func (l *mailLog) received(id string, peer smtpd.Peer, sender string, size, nrcpt int) {
+	if l == nil {
+		return
+	}
+
+	client := "client=unknown[]"
+	if ip := peerIP(peer); ip != nil {
+		client = "client=unknown[" + ip.String() + "]"
+	}
+
+	if peer.Username != "" {
+		client += ", sasl_username=" + peer.Username
+	}
+
+	l.write(syslogInfo, id+": "+client)
+
+	from := fmt.Sprintf("%s: from=<%s>", id, sender)
+	if size > 0 {
+		from += ", size=" + strconv.Itoa(size)
+	}
+
+	l.write(syslogInfo, fmt.Sprintf("%s, nrcpt=%d", from, nrcpt))
+}
+
+// delivered logs the outcome of the attempt, a to= line for each of its
+// recipients
+func (l *mailLog) delivered(a *deliveryAttempt) {
+	if l == nil {
+		return
+	}
+
+	relay := cmp.Or(a.out.Host, "none")
+
+	dsn, status, detail, severity := "2.0.0", syslogSent, "delivered", syslogInfo
+	if a.out.reply != "" {
+		detail = "250 " + strings.Join(strings.Fields(a.out.reply), " ")
+	}
+
+	if a.err != nil {
+		status, severity = syslogBounced, syslogWarning
+		if a.deferred {
+			status = syslogDeferred
+		}
+
+		dsn, detail = mailLogDSN(a.err, a.deferred), strings.Join(strings.Fields(a.err.Error()), " ")
+		if a.queueID != "" {
+			detail = "queued as " + a.queueID + ": " + detail
+		}
+	}
+
+	for _, rcpt := range a.recipients {
+		l.write(severity, fmt.Sprintf("%s: to=<%s>, relay=%s, delay=%.2f, dsn=%s, status=%s (%s)",
+			a.id, rcpt, relay, a.delay.Seconds(), dsn, status, detail))
+	}
+}
+
+// mailLogDSN returns the enhanced status code of a failed delivery
+func mailLogDSN(err error, deferred bool) string {
+	var smtpErr *smtpd.Error
+	if errors.As(err, &smtpErr) && smtpErr.EnhancedCode != "" {
+		return smtpErr.EnhancedCode
+	}
+
+	if deferred {
+		return "4.0.0"
+	}
+
+	return "5.0.0"
+}
+
+// write sends a line to syslog, reconnecting once if the connection was
+// closed
+func (l *mailLog) write(severity int, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if l.conn == nil {
+			if !l.failedAt.IsZero() && time.Since(l.failedAt) < syslogRetryDelay {
+				l.dropped++
+				return
+			}
+
+			if err := l.dial(); err != nil {
+				l.failed(err)
+				return
+			}
+		}
+
+		_ = l.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+
+		if _, err := l.conn.Write(l.format(severity, time.Now(), msg)); err != nil {
+			_ = l.conn.Close()
+			l.conn = nil
+
+			if attempt > 0 {
+				l.failed(err)
+			}
+
+			continue
+		}
+
+		if l.dropped > 0 {
+			l.logger.Info("syslog server reachable again", slog.Int("dropped_lines", l.dropped))
+		}
+
+		l.failedAt, l.dropped = time.Time{}, 0
+
+		return
+	}
+}
+
+// failed drops the line which couldn't be written, and the next ones for a
+// while. It must be called with the lock held.
+func (l *mailLog) failed(err error) {
+	if l.failedAt.IsZero() {
+		l.logger.Warn("cannot write to syslog, dropping lines", slog.Any("error", err))
+	}
+
+	l.failedAt = time.Now()
+	l.dropped++
+}
+
+// dial connects to the syslog server. It must be called with the lock held.
+func (l *mailLog) dial() error {
+	if l.dialLocal != nil {
+		conn, network, err := l.dialLocal()
+		if err != nil {
+			return err
+		}
+
+		l.conn, l.network = conn, network
+
+		return nil
+	}
+
+	dialer := &net.Dialer{Timeout: syslogTimeout}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	if l.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", l.addr, l.tlsConfig)
+	} else {
+		conn, err = dialer.DialContext(context.Background(), "tcp", l.addr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	l.conn = conn
+
+	return nil
+}
+
+// format formats a line for the network of the connection: the local
+// daemon gets the traditional format, without hostname, and remote servers
+// the RFC 5424 one, with its length prepended
+func (l *mailLog) format(severity int, now time.Time, msg string) []byte {
+	pri := l.facility*8 + severity
+
+	switch l.network {
+	case "unixgram":
+		return fmt.Appendf(nil, "<%d>%s %s[%d]: %s", pri, now.Format(time.Stamp), l.tag, l.pid, msg)
+	case "unix":
+		return fmt.Appendf(nil, "<%d>%s %s[%d]: %s\n", pri, now.Format(time.Stamp), l.tag, l.pid, msg)
+	}
+
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		pri, now.UTC().Format(time.RFC3339Nano), syslogHeaderValue(l.hostName), syslogHeaderValue(l.tag), l.pid, msg)
+
+	return fmt.Appendf(nil, "%d %s", len(line), line)
+}
+
+// syslogHeaderValue returns a valid RFC 5424 header value, "-" if s is empty
+func syslogHeaderValue(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+
+		return r
+	}, s)
+
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// close is nil-safe
+func (l *mailLog) close() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn != nil {
+		_ = l.conn.Close()
+		l.conn = nil
+	}
+}
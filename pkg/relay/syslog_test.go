@@ -0,0 +1,323 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSyslog is a syslog server receiving RFC 5424 lines with octet-counting
+// framing over TCP
+type fakeSyslog struct {
+	addr string
+
+	mu    sync.Mutex
+	lines []string
+	conns []net.Conn
+}
+
+func startFakeSyslog(t *testing.T) *fakeSyslog {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = l.Close() })
+
+	s := &fakeSyslog{addr: l.Addr().String()}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeSyslog) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	for {
+		size, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+
+		n, err := strconv.Atoi(strings.TrimSuffix(size, " "))
+		if err != nil {
+			return
+		}
+
+		line := make([]byte, n)
+		if _, err := io.ReadFull(r, line); err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.lines = append(s.lines, string(line))
+		s.mu.Unlock()
+	}
+}
+
+// messages waits for n lines, and returns their messages
+func (s *fakeSyslog) messages(t *testing.T, n int) []string {
+	t.Helper()
+
+	var msgs []string
+
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		msgs = msgs[:0]
+		for _, line := range s.lines {
+			// <pri>1 timestamp hostname app-name procid msgid sd msg
+			fields := strings.SplitN(line, " ", 8)
+			msgs = append(msgs, fields[len(fields)-1])
+		}
+
+		return len(msgs) >= n
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return msgs
+}
+
+func (s *fakeSyslog) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+func TestNewMailLog(t *testing.T) {
+	t.Parallel()
+
+	l, err := newMailLog("", "mail", "smtprelay", "relay.example.com")
+	require.NoError(t, err)
+	assert.Nil(t, l)
+
+	l, err = newMailLog("tls://syslog.example.com:6514", "LOCAL3", "smtprelay", "relay.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "tls", l.network)
+	assert.Equal(t, "syslog.example.com:6514", l.addr)
+	assert.Equal(t, 19, l.facility)
+	assert.Equal(t, "syslog.example.com", l.tlsConfig.ServerName)
+
+	l, err = newMailLog("local", "mail", "smtprelay", "relay.example.com")
+	require.NoError(t, err)
+	assert.NotNil(t, l.dialLocal)
+
+	for _, bad := range [][2]string{
+		{"udp://syslog.example.com:514", "mail"},
+		{"tcp://syslog.example.com", "mail"},
+		{"syslog.example.com:514", "mail"},
+		{"tcp://syslog.example.com:514", "bogus"},
+	} {
+		_, err = newMailLog(bad[0], bad[1], "smtprelay", "relay.example.com")
+		require.Error(t, err, bad)
+	}
+}
+
+func TestMailLogFormat(t *testing.T) {
+	t.Parallel()
+
+	l, err := newMailLog("tcp://127.0.0.1:514", "mail", "smtp relay", "relay.example.com")
+	require.NoError(t, err)
+
+	l.pid = 42
+	now := time.Date(2024, 3, 5, 14, 30, 15, 123000000, time.UTC)
+
+	line := "<22>1 2024-03-05T14:30:15.123Z relay.example.com smtprelay 42 - - id: from=<alice@example.com>, nrcpt=1"
+	assert.Equal(t, strconv.Itoa(len(line))+" "+line, string(l.format(syslogInfo, now, "id: from=<alice@example.com>, nrcpt=1")))
+
+	l.network = "unixgram"
+	assert.Equal(t, "<20>Mar  5 14:30:15 smtp relay[42]: id: to=<bob@example.com>",
+		string(l.format(syslogWarning, now, "id: to=<bob@example.com>")))
+}
+
+func TestMailLog(t *testing.T) {
+	t.Parallel()
+
+	s := startFakeSyslog(t)
+
+	l, err := newMailLog("tcp://"+s.addr, "mail", "smtprelay", "relay.example.com")
+	require.NoError(t, err)
+
+	t.Cleanup(l.close)
+
+	peer := smtpd.Peer{
+		Username: "alice",
+		Addr:     &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345},
+	}
+
+	out := &outbound{Host: "smtp.example.com:587", Sender: "alice@example.com"}
+
+	l.received("id1", peer, "alice@example.com", 1234, 2)
+	l.delivered(&deliveryAttempt{
+		id: "id1", out: out, recipients: []string{"bob@example.org"}, delay: 420 * time.Millisecond,
+	})
+	l.delivered(&deliveryAttempt{
+		id: "id1", out: out, recipients: []string{"carol@example.org"}, delay: time.Second,
+		err: &smtpd.Error{Code: 550, EnhancedCode: "5.1.1", Msg: "User unknown"},
+	})
+	l.delivered(&deliveryAttempt{
+		id: "id1", queueID: "q1", out: &outbound{}, recipients: []string{"dave@example.org", "erin@example.org"},
+		delay: 2 * time.Second, err: &textproto.Error{Code: 421, Msg: "try again later"}, deferred: true,
+	})
+
+	assert.Equal(t, []string{
+		"id1: client=unknown[192.0.2.10], sasl_username=alice",
+		"id1: from=<alice@example.com>, size=1234, nrcpt=2",
+		"id1: to=<bob@example.org>, relay=smtp.example.com:587, delay=0.42, dsn=2.0.0, status=sent (delivered)",
+		"id1: to=<carol@example.org>, relay=smtp.example.com:587, delay=1.00, dsn=5.1.1, status=bounced (550 5.1.1 User unknown)",
+		`id1: to=<dave@example.org>, relay=none, delay=2.00, dsn=4.0.0, status=deferred (queued as q1: 421 "try again later")`,
+		`id1: to=<erin@example.org>, relay=none, delay=2.00, dsn=4.0.0, status=deferred (queued as q1: 421 "try again later")`,
+	}, s.messages(t, 6))
+
+	// the connection is reopened if the server closed it
+	s.closeConns()
+
+	require.Eventually(t, func() bool {
+		l.received("id2", smtpd.Peer{}, "", 0, 1)
+
+		return len(s.messages(t, 0)) > 6
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Contains(t, s.messages(t, 7), "id2: from=<>, nrcpt=1")
+
+	// lines are dropped while the server is unreachable
+	l, err = newMailLog("tcp://127.0.0.1:9", "mail", "smtprelay", "relay.example.com")
+	require.NoError(t, err)
+
+	l.received("id3", smtpd.Peer{}, "", 0, 1)
+	assert.Equal(t, 2, l.dropped)
+	assert.False(t, l.failedAt.IsZero())
+
+	var nilLog *mailLog
+	nilLog.received("id3", smtpd.Peer{}, "", 0, 1)
+	nilLog.delivered(&deliveryAttempt{id: "id3", out: out, recipients: []string{"bob@example.org"}})
+	nilLog.close()
+}
+
+func TestMailLogLocal(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "log")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	l, err := newMailLog("local", "mail", "smtprelay", "relay.example.com")
+	require.NoError(t, err)
+
+	t.Cleanup(l.close)
+
+	l.dialLocal = func() (net.Conn, string, error) {
+		c, err := net.Dial("unixgram", path)
+		return c, "unixgram", err
+	}
+
+	l.received("id1", smtpd.Peer{}, "alice@example.com", 0, 1)
+
+	buf := make([]byte, 1024)
+
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^<22>\w{3} [ \d]\d \d{2}:\d{2}:\d{2} smtprelay\[\d+\]: id1: client=unknown\[\]$`), string(buf[:n]))
+
+	n, err = conn.Read(buf)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(buf[:n]), "]: id1: from=<alice@example.com>, nrcpt=1"))
+}
+
+func TestMailLogDeliveries(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	s := startFakeSyslog(t)
+
+	l, err := newMailLog("tcp://"+s.addr, "mail", "smtprelay", "relay.example.com")
+	require.NoError(t, err)
+
+	t.Cleanup(l.close)
+
+	cfg := &config{
+		remoteHost: "127.0.0.1:9",
+		delivery:   deliveryDiscard,
+		mailLog:    l,
+	}
+
+	r, err := newRelay(newConfigStore(cfg), listenerConfig{}, &relayShared{})
+	require.NoError(t, err)
+
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345}}
+	env := smtpd.Envelope{
+		Sender:     "alice@example.com",
+		Recipients: []string{"bob@example.com"},
+		Data:       []byte("Subject: hi\r\n\r\nhello\r\n"),
+	}
+	require.NoError(t, r.mailHandler()(ctx, peer, env))
+
+	msgs := s.messages(t, 3)
+	require.Len(t, msgs, 3)
+
+	id, _, ok := strings.Cut(msgs[0], ": ")
+	require.True(t, ok)
+
+	assert.Equal(t, id+": client=unknown[192.0.2.10]", msgs[0])
+	assert.Regexp(t, `^`+id+`: from=<alice@example.com>, size=\d+, nrcpt=1$`, msgs[1])
+	assert.Regexp(t, `^`+id+`: to=<bob@example.com>, relay=127.0.0.1:9, delay=\d+\.\d{2}, dsn=2.0.0, status=sent \(delivered\)$`, msgs[2])
+
+	// and so are the attempts of the queue
+	deliverErr := error(&textproto.Error{Code: 421, Msg: "try again later"})
+
+	q := newTestQueue(t, t.TempDir(), func(context.Context, *queuedMessage, []byte) error {
+		return deliverErr
+	})
+	q.mailLog = l
+
+	qid, err := q.enqueue(testOutbound, []byte("hello"), errors.New("boom"))
+	require.NoError(t, err)
+
+	now := time.Now().Add(time.Minute)
+	q.processDue(ctx, now)
+
+	deliverErr = nil
+	q.processDue(ctx, now.Add(2*time.Minute))
+
+	msgs = s.messages(t, 5)
+	require.Len(t, msgs, 5)
+	assert.Regexp(t, `^`+qid+`: to=<alice@example.com>, relay=upstream:25, delay=60\.\d{2}, dsn=4.0.0, status=deferred \(421 "try again later"\)$`, msgs[3])
+	assert.Regexp(t, `^`+qid+`: to=<alice@example.com>, relay=upstream:25, delay=180\.\d{2}, dsn=2.0.0, status=sent \(delivered\)$`, msgs[4])
+}
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsVersions are the supported values of the TLS min version settings
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves are the supported values of the TLS curves settings
+var tlsCurves = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+}
+
+// tlsPolicy restricts the TLS versions, cipher suites and curves of
+// connections. Zero values keep the defaults of crypto/tls.
+type tlsPolicy struct {
+	minVersion uint16
+	ciphers    []uint16
+	curves     []tls.CurveID
+}
+
+// parseTLSPolicy parses the min version ("1.2" or "1.3"), and the cipher
+// suites and curves, separated by spaces. Only the cipher suites considered
+// secure by crypto/tls are allowed, and they only apply to TLS 1.2, as the
+// ones of TLS 1.3 aren't configurable.
+func parseTLSPolicy(minVersion, ciphers, curves string) (tlsPolicy, error) {
+	p := tlsPolicy{}
+
+	if minVersion != "" {
+		v, ok := tlsVersions[minVersion]
+		if !ok {
+			return p, fmt.Errorf("unsupported TLS version %q", minVersion)
+		}
+
+		p.minVersion = v
+	}
+
+	suites := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		suites[s.Name] = s.ID
+	}
+
+	for _, name := range splitstr(ciphers, ' ') {
+		id, ok := suites[strings.ToUpper(name)]
+		if !ok {
+			return p, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+
+		p.ciphers = append(p.ciphers, id)
+	}
+
+	for _, name := range splitstr(curves, ' ') {
+		id, ok := tlsCurves[strings.ToLower(strings.ReplaceAll(name, "-", ""))]
+		if !ok {
+			return p, fmt.Errorf("unsupported curve %q", name)
+		}
+
+		p.curves = append(p.curves, id)
+	}
+
+	return p, nil
+}
+
+// apply sets the policy on the TLS config
+func (p tlsPolicy) apply(c *tls.Config) {
+	if p.minVersion != 0 {
+		c.MinVersion = p.minVersion
+	}
+
+	if len(p.ciphers) > 0 {
+		c.CipherSuites = p.ciphers
+	}
+
+	if len(p.curves) > 0 {
+		c.CurvePreferences = p.curves
+	}
+}
@@ -0,0 +1,44 @@
+package relay
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTLSPolicy(t *testing.T) {
+	t.Parallel()
+
+	p, err := parseTLSPolicy("", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, tlsPolicy{}, p)
+
+	p, err = parseTLSPolicy("1.3",
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 tls_ecdhe_rsa_with_chacha20_poly1305_sha256",
+		"X25519 P-256")
+	require.NoError(t, err)
+	assert.Equal(t, tlsPolicy{
+		minVersion: tls.VersionTLS13,
+		ciphers:    []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256},
+		curves:     []tls.CurveID{tls.X25519, tls.CurveP256},
+	}, p)
+
+	c := &tls.Config{}
+	p.apply(c)
+	assert.Equal(t, uint16(tls.VersionTLS13), c.MinVersion)
+	assert.Equal(t, p.ciphers, c.CipherSuites)
+	assert.Equal(t, p.curves, c.CurvePreferences)
+
+	for _, bad := range [][3]string{
+		{"1.0", "", ""},
+		{"tls1.2", "", ""},
+		{"", "TLS_RSA_WITH_RC4_128_SHA", ""},
+		{"", "bogus", ""},
+		{"", "", "P224"},
+	} {
+		_, err = parseTLSPolicy(bad[0], bad[1], bad[2])
+		require.Error(t, err, "expected error for %q", bad)
+	}
+}
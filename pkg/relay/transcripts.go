@@ -0,0 +1,103 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// transcripts records the SMTP sessions of a sample of the clients, and of
+// all the clients on the networks, to a file each in dir
+type transcripts struct {
+	dir      string
+	sample   int // percentage of the sessions recorded
+	networks []*net.IPNet
+
+	// randN returns a number in [0, n) - overridable for tests
+	randN func(n int) int
+
+	logger *slog.Logger
+}
+
+// newTranscripts returns nil if dir is empty, and checks that the sessions
+// to record are set otherwise
+func newTranscripts(dir string, sample int, networks string) (*transcripts, error) {
+	if dir == "" {
+		if sample != 0 || networks != "" {
+			return nil, errors.New("transcript_sample and transcript_networks require transcript_dir to be set")
+		}
+
+		return nil, nil
+	}
+
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("transcript_dir %s isn't a directory", dir)
+	}
+
+	if sample < 0 || sample > 100 {
+		return nil, fmt.Errorf("transcript_sample must be between 0 and 100, got %d", sample)
+	}
+
+	nets, err := setupAllowedNetworks(networks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transcript_networks: %w", err)
+	}
+
+	if sample == 0 && len(nets) == 0 {
+		return nil, errors.New("transcript_dir requires transcript_sample or transcript_networks to be set")
+	}
+
+	return &transcripts{
+		dir:      dir,
+		sample:   sample,
+		networks: nets,
+		randN:    rand.IntN,
+		logger:   slog.Default().With(slog.String("component", "transcripts")),
+	}, nil
+}
+
+// recorded reports whether the session with peer is recorded
+func (t *transcripts) recorded(peer smtpd.Peer) bool {
+	if ip := peerIP(peer); ip != nil && slices.ContainsFunc(t.networks, func(n *net.IPNet) bool {
+		return n.Contains(ip)
+	}) {
+		return true
+	}
+
+	return t.randN(100) < t.sample
+}
+
+// open creates the file the session with peer is recorded to, named after
+// the time it starts. It returns nil if the session isn't recorded, or if the
+// file can't be created, which doesn't fail the session.
+func (t *transcripts) open(ctx context.Context, peer smtpd.Peer) io.WriteCloser {
+	if t == nil || !t.recorded(peer) {
+		return nil
+	}
+
+	name := fmt.Sprintf("%s-%s.log", time.Now().UTC().Format("20060102T150405Z"), generateUUID())
+
+	// the transcripts may have the addresses of the senders and recipients
+	f, err := os.OpenFile(filepath.Join(t.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		t.logger.WarnContext(ctx, "cannot record session transcript",
+			slog.String("client_ip", peer.Addr.String()), slog.Any("error", err))
+
+		return nil
+	}
+
+	t.logger.DebugContext(ctx, "recording session transcript",
+		slog.String("client_ip", peer.Addr.String()), slog.String("file", f.Name()))
+
+	return f
+}
@@ -0,0 +1,122 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTranscripts(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	tr, err := newTranscripts("", 0, "")
+	require.NoError(t, err)
+	assert.Nil(t, tr)
+
+	tr, err = newTranscripts(dir, 10, "192.0.2.0/24 2001:db8::/32")
+	require.NoError(t, err)
+	assert.Equal(t, 10, tr.sample)
+	assert.Len(t, tr.networks, 2)
+
+	for _, tc := range []struct {
+		dir      string
+		sample   int
+		networks string
+	}{
+		{"", 10, ""},
+		{"", 0, "192.0.2.0/24"},
+		{dir, 0, ""},
+		{dir, 101, ""},
+		{dir, -1, "192.0.2.0/24"},
+		{dir, 0, "192.0.2.1/24"},
+		{filepath.Join(dir, "missing"), 100, ""},
+	} {
+		_, err := newTranscripts(tc.dir, tc.sample, tc.networks)
+		require.Error(t, err, tc)
+	}
+}
+
+func TestTranscriptsRecorded(t *testing.T) {
+	t.Parallel()
+
+	tr, err := newTranscripts(t.TempDir(), 10, "192.0.2.0/24")
+	require.NoError(t, err)
+
+	peer := func(ip string) smtpd.Peer {
+		return smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 12345}}
+	}
+
+	n := 10
+	tr.randN = func(int) int { return n }
+
+	assert.True(t, tr.recorded(peer("192.0.2.10")))
+	assert.False(t, tr.recorded(peer("198.51.100.10")))
+
+	n = 9
+	assert.True(t, tr.recorded(peer("198.51.100.10")))
+
+	w := tr.open(context.Background(), peer("192.0.2.10"))
+	require.NotNil(t, w)
+	require.NoError(t, w.Close())
+
+	files, err := os.ReadDir(tr.dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Regexp(t, `^\d{8}T\d{6}Z-[0-9a-f-]{36}\.log$`, files[0].Name())
+
+	// sessions aren't failed if the file can't be created
+	tr.dir = filepath.Join(tr.dir, "missing")
+	assert.Nil(t, tr.open(context.Background(), peer("192.0.2.10")))
+}
+
+func TestRelayTranscripts(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv := startTestSMTPServer(ctx, t)
+
+	dir := t.TempDir()
+
+	tr, err := newTranscripts(dir, 0, "127.0.0.0/8")
+	require.NoError(t, err)
+
+	addr := startRelayConfig(ctx, t, "", &config{remoteHost: srv.addr, transcripts: tr})
+
+	err = sendMsg(t, addr, []string{"alice@example.com"},
+		"bob@example.com", "test message", textproto.MIMEHeader{}, "hello world")
+	require.NoError(t, err)
+
+	// the relay was also connected to, to wait for it to start
+	var transcript string
+
+	require.Eventually(t, func() bool {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+		for _, file := range files {
+			data, _ := os.ReadFile(file)
+			if transcript = string(data); strings.Contains(transcript, "MAIL FROM") &&
+				strings.HasSuffix(transcript, " -- connection closed\n") {
+				return true
+			}
+		}
+
+		return false
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assert.Contains(t, transcript, " C MAIL FROM:<bob@example.com>")
+	assert.Contains(t, transcript, " C RCPT TO:<alice@example.com>")
+	assert.Contains(t, transcript, " S 221 2.0.0 OK, bye")
+	assert.NotContains(t, transcript, "hello world")
+}
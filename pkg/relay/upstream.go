@@ -0,0 +1,699 @@
+package relay
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/auth"
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/evidentiq/smtprelay/v2/internal/traceutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// outbound is the envelope of a message to be delivered to an upstream host
+type outbound struct {
+	Host       string   `json:"host"`
+	Sender     string   `json:"sender"`
+	Recipients []string `json:"recipients"`
+
+	// SMTPUTF8 and 8BITMIME requirements, as requested by the client
+	SMTPUTF8 bool `json:"smtputf8,omitempty"`
+	Body8Bit bool `json:"body_8bit,omitempty"`
+
+	// Size is the size of the message, sent with the SIZE parameter if the
+	// upstream supports it: the actual size of buffered messages, or the one
+	// declared by the client for streamed ones. 0 if unknown.
+	Size int64 `json:"size,omitempty"`
+
+	// CredentialsKey selects the upstream credentials from remote_credentials,
+	// empty for the default remote_user/remote_pass. The key is stored rather
+	// than the credentials, so queued messages don't hold any secrets.
+	CredentialsKey string `json:"credentials_key,omitempty"`
+
+	// DSN parameters (RFC 3461), forwarded if the upstream supports DSN
+	DSNRet   string                        `json:"dsn_ret,omitempty"`
+	DSNEnvID string                        `json:"dsn_envid,omitempty"`
+	DSN      map[string]smtpd.RecipientDSN `json:"dsn,omitempty"`
+
+	// Priority is the MT-PRIORITY parameter (RFC 6710), forwarded if the
+	// upstream supports it, and the order of the queued deliveries
+	Priority int `json:"priority,omitempty"`
+
+	// Client is forwarded with XCLIENT or XFORWARD if remote_xclient is set
+	Client *clientInfo `json:"client,omitempty"`
+
+	// direct is set when delivering to an MX host of the recipient domain,
+	// which isn't authenticated with
+	direct bool
+
+	// sentVia and tlsState describe the SMTP upstream the message was last
+	// sent to, for the audit log: the MX host of direct deliveries, and the
+	// TLS state of the connection if it was encrypted
+	sentVia  string
+	tlsState *tls.ConnectionState
+
+	// reply is the reply of the upstream accepting the message, without its
+	// code, and upstreamDSN is set if it was given the DSN parameters, so it
+	// notifies the delivery to the recipients itself
+	reply       string
+	upstreamDSN bool
+}
+
+// newOutbound builds the outbound envelope for the recipients delivered to
+// host, carrying over the SMTPUTF8, BODY, SIZE, DSN and MT-PRIORITY parameters
+// of the original envelope
+func newOutbound(env *smtpd.Envelope, host, sender string, recipients []string) *outbound {
+	out := &outbound{
+		Host:       host,
+		Sender:     sender,
+		Recipients: recipients,
+		SMTPUTF8:   env.SMTPUTF8,
+		Body8Bit:   env.BodyType == smtpd.Body8BitMIME,
+		Size:       env.Size,
+		DSNRet:     env.DSNRet,
+		DSNEnvID:   env.DSNEnvID,
+		Priority:   env.Priority,
+	}
+
+	for _, rcpt := range recipients {
+		if dsn, ok := env.DSN[rcpt]; ok {
+			if out.DSN == nil {
+				out.DSN = map[string]smtpd.RecipientDSN{}
+			}
+
+			out.DSN[rcpt] = dsn
+		}
+	}
+
+	return out
+}
+
+// sentThrough records the outcome of the delivery of hostOut, the copy of
+// the envelope sent to one of the hosts of an upstream group or MX hosts
+func (out *outbound) sentThrough(host string, hostOut *outbound) {
+	out.sentVia, out.tlsState = host, hostOut.tlsState
+	out.reply, out.upstreamDSN = hostOut.reply, hostOut.upstreamDSN
+}
+
+// seekableBody returns the body as an io.ReadSeeker, so it can be sent to
+// several hosts in turn, reading it in memory if it isn't one already
+func seekableBody(body io.Reader) (io.ReadSeeker, error) {
+	if rs, ok := body.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("data: %w", err)
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// mailParams returns the ESMTP parameters of the MAIL FROM command, with the
+// SIZE, DSN and MT-PRIORITY ones if the upstream supports them
+func (out *outbound) mailParams(dsn, size, priority bool) string {
+	params := ""
+
+	if size && out.Size > 0 {
+		params += " SIZE=" + strconv.FormatInt(out.Size, 10)
+	}
+
+	if out.Body8Bit {
+		params += " BODY=" + smtpd.Body8BitMIME
+	}
+
+	if out.SMTPUTF8 {
+		params += " SMTPUTF8"
+	}
+
+	if dsn && out.DSNRet != "" {
+		params += " RET=" + out.DSNRet
+	}
+
+	if dsn && out.DSNEnvID != "" {
+		params += " ENVID=" + out.DSNEnvID
+	}
+
+	if priority && out.Priority != 0 {
+		params += " MT-PRIORITY=" + strconv.Itoa(out.Priority)
+	}
+
+	return params
+}
+
+// rcptParams returns the ESMTP parameters of the RCPT TO command for rcpt
+func (out *outbound) rcptParams(rcpt string, dsn bool) string {
+	if !dsn {
+		return ""
+	}
+
+	p := out.DSN[rcpt]
+	params := ""
+
+	if p.Notify != "" {
+		params += " NOTIFY=" + p.Notify
+	}
+
+	if p.ORcpt != "" {
+		params += " ORCPT=" + p.ORcpt
+	}
+
+	return params
+}
+
+// sendMail delivers the message on a new connection, see upstreamPool.send
+func sendMail(cfg *config, out *outbound, data []byte) error {
+	var p *upstreamPool
+
+	return p.send(context.Background(), cfg, out, bytes.NewReader(data))
+}
+
+// countingReader counts the bytes read, for streamed messages whose size
+// isn't known upfront
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// upstreamConn is a connection to an upstream host, ready to send messages:
+// STARTTLS and authentication are done once, when it's established
+type upstreamConn struct {
+	c       *smtp.Client
+	created time.Time
+
+	// replied is set once a reply was read in the current transaction, so
+	// failures on reused connections are only retried if nothing was sent
+	replied bool
+
+	// broken is set if the connection can't be used for further messages
+	broken bool
+
+	// tls is set if the connection was upgraded with STARTTLS
+	tls bool
+
+	// forward is the command forwarding the client of each message, empty
+	// for none, and localName the name the upstream is greeted with
+	forward   string
+	localName string
+}
+
+// dialUpstream connects to the upstream host, authenticating with the
+// credentials selected for the message. Like smtp.SendMail, it upgrades to
+// TLS when the upstream supports STARTTLS.
+func dialUpstream(ctx context.Context, cfg *config, out *outbound) (*upstreamConn, error) {
+	uc, err := dialUpstreamOnce(ctx, cfg, out)
+
+	// access tokens may be revoked or expire early: get a new one and try
+	// again once
+	var tperr *textproto.Error
+	if errors.As(err, &tperr) && tperr.Code == 535 && cfg.oauthTokens != nil {
+		cfg.oauthTokens.Invalidate()
+
+		uc, err = dialUpstreamOnce(ctx, cfg, out)
+	}
+
+	return uc, err
+}
+
+func dialUpstreamOnce(ctx context.Context, cfg *config, out *outbound) (*upstreamConn, error) {
+	_, span := startUpstreamSpan(ctx, "upstream.dial", out)
+
+	c, err := dialSMTP(ctx, cfg, out.Host)
+	if err != nil {
+		err = fmt.Errorf("dial: %w", err)
+		endUpstreamSpan(span, err)
+
+		return nil, err
+	}
+
+	span.End()
+
+	uc := &upstreamConn{c: c, created: time.Now()}
+
+	if err := uc.setup(ctx, cfg, out); err != nil {
+		c.Close()
+
+		return nil, err
+	}
+
+	return uc, nil
+}
+
+// dialSMTP connects to the SMTP upstream with the outbound dialer, and reads
+// its greeting
+func dialSMTP(ctx context.Context, cfg *config, host string) (*smtp.Client, error) {
+	conn, err := cfg.dialer.dial(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _, _ := net.SplitHostPort(host)
+
+	c, err := smtp.NewClient(conn, hostname)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// setup greets the upstream, then upgrades the connection to TLS and
+// authenticates if needed, each step being traced in its own span
+func (uc *upstreamConn) setup(ctx context.Context, cfg *config, out *outbound) error {
+	// same default as net/smtp
+	localName := cfg.hostName
+	if localName == "" {
+		localName = "localhost"
+	}
+
+	_, span := startUpstreamSpan(ctx, "upstream.ehlo", out)
+
+	if err := uc.c.Hello(localName); err != nil {
+		err = fmt.Errorf("hello: %w", err)
+		endUpstreamSpan(span, err)
+
+		return err
+	}
+
+	span.End()
+
+	uc.localName = localName
+
+	// MX hosts don't trust the relay
+	if !out.direct {
+		uc.forward = cfg.remoteXClient
+	}
+
+	hostname, _, _ := net.SplitHostPort(out.Host)
+
+	tlsConfig := &tls.Config{ServerName: hostname}
+
+	// with TLSA records, TLS is mandatory and authenticated with them
+	var tlsa []tlsaRecord
+	if cfg.dane != nil {
+		var err error
+		if tlsa, err = cfg.dane.records(out.Host); err != nil {
+			return err
+		}
+
+		if tlsa != nil {
+			tlsConfig = cfg.dane.tlsConfig(hostname, tlsa)
+		}
+	}
+
+	cfg.remoteTLS.apply(tlsConfig)
+
+	if ok, _ := uc.c.Extension("STARTTLS"); ok {
+		_, span := startUpstreamSpan(ctx, "upstream.starttls", out)
+
+		if err := uc.c.StartTLS(tlsConfig); err != nil {
+			err = fmt.Errorf("starttls: %w", err)
+			endUpstreamSpan(span, err)
+
+			return err
+		}
+
+		span.End()
+
+		uc.tls = true
+	} else if tlsa != nil {
+		return fmt.Errorf("dane: upstream %s doesn't support STARTTLS", out.Host)
+	}
+
+	if out.direct {
+		return nil
+	}
+
+	a, err := cfg.upstreamSASL(cfg.upstreamAuth(out.CredentialsKey), hostname)
+	if err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+
+	if a != nil {
+		if ok, _ := uc.c.Extension("AUTH"); !ok {
+			return fmt.Errorf("auth: upstream %s doesn't support AUTH", out.Host)
+		}
+
+		_, span := startUpstreamSpan(ctx, "upstream.auth", out,
+			attribute.String("smtp.auth.mechanism", cmp.Or(cfg.remoteAuth, "plain")))
+
+		if err := uc.c.Auth(a); err != nil {
+			err = fmt.Errorf("auth: %w", err)
+			endUpstreamSpan(span, err)
+
+			return err
+		}
+
+		span.End()
+	}
+
+	return nil
+}
+
+// upstreamSASL returns the SASL mechanism selected with remote_auth, nil if
+// there are no credentials to authenticate with
+func (cfg *config) upstreamSASL(creds upstreamCredentials, hostname string) (smtp.Auth, error) {
+	// XOAUTH2 and OAUTHBEARER use access tokens rather than passwords
+	if creds.username == "" || (creds.password == "" && cfg.oauthTokens == nil) {
+		return nil, nil
+	}
+
+	switch cfg.remoteAuth {
+	case "", "plain":
+		return smtp.PlainAuth("", creds.username, creds.password, hostname), nil
+	case "scram-sha-256":
+		return auth.SCRAMSHA256Auth(creds.username, creds.password), nil
+	case "xoauth2":
+		return auth.XOAuth2Auth(creds.username, cfg.oauthTokens), nil
+	case "oauthbearer":
+		return auth.OAuthBearerAuth(creds.username, cfg.oauthTokens), nil
+	default:
+		return nil, smtpd.ErrUnsupportedAuthMethod
+	}
+}
+
+// send sends the message in a new transaction. It fails without sending the
+// message if the envelope needs SMTPUTF8 or 8BITMIME and the upstream doesn't
+// advertise it. The body is only read once the upstream accepted the DATA
+// command. If the upstream rejects some of the recipients only, the message is
+// delivered to the other ones, and a recipientErrors is returned.
+func (uc *upstreamConn) send(ctx context.Context, out *outbound, body io.Reader) (err error) {
+	uc.replied = false
+
+	_, span := startUpstreamSpan(ctx, "upstream.data", out,
+		traceutil.Sender(out.Sender),
+		traceutil.Recipients(out.Recipients),
+	)
+
+	counted := &countingReader{r: body}
+	body = counted
+
+	defer func() {
+		span.SetAttributes(traceutil.DataSize(counted.n))
+		if err == nil {
+			span.SetAttributes(traceutil.StatusCode(250))
+		}
+
+		endUpstreamSpan(span, err)
+	}()
+
+	out.tlsState, out.reply, out.upstreamDSN = nil, "", false
+	if state, ok := uc.c.TLSConnectionState(); ok {
+		out.tlsState = &state
+	}
+
+	if ok, _ := uc.c.Extension("SMTPUTF8"); out.SMTPUTF8 && !ok {
+		return smtpd.ErrSMTPUTF8Unsupported
+	}
+
+	if ok, _ := uc.c.Extension("8BITMIME"); out.Body8Bit && !ok {
+		return smtpd.Err8BitMIMEUnsupported
+	}
+
+	if err := uc.forwardClient(out); err != nil {
+		return err
+	}
+
+	// SIZE, DSN and MT-PRIORITY parameters are silently dropped if the
+	// upstream doesn't support them
+	dsn, _ := uc.c.Extension("DSN")
+	size, _ := uc.c.Extension("SIZE")
+	priority, _ := uc.c.Extension("MT-PRIORITY")
+	out.upstreamDSN = dsn
+
+	// MAIL and RCPT are sent directly, as net/smtp doesn't support passing
+	// ESMTP parameters
+	cmds := []string{fmt.Sprintf("MAIL FROM:<%s>%s", out.Sender, out.mailParams(dsn, size, priority))}
+	for _, rcpt := range out.Recipients {
+		cmds = append(cmds, fmt.Sprintf("RCPT TO:<%s>%s", rcpt, out.rcptParams(rcpt, dsn)))
+	}
+
+	cmds = append(cmds, "DATA")
+
+	var errs []error
+	if ok, _ := uc.c.Extension("PIPELINING"); ok {
+		errs = uc.pipeline(cmds)
+	} else {
+		errs = uc.sequence(cmds)
+	}
+
+	if uc.broken {
+		return errs[len(errs)-1]
+	}
+
+	// the recipients rejected by the upstream are reported separately, the
+	// message is still delivered to the accepted ones
+	var (
+		rcptErrs = recipientErrors{}
+		rcptErr  error
+	)
+
+	for i, rcpt := range out.Recipients {
+		if i+1 >= len(errs) || errs[i+1] == nil {
+			continue
+		}
+
+		var tperr *textproto.Error
+		if errors.As(errs[i+1], &tperr) {
+			rcptErrs[rcpt] = tperr
+		}
+
+		rcptErr = cmp.Or(rcptErr, errs[i+1])
+	}
+
+	dataSent := len(errs) == len(cmds)
+
+	if errs[0] != nil || len(rcptErrs) == len(out.Recipients) {
+		// DATA was accepted even though the transaction failed: dropping the
+		// connection is the only way to abort it without sending the message
+		if dataSent && errs[len(errs)-1] == nil {
+			uc.broken = true
+		}
+
+		return cmp.Or(errs[0], rcptErr)
+	}
+
+	if err := errs[len(errs)-1]; err != nil {
+		return err
+	}
+
+	// if the body can't be read, e.g. as the message is too big, the
+	// connection is dropped before completing the message so the upstream
+	// discards it
+	w := uc.c.Text.DotWriter()
+	if _, err := io.Copy(w, body); err != nil {
+		uc.broken = true
+		return fmt.Errorf("data: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		uc.broken = true
+		return fmt.Errorf("data: %w", err)
+	}
+
+	_, reply, err := uc.c.Text.ReadResponse(250)
+	if err != nil {
+		return uc.result("DATA", err)
+	}
+
+	out.reply = reply
+
+	if len(rcptErrs) > 0 {
+		return rcptErrs
+	}
+
+	return nil
+}
+
+// cmd sends a command of the transaction and reads its reply
+func (uc *upstreamConn) cmd(line string) error {
+	id, err := uc.c.Text.Cmd("%s", line)
+	if err != nil {
+		return uc.result(line, err)
+	}
+
+	uc.c.Text.StartResponse(id)
+	defer uc.c.Text.EndResponse(id)
+
+	_, _, err = uc.c.Text.ReadResponse(expectedCode(line))
+
+	return uc.result(line, err)
+}
+
+// sequence sends the commands of the transaction one at a time, and returns
+// their errors in order. It stops after a failed MAIL command, and before DATA
+// if all the recipients were rejected, or once the connection is broken.
+func (uc *upstreamConn) sequence(cmds []string) []error {
+	errs := make([]error, 0, len(cmds))
+	accepted := false
+
+	for i, line := range cmds {
+		if i == len(cmds)-1 && !accepted {
+			break
+		}
+
+		err := uc.cmd(line)
+		errs = append(errs, err)
+
+		if uc.broken || (i == 0 && err != nil) {
+			break
+		}
+
+		accepted = accepted || (i > 0 && err == nil)
+	}
+
+	return errs
+}
+
+// pipeline sends the commands of the transaction at once, then reads their
+// replies (RFC 2920), and returns their errors in order. It stops once the
+// connection is broken.
+func (uc *upstreamConn) pipeline(cmds []string) []error {
+	ids := make([]uint, 0, len(cmds))
+
+	for _, line := range cmds {
+		id, err := uc.c.Text.Cmd("%s", line)
+		if err != nil {
+			return []error{uc.result(line, err)}
+		}
+
+		ids = append(ids, id)
+	}
+
+	errs := make([]error, 0, len(cmds))
+
+	for i, id := range ids {
+		uc.c.Text.StartResponse(id)
+		_, _, err := uc.c.Text.ReadResponse(expectedCode(cmds[i]))
+		uc.c.Text.EndResponse(id)
+
+		errs = append(errs, uc.result(cmds[i], err))
+		if uc.broken {
+			break
+		}
+	}
+
+	return errs
+}
+
+// result records the outcome of a command, and wraps its error. Protocol
+// errors leave the connection usable, other ones break it.
+func (uc *upstreamConn) result(line string, err error) error {
+	if err == nil {
+		uc.replied = true
+		return nil
+	}
+
+	var tperr *textproto.Error
+	if errors.As(err, &tperr) {
+		uc.replied = true
+	} else {
+		uc.broken = true
+	}
+
+	verb, _, _ := strings.Cut(line, " ")
+	label := strings.ToLower(verb)
+
+	if rcpt, ok := strings.CutPrefix(line, "RCPT TO:<"); ok {
+		rcpt, _, _ = strings.Cut(rcpt, ">")
+		label += " " + rcpt
+	}
+
+	return fmt.Errorf("%s: %w", label, err)
+}
+
+// expectedCode returns the expected reply code of a transaction command
+func expectedCode(line string) int {
+	switch {
+	case strings.HasPrefix(line, "RCPT"):
+		return 25
+	case line == "DATA":
+		return 354
+	case strings.HasPrefix(line, "XCLIENT"):
+		return 220
+	default:
+		return 250
+	}
+}
+
+// reset aborts the current transaction, so the connection can be reused
+func (uc *upstreamConn) reset() error {
+	return uc.c.Reset()
+}
+
+// close ends the session, politely if the connection is still usable
+func (uc *upstreamConn) close() {
+	if !uc.broken {
+		_ = uc.c.Quit()
+	}
+
+	_ = uc.c.Close()
+}
+
+// cmd sends a command and reads the reply, failing if the reply code doesn't
+// start with expectCode
+func cmd(text *textproto.Conn, expectCode int, format string, args ...any) error {
+	id, err := text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+
+	_, _, err = text.ReadResponse(expectCode)
+
+	return err
+}
+
+// startUpstreamSpan starts the span of a step of the conversation with the
+// upstream host of out
+func startUpstreamSpan(ctx context.Context, name string, out *outbound, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	host, port, _ := net.SplitHostPort(out.Host)
+
+	attrs = append(attrs, semconv.ServerAddress(host))
+	if n, err := strconv.Atoi(port); err == nil {
+		attrs = append(attrs, semconv.ServerPort(n))
+	}
+
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endUpstreamSpan ends the span, recording the error and the reply code of
+// the upstream if the step failed
+func endUpstreamSpan(span trace.Span, err error) {
+	if err != nil {
+		var tperr *textproto.Error
+		if errors.As(err, &tperr) {
+			span.SetAttributes(traceutil.StatusCode(tperr.Code))
+		}
+
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
@@ -0,0 +1,535 @@
+package relay
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// fakeUpstream is a minimal scripted SMTP server, advertising only the given
+// extensions and recording the commands it receives
+type fakeUpstream struct {
+	addr       string
+	extensions []string
+
+	// replies overrides the reply to commands starting with the given prefix
+	replies map[string]string
+
+	mu       sync.Mutex
+	commands []string
+	data     []string
+}
+
+func startFakeUpstream(t *testing.T, extensions ...string) *fakeUpstream {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = l.Close() })
+
+	u := &fakeUpstream{
+		addr:       l.Addr().String(),
+		extensions: extensions,
+		replies:    map[string]string{},
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go u.serve(conn)
+		}
+	}()
+
+	return u
+}
+
+func (u *fakeUpstream) serve(conn net.Conn) {
+	defer conn.Close()
+
+	tc := textproto.NewConn(conn)
+
+	_ = tc.PrintfLine("220 fake ESMTP")
+
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+
+		u.mu.Lock()
+		u.commands = append(u.commands, line)
+		reply, ok := "", false
+		for prefix, r := range u.replies {
+			if strings.HasPrefix(strings.ToUpper(line), prefix) {
+				reply, ok = r, true
+			}
+		}
+		u.mu.Unlock()
+
+		verb, _, _ := strings.Cut(strings.ToUpper(line), " ")
+
+		switch {
+		case ok:
+			_ = tc.PrintfLine("%s", reply)
+		case verb == "EHLO":
+			lines := append([]string{"fake"}, u.extensions...)
+			for i, l := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				_ = tc.PrintfLine("250%s%s", sep, l)
+			}
+		case verb == "DATA":
+			_ = tc.PrintfLine("354 go ahead")
+
+			b, err := tc.ReadDotBytes()
+			if err != nil {
+				return
+			}
+
+			u.mu.Lock()
+			u.data = append(u.data, string(b))
+			u.mu.Unlock()
+
+			_ = tc.PrintfLine("250 queued as 12345")
+		case verb == "QUIT":
+			_ = tc.PrintfLine("221 bye")
+			return
+		default:
+			_ = tc.PrintfLine("250 ok")
+		}
+	}
+}
+
+// setReply overrides the reply to commands starting with prefix
+func (u *fakeUpstream) setReply(prefix, reply string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.replies[prefix] = reply
+}
+
+func (u *fakeUpstream) received() ([]string, []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return append([]string{}, u.commands...), append([]string{}, u.data...)
+}
+
+func TestSendMailExtensions(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{hostName: "relay.example.com"}
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+
+	t.Run("plain message to a minimal upstream", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t)
+
+		err := sendMail(cfg, &outbound{Host: u.addr, Sender: "bob@example.com", Recipients: []string{"alice@example.com"}}, data)
+		require.NoError(t, err)
+
+		cmds, msgs := u.received()
+		assert.Equal(t, []string{
+			"EHLO relay.example.com",
+			"MAIL FROM:<bob@example.com>",
+			"RCPT TO:<alice@example.com>",
+			"DATA",
+			"QUIT",
+		}, cmds)
+		assert.Equal(t, []string{"Subject: test\n\nhello\n"}, msgs)
+	})
+
+	t.Run("SMTPUTF8 required but not supported", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t, "8BITMIME")
+
+		err := sendMail(cfg, &outbound{Host: u.addr, Sender: "josé@example.com", Recipients: []string{"alice@example.com"}, SMTPUTF8: true}, data)
+		require.ErrorIs(t, err, smtpd.ErrSMTPUTF8Unsupported)
+		assert.False(t, isTemporaryErr(err))
+
+		cmds, _ := u.received()
+		assert.NotContains(t, cmds, "DATA")
+	})
+
+	t.Run("8BITMIME required but not supported", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t, "SMTPUTF8")
+
+		err := sendMail(cfg, &outbound{Host: u.addr, Sender: "bob@example.com", Recipients: []string{"alice@example.com"}, Body8Bit: true}, data)
+		require.ErrorIs(t, err, smtpd.Err8BitMIMEUnsupported)
+	})
+
+	t.Run("SMTPUTF8 and 8BITMIME supported", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t, "8BITMIME", "SMTPUTF8")
+
+		err := sendMail(cfg, &outbound{Host: u.addr, Sender: "josé@example.com", Recipients: []string{"alice@example.com"}, SMTPUTF8: true, Body8Bit: true}, data)
+		require.NoError(t, err)
+
+		cmds, _ := u.received()
+		assert.Contains(t, cmds, "MAIL FROM:<josé@example.com> BODY=8BITMIME SMTPUTF8")
+	})
+}
+
+func TestSendMailDSN(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{hostName: "relay.example.com"}
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+
+	env := &smtpd.Envelope{
+		Sender:     "bob@example.com",
+		Recipients: []string{"alice@example.com", "carol@example.com"},
+		DSNRet:     smtpd.DSNRetHeaders,
+		DSNEnvID:   "QQ314159",
+		DSN: map[string]smtpd.RecipientDSN{
+			"alice@example.com": {Notify: "SUCCESS,FAILURE", ORcpt: "rfc822;alice@example.com"},
+		},
+	}
+
+	out := newOutbound(env, "", env.Sender, env.Recipients)
+
+	t.Run("forwarded to upstream supporting DSN", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t, "DSN")
+
+		o := *out
+		o.Host = u.addr
+
+		require.NoError(t, sendMail(cfg, &o, data))
+
+		cmds, _ := u.received()
+		assert.Contains(t, cmds, "MAIL FROM:<bob@example.com> RET=HDRS ENVID=QQ314159")
+		assert.Contains(t, cmds, "RCPT TO:<alice@example.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;alice@example.com")
+		assert.Contains(t, cmds, "RCPT TO:<carol@example.com>")
+	})
+
+	t.Run("dropped for upstream not supporting DSN", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t)
+
+		o := *out
+		o.Host = u.addr
+
+		require.NoError(t, sendMail(cfg, &o, data))
+
+		cmds, _ := u.received()
+		assert.Contains(t, cmds, "MAIL FROM:<bob@example.com>")
+		assert.Contains(t, cmds, "RCPT TO:<alice@example.com>")
+	})
+}
+
+func TestSendMailSize(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{hostName: "relay.example.com"}
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+
+	env := &smtpd.Envelope{Sender: "bob@example.com", Recipients: []string{"alice@example.com"}, Size: 1234}
+	out := newOutbound(env, "", env.Sender, env.Recipients)
+	assert.Equal(t, int64(1234), out.Size)
+
+	// the parameter is dropped if the upstream doesn't support it
+	for expected, extensions := range map[string][]string{
+		"MAIL FROM:<bob@example.com> SIZE=1234": {"SIZE 10240000"},
+		"MAIL FROM:<bob@example.com>":           nil,
+	} {
+		u := startFakeUpstream(t, extensions...)
+
+		o := *out
+		o.Host = u.addr
+
+		require.NoError(t, sendMail(cfg, &o, data))
+
+		cmds, _ := u.received()
+		assert.Contains(t, cmds, expected)
+	}
+}
+
+func TestSendMailPriority(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{hostName: "relay.example.com"}
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+
+	env := &smtpd.Envelope{Sender: "bob@example.com", Recipients: []string{"alice@example.com"}, Priority: -3}
+	out := newOutbound(env, "", env.Sender, env.Recipients)
+	assert.Equal(t, -3, out.Priority)
+
+	// the parameter is dropped if the upstream doesn't support it
+	for expected, extensions := range map[string][]string{
+		"MAIL FROM:<bob@example.com> MT-PRIORITY=-3": {"MT-PRIORITY"},
+		"MAIL FROM:<bob@example.com>":                nil,
+	} {
+		u := startFakeUpstream(t, extensions...)
+
+		o := *out
+		o.Host = u.addr
+
+		require.NoError(t, sendMail(cfg, &o, data))
+
+		cmds, _ := u.received()
+		assert.Contains(t, cmds, expected)
+	}
+}
+
+func TestSendMailRecipientErrors(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{hostName: "relay.example.com"}
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+
+	for _, extensions := range [][]string{nil, {"PIPELINING"}} {
+		t.Run("some recipients rejected "+strings.Join(extensions, ""), func(t *testing.T) {
+			t.Parallel()
+
+			u := startFakeUpstream(t, extensions...)
+			u.setReply("RCPT TO:<CAROL@", "452 4.2.2 mailbox full")
+			u.setReply("RCPT TO:<DAVE@", "550 5.1.1 no such user")
+
+			out := &outbound{
+				Host:       u.addr,
+				Sender:     "bob@example.com",
+				Recipients: []string{"alice@example.com", "carol@example.com", "dave@example.com"},
+			}
+
+			err := sendMail(cfg, out, data)
+
+			var rcptErrs recipientErrors
+			require.ErrorAs(t, err, &rcptErrs)
+			assert.Len(t, rcptErrs, 2)
+
+			retry, tempErr, permErr := rcptErrs.split(out)
+			require.NotNil(t, retry)
+			assert.Equal(t, []string{"carol@example.com"}, retry.Recipients)
+
+			var tperr *textproto.Error
+			require.ErrorAs(t, tempErr, &tperr)
+			assert.Equal(t, 452, tperr.Code)
+
+			require.ErrorAs(t, permErr, &tperr)
+			assert.Equal(t, 550, tperr.Code)
+
+			_, msgs := u.received()
+			assert.Len(t, msgs, 1)
+		})
+
+		t.Run("all recipients rejected "+strings.Join(extensions, ""), func(t *testing.T) {
+			t.Parallel()
+
+			u := startFakeUpstream(t, extensions...)
+			u.setReply("RCPT", "550 5.1.1 no such user")
+
+			out := &outbound{
+				Host:       u.addr,
+				Sender:     "bob@example.com",
+				Recipients: []string{"alice@example.com", "carol@example.com"},
+			}
+
+			err := sendMail(cfg, out, data)
+			require.ErrorContains(t, err, "rcpt alice@example.com:")
+
+			var rcptErrs recipientErrors
+			assert.NotErrorAs(t, err, &rcptErrs)
+
+			cmds, msgs := u.received()
+			assert.Empty(t, msgs)
+
+			if extensions == nil {
+				assert.NotContains(t, cmds, "DATA")
+			}
+		})
+	}
+}
+
+func TestSendMailCredentials(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config{
+		remoteUser: "default",
+		remotePass: "defaultpass",
+		remoteCredentials: map[string]upstreamCredentials{
+			"@example.com": {username: "tenant", password: "tenantpass"},
+		},
+	}
+
+	testCases := map[string]string{
+		"":             "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00default\x00defaultpass")),
+		"@example.com": "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00tenant\x00tenantpass")),
+	}
+
+	for key, expected := range testCases {
+		t.Run(key, func(t *testing.T) {
+			t.Parallel()
+
+			u := startFakeUpstream(t, "AUTH PLAIN")
+			u.setReply("AUTH", "235 ok")
+
+			out := &outbound{Host: u.addr, Sender: "bob@example.com", Recipients: []string{"alice@example.com"}, CredentialsKey: key}
+			require.NoError(t, sendMail(cfg, out, []byte("hello\r\n")))
+
+			cmds, _ := u.received()
+			assert.Contains(t, cmds, expected)
+		})
+	}
+}
+
+func TestSendMailXOAUTH2(t *testing.T) {
+	t.Parallel()
+
+	issued := 0
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		issued++
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3600}`, issued)
+	}))
+	t.Cleanup(tokenSrv.Close)
+
+	cfg := &config{
+		remoteUser:     "bob@example.com",
+		remoteAuth:     "xoauth2",
+		remoteOAuthURL: tokenSrv.URL,
+		remoteOAuthID:  "id",
+	}
+	require.NoError(t, cfg.setup())
+
+	xoauth2 := func(token string) string {
+		return "AUTH XOAUTH2 " + base64.StdEncoding.EncodeToString([]byte("user=bob@example.com\x01auth=Bearer "+token+"\x01\x01"))
+	}
+
+	// the first token was revoked
+	u := startFakeUpstream(t, "AUTH XOAUTH2")
+	u.setReply(strings.ToUpper(xoauth2("token-1")), "535 5.7.8 token expired")
+	u.setReply(strings.ToUpper(xoauth2("token-2")), "235 ok")
+
+	out := &outbound{Host: u.addr, Sender: "bob@example.com", Recipients: []string{"alice@example.com"}}
+	require.NoError(t, sendMail(cfg, out, []byte("hello\r\n")))
+	require.NoError(t, sendMail(cfg, out, []byte("hello\r\n")))
+
+	cmds, msgs := u.received()
+	assert.Contains(t, cmds, xoauth2("token-1"))
+	assert.Contains(t, cmds, xoauth2("token-2"))
+	assert.Len(t, msgs, 2)
+
+	// the new token is cached
+	assert.Equal(t, 2, issued)
+}
+
+// recordSpans replaces the tracer with one recording the spans, until the end
+// of the test, which mustn't run in parallel with others
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	prev := tracer
+	tracer = tp.Tracer("test")
+
+	t.Cleanup(func() { tracer = prev })
+
+	return recorder
+}
+
+// endedSpans returns the spans recorded, by name
+func endedSpans(recorder *tracetest.SpanRecorder) map[string]sdktrace.ReadOnlySpan {
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	return spans
+}
+
+// spanAttr returns the value of the attribute of the span
+func spanAttr(span sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+
+	return attribute.Value{}
+}
+
+//nolint:paralleltest
+func TestSendMailSpans(t *testing.T) {
+	recorder := recordSpans(t)
+
+	u := startFakeUpstream(t, "AUTH PLAIN")
+	u.setReply("AUTH", "235 ok")
+	u.setReply("RCPT TO:<CAROL@EXAMPLE.COM>", "550 5.1.1 User unknown")
+
+	cfg := &config{remoteUser: "alice", remotePass: "secret"}
+	out := &outbound{Host: u.addr, Sender: "bob@example.com", Recipients: []string{"alice@example.com", "carol@example.com"}}
+
+	var rcptErrs recipientErrors
+	require.ErrorAs(t, sendMail(cfg, out, []byte("hello\r\n")), &rcptErrs)
+
+	spans := endedSpans(recorder)
+	require.Len(t, spans, 5)
+
+	send := spans["upstream.send"]
+	require.NotNil(t, send)
+	assert.Equal(t, "127.0.0.1", spanAttr(send, "server.address").AsString())
+	assert.False(t, spanAttr(send, "smtp.connection.reused").AsBool())
+
+	// each step of the conversation is a child of the delivery
+	for _, name := range []string{"upstream.dial", "upstream.ehlo", "upstream.auth", "upstream.data"} {
+		require.Contains(t, spans, name)
+		assert.Equal(t, send.SpanContext().SpanID(), spans[name].Parent().SpanID(), name)
+	}
+
+	assert.Equal(t, codes.Unset, spans["upstream.auth"].Status().Code)
+	assert.Equal(t, "plain", spanAttr(spans["upstream.auth"], "smtp.auth.mechanism").AsString())
+
+	data := spans["upstream.data"]
+	assert.Equal(t, []string{"alice@example.com", "carol@example.com"}, spanAttr(data, "smtp.recipients").AsStringSlice())
+	assert.Equal(t, int64(7), spanAttr(data, "smtp.data.size").AsInt64())
+	assert.Equal(t, codes.Error, data.Status().Code)
+
+	// failed steps end the delivery
+	recorder.Reset()
+
+	u = startFakeUpstream(t)
+	u.setReply("EHLO", "554 go away")
+	u.setReply("HELO", "554 go away")
+
+	out.Host = u.addr
+	require.Error(t, sendMail(&config{}, out, []byte("hello\r\n")))
+
+	spans = endedSpans(recorder)
+	assert.NotContains(t, spans, "upstream.data")
+	require.Contains(t, spans, "upstream.ehlo")
+	assert.Equal(t, codes.Error, spans["upstream.ehlo"].Status().Code)
+	assert.Equal(t, int64(554), spanAttr(spans["upstream.ehlo"], "smtp.response.status_code").AsInt64())
+	assert.Equal(t, codes.Error, spans["upstream.send"].Status().Code)
+}
@@ -0,0 +1,84 @@
+package relay
+
+import (
+	"context"
+	"log/slog"
+	"net/mail"
+	"strings"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// verifyAddress answers VRFY if verify_commands is set: the address is
+// checked as a recipient, and its mailbox returned if the upstream host it's
+// routed to accepted it in the recipient callout. Addresses which can't be
+// verified are replied 252, as with verify_commands unset.
+func (r *relay) verifyAddress(ctx context.Context, peer smtpd.Peer, query string) (string, error) {
+	cfg := r.config(ctx)
+
+	addr, ok := queryAddress(cfg, query)
+	if !ok {
+		return "", nil
+	}
+
+	if err := r.checkRecipient(ctx, peer, addr); err != nil {
+		return "", err
+	}
+
+	target, ok := r.calloutTarget(cfg, peer, addr)
+	if !ok || !r.shared.callout.verified(r.router.match(target), target) {
+		return "", nil
+	}
+
+	slog.InfoContext(ctx, "verified address", slog.String("component", "vrfy"),
+		slog.String("address", addr))
+
+	return "<" + addr + ">", nil
+}
+
+// expandList answers EXPN if verify_commands is set, with the addresses the
+// alias is delivered to. Other addresses are replied 252, as with
+// verify_commands unset.
+func (r *relay) expandList(ctx context.Context, peer smtpd.Peer, query string) ([]string, error) {
+	cfg := r.config(ctx)
+
+	addr, ok := queryAddress(cfg, query)
+	if !ok {
+		return nil, nil
+	}
+
+	if _, ok := cfg.aliases.lookup(strings.ToLower(addr)); !ok {
+		return nil, nil
+	}
+
+	if err := r.checkRecipient(ctx, peer, addr); err != nil {
+		return nil, err
+	}
+
+	targets := cfg.aliases.expand(addr)
+
+	slog.InfoContext(ctx, "expanded alias", slog.String("component", "vrfy"),
+		slog.String("address", addr), slog.Any("targets", targets))
+
+	mailboxes := make([]string, 0, len(targets))
+	for _, target := range targets {
+		mailboxes = append(mailboxes, "<"+target+">")
+	}
+
+	return mailboxes, nil
+}
+
+// queryAddress returns the address queried with VRFY or EXPN, if
+// verify_commands is set and the query is an address rather than a user name
+func queryAddress(cfg *config, query string) (string, bool) {
+	if !cfg.verifyCommands {
+		return "", false
+	}
+
+	addr, err := mail.ParseAddress(query)
+	if err != nil {
+		return "", false
+	}
+
+	return addr.Address, true
+}
@@ -0,0 +1,65 @@
+package relay
+
+import (
+	"context"
+	"net/smtp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyCommands(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	u := startFakeUpstream(t)
+	u.setReply("RCPT TO:<DAVE@", "550 5.1.1 no such user")
+
+	a, err := loadAliasesFile(writeTestFile(t, "aliases", `
+info@example.com alice@example.org, bob@example.org
+`))
+	require.NoError(t, err)
+
+	addr := startRelayConfig(ctx, t, "", &config{
+		remoteHost:       u.addr,
+		rcptCallout:      true,
+		aliases:          a,
+		verifyCommands:   true,
+		deniedRecipients: "^mallory@",
+	})
+
+	c, err := smtp.Dial(addr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = c.Close() })
+
+	require.NoError(t, c.Hello("localhost"))
+
+	for _, tc := range []struct {
+		cmd  string
+		code int
+		msg  string
+	}{
+		{"VRFY <bob@example.com>", 250, "2.1.5 <bob@example.com>"},
+		{"VRFY dave@example.com", 550, "5.1.1 Recipient address rejected by upstream"},
+		{"VRFY mallory@example.com", 451, "4.7.1 Denied recipient address"},
+		{"VRFY bob", 252, "2.0.0 Cannot VRFY user, but will accept message and attempt delivery"},
+		// aliases expanding to several addresses aren't verified
+		{"VRFY info@example.com", 252, "2.0.0 Cannot VRFY user, but will accept message and attempt delivery"},
+		{"EXPN info@example.com", 250, "2.1.5 <alice@example.org>\n2.1.5 <bob@example.org>"},
+		{"EXPN bob@example.com", 252, "2.0.0 Cannot EXPN list, but will accept message and attempt delivery"},
+	} {
+		id, err := c.Text.Cmd("%s", tc.cmd)
+		require.NoError(t, err)
+
+		c.Text.StartResponse(id)
+		code, msg, _ := c.Text.ReadResponse(tc.code)
+		c.Text.EndResponse(id)
+
+		assert.Equal(t, tc.code, code, tc.cmd)
+		assert.Equal(t, tc.msg, msg, tc.cmd)
+	}
+}
@@ -0,0 +1,185 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// Webhook formats
+const (
+	webhookFormatRaw  = "raw"  // the message as is, with the envelope in headers
+	webhookFormatJSON = "json" // the envelope, headers and body as JSON
+)
+
+// Webhook request headers
+const (
+	webhookSenderHeader     = "X-Smtprelay-Sender"
+	webhookRecipientsHeader = "X-Smtprelay-Recipients"
+	webhookTimestampHeader  = "X-Smtprelay-Timestamp"
+	webhookSignatureHeader  = "X-Smtprelay-Signature"
+)
+
+// webhookMessage is the body of JSON webhook requests
+type webhookMessage struct {
+	Sender     string              `json:"sender"`
+	Recipients []string            `json:"recipients"`
+	SMTPUTF8   bool                `json:"smtputf8,omitempty"`
+	Headers    map[string][]string `json:"headers"`
+	Body       string              `json:"body"`
+}
+
+// webhook delivers messages with HTTP POST requests to an endpoint, for
+// backends which don't speak SMTP. Requests are retried on network errors,
+// 408, 429 and 5xx responses, and other responses than 2xx reject the
+// message.
+type webhook struct {
+	url     string
+	format  string
+	secret  string
+	retries int
+	client  *http.Client
+
+	// retryDelay is the delay before the first retry, doubled on each
+	// attempt - overridable for tests
+	retryDelay time.Duration
+}
+
+// newWebhook returns nil unless the delivery mode is webhook
+func newWebhook(cfg *config) (*webhook, error) {
+	if cfg.delivery != deliveryWebhook {
+		return nil, nil
+	}
+
+	if cfg.webhookURL == "" {
+		return nil, fmt.Errorf("delivery %s requires webhook_url to be set", deliveryWebhook)
+	}
+
+	switch cfg.webhookFormat {
+	case "", webhookFormatRaw, webhookFormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown webhook_format %q", cfg.webhookFormat)
+	}
+
+	return &webhook{
+		url:        cfg.webhookURL,
+		format:     cfg.webhookFormat,
+		secret:     cfg.webhookSecret,
+		retries:    cfg.webhookRetries,
+		client:     &http.Client{Timeout: cfg.webhookTimeout},
+		retryDelay: time.Second,
+	}, nil
+}
+
+// send posts the message to the endpoint
+func (w *webhook) send(out *outbound, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("data: %w", err)
+	}
+
+	contentType := "message/rfc822"
+
+	if w.format == webhookFormatJSON {
+		if data, err = webhookJSON(out, data); err != nil {
+			return &smtpd.Error{Code: 554, EnhancedCode: "5.6.0", Msg: "Malformed message: " + err.Error()}
+		}
+
+		contentType = "application/json"
+	}
+
+	delay := w.retryDelay
+
+	for attempt := 0; ; attempt++ {
+		err = w.post(out, contentType, data)
+		if err == nil || !isTemporaryErr(err) || attempt >= w.retries {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post sends a single request. Failures which may succeed on retry are
+// temporary errors, and the other ones permanent SMTP errors.
+func (w *webhook) post(out *outbound, contentType string, data []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(webhookSenderHeader, out.Sender)
+	req.Header.Set(webhookRecipientsHeader, strings.Join(out.Recipients, ","))
+
+	if w.secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(w.secret, timestamp, data))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// the response is drained so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return fmt.Errorf("webhook: unexpected status %q", resp.Status)
+	default:
+		return &smtpd.Error{Code: 554, EnhancedCode: "5.3.0", Msg: "Message rejected by webhook: " + resp.Status}
+	}
+}
+
+// webhookSignature returns the hex HMAC-SHA256 of the timestamp and body,
+// separated by a dot, so receivers can reject replayed requests
+func webhookSignature(secret, timestamp string, data []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(data)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookJSON returns the JSON body of the message. The body of the message
+// must be valid UTF-8, as invalid sequences are replaced.
+func webhookJSON(out *outbound, data []byte) ([]byte, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	msgBody, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(webhookMessage{
+		Sender:     out.Sender,
+		Recipients: out.Recipients,
+		SMTPUTF8:   out.SMTPUTF8,
+		Headers:    msg.Header,
+		Body:       string(msgBody),
+	})
+}
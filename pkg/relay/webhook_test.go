@@ -0,0 +1,162 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookRequest is a request received by the test endpoint
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// startWebhook starts an endpoint replying with the given statuses in turn,
+// then 200, and recording the requests
+func startWebhook(t *testing.T, statuses ...int) (*httptest.Server, func() []webhookRequest) {
+	t.Helper()
+
+	var (
+		mu       sync.Mutex
+		requests []webhookRequest
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		requests = append(requests, webhookRequest{header: r.Header, body: body})
+		status := http.StatusOK
+		if len(requests) <= len(statuses) {
+			status = statuses[len(requests)-1]
+		}
+		mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]webhookRequest{}, requests...)
+	}
+}
+
+func testWebhook(t *testing.T, url, format string) *webhook {
+	t.Helper()
+
+	w, err := newWebhook(&config{
+		delivery:       deliveryWebhook,
+		webhookURL:     url,
+		webhookFormat:  format,
+		webhookSecret:  "secret",
+		webhookRetries: 2,
+	})
+	require.NoError(t, err)
+
+	w.retryDelay = 0
+
+	return w
+}
+
+func TestNewWebhook(t *testing.T) {
+	t.Parallel()
+
+	w, err := newWebhook(&config{delivery: deliverySmarthost, webhookURL: "http://example.com"})
+	require.NoError(t, err)
+	assert.Nil(t, w)
+
+	_, err = newWebhook(&config{delivery: deliveryWebhook})
+	require.Error(t, err)
+
+	_, err = newWebhook(&config{delivery: deliveryWebhook, webhookURL: "http://example.com", webhookFormat: "xml"})
+	require.Error(t, err)
+}
+
+func TestWebhookRaw(t *testing.T) {
+	t.Parallel()
+
+	srv, requests := startWebhook(t)
+	cfg := &config{webhook: testWebhook(t, srv.URL, webhookFormatRaw)}
+
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+	require.NoError(t, sendMail(cfg, testOutbound, data))
+
+	reqs := requests()
+	require.Len(t, reqs, 1)
+
+	h := reqs[0].header
+	assert.Equal(t, data, reqs[0].body)
+	assert.Equal(t, "message/rfc822", h.Get("Content-Type"))
+	assert.Equal(t, testOutbound.Sender, h.Get(webhookSenderHeader))
+	assert.Equal(t, "sha256="+webhookSignature("secret", h.Get(webhookTimestampHeader), data),
+		h.Get(webhookSignatureHeader))
+}
+
+func TestWebhookJSON(t *testing.T) {
+	t.Parallel()
+
+	srv, requests := startWebhook(t)
+	cfg := &config{webhook: testWebhook(t, srv.URL, webhookFormatJSON)}
+
+	out := &outbound{Sender: "bob@example.com", Recipients: []string{"alice@example.com", "carol@example.com"}}
+	require.NoError(t, sendMail(cfg, out, []byte("Subject: test\r\nX-Foo: a\r\nX-Foo: b\r\n\r\nhello\r\n")))
+
+	reqs := requests()
+	require.Len(t, reqs, 1)
+	assert.Equal(t, "application/json", reqs[0].header.Get("Content-Type"))
+
+	var msg webhookMessage
+	require.NoError(t, json.Unmarshal(reqs[0].body, &msg))
+	assert.Equal(t, webhookMessage{
+		Sender:     "bob@example.com",
+		Recipients: []string{"alice@example.com", "carol@example.com"},
+		Headers:    map[string][]string{"Subject": {"test"}, "X-Foo": {"a", "b"}},
+		Body:       "hello\r\n",
+	}, msg)
+
+	// malformed messages are rejected
+	err := sendMail(cfg, out, []byte("not a header\r\n"))
+	require.Error(t, err)
+	assert.False(t, isTemporaryErr(err))
+}
+
+func TestWebhookRetry(t *testing.T) {
+	t.Parallel()
+
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+
+	srv, requests := startWebhook(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	w := testWebhook(t, srv.URL, webhookFormatRaw)
+
+	require.NoError(t, w.send(testOutbound, bytes.NewReader(data)))
+	assert.Len(t, requests(), 3)
+
+	// retries are exhausted
+	srv, requests = startWebhook(t, http.StatusInternalServerError, http.StatusBadGateway, http.StatusInternalServerError)
+	w = testWebhook(t, srv.URL, webhookFormatRaw)
+
+	err := w.send(testOutbound, bytes.NewReader(data))
+	require.Error(t, err)
+	assert.True(t, isTemporaryErr(err))
+	assert.Len(t, requests(), 3)
+
+	// client errors aren't retried
+	srv, requests = startWebhook(t, http.StatusBadRequest)
+	w = testWebhook(t, srv.URL, webhookFormatRaw)
+
+	err = w.send(testOutbound, bytes.NewReader(data))
+	require.Error(t, err)
+	assert.False(t, isTemporaryErr(err))
+	assert.Len(t, requests(), 1)
+}
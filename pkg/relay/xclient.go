@@ -0,0 +1,199 @@
+package relay
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+)
+
+// Commands forwarding the client of the messages to the upstream, selected
+// with remote_xclient
+const (
+	forwardXClient  = "xclient"  // XCLIENT: the upstream acts as if the client connected to it
+	forwardXForward = "xforward" // XFORWARD: the upstream only logs the client
+)
+
+// unavailable is the value of the XCLIENT and XFORWARD attributes which are
+// unknown
+const unavailable = "[UNAVAILABLE]"
+
+// clientInfo is the client a message was received from, as forwarded to the
+// upstream. It's kept with the queued messages, so their retries forward it
+// too.
+type clientInfo struct {
+	Addr  string `json:"addr,omitempty"`
+	Port  int    `json:"port,omitempty"`
+	Name  string `json:"name,omitempty"` // from the FCrDNS checks, if enabled
+	Helo  string `json:"helo,omitempty"`
+	Login string `json:"login,omitempty"`
+	Proto string `json:"proto,omitempty"`
+}
+
+// parseForwardMode validates remote_xclient
+func parseForwardMode(mode string) (string, error) {
+	mode = strings.ToLower(mode)
+
+	switch mode {
+	case "", forwardXClient, forwardXForward:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown command %q, expected %s or %s", mode, forwardXClient, forwardXForward)
+	}
+}
+
+// newClientInfo describes the peer, name being its verified host name if
+// known
+func newClientInfo(peer smtpd.Peer, name string) *clientInfo {
+	ci := &clientInfo{
+		Name:  name,
+		Helo:  peer.HeloName,
+		Login: peer.Username,
+		Proto: string(peer.Protocol),
+	}
+
+	if addr, ok := peer.Addr.(*net.TCPAddr); ok {
+		ci.Addr, ci.Port = addr.IP.String(), addr.Port
+	}
+
+	return ci
+}
+
+// clientInfo describes the peer, with its host name if the FCrDNS checks
+// verified it
+func (r *relay) clientInfo(ctx context.Context, peer smtpd.Peer) *clientInfo {
+	name := ""
+	if r.fcrdns != nil {
+		if res := r.fcrdns.result(ctx, peer); res != nil {
+			name = strings.TrimSuffix(res.name, ".")
+		}
+	}
+
+	return newClientInfo(peer, name)
+}
+
+// command returns the XCLIENT or XFORWARD command forwarding the client,
+// with the attributes the upstream supports, given as the parameters of its
+// extension. All of them are sent, the unknown ones as unavailable, so none
+// is left over from the previous message of the connection.
+func (ci *clientInfo) command(mode, supported string) string {
+	verb := strings.ToUpper(mode)
+
+	// only XCLIENT changes the identity the upstream authorizes
+	names := []string{"NAME", "ADDR", "PORT", "PROTO", "HELO"}
+	if mode == forwardXClient {
+		names = append(names, "LOGIN")
+	}
+
+	advertised := map[string]bool{}
+	for _, name := range strings.Fields(strings.ToUpper(supported)) {
+		advertised[name] = true
+	}
+
+	line := verb
+
+	for _, name := range names {
+		if !advertised[name] {
+			continue
+		}
+
+		line += " " + name + "=" + xtextEncode(cmp.Or(ci.attr(name), unavailable))
+	}
+
+	return line
+}
+
+// attr returns the value of the XCLIENT or XFORWARD attribute, empty if it's
+// unknown
+func (ci *clientInfo) attr(name string) string {
+	switch name {
+	case "NAME":
+		return ci.Name
+	case "ADDR":
+		// IPv6 addresses are tagged like in address literals
+		if ip := net.ParseIP(ci.Addr); ip != nil && ip.To4() == nil {
+			return "IPV6:" + ci.Addr
+		}
+
+		return ci.Addr
+	case "PORT":
+		if ci.Port == 0 {
+			return ""
+		}
+
+		return strconv.Itoa(ci.Port)
+	case "PROTO":
+		// LMTP isn't one of the protocols of the upstream
+		if ci.Proto == string(smtpd.SMTP) {
+			return ci.Proto
+		}
+
+		if ci.Proto == "" {
+			return ""
+		}
+
+		return string(smtpd.ESMTP)
+	case "HELO":
+		return ci.Helo
+	case "LOGIN":
+		return ci.Login
+	default:
+		return ""
+	}
+}
+
+// xtextEncode encodes s as xtext (RFC 3461): the characters outside of the
+// printable ASCII range, + and = as +XX
+func xtextEncode(s string) string {
+	var b strings.Builder
+
+	for i := range len(s) {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+			continue
+		}
+
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+// forwardClient sends the client of the message to the upstream, with the
+// command the connection was set up with, if the upstream advertises it.
+// XCLIENT starts a new session, which is greeted again. If the upstream
+// rejects the command, the message is sent without it.
+func (uc *upstreamConn) forwardClient(out *outbound) error {
+	if uc.forward == "" || out.Client == nil {
+		return nil
+	}
+
+	ok, supported := uc.c.Extension(uc.forward)
+	if !ok {
+		return nil
+	}
+
+	err := uc.cmd(out.Client.command(uc.forward, supported))
+	if uc.broken {
+		return err
+	}
+
+	if err != nil {
+		slog.Warn("upstream rejected the client forwarding", slog.String("component", "upstream"),
+			slog.String("host", out.Host), slog.Any("error", err))
+
+		return nil
+	}
+
+	if uc.forward == forwardXClient {
+		return uc.cmd("EHLO " + uc.localName)
+	}
+
+	return nil
+}
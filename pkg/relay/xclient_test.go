@@ -0,0 +1,166 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"testing"
+
+	"github.com/evidentiq/smtprelay/v2/internal/smtpd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientInfoCommand(t *testing.T) {
+	t.Parallel()
+
+	ci := newClientInfo(smtpd.Peer{
+		Addr:     &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242},
+		HeloName: "client.example.com",
+		Username: "bob+relay",
+		Protocol: smtpd.ESMTP,
+	}, "client.example.com")
+
+	assert.Equal(t,
+		"XCLIENT NAME=client.example.com ADDR=192.0.2.1 PORT=4242 PROTO=ESMTP HELO=client.example.com LOGIN=bob+2Brelay",
+		ci.command(forwardXClient, "NAME ADDR PORT PROTO HELO LOGIN DESTADDR"))
+
+	// only the attributes supported by the upstream are sent, and XFORWARD
+	// has no login
+	assert.Equal(t, "XFORWARD ADDR=192.0.2.1 HELO=client.example.com",
+		ci.command(forwardXForward, "ADDR HELO IDENT"))
+
+	// the unknown attributes are unavailable
+	ci = newClientInfo(smtpd.Peer{
+		Addr:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 25},
+		Protocol: smtpd.LMTP,
+	}, "")
+
+	assert.Equal(t,
+		"XCLIENT NAME=[UNAVAILABLE] ADDR=IPV6:2001:db8::1 PROTO=ESMTP HELO=[UNAVAILABLE] LOGIN=[UNAVAILABLE]",
+		ci.command(forwardXClient, "name addr proto helo login"))
+}
+
+func TestParseForwardMode(t *testing.T) {
+	t.Parallel()
+
+	for mode, expected := range map[string]string{"": "", "XCLIENT": forwardXClient, "xforward": forwardXForward} {
+		m, err := parseForwardMode(mode)
+		require.NoError(t, err)
+		assert.Equal(t, expected, m)
+	}
+
+	_, err := parseForwardMode("proxy")
+	require.Error(t, err)
+}
+
+func TestForwardClient(t *testing.T) {
+	t.Parallel()
+
+	client := &clientInfo{Addr: "192.0.2.1", Port: 4242, Helo: "client.example.com", Login: "bob", Proto: "ESMTP"}
+	data := []byte("Subject: test\r\n\r\nhello\r\n")
+
+	t.Run("xclient", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t, "XCLIENT ADDR HELO LOGIN")
+		u.setReply("XCLIENT", "220 fake ESMTP")
+
+		cfg := &config{hostName: "relay.example.com", remoteXClient: forwardXClient}
+		require.NoError(t, cfg.setup())
+
+		out := &outbound{Host: u.addr, Sender: "bob@example.com", Recipients: []string{"alice@example.com"}, Client: client}
+		require.NoError(t, sendMail(cfg, out, data))
+
+		// the new session is greeted again
+		commands, msgs := u.received()
+		assert.Equal(t, []string{
+			"EHLO relay.example.com",
+			"XCLIENT ADDR=192.0.2.1 HELO=client.example.com LOGIN=bob",
+			"EHLO relay.example.com",
+			"MAIL FROM:<bob@example.com>",
+			"RCPT TO:<alice@example.com>",
+			"DATA",
+			"QUIT",
+		}, commands)
+		assert.Len(t, msgs, 1)
+	})
+
+	t.Run("xforward", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t, "XFORWARD NAME ADDR PORT PROTO HELO SOURCE")
+
+		cfg := &config{hostName: "relay.example.com", remoteXClient: forwardXForward}
+		require.NoError(t, cfg.setup())
+
+		out := &outbound{Host: u.addr, Sender: "bob@example.com", Recipients: []string{"alice@example.com"}, Client: client}
+		require.NoError(t, sendMail(cfg, out, data))
+
+		commands, _ := u.received()
+		assert.Equal(t, []string{
+			"EHLO relay.example.com",
+			"XFORWARD NAME=[UNAVAILABLE] ADDR=192.0.2.1 PORT=4242 PROTO=ESMTP HELO=client.example.com",
+			"MAIL FROM:<bob@example.com>",
+			"RCPT TO:<alice@example.com>",
+			"DATA",
+			"QUIT",
+		}, commands)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		t.Parallel()
+
+		u := startFakeUpstream(t, "XCLIENT ADDR")
+		u.setReply("XCLIENT", "550 5.7.0 insufficient authorization")
+
+		cfg := &config{hostName: "relay.example.com", remoteXClient: forwardXClient}
+		require.NoError(t, cfg.setup())
+
+		// the message is delivered without forwarding the client
+		out := &outbound{Host: u.addr, Sender: "bob@example.com", Recipients: []string{"alice@example.com"}, Client: client}
+		require.NoError(t, sendMail(cfg, out, data))
+
+		_, msgs := u.received()
+		assert.Len(t, msgs, 1)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &config{hostName: "relay.example.com", remoteXClient: forwardXClient}
+		require.NoError(t, cfg.setup())
+
+		// neither the upstreams not advertising the command nor MX hosts
+		// are sent it
+		for ext, direct := range map[string]bool{"XFORWARD ADDR": false, "XCLIENT ADDR": true} {
+			u := startFakeUpstream(t, ext)
+
+			out := &outbound{
+				Host: u.addr, Sender: "bob@example.com", Recipients: []string{"alice@example.com"},
+				Client: client, direct: direct,
+			}
+			require.NoError(t, sendMail(cfg, out, data))
+
+			commands, _ := u.received()
+			assert.NotContains(t, commands, "XCLIENT ADDR=192.0.2.1", ext)
+			assert.Contains(t, commands, "MAIL FROM:<bob@example.com>", ext)
+		}
+	})
+}
+
+func TestForwardClientRelay(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	u := startFakeUpstream(t, "SMTPUTF8", "8BITMIME", "XFORWARD ADDR HELO")
+	addr := startRelayConfig(ctx, t, "", &config{remoteHost: u.addr, remoteXClient: forwardXForward})
+
+	require.NoError(t, smtp.SendMail(addr, nil, "bob@example.com", []string{"alice@example.com"},
+		[]byte("Subject: test\r\n\r\nhello\r\n")))
+
+	commands, _ := u.received()
+	assert.Contains(t, commands, "XFORWARD ADDR=127.0.0.1 HELO=localhost")
+}